@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// adminClient returns an Admin client for the server at addr. A server run
+// with --admin_listen serves Admin elsewhere, as its GetServerInfo reports;
+// otherwise Admin shares the KVS connection unless there is an admin token
+// to send.
+func (c *routedClient) adminClient(addr string) (kvpb.AdminClient, error) {
+	cli, err := c.ensureConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.connMu.Lock()
+	conn := c.adminConns[addr]
+	c.connMu.Unlock()
+	if conn != nil {
+		return kvpb.NewAdminClient(conn), nil
+	}
+
+	target := addr
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	info, err := cli.GetServerInfo(ctx, &kvpb.GetServerInfoRequest{})
+	cancel()
+	switch {
+	case err == nil:
+		target = resolveAdminAddr(addr, info.AdminAddr)
+	case status.Code(err) != codes.Unimplemented:
+		// Servers too old to report an admin address serve it beside KVS.
+		return nil, err
+	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if conn = c.conns[addr]; target != addr || c.adminToken != "" {
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if c.adminToken != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(c.adminToken)))
+		}
+		if c.traceID != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(traceIDHeader(c.traceID)))
+		}
+		if conn, err = grpc.NewClient(target, opts...); err != nil {
+			return nil, err
+		}
+	}
+	c.adminConns[addr] = conn
+	return kvpb.NewAdminClient(conn), nil
+}
+
+// dropAdminConnLocked forgets the Admin connection for addr, closing it
+// unless it is the KVS connection.
+func (c *routedClient) dropAdminConnLocked(addr string) {
+	if conn := c.adminConns[addr]; conn != nil && conn != c.conns[addr] {
+		_ = conn.Close()
+	}
+	delete(c.adminConns, addr)
+}
+
+// resolveAdminAddr returns where the server at apiAddr serves Admin, given
+// the admin_addr its GetServerInfo reported: apiAddr itself if that is
+// empty, and otherwise the reported address with apiAddr's host in place of
+// an unspecified one such as 0.0.0.0.
+func resolveAdminAddr(apiAddr, reported string) string {
+	if reported == "" {
+		return apiAddr
+	}
+	host, port, err := net.SplitHostPort(reported)
+	if err != nil {
+		return reported
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if apiHost, _, err := net.SplitHostPort(apiAddr); err == nil {
+			return net.JoinHostPort(apiHost, port)
+		}
+	}
+	return reported
+}
+
+// printStats prints one Stats line for every replica.
+func printStats(c *routedClient, w io.Writer) {
+	if !c.supports(featureAdminStats) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "STATS unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				fmt.Fprintf(w, "STATS partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := admin.Stats(ctx, &kvpb.StatsRequest{})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "STATS partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			fmt.Fprintf(w, "STATS partition=%d replica=%d addr=%s role=%s type=%s commit=%d applied=%d live_keys=%d tombstones=%d gc_horizon=%d purged=%d snapshot=%d log_start=%d compaction_queue=%d\n",
+				resp.PartitionId, resp.ReplicaId, addr, resp.Role, resp.MemberType, resp.CommitIndex, resp.LastApplied,
+				resp.LiveKeys, resp.Tombstones, resp.GcHorizon, resp.TombstonesPurged,
+				resp.SnapshotIndex, resp.LogStart, resp.CompactionQueueDepth)
+		}
+	}
+}
+
+// compactAll asks every replica to snapshot and compact its raft log.
+func compactAll(c *routedClient, w io.Writer) {
+	if !c.supports(featureCompaction) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "COMPACT unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				fmt.Fprintf(w, "COMPACT partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := admin.Compact(ctx, &kvpb.CompactRequest{})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "COMPACT partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			fmt.Fprintf(w, "COMPACT partition=%d addr=%s queued=%v\n", partition, addr, resp.Queued)
+		}
+	}
+}
+
+// backupAll asks every replica to write a backup of its applied state.
+func backupAll(c *routedClient, w io.Writer) {
+	if !c.supports(featureBackup) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "BACKUP unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				fmt.Fprintf(w, "BACKUP partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := admin.Backup(ctx, &kvpb.BackupRequest{})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "BACKUP partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			fmt.Fprintf(w, "BACKUP partition=%d addr=%s path=%s index=%d bytes=%d\n", partition, addr, resp.Path, resp.LastIndex, resp.Bytes)
+		}
+	}
+}
+
+// scrubAll prints what every replica's last scrub pass found, starting a
+// pass on each first if start is set.
+func scrubAll(c *routedClient, w io.Writer, start bool) {
+	if !c.supports(featureScrub) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "SCRUB unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				fmt.Fprintf(w, "SCRUB partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := admin.Scrub(ctx, &kvpb.ScrubRequest{Start: start})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "SCRUB partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			last := "never"
+			if resp.LastFinishedUnixNanos != 0 {
+				last = time.Unix(0, resp.LastFinishedUnixNanos).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "SCRUB partition=%d addr=%s started=%v running=%v last_finished=%s snapshot_checked=%v log_entries=%d values=%d problems=%d\n",
+				partition, addr, resp.Started, resp.Running, last, resp.SnapshotChecked, resp.LogEntriesChecked, resp.ValuesChecked, resp.ProblemCount)
+			for _, p := range resp.Problems {
+				fmt.Fprintf(w, "SCRUB partition=%d addr=%s problem=%q\n", partition, addr, p)
+			}
+		}
+	}
+}
+
+// printNamespaceUsage prints per-namespace usage and quotas for each
+// partition, as reported by the first replica that answers, trying the
+// likely leader first since followers can lag. Quotas are
+// enforced by each partition on its share of a namespace. Request and byte
+// counts are metered by whichever replica served each request, so they are
+// summed over every replica that answers; window_* fields cover each
+// replica's last complete metering window.
+func printNamespaceUsage(c *routedClient, w io.Writer) {
+	if !c.supports(featureQuotas) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "USAGE unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		var resp *kvpb.NamespaceUsageReply
+		var lastErr error
+		metered := make(map[string]*kvpb.NamespaceUsage)
+		for _, idx := range c.getReplicaOrder(partition) {
+			addr := addrs[idx]
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			r, err := admin.NamespaceUsage(ctx, &kvpb.NamespaceUsageRequest{})
+			cancel()
+			if err != nil {
+				lastErr = err
+				c.resetConn(addr)
+				continue
+			}
+			if resp == nil {
+				resp = r
+			}
+			for _, ns := range r.Namespaces {
+				m, ok := metered[ns.Namespace]
+				if !ok {
+					m = &kvpb.NamespaceUsage{}
+					metered[ns.Namespace] = m
+				}
+				m.Requests += ns.Requests
+				m.BytesRead += ns.BytesRead
+				m.BytesWritten += ns.BytesWritten
+				m.WindowRequests += ns.WindowRequests
+				m.WindowBytesRead += ns.WindowBytesRead
+				m.WindowBytesWritten += ns.WindowBytesWritten
+			}
+		}
+		if resp == nil {
+			fmt.Fprintf(w, "USAGE partition=%d error=%v\n", partition, lastErr)
+			continue
+		}
+		storage := make(map[string]*kvpb.NamespaceUsage, len(resp.Namespaces))
+		for _, ns := range resp.Namespaces {
+			storage[ns.Namespace] = ns
+		}
+		names := make([]string, 0, len(metered))
+		for ns := range metered {
+			names = append(names, ns)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ns, m := storage[name], metered[name]
+			if ns == nil {
+				ns = &kvpb.NamespaceUsage{}
+			}
+			fmt.Fprintf(w, "USAGE partition=%d namespace=%q keys=%d bytes=%d max_keys=%d max_bytes=%d requests=%d bytes_read=%d bytes_written=%d window_requests=%d window_bytes_read=%d window_bytes_written=%d\n",
+				partition, name, ns.Keys, ns.Bytes, ns.MaxKeys, ns.MaxBytes,
+				m.Requests, m.BytesRead, m.BytesWritten, m.WindowRequests, m.WindowBytesRead, m.WindowBytesWritten)
+		}
+	}
+}
+
+// printReplicationStatus prints each partition leader's view of its
+// followers.
+func printReplicationStatus(c *routedClient, w io.Writer) {
+	if !c.supports(featureReplication) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "REPLICATION unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		var resp *kvpb.ReplicationStatusReply
+		var lastErr error
+		for _, idx := range c.getReplicaOrder(partition) {
+			addr := addrs[idx]
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err = admin.ReplicationStatus(ctx, &kvpb.ReplicationStatusRequest{})
+			cancel()
+			if err == nil {
+				break
+			}
+			lastErr = err
+			if status.Code(err) != codes.FailedPrecondition {
+				c.resetConn(addr)
+			}
+		}
+		if resp == nil {
+			fmt.Fprintf(w, "REPLICATION partition=%d error=%v\n", partition, lastErr)
+			continue
+		}
+		fmt.Fprintf(w, "REPLICATION partition=%d leader=%d term=%d commit=%d last_log=%d\n",
+			partition, resp.LeaderReplicaId, resp.Term, resp.CommitIndex, resp.LastLogIndex)
+		now := time.Now()
+		for _, f := range resp.Followers {
+			contact := "never"
+			if f.LastContactUnixNanos != 0 {
+				contact = now.Sub(time.Unix(0, f.LastContactUnixNanos)).Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "  follower=%d type=%s match=%d applied=%d lag_entries=%d lag=%s last_contact=%s\n",
+				f.ReplicaId, f.MemberType, f.MatchIndex, f.AppliedIndex, f.LagEntries, time.Duration(f.LagMillis)*time.Millisecond, contact)
+		}
+	}
+}
+
+// transferLeadership asks partition's leader to hand leadership to replica
+// target and returns the CLI exit code.
+func transferLeadership(c *routedClient, w io.Writer, partition, target int) int {
+	if !c.supports(featureTransfer) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "TRANSFER unsupported by server (api_version=%d)\n", version)
+		return exitRPCError
+	}
+	var lastErr error
+	for _, idx := range c.getReplicaOrder(partition) {
+		addr := c.partitions[partition][idx]
+		admin, err := c.adminClient(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// The leader waits for the target to catch up and win an election.
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout+5*time.Second)
+		resp, err := admin.TransferLeadership(ctx, &kvpb.TransferLeadershipRequest{TargetReplicaId: uint32(target)})
+		cancel()
+		if err == nil {
+			fmt.Fprintf(w, "TRANSFER partition=%d leader=%d term=%d\n", partition, target, resp.Term)
+			return exitOK
+		}
+		lastErr = err
+		if _, ok := leaderHintFromError(err); !ok {
+			break
+		}
+	}
+	return rpcFailed(lastErr)
+}
+
+// printMirrorStatus prints every replica's view of cross-cluster mirroring.
+func printMirrorStatus(c *routedClient, w io.Writer) {
+	if !c.supports(featureMirror) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "MIRROR unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			admin, err := c.adminClient(addr)
+			if err != nil {
+				fmt.Fprintf(w, "MIRROR partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := admin.MirrorStatus(ctx, &kvpb.MirrorStatusRequest{})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "MIRROR partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			role := resp.Role
+			if role == "" {
+				role = "none"
+			}
+			fmt.Fprintf(w, "MIRROR partition=%d addr=%s role=%s shipped=%d lag_entries=%d rpo=%s source_seq=%d applied=%d conflicts=%d\n",
+				partition, addr, role, resp.ShippedIndex, resp.LagEntries, time.Duration(resp.RpoMillis)*time.Millisecond,
+				resp.SourceSeq, resp.ChangesApplied, resp.Conflicts)
+		}
+	}
+}
+
+// promoteMirror promotes every partition of a standby cluster and returns
+// the CLI exit code.
+func promoteMirror(c *routedClient, w io.Writer) int {
+	if !c.supports(featureMirror) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "PROMOTE unsupported by server (api_version=%d)\n", version)
+		return exitRPCError
+	}
+	code := exitOK
+	for partition, addrs := range c.partitions {
+		var resp *kvpb.PromoteMirrorReply
+		var lastErr error
+		for _, idx := range c.getReplicaOrder(partition) {
+			admin, err := c.adminClient(addrs[idx])
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err = admin.PromoteMirror(ctx, &kvpb.PromoteMirrorRequest{})
+			cancel()
+			if err == nil {
+				break
+			}
+			lastErr = err
+			if _, ok := leaderHintFromError(err); !ok {
+				break
+			}
+		}
+		if resp == nil {
+			fmt.Fprintf(w, "PROMOTE partition=%d error=%v\n", partition, lastErr)
+			code = exitRPCError
+			continue
+		}
+		fmt.Fprintf(w, "PROMOTE partition=%d source_seq=%d\n", partition, resp.SourceSeq)
+	}
+	return code
+}
+
+// drainReplica drains one replica of partition for maintenance and waits,
+// printing progress, until the server reports that it is safe to stop.
+func drainReplica(c *routedClient, w io.Writer, partition, replica int) int {
+	if !c.supports(featureDrain) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "DRAIN unsupported by server (api_version=%d)\n", version)
+		return exitRPCError
+	}
+	addr := c.partitions[partition][replica]
+	admin, err := c.adminClient(addr)
+	if err != nil {
+		return rpcFailed(err)
+	}
+	const poll = time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout+poll)
+		resp, err := admin.Drain(ctx, &kvpb.DrainRequest{WaitMillis: poll.Milliseconds()})
+		cancel()
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "DRAIN partition=%d replica=%d addr=%s role=%s in_flight=%d safe_to_stop=%t", partition, replica, addr, resp.Role, resp.InFlight, resp.SafeToStop)
+		if resp.Error != "" {
+			fmt.Fprintf(w, " error=%q", resp.Error)
+		}
+		fmt.Fprintln(w)
+		if resp.SafeToStop {
+			return exitOK
+		}
+	}
+}
+
+// printDeleted lists the soft-deleted keys in [start, end] that can still
+// be restored with client undelete, asking each partition's leader.
+func printDeleted(c *routedClient, w io.Writer, start, end string, limit int) int {
+	if !c.supports(featureUndelete) {
+		fmt.Fprintln(w, "TRASH unsupported: server does not keep deleted values; it needs --soft_delete_retention")
+		return exitRPCError
+	}
+	code := exitOK
+	for partition, addrs := range c.partitions {
+		var resp *kvpb.ScanDeletedReply
+		var lastErr error
+		for _, idx := range c.getReplicaOrder(partition) {
+			admin, err := c.adminClient(addrs[idx])
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err = admin.ScanDeleted(ctx, &kvpb.ScanDeletedRequest{StartKey: start, EndKey: end, Limit: uint32(limit)})
+			cancel()
+			if err == nil {
+				break
+			}
+			lastErr = err
+			if _, ok := leaderHintFromError(err); !ok {
+				break
+			}
+		}
+		if resp == nil {
+			fmt.Fprintf(w, "TRASH partition=%d error=%v\n", partition, lastErr)
+			code = exitRPCError
+			continue
+		}
+		for _, k := range resp.Keys {
+			fmt.Fprintf(w, "TRASH partition=%d key=%s deleted_at=%s seq=%d restorable_until=%s value_bytes=%d\n", partition, k.Key,
+				time.Unix(0, k.DeletedUnixNanos).UTC().Format(time.RFC3339), k.DeletedSeq,
+				time.Unix(0, k.UndeleteUntilUnixNanos).UTC().Format(time.RFC3339), k.ValueBytes)
+		}
+		if resp.Truncated {
+			fmt.Fprintf(w, "TRASH partition=%d truncated at %d keys\n", partition, len(resp.Keys))
+		}
+	}
+	return code
+}
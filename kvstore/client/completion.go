@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Shell completion: "client completion bash|zsh|fish" prints a script that
+// completes the client's commands and flags, the names --op takes and the
+// values of the flags that only take a few. The scripts are generated from the registered
+// flags, so new flags are completed without touching this file.
+
+// completionShells are the shells printCompletion writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionValues are the values offered after flags that take a fixed set.
+var completionValues = map[string][]string{
+	"op":             cliOps,
+	"value_type":     {"string", "int"},
+	"durability":     {"local", "quorum", "all"},
+	"priority":       {"high", "normal", "bulk"},
+	"merge_operator": {"append", "int-add", "json-set", "set-union"},
+	"content_type":   {"application/json", "application/x-protobuf", "application/octet-stream", "text/plain"},
+}
+
+// completionFiles are the flags that name a file or directory.
+var completionFiles = map[string]bool{
+	"script":        true,
+	"replay":        true,
+	"report_json":   true,
+	"profile_dir":   true,
+	"export":        true,
+	"ingest":        true,
+	"verify_export": true,
+	"route_cache":   true,
+	"file":          true,
+}
+
+// commandWords returns the words that may start a command line, and those
+// that may follow "admin".
+func commandWords() (top, admin []string) {
+	top = []string{"completion", "help"}
+	for _, sc := range subcommands {
+		if sub, ok := strings.CutPrefix(sc.name, "admin "); ok {
+			admin = append(admin, sub)
+		} else {
+			top = append(top, sc.name)
+		}
+	}
+	return append(top, "admin"), admin
+}
+
+// completionFlag is one flag as a completion script describes it.
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+}
+
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, isBool: ok && b.IsBoolFlag()})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+// completionSummary shortens a flag's usage to its first clause, without
+// the characters the shells' description syntax treats specially.
+func completionSummary(usage string) string {
+	if i := strings.IndexAny(usage, ";("); i > 0 {
+		usage = usage[:i]
+	}
+	usage = strings.NewReplacer("[", "", "]", "", ":", "", "'", "", `"`, "", "`", "", "$", "", "\\", "").Replace(usage)
+	return strings.TrimSpace(usage)
+}
+
+// printCompletion writes the completion script for the shell named in args
+// and returns the exit code.
+func printCompletion(w io.Writer, args []string) int {
+	if len(args) != 1 {
+		return usageError("completion requires one shell: %s", strings.Join(completionShells, "|"))
+	}
+	flags := completionFlags()
+	switch args[0] {
+	case "bash":
+		bashCompletion(w, flags)
+	case "zsh":
+		zshCompletion(w, flags)
+	case "fish":
+		fishCompletion(w, flags)
+	default:
+		return usageError("completion: unknown shell %q (expected %s)", args[0], strings.Join(completionShells, "|"))
+	}
+	return exitOK
+}
+
+func bashCompletion(w io.Writer, flags []completionFlag) {
+	top, admin := commandWords()
+	var names, fileFlags, valueFlags []string
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+		switch {
+		case f.isBool, completionValues[f.name] != nil:
+		case completionFiles[f.name]:
+			fileFlags = append(fileFlags, f.name)
+		default:
+			valueFlags = append(valueFlags, f.name)
+		}
+	}
+	fmt.Fprintln(w, "# bash completion for client; load with: source <(client completion bash)")
+	fmt.Fprintln(w, "_client() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	// Go flags may start with one dash or two.
+	fmt.Fprintln(w, `	prev="${prev#-}"; prev="${prev#-}"`)
+	fmt.Fprintln(w, `	case "$prev" in`)
+	for _, name := range sortedKeys(completionValues) {
+		fmt.Fprintf(w, "\t%s)\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", name, strings.Join(completionValues[name], " "))
+	}
+	fmt.Fprintf(w, "\t%s)\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(fileFlags, "|"))
+	fmt.Fprintf(w, "\t%s)\n\t\tCOMPREPLY=(); return ;;\n", strings.Join(valueFlags, "|"))
+	fmt.Fprintln(w, "\tcompletion)")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "\tadmin)")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", strings.Join(admin, " "))
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, `	if [[ $cur != -* ]]; then`)
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\")); return\n", strings.Join(top, " "))
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _client client")
+}
+
+func zshCompletion(w io.Writer, flags []completionFlag) {
+	top, admin := commandWords()
+	fmt.Fprintln(w, "#compdef client")
+	fmt.Fprintln(w, "# zsh completion for client; load with: source <(client completion zsh)")
+	fmt.Fprintln(w, "_client() {")
+	fmt.Fprintln(w, "\t_arguments \\")
+	for _, f := range flags {
+		spec := fmt.Sprintf("--%s[%s]", f.name, completionSummary(f.usage))
+		switch {
+		case f.isBool:
+		case completionValues[f.name] != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(completionValues[f.name], " "))
+		case completionFiles[f.name]:
+			spec += fmt.Sprintf(":%s:_files", f.name)
+		default:
+			spec += fmt.Sprintf(":%s: ", f.name)
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "\t\t'1:command:(%s)' \\\n", strings.Join(top, " "))
+	fmt.Fprintf(w, "\t\t'2:subcommand:(%s %s)'\n", strings.Join(admin, " "), strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _client client")
+}
+
+func fishCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "# fish completion for client; load with: client completion fish | source")
+	fmt.Fprintln(w, "complete -c client -f")
+	top, admin := commandWords()
+	fmt.Fprintf(w, "complete -c client -n __fish_use_subcommand -a '%s'\n", strings.Join(top, " "))
+	fmt.Fprintf(w, "complete -c client -n '__fish_seen_subcommand_from admin' -a '%s'\n", strings.Join(admin, " "))
+	fmt.Fprintf(w, "complete -c client -n '__fish_seen_subcommand_from completion' -a '%s'\n", strings.Join(completionShells, " "))
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c client -l %s", f.name)
+		switch {
+		case f.isBool:
+		case completionValues[f.name] != nil:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(completionValues[f.name], " "))
+		case completionFiles[f.name]:
+			line += " -r -F"
+		default:
+			line += " -x"
+		}
+		fmt.Fprintf(w, "%s -d '%s'\n", line, completionSummary(f.usage))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// copyRange copies the live keys in [srcStart, srcEnd] to dstPrefix+key
+// with their value types, content types and TTLs, overwriting whatever the
+// destination keys held. The leader reads the range from one snapshot and
+// logs the whole copy as one entry, so readers see all of it or none of it.
+// Keys are hashed to partitions, so only single-partition clusters can copy
+// a range atomically; others are refused.
+func copyRange(c *routedClient, srcStart, srcEnd, dstPrefix string) (*kvpb.CopyRangeReply, error) {
+	if n := len(c.partitions); n > 1 {
+		return nil, fmt.Errorf("copyrange needs a single-partition cluster: keys are hashed to partitions, so the range is spread over all %d", n)
+	}
+	if !c.supports(featureCopyRange) {
+		return nil, errors.New("server does not support copying ranges")
+	}
+	var resp *kvpb.CopyRangeReply
+	reqID := c.nextMutationRequestID()
+	err := c.callPartition(0, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.CopyRange(ctx, &kvpb.CopyRangeRequest{StartKey: srcStart, EndKey: srcEnd, DstPrefix: dstPrefix})
+		return err
+	})
+	return resp, err
+}
+
+func printCopyRange(w io.Writer, c *routedClient, srcStart, srcEnd, dstPrefix string) error {
+	started := time.Now()
+	resp, err := copyRange(c, srcStart, srcEnd, dstPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "COPYRANGE %s %s %s keys=%d seq=%d elapsed=%s\n", srcStart, srcEnd, dstPrefix, resp.Keys, resp.Seq, time.Since(started).Round(time.Millisecond))
+	return nil
+}
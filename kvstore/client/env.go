@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Environment variables that supply flag defaults, so CI jobs and wrapper
+// scripts can configure the client once. An explicit flag still wins.
+const (
+	envServer     = "KV_SERVER"
+	envTimeout    = "KV_TIMEOUT"
+	envAuthToken  = "KV_AUTH_TOKEN"
+	envAdminToken = "KV_ADMIN_TOKEN"
+	envTLSCA      = "KV_TLS_CA"
+)
+
+func envString(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("ignoring %s=%q: %v", name, raw, err)
+		return fallback
+	}
+	return d
+}
+
+// bearerToken attaches a static token to every RPC as "authorization:
+// Bearer <token>" metadata.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity is false because the cluster only speaks
+// plaintext gRPC today.
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// tokenCommand runs a shell command before every RPC, including each
+// retry, and attaches what it prints as the bearer token. It is for servers
+// run with --oidc_one_time_tokens, which refuse a token the second time.
+type tokenCommand string
+
+func (t tokenCommand) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "sh", "-c", string(t)).Output()
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "auth_token_command: %v", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "auth_token_command printed no token")
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (t tokenCommand) RequireTransportSecurity() bool {
+	return false
+}
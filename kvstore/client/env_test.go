@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenCommandMintsTokenPerRequest(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "n")
+	mint := tokenCommand("n=$(cat " + counter + " 2>/dev/null || echo 0); echo $((n+1)) > " + counter + "; echo tok-$n")
+	for _, want := range []string{"Bearer tok-0", "Bearer tok-1"} {
+		md, err := mint.GetRequestMetadata(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := md["authorization"]; got != want {
+			t.Fatalf("authorization = %q, want %q", got, want)
+		}
+	}
+
+	for _, cmd := range []string{"exit 1", "true"} {
+		if _, err := tokenCommand(cmd).GetRequestMetadata(context.Background()); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("token command %q: err = %v, want Unauthenticated", cmd, err)
+		}
+	}
+}
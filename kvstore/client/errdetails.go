@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain and the reasons below mirror the server's ErrorInfo details.
+// Servers that predate them send bare messages, so each check falls back
+// to the message text.
+const errorDomain = "kvstore.madkv"
+
+const (
+	reasonNotLeader        = "NOT_LEADER"
+	reasonWrongPartition   = "WRONG_PARTITION"
+	reasonMirrorStandby    = "MIRROR_STANDBY"
+	reasonScanSnapshotLost = "SCAN_SNAPSHOT_LOST"
+	reasonTypeMismatch     = "VALUE_TYPE_MISMATCH"
+	reasonMergeRefused     = "MERGE_REFUSED"
+	reasonWriteOnce        = "WRITE_ONCE"
+)
+
+// errorInfo returns the server's ErrorInfo detail on err, if any.
+func errorInfo(err error) (*errdetails.ErrorInfo, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+// hasReason reports whether err carries reason, or, from an older server,
+// a message starting with legacyPrefix.
+func hasReason(err error, reason, legacyPrefix string) bool {
+	if info, ok := errorInfo(err); ok {
+		return info.Reason == reason
+	}
+	st, ok := status.FromError(err)
+	return ok && strings.HasPrefix(st.Message(), legacyPrefix)
+}
+
+// retryDelay returns the wait the server suggested before retrying err.
+func retryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// describeError renders err followed by what its details point at: the
+// request fields at fault, the exhausted quotas and the suggested retry
+// delay.
+func describeError(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", st.Code(), st.Message())
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				fmt.Fprintf(&b, " [field %s]", v.Field)
+			}
+		case *errdetails.QuotaFailure:
+			for _, v := range d.Violations {
+				fmt.Fprintf(&b, " [quota %s]", v.Subject)
+			}
+		case *errdetails.RetryInfo:
+			fmt.Fprintf(&b, " [retry after %s]", d.RetryDelay.AsDuration())
+		}
+	}
+	return b.String()
+}
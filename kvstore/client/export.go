@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Export format, version 1.
+//
+// An export directory holds one data file per partition and a manifest.json
+// describing them. The manifest is written last, so a directory without one
+// is an incomplete export.
+//
+// A data file is
+//
+//	"KVEXP001"
+//	record*      [uvarint key length][key][uvarint value length][value]
+//	trailer      [uint64 record count][uint32 CRC-32C] (big-endian)
+//
+// Records are sorted by key with no duplicates. The CRC covers every byte
+// before it, the magic included. Readers must reject a file whose trailer,
+// size or SHA-256 does not match the manifest.
+//
+// A namespace export holds only the keys of one namespace, those starting
+// with "<namespace>/", and names it in the manifest, so that ingest can move
+// the keys under another namespace.
+//
+// Incompatible changes to either file bump exportVersion.
+const (
+	exportFormat       = "kvstore-export"
+	exportVersion      = 1
+	exportMagic        = "KVEXP001"
+	exportManifestName = "manifest.json"
+	exportTrailerSize  = 12
+	exportPageSize     = 1000
+	namespaceSeparator = "/"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type exportManifest struct {
+	Format     string       `json:"format"`
+	Version    int          `json:"version"`
+	CreatedAt  string       `json:"created_at"`
+	Partitions int          `json:"partitions"`
+	Namespace  string       `json:"namespace,omitempty"`
+	Files      []exportFile `json:"files"`
+}
+
+type exportFile struct {
+	Name      string `json:"name"`
+	Partition int    `json:"partition"`
+	Keys      uint64 `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	FirstKey  string `json:"first_key"`
+	LastKey   string `json:"last_key"`
+	CRC32C    uint32 `json:"crc32c"`
+	SHA256    string `json:"sha256"`
+}
+
+// exportWriter writes one data file.
+type exportWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	crc   hash.Hash32
+	sha   hash.Hash
+	meta  exportFile
+	buf   []byte
+	count uint64
+}
+
+func createExportFile(path string, partition int) (*exportWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create export file: %w", err)
+	}
+	ew := &exportWriter{
+		f:    f,
+		w:    bufio.NewWriterSize(f, 256*1024),
+		crc:  crc32.New(crc32c),
+		sha:  sha256.New(),
+		meta: exportFile{Name: filepath.Base(path), Partition: partition},
+	}
+	if err := ew.write([]byte(exportMagic)); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *exportWriter) write(p []byte) error {
+	ew.crc.Write(p)
+	ew.sha.Write(p)
+	ew.meta.Bytes += int64(len(p))
+	_, err := ew.w.Write(p)
+	return err
+}
+
+func (ew *exportWriter) add(key, value string) error {
+	if ew.count > 0 && key <= ew.meta.LastKey {
+		return fmt.Errorf("export keys out of order: %q after %q", key, ew.meta.LastKey)
+	}
+	if ew.count == 0 {
+		ew.meta.FirstKey = key
+	}
+	ew.meta.LastKey = key
+	ew.count++
+	ew.buf = binary.AppendUvarint(ew.buf[:0], uint64(len(key)))
+	ew.buf = append(ew.buf, key...)
+	ew.buf = binary.AppendUvarint(ew.buf, uint64(len(value)))
+	ew.buf = append(ew.buf, value...)
+	return ew.write(ew.buf)
+}
+
+// finish writes the trailer, syncs and closes the file.
+func (ew *exportWriter) finish() (exportFile, error) {
+	trailer := binary.BigEndian.AppendUint64(nil, ew.count)
+	trailer = binary.BigEndian.AppendUint32(trailer, ew.crc.Sum32())
+	ew.sha.Write(trailer)
+	ew.meta.Bytes += int64(len(trailer))
+	ew.meta.Keys = ew.count
+	ew.meta.CRC32C = ew.crc.Sum32()
+	ew.meta.SHA256 = hex.EncodeToString(ew.sha.Sum(nil))
+	_, err := ew.w.Write(trailer)
+	if err == nil {
+		err = ew.w.Flush()
+	}
+	if err == nil {
+		err = ew.f.Sync()
+	}
+	if closeErr := ew.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return exportFile{}, fmt.Errorf("write %s: %w", ew.meta.Name, err)
+	}
+	return ew.meta, nil
+}
+
+// checkNamespaceName refuses a namespace name that is empty or would not
+// name a namespace.
+func checkNamespaceName(namespace string) error {
+	if namespace == "" || strings.Contains(namespace, namespaceSeparator) {
+		return fmt.Errorf("invalid namespace %q: must be non-empty and not contain %q", namespace, namespaceSeparator)
+	}
+	return nil
+}
+
+// exportMode pages through every partition with Iterate and writes the
+// export into dir, which must not already hold a manifest. With namespace
+// set it exports only that namespace.
+func exportMode(c *routedClient, dir, namespace string) error {
+	if !c.supports(featureIterate) {
+		return errors.New("server does not support iteration")
+	}
+	var prefix string
+	if namespace != "" {
+		if err := checkNamespaceName(namespace); err != nil {
+			return err
+		}
+		if !c.supports(featureIterPrefix) {
+			return errors.New("server does not support iterating a namespace")
+		}
+		prefix = namespace + namespaceSeparator
+	}
+	if _, err := os.Stat(filepath.Join(dir, exportManifestName)); err == nil {
+		return fmt.Errorf("%s already contains an export", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create export dir: %w", err)
+	}
+	started := time.Now()
+	manifest := exportManifest{
+		Format:     exportFormat,
+		Version:    exportVersion,
+		CreatedAt:  started.UTC().Format(time.RFC3339),
+		Partitions: len(c.partitions),
+		Namespace:  namespace,
+	}
+	// The partitions' live key counts size the job; without them progress
+	// is reported without a total.
+	var total uint64
+	if namespace == "" {
+		if stats, err := rangeStats(c, "", ""); err == nil {
+			total = stats.TotalKeys
+		}
+	} else if stats, err := rangeStats(c, prefix, namespace+"0"); err == nil {
+		// "<namespace>0" is the first key past the namespace.
+		total = stats.Keys
+	}
+	prog := startProgress("export", "keys", total, c.progressEvery)
+	defer prog.finish()
+	for partition := range c.partitions {
+		ew, err := createExportFile(filepath.Join(dir, fmt.Sprintf("part-%04d.kvx", partition)), partition)
+		if err != nil {
+			return err
+		}
+		var cursor []byte
+		for {
+			var resp *kvpb.IterateReply
+			if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+				var err error
+				resp, err = cli.Iterate(ctx, &kvpb.IterateRequest{Cursor: cursor, Limit: exportPageSize, Prefix: prefix})
+				return err
+			}); err != nil {
+				_ = ew.f.Close()
+				return err
+			}
+			for _, p := range resp.Pairs {
+				if err := ew.add(p.Key, p.Value); err != nil {
+					_ = ew.f.Close()
+					return err
+				}
+			}
+			prog.add(uint64(len(resp.Pairs)))
+			if resp.Done {
+				break
+			}
+			cursor = resp.NextCursor
+		}
+		meta, err := ew.finish()
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, meta)
+	}
+	if err := writeExportManifest(dir, &manifest); err != nil {
+		return err
+	}
+	var keys uint64
+	for _, f := range manifest.Files {
+		keys += f.Keys
+	}
+	if namespace != "" {
+		fmt.Printf("EXPORT %s namespace=%s files=%d keys=%d elapsed=%s\n", dir, namespace, len(manifest.Files), keys, time.Since(started).Round(time.Millisecond))
+		return nil
+	}
+	fmt.Printf("EXPORT %s files=%d keys=%d elapsed=%s\n", dir, len(manifest.Files), keys, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+func writeExportManifest(dir string, m *exportManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, exportManifestName+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, exportManifestName)); err != nil {
+		return fmt.Errorf("install manifest: %w", err)
+	}
+	return nil
+}
+
+// readExportManifest loads dir's manifest and checks the format version.
+func readExportManifest(dir string) (*exportManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, exportManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	var m exportManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if m.Format != exportFormat || m.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export %s version %d", m.Format, m.Version)
+	}
+	return &m, nil
+}
+
+// readExportFile verifies a data file against its manifest entry and calls
+// fn for each record in key order.
+func readExportFile(dir string, meta exportFile, fn func(key, value string) error) error {
+	path := filepath.Join(dir, meta.Name)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != meta.Bytes || info.Size() < int64(len(exportMagic)+exportTrailerSize) {
+		return fmt.Errorf("%s: size %d, manifest says %d", meta.Name, info.Size(), meta.Bytes)
+	}
+	sha := sha256.New()
+	if _, err := io.Copy(sha, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sha.Sum(nil)) != meta.SHA256 {
+		return fmt.Errorf("%s: sha256 mismatch", meta.Name)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	body := io.LimitReader(f, info.Size()-exportTrailerSize)
+	crc := crc32.New(crc32c)
+	r := bufio.NewReaderSize(io.TeeReader(body, crc), 256*1024)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != exportMagic {
+		return fmt.Errorf("%s: bad magic", meta.Name)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	var count uint64
+	for {
+		key, err := readString()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: truncated record: %w", meta.Name, err)
+		}
+		value, err := readString()
+		if err != nil {
+			return fmt.Errorf("%s: truncated record: %w", meta.Name, err)
+		}
+		count++
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, exportTrailerSize)
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return fmt.Errorf("%s: read trailer: %w", meta.Name, err)
+	}
+	if binary.BigEndian.Uint64(trailer) != count || count != meta.Keys {
+		return fmt.Errorf("%s: record count mismatch", meta.Name)
+	}
+	if binary.BigEndian.Uint32(trailer[8:]) != crc.Sum32() || crc.Sum32() != meta.CRC32C {
+		return fmt.Errorf("%s: crc32c mismatch", meta.Name)
+	}
+	return nil
+}
+
+// verifyExport checks every file of the export in dir without contacting
+// the cluster.
+func verifyExport(dir string) error {
+	m, err := readExportManifest(dir)
+	if err != nil {
+		return err
+	}
+	var keys uint64
+	for _, meta := range m.Files {
+		prev, first := "", true
+		err := readExportFile(dir, meta, func(key, value string) error {
+			if !first && key <= prev {
+				return fmt.Errorf("%s: keys out of order at %q", meta.Name, key)
+			}
+			if m.Namespace != "" && !strings.HasPrefix(key, m.Namespace+namespaceSeparator) {
+				return fmt.Errorf("%s: key %q is outside namespace %s", meta.Name, key, m.Namespace)
+			}
+			prev, first = key, false
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys += meta.Keys
+	}
+	fmt.Printf("VERIFY %s ok files=%d keys=%d\n", dir, len(m.Files), keys)
+	return nil
+}
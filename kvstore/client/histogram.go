@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// estimate is a cluster-wide count scaled up from the partitions' samples.
+type estimate struct {
+	keys, bytes float64
+}
+
+// printKeyspaceHistogram asks each partition's leader for a sample-based
+// histogram of its keys and prints cluster-wide estimates: how key and value
+// sizes are spread, and the key prefixes with the most keys and bytes. Each
+// partition only reports its own top prefixes, so a prefix spread thinly
+// over many partitions may be ranked lower than it should be.
+func printKeyspaceHistogram(c *routedClient, w io.Writer, sampleSize int, delimiter string, depth, top int) int {
+	if !c.supports(featureHistogram) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "HISTOGRAM unsupported by server (api_version=%d)\n", version)
+		return exitRPCError
+	}
+	if top == 0 {
+		top = 10
+	}
+	code := exitOK
+	keySizes := make(map[uint64]float64)
+	valueSizes := make(map[uint64]float64)
+	prefixes := make(map[string]*estimate)
+	var population, sampled uint64
+	var totalBytes float64
+	answered := 0
+	for partition, addrs := range c.partitions {
+		var resp *kvpb.KeyspaceHistogramReply
+		var lastErr error
+		for _, idx := range c.getReplicaOrder(partition) {
+			admin, err := c.adminClient(addrs[idx])
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err = admin.KeyspaceHistogram(ctx, &kvpb.KeyspaceHistogramRequest{SampleSize: uint32(sampleSize), Delimiter: delimiter, Depth: uint32(depth), TopPrefixes: uint32(top)})
+			cancel()
+			if err == nil {
+				break
+			}
+			lastErr = err
+			if _, ok := leaderHintFromError(err); !ok {
+				break
+			}
+		}
+		if resp == nil {
+			fmt.Fprintf(w, "HISTOGRAM partition=%d error=%v\n", partition, lastErr)
+			code = exitRPCError
+			continue
+		}
+		answered++
+		population += resp.Population
+		sampled += uint64(resp.Sampled)
+		if resp.Sampled == 0 {
+			continue
+		}
+		scale := float64(resp.Population) / float64(resp.Sampled)
+		totalBytes += float64(resp.SampledBytes) * scale
+		for _, b := range resp.KeySizes {
+			keySizes[b.LeBytes] += float64(b.Sampled) * scale
+		}
+		for _, b := range resp.ValueSizes {
+			valueSizes[b.LeBytes] += float64(b.Sampled) * scale
+		}
+		// A prefix may be in both lists; count it once.
+		seen := make(map[string]bool)
+		for _, st := range append(resp.TopByKeys, resp.TopByBytes...) {
+			if seen[st.Prefix] {
+				continue
+			}
+			seen[st.Prefix] = true
+			e := prefixes[st.Prefix]
+			if e == nil {
+				e = &estimate{}
+				prefixes[st.Prefix] = e
+			}
+			e.keys += float64(st.SampledKeys) * scale
+			e.bytes += float64(st.SampledBytes) * scale
+		}
+	}
+
+	fmt.Fprintf(w, "HISTOGRAM keys=%d bytes=%.0f sampled=%d partitions=%d/%d\n", population, totalBytes, sampled, answered, len(c.partitions))
+	printSizeBuckets(w, "KEY_SIZE", keySizes, float64(population))
+	printSizeBuckets(w, "VALUE_SIZE", valueSizes, float64(population))
+	names := make([]string, 0, len(prefixes))
+	for p := range prefixes {
+		names = append(names, p)
+	}
+	for _, by := range []struct {
+		label string
+		value func(*estimate) float64
+		total float64
+	}{
+		{"PREFIX_BY_KEYS", func(e *estimate) float64 { return e.keys }, float64(population)},
+		{"PREFIX_BY_BYTES", func(e *estimate) float64 { return e.bytes }, totalBytes},
+	} {
+		sort.Slice(names, func(i, j int) bool {
+			vi, vj := by.value(prefixes[names[i]]), by.value(prefixes[names[j]])
+			if vi != vj {
+				return vi > vj
+			}
+			return names[i] < names[j]
+		})
+		for _, p := range names[:min(top, len(names))] {
+			e := prefixes[p]
+			fmt.Fprintf(w, "%s prefix=%q keys=%.0f bytes=%.0f share=%s\n", by.label, p, e.keys, e.bytes, percent(by.value(e), by.total))
+		}
+	}
+	return code
+}
+
+func printSizeBuckets(w io.Writer, label string, buckets map[uint64]float64, total float64) {
+	bounds := make([]uint64, 0, len(buckets))
+	for le := range buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	for _, le := range bounds {
+		fmt.Fprintf(w, "%s le=%d keys=%.0f share=%s\n", label, le, buckets[le], percent(buckets[le], total))
+	}
+}
+
+func percent(part, total float64) string {
+	if total <= 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*part/total)
+}
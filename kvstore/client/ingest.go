@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	// ingestBatchBytes bounds one IngestBatch message; ingestSegmentBytes
+	// bounds the batches buffered per partition before a stream is sent,
+	// which is also what a retry resends.
+	ingestBatchBytes   = 256 * 1024
+	ingestSegmentBytes = 8 * 1024 * 1024
+)
+
+// ingestSegment is the pending, key-ordered data for one partition.
+type ingestSegment struct {
+	batches    []*kvpb.IngestBatch
+	batchBytes int
+	bytes      int
+}
+
+func (seg *ingestSegment) add(key, value string) {
+	pair := &kvpb.KVPair{Key: key, Value: value}
+	size := proto.Size(pair)
+	if len(seg.batches) == 0 || seg.batchBytes+size > ingestBatchBytes {
+		seg.batches = append(seg.batches, &kvpb.IngestBatch{})
+		seg.batchBytes = 0
+	}
+	last := seg.batches[len(seg.batches)-1]
+	last.Pairs = append(last.Pairs, pair)
+	seg.batchBytes += size
+	seg.bytes += size
+}
+
+// sendIngestSegment streams one segment to the partition leader. Ingest
+// overwrites like Put, so resending a segment after a failure is safe.
+func sendIngestSegment(c *routedClient, partition int, seg *ingestSegment) (*kvpb.IngestReply, error) {
+	var reply *kvpb.IngestReply
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		// Chunks commit one raft round trip at a time, so allow the whole
+		// segment more than a single request timeout.
+		ctx, cancel := context.WithTimeout(ctx, 10*c.timeout)
+		defer cancel()
+		stream, err := cli.Ingest(ctx)
+		if err != nil {
+			return err
+		}
+		for _, batch := range seg.batches {
+			if err := stream.Send(batch); err != nil {
+				_, err = stream.CloseAndRecv()
+				return err
+			}
+		}
+		reply, err = stream.CloseAndRecv()
+		return err
+	})
+	return reply, err
+}
+
+// ingestMode loads an export directory into the cluster. Each data file is
+// sorted, so routing its keys by the current partition count keeps every
+// per-partition stream sorted too, even when the export came from a cluster
+// with a different number of partitions. With namespace set, dir must hold
+// a namespace export, whose keys are loaded under namespace instead; the
+// rename keeps them sorted, since they all share one prefix.
+func ingestMode(c *routedClient, dir, namespace string) error {
+	if !c.supports(featureIngest) {
+		return errors.New("server does not support ingest")
+	}
+	m, err := readExportManifest(dir)
+	if err != nil {
+		return err
+	}
+	var fromPrefix, toPrefix string
+	if namespace != "" {
+		if err := checkNamespaceName(namespace); err != nil {
+			return err
+		}
+		if m.Namespace == "" {
+			return fmt.Errorf("%s is not a namespace export", dir)
+		}
+		fromPrefix, toPrefix = m.Namespace+namespaceSeparator, namespace+namespaceSeparator
+	}
+	started := time.Now()
+	var keys, entries uint64
+	flush := func(partition int, seg *ingestSegment) error {
+		if len(seg.batches) == 0 {
+			return nil
+		}
+		reply, err := sendIngestSegment(c, partition, seg)
+		if err != nil {
+			return fmt.Errorf("ingest into partition %d: %w", partition, err)
+		}
+		keys += reply.Keys
+		entries += reply.Entries
+		*seg = ingestSegment{}
+		return nil
+	}
+
+	var total uint64
+	for _, meta := range m.Files {
+		total += meta.Keys
+	}
+	prog := startProgress("ingest", "keys", total, c.progressEvery)
+	defer prog.finish()
+	for _, meta := range m.Files {
+		segments := make([]ingestSegment, len(c.partitions))
+		err := readExportFile(dir, meta, func(key, value string) error {
+			prog.add(1)
+			if namespace != "" {
+				rest, ok := strings.CutPrefix(key, fromPrefix)
+				if !ok {
+					return fmt.Errorf("%s: key %q is outside namespace %s", meta.Name, key, m.Namespace)
+				}
+				key = toPrefix + rest
+			}
+			partition := ownerForKey(key, len(c.partitions))
+			seg := &segments[partition]
+			seg.add(key, value)
+			if seg.bytes >= ingestSegmentBytes {
+				return flush(partition, seg)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for partition := range segments {
+			if err := flush(partition, &segments[partition]); err != nil {
+				return err
+			}
+		}
+	}
+	if namespace != "" {
+		fmt.Printf("INGEST %s namespace=%s keys=%d entries=%d elapsed=%s\n", dir, namespace, keys, entries, time.Since(started).Round(time.Millisecond))
+		return nil
+	}
+	fmt.Printf("INGEST %s keys=%d entries=%d elapsed=%s\n", dir, keys, entries, time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const defaultIteratePage = 100
+
+// A client iterate cursor is "<partition>.<base64 server cursor>". Partitions
+// are walked one after another, so pages come in key order within each
+// partition but not across the cluster.
+func parseIterateCursor(raw string, partitions int) (int, []byte, error) {
+	if raw == "" {
+		return 0, nil, nil
+	}
+	idx, enc, ok := strings.Cut(raw, ".")
+	partition, err := strconv.Atoi(idx)
+	if !ok || err != nil || partition < 0 || partition >= partitions {
+		return 0, nil, fmt.Errorf("invalid cursor %q", raw)
+	}
+	server, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid cursor %q", raw)
+	}
+	return partition, server, nil
+}
+
+// iteratePage returns up to limit pairs after cursor and the cursor for the
+// next page, which is empty once every partition is exhausted.
+func iteratePage(c *routedClient, cursor string, limit int) ([]*kvpb.KVPair, string, error) {
+	if !c.supports(featureIterate) {
+		return nil, "", errors.New("server does not support iteration")
+	}
+	partition, serverCursor, err := parseIterateCursor(cursor, len(c.partitions))
+	if err != nil {
+		return nil, "", err
+	}
+	var pairs []*kvpb.KVPair
+	for partition < len(c.partitions) && len(pairs) < limit {
+		var resp *kvpb.IterateReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.Iterate(ctx, &kvpb.IterateRequest{Cursor: serverCursor, Limit: uint32(limit - len(pairs))})
+			return err
+		}); err != nil {
+			return nil, "", err
+		}
+		pairs = append(pairs, resp.Pairs...)
+		if resp.Done {
+			partition, serverCursor = partition+1, nil
+		} else {
+			serverCursor = resp.NextCursor
+		}
+	}
+	if partition == len(c.partitions) {
+		return pairs, "", nil
+	}
+	return pairs, strconv.Itoa(partition) + "." + base64.RawURLEncoding.EncodeToString(serverCursor), nil
+}
+
+func printIteratePage(w io.Writer, pairs []*kvpb.KVPair, next string) {
+	if next == "" {
+		next = "done"
+	}
+	fmt.Fprintf(w, "ITERATE %d pairs next=%s\n", len(pairs), next)
+	for _, p := range pairs {
+		fmt.Fprintf(w, "  %s %s\n", p.Key, p.Value)
+	}
+}
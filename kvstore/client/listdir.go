@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const defaultListDirPage = 1000
+
+// dirEntry is one name in a merged listing: a key with its value, or a
+// common prefix when isPrefix is set.
+type dirEntry struct {
+	name     string
+	value    string
+	isPrefix bool
+}
+
+// listDir lists the children of prefix across every partition. Keys are
+// hashed across partitions, so each is asked for a page and the pages are
+// merged; a common prefix can come back from several of them. next is the
+// start_after for the following page, or empty once the listing is done.
+func listDir(c *routedClient, prefix, delim, after string, limit int) ([]dirEntry, string, error) {
+	if !c.supports(featureListDir) {
+		return nil, "", errors.New("server does not support directory listing")
+	}
+	merged := make(map[string]dirEntry)
+	// cutoff is the lowest last name of a truncated partition; names past it
+	// may be missing from that partition's page.
+	cutoff, truncated := "", false
+	for partition := range c.partitions {
+		var resp *kvpb.ListDirReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.ListDir(ctx, &kvpb.ListDirRequest{Prefix: prefix, Delimiter: delim, StartAfter: after, Limit: uint32(limit)})
+			return err
+		}); err != nil {
+			return nil, "", err
+		}
+		last := ""
+		for _, e := range resp.Entries {
+			merged[e.Key] = dirEntry{name: e.Key, value: e.Value}
+			last = max(last, e.Key)
+		}
+		for _, p := range resp.CommonPrefixes {
+			merged[p] = dirEntry{name: p, isPrefix: true}
+			last = max(last, p)
+		}
+		if resp.Truncated && (!truncated || last < cutoff) {
+			cutoff, truncated = last, true
+		}
+	}
+	entries := make([]dirEntry, 0, len(merged))
+	for _, e := range merged {
+		if !truncated || e.name <= cutoff {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	more := truncated
+	if len(entries) > limit {
+		entries, more = entries[:limit], true
+	}
+	if !more || len(entries) == 0 {
+		return entries, "", nil
+	}
+	return entries, entries[len(entries)-1].name, nil
+}
+
+func printListDir(w io.Writer, prefix string, entries []dirEntry, next string) {
+	if next == "" {
+		next = "done"
+	}
+	fmt.Fprintf(w, "LS %s (%d names) next=%s\n", prefix, len(entries), next)
+	for _, e := range entries {
+		if e.isPrefix {
+			fmt.Fprintf(w, "  %s\n", e.name)
+			continue
+		}
+		fmt.Fprintf(w, "  %s %s\n", e.name, e.value)
+	}
+}
+
+// lsArgs parses "LS [prefix] [limit] [start_after]"; an omitted or "-"
+// prefix lists the top level.
+func lsArgs(parts []string) (prefix string, limit int, after string, err error) {
+	if len(parts) > 4 {
+		return "", 0, "", errors.New("LS takes at most 3 arguments: [prefix] [limit] [start_after]")
+	}
+	limit = defaultListDirPage
+	if len(parts) > 1 && parts[1] != "-" {
+		prefix = parts[1]
+	}
+	if len(parts) > 2 {
+		if limit, err = strconv.Atoi(parts[2]); err != nil || limit < 1 {
+			return "", 0, "", errors.New("LS limit must be a positive integer")
+		}
+	}
+	if len(parts) > 3 {
+		after = parts[3]
+	}
+	return prefix, limit, after, nil
+}
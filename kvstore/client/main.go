@@ -3,10 +3,14 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
+	"io"
 	"log"
+	"math/rand"
 	"os"
 	"sort"
 	"strconv"
@@ -16,39 +20,165 @@ import (
 	"time"
 
 	kvpb "madkv/kvstore/gen/kvpb"
+	"madkv/kvstore/internal/buildinfo"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-const requestIDMetadataKey = "x-request-id"
+const (
+	requestIDMetadataKey  = "x-request-id"
+	priorityMetadataKey   = "x-priority"
+	durabilityMetadataKey = "x-durability"
+	traceIDMetadataKey    = "x-trace-id"
+)
+
+// priorityHeader tags every RPC with the client's priority class so
+// saturated servers admit foreground traffic ahead of bulk loads.
+type priorityHeader string
+
+func (p priorityHeader) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{priorityMetadataKey: string(p)}, nil
+}
+
+func (p priorityHeader) RequireTransportSecurity() bool {
+	return false
+}
+
+// durabilityHeader tells the leader when to acknowledge the client's
+// writes: local, quorum or all.
+type durabilityHeader string
+
+func (d durabilityHeader) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{durabilityMetadataKey: string(d)}, nil
+}
+
+func (d durabilityHeader) RequireTransportSecurity() bool {
+	return false
+}
+
+// traceIDHeader tags every RPC with the --trace_id, which servers log with
+// failed requests, add to error messages and echo in response headers.
+type traceIDHeader string
+
+func (t traceIDHeader) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{traceIDMetadataKey: string(t)}, nil
+}
+
+func (t traceIDHeader) RequireTransportSecurity() bool {
+	return false
+}
+
+// Feature names advertised by servers through the Capabilities RPC.
+const (
+	featureServerInfo   = "server_info"
+	featurePing         = "ping"
+	featureAdminStats   = "admin_stats"
+	featureCompaction   = "compaction"
+	featureQuotas       = "quotas"
+	featureDeleteAt     = "scheduled_delete"
+	featureTTL          = "ttl"
+	featureSampling     = "sampling"
+	featureRangeStats   = "range_stats"
+	featureIterate      = "iterate"
+	featureIngest       = "ingest"
+	featureListDir      = "list_dir"
+	featureReplication  = "replication_status"
+	featureTransfer     = "leadership_transfer"
+	featureDurability   = "durability_levels"
+	featureMirror       = "mirror"
+	featureWatch        = "watch"
+	featureScanSnapshot = "scan_snapshots"
+	featureDrain        = "drain"
+	featureUndelete     = "undelete"
+	featureRename       = "rename"
+	featureGetOrPut     = "get_or_put"
+	featureMerge        = "merge"
+	featureBatch        = "batch"
+	featureHistogram    = "keyspace_histogram"
+	featureQuery        = "query"
+	featureJSONPaths    = "json_paths"
+	featureKeyMeta      = "key_meta"
+	featureIterPrefix   = "iterate_prefix"
+	featureScrub        = "scrub"
+	featureBackup       = "backup"
+	featureCopyRange    = "copy_range"
+)
 
 type routedClient struct {
-	timeout       time.Duration
-	retry         time.Duration
-	partitions    [][]string
-	leaderHintsMu sync.Mutex
-	leaderHints   map[int]int
-	connMu        sync.Mutex
-	conns         map[string]*grpc.ClientConn
-	clients       map[string]kvpb.KVSClient
-	clientID      string
-	nextReqID     uint64
-}
-
-func newRoutedClient(partitions [][]string, timeout, retry time.Duration) *routedClient {
+	timeout        time.Duration
+	connectTimeout time.Duration
+	retry          time.Duration
+	maxRetry       time.Duration
+	partitions     [][]string
+	// leaderHintsMu guards leaderHints and the route cache state below, and
+	// the replica lists in partitions, which a refresh may replace. The
+	// number of partitions never changes.
+	leaderHintsMu  sync.Mutex
+	leaderHints    map[int]int
+	managerAddrs   []string
+	routeCachePath string
+	// routesDirty is set when the map or a leader hint changed since the
+	// cache was read; routesStale when the cluster was found to have a
+	// different partition count and the new map is already cached.
+	routesDirty     bool
+	routesStale     bool
+	routesRefreshed time.Time
+	connMu          sync.Mutex
+	conns           map[string]*grpc.ClientConn
+	clients         map[string]kvpb.KVSClient
+	clientID        string
+	nextReqID       uint64
+	giveUpAfter     time.Duration
+	authToken       string
+	// authTokenCommand mints a token per RPC in place of authToken.
+	authTokenCommand string
+	priority         string
+	durability       string
+	traceID          string
+	report           *latencyReport
+	// maxLines caps the pairs a scan prints; 0 prints them all.
+	maxLines int
+	// progressEvery is how often long jobs report progress; see
+	// startProgress.
+	progressEvery time.Duration
+	// migration is the second cluster of a dual-write migration, if any.
+	migration *migrationTarget
+	// multi is the open MULTI block of the stdin protocol, if any.
+	multi *multiQueue
+	// readCache serves stdin GETs under server cache leases, if enabled.
+	readCache *readCache
+	// adminToken is sent on adminConns, the connections to servers' Admin
+	// services, keyed by the servers' API addresses.
+	adminToken string
+	adminConns map[string]*grpc.ClientConn
+
+	capsOnce   sync.Once
+	apiVersion uint32
+	features   map[string]bool
+}
+
+func newRoutedClient(partitions [][]string, timeout, connectTimeout, retry, maxRetry time.Duration) *routedClient {
 	clientID := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	if maxRetry < retry {
+		maxRetry = retry
+	}
 	return &routedClient{
-		timeout:     timeout,
-		retry:       retry,
-		partitions:  partitions,
-		leaderHints: make(map[int]int, len(partitions)),
-		conns:       make(map[string]*grpc.ClientConn),
-		clients:     make(map[string]kvpb.KVSClient),
-		clientID:    clientID,
+		timeout:        timeout,
+		connectTimeout: connectTimeout,
+		retry:          retry,
+		maxRetry:       maxRetry,
+		partitions:     partitions,
+		leaderHints:    make(map[int]int, len(partitions)),
+		conns:          make(map[string]*grpc.ClientConn),
+		clients:        make(map[string]kvpb.KVSClient),
+		adminConns:     make(map[string]*grpc.ClientConn),
+		clientID:       clientID,
 	}
 }
 
@@ -77,8 +207,16 @@ func parseCommaList(raw string) []string {
 }
 
 func (c *routedClient) close() {
+	c.migration.close()
+	c.migration = nil
+	c.readCache.close()
+	c.readCache = nil
+	c.saveRouteCache()
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
+	for addr := range c.adminConns {
+		c.dropAdminConnLocked(addr)
+	}
 	for addr, conn := range c.conns {
 		_ = conn.Close()
 		delete(c.conns, addr)
@@ -86,24 +224,113 @@ func (c *routedClient) close() {
 	}
 }
 
+// ensureConn returns a client for addr, dialing it if there is none yet.
+// The dial waits without holding connMu, so one slow replica does not hold
+// up connections to the others.
 func (c *routedClient) ensureConn(addr string) (kvpb.KVSClient, error) {
 	c.connMu.Lock()
-	defer c.connMu.Unlock()
-	if cli := c.clients[addr]; cli != nil {
+	cli := c.clients[addr]
+	c.connMu.Unlock()
+	if cli != nil {
 		return cli, nil
 	}
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if c.authTokenCommand != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCommand(c.authTokenCommand)))
+	} else if c.authToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(c.authToken)))
+	}
+	if c.priority != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(priorityHeader(c.priority)))
+	}
+	if c.durability != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(durabilityHeader(c.durability)))
+	}
+	if c.traceID != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(traceIDHeader(c.traceID)))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if err := waitForReady(conn, c.connectTimeout); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server %s unreachable: %w", addr, err)
+	}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if cli := c.clients[addr]; cli != nil {
+		// Another caller connected first; keep its connection.
+		_ = conn.Close()
+		return cli, nil
+	}
 	c.conns[addr] = conn
 	c.clients[addr] = kvpb.NewKVSClient(conn)
 	return c.clients[addr], nil
 }
 
+// waitForReady forces a lazily created connection to dial and waits until it
+// is usable, so an unreachable server is reported here instead of surfacing
+// later as an opaque RPC failure.
+func waitForReady(conn *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("connection shut down")
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("not connected after %s (last state %s)", timeout, state)
+		}
+	}
+}
+
+// checkHealth probes every replica with the standard gRPC health service and
+// reports the ones that are unreachable or not serving. It returns the
+// partitions with no healthy replica at all.
+func (c *routedClient) checkHealth() []int {
+	var down []int
+	for partition, addrs := range c.partitions {
+		healthy := 0
+		for replica, addr := range addrs {
+			if _, err := c.ensureConn(addr); err != nil {
+				log.Printf("partition %d replica %d: %v", partition, replica, err)
+				continue
+			}
+			c.connMu.Lock()
+			conn := c.conns[addr]
+			c.connMu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: kvpb.KVS_ServiceDesc.ServiceName})
+			cancel()
+			switch {
+			case status.Code(err) == codes.Unimplemented:
+				// Older servers have no health service; reachability is all we can check.
+				healthy++
+			case err != nil:
+				log.Printf("partition %d replica %d (%s): health check failed: %v", partition, replica, addr, err)
+			case resp.Status != healthpb.HealthCheckResponse_SERVING:
+				log.Printf("partition %d replica %d (%s): not serving (%s)", partition, replica, addr, resp.Status)
+			default:
+				healthy++
+			}
+		}
+		if healthy == 0 {
+			down = append(down, partition)
+		}
+	}
+	return down
+}
+
 func (c *routedClient) resetConn(addr string) {
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
+	c.dropAdminConnLocked(addr)
 	if conn := c.conns[addr]; conn != nil {
 		_ = conn.Close()
 	}
@@ -114,33 +341,11 @@ func (c *routedClient) resetConn(addr string) {
 func fetchClusterInfo(managerAddrs []string, timeout, retry time.Duration) [][]string {
 	for {
 		for _, managerAddr := range managerAddrs {
-			conn, err := grpc.NewClient(managerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			partitions, err := queryClusterInfo(managerAddr, timeout)
 			if err != nil {
-				log.Printf("manager dial failed (%s): %v", managerAddr, err)
-				continue
-			}
-			mc := kvpb.NewClusterManagerClient(conn)
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			resp, err := mc.GetClusterInfo(ctx, &kvpb.GetClusterInfoRequest{})
-			cancel()
-			_ = conn.Close()
-			if err != nil {
-				log.Printf("manager query failed (%s): %v", managerAddr, err)
-				continue
-			}
-			if !resp.Ready || len(resp.ServerAddrs) == 0 {
-				log.Printf("manager %s not ready yet; retrying", managerAddr)
-				continue
-			}
-			if resp.ServerRf == 0 || len(resp.ServerAddrs)%int(resp.ServerRf) != 0 {
-				log.Printf("manager %s returned invalid topology", managerAddr)
+				log.Printf("%v; retrying", err)
 				continue
 			}
-			partitions := make([][]string, 0, len(resp.ServerAddrs)/int(resp.ServerRf))
-			for i := 0; i < len(resp.ServerAddrs); i += int(resp.ServerRf) {
-				group := append([]string(nil), resp.ServerAddrs[i:i+int(resp.ServerRf)]...)
-				partitions = append(partitions, group)
-			}
 			return partitions
 		}
 		time.Sleep(retry)
@@ -155,6 +360,12 @@ func leaderHintFromError(err error) (string, bool) {
 	if st.Code() != codes.FailedPrecondition {
 		return "", false
 	}
+	if info, ok := errorInfo(err); ok {
+		if info.Reason != reasonNotLeader {
+			return "", false
+		}
+		return info.Metadata["leader_addr"], true
+	}
 	const prefix = "not leader:"
 	msg := st.Message()
 	if !strings.HasPrefix(msg, prefix) {
@@ -188,26 +399,111 @@ func (c *routedClient) setLeaderHint(partition int, addr string) {
 	defer c.leaderHintsMu.Unlock()
 	for idx, candidate := range c.partitions[partition] {
 		if candidate == addr {
-			c.leaderHints[partition] = idx
+			c.setLeaderIndexLocked(partition, idx)
 			return
 		}
 	}
 }
 
+func (c *routedClient) setLeaderIndexLocked(partition, idx int) {
+	if hint, ok := c.leaderHints[partition]; !ok || hint != idx {
+		c.leaderHints[partition] = idx
+		c.routesDirty = true
+	}
+}
+
+// capabilities probes one replica per partition for its API version and
+// optional features, once per client. The result is the intersection across
+// partitions so a half-upgraded cluster is treated like its oldest member.
+// Servers that predate the Capabilities RPC count as API version 0 with no
+// optional features.
+func (c *routedClient) capabilities() (uint32, map[string]bool) {
+	c.capsOnce.Do(func() {
+		var version uint32
+		var features map[string]bool
+		for partition, addrs := range c.partitions {
+			pVersion, pFeatures, ok := c.probeCapabilities(addrs)
+			if !ok {
+				log.Printf("capabilities unknown for partition %d; assuming baseline API", partition)
+				pVersion, pFeatures = 0, map[string]bool{}
+			}
+			if features == nil {
+				version, features = pVersion, pFeatures
+				continue
+			}
+			version = min(version, pVersion)
+			for f := range features {
+				if !pFeatures[f] {
+					delete(features, f)
+				}
+			}
+		}
+		if features == nil {
+			features = map[string]bool{}
+		}
+		c.apiVersion, c.features = version, features
+	})
+	return c.apiVersion, c.features
+}
+
+func (c *routedClient) probeCapabilities(addrs []string) (uint32, map[string]bool, bool) {
+	for _, addr := range addrs {
+		cli, err := c.ensureConn(addr)
+		if err != nil {
+			c.resetConn(addr)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		resp, err := cli.Capabilities(ctx, &kvpb.CapabilitiesRequest{})
+		cancel()
+		if status.Code(err) == codes.Unimplemented {
+			return 0, map[string]bool{}, true
+		}
+		if err != nil {
+			c.resetConn(addr)
+			continue
+		}
+		features := make(map[string]bool, len(resp.Features))
+		for _, f := range resp.Features {
+			features[f] = true
+		}
+		return resp.ApiVersion, features, true
+	}
+	return 0, nil, false
+}
+
+func (c *routedClient) supports(feature string) bool {
+	_, features := c.capabilities()
+	return features[feature]
+}
+
 func (c *routedClient) nextMutationRequestID() string {
 	seq := atomic.AddUint64(&c.nextReqID, 1)
 	return c.clientID + "-" + strconv.FormatUint(seq, 10)
 }
 
-func (c *routedClient) callPartition(partition int, fn func(context.Context, kvpb.KVSClient) error) {
+// callPartition retries fn against the partition's replicas until one
+// succeeds, backing off exponentially (with jitter) between full rounds so a
+// down partition is not hammered while it recovers. Errors that retrying
+// cannot fix are returned at once, and with giveUpAfter set the last error is
+// returned once that much time has passed.
+func (c *routedClient) callPartition(partition int, fn func(context.Context, kvpb.KVSClient) error) error {
+	started := time.Now()
+	backoff := c.retry
+	var lastErr error
+rounds:
 	for {
-		order := c.getReplicaOrder(partition)
+		addrs, order := c.replicaAddrs(partition), c.getReplicaOrder(partition)
 		for _, idx := range order {
-			addr := c.partitions[partition][idx]
+			if idx >= len(addrs) {
+				break
+			}
+			addr := addrs[idx]
 			client, err := c.ensureConn(addr)
 			if err != nil {
-				log.Printf("server dial failed (%s): %v", addr, err)
+				log.Printf("%v", err)
 				c.resetConn(addr)
+				lastErr = err
 				continue
 			}
 
@@ -216,162 +512,1572 @@ func (c *routedClient) callPartition(partition int, fn func(context.Context, kvp
 			cancel()
 			if err == nil {
 				c.leaderHintsMu.Lock()
-				c.leaderHints[partition] = idx
+				c.setLeaderIndexLocked(partition, idx)
 				c.leaderHintsMu.Unlock()
-				return
+				return nil
+			}
+			if isWrongPartition(err) {
+				changed, rerr := c.refreshRoutes("wrong partition")
+				if rerr != nil {
+					return rerr
+				}
+				if !changed {
+					return err
+				}
+				continue rounds
+			}
+			if isPermanentError(err) {
+				return err
 			}
 			if leaderAddr, ok := leaderHintFromError(err); ok {
+				if leaderAddr != "" && !c.knowsReplica(partition, leaderAddr) {
+					if _, rerr := c.refreshRoutes("unknown leader " + leaderAddr); rerr != nil {
+						return rerr
+					}
+				}
 				c.setLeaderHint(partition, leaderAddr)
 			}
 			log.Printf("server rpc failed (%s): %v", addr, err)
 			c.resetConn(addr)
+			lastErr = err
+		}
+		if c.routeCachePath != "" {
+			// The cached replicas may have moved.
+			if _, err := c.refreshRoutes(fmt.Sprintf("partition %d unreachable", partition)); err != nil {
+				return err
+			}
 		}
-		time.Sleep(c.retry)
+		if c.giveUpAfter > 0 && time.Since(started) >= c.giveUpAfter {
+			return fmt.Errorf("partition %d: giving up after %s: %w", partition, c.giveUpAfter, lastErr)
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if delay, ok := retryDelay(lastErr); ok && delay > wait {
+			wait = delay
+		}
+		log.Printf("partition %d: no replica served the request; retrying in %s", partition, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		backoff = min(backoff*2, c.maxRetry)
+	}
+}
+
+// isPermanentError reports whether err would fail the same way on every
+// replica, so retrying it only delays the failure. An error the server
+// attached a retry delay to is never permanent.
+func isPermanentError(err error) bool {
+	if _, ok := retryDelay(err); ok {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.AlreadyExists, codes.NotFound, codes.OutOfRange,
+		codes.PermissionDenied, codes.Unauthenticated, codes.Unimplemented, codes.ResourceExhausted, codes.DataLoss:
+		return true
+	case codes.FailedPrecondition:
+		// A mirror standby refuses writes until an operator promotes it,
+		// and a lost scan snapshot is gone from every replica. A write the
+		// key's value refuses stays refused until someone else writes it,
+		// and one to a write-once key stays refused for good.
+		if info, ok := errorInfo(err); ok && (info.Reason == reasonTypeMismatch || info.Reason == reasonMergeRefused || info.Reason == reasonWriteOnce) {
+			return true
+		}
+		return hasReason(err, reasonMirrorStandby, "this cluster is a mirror standby") || isScanSnapshotLost(err)
+	}
+	return false
+}
+
+// valueChecksum returns the CRC-32C a Put sends with v, so the server can
+// refuse a value that did not arrive intact.
+func valueChecksum(v string) uint32 {
+	return crc32.Checksum([]byte(v), crc32c)
+}
+
+// checkValueChecksum fails if a Get reply's value does not match the
+// checksum the server stored with it. The error is retried: the value may
+// have been damaged on its way here.
+func checkValueChecksum(key string, resp *kvpb.GetReply) error {
+	if !resp.HasValueCrc32C {
+		return nil
 	}
+	if sum := valueChecksum(resp.Value); sum != resp.ValueCrc32C {
+		return fmt.Errorf("value for %q arrived with CRC-32C %08x, but the server stored %08x", key, sum, resp.ValueCrc32C)
+	}
+	return nil
+}
+
+// cliOps are the operations --op accepts.
+var cliOps = []string{
+	"put", "get", "swap", "getorput", "merge", "jsonget", "jsonset", "delete", "undelete", "rename", "trash",
+	"deleteat", "expire", "persist", "ttl", "meta", "expiring", "scan", "copyrange", "iterate", "ls",
+	"rangestats", "randomkey", "sample", "info", "capabilities", "ping", "stats", "compact",
+	"usage", "replication", "transfer", "mirror", "promote", "watch", "drain", "verify",
+	"histogram", "query", "scrub", "scrubnow", "backup",
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `Usage (CLI mode):
-  client --manager_addrs <a,b,c> --op put    --key <k> --value <v>
-  client --manager_addrs <a,b,c> --op get    --key <k>
-  client --manager_addrs <a,b,c> --op swap   --key <k> --value <v>
-  client --manager_addrs <a,b,c> --op delete --key <k>
-  client --manager_addrs <a,b,c> --op scan   --start <k1> --end <k2>
+	fmt.Fprint(os.Stderr, `Usage (CLI mode):
+  client [--manager_addrs <a,b,c>] <command> [flags] [--] [<args>]
+  client help [<command>]
+  client --version
+  client completion bash|zsh|fish
+
+`)
+	printSubcommands(os.Stderr)
+	fmt.Fprintf(os.Stderr, `
+  CLI mode exits 0 on success, 4 if the key was not found (get, jsonget,
+  delete, deleteat, expire, ttl, meta, randomkey), had no TTL (persist),
+  had no deleted value left to restore (undelete), was not moved (rename)
+  or did not match the expected data (verify), 2 on invalid usage, 3 if
+  the request failed (see --give_up_after), and 1 on any other error.
+  A command's flags go before its arguments: everything from the first
+  argument on, or after --, is an argument, so "client merge k -5" adds -5.
+  --quiet suppresses all output, logs included, in every mode.
+
+  On a terminal, scans print their first 1000 pairs and how to continue
+  from there; --max_lines changes the limit and --max_lines 0 removes it.
+  Piped or redirected output is never cut.
+
+  completion prints a script that completes commands, flags and flag
+  values for the shell; load it with, for example,
+  source <(client completion bash).
+
+  --op <op> is the older, deprecated form of the commands, with their
+  arguments passed as the flags they are named after: "--op put --key k
+  --value v" is "put k v". The admin commands are --op stats, compact,
+  usage, replication, transfer, mirror, promote, drain, histogram, scrub,
+  scrubnow and backup.
+
+  Admin commands reach each server's Admin service where its GetServerInfo
+  says it listens, which is a separate port on servers run with
+  --admin_listen. --admin_token is sent only on those connections, for
+  servers run with --admin_token.
 
 Usage (stdin/stdout mode):
   client --manager_addrs <a,b,c>
+
+  MULTI starts a block whose PUT, GET, SWAP and DELETE commands are queued
+  and answered QUEUED; EXEC applies them atomically as one batch and prints
+  their results between EXEC BEGIN and EXEC END, and DISCARD drops them.
+  A block's keys must all be in one partition.
+
+  QUERY <select> runs a query such as
+  QUERY SELECT key FROM kv WHERE key LIKE 'user/%%' AND value = 'x' LIMIT 10
+  on every partition and prints the matching rows in key order; see
+  client help query.
+
+  WATCH <prefix> [--events put,delete,...] [--from-seq <seq>] prints changes
+  under prefix as JSON lines until the watch fails, reconnecting as needed;
+  it reads no more input. --events keeps only the named ops, and --from-seq
+  first replays each partition's log from that seq.
+
+  Add --report (and optionally --report_json <file>) to print per-op latency
+  percentiles, throughput and client allocations per op to stderr when input
+  ends. --profile_dir <dir> also writes cpu.pprof and heap.pprof of the run;
+  it works in script and replay mode too.
+
+Usage (script mode):
+  client --manager_addrs <a,b,c> --script <ops.txt> [--stop-on-error] [--var name=value ...]
+
+Usage (export mode):
+  client --manager_addrs <a,b,c> --export <dir> [--namespace <ns>]
+  client --verify_export <dir>
+  client --manager_addrs <a,b,c> --ingest <dir> [--namespace <ns>]
+
+  Writes one sorted, checksummed data file per partition plus manifest.json;
+  the format is documented in client/export.go. --ingest bulk-loads such a
+  directory through the streaming Ingest RPC.
+
+  --namespace with --export exports one namespace, the keys starting with
+  <ns>/, and records it in the manifest. --namespace with --ingest loads
+  such an export under <ns>, renaming every key, so a tenant can move to
+  another cluster or another name; without it the keys keep their names.
+
+  Export, ingest and replay show a progress bar with throughput and ETA on
+  stderr when it is a terminal, and otherwise print a PROGRESS line every
+  --progress_interval.
+
+Usage (trace replay mode):
+  client --manager_addrs <a,b,c> --replay <trace.jsonl> [--replay_speed <x>]
+
+  Every unary KVS request in the trace is re-sent: keyed ones to the key's
+  partition, the rest to the partition that recorded them.
+
+  Backfills and replays should pass --priority bulk so that a server running
+  with --max_inflight serves foreground clients first when saturated.
+
+  --durability picks when the leader acknowledges writes: local once it is
+  in the leader's log, quorum (the default) once committed, all once every
+  replica stores it. local is fastest but loses writes if the leader fails.
+
+  --trace_id <id> tags every request with an ID that servers log with
+  failed requests and append to error messages, and prefixes the client's
+  own log lines with it. It is for tracing only; unlike the per-write
+  request IDs it never deduplicates writes, so it may be reused.
+
+Live migration:
+  --migrate_to <a,b,c> repeats every PUT, SWAP and DELETE that succeeds
+  on the cluster of --manager_addrs on the cluster with those managers,
+  and refuses other writes; reads stay on the first cluster.
+  --read_compare also reads every GET from the new cluster and logs
+  differences. Failures on the new cluster are logged and counted but
+  never fail a command; the counts are logged at exit. Backfill existing
+  data with --export/--ingest and check it with verify before switching
+  over.
+
+Read cache:
+  --read_cache <n> keeps up to n GET replies of the stdin protocol and
+  scripts in memory while the server's lease on them holds. Servers grant
+  leases when started with --cache_lease and push an invalidation when a
+  leased key changes, so cached values stay current; a value can be stale
+  for at most one lease only if the client loses touch with the leader.
+
+Authentication:
+  --auth_token is sent with every request. Servers run with
+  --oidc_one_time_tokens accept each token for one request only, so the
+  second request, or a retry, with the same token is refused; give them
+  --auth_token_command instead, a shell command that prints a fresh token
+  and runs before every request and every retry. A retried write keeps its
+  request ID, so if its first attempt was applied the server answers the
+  retry from its deduplication cache, as long as the token is new.
+
+Route cache:
+  --route_cache <file> keeps the partition map and each partition's leader
+  between runs, so a request goes straight to the leader without asking the
+  manager. The map is refreshed when a server reports a wrong partition or
+  an unknown leader, or a partition's cached replicas are unreachable.
+
+Environment (flag defaults; an explicit flag wins):
+  KV_SERVER      --manager_addrs
+  KV_TIMEOUT     --timeout, e.g. 500ms
+  KV_AUTH_TOKEN  --auth_token
+  KV_ADMIN_TOKEN --admin_token
 `)
 }
 
 func main() {
-	managerAddrsRaw := flag.String("manager_addrs", "127.0.0.1:3666", "comma-separated manager ip:port list")
-	op := flag.String("op", "", "operation: put|get|swap|delete|scan")
+	managerAddrsRaw := flag.String("manager_addrs", envString(envServer, "127.0.0.1:3666"), "comma-separated manager ip:port list (env "+envServer+")")
+	op := flag.String("op", "", "operation: "+strings.Join(cliOps, "|"))
+	count := flag.Int("count", 1, "number of pings per server for --op ping, or keys to draw for --op sample")
 	key := flag.String("key", "", "key for put/get/swap/delete")
-	value := flag.String("value", "", "value for put/swap")
+	value := flag.String("value", "", "value for put/swap, the default for getorput, or the operand for merge")
+	valueTypeName := flag.String("value_type", "string", "put/swap: string, or int to make the key an integer that refuses non-integer writes")
+	contentType := flag.String("content_type", "", "put/swap: media type to tag the value with, e.g. application/json; get prints it")
+	mergeOperator := flag.String("merge_operator", "", "merge: server merge operator that folds --value into the key's value, e.g. int-add")
+	path := flag.String("path", "", "jsonget/jsonset: field of a JSON value, e.g. profile.emails[0]; empty for the whole document")
+	newKey := flag.String("new_key", "", "rename: key to move --key's value to; it must be in the same partition")
+	overwrite := flag.Bool("overwrite", false, "rename: replace a value already stored under --new_key")
 	start := flag.String("start", "", "scan start key")
 	end := flag.String("end", "", "scan end key")
-	timeout := flag.Duration("timeout", 2*time.Second, "rpc timeout")
-	retry := flag.Duration("retry_interval", time.Second, "retry interval")
+	maxLines := flag.Int("max_lines", -1, "scan: print at most this many pairs, then how to continue; -1 limits to "+strconv.Itoa(ttyScanLines)+" when stdout is a terminal, 0 never limits")
+	sql := flag.String("sql", "", "query: SELECT statement to run, e.g. \"SELECT key, value FROM kv WHERE key LIKE ? LIMIT 10\"")
+	var params queryParams
+	flag.Var(&params, "param", "query: value for the next ? placeholder; may be repeated")
+	file := flag.String("file", "", "verify: JSON object of the keys and values the cluster should hold")
+	dstPrefix := flag.String("dst_prefix", "", "copyrange: prefix prepended to each copied key")
+	at := flag.String("at", "", "deletion time for deleteat: an RFC3339 timestamp or +duration from now")
+	ttl := flag.Duration("ttl", 0, "time to live for expire, e.g. 30s")
+	within := flag.Duration("within", 0, "window for expiring: list keys due for deletion within this long")
+	limit := flag.Int("limit", 0, "maximum keys for expiring, iterate or trash (per partition), events for watch, or prefixes per list for histogram; 0 uses the default (watch: no limit)")
+	cursor := flag.String("cursor", "", "iterate or ls: resume from the next= cursor of a previous page")
+	prefix := flag.String("prefix", "", "ls: list the children of this key prefix; watch: watch keys under it; verify: compare only keys under it")
+	delimiter := flag.String("delimiter", "/", "ls, histogram: separator between key levels")
+	depth := flag.Int("depth", 1, "histogram: group keys by their first this many levels")
+	sampleSize := flag.Int("sample_size", 1000, "histogram: keys to sample per partition")
+	partition := flag.Int("partition", -1, "transfer: partition whose leader moves; watch: partition to watch (default all)")
+	target := flag.Int("target", -1, "transfer: replica ID that becomes the leader; drain: replica ID to drain")
+	startSeq := flag.Uint64("start_seq", 0, "watch: replay the partition's changes from this seq before streaming live ones")
+	coalesce := flag.Bool("coalesce", false, "watch: let the server replace a pending event with a newer one for the same key when the client falls behind")
+	dropOnLag := flag.Bool("drop_on_lag", false, "watch: lose events instead of being disconnected when the client falls too far behind")
+	timeout := flag.Duration("timeout", envDuration(envTimeout, 2*time.Second), "rpc timeout (env "+envTimeout+")")
+	retry := flag.Duration("retry_interval", time.Second, "initial retry interval")
+	maxRetry := flag.Duration("max_retry_interval", 4*time.Second, "cap for the exponential retry backoff")
+	connectTimeout := flag.Duration("connect_timeout", time.Second, "how long to wait for a server connection before treating it as unreachable")
+	replay := flag.String("replay", "", "replay a server --trace_path file against the cluster")
+	replaySpeed := flag.Float64("replay_speed", 1, "replay speed multiplier; 0 replays as fast as possible")
+	script := flag.String("script", "", "run a file of stdin-protocol commands; supports FOR/END loops and ${name} variables")
+	stopOnError := flag.Bool("stop-on-error", false, "abort --script at the first failing command")
+	vars := scriptVars{}
+	flag.Var(vars, "var", "script variable as name=value; may be repeated")
+	giveUpAfter := flag.Duration("give_up_after", 0, "fail a request after retrying this long; 0 retries forever")
+	quiet := flag.Bool("quiet", false, "print nothing, logs included; in CLI mode the outcome is reported only through the exit code")
+	authToken := flag.String("auth_token", envString(envAuthToken, ""), "bearer token sent with every server request, such as a JWT from the servers' --oidc_issuer (env "+envAuthToken+")")
+	authTokenCommand := flag.String("auth_token_command", "", "shell command run before every server request, retries included, whose output is sent as its bearer token in place of --auth_token; for servers run with --oidc_one_time_tokens, which accept each token once")
+	adminToken := flag.String("admin_token", envString(envAdminToken, ""), "bearer token sent with admin requests, for servers run with --admin_token (env "+envAdminToken+")")
+	priority := flag.String("priority", "", "request priority class: high|normal|bulk; servers with --max_inflight admit high first and bulk last")
+	durability := flag.String("durability", "", "write acknowledgment level: local|quorum|all; empty uses the server default, quorum")
+	traceID := flag.String("trace_id", "", "ID sent with every request and prefixed to this client's logs, so one operation can be followed through client and server logs")
+	report := flag.Bool("report", false, "stdin/script mode: print per-op latency percentiles to stderr at exit")
+	reportJSON := flag.String("report_json", "", "also write the --report summary as JSON to this file")
+	profileDir := flag.String("profile_dir", "", "stdin/script/replay mode: write CPU and heap profiles of the client run here and add them to the report; implies --report")
+	export := flag.String("export", "", "write the whole key space to this directory in the export format")
+	ingest := flag.String("ingest", "", "bulk-load an export directory into the cluster")
+	namespace := flag.String("namespace", "", "with --export, export only this namespace, the keys starting with <namespace>/; with --ingest, load a namespace export under this namespace instead of its own")
+	verifyExportDir := flag.String("verify_export", "", "check the files of an export directory against its manifest and exit")
+	routeCachePath := flag.String("route_cache", "", "file caching the partition map and leaders between runs, so requests skip the manager and go straight to the leader")
+	routeCacheTTL := flag.Duration("route_cache_ttl", 10*time.Minute, "ignore a --route_cache older than this; 0 never expires it")
+	progressInterval := flag.Duration("progress_interval", 10*time.Second, "export/ingest/replay: how often to print a PROGRESS line to stderr when it is not a terminal, which gets a progress bar instead; 0 prints none")
+	migrateTo := flag.String("migrate_to", "", "comma-separated managers of a second cluster that PUT, SWAP and DELETE are repeated on, for a live migration to it")
+	readCacheSize := flag.Int("read_cache", 0, "stdin/script mode: cache up to this many GET replies while the server's lease on them holds; servers need --cache_lease; 0 disables")
+	readCompare := flag.Bool("read_compare", false, "with --migrate_to: also read every GET from the second cluster and log values that differ")
+	checkHealth := flag.Bool("check_health", false, "probe every replica's health service at startup and log the ones that are down")
+	showVersion := flag.Bool("version", false, "print client build information and exit")
 	flag.Usage = usage
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("client %s\n", buildinfo.Read())
+		return
+	}
+	if flag.Arg(0) == "completion" {
+		os.Exit(printCompletion(os.Stdout, flag.Args()[1:]))
+	}
+	opFlag := *op
+	if flag.NArg() > 0 {
+		if opFlag != "" {
+			os.Exit(usageError("--op cannot be combined with a command"))
+		}
+		name, code := parseSubcommand(flag.Args())
+		if code >= 0 {
+			os.Exit(code)
+		}
+		*op = name
+	}
+
+	out := io.Writer(os.Stdout)
+	if *quiet {
+		out = io.Discard
+		log.SetOutput(io.Discard)
+	}
+
+	if *traceID != "" {
+		if len(*traceID) > 128 || strings.ContainsFunc(*traceID, func(r rune) bool { return r <= ' ' || r > '~' }) {
+			os.Exit(usageError("trace_id must be at most 128 printable ASCII characters without spaces"))
+		}
+		log.SetPrefix("[trace_id=" + *traceID + "] ")
+	}
+	if opFlag != "" {
+		log.Printf("--op is deprecated; run \"client help\" for the commands that replace it")
+	}
+	if os.Getenv(envTLSCA) != "" {
+		log.Printf("ignoring %s: the cluster does not serve TLS", envTLSCA)
+	}
+
+	switch *priority {
+	case "", "high", "normal", "bulk":
+	default:
+		os.Exit(usageError("priority must be high, normal or bulk, got %q", *priority))
+	}
+	var valueType kvpb.ValueType
+	switch *valueTypeName {
+	case "string":
+	case "int":
+		valueType = kvpb.ValueType_VALUE_TYPE_INT64
+	default:
+		os.Exit(usageError("value_type must be string or int, got %q", *valueTypeName))
+	}
+	switch *durability {
+	case "", "local", "quorum", "all":
+	default:
+		os.Exit(usageError("durability must be local, quorum or all, got %q", *durability))
+	}
+
+	if *verifyExportDir != "" {
+		if err := verifyExport(*verifyExportDir); err != nil {
+			log.Fatalf("verify failed: %v", err)
+		}
+		return
+	}
+
 	managerAddrs := parseCommaList(*managerAddrsRaw)
 	if len(managerAddrs) == 0 {
-		log.Fatalf("manager_addrs must not be empty")
+		os.Exit(usageError("manager_addrs must not be empty"))
+	}
+	partitions, leaders, cached := [][]string(nil), []string(nil), false
+	if *routeCachePath != "" {
+		partitions, leaders, cached = loadRouteCache(*routeCachePath, managerAddrs, *routeCacheTTL)
+	}
+	if !cached {
+		partitions = fetchClusterInfo(managerAddrs, *timeout, *retry)
+	}
+	rc := newRoutedClient(partitions, *timeout, *connectTimeout, *retry, *maxRetry)
+	rc.managerAddrs = managerAddrs
+	rc.routeCachePath = *routeCachePath
+	rc.routesDirty = !cached
+	if cached {
+		rc.seedLeaderHints(leaders)
+	}
+	rc.giveUpAfter = *giveUpAfter
+	rc.authToken = *authToken
+	rc.authTokenCommand = *authTokenCommand
+	rc.adminToken = *adminToken
+	rc.priority = *priority
+	rc.durability = *durability
+	rc.traceID = *traceID
+	rc.maxLines = *maxLines
+	rc.progressEvery = *progressInterval
+	if *quiet {
+		rc.progressEvery = -1
+	}
+	if rc.maxLines < 0 {
+		rc.maxLines = 0
+		if isTerminal(os.Stdout) {
+			rc.maxLines = ttyScanLines
+		}
 	}
-	partitions := fetchClusterInfo(managerAddrs, *timeout, *retry)
-	rc := newRoutedClient(partitions, *timeout, *retry)
+	if *report || *reportJSON != "" || *profileDir != "" {
+		rc.report = newLatencyReport()
+		if *profileDir != "" {
+			if err := rc.report.startProfile(*profileDir); err != nil {
+				log.Fatalf("profile: %v", err)
+			}
+		}
+	}
+	if *migrateTo != "" {
+		if *ingest != "" || *export != "" || *replay != "" {
+			os.Exit(usageError("--migrate_to works with commands, the stdin protocol and scripts, not with export, ingest or replay"))
+		}
+		rc.migration = newMigrationTarget(rc, strings.Split(*migrateTo, ","), *readCompare)
+	}
+	rc.readCache = newReadCache(rc, *readCacheSize)
 	defer rc.close()
+	// Probing every replica costs a dial each, so it is opt-in; otherwise
+	// replicas are dialed as requests need them.
+	if *checkHealth {
+		if down := rc.checkHealth(); len(down) > 0 {
+			log.Printf("server unreachable: no healthy replica in partitions %v; requests to them will retry", down)
+		}
+	}
+	if *durability != "" && *durability != "quorum" && !rc.supports(featureDurability) {
+		log.Printf("servers do not support durability levels; writes are acknowledged at quorum")
+	}
 
-	if *op != "" {
-		cliMode(rc, strings.ToLower(*op), *key, *value, *start, *end)
+	if *ingest != "" {
+		if err := ingestMode(rc, *ingest, *namespace); err != nil {
+			log.Fatalf("ingest failed: %v", err)
+		}
+	} else if *export != "" {
+		if err := exportMode(rc, *export, *namespace); err != nil {
+			log.Fatalf("export failed: %v", err)
+		}
+	} else if *replay != "" {
+		if err := replayMode(rc, *replay, *replaySpeed); err != nil {
+			log.Fatalf("replay failed: %v", err)
+		}
+		finishReport(rc.report, *reportJSON)
+	} else if *script != "" {
+		failed, err := scriptMode(rc, *script, vars, *stopOnError)
+		if err != nil {
+			log.Fatalf("script failed: %v", err)
+		}
+		finishReport(rc.report, *reportJSON)
+		if failed > 0 {
+			rc.close()
+			os.Exit(1)
+		}
+	} else if *op != "" {
+		code := cliMode(rc, out, strings.ToLower(*op), cliOptions{
+			key:           *key,
+			value:         *value,
+			newKey:        *newKey,
+			start:         *start,
+			end:           *end,
+			dstPrefix:     *dstPrefix,
+			at:            *at,
+			ttl:           *ttl,
+			within:        *within,
+			cursor:        *cursor,
+			prefix:        *prefix,
+			delimiter:     *delimiter,
+			limit:         *limit,
+			count:         *count,
+			partition:     *partition,
+			target:        *target,
+			startSeq:      *startSeq,
+			coalesce:      *coalesce,
+			dropOnLag:     *dropOnLag,
+			overwrite:     *overwrite,
+			mergeOperator: *mergeOperator,
+			valueType:     valueType,
+			contentType:   *contentType,
+			file:          *file,
+			sampleSize:    *sampleSize,
+			depth:         *depth,
+			sql:           *sql,
+			params:        params,
+			path:          *path,
+		})
+		if code != exitOK {
+			rc.close()
+			os.Exit(code)
+		}
 	} else {
 		stdinMode(rc)
+		finishReport(rc.report, *reportJSON)
 	}
 }
 
-func cliMode(c *routedClient, op, key, value, start, end string) {
+func finishReport(r *latencyReport, jsonPath string) {
+	if r == nil {
+		return
+	}
+	if err := r.finish(); err != nil {
+		log.Printf("write profiles: %v", err)
+	}
+	r.print(os.Stderr)
+	if jsonPath != "" {
+		if err := r.writeJSON(jsonPath); err != nil {
+			log.Printf("write report: %v", err)
+		}
+	}
+}
+
+// Exit codes for CLI mode, so shell scripts can branch on the outcome. Flag
+// parsing errors already exit with 2 through the flag package.
+const (
+	exitOK       = 0
+	exitUsage    = 2
+	exitRPCError = 3
+	// exitNotFound is not 1, which log.Fatalf and other failures exit with.
+	exitNotFound = 4
+)
+
+func usageError(format string, args ...interface{}) int {
+	log.Printf(format, args...)
+	return exitUsage
+}
+
+func rpcFailed(err error) int {
+	log.Printf("rpc failed: %s", describeError(err))
+	return exitRPCError
+}
+
+// cliOptions are the flags and arguments a CLI command reads. Each command
+// uses the few it needs; the rest keep their flag defaults.
+type cliOptions struct {
+	key, value, newKey    string
+	start, end, dstPrefix string
+	at                    string
+	ttl, within           time.Duration
+	cursor                string
+	prefix, delimiter     string
+	limit, count          int
+	partition, target     int
+	startSeq              uint64
+	coalesce, dropOnLag   bool
+	overwrite             bool
+	mergeOperator         string
+	valueType             kvpb.ValueType
+	contentType           string
+	file                  string
+	sampleSize, depth     int
+	sql                   string
+	params                []string
+	path                  string
+}
+
+// cliMode runs a single --op and returns the process exit code. Output goes
+// to w, which is io.Discard under --quiet.
+func cliMode(c *routedClient, w io.Writer, op string, opts cliOptions) int {
+	if err := c.migration.checkMigrationCommand(strings.ToUpper(op)); err != nil {
+		return usageError("%v", err)
+	}
 	switch op {
 	case "put":
-		if key == "" || value == "" {
-			log.Fatalf("put requires --key and --value")
+		if opts.key == "" || opts.value == "" {
+			return usageError("put requires --key and --value")
 		}
 		var resp *kvpb.PutReply
 		reqID := c.nextMutationRequestID()
-		partition := ownerForKey(key, len(c.partitions))
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		partition := ownerForKey(opts.key, len(c.partitions))
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
 			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-			resp, err = cli.Put(ctx, &kvpb.PutRequest{Key: key, Value: value})
+			resp, err = cli.Put(ctx, &kvpb.PutRequest{Key: opts.key, Value: opts.value, ValueType: opts.valueType, ContentType: opts.contentType, ValueCrc32C: valueChecksum(opts.value), HasValueCrc32C: true})
 			return err
-		})
-		fmt.Printf("PUT %s %s (found=%v)\n", key, value, resp.Found)
+		}); err != nil {
+			return rpcFailed(err)
+		}
+		c.migration.put(opts.key, opts.value, opts.valueType, opts.contentType)
+		fmt.Fprintf(w, "PUT %s %s (found=%v seq=%d)\n", opts.key, opts.value, resp.Found, resp.Seq)
 	case "get":
-		if key == "" {
-			log.Fatalf("get requires --key")
+		if opts.key == "" {
+			return usageError("get requires --key")
 		}
 		var resp *kvpb.GetReply
-		partition := ownerForKey(key, len(c.partitions))
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		partition := ownerForKey(opts.key, len(c.partitions))
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
-			resp, err = cli.Get(ctx, &kvpb.GetRequest{Key: key})
-			return err
-		})
+			if resp, err = cli.Get(ctx, &kvpb.GetRequest{Key: opts.key}); err != nil {
+				return err
+			}
+			return checkValueChecksum(opts.key, resp)
+		}); err != nil {
+			return rpcFailed(err)
+		}
+		c.migration.compareGet(opts.key, resp.Value, resp.Found)
 		if !resp.Found {
-			fmt.Printf("GET %s null\n", key)
+			fmt.Fprintf(w, "GET %s null\n", opts.key)
+			return exitNotFound
+		} else if resp.ContentType != "" {
+			fmt.Fprintf(w, "GET %s %s (content_type=%s)\n", opts.key, resp.Value, resp.ContentType)
 		} else {
-			fmt.Printf("GET %s %s\n", key, resp.Value)
+			fmt.Fprintf(w, "GET %s %s\n", opts.key, resp.Value)
 		}
 	case "swap":
-		if key == "" || value == "" {
-			log.Fatalf("swap requires --key and --value")
+		if opts.key == "" || opts.value == "" {
+			return usageError("swap requires --key and --value")
 		}
 		var resp *kvpb.SwapReply
 		reqID := c.nextMutationRequestID()
-		partition := ownerForKey(key, len(c.partitions))
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		partition := ownerForKey(opts.key, len(c.partitions))
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
 			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-			resp, err = cli.Swap(ctx, &kvpb.SwapRequest{Key: key, Value: value})
+			resp, err = cli.Swap(ctx, &kvpb.SwapRequest{Key: opts.key, Value: opts.value, ValueType: opts.valueType, ContentType: opts.contentType})
 			return err
-		})
+		}); err != nil {
+			return rpcFailed(err)
+		}
+		c.migration.put(opts.key, opts.value, opts.valueType, opts.contentType)
 		if !resp.Found {
-			fmt.Printf("SWAP %s null\n", key)
+			fmt.Fprintf(w, "SWAP %s null (seq=%d)\n", opts.key, resp.Seq)
 		} else {
-			fmt.Printf("SWAP %s old=%s new=%s\n", key, resp.OldValue, value)
+			fmt.Fprintf(w, "SWAP %s old=%s new=%s (seq=%d)\n", opts.key, resp.OldValue, opts.value, resp.Seq)
 		}
 	case "delete":
-		if key == "" {
-			log.Fatalf("delete requires --key")
+		if opts.key == "" {
+			return usageError("delete requires --key")
 		}
 		var resp *kvpb.DeleteReply
 		reqID := c.nextMutationRequestID()
-		partition := ownerForKey(key, len(c.partitions))
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		partition := ownerForKey(opts.key, len(c.partitions))
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
 			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-			resp, err = cli.Delete(ctx, &kvpb.DeleteRequest{Key: key})
+			resp, err = cli.Delete(ctx, &kvpb.DeleteRequest{Key: opts.key})
 			return err
-		})
-		fmt.Printf("DELETE %s (found=%v)\n", key, resp.Found)
+		}); err != nil {
+			return rpcFailed(err)
+		}
+		c.migration.delete(opts.key)
+		fmt.Fprintf(w, "DELETE %s (found=%v seq=%d)\n", opts.key, resp.Found, resp.Seq)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "getorput":
+		if opts.key == "" || opts.value == "" {
+			return usageError("getorput requires --key and --value")
+		}
+		resp, err := getOrPut(c, opts.key, opts.value)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "GETORPUT %s %s (found=%v seq=%d)\n", opts.key, resp.Value, resp.Found, resp.Seq)
+	case "merge":
+		if opts.key == "" || opts.value == "" || opts.mergeOperator == "" {
+			return usageError("merge requires --key, --value and --merge_operator")
+		}
+		resp, err := mergeValue(c, opts.key, opts.value, opts.mergeOperator)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "MERGE %s %s (merged=%v seq=%d)\n", opts.key, resp.Value, resp.Merged, resp.Seq)
+	case "jsonget":
+		if opts.key == "" {
+			return usageError("jsonget requires --key")
+		}
+		resp, err := jsonGet(c, opts.key, opts.path)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		if !resp.Found {
+			fmt.Fprintf(w, "JSONGET %s %s null\n", opts.key, jsonPathOrRoot(opts.path))
+			return exitNotFound
+		}
+		fmt.Fprintf(w, "JSONGET %s %s %s\n", opts.key, jsonPathOrRoot(opts.path), resp.Value)
+	case "jsonset":
+		if opts.key == "" || opts.value == "" {
+			return usageError("jsonset requires --key and --value")
+		}
+		resp, err := jsonSet(c, opts.key, opts.path, opts.value)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "JSONSET %s %s (set=%v seq=%d)\n", opts.key, resp.Document, resp.Set, resp.Seq)
+	case "undelete":
+		if opts.key == "" {
+			return usageError("undelete requires --key")
+		}
+		resp, err := undeleteKey(c, opts.key)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "UNDELETE %s %s (found=%v seq=%d)\n", opts.key, resp.Value, resp.Found, resp.Seq)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "rename":
+		if opts.key == "" || opts.newKey == "" {
+			return usageError("rename requires --key and --new_key")
+		}
+		resp, err := renameKey(c, opts.key, opts.newKey, opts.overwrite)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "RENAME %s %s (found=%v renamed=%v seq=%d)\n", opts.key, opts.newKey, resp.Found, resp.Renamed, resp.Seq)
+		if !resp.Renamed {
+			return exitNotFound
+		}
+	case "deleteat":
+		if opts.key == "" || opts.at == "" {
+			return usageError("deleteat requires --key and --at")
+		}
+		when, err := parseDeleteTime(opts.at)
+		if err != nil {
+			return usageError("deleteat: %v", err)
+		}
+		resp, err := deleteAt(c, opts.key, when)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "DELETEAT %s %s (found=%v seq=%d)\n", opts.key, when.Format(time.RFC3339), resp.Found, resp.Seq)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "expire":
+		if opts.key == "" || opts.ttl <= 0 {
+			return usageError("expire requires --key and a positive --ttl")
+		}
+		resp, err := expireKey(c, opts.key, opts.ttl)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "EXPIRE %s %s (found=%v seq=%d)\n", opts.key, opts.ttl, resp.Found, resp.Seq)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "persist":
+		if opts.key == "" {
+			return usageError("persist requires --key")
+		}
+		resp, err := persistKey(c, opts.key)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "PERSIST %s (found=%v seq=%d)\n", opts.key, resp.Found, resp.Seq)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "ttl":
+		if opts.key == "" {
+			return usageError("ttl requires --key")
+		}
+		resp, err := keyTTL(c, opts.key)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "TTL %s %s\n", opts.key, formatTTL(resp))
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "meta":
+		if opts.key == "" {
+			return usageError("meta requires --key")
+		}
+		resp, err := keyMeta(c, opts.key)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printKeyMeta(w, opts.key, resp)
+		if !resp.Found {
+			return exitNotFound
+		}
+	case "expiring":
+		if opts.within < 0 || opts.limit < 0 {
+			return usageError("expiring requires a non-negative --within and --limit")
+		}
+		keys, truncated, err := scanExpiring(c, opts.within, opts.limit)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printExpiring(w, opts.within, keys, truncated)
 	case "scan":
-		if start == "" || end == "" {
-			log.Fatalf("scan requires --start and --end")
+		if opts.start == "" || opts.end == "" {
+			return usageError("scan requires --start and --end")
+		}
+		pairs, err := scanAll(c, opts.start, opts.end)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		fmt.Fprintf(w, "SCAN %s %s (%d pairs)\n", opts.start, opts.end, len(pairs))
+		shown, next := c.scanShown(pairs)
+		for _, p := range shown {
+			fmt.Fprintf(w, "  %s %s\n", p.Key, p.Value)
+		}
+		if next != "" {
+			fmt.Fprintf(w, "  ... %d more pairs not shown; continue with --start %s, or pass --max_lines 0\n", len(pairs)-len(shown), next)
+		}
+	case "query":
+		if opts.sql == "" {
+			return usageError("query requires --sql")
+		}
+		reply, err := queryAll(c, opts.sql, opts.params)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printQuery(w, reply)
+	case "copyrange":
+		if opts.start == "" || opts.end == "" || opts.dstPrefix == "" {
+			return usageError("copyrange requires --start, --end and --dst_prefix")
+		}
+		if err := printCopyRange(w, c, opts.start, opts.end, opts.dstPrefix); err != nil {
+			return rpcFailed(err)
+		}
+	case "iterate":
+		if opts.limit < 0 {
+			return usageError("iterate requires a non-negative --limit")
+		}
+		if opts.limit == 0 {
+			opts.limit = defaultIteratePage
+		}
+		if _, _, err := parseIterateCursor(opts.cursor, len(c.partitions)); err != nil {
+			return usageError("iterate: %v", err)
+		}
+		pairs, next, err := iteratePage(c, opts.cursor, opts.limit)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printIteratePage(w, pairs, next)
+	case "ls":
+		if opts.limit < 0 || opts.delimiter == "" {
+			return usageError("ls requires a non-negative --limit and a non-empty --delimiter")
+		}
+		if opts.limit == 0 {
+			opts.limit = defaultListDirPage
+		}
+		entries, next, err := listDir(c, opts.prefix, opts.delimiter, opts.cursor, opts.limit)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printListDir(w, opts.prefix, entries, next)
+	case "rangestats":
+		if opts.start == "" || opts.end == "" {
+			return usageError("rangestats requires --start and --end")
+		}
+		stats, err := rangeStats(c, opts.start, opts.end)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printRangeStats(w, opts.start, opts.end, stats)
+	case "randomkey":
+		key, found, err := randomKey(c)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		if !found {
+			fmt.Fprintln(w, "RANDOMKEY null")
+			return exitNotFound
+		}
+		fmt.Fprintf(w, "RANDOMKEY %s\n", key)
+	case "sample":
+		if opts.count < 1 {
+			return usageError("sample requires a positive --count")
+		}
+		keys, population, err := sampleKeys(c, opts.count)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		printSample(w, keys, population)
+	case "info":
+		printServerInfo(c, w)
+	case "capabilities":
+		version, features := c.capabilities()
+		names := make([]string, 0, len(features))
+		for f := range features {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "CAPABILITIES api_version=%d features=%s\n", version, strings.Join(names, ","))
+	case "ping":
+		pingAll(c, w, opts.count)
+	case "stats":
+		printStats(c, w)
+	case "compact":
+		compactAll(c, w)
+	case "scrub", "scrubnow":
+		scrubAll(c, w, op == "scrubnow")
+	case "backup":
+		backupAll(c, w)
+	case "usage":
+		printNamespaceUsage(c, w)
+	case "replication":
+		printReplicationStatus(c, w)
+	case "histogram":
+		if opts.sampleSize <= 0 || opts.depth <= 0 || opts.limit < 0 || opts.delimiter == "" {
+			return usageError("histogram requires a positive --sample_size and --depth, a non-negative --limit and a --delimiter")
 		}
-		pairs := scanAll(c, start, end)
-		fmt.Printf("SCAN %s %s (%d pairs)\n", start, end, len(pairs))
-		for _, p := range pairs {
-			fmt.Printf("  %s %s\n", p.Key, p.Value)
+		return printKeyspaceHistogram(c, w, opts.sampleSize, opts.delimiter, opts.depth, opts.limit)
+	case "transfer":
+		if opts.partition < 0 || opts.partition >= len(c.partitions) || opts.target < 0 {
+			return usageError("transfer requires --partition in [0,%d) and --target", len(c.partitions))
 		}
+		return transferLeadership(c, w, opts.partition, opts.target)
+	case "mirror":
+		printMirrorStatus(c, w)
+	case "promote":
+		return promoteMirror(c, w)
+	case "trash":
+		if opts.start == "" || opts.end == "" || opts.limit < 0 {
+			return usageError("trash requires --start and --end, and a non-negative --limit")
+		}
+		return printDeleted(c, w, opts.start, opts.end, opts.limit)
+	case "drain":
+		if opts.partition < 0 || opts.partition >= len(c.partitions) || opts.target < 0 || opts.target >= len(c.partitions[opts.partition]) {
+			return usageError("drain requires --partition in [0,%d) and --target naming one of its replicas", len(c.partitions))
+		}
+		return drainReplica(c, w, opts.partition, opts.target)
+	case "verify":
+		if opts.file == "" {
+			return usageError("verify requires --file")
+		}
+		return verifyContents(c, w, opts.file, opts.prefix)
+	case "watch":
+		if opts.limit < 0 {
+			return usageError("watch requires a non-negative --limit")
+		}
+		if opts.partition >= len(c.partitions) {
+			return usageError("watch --partition must be in [0,%d)", len(c.partitions))
+		}
+		if opts.startSeq > 0 && opts.partition < 0 && len(c.partitions) > 1 {
+			return usageError("watch --start_seq is a position in one partition's log; pick it with --partition")
+		}
+		return watchKeys(c, w, &kvpb.WatchRequest{Prefix: opts.prefix, Coalesce: opts.coalesce, DropOnLag: opts.dropOnLag, StartSeq: opts.startSeq}, opts.partition, opts.limit)
 	default:
-		log.Fatalf("unknown --op %q (expected put|get|swap|delete|scan)", op)
+		return usageError("unknown --op %q (expected %s)", op, strings.Join(cliOps, "|"))
+	}
+	return exitOK
+}
+
+// printServerInfo asks every replica, not just leaders, which build it runs.
+func printServerInfo(c *routedClient, w io.Writer) {
+	if !c.supports(featureServerInfo) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "INFO unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	for partition, addrs := range c.partitions {
+		for _, addr := range addrs {
+			cli, err := c.ensureConn(addr)
+			if err != nil {
+				fmt.Fprintf(w, "INFO partition=%d addr=%s error=%v\n", partition, addr, err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			resp, err := cli.GetServerInfo(ctx, &kvpb.GetServerInfoRequest{})
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "INFO partition=%d addr=%s error=%v\n", partition, addr, err)
+				c.resetConn(addr)
+				continue
+			}
+			info := buildinfo.Info{
+				Version:   resp.Version,
+				Commit:    resp.GitCommit,
+				BuildTime: resp.BuildTime,
+				GoVersion: resp.GoVersion,
+				Modified:  resp.Modified,
+			}
+			fmt.Fprintf(w, "INFO partition=%d replica=%d addr=%s role=%s %s\n", resp.PartitionId, resp.ReplicaId, addr, resp.Role, info)
+		}
 	}
 }
 
-func scanAll(c *routedClient, startKey, endKey string) []*kvpb.KVPair {
+func scanAll(c *routedClient, startKey, endKey string) ([]*kvpb.KVPair, error) {
 	if startKey == endKey {
-		partition := ownerForKey(startKey, len(c.partitions))
-		var resp *kvpb.ScanReply
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		return scanPartition(c, ownerForKey(startKey, len(c.partitions)), startKey, endKey)
+	}
+
+	merged := make([]*kvpb.KVPair, 0)
+	for partition := range c.partitions {
+		pairs, err := scanPartition(c, partition, startKey, endKey)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, pairs...)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+	return merged, nil
+}
+
+// runCommand executes one line of the stdin protocol and prints its result.
+// It reports whether the line was STOP.
+func runCommand(c *routedClient, line string) (bool, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return false, nil
+	}
+	cmd := strings.ToUpper(parts[0])
+	if err := c.migration.checkMigrationCommand(cmd); err != nil {
+		return false, err
+	}
+	if cmd != "GET" {
+		c.readCache.forget(parts[1:]...)
+	}
+	if handled, err := runMulti(c, cmd, parts); handled {
+		return false, err
+	}
+
+	switch cmd {
+	case "PUT":
+		if len(parts) < 3 {
+			return false, errors.New("PUT requires 2 arguments: key value")
+		}
+		k, v := parts[1], parts[2]
+		partition := ownerForKey(k, len(c.partitions))
+		var resp *kvpb.PutReply
+		reqID := c.nextMutationRequestID()
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
-			resp, err = cli.Scan(ctx, &kvpb.ScanRequest{StartKey: startKey, EndKey: endKey})
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+			resp, err = cli.Put(ctx, &kvpb.PutRequest{Key: k, Value: v, ValueCrc32C: valueChecksum(v), HasValueCrc32C: true})
 			return err
-		})
-		return resp.Pairs
+		}); err != nil {
+			return false, err
+		}
+		c.migration.put(k, v, kvpb.ValueType_VALUE_TYPE_STRING, "")
+		if resp.Found {
+			fmt.Printf("PUT %s found\n", k)
+		} else {
+			fmt.Printf("PUT %s not_found\n", k)
+		}
+	case "GET":
+		if len(parts) < 2 {
+			return false, errors.New("GET requires 1 argument: key")
+		}
+		k := parts[1]
+		if v, found, ok := c.readCache.get(k); ok {
+			if !found {
+				fmt.Printf("GET %s null\n", k)
+			} else {
+				fmt.Printf("GET %s %s\n", k, v)
+			}
+			return false, nil
+		}
+		partition := ownerForKey(k, len(c.partitions))
+		holder, gen := c.readCache.holder(partition)
+		sent := time.Now()
+		var resp *kvpb.GetReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			if resp, err = cli.Get(ctx, &kvpb.GetRequest{Key: k, LeaseHolder: holder}); err != nil {
+				return err
+			}
+			return checkValueChecksum(k, resp)
+		}); err != nil {
+			return false, err
+		}
+		c.readCache.store(k, partition, gen, resp, sent)
+		c.migration.compareGet(k, resp.Value, resp.Found)
+		if !resp.Found {
+			fmt.Printf("GET %s null\n", k)
+		} else {
+			fmt.Printf("GET %s %s\n", k, resp.Value)
+		}
+	case "SWAP":
+		if len(parts) < 3 {
+			return false, errors.New("SWAP requires 2 arguments: key value")
+		}
+		k, v := parts[1], parts[2]
+		partition := ownerForKey(k, len(c.partitions))
+		var resp *kvpb.SwapReply
+		reqID := c.nextMutationRequestID()
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+			resp, err = cli.Swap(ctx, &kvpb.SwapRequest{Key: k, Value: v})
+			return err
+		}); err != nil {
+			return false, err
+		}
+		c.migration.put(k, v, kvpb.ValueType_VALUE_TYPE_STRING, "")
+		if !resp.Found {
+			fmt.Printf("SWAP %s null\n", k)
+		} else {
+			fmt.Printf("SWAP %s %s\n", k, resp.OldValue)
+		}
+	case "DELETE":
+		if len(parts) < 2 {
+			return false, errors.New("DELETE requires 1 argument: key")
+		}
+		k := parts[1]
+		partition := ownerForKey(k, len(c.partitions))
+		var resp *kvpb.DeleteReply
+		reqID := c.nextMutationRequestID()
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+			resp, err = cli.Delete(ctx, &kvpb.DeleteRequest{Key: k})
+			return err
+		}); err != nil {
+			return false, err
+		}
+		c.migration.delete(k)
+		if resp.Found {
+			fmt.Printf("DELETE %s found\n", k)
+		} else {
+			fmt.Printf("DELETE %s not_found\n", k)
+		}
+	case "DELETEAT":
+		if len(parts) < 3 {
+			return false, errors.New("DELETEAT requires 2 arguments: key time")
+		}
+		k := parts[1]
+		when, err := parseDeleteTime(parts[2])
+		if err != nil {
+			return false, err
+		}
+		resp, err := deleteAt(c, k, when)
+		if err != nil {
+			return false, err
+		}
+		if resp.Found {
+			fmt.Printf("DELETEAT %s found\n", k)
+		} else {
+			fmt.Printf("DELETEAT %s not_found\n", k)
+		}
+	case "EXPIRE":
+		if len(parts) < 3 {
+			return false, errors.New("EXPIRE requires 2 arguments: key ttl")
+		}
+		k := parts[1]
+		ttl, err := time.ParseDuration(parts[2])
+		if err != nil || ttl <= 0 {
+			return false, fmt.Errorf("EXPIRE ttl must be a positive duration, got %q", parts[2])
+		}
+		resp, err := expireKey(c, k, ttl)
+		if err != nil {
+			return false, err
+		}
+		if resp.Found {
+			fmt.Printf("EXPIRE %s found\n", k)
+		} else {
+			fmt.Printf("EXPIRE %s not_found\n", k)
+		}
+	case "PERSIST":
+		if len(parts) < 2 {
+			return false, errors.New("PERSIST requires 1 argument: key")
+		}
+		k := parts[1]
+		resp, err := persistKey(c, k)
+		if err != nil {
+			return false, err
+		}
+		if resp.Found {
+			fmt.Printf("PERSIST %s found\n", k)
+		} else {
+			fmt.Printf("PERSIST %s not_found\n", k)
+		}
+	case "TTL":
+		if len(parts) < 2 {
+			return false, errors.New("TTL requires 1 argument: key")
+		}
+		k := parts[1]
+		resp, err := keyTTL(c, k)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("TTL %s %s\n", k, formatTTL(resp))
+	case "EXPIRING":
+		if len(parts) < 2 || len(parts) > 3 {
+			return false, errors.New("EXPIRING requires 1 or 2 arguments: within [limit]")
+		}
+		within, err := time.ParseDuration(parts[1])
+		if err != nil || within < 0 {
+			return false, fmt.Errorf("EXPIRING window must be a non-negative duration, got %q", parts[1])
+		}
+		limit := 0
+		if len(parts) == 3 {
+			if limit, err = strconv.Atoi(parts[2]); err != nil || limit < 0 {
+				return false, errors.New("EXPIRING limit must be a non-negative integer")
+			}
+		}
+		keys, truncated, err := scanExpiring(c, within, limit)
+		if err != nil {
+			return false, err
+		}
+		printExpiring(os.Stdout, within, keys, truncated)
+	case "QUERY":
+		sql := strings.TrimSpace(strings.TrimPrefix(line, parts[0]))
+		if sql == "" {
+			return false, errors.New("QUERY requires a SELECT statement")
+		}
+		reply, err := queryAll(c, sql, nil)
+		if err != nil {
+			return false, err
+		}
+		printQuery(os.Stdout, reply)
+	case "SCAN":
+		if len(parts) < 3 {
+			return false, errors.New("SCAN requires 2 arguments: start_key end_key")
+		}
+		startKey, endKey := parts[1], parts[2]
+		pairs, err := scanAll(c, startKey, endKey)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("SCAN %s %s BEGIN\n", startKey, endKey)
+		shown, next := c.scanShown(pairs)
+		for _, pair := range shown {
+			fmt.Printf("  %s %s\n", pair.Key, pair.Value)
+		}
+		if next != "" {
+			fmt.Printf("  ... %d more pairs not shown; continue with SCAN %s %s\n", len(pairs)-len(shown), next, endKey)
+		}
+		fmt.Println("SCAN END")
+	case "ITERATE":
+		if len(parts) < 2 || len(parts) > 3 {
+			return false, errors.New("ITERATE requires 1 or 2 arguments: limit [cursor]")
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit < 1 {
+			return false, errors.New("ITERATE limit must be a positive integer")
+		}
+		cursor := ""
+		if len(parts) == 3 {
+			cursor = parts[2]
+		}
+		pairs, next, err := iteratePage(c, cursor, limit)
+		if err != nil {
+			return false, err
+		}
+		printIteratePage(os.Stdout, pairs, next)
+	case "LS":
+		prefix, limit, after, err := lsArgs(parts)
+		if err != nil {
+			return false, err
+		}
+		entries, next, err := listDir(c, prefix, "/", after, limit)
+		if err != nil {
+			return false, err
+		}
+		printListDir(os.Stdout, prefix, entries, next)
+	case "RANGESTATS":
+		if len(parts) != 3 {
+			return false, errors.New("RANGESTATS requires 2 arguments: start_key end_key")
+		}
+		stats, err := rangeStats(c, parts[1], parts[2])
+		if err != nil {
+			return false, err
+		}
+		printRangeStats(os.Stdout, parts[1], parts[2], stats)
+	case "RANDOMKEY":
+		if len(parts) != 1 {
+			return false, errors.New("RANDOMKEY takes no arguments")
+		}
+		key, found, err := randomKey(c)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			fmt.Println("RANDOMKEY null")
+		} else {
+			fmt.Printf("RANDOMKEY %s\n", key)
+		}
+	case "SAMPLE":
+		if len(parts) != 2 {
+			return false, errors.New("SAMPLE requires 1 argument: n")
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return false, errors.New("SAMPLE n must be a positive integer")
+		}
+		keys, population, err := sampleKeys(c, n)
+		if err != nil {
+			return false, err
+		}
+		printSample(os.Stdout, keys, population)
+	case "PING":
+		n := 1
+		if len(parts) > 2 {
+			return false, errors.New("PING takes at most 1 argument: count")
+		}
+		if len(parts) == 2 {
+			parsed, err := strconv.Atoi(parts[1])
+			if err != nil || parsed < 1 {
+				return false, errors.New("PING count must be a positive integer")
+			}
+			n = parsed
+		}
+		pingAll(c, os.Stdout, n)
+	case "WATCH":
+		req, ops, err := parseWatchCommand(parts[1:])
+		if err != nil {
+			return false, err
+		}
+		if err := watchJSON(c, os.Stdout, req, ops); err != nil {
+			return false, err
+		}
+	case "STOP":
+		if len(parts) != 1 {
+			return false, errors.New("STOP takes no arguments")
+		}
+		fmt.Println("STOP")
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command: %s", cmd)
 	}
+	return false, nil
+}
 
-	merged := make([]*kvpb.KVPair, 0)
+// parseDeleteTime accepts an RFC3339 timestamp or "+duration" from now.
+func parseDeleteTime(raw string) (time.Time, error) {
+	if rel, ok := strings.CutPrefix(raw, "+"); ok {
+		d, err := time.ParseDuration(rel)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid delay %q: %w", raw, err)
+		}
+		return time.Now().Add(d), nil
+	}
+	when, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC3339 or +duration", raw)
+	}
+	return when, nil
+}
+
+func deleteAt(c *routedClient, key string, when time.Time) (*kvpb.DeleteAtReply, error) {
+	if !c.supports(featureDeleteAt) {
+		return nil, errors.New("server does not support scheduled deletes")
+	}
+	var resp *kvpb.DeleteAtReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.DeleteAt(ctx, &kvpb.DeleteAtRequest{Key: key, UnixNanos: when.UnixNano()})
+		return err
+	})
+	return resp, err
+}
+
+func expireKey(c *routedClient, key string, ttl time.Duration) (*kvpb.ExpireReply, error) {
+	if !c.supports(featureTTL) {
+		return nil, errors.New("server does not support TTLs")
+	}
+	var resp *kvpb.ExpireReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Expire(ctx, &kvpb.ExpireRequest{Key: key, TtlMillis: ttl.Milliseconds()})
+		return err
+	})
+	return resp, err
+}
+
+func persistKey(c *routedClient, key string) (*kvpb.PersistReply, error) {
+	if !c.supports(featureTTL) {
+		return nil, errors.New("server does not support TTLs")
+	}
+	var resp *kvpb.PersistReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Persist(ctx, &kvpb.PersistRequest{Key: key})
+		return err
+	})
+	return resp, err
+}
+
+// undeleteKey restores key's value from before its latest delete, on
+// servers that keep deleted values.
+func undeleteKey(c *routedClient, key string) (*kvpb.UndeleteReply, error) {
+	if !c.supports(featureUndelete) {
+		return nil, errors.New("server does not keep deleted values; it needs --soft_delete_retention")
+	}
+	var resp *kvpb.UndeleteReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Undelete(ctx, &kvpb.UndeleteRequest{Key: key})
+		return err
+	})
+	return resp, err
+}
+
+// getOrPut returns key's value, storing value as it first if the key has
+// none.
+func getOrPut(c *routedClient, key, value string) (*kvpb.GetOrPutReply, error) {
+	if !c.supports(featureGetOrPut) {
+		return nil, errors.New("server does not support get-or-put")
+	}
+	var resp *kvpb.GetOrPutReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.GetOrPut(ctx, &kvpb.GetOrPutRequest{Key: key, Value: value})
+		return err
+	})
+	return resp, err
+}
+
+// mergeValue folds operand into key's value with the named server merge
+// operator.
+func mergeValue(c *routedClient, key, operand, operator string) (*kvpb.MergeReply, error) {
+	if !c.supports(featureMerge) {
+		return nil, errors.New("server does not support merge")
+	}
+	var resp *kvpb.MergeReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Merge(ctx, &kvpb.MergeRequest{Key: key, Operand: operand, Operator: operator})
+		return err
+	})
+	return resp, err
+}
+
+// jsonGet reads the field at path of key's JSON value.
+func jsonGet(c *routedClient, key, path string) (*kvpb.JSONGetReply, error) {
+	if !c.supports(featureJSONPaths) {
+		return nil, errors.New("server does not support JSON paths")
+	}
+	var resp *kvpb.JSONGetReply
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		resp, err = cli.JSONGet(ctx, &kvpb.JSONGetRequest{Key: key, Path: path})
+		return err
+	})
+	return resp, err
+}
+
+// jsonSet replaces the field at path of key's JSON value with value on the
+// server, so the rest of the document is neither read nor rewritten here.
+func jsonSet(c *routedClient, key, path, value string) (*kvpb.JSONSetReply, error) {
+	if !c.supports(featureJSONPaths) {
+		return nil, errors.New("server does not support JSON paths")
+	}
+	var resp *kvpb.JSONSetReply
+	reqID := c.nextMutationRequestID()
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.JSONSet(ctx, &kvpb.JSONSetRequest{Key: key, Path: path, Value: value})
+		return err
+	})
+	return resp, err
+}
+
+// jsonPathOrRoot prints an empty path as the whole document's "$".
+func jsonPathOrRoot(path string) string {
+	if path == "" {
+		return "$"
+	}
+	return path
+}
+
+// renameKey moves oldKey's value to newKey in one step. Both keys must be
+// in the same partition.
+func renameKey(c *routedClient, oldKey, newKey string, overwrite bool) (*kvpb.RenameReply, error) {
+	if !c.supports(featureRename) {
+		return nil, errors.New("server does not support rename")
+	}
+	partition := ownerForKey(oldKey, len(c.partitions))
+	if other := ownerForKey(newKey, len(c.partitions)); other != partition {
+		return nil, fmt.Errorf("cannot rename %q (partition %d) to %q (partition %d): keys must share a partition", oldKey, partition, newKey, other)
+	}
+	var resp *kvpb.RenameReply
+	reqID := c.nextMutationRequestID()
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Rename(ctx, &kvpb.RenameRequest{OldKey: oldKey, NewKey: newKey, Overwrite: overwrite})
+		return err
+	})
+	return resp, err
+}
+
+func keyTTL(c *routedClient, key string) (*kvpb.TTLReply, error) {
+	if !c.supports(featureTTL) {
+		return nil, errors.New("server does not support TTLs")
+	}
+	var resp *kvpb.TTLReply
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		resp, err = cli.TTL(ctx, &kvpb.TTLRequest{Key: key})
+		return err
+	})
+	return resp, err
+}
+
+// scanExpiring asks every partition which keys expire within the window and
+// merges the answers by deadline. With a limit, each partition returns at
+// most limit keys and the merged list is cut to limit.
+func scanExpiring(c *routedClient, within time.Duration, limit int) ([]*kvpb.ExpiringKey, bool, error) {
+	if !c.supports(featureTTL) {
+		return nil, false, errors.New("server does not support TTLs")
+	}
+	var merged []*kvpb.ExpiringKey
+	truncated := false
 	for partition := range c.partitions {
-		var resp *kvpb.ScanReply
-		c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var resp *kvpb.ScanExpiringReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
 			var err error
-			resp, err = cli.Scan(ctx, &kvpb.ScanRequest{StartKey: startKey, EndKey: endKey})
+			resp, err = cli.ScanExpiring(ctx, &kvpb.ScanExpiringRequest{WithinMillis: within.Milliseconds(), Limit: uint32(limit)})
 			return err
-		})
-		merged = append(merged, resp.Pairs...)
+		}); err != nil {
+			return nil, false, err
+		}
+		merged = append(merged, resp.Keys...)
+		truncated = truncated || resp.Truncated
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].DeleteAt != merged[j].DeleteAt {
+			return merged[i].DeleteAt < merged[j].DeleteAt
+		}
+		return merged[i].Key < merged[j].Key
+	})
+	if limit > 0 && len(merged) > limit {
+		merged, truncated = merged[:limit], true
+	}
+	return merged, truncated, nil
+}
+
+func printExpiring(w io.Writer, within time.Duration, keys []*kvpb.ExpiringKey, truncated bool) {
+	suffix := ""
+	if truncated {
+		suffix = ", truncated"
+	}
+	fmt.Fprintf(w, "EXPIRING %s (%d keys%s)\n", within, len(keys), suffix)
+	now := time.Now()
+	for _, k := range keys {
+		at := time.Unix(0, k.DeleteAt)
+		fmt.Fprintf(w, "  %s %s (in %s)\n", k.Key, at.Format(time.RFC3339), max(at.Sub(now), 0).Round(time.Millisecond))
+	}
+}
+
+// formatTTL renders a TTL reply as "null" (missing key), "none" (no TTL) or
+// the remaining time.
+func formatTTL(resp *kvpb.TTLReply) string {
+	switch {
+	case !resp.Found:
+		return "null"
+	case resp.DeleteAt == 0:
+		return "none"
+	default:
+		return (time.Duration(resp.RemainingMillis) * time.Millisecond).String()
 	}
-	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
-	return merged
 }
 
 func stdinMode(c *routedClient) {
@@ -383,117 +2089,22 @@ func stdinMode(c *routedClient) {
 		if line == "" {
 			continue
 		}
-
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+		started := time.Now()
+		stop, err := runCommand(c, line)
+		c.report.observe(line, time.Since(started), err)
+		if err != nil {
+			log.Printf("%v", err)
 			continue
 		}
-		cmd := strings.ToUpper(parts[0])
-
-		switch cmd {
-		case "PUT":
-			if len(parts) < 3 {
-				log.Printf("PUT requires 2 arguments: key value")
-				continue
-			}
-			k, v := parts[1], parts[2]
-			partition := ownerForKey(k, len(c.partitions))
-			var resp *kvpb.PutReply
-			reqID := c.nextMutationRequestID()
-			c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
-				var err error
-				ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-				resp, err = cli.Put(ctx, &kvpb.PutRequest{Key: k, Value: v})
-				return err
-			})
-			if resp.Found {
-				fmt.Printf("PUT %s found\n", k)
-			} else {
-				fmt.Printf("PUT %s not_found\n", k)
-			}
-		case "GET":
-			if len(parts) < 2 {
-				log.Printf("GET requires 1 argument: key")
-				continue
-			}
-			k := parts[1]
-			partition := ownerForKey(k, len(c.partitions))
-			var resp *kvpb.GetReply
-			c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
-				var err error
-				resp, err = cli.Get(ctx, &kvpb.GetRequest{Key: k})
-				return err
-			})
-			if !resp.Found {
-				fmt.Printf("GET %s null\n", k)
-			} else {
-				fmt.Printf("GET %s %s\n", k, resp.Value)
-			}
-		case "SWAP":
-			if len(parts) < 3 {
-				log.Printf("SWAP requires 2 arguments: key value")
-				continue
-			}
-			k, v := parts[1], parts[2]
-			partition := ownerForKey(k, len(c.partitions))
-			var resp *kvpb.SwapReply
-			reqID := c.nextMutationRequestID()
-			c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
-				var err error
-				ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-				resp, err = cli.Swap(ctx, &kvpb.SwapRequest{Key: k, Value: v})
-				return err
-			})
-			if !resp.Found {
-				fmt.Printf("SWAP %s null\n", k)
-			} else {
-				fmt.Printf("SWAP %s %s\n", k, resp.OldValue)
-			}
-		case "DELETE":
-			if len(parts) < 2 {
-				log.Printf("DELETE requires 1 argument: key")
-				continue
-			}
-			k := parts[1]
-			partition := ownerForKey(k, len(c.partitions))
-			var resp *kvpb.DeleteReply
-			reqID := c.nextMutationRequestID()
-			c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
-				var err error
-				ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
-				resp, err = cli.Delete(ctx, &kvpb.DeleteRequest{Key: k})
-				return err
-			})
-			if resp.Found {
-				fmt.Printf("DELETE %s found\n", k)
-			} else {
-				fmt.Printf("DELETE %s not_found\n", k)
-			}
-		case "SCAN":
-			if len(parts) < 3 {
-				log.Printf("SCAN requires 2 arguments: start_key end_key")
-				continue
-			}
-			startKey, endKey := parts[1], parts[2]
-			pairs := scanAll(c, startKey, endKey)
-			fmt.Printf("SCAN %s %s BEGIN\n", startKey, endKey)
-			for _, pair := range pairs {
-				fmt.Printf("  %s %s\n", pair.Key, pair.Value)
-			}
-			fmt.Println("SCAN END")
-		case "STOP":
-			if len(parts) != 1 {
-				log.Printf("STOP takes no arguments")
-				continue
-			}
-			fmt.Println("STOP")
-			return
-		default:
-			log.Printf("unknown command: %s", cmd)
+		if stop {
+			break
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Fatalf("scanner error: %v", err)
 	}
+	if c.multi != nil {
+		log.Printf("input ended inside MULTI; discarded %d queued commands", len(c.multi.ops))
+	}
 }
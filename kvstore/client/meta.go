@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// keyMeta reads what the server keeps about key besides its value.
+func keyMeta(c *routedClient, key string) (*kvpb.GetMetaReply, error) {
+	if !c.supports(featureKeyMeta) {
+		return nil, errors.New("server does not support key metadata")
+	}
+	var resp *kvpb.GetMetaReply
+	partition := ownerForKey(key, len(c.partitions))
+	err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		resp, err = cli.GetMeta(ctx, &kvpb.GetMetaRequest{Key: key})
+		return err
+	})
+	return resp, err
+}
+
+// printKeyMeta prints a META line for key and, if the server tracks access,
+// an ACCESS line with its counts and when it was last read and written.
+func printKeyMeta(w io.Writer, key string, resp *kvpb.GetMetaReply) {
+	if !resp.Found {
+		fmt.Fprintf(w, "META %s null\n", key)
+		return
+	}
+	fields := []string{
+		fmt.Sprintf("value_bytes=%d", resp.ValueBytes),
+		"value_type=" + strings.ToLower(strings.TrimPrefix(resp.ValueType.String(), "VALUE_TYPE_")),
+	}
+	if resp.ContentType != "" {
+		fields = append(fields, "content_type="+resp.ContentType)
+	}
+	if resp.DeleteAt != 0 {
+		fields = append(fields, "delete_at="+formatUnixNanos(resp.DeleteAt))
+	}
+	fmt.Fprintf(w, "META %s %s\n", key, strings.Join(fields, " "))
+	if a := resp.Access; a != nil {
+		fmt.Fprintf(w, "ACCESS %s reads=%d writes=%d last_read=%s last_write=%s since=%s\n", key, a.Reads, a.Writes,
+			formatUnixNanos(a.LastReadUnixNanos), formatUnixNanos(a.LastWriteUnixNanos), formatUnixNanos(a.SinceUnixNanos))
+	}
+}
+
+// formatUnixNanos prints t in RFC 3339, or "never" for 0.
+func formatUnixNanos(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	return time.Unix(0, t).UTC().Format(time.RFC3339)
+}
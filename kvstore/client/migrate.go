@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Dual-write migration: with --migrate_to naming a second cluster's
+// managers, every PUT, SWAP and DELETE that succeeds on the primary
+// cluster is repeated on the second, so an application can move to it
+// live: dual-write, backfill with export/ingest, check with verify, then
+// switch. Reads go to the primary; with --read_compare each GET is also
+// read from the second cluster and differences are logged. The second
+// cluster never fails a command: its errors and mismatches are logged and
+// counted, and the counts are logged when the client exits. Writes the
+// migration cannot repeat, such as merges, renames and TTLs, are refused
+// while it runs.
+
+// migrationGiveUp bounds retries against the second cluster when
+// --give_up_after does not, so that it being down cannot stall the
+// primary's commands.
+const migrationGiveUp = 10 * time.Second
+
+// migrationTarget is the second cluster of a dual-write migration.
+type migrationTarget struct {
+	c           *routedClient
+	readCompare bool
+
+	writes        atomic.Uint64
+	writeFailures atomic.Uint64
+	compared      atomic.Uint64
+	mismatches    atomic.Uint64
+}
+
+// newMigrationTarget connects to the cluster managed at managerAddrs with
+// the same settings as primary.
+func newMigrationTarget(primary *routedClient, managerAddrs []string, readCompare bool) *migrationTarget {
+	partitions := fetchClusterInfo(managerAddrs, primary.timeout, primary.retry)
+	c := newRoutedClient(partitions, primary.timeout, primary.connectTimeout, primary.retry, primary.maxRetry)
+	c.managerAddrs = managerAddrs
+	c.authToken = primary.authToken
+	c.authTokenCommand = primary.authTokenCommand
+	c.priority = primary.priority
+	c.durability = primary.durability
+	c.traceID = primary.traceID
+	c.giveUpAfter = primary.giveUpAfter
+	if c.giveUpAfter <= 0 {
+		c.giveUpAfter = migrationGiveUp
+	}
+	return &migrationTarget{c: c, readCompare: readCompare}
+}
+
+// migrationWrites are the stdin commands and CLI ops repeated on the
+// second cluster; migrationReadOnly are those that do not write.
+var (
+	migrationWrites   = map[string]bool{"PUT": true, "SWAP": true, "DELETE": true}
+	migrationReadOnly = map[string]bool{
+		"GET": true, "TTL": true, "EXPIRING": true, "SCAN": true, "ITERATE": true, "LS": true, "RANGESTATS": true,
+		"RANDOMKEY": true, "SAMPLE": true, "PING": true, "STOP": true, "WATCH": true, "INFO": true, "CAPABILITIES": true,
+		"STATS": true, "USAGE": true, "QUERY": true, "REPLICATION": true, "MIRROR": true, "TRASH": true, "VERIFY": true,
+		"COMPACT": true, "TRANSFER": true, "DRAIN": true, "PROMOTE": true,
+	}
+)
+
+// checkMigrationCommand refuses a write the migration would not repeat on
+// the second cluster. cmd is a stdin command or CLI op in upper case.
+func (m *migrationTarget) checkMigrationCommand(cmd string) error {
+	if m == nil || migrationWrites[cmd] || migrationReadOnly[cmd] {
+		return nil
+	}
+	return fmt.Errorf("%s is not supported while dual-writing to --migrate_to; only PUT, SWAP and DELETE are repeated there", cmd)
+}
+
+// put repeats a successful put or swap on the second cluster.
+func (m *migrationTarget) put(key, value string, valueType kvpb.ValueType, contentType string) {
+	if m == nil {
+		return
+	}
+	m.write("PUT", key, func(ctx context.Context, cli kvpb.KVSClient) error {
+		_, err := cli.Put(ctx, &kvpb.PutRequest{Key: key, Value: value, ValueType: valueType, ContentType: contentType})
+		return err
+	})
+}
+
+// delete repeats a successful delete on the second cluster.
+func (m *migrationTarget) delete(key string) {
+	if m == nil {
+		return
+	}
+	m.write("DELETE", key, func(ctx context.Context, cli kvpb.KVSClient) error {
+		_, err := cli.Delete(ctx, &kvpb.DeleteRequest{Key: key})
+		return err
+	})
+}
+
+func (m *migrationTarget) write(op, key string, fn func(context.Context, kvpb.KVSClient) error) {
+	m.writes.Add(1)
+	reqID := m.c.nextMutationRequestID()
+	err := m.c.callPartition(ownerForKey(key, len(m.c.partitions)), func(ctx context.Context, cli kvpb.KVSClient) error {
+		return fn(metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID), cli)
+	})
+	if err != nil {
+		m.writeFailures.Add(1)
+		log.Printf("migrate: %s %s on the new cluster failed: %s", op, key, describeError(err))
+	}
+}
+
+// compareGet reads key from the second cluster, if reads are compared, and
+// logs it if it differs from what the primary returned.
+func (m *migrationTarget) compareGet(key, value string, found bool) {
+	if m == nil || !m.readCompare {
+		return
+	}
+	var resp *kvpb.GetReply
+	if err := m.c.callPartition(ownerForKey(key, len(m.c.partitions)), func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		resp, err = cli.Get(ctx, &kvpb.GetRequest{Key: key})
+		return err
+	}); err != nil {
+		log.Printf("migrate: GET %s on the new cluster failed: %s", key, describeError(err))
+		return
+	}
+	m.compared.Add(1)
+	if resp.Found != found || resp.Value != value {
+		m.mismatches.Add(1)
+		log.Printf("migrate: GET %s mismatch: old=%s new=%s", key, describedValue(value, found), describedValue(resp.Value, resp.Found))
+	}
+}
+
+func describedValue(value string, found bool) string {
+	if !found {
+		return "null"
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// close logs the migration's counts and closes the second cluster's
+// connections.
+func (m *migrationTarget) close() {
+	if m == nil {
+		return
+	}
+	log.Printf("migrate: writes=%d write_failures=%d compared=%d mismatches=%d",
+		m.writes.Load(), m.writeFailures.Load(), m.compared.Load(), m.mismatches.Load())
+	m.c.close()
+}
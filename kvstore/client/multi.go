@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// MULTI ... EXEC in the stdin protocol works like Redis's: between them
+// PUT, GET, SWAP and DELETE are only queued, each answered with QUEUED,
+// and EXEC sends them as one Batch, which the server applies atomically,
+// then prints each command's result in its usual format between EXEC BEGIN
+// and EXEC END. DISCARD drops the queue. A malformed or unqueueable command
+// inside the block makes EXEC refuse the whole block with EXECABORT. All
+// keys of a block must be in one partition.
+
+// multiQueue is an open MULTI block.
+type multiQueue struct {
+	ops []*kvpb.BatchOp
+	// aborted is the first error queuing a command; EXEC reports it.
+	aborted error
+}
+
+// runMulti handles cmd if it opens, closes or belongs to a MULTI block. It
+// reports whether it did.
+func runMulti(c *routedClient, cmd string, parts []string) (bool, error) {
+	switch cmd {
+	case "MULTI":
+		if len(parts) != 1 {
+			return true, errors.New("MULTI takes no arguments")
+		}
+		if c.multi != nil {
+			return true, errors.New("MULTI calls cannot be nested")
+		}
+		c.multi = &multiQueue{}
+		fmt.Println("MULTI OK")
+		return true, nil
+	case "DISCARD":
+		if c.multi == nil {
+			return true, errors.New("DISCARD without MULTI")
+		}
+		c.multi = nil
+		fmt.Println("DISCARD OK")
+		return true, nil
+	case "EXEC":
+		q := c.multi
+		if q == nil {
+			return true, errors.New("EXEC without MULTI")
+		}
+		c.multi = nil
+		if q.aborted != nil {
+			return true, fmt.Errorf("EXECABORT transaction discarded because of an earlier error: %v", q.aborted)
+		}
+		return true, execMulti(c, q.ops)
+	}
+	if c.multi == nil || cmd == "STOP" {
+		return false, nil
+	}
+	op, err := queuedOp(cmd, parts)
+	if err != nil {
+		if c.multi.aborted == nil {
+			c.multi.aborted = err
+		}
+		return true, err
+	}
+	c.multi.ops = append(c.multi.ops, op)
+	fmt.Println("QUEUED")
+	return true, nil
+}
+
+// queuedOp parses a command queued inside a MULTI block.
+func queuedOp(cmd string, parts []string) (*kvpb.BatchOp, error) {
+	switch cmd {
+	case "PUT", "SWAP":
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("%s requires 2 arguments: key value", cmd)
+		}
+		return &kvpb.BatchOp{Op: cmd, Key: parts[1], Value: parts[2]}, nil
+	case "GET", "DELETE":
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s requires 1 argument: key", cmd)
+		}
+		return &kvpb.BatchOp{Op: cmd, Key: parts[1]}, nil
+	}
+	return nil, fmt.Errorf("%s cannot be queued in MULTI; only PUT, GET, SWAP and DELETE can", cmd)
+}
+
+// execMulti sends a MULTI block as one Batch and prints its results.
+func execMulti(c *routedClient, ops []*kvpb.BatchOp) error {
+	if len(ops) == 0 {
+		fmt.Println("EXEC BEGIN")
+		fmt.Println("EXEC END")
+		return nil
+	}
+	if !c.supports(featureBatch) {
+		version, _ := c.capabilities()
+		return fmt.Errorf("EXEC unsupported by server (api_version=%d)", version)
+	}
+	partition := ownerForKey(ops[0].Key, len(c.partitions))
+	for _, op := range ops[1:] {
+		if ownerForKey(op.Key, len(c.partitions)) != partition {
+			return fmt.Errorf("CROSSPARTITION keys %q and %q are in different partitions; a MULTI block must stay in one", ops[0].Key, op.Key)
+		}
+	}
+	var resp *kvpb.BatchReply
+	reqID := c.nextMutationRequestID()
+	if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		resp, err = cli.Batch(ctx, &kvpb.BatchRequest{Ops: ops})
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(resp.Results) != len(ops) {
+		return fmt.Errorf("EXEC got %d results for %d commands", len(resp.Results), len(ops))
+	}
+	fmt.Println("EXEC BEGIN")
+	for i, op := range ops {
+		fmt.Println(multiResultLine(op, resp.Results[i]))
+	}
+	fmt.Println("EXEC END")
+	return nil
+}
+
+// multiResultLine formats a queued command's result as the command would
+// print it on its own.
+func multiResultLine(op *kvpb.BatchOp, r *kvpb.BatchResult) string {
+	if r.Error != "" {
+		return fmt.Sprintf("%s %s error %s", op.Op, op.Key, r.Error)
+	}
+	switch strings.ToUpper(op.Op) {
+	case "GET", "SWAP":
+		if !r.Found {
+			return fmt.Sprintf("%s %s null", op.Op, op.Key)
+		}
+		return fmt.Sprintf("%s %s %s", op.Op, op.Key, r.Value)
+	default:
+		if r.Found {
+			return fmt.Sprintf("%s %s found", op.Op, op.Key)
+		}
+		return fmt.Sprintf("%s %s not_found", op.Op, op.Key)
+	}
+}
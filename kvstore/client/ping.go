@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// percentile returns the q-quantile (0..1) of an ascending slice.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1)+0.5)]
+}
+
+// pingAll pings every replica count times and prints one RTT summary line per
+// server. Replicas are addressed directly, bypassing leader routing, so a
+// follower that is reachable but never elected still shows up.
+func pingAll(c *routedClient, w io.Writer, count int) {
+	if !c.supports(featurePing) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "PING unsupported by server (api_version=%d)\n", version)
+		return
+	}
+	if count < 1 {
+		count = 1
+	}
+	payload := []byte("ping")
+	for partition, addrs := range c.partitions {
+		for replica, addr := range addrs {
+			cli, err := c.ensureConn(addr)
+			if err != nil {
+				fmt.Fprintf(w, "PING %s partition=%d replica=%d unreachable: %v\n", addr, partition, replica, err)
+				continue
+			}
+			rtts := make([]time.Duration, 0, count)
+			failures := 0
+			for i := 0; i < count; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+				sent := time.Now()
+				_, err := cli.Ping(ctx, &kvpb.EchoRequest{Payload: payload})
+				rtt := time.Since(sent)
+				cancel()
+				if err != nil {
+					failures++
+					continue
+				}
+				rtts = append(rtts, rtt)
+			}
+			if len(rtts) == 0 {
+				fmt.Fprintf(w, "PING %s partition=%d replica=%d sent=%d ok=0\n", addr, partition, replica, count)
+				c.resetConn(addr)
+				continue
+			}
+			sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+			var total time.Duration
+			for _, rtt := range rtts {
+				total += rtt
+			}
+			fmt.Fprintf(w, "PING %s partition=%d replica=%d sent=%d ok=%d min=%s avg=%s p50=%s p99=%s max=%s\n",
+				addr, partition, replica, count, count-failures,
+				rtts[0], total/time.Duration(len(rtts)), percentile(rtts, 0.5), percentile(rtts, 0.99), rtts[len(rtts)-1])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Long jobs (export, ingest, replay) report progress on stderr so that
+// operators can tell a slow job from a stuck one. On a terminal a bar with
+// throughput and ETA is redrawn every second; otherwise a PROGRESS line is
+// printed every --progress_interval for log collectors and scripts:
+//
+//	PROGRESS export done=120000 total=500000 unit=keys rate=40000.0/s elapsed=3s eta=9s
+//
+// total and eta are left out when the job's size is not known up front.
+
+const (
+	progressBarWidth = 30
+	progressTTYEvery = time.Second
+)
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progress tracks one job. Its methods are safe to call on a nil
+// *progress, which reports nothing.
+type progress struct {
+	label   string
+	unit    string
+	total   uint64
+	done    atomic.Uint64
+	started time.Time
+	w       io.Writer
+	tty     bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// startProgress starts reporting a job of total units, or of unknown size
+// with total 0. It returns nil if every is 0 and stderr is not a terminal,
+// or if every is negative.
+func startProgress(label, unit string, total uint64, every time.Duration) *progress {
+	if every < 0 {
+		return nil
+	}
+	tty := isTerminal(os.Stderr)
+	if tty {
+		every = progressTTYEvery
+	}
+	if every <= 0 {
+		return nil
+	}
+	p := &progress{label: label, unit: unit, total: total, started: time.Now(), w: os.Stderr, tty: tty, stop: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add records n more units done.
+func (p *progress) add(n uint64) {
+	if p != nil {
+		p.done.Add(n)
+	}
+}
+
+// finish stops reporting, printing the final state once more.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.print()
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progress) print() {
+	done := p.done.Load()
+	elapsed := time.Since(p.started)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+	var eta time.Duration
+	known := p.total > 0 && rate > 0
+	if known && done < p.total {
+		eta = time.Duration(float64(p.total-done) / rate * float64(time.Second))
+	}
+	if !p.tty {
+		line := fmt.Sprintf("PROGRESS %s done=%d", p.label, done)
+		if p.total > 0 {
+			line += fmt.Sprintf(" total=%d", p.total)
+		}
+		line += fmt.Sprintf(" unit=%s rate=%.1f/s elapsed=%s", p.unit, rate, elapsed.Round(time.Second))
+		if known {
+			line += fmt.Sprintf(" eta=%s", eta.Round(time.Second))
+		}
+		fmt.Fprintln(p.w, line)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\r%s ", p.label)
+	if p.total > 0 {
+		frac := min(float64(done)/float64(p.total), 1)
+		filled := int(frac * progressBarWidth)
+		fmt.Fprintf(&b, "[%s%s] %3.0f%% %d/%d %s", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), frac*100, done, p.total, p.unit)
+	} else {
+		fmt.Fprintf(&b, "%d %s", done, p.unit)
+	}
+	fmt.Fprintf(&b, " %.0f/s %s", rate, elapsed.Round(time.Second))
+	if known {
+		fmt.Fprintf(&b, " ETA %s", eta.Round(time.Second))
+	}
+	// Pad over what a longer previous line left behind.
+	b.WriteString("\x1b[K")
+	fmt.Fprint(p.w, b.String())
+}
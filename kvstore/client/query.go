@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// queryParams are the values bound to a query's ? placeholders, in order.
+type queryParams []string
+
+func (p *queryParams) String() string { return strings.Join(*p, ",") }
+
+func (p *queryParams) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// queryAll runs sql on every partition, which filters its own keys, and
+// merges the rows in key order under the query's limit.
+func queryAll(c *routedClient, sql string, args []string) (*kvpb.QueryReply, error) {
+	if !c.supports(featureQuery) {
+		version, _ := c.capabilities()
+		return nil, fmt.Errorf("QUERY unsupported by server (api_version=%d)", version)
+	}
+	merged := &kvpb.QueryReply{}
+	for partition := range c.partitions {
+		var resp *kvpb.QueryReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.Query(ctx, &kvpb.QueryRequest{Sql: sql, Args: args})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		merged.Columns, merged.Limit = resp.Columns, resp.Limit
+		merged.Rows = append(merged.Rows, resp.Rows...)
+		merged.Truncated = merged.Truncated || resp.Truncated
+		merged.Examined += resp.Examined
+	}
+	sort.Slice(merged.Rows, func(i, j int) bool { return merged.Rows[i].Key < merged.Rows[j].Key })
+	if limit := int(merged.Limit); limit > 0 && len(merged.Rows) > limit {
+		merged.Rows, merged.Truncated = merged.Rows[:limit], true
+	}
+	return merged, nil
+}
+
+// printQuery prints a query's rows, one per line with the selected columns
+// separated by spaces.
+func printQuery(w io.Writer, reply *kvpb.QueryReply) {
+	fmt.Fprintf(w, "QUERY (%d rows, %d keys examined)\n", len(reply.Rows), reply.Examined)
+	for _, row := range reply.Rows {
+		fields := make([]string, 0, len(reply.Columns))
+		for _, col := range reply.Columns {
+			if col == "value" {
+				fields = append(fields, row.Value)
+			} else {
+				fields = append(fields, row.Key)
+			}
+		}
+		fmt.Fprintf(w, "  %s\n", strings.Join(fields, " "))
+	}
+	if reply.Truncated {
+		fmt.Fprintf(w, "  ... more rows matched than the limit of %d; narrow the WHERE clause or raise its LIMIT\n", reply.Limit)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// rangeStats sums the per-partition estimates for [start, end]. Keys are
+// hash partitioned, so every partition holds part of any range.
+func rangeStats(c *routedClient, start, end string) (*kvpb.RangeStatsReply, error) {
+	if !c.supports(featureRangeStats) {
+		return nil, errors.New("server does not support range statistics")
+	}
+	total := &kvpb.RangeStatsReply{}
+	for partition := range c.partitions {
+		var resp *kvpb.RangeStatsReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.RangeStats(ctx, &kvpb.RangeStatsRequest{StartKey: start, EndKey: end})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		total.Keys += resp.Keys
+		total.Bytes += resp.Bytes
+		total.TotalKeys += resp.TotalKeys
+	}
+	return total, nil
+}
+
+func printRangeStats(w io.Writer, start, end string, stats *kvpb.RangeStatsReply) {
+	fmt.Fprintf(w, "RANGESTATS %s %s keys~%d bytes~%d (of %d keys)\n", start, end, stats.Keys, stats.Bytes, stats.TotalKeys)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// With --read_cache, GETs in the stdin protocol and scripts are served from
+// a local cache of earlier replies while the server's lease on them holds.
+// The client keeps a CacheInvalidations stream open to each partition's
+// leader, which pushes the keys whose leased values changed; leases are
+// only granted while that stream is open, and everything cached under a
+// stream is dropped when it breaks. The client also forgets the keys its
+// own commands name, so it reads its own writes.
+
+// readCache is the lease-based GET cache. A nil *readCache is disabled.
+type readCache struct {
+	c   *routedClient
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *cacheEntry, most recently used first.
+	lru  *list.List
+	subs []*cacheSubscription
+	// disabled is set once the servers turn out not to grant leases, or
+	// the client is closing.
+	disabled     bool
+	hits, misses uint64
+}
+
+type cacheEntry struct {
+	key       string
+	partition int
+	gen       uint64
+	value     string
+	found     bool
+	expires   time.Time
+}
+
+// cacheSubscription is the invalidation stream of one partition. gen
+// advances whenever the stream connects or breaks, voiding the entries
+// cached under an earlier one.
+type cacheSubscription struct {
+	addr      string
+	gen       uint64
+	connected bool
+	started   bool
+	cancel    context.CancelFunc
+}
+
+func newReadCache(c *routedClient, max int) *readCache {
+	if max <= 0 {
+		return nil
+	}
+	subs := make([]*cacheSubscription, len(c.partitions))
+	for i := range subs {
+		subs[i] = &cacheSubscription{}
+	}
+	return &readCache{c: c, max: max, entries: make(map[string]*list.Element), lru: list.New(), subs: subs}
+}
+
+// get returns key's cached reply, if it has one whose lease still holds.
+func (rc *readCache) get(key string) (value string, found, ok bool) {
+	if rc == nil {
+		return "", false, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el := rc.entries[key]
+	if el == nil {
+		rc.misses++
+		return "", false, false
+	}
+	e := el.Value.(*cacheEntry)
+	sub := rc.subs[e.partition]
+	if e.gen != sub.gen || !sub.connected || !time.Now().Before(e.expires) {
+		rc.removeLocked(el)
+		rc.misses++
+		return "", false, false
+	}
+	rc.lru.MoveToFront(el)
+	rc.hits++
+	return e.value, e.found, true
+}
+
+// holder returns the lease holder to send with a GET of key, starting the
+// partition's invalidation stream if it is not running, and the stream
+// generation to pass to store with the reply. The holder is empty if the
+// cache is off.
+func (rc *readCache) holder(partition int) (string, uint64) {
+	if rc == nil {
+		return "", 0
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.disabled {
+		return "", 0
+	}
+	sub := rc.subs[partition]
+	if !sub.started {
+		sub.started = true
+		go rc.subscribe(partition)
+	}
+	return rc.c.clientID, sub.gen
+}
+
+// store caches a GET reply that came with a lease, unless the stream it was
+// granted under has broken since the GET was sent at sent.
+func (rc *readCache) store(key string, partition int, gen uint64, resp *kvpb.GetReply, sent time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	sub := rc.subs[partition]
+	if resp.LeaseMillis <= 0 {
+		// The leader that answered does not know our stream; move it there.
+		if sub.connected && sub.cancel != nil && sub.addr != rc.leaderAddr(partition) {
+			sub.cancel()
+		}
+		return
+	}
+	if gen != sub.gen || !sub.connected {
+		return
+	}
+	if el := rc.entries[key]; el != nil {
+		rc.removeLocked(el)
+	}
+	e := &cacheEntry{key: key, partition: partition, gen: gen, value: resp.Value, found: resp.Found, expires: sent.Add(time.Duration(resp.LeaseMillis) * time.Millisecond)}
+	rc.entries[key] = rc.lru.PushFront(e)
+	for rc.lru.Len() > rc.max {
+		rc.removeLocked(rc.lru.Back())
+	}
+}
+
+// forget drops keys, which a command of this client is about to change.
+func (rc *readCache) forget(keys ...string) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, key := range keys {
+		if el := rc.entries[key]; el != nil {
+			rc.removeLocked(el)
+		}
+	}
+}
+
+func (rc *readCache) removeLocked(el *list.Element) {
+	delete(rc.entries, el.Value.(*cacheEntry).key)
+	rc.lru.Remove(el)
+}
+
+func (rc *readCache) leaderAddr(partition int) string {
+	return rc.c.replicaAddrs(partition)[rc.c.getReplicaOrder(partition)[0]]
+}
+
+// subscribe keeps partition's invalidation stream open to its leader,
+// reconnecting with backoff when it breaks, until the cache is disabled.
+func (rc *readCache) subscribe(partition int) {
+	sub := rc.subs[partition]
+	backoff := rc.c.retry
+	for {
+		rc.mu.Lock()
+		addr := rc.leaderAddr(partition)
+		rc.mu.Unlock()
+		err := rc.stream(partition, addr)
+		rc.mu.Lock()
+		sub.connected, sub.cancel = false, nil
+		sub.gen++
+		switch status.Code(err) {
+		case codes.Unimplemented, codes.FailedPrecondition:
+			if !rc.disabled {
+				log.Printf("read cache disabled: %s does not grant cache leases: %v", addr, err)
+			}
+			rc.disabled = true
+		}
+		disabled := rc.disabled
+		rc.mu.Unlock()
+		if disabled {
+			return
+		}
+		if err != nil && status.Code(err) != codes.Canceled {
+			log.Printf("read cache: invalidation stream to %s broke: %v; reconnecting", addr, err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, rc.c.maxRetry)
+		} else {
+			backoff = rc.c.retry
+		}
+	}
+}
+
+// stream runs one invalidation stream to addr until it breaks.
+func (rc *readCache) stream(partition int, addr string) error {
+	cli, err := rc.c.ensureConn(addr)
+	if err != nil {
+		rc.c.resetConn(addr)
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := cli.CacheInvalidations(ctx, &kvpb.CacheInvalidationsRequest{Holder: rc.c.clientID})
+	if err != nil {
+		return err
+	}
+	sub := rc.subs[partition]
+	rc.mu.Lock()
+	sub.addr, sub.cancel, sub.connected = addr, cancel, true
+	sub.gen++
+	rc.mu.Unlock()
+	for {
+		inv, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		rc.mu.Lock()
+		if inv.All {
+			sub.gen++
+		}
+		for _, key := range inv.Keys {
+			if el := rc.entries[key]; el != nil {
+				rc.removeLocked(el)
+			}
+		}
+		rc.mu.Unlock()
+	}
+}
+
+// close stops the invalidation streams and logs the hit rate.
+func (rc *readCache) close() {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.disabled = true
+	for _, sub := range rc.subs {
+		if sub.cancel != nil {
+			sub.cancel()
+		}
+	}
+	if rc.hits+rc.misses > 0 {
+		log.Printf("read cache: hits=%d misses=%d", rc.hits, rc.misses)
+	}
+}
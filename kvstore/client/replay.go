@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// traceRecord mirrors the JSON-lines records the server writes with
+// --trace_path.
+type traceRecord struct {
+	UnixNanos int64           `json:"ts"`
+	Method    string          `json:"method"`
+	Request   json.RawMessage `json:"request"`
+	Partition int             `json:"partition"`
+}
+
+// replayMode re-issues a recorded trace against the cluster. speed scales the
+// original inter-arrival gaps (2 replays twice as fast); speed <= 0 issues
+// requests back to back.
+func replayMode(c *routedClient, tracePath string, speed float64) error {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return fmt.Errorf("open trace: %w", err)
+	}
+	defer f.Close()
+	var size uint64
+	if fi, err := f.Stat(); err == nil {
+		size = uint64(fi.Size())
+	}
+	prog := startProgress("replay", "bytes", size, c.progressEvery)
+	defer prog.finish()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	var firstTS int64
+	var started time.Time
+	issued, skipped := 0, 0
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		prog.add(uint64(len(scanner.Bytes()) + 1))
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec traceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("trace line %d: %w", lineNo, err)
+		}
+		if started.IsZero() {
+			firstTS = rec.UnixNanos
+			started = time.Now()
+		}
+		if speed > 0 {
+			offset := time.Duration(float64(rec.UnixNanos-firstTS) / speed)
+			if wait := time.Until(started.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		opStarted := time.Now()
+		err := replayRecord(c, rec)
+		c.report.observe(path.Base(rec.Method), time.Since(opStarted), err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "trace line %d: %v\n", lineNo, err)
+			skipped++
+			continue
+		}
+		issued++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read trace: %w", err)
+	}
+
+	elapsed := time.Since(started)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(issued) / elapsed.Seconds()
+	}
+	fmt.Printf("REPLAY %s issued=%d skipped=%d elapsed=%s rate=%.1f/s\n", tracePath, issued, skipped, elapsed.Round(time.Millisecond), rate)
+	return nil
+}
+
+// replayRecord re-issues rec by calling the KVSClient method it names with
+// the recorded request. Keyed requests go to the key's partition in this
+// cluster; the rest, such as a Scan page, to the partition that recorded
+// them. Every request carries a new request ID, which reads ignore, so
+// replayed mutations are not mistaken for retries of the recorded ones.
+func replayRecord(c *routedClient, rec traceRecord) error {
+	name := path.Base(rec.Method)
+	// The server traces unary KVS methods only; streams have no single
+	// request to record.
+	unary := slices.ContainsFunc(kvpb.KVS_ServiceDesc.Methods, func(m grpc.MethodDesc) bool { return m.MethodName == name })
+	if !unary || rec.Method != "/"+kvpb.KVS_ServiceDesc.ServiceName+"/"+name {
+		return fmt.Errorf("unsupported traced method %q", rec.Method)
+	}
+	method, _ := reflect.TypeOf((*kvpb.KVSClient)(nil)).Elem().MethodByName(name)
+	req := reflect.New(method.Type.In(1).Elem()).Interface().(proto.Message)
+	if err := protojson.Unmarshal(rec.Request, req); err != nil {
+		return err
+	}
+	reqID := c.nextMutationRequestID()
+	return c.callPartition(replayPartition(c, req, rec.Partition), func(ctx context.Context, cli kvpb.KVSClient) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, reqID)
+		out := reflect.ValueOf(cli).MethodByName(name).Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(req)})
+		err, _ := out[1].Interface().(error)
+		return err
+	})
+}
+
+// replayPartition picks the partition a replayed request goes to.
+func replayPartition(c *routedClient, req proto.Message, recorded int) int {
+	switch r := req.(type) {
+	case interface{ GetKey() string }:
+		return ownerForKey(r.GetKey(), len(c.partitions))
+	case *kvpb.RenameRequest:
+		return ownerForKey(r.OldKey, len(c.partitions))
+	case *kvpb.BatchRequest:
+		if len(r.Ops) > 0 {
+			return ownerForKey(r.Ops[0].Key, len(c.partitions))
+		}
+	}
+	if recorded < 0 || recorded >= len(c.partitions) {
+		return 0
+	}
+	return recorded
+}
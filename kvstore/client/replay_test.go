@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayDispatchesEveryUnaryMethod(t *testing.T) {
+	c := startFakeKVS(t, map[string]string{"a/1": "x"})
+	trace := strings.Join([]string{
+		`{"ts":1,"method":"/KVS/Put","request":{"key":"a/2","value":"y"}}`,
+		`{"ts":2,"method":"/KVS/Batch","request":{"ops":[{"op":"PUT","key":"b","value":"z"},{"op":"DELETE","key":"a/1"}]}}`,
+		`{"ts":3,"method":"/KVS/ListDir","request":{"prefix":"a/"}}`,
+		`{"ts":4,"method":"/KVS/RangeStats","request":{"startKey":"a","endKey":"b"},"partition":0}`,
+		`{"ts":5,"method":"/KVS/Watch","request":{"prefix":"a/"}}`,
+		`{"ts":6,"method":"/Admin/Backup","request":{}}`,
+	}, "\n")
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := os.WriteFile(path, []byte(trace+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayMode(c, path, 0); err != nil {
+		t.Fatalf("replayMode() failed: %v", err)
+	}
+	got := runStdin(t, c, "GET a/1", "GET a/2", "GET b")
+	if want := "GET a/1 null\nGET a/2 y\nGET b z\n"; got != want {
+		t.Fatalf("after replay:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyReport collects per-operation latencies for --report. A nil
+// *latencyReport records nothing.
+type latencyReport struct {
+	mu      sync.Mutex
+	started time.Time
+	samples map[string][]time.Duration
+	errors  map[string]int
+
+	// Allocation counters of this process when the run started, and the
+	// run's totals and length once it ended.
+	startMallocs, startBytes uint64
+	mallocs, bytes           uint64
+	elapsed                  time.Duration
+	ended                    bool
+
+	// profileDir receives cpu.pprof and heap.pprof when set.
+	profileDir string
+	cpuProfile *os.File
+}
+
+func newLatencyReport() *latencyReport {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &latencyReport{
+		started:      time.Now(),
+		samples:      make(map[string][]time.Duration),
+		errors:       make(map[string]int),
+		startMallocs: m.Mallocs,
+		startBytes:   m.TotalAlloc,
+	}
+}
+
+// startProfile begins a CPU profile of the client that finish stops.
+func (r *latencyReport) startProfile(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.profileDir, r.cpuProfile = dir, f
+	return nil
+}
+
+// finish ends the run: it fixes the elapsed time and allocation totals and
+// writes the profiles.
+func (r *latencyReport) finish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended {
+		return nil
+	}
+	r.ended = true
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	r.mallocs, r.bytes = m.Mallocs-r.startMallocs, m.TotalAlloc-r.startBytes
+	r.elapsed = time.Since(r.started)
+	if r.cpuProfile == nil {
+		return nil
+	}
+	pprof.StopCPUProfile()
+	if err := r.cpuProfile.Close(); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(r.profileDir, "heap.pprof"))
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// observe records how long one stdin-protocol command took. Failed commands
+// are counted but kept out of the latency distribution.
+func (r *latencyReport) observe(line string, elapsed time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	op := strings.ToUpper(fields[0])
+	if op == "STOP" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors[op]++
+		return
+	}
+	r.samples[op] = append(r.samples[op], elapsed)
+}
+
+// opSummary is one operation's row in the report. The JSON field names are
+// part of the --report_json format.
+type opSummary struct {
+	Op     string  `json:"op"`
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P95MS  float64 `json:"p95_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+type reportSummary struct {
+	ElapsedSeconds float64     `json:"elapsed_seconds"`
+	Throughput     float64     `json:"throughput_ops_per_sec"`
+	AllocsPerOp    float64     `json:"allocs_per_op"`
+	BytesPerOp     float64     `json:"alloc_bytes_per_op"`
+	ProfileDir     string      `json:"profile_dir,omitempty"`
+	Ops            []opSummary `json:"ops"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *latencyReport) summary() reportSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := make(map[string]bool, len(r.samples)+len(r.errors))
+	for op := range r.samples {
+		ops[op] = true
+	}
+	for op := range r.errors {
+		ops[op] = true
+	}
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+
+	elapsed := r.elapsed
+	if !r.ended {
+		elapsed = time.Since(r.started)
+	}
+	out := reportSummary{ElapsedSeconds: elapsed.Seconds(), ProfileDir: r.profileDir}
+	total := 0
+	for _, op := range names {
+		sorted := append([]time.Duration(nil), r.samples[op]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		row := opSummary{Op: op, Count: len(sorted), Errors: r.errors[op]}
+		if len(sorted) > 0 {
+			var total time.Duration
+			for _, d := range sorted {
+				total += d
+			}
+			row.MeanMS = millis(total / time.Duration(len(sorted)))
+			row.P50MS = millis(percentile(sorted, 0.50))
+			row.P95MS = millis(percentile(sorted, 0.95))
+			row.P99MS = millis(percentile(sorted, 0.99))
+			row.MaxMS = millis(sorted[len(sorted)-1])
+		}
+		out.Ops = append(out.Ops, row)
+		total += row.Count
+	}
+	if out.ElapsedSeconds > 0 {
+		out.Throughput = float64(total) / out.ElapsedSeconds
+	}
+	if total > 0 && r.ended {
+		// Allocations are the whole client's, so they include connection
+		// and report bookkeeping, not only request encoding.
+		out.AllocsPerOp = float64(r.mallocs) / float64(total)
+		out.BytesPerOp = float64(r.bytes) / float64(total)
+	}
+	return out
+}
+
+// print writes one line per operation, plus a throughput line.
+func (r *latencyReport) print(w io.Writer) {
+	s := r.summary()
+	total := 0
+	for _, row := range s.Ops {
+		total += row.Count
+		fmt.Fprintf(w, "REPORT %s count=%d errors=%d mean=%.2fms p50=%.2fms p95=%.2fms p99=%.2fms max=%.2fms\n",
+			row.Op, row.Count, row.Errors, row.MeanMS, row.P50MS, row.P95MS, row.P99MS, row.MaxMS)
+	}
+	fmt.Fprintf(w, "REPORT total=%d elapsed=%.2fs throughput=%.1f ops/s allocs/op=%.0f bytes/op=%.0f\n",
+		total, s.ElapsedSeconds, s.Throughput, s.AllocsPerOp, s.BytesPerOp)
+	if s.ProfileDir != "" {
+		fmt.Fprintf(w, "REPORT profiles=%s (go tool pprof %s)\n", s.ProfileDir, filepath.Join(s.ProfileDir, "cpu.pprof"))
+	}
+}
+
+func (r *latencyReport) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r.summary(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
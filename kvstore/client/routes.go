@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// The route cache lets a short-lived client skip the manager: --route_cache
+// names a JSON file holding the partition map and the last leader seen for
+// each partition, so the first request goes straight to the right replica.
+// A cached map older than --route_cache_ttl, or one written for different
+// managers, is ignored. A "wrong partition" reply, a leader hint naming an
+// unknown address, or a partition that no cached replica serves refreshes
+// the map from the manager.
+
+// routeCache is the on-disk form of the cache.
+type routeCache struct {
+	ManagerAddrs []string   `json:"manager_addrs"`
+	Partitions   [][]string `json:"partitions"`
+	// Leaders holds the leader address of each partition, "" if unknown.
+	Leaders   []string `json:"leaders"`
+	SavedUnix int64    `json:"saved_unix"`
+}
+
+// errRoutesChanged reports that the cluster's partition count changed, which
+// moves keys between partitions; requests routed with the old count are not
+// retried.
+var errRoutesChanged = errors.New("cluster partition count changed")
+
+// loadRouteCache returns the cached partition map and leaders if path holds
+// a fresh map for managerAddrs.
+func loadRouteCache(path string, managerAddrs []string, maxAge time.Duration) ([][]string, []string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("route cache %s: %v", path, err)
+		}
+		return nil, nil, false
+	}
+	var rc routeCache
+	if err := json.Unmarshal(data, &rc); err != nil {
+		log.Printf("route cache %s is unreadable; ignoring it: %v", path, err)
+		return nil, nil, false
+	}
+	if !slices.Equal(rc.ManagerAddrs, managerAddrs) || len(rc.Partitions) == 0 || len(rc.Leaders) != len(rc.Partitions) {
+		return nil, nil, false
+	}
+	if maxAge > 0 && time.Since(time.Unix(rc.SavedUnix, 0)) > maxAge {
+		return nil, nil, false
+	}
+	return rc.Partitions, rc.Leaders, true
+}
+
+// saveRouteCache writes the current map and leader hints if either changed
+// since the client started.
+func (c *routedClient) saveRouteCache() {
+	c.leaderHintsMu.Lock()
+	if c.routeCachePath == "" || !c.routesDirty || c.routesStale {
+		c.leaderHintsMu.Unlock()
+		return
+	}
+	rc := routeCache{
+		ManagerAddrs: c.managerAddrs,
+		Partitions:   c.partitions,
+		Leaders:      make([]string, len(c.partitions)),
+		SavedUnix:    time.Now().Unix(),
+	}
+	for partition, idx := range c.leaderHints {
+		if idx >= 0 && idx < len(c.partitions[partition]) {
+			rc.Leaders[partition] = c.partitions[partition][idx]
+		}
+	}
+	c.routesDirty = false
+	c.leaderHintsMu.Unlock()
+	c.writeRouteCache(rc)
+}
+
+func (c *routedClient) writeRouteCache(rc routeCache) {
+	data, err := json.MarshalIndent(rc, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(c.routeCachePath, data)
+	}
+	if err != nil {
+		log.Printf("route cache %s not saved: %v", c.routeCachePath, err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// seedLeaderHints points each partition at its cached leader.
+func (c *routedClient) seedLeaderHints(leaders []string) {
+	for partition, addr := range leaders {
+		c.setLeaderHint(partition, addr)
+	}
+	c.leaderHintsMu.Lock()
+	c.routesDirty = false
+	c.leaderHintsMu.Unlock()
+}
+
+// replicaAddrs returns the addresses of partition's replicas.
+func (c *routedClient) replicaAddrs(partition int) []string {
+	c.leaderHintsMu.Lock()
+	defer c.leaderHintsMu.Unlock()
+	return c.partitions[partition]
+}
+
+// knowsReplica reports whether addr is one of partition's replicas.
+func (c *routedClient) knowsReplica(partition int, addr string) bool {
+	return slices.Contains(c.replicaAddrs(partition), addr)
+}
+
+// refreshRoutes asks the managers for the partition map, at most once per
+// retry interval, and reports whether any replica list changed. The
+// partition count is fixed for the life of a client, since callers have
+// already hashed keys with it; if it changed, the new map is cached for the
+// next run and errRoutesChanged is returned.
+func (c *routedClient) refreshRoutes(reason string) (bool, error) {
+	c.leaderHintsMu.Lock()
+	if time.Since(c.routesRefreshed) < c.retry {
+		c.leaderHintsMu.Unlock()
+		return false, nil
+	}
+	c.routesRefreshed = time.Now()
+	c.leaderHintsMu.Unlock()
+
+	var partitions [][]string
+	var err error
+	for _, managerAddr := range c.managerAddrs {
+		if partitions, err = queryClusterInfo(managerAddr, c.timeout); err == nil {
+			break
+		}
+		log.Printf("%v", err)
+	}
+	if partitions == nil {
+		return false, nil
+	}
+
+	c.leaderHintsMu.Lock()
+	defer c.leaderHintsMu.Unlock()
+	if slices.EqualFunc(partitions, c.partitions, slices.Equal) {
+		return false, nil
+	}
+	log.Printf("partition map refreshed from the manager (%s)", reason)
+	if len(partitions) != len(c.partitions) {
+		if c.routeCachePath != "" {
+			c.routesStale = true
+			c.writeRouteCache(routeCache{ManagerAddrs: c.managerAddrs, Partitions: partitions, Leaders: make([]string, len(partitions)), SavedUnix: time.Now().Unix()})
+		}
+		return false, fmt.Errorf("%w from %d to %d; rerun the request", errRoutesChanged, len(c.partitions), len(partitions))
+	}
+	c.routesDirty = true
+	for partition, addrs := range partitions {
+		if !slices.Equal(addrs, c.partitions[partition]) {
+			c.partitions[partition] = addrs
+			delete(c.leaderHints, partition)
+		}
+	}
+	return true, nil
+}
+
+// queryClusterInfo asks one manager for the partition map.
+func queryClusterInfo(managerAddr string, timeout time.Duration) ([][]string, error) {
+	conn, err := grpc.NewClient(managerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("manager dial failed (%s): %w", managerAddr, err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := kvpb.NewClusterManagerClient(conn).GetClusterInfo(ctx, &kvpb.GetClusterInfoRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("manager query failed (%s): %w", managerAddr, err)
+	}
+	if !resp.Ready || len(resp.ServerAddrs) == 0 {
+		return nil, fmt.Errorf("manager %s not ready yet", managerAddr)
+	}
+	if resp.ServerRf == 0 || len(resp.ServerAddrs)%int(resp.ServerRf) != 0 {
+		return nil, fmt.Errorf("manager %s returned invalid topology", managerAddr)
+	}
+	partitions := make([][]string, 0, len(resp.ServerAddrs)/int(resp.ServerRf))
+	for i := 0; i < len(resp.ServerAddrs); i += int(resp.ServerRf) {
+		group := append([]string(nil), resp.ServerAddrs[i:i+int(resp.ServerRf)]...)
+		partitions = append(partitions, group)
+	}
+	return partitions, nil
+}
+
+// isWrongPartition reports whether a server refused a key it does not own,
+// which means the client's partition map is out of date.
+func isWrongPartition(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition && hasReason(err, reasonWrongPartition, "wrong partition")
+}
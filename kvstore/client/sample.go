@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// randomKey returns a key drawn uniformly from the whole cluster.
+func randomKey(c *routedClient) (string, bool, error) {
+	if !c.supports(featureSampling) {
+		return "", false, errors.New("server does not support key sampling")
+	}
+	if len(c.partitions) == 1 {
+		var resp *kvpb.RandomKeyReply
+		err := c.callPartition(0, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.RandomKey(ctx, &kvpb.RandomKeyRequest{})
+			return err
+		})
+		if err != nil {
+			return "", false, err
+		}
+		return resp.Key, resp.Found, nil
+	}
+	keys, _, err := sampleKeys(c, 1)
+	if err != nil || len(keys) == 0 {
+		return "", false, err
+	}
+	return keys[0].Key, true, nil
+}
+
+// sampleKeys draws n keys uniformly without replacement from the whole
+// cluster. Every partition returns a uniform sample of up to n keys. The
+// draws are then split across partitions in proportion to the keys each one
+// has left, which keeps the merged sample uniform.
+func sampleKeys(c *routedClient, n int) ([]*kvpb.SampledKey, uint64, error) {
+	if !c.supports(featureSampling) {
+		return nil, 0, errors.New("server does not support key sampling")
+	}
+	samples := make([][]*kvpb.SampledKey, len(c.partitions))
+	remaining := make([]uint64, len(c.partitions))
+	var population uint64
+	for partition := range c.partitions {
+		var resp *kvpb.SampleKeysReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.SampleKeys(ctx, &kvpb.SampleKeysRequest{N: uint32(n)})
+			return err
+		}); err != nil {
+			return nil, 0, err
+		}
+		samples[partition] = resp.Keys
+		remaining[partition] = uint64(len(resp.Keys))
+		if resp.Population > remaining[partition] {
+			remaining[partition] = resp.Population
+		}
+		population += resp.Population
+	}
+
+	total := uint64(0)
+	for _, r := range remaining {
+		total += r
+	}
+	out := make([]*kvpb.SampledKey, 0, n)
+	for len(out) < n && total > 0 {
+		pick := uint64(rand.Int63n(int64(total)))
+		for partition, r := range remaining {
+			if pick >= r {
+				pick -= r
+				continue
+			}
+			if len(samples[partition]) == 0 {
+				// The partition shrank between its count and its sample.
+				total -= r
+				remaining[partition] = 0
+				break
+			}
+			out = append(out, samples[partition][0])
+			samples[partition] = samples[partition][1:]
+			remaining[partition]--
+			total--
+			break
+		}
+	}
+	return out, population, nil
+}
+
+func printSample(w io.Writer, keys []*kvpb.SampledKey, population uint64) {
+	fmt.Fprintf(w, "SAMPLE %d keys of %d\n", len(keys), population)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s value_bytes=%d\n", k.Key, k.ValueBytes)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	// scanPageSize is the number of pairs fetched per Scan page from
+	// servers that pin a snapshot for later pages.
+	scanPageSize = 1000
+	// scanRestarts bounds how often a paged scan starts over after losing
+	// its snapshot, for example to a leader change.
+	scanRestarts = 3
+	// ttyScanLines is how many pairs a scan prints to a terminal by
+	// default, so an accidentally huge scan does not flood it.
+	ttyScanLines = 1000
+)
+
+// scanShown returns the pairs of a scan to print under c.maxLines and, if
+// that cut any, the first key left out.
+func (c *routedClient) scanShown(pairs []*kvpb.KVPair) ([]*kvpb.KVPair, string) {
+	if c.maxLines <= 0 || len(pairs) <= c.maxLines {
+		return pairs, ""
+	}
+	return pairs[:c.maxLines], pairs[c.maxLines].Key
+}
+
+// scanPartition returns the live pairs of one partition in [startKey,
+// endKey]. Servers that support it are read a page at a time, every page
+// from the snapshot the first one saw, so the result is a consistent view
+// of the partition however long the scan takes.
+func scanPartition(c *routedClient, partition int, startKey, endKey string) ([]*kvpb.KVPair, error) {
+	if !c.supports(featureScanSnapshot) {
+		var resp *kvpb.ScanReply
+		if err := c.callPartition(partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+			var err error
+			resp, err = cli.Scan(ctx, &kvpb.ScanRequest{StartKey: startKey, EndKey: endKey})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		return resp.Pairs, nil
+	}
+	for attempt := 0; ; attempt++ {
+		pairs, err := scanPages(c, partition, startKey, endKey)
+		if !isScanSnapshotLost(err) || attempt == scanRestarts {
+			return pairs, err
+		}
+		log.Printf("scan of partition %d restarting: %v", partition, err)
+	}
+}
+
+// isScanSnapshotLost reports whether the server no longer holds the
+// snapshot a paged scan was reading.
+func isScanSnapshotLost(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition && hasReason(err, reasonScanSnapshotLost, "scan snapshot")
+}
+
+func scanPages(c *routedClient, partition int, startKey, endKey string) ([]*kvpb.KVPair, error) {
+	pager := newScanPager(c, partition, startKey, endKey)
+	var pairs []*kvpb.KVPair
+	for !pager.done {
+		page, err := pager.next()
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, page...)
+	}
+	return pairs, nil
+}
+
+// scanPager reads one partition a page at a time, every page from the
+// snapshot the first one pinned.
+type scanPager struct {
+	c         *routedClient
+	partition int
+	req       *kvpb.ScanRequest
+	// done is set once the last page has been returned.
+	done bool
+}
+
+func newScanPager(c *routedClient, partition int, startKey, endKey string) *scanPager {
+	return &scanPager{c: c, partition: partition, req: &kvpb.ScanRequest{StartKey: startKey, EndKey: endKey, Limit: scanPageSize}}
+}
+
+func (p *scanPager) next() ([]*kvpb.KVPair, error) {
+	var resp *kvpb.ScanReply
+	if err := p.c.callPartition(p.partition, func(ctx context.Context, cli kvpb.KVSClient) error {
+		var err error
+		resp, err = cli.Scan(ctx, p.req)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if !resp.Truncated {
+		p.done = true
+		return resp.Pairs, nil
+	}
+	if len(resp.Pairs) == 0 {
+		return nil, fmt.Errorf("scan of partition %d returned an empty truncated page", p.partition)
+	}
+	// The next page starts just after the last key returned.
+	p.req.StartKey = resp.Pairs[len(resp.Pairs)-1].Key + "\x00"
+	p.req.SnapshotSeq = resp.SnapshotSeq
+	return resp.Pairs, nil
+}
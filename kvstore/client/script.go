@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scriptVars collects repeated --var name=value flags.
+type scriptVars map[string]string
+
+func (v scriptVars) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v scriptVars) Set(raw string) error {
+	name, value, ok := strings.Cut(raw, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", raw)
+	}
+	v[name] = value
+	return nil
+}
+
+// scriptLine is one command of a script file with its 1-based line number.
+type scriptLine struct {
+	num  int
+	text string
+}
+
+// scriptLoop repeats body with loop variable name bound to from..to inclusive.
+type scriptLoop struct {
+	name     string
+	from, to int
+	body     []scriptStep
+}
+
+// scriptStep is either a single command or a FOR loop.
+type scriptStep struct {
+	line scriptLine
+	loop *scriptLoop
+}
+
+var scriptVarRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// parseScript reads a script file. Besides the stdin protocol commands it
+// accepts blank lines, '#' comments, and loops of the form
+//
+//	FOR i 1 10
+//	  PUT key${i} value${i}
+//	END
+func parseScript(path string) ([]scriptStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open script: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	// stack[0] collects top-level steps; each open FOR pushes a frame.
+	stack := [][]scriptStep{nil}
+	var loops []*scriptLoop
+	var loopLines []int
+	num := 0
+	for scanner.Scan() {
+		num++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Fields(text)
+		switch strings.ToUpper(parts[0]) {
+		case "FOR":
+			if len(parts) != 4 {
+				return nil, fmt.Errorf("line %d: FOR requires 3 arguments: var from to", num)
+			}
+			from, err1 := strconv.Atoi(parts[2])
+			to, err2 := strconv.Atoi(parts[3])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("line %d: FOR bounds must be integers", num)
+			}
+			loops = append(loops, &scriptLoop{name: parts[1], from: from, to: to})
+			loopLines = append(loopLines, num)
+			stack = append(stack, nil)
+		case "END":
+			if len(loops) == 0 {
+				return nil, fmt.Errorf("line %d: END without FOR", num)
+			}
+			loop := loops[len(loops)-1]
+			loop.body = stack[len(stack)-1]
+			loops = loops[:len(loops)-1]
+			loopLines = loopLines[:len(loopLines)-1]
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1] = append(stack[len(stack)-1], scriptStep{loop: loop})
+		default:
+			stack[len(stack)-1] = append(stack[len(stack)-1], scriptStep{line: scriptLine{num: num, text: text}})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read script: %w", err)
+	}
+	if len(loops) > 0 {
+		return nil, fmt.Errorf("line %d: FOR without END", loopLines[len(loopLines)-1])
+	}
+	return stack[0], nil
+}
+
+func substituteVars(text string, vars map[string]string) (string, error) {
+	var missing string
+	out := scriptVarRE.ReplaceAllStringFunc(text, func(ref string) string {
+		name := scriptVarRE.FindStringSubmatch(ref)[1]
+		value, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable ${%s}", missing)
+	}
+	return out, nil
+}
+
+// scriptRun tracks progress through a script.
+type scriptRun struct {
+	c           *routedClient
+	stopOnError bool
+	ok, failed  int
+	stopped     bool
+}
+
+// exec runs steps in order and returns false once the script should end,
+// either because of STOP or because a command failed under --stop-on-error.
+func (r *scriptRun) exec(steps []scriptStep, vars map[string]string) bool {
+	for _, step := range steps {
+		if step.loop != nil {
+			scoped := make(map[string]string, len(vars)+1)
+			for name, value := range vars {
+				scoped[name] = value
+			}
+			for i := step.loop.from; i <= step.loop.to; i++ {
+				scoped[step.loop.name] = strconv.Itoa(i)
+				if !r.exec(step.loop.body, scoped) {
+					return false
+				}
+			}
+			continue
+		}
+
+		line, err := substituteVars(step.line.text, vars)
+		var stop bool
+		if err == nil {
+			started := time.Now()
+			stop, err = runCommand(r.c, line)
+			r.c.report.observe(line, time.Since(started), err)
+		}
+		if err != nil {
+			r.failed++
+			log.Printf("line %d: %v", step.line.num, err)
+			if r.stopOnError {
+				return false
+			}
+			continue
+		}
+		r.ok++
+		if stop {
+			r.stopped = true
+			return false
+		}
+	}
+	return true
+}
+
+// scriptMode runs a file of stdin protocol commands and prints a summary
+// line. It returns the number of failed commands.
+func scriptMode(c *routedClient, path string, vars map[string]string, stopOnError bool) (int, error) {
+	steps, err := parseScript(path)
+	if err != nil {
+		return 0, err
+	}
+	run := &scriptRun{c: c, stopOnError: stopOnError}
+	completed := run.exec(steps, vars) || run.stopped
+	status := "completed"
+	if !completed {
+		status = "aborted"
+	}
+	fmt.Printf("SCRIPT %s %s ok=%d failed=%d\n", path, status, run.ok, run.failed)
+	return run.failed, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+
+	"google.golang.org/grpc"
+)
+
+// fakeKVS is an in-memory, single-partition stand-in for a server, enough
+// to drive the stdin protocol end to end.
+type fakeKVS struct {
+	kvpb.UnimplementedKVSServer
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (f *fakeKVS) Capabilities(ctx context.Context, req *kvpb.CapabilitiesRequest) (*kvpb.CapabilitiesReply, error) {
+	return &kvpb.CapabilitiesReply{ApiVersion: 1, Features: []string{featureListDir, featureRangeStats, featureSampling, featureBatch}}, nil
+}
+
+func (f *fakeKVS) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.data[req.Key]
+	f.data[req.Key] = req.Value
+	return &kvpb.PutReply{Found: found}, nil
+}
+
+func (f *fakeKVS) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, found := f.data[req.Key]
+	return &kvpb.GetReply{Value: v, Found: found}, nil
+}
+
+func (f *fakeKVS) Swap(ctx context.Context, req *kvpb.SwapRequest) (*kvpb.SwapReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old, found := f.data[req.Key]
+	f.data[req.Key] = req.Value
+	return &kvpb.SwapReply{OldValue: old, Found: found}, nil
+}
+
+func (f *fakeKVS) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.data[req.Key]
+	delete(f.data, req.Key)
+	return &kvpb.DeleteReply{Found: found}, nil
+}
+
+func (f *fakeKVS) Scan(ctx context.Context, req *kvpb.ScanRequest) (*kvpb.ScanReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &kvpb.ScanReply{}
+	for _, k := range f.sortedKeysLocked() {
+		if k >= req.StartKey && k <= req.EndKey {
+			resp.Pairs = append(resp.Pairs, &kvpb.KVPair{Key: k, Value: f.data[k]})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeKVS) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &kvpb.BatchReply{}
+	for _, op := range req.Ops {
+		old, found := f.data[op.Key]
+		switch op.Op {
+		case "PUT", "SWAP":
+			f.data[op.Key] = op.Value
+		case "DELETE":
+			delete(f.data, op.Key)
+		}
+		resp.Results = append(resp.Results, &kvpb.BatchResult{Found: found, Value: old})
+	}
+	return resp, nil
+}
+
+func (f *fakeKVS) RandomKey(ctx context.Context, req *kvpb.RandomKeyRequest) (*kvpb.RandomKeyReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := f.sortedKeysLocked()
+	if len(keys) == 0 {
+		return &kvpb.RandomKeyReply{}, nil
+	}
+	return &kvpb.RandomKeyReply{Key: keys[0], Found: true}, nil
+}
+
+func (f *fakeKVS) ListDir(ctx context.Context, req *kvpb.ListDirRequest) (*kvpb.ListDirReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &kvpb.ListDirReply{}
+	seen := make(map[string]bool)
+	for _, k := range f.sortedKeysLocked() {
+		if !strings.HasPrefix(k, req.Prefix) || k <= req.StartAfter {
+			continue
+		}
+		if i := strings.Index(k[len(req.Prefix):], req.Delimiter); req.Delimiter != "" && i >= 0 {
+			p := k[:len(req.Prefix)+i+len(req.Delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				resp.CommonPrefixes = append(resp.CommonPrefixes, p)
+			}
+			continue
+		}
+		resp.Entries = append(resp.Entries, &kvpb.KVPair{Key: k, Value: f.data[k]})
+	}
+	return resp, nil
+}
+
+func (f *fakeKVS) RangeStats(ctx context.Context, req *kvpb.RangeStatsRequest) (*kvpb.RangeStatsReply, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &kvpb.RangeStatsReply{TotalKeys: uint64(len(f.data))}
+	for k, v := range f.data {
+		if k >= req.StartKey && k <= req.EndKey {
+			resp.Keys++
+			resp.Bytes += uint64(len(k) + len(v))
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeKVS) sortedKeysLocked() []string {
+	keys := make([]string, 0, len(f.data))
+	for k := range f.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// startFakeKVS serves a fakeKVS holding data and returns a client routed to
+// it.
+func startFakeKVS(t *testing.T, data map[string]string) *routedClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	kvpb.RegisterKVSServer(srv, &fakeKVS{data: data})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	c := newRoutedClient([][]string{{lis.Addr().String()}}, time.Second, time.Second, 10*time.Millisecond, 10*time.Millisecond)
+	c.giveUpAfter = time.Second
+	t.Cleanup(c.close)
+	return c
+}
+
+// runStdin feeds lines to runCommand as stdinMode would and returns what
+// they printed, with the error of any line that failed in place of its
+// output.
+func runStdin(t *testing.T, c *routedClient, lines ...string) string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	func() {
+		defer func() { os.Stdout = stdout }()
+		for _, line := range lines {
+			if _, err := runCommand(c, line); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+			}
+		}
+	}()
+	printed, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(printed)
+}
+
+func TestStdinListDirAndRangeStats(t *testing.T) {
+	c := startFakeKVS(t, map[string]string{"a/1": "x", "a/2": "yy", "b": "z"})
+	got := runStdin(t, c, "LS a/", "RANGESTATS a/ a/~", "LS", "RANGESTATS a b c")
+	want := strings.Join([]string{
+		"LS a/ (2 names) next=done",
+		"  a/1 x",
+		"  a/2 yy",
+		"RANGESTATS a/ a/~ keys~2 bytes~9 (of 3 keys)",
+		"LS  (2 names) next=done",
+		"  a/",
+		"  b z",
+		"error: RANGESTATS requires 2 arguments: start_key end_key",
+	}, "\n") + "\n"
+	if got != want {
+		t.Fatalf("stdin output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestStdinOutputFormat checks each command's result line in the format
+// runner/src/ioapi.rs parses, and the extensions that share its shape.
+func TestStdinOutputFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  map[string]string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "put",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"PUT a 2", "PUT b 3"},
+			want:  []string{"PUT a found", "PUT b not_found"},
+		},
+		{
+			name:  "get",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"GET a", "GET b", "get a"},
+			want:  []string{"GET a 1", "GET b null", "GET a 1"},
+		},
+		{
+			name:  "swap",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"SWAP a 2", "SWAP b 3", "GET a"},
+			want:  []string{"SWAP a 1", "SWAP b null", "GET a 2"},
+		},
+		{
+			name:  "delete",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"DELETE a", "DELETE a"},
+			want:  []string{"DELETE a found", "DELETE a not_found"},
+		},
+		{
+			name:  "scan",
+			data:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			lines: []string{"SCAN a b", "SCAN x z"},
+			want:  []string{"SCAN a b BEGIN", "  a 1", "  b 2", "SCAN END", "SCAN x z BEGIN", "SCAN END"},
+		},
+		{
+			name:  "multi",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"MULTI", "PUT a 2", "GET a", "DELETE b", "EXEC"},
+			want:  []string{"MULTI OK", "QUEUED", "QUEUED", "QUEUED", "EXEC BEGIN", "PUT a found", "GET a 2", "DELETE b not_found", "EXEC END"},
+		},
+		{
+			name:  "discard",
+			data:  map[string]string{},
+			lines: []string{"MULTI", "PUT a 1", "DISCARD", "GET a"},
+			want:  []string{"MULTI OK", "QUEUED", "DISCARD OK", "GET a null"},
+		},
+		{
+			name:  "randomkey",
+			data:  map[string]string{"a": "1"},
+			lines: []string{"RANDOMKEY", "DELETE a", "RANDOMKEY"},
+			want:  []string{"RANDOMKEY a", "DELETE a found", "RANDOMKEY null"},
+		},
+		{
+			name:  "stop",
+			data:  map[string]string{},
+			lines: []string{"STOP"},
+			want:  []string{"STOP"},
+		},
+		{
+			name:  "errors",
+			data:  map[string]string{},
+			lines: []string{"PUT a", "GET", "FROB a", "STOP now"},
+			want: []string{
+				"error: PUT requires 2 arguments: key value",
+				"error: GET requires 1 argument: key",
+				"error: unknown command: FROB",
+				"error: STOP takes no arguments",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := startFakeKVS(t, tc.data)
+			got := runStdin(t, c, tc.lines...)
+			if want := strings.Join(tc.want, "\n") + "\n"; got != want {
+				t.Fatalf("stdin %q printed:\n%s\nwant:\n%s", tc.lines, got, want)
+			}
+		})
+	}
+}
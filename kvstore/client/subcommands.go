@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Subcommands are the CLI's main surface: "client put k v", "client scan a
+// z", "client admin snapshot". Each one runs a --op: its positional
+// arguments and its own flags set the same flag values --op reads, so the
+// two surfaces cannot drift apart. --op still works but is deprecated.
+// Connection flags such as --manager_addrs may come before the subcommand
+// or among its own flags. Flags end at the first positional argument or
+// "--", as with the go command, so an operand such as the -5 of "client
+// merge k -5" is never taken for a flag.
+
+// subcommand is one CLI subcommand.
+type subcommand struct {
+	name string
+	// op is the --op the subcommand runs.
+	op string
+	// args are the flags its positional arguments set, in order; the last
+	// optional of them may be left out.
+	args     []string
+	optional int
+	// flags are the other op flags it takes.
+	flags   []string
+	summary string
+}
+
+var subcommands = []subcommand{
+	{name: "put", op: "put", args: []string{"key", "value"}, flags: []string{"value_type", "content_type"}, summary: "store a value"},
+	{name: "get", op: "get", args: []string{"key"}, summary: "print a key's value"},
+	{name: "swap", op: "swap", args: []string{"key", "value"}, flags: []string{"value_type", "content_type"}, summary: "store a value and print the one it replaced"},
+	{name: "getorput", op: "getorput", args: []string{"key", "value"}, summary: "print a key's value, storing the given default first if it has none"},
+	{name: "merge", op: "merge", args: []string{"key", "value"}, flags: []string{"merge_operator"}, summary: "fold an operand into a key's value with a server merge operator"},
+	{name: "jsonget", op: "jsonget", args: []string{"key", "path"}, optional: 1, summary: "print one field of a key's JSON value"},
+	{name: "jsonset", op: "jsonset", args: []string{"key", "path", "value"}, summary: "set one field of a key's JSON value on the server"},
+	{name: "delete", op: "delete", args: []string{"key"}, summary: "delete a key"},
+	{name: "undelete", op: "undelete", args: []string{"key"}, summary: "restore a soft-deleted key"},
+	{name: "rename", op: "rename", args: []string{"key", "new_key"}, flags: []string{"overwrite"}, summary: "move a value to another key in the same partition"},
+	{name: "trash", op: "trash", args: []string{"start", "end"}, flags: []string{"limit"}, summary: "list soft-deleted keys that can still be restored"},
+	{name: "deleteat", op: "deleteat", args: []string{"key", "at"}, summary: "schedule a key's deletion at an RFC3339 time or +duration"},
+	{name: "expire", op: "expire", args: []string{"key", "ttl"}, summary: "delete a key after a duration"},
+	{name: "persist", op: "persist", args: []string{"key"}, summary: "cancel a key's scheduled deletion"},
+	{name: "ttl", op: "ttl", args: []string{"key"}, summary: "print how long a key has left"},
+	{name: "meta", op: "meta", args: []string{"key"}, summary: "print a key's size, types and, if the server tracks them, access counts"},
+	{name: "expiring", op: "expiring", args: []string{"within"}, flags: []string{"limit"}, summary: "list keys due for deletion within a duration"},
+	{name: "scan", op: "scan", args: []string{"start", "end"}, flags: []string{"max_lines"}, summary: "print the pairs in a key range"},
+	{name: "copyrange", op: "copyrange", args: []string{"start", "end", "dst_prefix"}, summary: "copy a key range, with its TTLs and value types, under a new prefix in one write"},
+	{name: "iterate", op: "iterate", flags: []string{"cursor", "limit"}, summary: "page through every key"},
+	{name: "ls", op: "ls", args: []string{"prefix"}, optional: 1, flags: []string{"delimiter", "cursor", "limit"}, summary: "list the children of a key prefix"},
+	{name: "query", op: "query", args: []string{"sql"}, flags: []string{"param"}, summary: "print the rows a SELECT ... FROM kv query matches"},
+	{name: "rangestats", op: "rangestats", args: []string{"start", "end"}, summary: "estimate the keys and bytes in a key range"},
+	{name: "randomkey", op: "randomkey", summary: "print a random live key"},
+	{name: "sample", op: "sample", args: []string{"count"}, summary: "print a random sample of keys"},
+	{name: "watch", op: "watch", args: []string{"prefix"}, optional: 1, flags: []string{"limit", "partition", "start_seq", "coalesce", "drop_on_lag"}, summary: "stream changes under a prefix"},
+	{name: "verify", op: "verify", flags: []string{"file", "prefix"}, summary: "diff the cluster's contents against an expected JSON dataset"},
+	{name: "info", op: "info", summary: "print every replica's build and role"},
+	{name: "capabilities", op: "capabilities", summary: "print the features the servers support"},
+	{name: "ping", op: "ping", flags: []string{"count"}, summary: "measure round trips to every replica"},
+	{name: "admin stats", op: "stats", summary: "print every replica's stats"},
+	{name: "admin snapshot", op: "compact", summary: "snapshot every replica and compact its raft log"},
+	{name: "admin compact", op: "compact", summary: "same as admin snapshot"},
+	{name: "admin scrub start", op: "scrubnow", summary: "start a background scrub pass on every replica now"},
+	{name: "admin backup", op: "backup", summary: "write a backup of every replica's state under its backer_path"},
+	{name: "admin scrub", op: "scrub", summary: "print the corruption every replica's last background scrub found"},
+	{name: "admin usage", op: "usage", summary: "print usage and quotas per namespace"},
+	{name: "admin replication", op: "replication", summary: "print how far each follower is behind"},
+	{name: "admin histogram", op: "histogram", flags: []string{"sample_size", "delimiter", "depth", "limit"}, summary: "estimate key and value sizes and the largest key prefixes from a sample"},
+	{name: "admin transfer", op: "transfer", flags: []string{"partition", "target"}, summary: "move a partition's leadership to another replica"},
+	{name: "admin drain", op: "drain", flags: []string{"partition", "target"}, summary: "move leadership off a replica before taking it down"},
+	{name: "admin mirror", op: "mirror", summary: "print the mirror status of every partition"},
+	{name: "admin promote", op: "promote", summary: "promote a mirror standby to accept writes"},
+}
+
+// connectionFlags are the flags every subcommand also takes.
+var connectionFlags = []string{
+	"manager_addrs", "timeout", "retry_interval", "max_retry_interval", "connect_timeout", "give_up_after",
+	"quiet", "auth_token", "auth_token_command", "admin_token", "priority", "durability", "trace_id", "route_cache", "route_cache_ttl",
+}
+
+func findSubcommand(args []string) (subcommand, int, bool) {
+	for _, sc := range subcommands {
+		words := strings.Fields(sc.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == sc.name {
+			return sc, len(words), true
+		}
+	}
+	return subcommand{}, 0, false
+}
+
+func (sc subcommand) synopsis() string {
+	var b strings.Builder
+	b.WriteString("client " + sc.name)
+	if len(sc.flags) > 0 {
+		b.WriteString(" [flags]")
+	}
+	for i, arg := range sc.args {
+		if i >= len(sc.args)-sc.optional {
+			fmt.Fprintf(&b, " [<%s>]", arg)
+		} else {
+			fmt.Fprintf(&b, " <%s>", arg)
+		}
+	}
+	return b.String()
+}
+
+// flagSet returns the flags sc takes, sharing their values with the
+// program's own flags. Its usage lists only sc's own flags.
+func (sc subcommand) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	own := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+	own.SetOutput(os.Stderr)
+	for _, name := range sc.flags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+		own.Var(f.Value, name, f.Usage)
+	}
+	for _, name := range connectionFlags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\n  %s\n", sc.synopsis(), sc.summary)
+		if len(sc.flags) > 0 {
+			fmt.Fprintln(os.Stderr, "\nFlags:")
+			own.PrintDefaults()
+		}
+		fmt.Fprintf(os.Stderr, "\nIt also takes the connection flags --%s; see client --help.\n", strings.Join(connectionFlags, ", --"))
+	}
+	return fs
+}
+
+// parseSubcommand sets the flags for the subcommand line args and returns
+// its op. It returns an exit code instead if there is nothing to run.
+func parseSubcommand(args []string) (string, int) {
+	if args[0] == "help" {
+		if sc, _, ok := findSubcommand(args[1:]); ok {
+			sc.flagSet().Usage()
+		} else {
+			printSubcommands(os.Stderr)
+			fmt.Fprintln(os.Stderr, "\nRun \"client help <command>\" for a command's flags, and \"client --help\"\nfor the global flags and the stdin protocol.")
+		}
+		return "", exitOK
+	}
+	sc, words, ok := findSubcommand(args)
+	if !ok {
+		printSubcommands(os.Stderr)
+		return "", usageError("unknown command %q", strings.Join(args, " "))
+	}
+	fs := sc.flagSet()
+	if err := fs.Parse(args[words:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", exitOK
+		}
+		return "", exitUsage
+	}
+	positional := fs.Args()
+	if len(positional) > len(sc.args) || len(positional) < len(sc.args)-sc.optional {
+		fs.Usage()
+		return "", usageError("%s takes %d arguments, got %d", sc.name, len(sc.args), len(positional))
+	}
+	for i, value := range positional {
+		if err := flag.Set(sc.args[i], value); err != nil {
+			return "", usageError("%s: invalid <%s> %q: %v", sc.name, sc.args[i], value, err)
+		}
+	}
+	return sc.op, -1
+}
+
+func printSubcommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	for _, sc := range subcommands {
+		fmt.Fprintf(w, "  %-48s %s\n", sc.synopsis(), sc.summary)
+	}
+}
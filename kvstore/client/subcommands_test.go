@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// registerSubcommandFlags defines, on the program's flag set, the flags
+// that main defines and the named subcommands read.
+func registerSubcommandFlags(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range append(names, connectionFlags...) {
+		if flag.Lookup(name) == nil {
+			flag.String(name, "", "")
+		}
+	}
+}
+
+func TestParseSubcommandStopsFlagsAtFirstArgument(t *testing.T) {
+	registerSubcommandFlags(t, "key", "value", "merge_operator")
+	tests := []struct {
+		args           []string
+		key, value, op string
+		mergeOperator  string
+		wantCode       int
+	}{
+		{args: []string{"merge", "k", "-5"}, key: "k", value: "-5", op: "merge", wantCode: -1},
+		{args: []string{"merge", "--merge_operator", "int-add", "k", "-5"}, key: "k", value: "-5", op: "merge", mergeOperator: "int-add", wantCode: -1},
+		{args: []string{"merge", "--", "-k", "--merge_operator"}, key: "-k", value: "--merge_operator", op: "merge", wantCode: -1},
+		// A flag after the arguments is an argument too, one too many.
+		{args: []string{"merge", "k", "1", "--merge_operator", "int-add"}, wantCode: exitUsage},
+	}
+	for _, tc := range tests {
+		for _, name := range []string{"key", "value", "merge_operator"} {
+			if err := flag.Set(name, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		op, code := parseSubcommand(tc.args)
+		if code != tc.wantCode {
+			t.Fatalf("parseSubcommand(%q) code = %d, want %d", tc.args, code, tc.wantCode)
+		}
+		if code >= 0 {
+			continue
+		}
+		key, value, mergeOperator := flag.Lookup("key").Value.String(), flag.Lookup("value").Value.String(), flag.Lookup("merge_operator").Value.String()
+		if op != tc.op || key != tc.key || value != tc.value || mergeOperator != tc.mergeOperator {
+			t.Fatalf("parseSubcommand(%q) = op %q key %q value %q merge_operator %q; want %q %q %q %q", tc.args, op, key, value, mergeOperator, tc.op, tc.key, tc.value, tc.mergeOperator)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// verifyContents compares the cluster's live pairs under prefix with the
+// expected dataset in path, a JSON object mapping each key to its value,
+// and prints every key that is missing, extra or holds another value. It
+// reads the cluster a page at a time with Iterate, so writes made while it
+// runs may show up as differences. It returns exitNotFound if anything
+// differed.
+func verifyContents(c *routedClient, w io.Writer, path, prefix string) int {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return usageError("verify: %v", err)
+	}
+	var expected map[string]string
+	if err := json.Unmarshal(raw, &expected); err != nil {
+		return usageError("verify: %s is not a JSON object of key to value: %v", path, err)
+	}
+	for key := range expected {
+		if !strings.HasPrefix(key, prefix) {
+			delete(expected, key)
+		}
+	}
+
+	actual := make(map[string]string)
+	cursor := ""
+	for {
+		pairs, next, err := iteratePage(c, cursor, exportPageSize)
+		if err != nil {
+			return rpcFailed(err)
+		}
+		for _, p := range pairs {
+			if strings.HasPrefix(p.Key, prefix) {
+				actual[p.Key] = p.Value
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	keys := make([]string, 0, len(expected)+len(actual))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var missing, extra, mismatched int
+	for _, key := range keys {
+		want, inExpected := expected[key]
+		got, inActual := actual[key]
+		switch {
+		case !inActual:
+			missing++
+			fmt.Fprintf(w, "  MISSING %s expected=%s\n", key, want)
+		case !inExpected:
+			extra++
+			fmt.Fprintf(w, "  EXTRA %s actual=%s\n", key, got)
+		case got != want:
+			mismatched++
+			fmt.Fprintf(w, "  MISMATCH %s expected=%s actual=%s\n", key, want, got)
+		}
+	}
+	result := "ok"
+	if missing+extra+mismatched > 0 {
+		result = "differs"
+	}
+	fmt.Fprintf(w, "VERIFY %s %s expected=%d actual=%d missing=%d extra=%d mismatched=%d\n", path, result, len(expected), len(actual), missing, extra, mismatched)
+	if result != "ok" {
+		return exitNotFound
+	}
+	return exitOK
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// watchResult is one event, or the error that ended a partition's stream.
+type watchResult struct {
+	partition int
+	event     *kvpb.WatchEvent
+	err       error
+}
+
+// watchKeys streams changes under prefix from one partition, or every
+// partition with partition -1, and prints them until limit events have
+// arrived, or forever with limit 0. Keys are hashed across partitions, so
+// events from different partitions are not ordered relative to each other;
+// seq orders them within one partition.
+func watchKeys(c *routedClient, w io.Writer, req *kvpb.WatchRequest, partition, limit int) int {
+	if !c.supports(featureWatch) {
+		version, _ := c.capabilities()
+		fmt.Fprintf(w, "WATCH unsupported by server (api_version=%d)\n", version)
+		return exitRPCError
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan watchResult)
+	if partition >= 0 {
+		go c.watchPartition(ctx, partition, req, results)
+	} else {
+		for p := range c.partitions {
+			go c.watchPartition(ctx, p, req, results)
+		}
+	}
+	seen := 0
+	for res := range results {
+		if res.err != nil {
+			fmt.Fprintf(w, "WATCH partition=%d error=%v\n", res.partition, res.err)
+			return exitRPCError
+		}
+		ev := res.event
+		if ev.Dropped > 0 {
+			fmt.Fprintf(w, "WATCH partition=%d dropped=%d\n", res.partition, ev.Dropped)
+		}
+		switch ev.Op {
+		case "PUT", "SWAP", "MERGE":
+			fmt.Fprintf(w, "WATCH partition=%d seq=%d %s %s %s\n", res.partition, ev.Seq, ev.Op, ev.Key, ev.Value)
+		case "DELETE_AT":
+			fmt.Fprintf(w, "WATCH partition=%d seq=%d %s %s %d\n", res.partition, ev.Seq, ev.Op, ev.Key, ev.DeleteAt)
+		default:
+			fmt.Fprintf(w, "WATCH partition=%d seq=%d %s %s\n", res.partition, ev.Seq, ev.Op, ev.Key)
+		}
+		seen++
+		if limit > 0 && seen >= limit {
+			return exitOK
+		}
+	}
+	return exitOK
+}
+
+// watchEventOps are the ops a WATCH --events filter can name.
+var watchEventOps = []string{"put", "swap", "merge", "delete", "undelete", "delete_at", "expire", "persist"}
+
+// watchLine is a WATCH event as printed: one JSON object per line. A line
+// with only partition and dropped reports events the server dropped.
+type watchLine struct {
+	Partition int    `json:"partition"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Op        string `json:"op,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	UnixNanos int64  `json:"unix_nanos,omitempty"`
+	DeleteAt  int64  `json:"delete_at,omitempty"`
+	Dropped   uint64 `json:"dropped,omitempty"`
+}
+
+// parseWatchCommand parses the arguments of the stdin protocol's
+// WATCH <prefix> [--events op,op] [--from-seq N].
+func parseWatchCommand(args []string) (*kvpb.WatchRequest, map[string]bool, error) {
+	if len(args) == 0 {
+		return nil, nil, errors.New("WATCH requires a prefix")
+	}
+	req := &kvpb.WatchRequest{Prefix: args[0]}
+	var ops map[string]bool
+	for rest := args[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			return nil, nil, fmt.Errorf("WATCH %s requires a value", rest[0])
+		}
+		switch rest[0] {
+		case "--events":
+			ops = make(map[string]bool)
+			for _, op := range strings.Split(strings.ToLower(rest[1]), ",") {
+				if !slices.Contains(watchEventOps, op) {
+					return nil, nil, fmt.Errorf("WATCH --events: unknown event %q (have %s)", op, strings.Join(watchEventOps, ","))
+				}
+				ops[strings.ToUpper(op)] = true
+			}
+		case "--from-seq":
+			seq, err := strconv.ParseUint(rest[1], 10, 64)
+			if err != nil || seq == 0 {
+				return nil, nil, fmt.Errorf("WATCH --from-seq must be a positive integer, got %q", rest[1])
+			}
+			req.StartSeq = seq
+		default:
+			return nil, nil, fmt.Errorf("WATCH: unknown option %q (expected --events or --from-seq)", rest[0])
+		}
+	}
+	return req, ops, nil
+}
+
+// watchJSON streams changes under req.Prefix from every partition to w as
+// JSON lines, keeping only events whose op is in ops if ops is set, until
+// a partition's watch fails for good. Watches reconnect on their own. A
+// start seq is a position in each partition's own log, so with several
+// partitions every one of them replays from it.
+func watchJSON(c *routedClient, w io.Writer, req *kvpb.WatchRequest, ops map[string]bool) error {
+	if !c.supports(featureWatch) {
+		version, _ := c.capabilities()
+		return fmt.Errorf("WATCH unsupported by server (api_version=%d)", version)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan watchResult)
+	for p := range c.partitions {
+		go c.watchPartition(ctx, p, req, results)
+	}
+	enc := json.NewEncoder(w)
+	for res := range results {
+		if res.err != nil {
+			return fmt.Errorf("WATCH partition %d: %w", res.partition, res.err)
+		}
+		ev := res.event
+		if ev.Dropped > 0 {
+			if err := enc.Encode(watchLine{Partition: res.partition, Dropped: ev.Dropped}); err != nil {
+				return err
+			}
+		}
+		if ops != nil && !ops[ev.Op] {
+			continue
+		}
+		line := watchLine{Partition: res.partition, Seq: ev.Seq, Op: ev.Op, Key: ev.Key, Value: ev.Value, UnixNanos: ev.UnixNanos, DeleteAt: ev.DeleteAt}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchPartition keeps a watch open on partition and forwards its events,
+// trying the last known leader first. When a stream breaks it reconnects,
+// to any replica, from the seq of the last event it forwarded: the pairs of
+// one ingest share a seq, so the events already forwarded at that seq are
+// skipped rather than resuming one past it and risking a gap. Errors a
+// reconnect cannot fix, such as falling behind or a start_seq that was
+// compacted away, end the watch. A live watch that breaks before its first
+// event resumes live and may miss the changes made while it reconnects.
+func (c *routedClient) watchPartition(ctx context.Context, partition int, req *kvpb.WatchRequest, results chan<- watchResult) {
+	send := func(res watchResult) bool {
+		select {
+		case results <- res:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	req = proto.Clone(req).(*kvpb.WatchRequest)
+	var lastSeq uint64
+	// forwarded counts the events forwarded at lastSeq, and skip those a
+	// resumed stream has yet to send again.
+	var forwarded, skip int
+	backoff := c.retry
+	for {
+		var lastErr error
+		progressed := false
+		addrs := c.replicaAddrs(partition)
+		for _, idx := range c.getReplicaOrder(partition) {
+			cli, err := c.ensureConn(addrs[idx])
+			if err != nil {
+				log.Printf("%v", err)
+				c.resetConn(addrs[idx])
+				lastErr = err
+				continue
+			}
+			stream, err := cli.Watch(ctx, req)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for {
+				ev, err := stream.Recv()
+				if err != nil {
+					lastErr = err
+					break
+				}
+				if ev.Seq == lastSeq && skip > 0 {
+					skip--
+					continue
+				}
+				if ev.Seq != lastSeq {
+					lastSeq, forwarded, skip = ev.Seq, 0, 0
+				}
+				if !send(watchResult{partition: partition, event: ev}) {
+					return
+				}
+				forwarded++
+				progressed = true
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			switch status.Code(lastErr) {
+			case codes.ResourceExhausted, codes.OutOfRange, codes.InvalidArgument, codes.Unimplemented:
+				send(watchResult{partition: partition, err: lastErr})
+				return
+			}
+			log.Printf("watch on %s broke after seq %d: %v; reconnecting", addrs[idx], lastSeq, lastErr)
+			if lastSeq > 0 {
+				req.StartSeq, skip = lastSeq, forwarded
+			}
+		}
+		if progressed {
+			backoff = c.retry
+		} else if backoff >= c.maxRetry {
+			send(watchResult{partition: partition, err: fmt.Errorf("no replica accepted the watch: %w", lastErr)})
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, c.maxRetry)
+	}
+}
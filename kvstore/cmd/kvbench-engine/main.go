@@ -0,0 +1,305 @@
+// Command kvbench-engine measures a server's storage engine on its own, with
+// no gRPC or raft replication in front of it: every write is appended to
+// the raft log in sqlite, synced, and applied to the in-memory index, and
+// every read comes from the index.
+//
+//	kvbench-engine                                    # the default matrix
+//	kvbench-engine --key_sizes 16 --value_sizes 1024 --mixes read,90:5
+//	kvbench-engine --json > before.jsonl              # one JSON line per case
+//
+// Each case preloads --keys keys and then runs --ops operations picked from
+// its mix with the same --seed, so reports from different engines, or from
+// one engine before and after a change, compare case by case. The tree has
+// one engine, "btree"; --engine takes a comma-separated list so others can
+// join the same report.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+	"madkv/kvstore/walformat"
+	_ "modernc.org/sqlite"
+)
+
+// engine is the storage a case runs against.
+type engine interface {
+	put(key, value string) error
+	delete(key string) error
+	get(key string) (string, bool)
+	close() error
+}
+
+// engines opens each engine by name in an empty directory.
+var engines = map[string]func(dir string) (engine, error){
+	"btree": openBtreeEngine,
+}
+
+// btreeEngine is the server's storage path: a B-tree index in memory in
+// front of the raft log in sqlite.
+type btreeEngine struct {
+	db    *sql.DB
+	tree  *btree.BTreeG[pair]
+	index uint64
+	buf   []byte
+}
+
+type pair struct{ key, value string }
+
+func openBtreeEngine(dir string) (engine, error) {
+	db, err := sql.Open("sqlite", filepath.Join(dir, walformat.DBFileName))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(walformat.Pragmas + walformat.Schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("initialize sqlite schema: %w", err)
+	}
+	return &btreeEngine{db: db, tree: btree.NewG(8, func(a, b pair) bool { return a.key < b.key })}, nil
+}
+
+// append logs wal as the server logs a client command.
+func (e *btreeEngine) append(wal *kvpb.WALCommand) error {
+	e.index++
+	wal.UnixNanos = time.Now().UnixNano()
+	payload, err := proto.MarshalOptions{}.MarshalAppend(e.buf[:0], &kvpb.ClientCommand{Wal: wal})
+	if err != nil {
+		return err
+	}
+	e.buf = payload
+	_, err = e.db.Exec(walformat.AppendSQL, e.index, 1, payload, walformat.Checksum(payload))
+	return err
+}
+
+func (e *btreeEngine) put(key, value string) error {
+	if err := e.append(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: key, Value: value}); err != nil {
+		return err
+	}
+	e.tree.ReplaceOrInsert(pair{key, value})
+	return nil
+}
+
+func (e *btreeEngine) delete(key string) error {
+	if err := e.append(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE, Key: key}); err != nil {
+		return err
+	}
+	e.tree.Delete(pair{key: key})
+	return nil
+}
+
+func (e *btreeEngine) get(key string) (string, bool) {
+	p, ok := e.tree.Get(pair{key: key})
+	return p.value, ok
+}
+
+func (e *btreeEngine) close() error { return e.db.Close() }
+
+// mix is a share of reads and deletes; the rest of the operations are puts.
+type mix struct {
+	name           string
+	reads, deletes float64
+}
+
+var namedMixes = map[string]mix{
+	"write":  {name: "write"},
+	"update": {name: "update", reads: 0.5},
+	"read":   {name: "read", reads: 0.95},
+	"churn":  {name: "churn", reads: 0.5, deletes: 0.25},
+}
+
+// parseMix reads a named mix or "<read%>:<delete%>", such as 90:5.
+func parseMix(s string) (mix, error) {
+	if m, ok := namedMixes[s]; ok {
+		return m, nil
+	}
+	r, d, ok := strings.Cut(s, ":")
+	reads, err1 := strconv.ParseFloat(r, 64)
+	deletes, err2 := strconv.ParseFloat(d, 64)
+	if !ok || err1 != nil || err2 != nil || reads < 0 || deletes < 0 || reads+deletes > 100 {
+		return mix{}, fmt.Errorf("mix %q is not write, update, read, churn or <read%%>:<delete%%> adding up to at most 100", s)
+	}
+	return mix{name: s, reads: reads / 100, deletes: deletes / 100}, nil
+}
+
+// result is one case's report line.
+type result struct {
+	Engine    string  `json:"engine"`
+	KeySize   int     `json:"key_size"`
+	ValueSize int     `json:"value_size"`
+	Mix       string  `json:"mix"`
+	Ops       int     `json:"ops"`
+	Reads     int     `json:"reads"`
+	Writes    int     `json:"writes"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	MBPerSec  float64 `json:"mb_per_sec"`
+	ReadP50   float64 `json:"read_p50_us"`
+	ReadP99   float64 `json:"read_p99_us"`
+	WriteP50  float64 `json:"write_p50_us"`
+	WriteP99  float64 `json:"write_p99_us"`
+}
+
+// runCase measures one engine on one workload, in a new directory under
+// baseDir.
+func runCase(open func(string) (engine, error), baseDir string, numKeys, ops int, seed int64, keySize, valueSize int, m mix) (result, error) {
+	dir, err := os.MkdirTemp(baseDir, "kvbench-engine-")
+	if err != nil {
+		return result{}, err
+	}
+	defer os.RemoveAll(dir)
+	e, err := open(dir)
+	if err != nil {
+		return result{}, err
+	}
+	defer e.close()
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		id := fmt.Sprintf("k%d-", i)
+		keys[i] = id + strings.Repeat("x", max(keySize-len(id), 0))
+	}
+	value := strings.Repeat("v", valueSize)
+	for _, key := range keys {
+		if err := e.put(key, value); err != nil {
+			return result{}, fmt.Errorf("preload %q: %w", key, err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	var reads, writes []time.Duration
+	started := time.Now()
+	for i := 0; i < ops; i++ {
+		key := keys[rng.Intn(len(keys))]
+		opStart := time.Now()
+		switch r := rng.Float64(); {
+		case r < m.reads:
+			e.get(key)
+			reads = append(reads, time.Since(opStart))
+			continue
+		case r < m.reads+m.deletes:
+			err = e.delete(key)
+		default:
+			err = e.put(key, value)
+		}
+		if err != nil {
+			return result{}, err
+		}
+		writes = append(writes, time.Since(opStart))
+	}
+	elapsed := time.Since(started).Seconds()
+	res := result{KeySize: keySize, ValueSize: valueSize, Mix: m.name, Ops: ops, Reads: len(reads), Writes: len(writes), OpsPerSec: float64(ops) / elapsed, MBPerSec: float64(ops*(keySize+valueSize)) / elapsed / 1e6}
+	res.ReadP50, res.ReadP99 = percentile(reads, 0.5), percentile(reads, 0.99)
+	res.WriteP50, res.WriteP99 = percentile(writes, 0.5), percentile(writes, 0.99)
+	return res, nil
+}
+
+// percentile returns the p-th quantile of ds in microseconds, or 0 if ds is
+// empty. It sorts ds.
+func percentile(ds []time.Duration, p float64) float64 {
+	if len(ds) == 0 {
+		return 0
+	}
+	slices.Sort(ds)
+	return float64(ds[int(p*float64(len(ds)-1))]) / float64(time.Microsecond)
+}
+
+func parseSizes(name, raw string) ([]int, error) {
+	var sizes []int
+	for _, s := range strings.Split(raw, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("--%s: %q is not a positive size", name, s)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+func main() {
+	baseDir := flag.String("dir", "", "directory to create each case's database in; the default is the system temporary directory")
+	engineNames := flag.String("engine", "btree", "comma-separated engines to measure")
+	keySizesRaw := flag.String("key_sizes", "16,128", "comma-separated key sizes in bytes")
+	valueSizesRaw := flag.String("value_sizes", "100,4096", "comma-separated value sizes in bytes")
+	mixesRaw := flag.String("mixes", "write,update,read,churn", "comma-separated operation mixes: write (all puts), update (50% reads), read (95% reads), churn (50% reads, 25% deletes), or <read%>:<delete%> with puts for the rest")
+	numKeys := flag.Int("keys", 2000, "keys preloaded before each case, and the key space its operations pick from")
+	ops := flag.Int("ops", 20000, "operations measured per case")
+	seed := flag.Int64("seed", 1, "seed for the operation sequence; keep it fixed to compare runs")
+	asJSON := flag.Bool("json", false, "print one JSON object per case instead of a table")
+	flag.Parse()
+
+	keySizes, err := parseSizes("key_sizes", *keySizesRaw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	valueSizes, err := parseSizes("value_sizes", *valueSizesRaw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mixes []mix
+	for _, s := range strings.Split(*mixesRaw, ",") {
+		m, err := parseMix(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatal(err)
+		}
+		mixes = append(mixes, m)
+	}
+	names := strings.Split(*engineNames, ",")
+	for _, name := range names {
+		if engines[name] == nil {
+			log.Fatalf("unknown engine %q (have btree)", name)
+		}
+	}
+	if *numKeys <= 0 || *ops <= 0 {
+		log.Fatal("--keys and --ops must be positive")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if !*asJSON {
+		fmt.Printf(rowFormat, "engine", "key", "value", "mix", "ops/s", "MB/s", "read p50", "read p99", "write p50", "write p99")
+	}
+	for _, name := range names {
+		for _, keySize := range keySizes {
+			for _, valueSize := range valueSizes {
+				for _, m := range mixes {
+					res, err := runCase(engines[name], *baseDir, *numKeys, *ops, *seed, keySize, valueSize, m)
+					if err != nil {
+						log.Fatalf("%s key=%d value=%d mix=%s: %v", name, keySize, valueSize, m.name, err)
+					}
+					res.Engine = name
+					if *asJSON {
+						_ = enc.Encode(res)
+						continue
+					}
+					fmt.Printf(rowFormat, res.Engine, strconv.Itoa(res.KeySize), strconv.Itoa(res.ValueSize), res.Mix,
+						fmt.Sprintf("%.0f", res.OpsPerSec), fmt.Sprintf("%.2f", res.MBPerSec),
+						micros(res.ReadP50, res.Reads), micros(res.ReadP99, res.Reads), micros(res.WriteP50, res.Writes), micros(res.WriteP99, res.Writes))
+				}
+			}
+		}
+	}
+}
+
+// rowFormat lays out the table, a row per case, as each case finishes.
+const rowFormat = "%-8s %5s %6s %-8s %9s %8s %10s %10s %10s %10s\n"
+
+// micros formats a latency in microseconds, or "-" if no operation of its
+// kind ran.
+func micros(us float64, ops int) string {
+	if ops == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fus", us)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    mix
+		wantErr bool
+	}{
+		{in: "churn", want: mix{name: "churn", reads: 0.5, deletes: 0.25}},
+		{in: "90:5", want: mix{name: "90:5", reads: 0.9, deletes: 0.05}},
+		{in: "90:20", wantErr: true},
+		{in: "mostly-reads", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseMix(tc.in)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseMix(%q) = %+v, %v; want %+v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestRunCaseReportsEveryOperation(t *testing.T) {
+	res, err := runCase(openBtreeEngine, t.TempDir(), 20, 200, 1, 16, 32, namedMixes["churn"])
+	if err != nil {
+		t.Fatalf("runCase() failed: %v", err)
+	}
+	if res.Reads+res.Writes != 200 || res.Reads == 0 || res.Writes == 0 || res.OpsPerSec <= 0 {
+		t.Fatalf("runCase() = %+v, want 200 reads and writes between them", res)
+	}
+}
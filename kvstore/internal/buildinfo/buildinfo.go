@@ -0,0 +1,69 @@
+// Package buildinfo reports which build of the server or client binary is
+// running, for --version and GetServerInfo.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and BuildTime can be stamped at link time, e.g.
+//
+//	go build -ldflags "-X madkv/kvstore/internal/buildinfo.Version=v1.2.0 -X madkv/kvstore/internal/buildinfo.BuildTime=$(date -u +%FT%TZ)"
+//
+// Otherwise they fall back to what the Go toolchain embedded in the binary.
+var (
+	Version   = "dev"
+	BuildTime = ""
+)
+
+// Info describes a build.
+type Info struct {
+	Version   string
+	Commit    string
+	BuildTime string
+	GoVersion string
+	Modified  bool
+}
+
+// Read returns the running binary's build.
+func Read() Info {
+	info := Info{Version: Version, BuildTime: BuildTime, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			// Commit time is the best stand-in when no build time was stamped.
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+func (b Info) String() string {
+	commit := b.Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+	if b.Modified {
+		commit += "-dirty"
+	}
+	built := b.BuildTime
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("version=%s commit=%s built=%s go=%s", b.Version, commit, built, b.GoVersion)
+}
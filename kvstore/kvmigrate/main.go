@@ -0,0 +1,72 @@
+// Command kvmigrate upgrades a stopped server's raft log to the format the
+// current server reads:
+//
+//	kvmigrate --backer_path <dir>          # upgrade in place
+//	kvmigrate --backer_path <dir> --check  # only report the format
+//
+// The upgrade runs in one sqlite transaction, so an interrupted run leaves
+// the log as it was.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"madkv/kvstore/walformat"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	backerDir := flag.String("backer_path", "data", "server data directory to upgrade; the server must be stopped")
+	check := flag.Bool("check", false, "report the log's format and whether it needs upgrading, without changing it")
+	flag.Parse()
+
+	dbPath := filepath.Join(*backerDir, walformat.DBFileName)
+	if _, err := os.Stat(dbPath); err != nil {
+		log.Fatalf("no server database: %v", err)
+	}
+	// busy_timeout 0: fail at once, rather than wait, if a server has it.
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?_pragma=busy_timeout(0)")
+	if err != nil {
+		log.Fatalf("open %s: %v", dbPath, err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	format, err := walformat.Detect(db)
+	if err != nil {
+		log.Fatalf("detect format of %s: %v", dbPath, err)
+	}
+	if *check {
+		fmt.Printf("%s: format %s; current is %s\n", dbPath, walformat.Name(format), walformat.Name(walformat.Current))
+		if format != walformat.Current && format != walformat.Empty {
+			os.Exit(1)
+		}
+		return
+	}
+
+	start := time.Now()
+	lastLog := start
+	from, err := walformat.Migrate(db, func(done, total int) {
+		if now := time.Now(); now.Sub(lastLog) >= 5*time.Second {
+			log.Printf("converted %d/%d entries", done, total)
+			lastLog = now
+		}
+	})
+	if err != nil {
+		log.Fatalf("migrate %s: %v", dbPath, err)
+	}
+	if from == walformat.Current {
+		log.Printf("%s is already in format %s", dbPath, walformat.Name(from))
+		return
+	}
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		log.Printf("checkpoint failed: %v", err)
+	}
+	log.Printf("upgraded %s from format %s to %s in %s", dbPath, walformat.Name(from), walformat.Name(walformat.Current), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// balancer spreads partition leaders across hosts. After a rolling restart
+// the host that stayed up longest tends to lead every partition and take all
+// the writes; each round moves at most one leader from the busiest host to
+// the idlest one until the counts differ by at most one.
+type balancer struct {
+	serverAddrs []string
+	serverRF    int
+	timeout     time.Duration
+	// adminToken is the servers' --admin_token.
+	adminToken string
+	// conns are connections to the servers' Admin services, keyed by API
+	// address.
+	conns map[string]*grpc.ClientConn
+}
+
+func newBalancer(serverAddrs []string, serverRF int, adminToken string) *balancer {
+	return &balancer{
+		serverAddrs: serverAddrs,
+		serverRF:    serverRF,
+		timeout:     5 * time.Second,
+		adminToken:  adminToken,
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (b *balancer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := b.round(); err != nil {
+			log.Printf("leader balancing: %v", err)
+		}
+	}
+}
+
+// admin returns an Admin client for the server at addr, asking it first
+// where it serves Admin.
+func (b *balancer) admin(addr string) (kvpb.AdminClient, error) {
+	if conn, ok := b.conns[addr]; ok {
+		return kvpb.NewAdminClient(conn), nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	info, err := kvpb.NewKVSClient(conn).GetServerInfo(ctx, &kvpb.GetServerInfoRequest{})
+	cancel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if target := resolveAdminAddr(addr, info.AdminAddr); target != addr || b.adminToken != "" {
+		_ = conn.Close()
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if b.adminToken != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(adminBearer(b.adminToken)))
+		}
+		if conn, err = grpc.NewClient(target, opts...); err != nil {
+			return nil, err
+		}
+	}
+	b.conns[addr] = conn
+	return kvpb.NewAdminClient(conn), nil
+}
+
+// resolveAdminAddr returns where the server at apiAddr serves Admin, given
+// the admin_addr its GetServerInfo reported: apiAddr itself if that is
+// empty, and otherwise the reported address with apiAddr's host in place of
+// an unspecified one such as 0.0.0.0.
+func resolveAdminAddr(apiAddr, reported string) string {
+	if reported == "" {
+		return apiAddr
+	}
+	host, port, err := net.SplitHostPort(reported)
+	if err != nil {
+		return reported
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return net.JoinHostPort(hostOf(apiAddr), port)
+	}
+	return reported
+}
+
+// adminBearer sends the admin token with every RPC on a connection.
+type adminBearer string
+
+func (t adminBearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t adminBearer) RequireTransportSecurity() bool { return false }
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// partitionView is what one round learned about a partition.
+type partitionView struct {
+	leader int
+	voters []int
+}
+
+// round polls every replica and, if the hosts are out of balance, moves one
+// leader. Partitions with an unreachable replica or no leader are left alone.
+func (b *balancer) round() error {
+	leaders := make(map[string]int)
+	for _, addr := range b.serverAddrs {
+		leaders[hostOf(addr)] = 0
+	}
+	numPartitions := len(b.serverAddrs) / b.serverRF
+	views := make([]*partitionView, numPartitions)
+	for p := 0; p < numPartitions; p++ {
+		view := &partitionView{leader: -1}
+		for r := 0; r < b.serverRF; r++ {
+			addr := b.serverAddrs[p*b.serverRF+r]
+			admin, err := b.admin(addr)
+			if err != nil {
+				view = nil
+				break
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+			resp, err := admin.Stats(ctx, &kvpb.StatsRequest{})
+			cancel()
+			if err != nil {
+				view = nil
+				break
+			}
+			if resp.Role == "leader" {
+				view.leader = r
+			}
+			if resp.MemberType == "" || resp.MemberType == "voter" {
+				view.voters = append(view.voters, r)
+			}
+		}
+		if view != nil && view.leader >= 0 {
+			views[p] = view
+			leaders[hostOf(b.serverAddrs[p*b.serverRF+view.leader])]++
+		}
+	}
+
+	hosts := make([]string, 0, len(leaders))
+	for host := range leaders {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if leaders[hosts[i]] != leaders[hosts[j]] {
+			return leaders[hosts[i]] < leaders[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	busiest := hosts[len(hosts)-1]
+	for _, idlest := range hosts {
+		if leaders[busiest]-leaders[idlest] <= 1 {
+			return nil
+		}
+		for p, view := range views {
+			if view == nil || hostOf(b.serverAddrs[p*b.serverRF+view.leader]) != busiest {
+				continue
+			}
+			for _, r := range view.voters {
+				if hostOf(b.serverAddrs[p*b.serverRF+r]) == idlest {
+					return b.transfer(p, view.leader, r)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *balancer) transfer(partition, from, to int) error {
+	addr := b.serverAddrs[partition*b.serverRF+from]
+	admin, err := b.admin(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	resp, err := admin.TransferLeadership(ctx, &kvpb.TransferLeadershipRequest{TargetReplicaId: uint32(to)})
+	if err != nil {
+		return fmt.Errorf("move partition %d leader from replica %d to %d: %w", partition, from, to, err)
+	}
+	log.Printf("moved partition %d leader from replica %d (%s) to %d (%s) at term %d",
+		partition, from, addr, to, b.serverAddrs[partition*b.serverRF+to], resp.Term)
+	return nil
+}
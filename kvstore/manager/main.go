@@ -114,6 +114,8 @@ func main() {
 	serverRF := flag.Int("server_rf", 1, "server replication factor")
 	servers := flag.String("server_addrs", "127.0.0.1:3777", "comma-separated list of server public addresses")
 	_ = flag.String("backer_path", "./backer.m.0", "unused manager backer path for non-replicated manager mode")
+	balanceInterval := flag.Duration("balance_interval", 0, "move partition leaders between hosts this often so none leads more than one above another; 0 disables")
+	adminToken := flag.String("admin_token", "", "the servers' --admin_token, sent with the Admin RPCs leader balancing makes")
 	flag.Parse()
 
 	serverAddrs, err := parseServers(*servers)
@@ -125,6 +127,10 @@ func main() {
 		log.Fatalf("manager init failed: %v", err)
 	}
 
+	if *balanceInterval > 0 {
+		go newBalancer(serverAddrs, *serverRF, *adminToken).run(*balanceInterval)
+	}
+
 	lis, err := net.Listen("tcp", *managerListen)
 	if err != nil {
 		log.Fatalf("listen failed: %v", err)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Per-key access statistics, kept when --access_stats is set, tell owners
+// which keys nothing reads or writes any more. They live in memory on each
+// replica and are not replicated: writes are counted as they apply, and
+// reads on whichever replica serves them, which is the leader. Each live
+// key costs an entry, which is why tracking is off by default.
+
+// keyAccess is one key's counts and the times of its latest read and write.
+type keyAccess struct {
+	reads, writes       uint64
+	lastRead, lastWrite int64
+}
+
+// accessStats is the per-key access table, guarded by kvServer.mu. A nil
+// *accessStats tracks nothing.
+type accessStats struct {
+	since int64
+	keys  map[string]*keyAccess
+}
+
+func newAccessStats(enabled bool) *accessStats {
+	if !enabled {
+		return nil
+	}
+	return &accessStats{since: time.Now().UnixNano(), keys: make(map[string]*keyAccess)}
+}
+
+func (a *accessStats) entryLocked(key string) *keyAccess {
+	e := a.keys[key]
+	if e == nil {
+		e = &keyAccess{}
+		a.keys[key] = e
+	}
+	return e
+}
+
+// readLocked counts a read of key.
+func (a *accessStats) readLocked(key string) {
+	if a == nil {
+		return
+	}
+	e := a.entryLocked(key)
+	e.reads++
+	e.lastRead = time.Now().UnixNano()
+}
+
+// wroteLocked counts a write that left key with a value.
+func (a *accessStats) wroteLocked(key string) {
+	if a == nil {
+		return
+	}
+	e := a.entryLocked(key)
+	e.writes++
+	e.lastWrite = time.Now().UnixNano()
+}
+
+// forgetLocked drops a deleted key's entry.
+func (a *accessStats) forgetLocked(key string) {
+	if a == nil {
+		return
+	}
+	delete(a.keys, key)
+}
+
+// reset starts tracking over, as when a snapshot replaces every key.
+func (a *accessStats) reset() {
+	if a == nil {
+		return
+	}
+	a.since = time.Now().UnixNano()
+	a.keys = make(map[string]*keyAccess)
+}
+
+// lookupLocked returns key's statistics, all zero if it has not been
+// accessed since tracking started, or nil if tracking is off.
+func (a *accessStats) lookupLocked(key string) *kvpb.KeyAccess {
+	if a == nil {
+		return nil
+	}
+	out := &kvpb.KeyAccess{SinceUnixNanos: a.since}
+	if e := a.keys[key]; e != nil {
+		out.Reads, out.Writes = e.reads, e.writes
+		out.LastReadUnixNanos, out.LastWriteUnixNanos = e.lastRead, e.lastWrite
+	}
+	return out
+}
+
+// GetMeta returns key's type, content type, size, deletion schedule and,
+// if tracked, access statistics. It does not count as a read.
+func (s *kvServer) GetMeta(ctx context.Context, req *kvpb.GetMetaRequest) (*kvpb.GetMetaReply, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateKeyOwner(req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	it, found := s.getLiveLocked(req.Key)
+	if !found {
+		return &kvpb.GetMetaReply{Found: false}, nil
+	}
+	return &kvpb.GetMetaReply{
+		Found:       true,
+		ValueType:   it.vtype,
+		ContentType: it.contentType,
+		ValueBytes:  uint64(len(it.value)),
+		DeleteAt:    it.deleteAt,
+		Access:      s.accessStats.lookupLocked(req.Key),
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestGetMetaReportsAccess(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	meta := func(key string) *kvpb.GetMetaReply {
+		t.Helper()
+		got, err := srv.GetMeta(context.Background(), &kvpb.GetMetaRequest{Key: key})
+		if err != nil {
+			t.Fatalf("GetMeta(%s) failed: %v", key, err)
+		}
+		return got
+	}
+
+	if _, err := srv.Put(call("put-a"), &kvpb.PutRequest{Key: "a", Value: "12345", ContentType: "text/plain"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := meta("a"); !got.Found || got.ValueBytes != 5 || got.ContentType != "text/plain" || got.Access != nil {
+		t.Fatalf("GetMeta without tracking = %v, want 5 text/plain bytes and no access stats", got)
+	}
+
+	srv.mu.Lock()
+	srv.accessStats = newAccessStats(true)
+	srv.mu.Unlock()
+	for i, key := range []string{"a", "b"} {
+		if _, err := srv.Put(call("put-again-"+key), &kvpb.PutRequest{Key: key, Value: "v"}); err != nil {
+			t.Fatalf("Put %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "a"}); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	got := meta("a").Access
+	if got.Reads != 3 || got.Writes != 1 || got.LastReadUnixNanos < got.LastWriteUnixNanos || got.LastWriteUnixNanos < got.SinceUnixNanos {
+		t.Fatalf("access of a = %v, want 3 reads after 1 write", got)
+	}
+	meta("a")
+	if got := meta("a").Access; got.Reads != 3 {
+		t.Fatalf("reads after GetMeta = %d, want GetMeta not to count", got.Reads)
+	}
+	if got := meta("b").Access; got.Reads != 0 || got.Writes != 1 || got.LastReadUnixNanos != 0 {
+		t.Fatalf("access of b = %v, want a write and no reads", got)
+	}
+
+	if _, err := srv.Delete(call("del-b"), &kvpb.DeleteRequest{Key: "b"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := srv.Put(call("put-b-again"), &kvpb.PutRequest{Key: "b", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := meta("b").Access; got.Writes != 1 {
+		t.Fatalf("writes of a recreated key = %d, want its old stats dropped", got.Writes)
+	}
+	if got := meta("missing"); got.Found || got.Access != nil {
+		t.Fatalf("GetMeta of a missing key = %v, want not found", got)
+	}
+}
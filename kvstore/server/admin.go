@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// adminServer serves the Admin service from the same state as the KVS API.
+type adminServer struct {
+	kvpb.UnimplementedAdminServer
+	kv *kvServer
+}
+
+func (a *adminServer) Stats(ctx context.Context, req *kvpb.StatsRequest) (*kvpb.StatsReply, error) {
+	s := a.kv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &kvpb.StatsReply{
+		PartitionId:          uint32(s.partitionID),
+		ReplicaId:            uint32(s.replicaID),
+		Role:                 s.role,
+		CommitIndex:          s.commitIndex,
+		LastApplied:          s.lastApplied,
+		LiveKeys:             uint64(s.liveKeys),
+		Tombstones:           uint64(s.tombstones),
+		GcHorizon:            s.gcHorizonLocked(),
+		TombstonesPurged:     s.tombstonesPurged,
+		SnapshotIndex:        s.snapshotIndex,
+		LogStart:             s.logBase + 1,
+		CompactionQueueDepth: uint32(s.compactor.queueDepth()),
+		Followers:            s.followerStatusLocked(time.Now()),
+		MemberType:           s.memberType(s.replicaID),
+	}, nil
+}
+
+func (a *adminServer) Compact(ctx context.Context, req *kvpb.CompactRequest) (*kvpb.CompactReply, error) {
+	return &kvpb.CompactReply{Queued: a.kv.compactor.enqueue(compactionJobSnapshot)}, nil
+}
+
+func (a *adminServer) NamespaceUsage(ctx context.Context, req *kvpb.NamespaceUsageRequest) (*kvpb.NamespaceUsageReply, error) {
+	a.kv.mu.Lock()
+	usage := a.kv.namespaceUsageLocked()
+	a.kv.mu.Unlock()
+	usage, start, end := a.kv.meter.report(usage)
+	reply := &kvpb.NamespaceUsageReply{Namespaces: usage}
+	if !end.IsZero() {
+		reply.WindowStartUnixNanos, reply.WindowEndUnixNanos = start.UnixNano(), end.UnixNano()
+	}
+	return reply, nil
+}
+
+// locked returns fn wrapped to run under s.mu, for metrics that read
+// state it guards.
+func (s *kvServer) locked(fn func() float64) func() float64 {
+	return func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return fn()
+	}
+}
+
+// registerMetrics exports the server's state through r.
+func (s *kvServer) registerMetrics(r *metricsRegistry) {
+	r.gauge("kv_live_keys", "Keys with a live value.", s.locked(func() float64 { return float64(s.liveKeys) }))
+	r.gauge("kv_tombstones", "Deleted keys retained as tombstones.", s.locked(func() float64 { return float64(s.tombstones) }))
+	r.counter("kv_tombstones_purged_total", "Tombstones removed by tombstone GC.", s.locked(func() float64 { return float64(s.tombstonesPurged) }))
+	r.gauge("kv_gc_horizon", "Highest log index every replica is known to have stored.", s.locked(func() float64 { return float64(s.gcHorizonLocked()) }))
+	r.gauge("kv_commit_index", "Raft commit index.", s.locked(func() float64 { return float64(s.commitIndex) }))
+	r.gauge("kv_last_applied", "Highest log index applied to the key space.", s.locked(func() float64 { return float64(s.lastApplied) }))
+	r.gauge("kv_snapshot_index", "Log index covered by the latest snapshot.", s.locked(func() float64 { return float64(s.snapshotIndex) }))
+	r.gauge("kv_raft_log_entries", "Raft log entries not yet compacted.", s.locked(func() float64 { return float64(len(s.logEntries)) }))
+	r.gauge("kv_compaction_queue_depth", "Compaction jobs waiting to run.", func() float64 { return float64(s.compactor.queueDepth()) })
+	r.gauge("kv_compaction_running", "1 while a compaction job is running.", func() float64 {
+		if s.compactor.isRunning() {
+			return 1
+		}
+		return 0
+	})
+	r.counter("kv_compactions_total", "Compaction jobs that finished successfully.", func() float64 { return float64(s.compactor.completed.Load()) })
+	r.counter("kv_compaction_failures_total", "Compaction jobs that failed.", func() float64 { return float64(s.compactor.failed.Load()) })
+	r.counter("kv_compaction_deferrals_total", "Times compaction paused because the server was busy.", func() float64 { return float64(s.compactor.deferrals.Load()) })
+	r.counter("kv_compaction_bytes_written_total", "Bytes written by compaction jobs.", func() float64 { return float64(s.compactionBytes.Load()) })
+	r.counter("kv_checksum_failures_total", "Reads that found a value not matching its stored checksum.", func() float64 { return float64(s.checksumFailures.Load()) })
+	r.gauge("kv_inflight_requests", "Client RPCs currently being served.", func() float64 { return float64(s.load.inflight.Load()) })
+	r.gauge("kv_scheduled_deletes_pending", "Live keys with a scheduled deletion.", s.locked(func() float64 { return float64(s.deadlines.Len()) }))
+	r.counter("kv_scheduled_deletes_total", "Scheduled deletions carried out.", s.locked(func() float64 { return float64(s.scheduledDeletes) }))
+	r.gauge("kv_is_leader", "1 if this replica is the partition leader.", s.locked(func() float64 {
+		if s.role == roleLeader {
+			return 1
+		}
+		return 0
+	}))
+	s.registerReplicationMetrics(r)
+	s.registerReadMetrics(r)
+	if s.admission != nil {
+		s.admission.registerMetrics(r)
+	}
+	if s.scanCache != nil {
+		s.registerScanCacheMetrics(r)
+	}
+	if s.cacheLeases != nil {
+		s.registerCacheLeaseMetrics(r)
+	}
+	if s.scanSnapshots != nil {
+		s.registerScanSnapshotMetrics(r)
+	}
+	if s.backing != nil {
+		s.registerBackingMetrics(r)
+	}
+	if s.tier != nil {
+		s.registerTierMetrics(r)
+	}
+	if s.scrub != nil {
+		s.scrub.registerMetrics(r)
+	}
+	if s.keyPrefixes != nil {
+		s.registerKeyPrefixMetrics(r)
+	}
+	if s.oidc != nil {
+		s.oidc.registerMetrics(r)
+	}
+	if len(s.feeds) > 0 {
+		s.registerCDCMetrics(r)
+	}
+	s.registerMirrorMetrics(r)
+	s.registerWatchMetrics(r)
+	s.registerMeteringMetrics(r)
+	if s.clusterID != "" {
+		s.registerConflictMetrics(r)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestResolveAdminAddr(t *testing.T) {
+	for _, tc := range []struct{ api, reported, want string }{
+		{"10.0.0.5:3777", "", "10.0.0.5:3777"},
+		{"10.0.0.5:3777", "0.0.0.0:4777", "10.0.0.5:4777"},
+		{"10.0.0.5:3777", "[::]:4777", "10.0.0.5:4777"},
+		{"10.0.0.5:3777", ":4777", "10.0.0.5:4777"},
+		{"10.0.0.5:3777", "192.168.1.5:4777", "192.168.1.5:4777"},
+	} {
+		if got := resolveAdminAddr(tc.api, tc.reported); got != tc.want {
+			t.Errorf("resolveAdminAddr(%q, %q) = %q, want %q", tc.api, tc.reported, got, tc.want)
+		}
+	}
+}
+
+func TestAdminAuthGuardsOnlyAdminMethods(t *testing.T) {
+	auth := adminAuth("s3cret")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	call := func(method, token string) error {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer app-token", "authorization", "Bearer "+token))
+		}
+		_, err := auth.unaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	stats := "/" + kvpb.Admin_ServiceDesc.ServiceName + "/Stats"
+	get := "/" + kvpb.KVS_ServiceDesc.ServiceName + "/Get"
+
+	if err := call(stats, ""); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Admin call without a token: err = %v, want Unauthenticated", err)
+	}
+	if err := call(stats, "wrong"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Admin call with the wrong token: err = %v, want Unauthenticated", err)
+	}
+	if err := call(stats, "s3cret"); err != nil {
+		t.Fatalf("Admin call with the token failed: %v", err)
+	}
+	if err := call(get, ""); err != nil {
+		t.Fatalf("KVS call without the admin token failed: %v", err)
+	}
+	if err := adminAuth("").check(context.Background()); err != nil {
+		t.Fatalf("no admin token configured: err = %v, want every call admitted", err)
+	}
+}
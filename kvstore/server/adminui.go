@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	adminUIPageSize     = 200
+	adminUIRecentLimit  = 100
+	adminUIValuePreview = 120
+)
+
+// adminUI serves a small HTML console for one replica. It reads this
+// replica's own state, so a follower's view may trail the leader's. Every
+// request must carry the token as a bearer token or as the HTTP basic auth
+// password.
+type adminUI struct {
+	kv    *kvServer
+	token string
+}
+
+func newAdminUI(kv *kvServer, token string, metrics *metricsRegistry) http.Handler {
+	ui := &adminUI{kv: kv, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", ui.overview)
+	mux.HandleFunc("GET /keys", ui.keys)
+	mux.HandleFunc("GET /scan", ui.scan)
+	mux.HandleFunc("GET /recent", ui.recent)
+	mux.HandleFunc("POST /snapshot", ui.snapshot)
+	mux.Handle("GET /metrics", metrics)
+	return ui.authenticate(mux)
+}
+
+// serveAdminUI serves the admin console on addr.
+func serveAdminUI(addr string, kv *kvServer, token string, metrics *metricsRegistry) error {
+	return http.ListenAndServe(addr, newAdminUI(kv, token, metrics))
+}
+
+func (ui *adminUI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, got, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(ui.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvstore admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type uiRow struct {
+	Key, Value, Link string
+}
+
+type uiPage struct {
+	Title   string
+	Role    string
+	Part    int
+	Replica int
+	Message string
+	Stats   *kvpb.StatsReply
+
+	Prefix, Start, End, Next string
+	Rows                     []uiRow
+	Recent                   []uiRecent
+}
+
+type uiRecent struct {
+	Index uint64
+	Time  string
+	Op    string
+	Key   string
+	Value string
+}
+
+func preview(v string) string {
+	if len(v) <= adminUIValuePreview {
+		return v
+	}
+	return v[:adminUIValuePreview] + "…"
+}
+
+func (ui *adminUI) page(title string) uiPage {
+	s := ui.kv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uiPage{Title: title, Role: s.role, Part: s.partitionID, Replica: s.replicaID}
+}
+
+func (ui *adminUI) render(w http.ResponseWriter, p uiPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminUITemplate.Execute(w, p); err != nil {
+		log.Printf("admin ui render failed: %v", err)
+	}
+}
+
+func (ui *adminUI) overview(w http.ResponseWriter, r *http.Request) {
+	p := ui.page("Overview")
+	p.Message = r.URL.Query().Get("msg")
+	p.Stats, _ = (&adminServer{kv: ui.kv}).Stats(r.Context(), &kvpb.StatsRequest{})
+	ui.render(w, p)
+}
+
+func (ui *adminUI) keys(w http.ResponseWriter, r *http.Request) {
+	p := ui.page("Keys")
+	p.Prefix = r.URL.Query().Get("prefix")
+	s := ui.kv
+	s.mu.Lock()
+	reply, err := s.listDirLocked(p.Prefix, "/", r.URL.Query().Get("after"), adminUIPageSize)
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, cp := range reply.CommonPrefixes {
+		p.Rows = append(p.Rows, uiRow{Key: cp, Link: "/keys?prefix=" + template.URLQueryEscaper(cp)})
+	}
+	for _, e := range reply.Entries {
+		p.Rows = append(p.Rows, uiRow{Key: e.Key, Value: preview(e.Value)})
+	}
+	if reply.Truncated {
+		// Rows holds prefixes then entries, so find the greatest name.
+		for _, row := range p.Rows {
+			if row.Key > p.Next {
+				p.Next = row.Key
+			}
+		}
+	}
+	ui.render(w, p)
+}
+
+func (ui *adminUI) scan(w http.ResponseWriter, r *http.Request) {
+	p := ui.page("Scan")
+	p.Start, p.End = r.URL.Query().Get("start"), r.URL.Query().Get("end")
+	if p.Start != "" || p.End != "" {
+		s := ui.kv
+		s.mu.Lock()
+		s.tree.AscendGreaterOrEqual(item{key: p.Start}, func(it item) bool {
+			key := it.fullKey()
+			if (p.End != "" && key > p.End) || len(p.Rows) == adminUIPageSize {
+				return false
+			}
+			if !it.tombstone {
+				p.Rows = append(p.Rows, uiRow{Key: key, Value: preview(it.value)})
+			}
+			return true
+		})
+		s.mu.Unlock()
+		if len(p.Rows) == adminUIPageSize {
+			p.Message = "showing the first 200 keys"
+		}
+	}
+	ui.render(w, p)
+}
+
+func (ui *adminUI) recent(w http.ResponseWriter, r *http.Request) {
+	p := ui.page("Recent mutations")
+	s := ui.kv
+	s.mu.Lock()
+	for idx := s.lastApplied; idx > s.logBase && len(p.Recent) < adminUIRecentLimit; idx-- {
+		wal := s.entryLocked(idx).GetCommand().GetWal()
+		if wal == nil || wal.Op == kvpb.WALCommand_OP_UNSPECIFIED {
+			continue
+		}
+		rec := uiRecent{Index: idx, Op: strings.TrimPrefix(wal.Op.String(), "OP_"), Key: wal.Key, Value: preview(wal.Value)}
+		if wal.UnixNanos != 0 {
+			rec.Time = time.Unix(0, wal.UnixNanos).UTC().Format("2006-01-02 15:04:05.000")
+		}
+		if n := len(wal.Ingest); n > 0 {
+			rec.Value = fmt.Sprintf("%d pairs", n)
+		}
+		p.Recent = append(p.Recent, rec)
+	}
+	s.mu.Unlock()
+	ui.render(w, p)
+}
+
+func (ui *adminUI) snapshot(w http.ResponseWriter, r *http.Request) {
+	msg := "snapshot queued"
+	if !ui.kv.compactor.enqueue(compactionJobSnapshot) {
+		msg = "a snapshot is already queued"
+	}
+	http.Redirect(w, r, "/?msg="+template.URLQueryEscaper(msg), http.StatusSeeOther)
+}
+
+var adminUITemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}} · kvstore p{{.Part}}/r{{.Replica}}</title>
+<style>
+body{font:14px sans-serif;margin:1.5em;color:#222}
+nav a{margin-right:1em}
+table{border-collapse:collapse;margin-top:1em}
+td,th{border-bottom:1px solid #ddd;padding:3px 10px;text-align:left;font-family:monospace}
+.msg{background:#eef;padding:4px 8px}
+</style></head><body>
+<nav><b>kvstore</b> partition {{.Part}} replica {{.Replica}} ({{.Role}}) ·
+<a href="/">overview</a><a href="/keys">keys</a><a href="/scan">scan</a><a href="/recent">recent</a><a href="/metrics">metrics</a></nav>
+<h2>{{.Title}}</h2>
+{{with .Message}}<p class="msg">{{.}}</p>{{end}}
+{{with .Stats}}
+<table>
+<tr><th>commit index</th><td>{{.CommitIndex}}</td></tr>
+<tr><th>last applied</th><td>{{.LastApplied}}</td></tr>
+<tr><th>live keys</th><td>{{.LiveKeys}}</td></tr>
+<tr><th>tombstones</th><td>{{.Tombstones}}</td></tr>
+<tr><th>snapshot index</th><td>{{.SnapshotIndex}}</td></tr>
+<tr><th>log start</th><td>{{.LogStart}}</td></tr>
+<tr><th>gc horizon</th><td>{{.GcHorizon}}</td></tr>
+<tr><th>compaction queue</th><td>{{.CompactionQueueDepth}}</td></tr>
+</table>
+<form method="post" action="/snapshot"><p><button>Take snapshot now</button></p></form>
+{{end}}
+{{if eq .Title "Keys"}}
+<form><input name="prefix" value="{{.Prefix}}" placeholder="prefix" size="40"> <button>List</button></form>
+{{end}}
+{{if eq .Title "Scan"}}
+<form><input name="start" value="{{.Start}}" placeholder="start key"> <input name="end" value="{{.End}}" placeholder="end key"> <button>Scan</button></form>
+{{end}}
+{{if .Rows}}
+<table><tr><th>key</th><th>value</th></tr>
+{{range .Rows}}<tr><td>{{if .Link}}<a href="{{.Link}}">{{.Key}}</a>{{else}}{{.Key}}{{end}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Next}}<p><a href="/keys?prefix={{$.Prefix}}&after={{.}}">next page</a></p>{{end}}
+{{if .Recent}}
+<table><tr><th>index</th><th>time (UTC)</th><th>op</th><th>key</th><th>value</th></tr>
+{{range .Recent}}<tr><td>{{.Index}}</td><td>{{.Time}}</td><td>{{.Op}}</td><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}
+</body></html>
+`))
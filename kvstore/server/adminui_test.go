@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestAdminUIRequiresTokenAndListsKeys(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-1"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "users/<alice>", Value: "v1"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	metrics := newMetricsRegistry(nil)
+	srv.registerMetrics(metrics)
+	ui := httptest.NewServer(newAdminUI(srv, "s3cret", metrics))
+	defer ui.Close()
+
+	get := func(path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ui.URL+path, nil)
+		if token != "" {
+			req.SetBasicAuth("admin", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", path, err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	if code, _ := get("/", ""); code != http.StatusUnauthorized {
+		t.Fatalf("GET / without a token = %d, want 401", code)
+	}
+	if code, _ := get("/", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("GET / with a wrong token = %d, want 401", code)
+	}
+	if code, body := get("/keys", "s3cret"); code != http.StatusOK || !strings.Contains(body, "users/") {
+		t.Fatalf("GET /keys = %d %q, want the users/ prefix", code, body)
+	}
+	code, body := get("/keys?prefix=users/", "s3cret")
+	if code != http.StatusOK || !strings.Contains(body, "users/&lt;alice&gt;") {
+		t.Fatalf("GET /keys?prefix=users/ = %d %q, want the escaped key", code, body)
+	}
+	if code, body := get("/recent", "s3cret"); code != http.StatusOK || !strings.Contains(body, "PUT") {
+		t.Fatalf("GET /recent = %d %q, want the PUT", code, body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// priorityMetadataKey carries a request's priority class. Requests without
+// it are normal priority.
+const priorityMetadataKey = "x-priority"
+
+type priority int
+
+const (
+	priorityBulk priority = iota
+	priorityNormal
+	priorityHigh
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"bulk", "normal", "high"}
+
+func (p priority) String() string { return priorityNames[p] }
+
+func priorityFromContext(ctx context.Context) priority {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return priorityNormal
+	}
+	values := md.Get(priorityMetadataKey)
+	if len(values) == 0 {
+		return priorityNormal
+	}
+	switch strings.ToLower(strings.TrimSpace(values[0])) {
+	case "high":
+		return priorityHigh
+	case "bulk", "low", "backfill":
+		return priorityBulk
+	default:
+		return priorityNormal
+	}
+}
+
+// admissionController caps concurrent data-plane requests. Once the cap is
+// reached, requests queue per priority class and a freed slot always goes to
+// the highest class waiting, so bulk traffic cannot delay foreground
+// requests. A request that waits longer than maxWait is rejected with
+// ResourceExhausted. A nil *admissionController admits everything.
+type admissionController struct {
+	mu       sync.Mutex
+	limit    int
+	inflight int
+	maxWait  time.Duration
+	waiters  [numPriorities][]chan struct{}
+	rejected [numPriorities]uint64
+}
+
+func newAdmissionController(limit int, maxWait time.Duration) *admissionController {
+	if limit <= 0 {
+		return nil
+	}
+	return &admissionController{limit: limit, maxWait: maxWait}
+}
+
+func (a *admissionController) acquire(ctx context.Context, p priority) error {
+	a.mu.Lock()
+	if a.inflight < a.limit && a.queuedAtOrAboveLocked(p) == 0 {
+		a.inflight++
+		a.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	a.waiters[p] = append(a.waiters[p], ready)
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		err = retryableError(codes.ResourceExhausted, a.maxWait, "server saturated: %s request waited %s for admission", p, a.maxWait)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, ch := range a.waiters[p] {
+		if ch == ready {
+			a.waiters[p] = append(a.waiters[p][:i], a.waiters[p][i+1:]...)
+			a.rejected[p]++
+			return err
+		}
+	}
+	// release handed us a slot just as we gave up; pass it on.
+	a.releaseLocked()
+	a.rejected[p]++
+	return err
+}
+
+func (a *admissionController) queuedAtOrAboveLocked(p priority) int {
+	n := 0
+	for q := p; q < numPriorities; q++ {
+		n += len(a.waiters[q])
+	}
+	return n
+}
+
+func (a *admissionController) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked()
+}
+
+// releaseLocked frees a slot, handing it straight to the oldest waiter of
+// the highest priority class.
+func (a *admissionController) releaseLocked() {
+	for p := numPriorities - 1; p >= 0; p-- {
+		if len(a.waiters[p]) > 0 {
+			ready := a.waiters[p][0]
+			a.waiters[p] = a.waiters[p][1:]
+			close(ready)
+			return
+		}
+	}
+	a.inflight--
+}
+
+// snapshot returns in-flight requests, queue lengths and rejections.
+func (a *admissionController) snapshot() (int, [numPriorities]int, [numPriorities]uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var queued [numPriorities]int
+	for p := range a.waiters {
+		queued[p] = len(a.waiters[p])
+	}
+	return a.inflight, queued, a.rejected
+}
+
+// unaryInterceptor applies admission to KVS data requests only; admin,
+// health and raft traffic is never queued.
+func (a *admissionController) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	if err := a.acquire(ctx, priorityFromContext(ctx)); err != nil {
+		return nil, err
+	}
+	defer a.release()
+	return handler(ctx, req)
+}
+
+func (a *admissionController) registerMetrics(r *metricsRegistry) {
+	r.gauge("kv_admission_inflight", "Data-plane requests holding an admission slot.", func() float64 {
+		inflight, _, _ := a.snapshot()
+		return float64(inflight)
+	})
+	r.register("kv_admission_queued", "Requests waiting for admission, by priority.", "gauge", func() []metricSample {
+		_, queued, _ := a.snapshot()
+		samples := make([]metricSample, 0, numPriorities)
+		for p := priority(0); p < numPriorities; p++ {
+			samples = append(samples, metricSample{labels: map[string]string{"priority": p.String()}, value: float64(queued[p])})
+		}
+		return samples
+	})
+	r.register("kv_admission_rejected_total", "Requests rejected after waiting too long for admission, by priority.", "counter", func() []metricSample {
+		_, _, rejected := a.snapshot()
+		samples := make([]metricSample, 0, numPriorities)
+		for p := priority(0); p < numPriorities; p++ {
+			samples = append(samples, metricSample{labels: map[string]string{"priority": p.String()}, value: float64(rejected[p])})
+		}
+		return samples
+	})
+}
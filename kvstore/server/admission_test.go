@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmissionPrefersHighPriorityWaiters(t *testing.T) {
+	a := newAdmissionController(1, 5*time.Second)
+	ctx := context.Background()
+	if err := a.acquire(ctx, priorityNormal); err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+
+	order := make(chan priority, 2)
+	waitQueued := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			_, queued, _ := a.snapshot()
+			if queued[priorityBulk]+queued[priorityHigh] == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d queued requests", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i, p := range []priority{priorityBulk, priorityHigh} {
+		go func(p priority) {
+			if err := a.acquire(ctx, p); err != nil {
+				t.Errorf("acquire(%s) failed: %v", p, err)
+				return
+			}
+			order <- p
+			a.release()
+		}(p)
+		waitQueued(i + 1)
+	}
+
+	a.release()
+	if first := <-order; first != priorityHigh {
+		t.Fatalf("first admitted = %s, want high", first)
+	}
+	if second := <-order; second != priorityBulk {
+		t.Fatalf("second admitted = %s, want bulk", second)
+	}
+}
+
+func TestAdmissionRejectsAfterMaxWait(t *testing.T) {
+	a := newAdmissionController(1, 20*time.Millisecond)
+	if err := a.acquire(context.Background(), priorityHigh); err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+	err := a.acquire(context.Background(), priorityBulk)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("saturated acquire err = %v, want ResourceExhausted", err)
+	}
+	a.release()
+	inflight, queued, rejected := a.snapshot()
+	if inflight != 0 || queued[priorityBulk] != 0 || rejected[priorityBulk] != 1 {
+		t.Fatalf("snapshot = inflight %d queued %v rejected %v, want 0, none, 1 bulk", inflight, queued, rejected)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Authorization: with --authz_policy, every KVS RPC is checked against a
+// policy file before it runs. Each line of the file is a rule
+//
+//	allow|deny <identity> <verbs> <key prefix>
+//
+// where identity is a glob over the caller's identity (see oidc.go; without
+// --oidc_issuer every caller's identity is empty, so only * matches), verbs
+// is a comma-separated list of read, write, delete and scan, or *, and a
+// key prefix of * covers every key. Blank lines and lines starting with #
+// are ignored. For example, to let team-a write only under a/ and never
+// Scan:
+//
+//	deny  team-a scan  *
+//	allow team-a write a/
+//	allow team-a read  *
+//
+// A request becomes one or more checks, each a verb over a key or key
+// range: a Get reads its key, a Rename reads and deletes its old key and
+// writes its new one, a Scan scans its range, and a Batch checks each op.
+// Each check is decided by the first rule whose identity and verb match
+// and whose prefix, for an allow, covers the whole range, or, for a deny,
+// touches any of it; a check no rule decides is denied, and so is a
+// request if any of its checks is. Discovery RPCs (GetServerInfo,
+// Capabilities, Ping) are not checked, nor is CacheInvalidations, which
+// only reports keys the caller was allowed to Get: holders are scoped to
+// the caller's identity (see cachelease.go), so it cannot subscribe to
+// another's. Admin is guarded by --admin_token instead.
+
+// authzVerb is a set of verbs.
+type authzVerb uint8
+
+const (
+	verbRead authzVerb = 1 << iota
+	verbWrite
+	verbDelete
+	verbScan
+)
+
+var authzVerbNames = map[string]authzVerb{
+	"read":   verbRead,
+	"write":  verbWrite,
+	"delete": verbDelete,
+	"scan":   verbScan,
+	"*":      verbRead | verbWrite | verbDelete | verbScan,
+}
+
+func (v authzVerb) String() string {
+	for _, name := range []string{"read", "write", "delete", "scan"} {
+		if v == authzVerbNames[name] {
+			return name
+		}
+	}
+	return fmt.Sprintf("verbs(%d)", uint8(v))
+}
+
+// authzRule is one line of a policy file.
+type authzRule struct {
+	line     int
+	allow    bool
+	identity string
+	verbs    authzVerb
+	prefix   string
+}
+
+// authzPolicy is a parsed policy file. A nil *authzPolicy allows every
+// call.
+type authzPolicy struct {
+	rules []authzRule
+	// redact applies to the keys in denials.
+	redact redaction
+}
+
+func loadAuthzPolicy(file string, redact redaction) (*authzPolicy, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("open policy: %w", err)
+	}
+	defer f.Close()
+	p := &authzPolicy{redact: redact}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseAuthzRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		rule.line = n
+		p.rules = append(p.rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+	return p, nil
+}
+
+func parseAuthzRule(line string) (authzRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return authzRule{}, fmt.Errorf("want allow|deny <identity> <verbs> <key prefix>, got %d fields", len(fields))
+	}
+	var rule authzRule
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return authzRule{}, fmt.Errorf("unknown effect %q, want allow or deny", fields[0])
+	}
+	if _, err := path.Match(fields[1], ""); err != nil {
+		return authzRule{}, fmt.Errorf("bad identity pattern %q: %w", fields[1], err)
+	}
+	rule.identity = fields[1]
+	for _, name := range strings.Split(fields[2], ",") {
+		verb, ok := authzVerbNames[name]
+		if !ok {
+			return authzRule{}, fmt.Errorf("unknown verb %q, want read, write, delete, scan or *", name)
+		}
+		rule.verbs |= verb
+	}
+	if fields[3] != "*" {
+		rule.prefix = fields[3]
+	}
+	return rule, nil
+}
+
+// authzCheck is a verb over the keys in [lo, hi); hi "" is unbounded.
+type authzCheck struct {
+	verb   authzVerb
+	lo, hi string
+}
+
+func keyCheck(verb authzVerb, key string) authzCheck {
+	return authzCheck{verb: verb, lo: key, hi: key + "\x00"}
+}
+
+func prefixCheck(verb authzVerb, prefix string) authzCheck {
+	return authzCheck{verb: verb, lo: prefix, hi: prefixSuccessor(prefix)}
+}
+
+// inclusiveCheck covers [start, end], as Scan and RangeStats read.
+func inclusiveCheck(verb authzVerb, start, end string) authzCheck {
+	return authzCheck{verb: verb, lo: start, hi: end + "\x00"}
+}
+
+// describe names the keys c covers, redacted by redact.
+func (c authzCheck) describe(redact redaction) string {
+	switch {
+	case c.hi == c.lo+"\x00":
+		return fmt.Sprintf("key %q", redact.key(c.lo))
+	case c.hi == "":
+		return fmt.Sprintf("keys from %q", redact.key(c.lo))
+	case strings.HasSuffix(c.hi, "\x00"):
+		return fmt.Sprintf("keys %q through %q", redact.key(c.lo), redact.key(strings.TrimSuffix(c.hi, "\x00")))
+	}
+	return fmt.Sprintf("keys from %q up to %q", redact.key(c.lo), redact.key(c.hi))
+}
+
+// within reports whether every key in c starts with prefix.
+func (c authzCheck) within(prefix string) bool {
+	end := prefixSuccessor(prefix)
+	return c.lo >= prefix && (end == "" || (c.hi != "" && c.hi <= end))
+}
+
+// touches reports whether some key in c starts with prefix.
+func (c authzCheck) touches(prefix string) bool {
+	end := prefixSuccessor(prefix)
+	return (c.hi == "" || c.hi > prefix) && (end == "" || c.lo < end)
+}
+
+// authzChecks returns the checks req needs. ok is false for a request the
+// policy does not know, which is refused.
+func authzChecks(req interface{}) (checks []authzCheck, ok bool) {
+	switch r := req.(type) {
+	case *kvpb.GetRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key)}, true
+	case *kvpb.JSONGetRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key)}, true
+	case *kvpb.GetMetaRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key)}, true
+	case *kvpb.TTLRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key)}, true
+	case *kvpb.PutRequest:
+		return []authzCheck{keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.MergeRequest:
+		return []authzCheck{keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.JSONSetRequest:
+		return []authzCheck{keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.PersistRequest:
+		return []authzCheck{keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.UndeleteRequest:
+		return []authzCheck{keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.SwapRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key), keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.GetOrPutRequest:
+		return []authzCheck{keyCheck(verbRead, r.Key), keyCheck(verbWrite, r.Key)}, true
+	case *kvpb.DeleteRequest:
+		return []authzCheck{keyCheck(verbDelete, r.Key)}, true
+	case *kvpb.DeleteAtRequest:
+		return []authzCheck{keyCheck(verbDelete, r.Key)}, true
+	case *kvpb.ExpireRequest:
+		return []authzCheck{keyCheck(verbDelete, r.Key)}, true
+	case *kvpb.RenameRequest:
+		return []authzCheck{keyCheck(verbRead, r.OldKey), keyCheck(verbDelete, r.OldKey), keyCheck(verbWrite, r.NewKey)}, true
+	case *kvpb.BatchRequest:
+		for _, op := range r.Ops {
+			switch strings.ToUpper(op.Op) {
+			case "GET":
+				checks = append(checks, keyCheck(verbRead, op.Key))
+			case "DELETE":
+				checks = append(checks, keyCheck(verbDelete, op.Key))
+			case "SWAP":
+				checks = append(checks, keyCheck(verbRead, op.Key), keyCheck(verbWrite, op.Key))
+			default:
+				checks = append(checks, keyCheck(verbWrite, op.Key))
+			}
+		}
+		return checks, true
+	case *kvpb.CopyRangeRequest:
+		return []authzCheck{inclusiveCheck(verbScan, r.StartKey, r.EndKey), inclusiveCheck(verbWrite, r.DstPrefix+r.StartKey, r.DstPrefix+r.EndKey)}, true
+	case *kvpb.IngestBatch:
+		for _, pair := range r.Pairs {
+			checks = append(checks, keyCheck(verbWrite, pair.Key))
+		}
+		return checks, true
+	case *kvpb.WatchRequest:
+		return []authzCheck{prefixCheck(verbRead, r.Prefix)}, true
+	case *kvpb.ScanRequest:
+		return []authzCheck{inclusiveCheck(verbScan, r.StartKey, r.EndKey)}, true
+	case *kvpb.RangeStatsRequest:
+		return []authzCheck{inclusiveCheck(verbScan, r.StartKey, r.EndKey)}, true
+	case *kvpb.IterateRequest:
+		return []authzCheck{prefixCheck(verbScan, r.Prefix)}, true
+	case *kvpb.ListDirRequest:
+		return []authzCheck{prefixCheck(verbScan, r.Prefix)}, true
+	case *kvpb.ScanExpiringRequest, *kvpb.RandomKeyRequest, *kvpb.SampleKeysRequest, *kvpb.QueryRequest:
+		return []authzCheck{prefixCheck(verbScan, "")}, true
+	case *kvpb.GetServerInfoRequest, *kvpb.CapabilitiesRequest, *kvpb.EchoRequest, *kvpb.CacheInvalidationsRequest:
+		return nil, true
+	}
+	return nil, false
+}
+
+// decide returns the rule that decides c for identity, or nil if none does.
+func (p *authzPolicy) decide(identity string, c authzCheck) *authzRule {
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.verbs&c.verb == 0 {
+			continue
+		}
+		if ok, _ := path.Match(rule.identity, identity); !ok {
+			continue
+		}
+		if (rule.allow && c.within(rule.prefix)) || (!rule.allow && c.touches(rule.prefix)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// authorize fails with PermissionDenied unless the policy allows every
+// check req needs.
+func (p *authzPolicy) authorize(ctx context.Context, req interface{}) error {
+	identity := identityFromContext(ctx)
+	checks, ok := authzChecks(req)
+	if !ok {
+		return reasonError(codes.PermissionDenied, reasonPolicyDenied, map[string]string{"identity": identity},
+			"%T is not covered by the authorization policy", req)
+	}
+	for _, c := range checks {
+		rule := p.decide(identity, c)
+		if rule != nil && rule.allow {
+			continue
+		}
+		why := "no rule allows it"
+		if rule != nil {
+			why = fmt.Sprintf("denied by policy line %d", rule.line)
+		}
+		return reasonError(codes.PermissionDenied, reasonPolicyDenied, map[string]string{"identity": identity, "verb": c.verb.String(), "key": p.redact.key(c.lo)},
+			"%q may not %s %s: %s", identity, c.verb, c.describe(p.redact), why)
+	}
+	return nil
+}
+
+func (p *authzPolicy) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if p == nil || !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	if err := p.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor checks every message a KVS stream receives, which is a
+// Watch's request or each batch of an Ingest.
+func (p *authzPolicy) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if p == nil || !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(srv, ss)
+	}
+	return handler(srv, &authzStream{ServerStream: ss, policy: p})
+}
+
+type authzStream struct {
+	grpc.ServerStream
+	policy *authzPolicy
+}
+
+func (s *authzStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.policy.authorize(s.Context(), m)
+}
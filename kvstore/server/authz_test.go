@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestAuthzPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(file, []byte(`# team-a may write only a/ and may never scan
+deny  team-a        scan       *
+allow team-a        write      a/
+allow team-a        read       *
+deny  *             *          secret/
+allow *@example.com read,scan  *
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadAuthzPolicy(file, redaction{})
+	if err != nil {
+		t.Fatalf("loadAuthzPolicy: %v", err)
+	}
+	as := func(identity string) context.Context {
+		return context.WithValue(context.Background(), identityKey{}, identity)
+	}
+	for _, tc := range []struct {
+		identity string
+		req      interface{}
+		allowed  bool
+	}{
+		{"team-a", &kvpb.PutRequest{Key: "a/x"}, true},
+		{"team-a", &kvpb.PutRequest{Key: "b/x"}, false},
+		{"team-a", &kvpb.DeleteRequest{Key: "a/x"}, false},
+		{"team-a", &kvpb.GetRequest{Key: "b/x"}, true},
+		{"team-a", &kvpb.ScanRequest{StartKey: "a/", EndKey: "a/z"}, false},
+		{"team-a", &kvpb.BatchRequest{Ops: []*kvpb.BatchOp{{Op: "put", Key: "a/1"}, {Op: "get", Key: "b/1"}}}, true},
+		{"team-a", &kvpb.BatchRequest{Ops: []*kvpb.BatchOp{{Op: "put", Key: "a/1"}, {Op: "put", Key: "b/1"}}}, false},
+		{"team-a", &kvpb.RenameRequest{OldKey: "a/1", NewKey: "a/2"}, false},
+		{"team-a", &kvpb.IngestBatch{Pairs: []*kvpb.KVPair{{Key: "a/1"}, {Key: "b/1"}}}, false},
+		{"team-a", &kvpb.EchoRequest{}, true},
+		{"ann@example.com", &kvpb.ScanRequest{StartKey: "a", EndKey: "b"}, true},
+		{"ann@example.com", &kvpb.ScanRequest{StartKey: "a", EndKey: "t"}, false},
+		{"ann@example.com", &kvpb.GetRequest{Key: "secret/k"}, false},
+		{"ann@example.com", &kvpb.IterateRequest{Prefix: "a/"}, true},
+		{"ann@example.com", &kvpb.PutRequest{Key: "a/x"}, false},
+		{"", &kvpb.GetRequest{Key: "a/x"}, false},
+	} {
+		err := p.authorize(as(tc.identity), tc.req)
+		if tc.allowed && err != nil {
+			t.Errorf("%s %T %v: %v, want allowed", tc.identity, tc.req, tc.req, err)
+		}
+		if !tc.allowed && (status.Code(err) != codes.PermissionDenied || errorReason(err) != reasonPolicyDenied) {
+			t.Errorf("%s %T %v: err = %v, want PermissionDenied", tc.identity, tc.req, tc.req, err)
+		}
+	}
+
+	for _, bad := range []string{"allow team-a read", "permit team-a read *", "allow team-a list *", "allow [ read *"} {
+		if _, err := parseAuthzRule(bad); err == nil {
+			t.Errorf("parseAuthzRule(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestAuthzCoversEveryKVSMethod(t *testing.T) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(kvpb.KVS_ServiceDesc.ServiceName))
+	if err != nil {
+		t.Fatalf("find KVS service: %v", err)
+	}
+	methods := desc.(protoreflect.ServiceDescriptor).Methods()
+	for i := 0; i < methods.Len(); i++ {
+		m := methods.Get(i)
+		typ, err := protoregistry.GlobalTypes.FindMessageByName(m.Input().FullName())
+		if err != nil {
+			t.Fatalf("find %s: %v", m.Input().FullName(), err)
+		}
+		if _, ok := authzChecks(typ.New().Interface()); !ok {
+			t.Errorf("KVS.%s takes %s, which the authorization policy does not cover", m.Name(), m.Input().Name())
+		}
+	}
+}
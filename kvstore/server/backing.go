@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// BackingStore is a slower system of record the server caches. Gets that
+// miss load from it, and committed writes reach it through the "backing"
+// change feed (write-behind), so Store and Delete may see a change more
+// than once and must be idempotent.
+//
+// Expiry is treated as cache eviction: scheduled and TTL deletions never
+// reach the store.
+type BackingStore interface {
+	Load(ctx context.Context, key string) (value string, found bool, err error)
+	Store(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+const (
+	// backingFeedName names the change feed that writes behind to the store.
+	backingFeedName = "backing"
+	// backingLoadTimeout bounds one read-through load and fill.
+	backingLoadTimeout = 5 * time.Second
+)
+
+// openBackingStore builds the store described by spec. The only kind
+// today is sqlite:<path>, a table kv(key, value) in a SQLite database.
+func openBackingStore(spec string) (BackingStore, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("backing store %q: want kind:target", spec)
+	}
+	switch kind {
+	case "sqlite":
+		db, err := sql.Open("sqlite", target)
+		if err != nil {
+			return nil, fmt.Errorf("open backing store: %w", err)
+		}
+		if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS kv (key TEXT PRIMARY KEY, value BLOB NOT NULL)`); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("initialize backing store: %w", err)
+		}
+		return &sqlBackingStore{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown backing store kind %q", kind)
+	}
+}
+
+// sqlBackingStore keeps keys in the kv table of a SQL database.
+type sqlBackingStore struct {
+	db *sql.DB
+}
+
+func (b *sqlBackingStore) Load(ctx context.Context, key string) (string, bool, error) {
+	var value []byte
+	err := b.db.QueryRowContext(ctx, `SELECT value FROM kv WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (b *sqlBackingStore) Store(ctx context.Context, key, value string) error {
+	_, err := b.db.ExecContext(ctx, `INSERT INTO kv(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, []byte(value))
+	return err
+}
+
+func (b *sqlBackingStore) Delete(ctx context.Context, key string) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM kv WHERE key = ?`, key)
+	return err
+}
+
+func (b *sqlBackingStore) Close() error { return b.db.Close() }
+
+// backingSink is the ChangeSink that writes changes behind to a store.
+type backingSink struct {
+	store  BackingStore
+	redact redaction
+}
+
+func (b *backingSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	for _, ev := range events {
+		var err error
+		switch ev.Op {
+		case "PUT", "SWAP", "INGEST", "UNDELETE", "GET_OR_PUT":
+			err = b.store.Store(ctx, ev.Key, ev.Value)
+		case "DELETE":
+			err = b.store.Delete(ctx, ev.Key)
+		case "RENAME":
+			if err = b.store.Store(ctx, ev.NewKey, ev.Value); err == nil {
+				err = b.store.Delete(ctx, ev.Key)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("backing store %s %q: %w", ev.Op, b.redact.key(ev.Key), err)
+		}
+	}
+	return nil
+}
+
+func (b *backingSink) Close() error { return b.store.Close() }
+
+// readThrough loads key from the backing store after a cache miss and
+// fills the cache with it through the raft log. The fill loses to any write
+// that reaches the log first, so the reply is read back from the tree.
+func (s *kvServer) readThrough(ctx context.Context, key string) (*kvpb.GetReply, error) {
+	found, shared, err := s.loads.do(key, func() (bool, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), backingLoadTimeout)
+		defer cancel()
+		s.backingLoads.Add(1)
+		value, found, err := s.backing.Load(loadCtx, key)
+		if err != nil || !found {
+			return false, err
+		}
+		s.tier.promoted()
+		_, err = s.submitCommand(loadCtx, &kvpb.ClientCommand{
+			Wal: &kvpb.WALCommand{Op: kvpb.WALCommand_OP_FILL, Key: key, Value: value},
+		})
+		return true, err
+	})
+	if shared {
+		s.backingLoadsShared.Add(1)
+	}
+	if err != nil {
+		s.backingErrors.Add(1)
+		if st, ok := status.FromError(err); ok {
+			return nil, st.Err()
+		}
+		return nil, status.Errorf(codes.Unavailable, "read through %q: %v", s.redact.key(key), err)
+	}
+	if !found {
+		return &kvpb.GetReply{Found: false}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.getLiveLocked(key)
+	return &kvpb.GetReply{Found: ok, Value: it.value}, nil
+}
+
+// loadBeforeWrite reads key through before a write that depends on its
+// value, such as a Swap, Delete, Rename or DeleteAt, so the reply reflects
+// a value held only by the backing store and the write applies to it. Puts
+// skip this; their found flag only covers cached keys. Reads that answer
+// from the tree themselves, like JSONGet and GetMeta, call it too.
+func (s *kvServer) loadBeforeWrite(ctx context.Context, key string) error {
+	if s.backing == nil {
+		return nil
+	}
+	s.mu.Lock()
+	miss := s.role == roleLeader && !s.tree.Has(item{key: key})
+	s.mu.Unlock()
+	if !miss {
+		return nil
+	}
+	_, err := s.readThrough(ctx, key)
+	return err
+}
+
+// backingHorizonLocked caps tombstone GC at what the write-behind feed has
+// shipped: until the store has seen a delete, the tombstone is what keeps
+// reads from loading the old value back.
+func (s *kvServer) backingHorizonLocked(horizon uint64) uint64 {
+	for _, f := range s.feeds {
+		if f.name == backingFeedName {
+			horizon = min(horizon, f.shipped)
+		}
+	}
+	return horizon
+}
+
+func (s *kvServer) registerBackingMetrics(r *metricsRegistry) {
+	r.counter("kv_backing_loads_total", "Cache misses loaded from the backing store.", func() float64 { return float64(s.backingLoads.Load()) })
+	r.counter("kv_backing_loads_shared_total", "Gets that waited on another caller's load of the same key instead of loading it again.", func() float64 { return float64(s.backingLoadsShared.Load()) })
+	r.counter("kv_backing_load_errors_total", "Read-through loads that failed.", func() float64 { return float64(s.backingErrors.Load()) })
+}
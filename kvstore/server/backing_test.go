@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+type mapStore struct {
+	mu    sync.Mutex
+	data  map[string]string
+	loads int
+	delay time.Duration
+}
+
+func (m *mapStore) Load(ctx context.Context, key string) (string, bool, error) {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads++
+	v, ok := m.data[key]
+	return v, ok, nil
+}
+
+func (m *mapStore) Store(ctx context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+func (m *mapStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func (m *mapStore) Close() error { return nil }
+
+func TestBackingStoreReadsThroughAndWritesBehind(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	store := &mapStore{data: map[string]string{"cold": "from-store", "gone": "old"}, delay: 20 * time.Millisecond}
+	srv.backing = store
+	feed, err := srv.addChangeFeed(backingFeedName, &backingSink{store: store}, 100, 0)
+	if err != nil {
+		t.Fatalf("addChangeFeed() failed: %v", err)
+	}
+	becomeTestLeader(t, srv, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "cold"})
+			if err != nil || !got.Found || got.Value != "from-store" {
+				t.Errorf("Get(cold) = %+v, %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "cold"}); err != nil {
+		t.Fatalf("cached Get failed: %v", err)
+	}
+	if got, _ := srv.Get(context.Background(), &kvpb.GetRequest{Key: "absent"}); got.Found {
+		t.Fatalf("Get(absent) found %q", got.Value)
+	}
+	if store.loads != 2 {
+		t.Fatalf("backing store loads = %d, want 2 (one per missing key)", store.loads)
+	}
+
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	if _, err := srv.Put(call("p1"), &kvpb.PutRequest{Key: "new", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.Delete(call("d1"), &kvpb.DeleteRequest{Key: "gone"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if got, _ := srv.Get(context.Background(), &kvpb.GetRequest{Key: "gone"}); got.Found {
+		t.Fatalf("deleted key read through as %q", got.Value)
+	}
+	if _, err := srv.shipChanges(context.Background(), feed); err != nil {
+		t.Fatalf("shipChanges failed: %v", err)
+	}
+	want := map[string]string{"cold": "from-store", "new": "v"}
+	if len(store.data) != len(want) || store.data["cold"] != want["cold"] || store.data["new"] != want["new"] {
+		t.Fatalf("backing store = %v, want %v", store.data, want)
+	}
+}
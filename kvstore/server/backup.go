@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// backupDirName is the directory under backer_path that Backup writes to.
+const backupDirName = "backups"
+
+// Backup writes the replica's applied state to a new snapshot file under
+// backer_path. The file loads like snapshot.dat, so a replica restored from
+// it catches up on the rest from its leader.
+func (a *adminServer) Backup(ctx context.Context, req *kvpb.BackupRequest) (*kvpb.BackupReply, error) {
+	s := a.kv
+	if s.ephemeral() {
+		return nil, status.Error(codes.FailedPrecondition, "ephemeral servers keep nothing on disk to back up")
+	}
+	if req.Name != "" && (req.Name != filepath.Base(req.Name) || req.Name == "." || req.Name == "..") {
+		return nil, invalidFieldError("name", "%q is not a plain file name", req.Name)
+	}
+	s.mu.Lock()
+	st := s.snapshotStateLocked()
+	s.mu.Unlock()
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("backup-%d.dat", st.header.LastIndex)
+	}
+	dir := filepath.Join(s.backerDir, backupDirName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, status.Errorf(codes.Internal, "create backup directory: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return nil, status.Errorf(codes.AlreadyExists, "backup %s already exists", path)
+	}
+	written, err := writeSnapshotFile(path, st, func(w io.Writer) io.Writer { return w })
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "backup: %v", err)
+	}
+	s.logf("backup index=%d bytes=%d written to %s", st.header.LastIndex, written, path)
+	return &kvpb.BackupReply{Path: path, LastIndex: st.header.LastIndex, Bytes: uint64(written)}, nil
+}
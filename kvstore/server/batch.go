@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// A batch is a list of puts, swaps, deletes and gets logged as one
+// OP_BATCH entry, so every replica applies all of them, in order, with no
+// other write in between. Gets read the value the earlier operations left.
+// Its keys must share a partition. Readers of the log other than apply,
+// such as watchers and change feeds, see the batch's writes as separate
+// events with the entry's sequence number.
+
+// batchOps are the operations a batch may contain.
+var batchOps = map[string]kvpb.WALCommand_Op{
+	"PUT":    kvpb.WALCommand_OP_PUT,
+	"SWAP":   kvpb.WALCommand_OP_SWAP,
+	"DELETE": kvpb.WALCommand_OP_DELETE,
+	"GET":    kvpb.WALCommand_OP_GET,
+}
+
+// batchWrites returns the writes in an OP_BATCH, leaving out its gets.
+func batchWrites(wal *kvpb.WALCommand) []*kvpb.WALCommand {
+	writes := make([]*kvpb.WALCommand, 0, len(wal.Batch))
+	for _, sub := range wal.Batch {
+		if sub.Op != kvpb.WALCommand_OP_GET {
+			writes = append(writes, sub)
+		}
+	}
+	return writes
+}
+
+// stampBatchLocked gives each operation in a batch the entry's time and the
+// leader-filled fields it would get on its own.
+func (s *kvServer) stampBatchLocked(wal *kvpb.WALCommand) {
+	for _, sub := range wal.Batch {
+		sub.UnixNanos = wal.UnixNanos
+		s.stampSoftDeleteLocked(sub)
+	}
+}
+
+// applyBatchLocked applies an OP_BATCH, returning a result for each of its
+// operations.
+func (s *kvServer) applyBatchLocked(wal *kvpb.WALCommand, seq uint64) cachedMutation {
+	res := cachedMutation{op: wal.Op, key: wal.Key, found: true}
+	for _, sub := range wal.Batch {
+		if sub.Op == kvpb.WALCommand_OP_GET {
+			it, found := s.getLiveLocked(sub.Key)
+			res.batch = append(res.batch, cachedMutation{op: sub.Op, key: sub.Key, found: found, oldValue: it.value, hasOldValue: found})
+			continue
+		}
+		res.batch = append(res.batch, s.applyWALLocked(sub, seq))
+	}
+	return res
+}
+
+// validateCachedBatch checks a retried batch against the one first logged
+// under its request id.
+func validateCachedBatch(cached cachedMutation, wal *kvpb.WALCommand) error {
+	if len(cached.batch) != len(wal.Batch) {
+		return status.Errorf(codes.AlreadyExists, "request id reused with different operation")
+	}
+	for i, sub := range wal.Batch {
+		if err := validateCachedMutation(cached.batch[i], sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch applies req.Ops atomically and returns a result for each.
+func (s *kvServer) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchReply, error) {
+	if s.clusterID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "batch is not supported in a multi-writer cluster")
+	}
+	if len(req.Ops) == 0 {
+		return nil, invalidFieldError("ops", "a batch needs at least one operation")
+	}
+	wal := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_BATCH, Key: req.Ops[0].Key}
+	for i, op := range req.Ops {
+		walOp, ok := batchOps[strings.ToUpper(op.Op)]
+		if !ok {
+			return nil, invalidFieldError(fmt.Sprintf("ops[%d].op", i), "unknown batch operation %q (have PUT, SWAP, DELETE, GET)", op.Op)
+		}
+		if owner := ownerForKey(op.Key, s.numPartitions); owner != ownerForKey(wal.Key, s.numPartitions) {
+			return nil, invalidFieldError(fmt.Sprintf("ops[%d].key", i), "keys %q and %q are in different partitions; a batch must stay in one", s.redact.key(wal.Key), s.redact.key(op.Key))
+		}
+		sub := &kvpb.WALCommand{Op: walOp, Key: op.Key}
+		if walOp == kvpb.WALCommand_OP_PUT || walOp == kvpb.WALCommand_OP_SWAP {
+			sub.Value = op.Value
+		}
+		wal.Batch = append(wal.Batch, sub)
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range wal.Batch {
+		if err := s.loadBeforeWrite(ctx, sub.Key); err != nil {
+			return nil, err
+		}
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{RequestId: reqID, Wal: wal})
+	if err != nil {
+		return nil, err
+	}
+	reply := &kvpb.BatchReply{Seq: cached.seq}
+	for _, r := range cached.batch {
+		result := &kvpb.BatchResult{Found: r.found}
+		if r.hasOldValue {
+			result.Value = r.oldValue
+		}
+		if err := r.applyError(s.redact); err != nil {
+			result.Error = status.Convert(err).Message()
+		}
+		reply.Results = append(reply.Results, result)
+	}
+	return reply, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestBatchAppliesInOrderAsOneEntry(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	if _, err := srv.Put(call("seed"), &kvpb.PutRequest{Key: "a", Value: "old"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	srv.mu.Lock()
+	before := srv.commitIndex
+	srv.mu.Unlock()
+
+	req := &kvpb.BatchRequest{Ops: []*kvpb.BatchOp{
+		{Op: "GET", Key: "a"},
+		{Op: "SWAP", Key: "a", Value: "new"},
+		{Op: "GET", Key: "a"},
+		{Op: "DELETE", Key: "a"},
+		{Op: "get", Key: "a"},
+	}}
+	got, err := srv.Batch(call("batch"), req)
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	want := []*kvpb.BatchResult{
+		{Found: true, Value: "old"},
+		{Found: true, Value: "old"},
+		{Found: true, Value: "new"},
+		{Found: true},
+		{},
+	}
+	if len(got.Results) != len(want) {
+		t.Fatalf("Batch returned %d results, want %d", len(got.Results), len(want))
+	}
+	for i, w := range want {
+		if r := got.Results[i]; r.Found != w.Found || r.Value != w.Value || r.Error != "" {
+			t.Errorf("result %d = %v, want %v", i, r, w)
+		}
+	}
+	srv.mu.Lock()
+	after := srv.commitIndex
+	srv.mu.Unlock()
+	if after != before+1 || got.Seq != after {
+		t.Fatalf("Batch logged entries %d..%d with seq %d, want one entry", before+1, after, got.Seq)
+	}
+
+	if retry, err := srv.Batch(call("batch"), req); err != nil || retry.Seq != got.Seq || retry.Results[0].Value != "old" {
+		t.Fatalf("retried Batch = %v, %v; want the first reply", retry, err)
+	}
+	changed := &kvpb.BatchRequest{Ops: append([]*kvpb.BatchOp{}, req.Ops[:4]...)}
+	if _, err := srv.Batch(call("batch"), changed); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Batch reusing a request id with other operations: err = %v, want AlreadyExists", err)
+	}
+
+	if _, err := srv.Batch(call("bad-op"), &kvpb.BatchRequest{Ops: []*kvpb.BatchOp{{Op: "RENAME", Key: "a"}}}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Batch with an unknown operation: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.Batch(call("empty"), &kvpb.BatchRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("empty Batch: err = %v, want InvalidArgument", err)
+	}
+
+	// Watchers see the batch's writes, not its gets.
+	srv.mu.Lock()
+	logged := srv.entryLocked(got.Seq).Command.Wal
+	srv.mu.Unlock()
+	events := watchEvents(got.Seq, logged, cachedMutation{found: true})
+	if len(events) != 2 || events[0].Op != "SWAP" || events[1].Op != "DELETE" {
+		t.Fatalf("watch events for the batch = %v, want SWAP then DELETE", events)
+	}
+}
+
+func TestBatchStaysInOnePartition(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.numPartitions = 4
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		key := string(rune('a' + i))
+		if len(keys) == 0 || ownerForKey(key, 4) != ownerForKey(keys[0], 4) {
+			keys = append(keys, key)
+		}
+	}
+	req := &kvpb.BatchRequest{Ops: []*kvpb.BatchOp{{Op: "PUT", Key: keys[0]}, {Op: "PUT", Key: keys[1]}}}
+	if _, err := srv.Batch(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Batch across partitions: err = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// cacheLeaseMaxPending is how many invalidated keys a holder may have
+// waiting to be sent before they are folded into one that voids all its
+// leases.
+const cacheLeaseMaxPending = 1024
+
+// holderID names a lease holder. The name is the client's choice, so it is
+// scoped to the caller's identity: a caller cannot take over, or hear the
+// invalidations of, a holder another identity subscribed.
+type holderID struct {
+	identity, name string
+}
+
+func leaseHolderID(ctx context.Context, name string) holderID {
+	return holderID{identity: identityFromContext(ctx), name: name}
+}
+
+// leaseHolder is one client cache subscribed to its lease invalidations.
+type leaseHolder struct {
+	id      holderID
+	pending []string
+	all     bool
+	closed  bool
+	notify  chan struct{}
+}
+
+func (h *leaseHolder) signal() {
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+// cacheLeases lets clients cache Get replies. The leader grants a holder a
+// lease on a key for ttl; while it holds, a write to the key pushes an
+// invalidation down the holder's CacheInvalidations stream. A holder whose
+// stream breaks gets no more pushes and must drop what it cached. Every
+// replica that applies the write pushes to the holders subscribed to it,
+// so a leader that has stepped down keeps invalidating the leases it
+// granted; in the worst case, a lease granted by a deposed leader that no
+// longer hears of writes, a cached value is stale for at most ttl. It is
+// guarded by kvServer.mu; a nil cacheLeases is disabled.
+type cacheLeases struct {
+	ttl     time.Duration
+	maxKeys int
+	holders map[holderID]*leaseHolder
+	// keys holds, per leased key, each holder's lease expiry.
+	keys          map[string]map[*leaseHolder]time.Time
+	granted       uint64
+	invalidations uint64
+}
+
+func newCacheLeases(ttl time.Duration, maxKeys int) *cacheLeases {
+	if ttl <= 0 || maxKeys <= 0 {
+		return nil
+	}
+	return &cacheLeases{ttl: ttl, maxKeys: maxKeys, holders: make(map[holderID]*leaseHolder), keys: make(map[string]map[*leaseHolder]time.Time)}
+}
+
+// subscribeLocked registers holder id, replacing and voiding any earlier
+// subscription under the same id.
+func (c *cacheLeases) subscribeLocked(id holderID) *leaseHolder {
+	if old := c.holders[id]; old != nil {
+		old.closed = true
+		old.signal()
+	}
+	h := &leaseHolder{id: id, notify: make(chan struct{}, 1)}
+	c.holders[id] = h
+	return h
+}
+
+func (c *cacheLeases) unsubscribeLocked(h *leaseHolder) {
+	h.closed = true
+	if c.holders[h.id] == h {
+		delete(c.holders, h.id)
+	}
+}
+
+// grantLocked leases key to holder id and returns the lease length, or 0 if
+// the holder is not subscribed or too many keys are leased.
+func (c *cacheLeases) grantLocked(key string, id holderID, now time.Time) time.Duration {
+	if c == nil || id.name == "" {
+		return 0
+	}
+	h := c.holders[id]
+	if h == nil {
+		return 0
+	}
+	byHolder := c.keys[key]
+	if byHolder == nil {
+		if len(c.keys) >= c.maxKeys {
+			c.sweepLocked(now)
+			if len(c.keys) >= c.maxKeys {
+				return 0
+			}
+		}
+		byHolder = make(map[*leaseHolder]time.Time)
+		c.keys[key] = byHolder
+	}
+	byHolder[h] = now.Add(c.ttl)
+	c.granted++
+	return c.ttl
+}
+
+// sweepLocked drops expired leases and those of closed holders.
+func (c *cacheLeases) sweepLocked(now time.Time) {
+	for key, byHolder := range c.keys {
+		for h, expires := range byHolder {
+			if h.closed || now.After(expires) {
+				delete(byHolder, h)
+			}
+		}
+		if len(byHolder) == 0 {
+			delete(c.keys, key)
+		}
+	}
+}
+
+// invalidate pushes a change to key to the holders with a lease on it.
+func (c *cacheLeases) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	byHolder, ok := c.keys[key]
+	if !ok {
+		return
+	}
+	delete(c.keys, key)
+	now := time.Now()
+	for h, expires := range byHolder {
+		if h.closed || now.After(expires) {
+			continue
+		}
+		c.invalidations++
+		if !h.all {
+			if len(h.pending) >= cacheLeaseMaxPending {
+				h.pending, h.all = nil, true
+			} else {
+				h.pending = append(h.pending, key)
+			}
+		}
+		h.signal()
+	}
+}
+
+// reset voids every lease, for when the whole tree is replaced.
+func (c *cacheLeases) reset() {
+	if c == nil {
+		return
+	}
+	for _, h := range c.holders {
+		h.pending, h.all = nil, true
+		h.signal()
+	}
+	clear(c.keys)
+}
+
+// takeLocked returns what h has to send, or nil if nothing.
+func (h *leaseHolder) takeLocked() *kvpb.CacheInvalidation {
+	if !h.all && len(h.pending) == 0 {
+		return nil
+	}
+	inv := &kvpb.CacheInvalidation{Keys: h.pending, All: h.all}
+	h.pending, h.all = nil, false
+	return inv
+}
+
+// CacheInvalidations streams the invalidations of the cache leases granted
+// to req.Holder, under the caller's identity, until the client goes away or
+// subscribes again.
+func (s *kvServer) CacheInvalidations(req *kvpb.CacheInvalidationsRequest, stream kvpb.KVS_CacheInvalidationsServer) error {
+	if req.Holder == "" {
+		return invalidFieldError("holder", "holder is required")
+	}
+	s.mu.Lock()
+	if s.cacheLeases == nil {
+		s.mu.Unlock()
+		return status.Errorf(codes.FailedPrecondition, "cache leases are disabled on this server")
+	}
+	h := s.cacheLeases.subscribeLocked(leaseHolderID(stream.Context(), req.Holder))
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cacheLeases.unsubscribeLocked(h)
+		s.mu.Unlock()
+	}()
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.notify:
+		}
+		s.mu.Lock()
+		closed, inv := h.closed, h.takeLocked()
+		s.mu.Unlock()
+		if closed {
+			return status.Error(codes.Aborted, "the holder subscribed again on another stream")
+		}
+		if inv != nil {
+			if err := stream.Send(inv); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *kvServer) registerCacheLeaseMetrics(r *metricsRegistry) {
+	r.counter("kv_cache_leases_granted_total", "Cache leases granted on Get replies.", s.locked(func() float64 { return float64(s.cacheLeases.granted) }))
+	r.counter("kv_cache_lease_invalidations_total", "Invalidations pushed to holders of a cache lease on a changed key.", s.locked(func() float64 { return float64(s.cacheLeases.invalidations) }))
+	r.gauge("kv_cache_lease_holders", "Client caches subscribed to lease invalidations.", s.locked(func() float64 { return float64(len(s.cacheLeases.holders)) }))
+	r.gauge("kv_cache_leased_keys", "Keys with a cache lease that may still be in force.", s.locked(func() float64 { return float64(len(s.cacheLeases.keys)) }))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestCacheLeasesInvalidateOnWrite(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.cacheLeases = newCacheLeases(time.Minute, 16)
+	becomeTestLeader(t, srv, 1)
+
+	put := func(reqID, key, value string) {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: value}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	get := func(key, holder string) *kvpb.GetReply {
+		t.Helper()
+		resp, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: key, LeaseHolder: holder})
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", key, err)
+		}
+		return resp
+	}
+	put("p1", "a", "1")
+
+	if resp := get("a", "c1"); resp.LeaseMillis != 0 {
+		t.Fatalf("lease_millis = %d for an unsubscribed holder, want 0", resp.LeaseMillis)
+	}
+	srv.mu.Lock()
+	h := srv.cacheLeases.subscribeLocked(holderID{name: "c1"})
+	srv.mu.Unlock()
+	if resp := get("a", "c1"); resp.LeaseMillis != time.Minute.Milliseconds() || resp.Value != "1" {
+		t.Fatalf("Get = %v, want value 1 with a one minute lease", resp)
+	}
+	if resp := get("missing", "c1"); resp.Found || resp.LeaseMillis == 0 {
+		t.Fatalf("Get(missing) = %v, want a leased not-found reply", resp)
+	}
+
+	put("p2", "b", "unleased")
+	put("p3", "a", "2")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "d1"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "a"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	put("p4", "missing", "now")
+	srv.mu.Lock()
+	inv := h.takeLocked()
+	srv.mu.Unlock()
+	if inv == nil || inv.All || !slices.Equal(inv.Keys, []string{"a", "missing"}) {
+		t.Fatalf("invalidation = %v, want keys [a missing]: the delete needs no second push once the put voided the lease", inv)
+	}
+
+	get("a", "c1")
+	srv.mu.Lock()
+	srv.cacheLeases.reset()
+	inv = h.takeLocked()
+	srv.mu.Unlock()
+	if inv == nil || !inv.All {
+		t.Fatalf("invalidation after reset = %v, want all", inv)
+	}
+}
+
+func TestCacheLeasesResubscribeVoidsOldHolder(t *testing.T) {
+	c := newCacheLeases(time.Minute, 1)
+	now := time.Now()
+	c1 := holderID{name: "c1"}
+	old := c.subscribeLocked(c1)
+	if c.grantLocked("a", c1, now) == 0 {
+		t.Fatal("first lease not granted")
+	}
+	if c.grantLocked("b", c1, now) != 0 {
+		t.Fatal("lease granted past cache_lease_keys")
+	}
+	c.subscribeLocked(c1)
+	if !old.closed {
+		t.Fatal("the earlier subscription is still open")
+	}
+	// The old holder's lease on a is swept, making room for b.
+	if c.grantLocked("b", c1, now) == 0 {
+		t.Fatal("lease on b not granted after the old holder's leases were swept")
+	}
+	c.invalidate("b")
+	if got := c.holders[c1].takeLocked(); got == nil || !slices.Equal(got.Keys, []string{"b"}) {
+		t.Fatalf("invalidation = %v, want [b]", got)
+	}
+}
+
+func TestCacheLeaseHoldersAreScopedToIdentity(t *testing.T) {
+	c := newCacheLeases(time.Minute, 10)
+	now := time.Now()
+	ann := leaseHolderID(context.WithValue(context.Background(), identityKey{}, "ann"), "c1")
+	bob := leaseHolderID(context.WithValue(context.Background(), identityKey{}, "bob"), "c1")
+	annHolder := c.subscribeLocked(ann)
+	if c.grantLocked("a", ann, now) == 0 {
+		t.Fatal("lease not granted to ann's holder")
+	}
+	// bob picks the same holder name; it is a holder of his own.
+	bobHolder := c.subscribeLocked(bob)
+	if annHolder.closed {
+		t.Fatal("another identity's subscription closed ann's holder")
+	}
+	c.invalidate("a")
+	if got := bobHolder.takeLocked(); got != nil {
+		t.Fatalf("bob heard ann's invalidation %v", got)
+	}
+	if got := annHolder.takeLocked(); got == nil || !slices.Equal(got.Keys, []string{"a"}) {
+		t.Fatalf("ann's invalidation = %v, want [a]", got)
+	}
+}
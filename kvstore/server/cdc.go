@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// ChangeEvent is one committed WAL record as shipped to a change sink.
+// Events describe commands, not their outcome: an EXPIRE whose schedule was
+// cancelled in the meantime is still shipped. An INGEST record becomes one
+// event per pair, all with the same seq. A RENAME moves Value from Key to
+// NewKey.
+type ChangeEvent struct {
+	Partition int    `json:"partition"`
+	Seq       uint64 `json:"seq"`
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	DeleteAt  int64  `json:"delete_at,omitempty"`
+	TTLNanos  int64  `json:"ttl_nanos,omitempty"`
+	UnixNanos int64  `json:"unix_nanos"`
+	NewKey    string `json:"new_key,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	// MergeOperator names the operator a MERGE folds Value in with.
+	MergeOperator string `json:"merge_operator,omitempty"`
+	// ValueType is set on a PUT or SWAP that makes its key an integer.
+	ValueType string `json:"value_type,omitempty"`
+	// ContentType is the media type a PUT or SWAP tags Value with.
+	ContentType string `json:"content_type,omitempty"`
+	// Origin and HVC are set in a multi-writer mirror; see conflict.go.
+	Origin string           `json:"origin,omitempty"`
+	HVC    map[string]int64 `json:"hvc,omitempty"`
+}
+
+// ChangeSink receives committed changes from the partition leader.
+//
+// Publish must not return nil until every event in the batch is durably
+// accepted; on error the whole batch is sent again, so sinks see each event
+// at least once and consumers should deduplicate on (partition, seq, key).
+type ChangeSink interface {
+	Publish(ctx context.Context, events []ChangeEvent) error
+	Close() error
+}
+
+// newChangeSink builds the sink described by spec, which is one of
+//
+//	kafka:<REST proxy URL>   POST to topic through a Kafka REST proxy (v2 API)
+//	file:<path>              append JSON lines to path
+func newChangeSink(spec, topic string) (ChangeSink, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("cdc sink %q: want kind:target", spec)
+	}
+	switch kind {
+	case "kafka":
+		if topic == "" {
+			return nil, errors.New("kafka cdc sink needs a topic")
+		}
+		return &kafkaRESTSink{
+			url:    strings.TrimRight(target, "/") + "/topics/" + topic,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "file":
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open cdc file: %w", err)
+		}
+		return &fileSink{f: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown cdc sink kind %q", kind)
+	}
+}
+
+// kafkaRESTSink produces to a Kafka topic through a REST proxy. Records are
+// keyed by the KV key, so Kafka keeps each key's changes in order.
+type kafkaRESTSink struct {
+	url    string
+	client *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string      `json:"key"`
+	Value ChangeEvent `json:"value"`
+}
+
+func (k *kafkaRESTSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	records := make([]kafkaRecord, len(events))
+	for i, ev := range events {
+		records[i] = kafkaRecord{Key: ev.Key, Value: ev}
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kafka produce: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka produce: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	// The proxy answers 200 even when single records fail.
+	var reply struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("kafka produce: decode reply: %w", err)
+	}
+	for _, off := range reply.Offsets {
+		if off.ErrorCode != nil {
+			return fmt.Errorf("kafka produce: record failed: %d %s", *off.ErrorCode, off.Error)
+		}
+	}
+	return nil
+}
+
+func (k *kafkaRESTSink) Close() error { return nil }
+
+// fileSink appends events to a local file as JSON lines.
+type fileSink struct {
+	f *os.File
+}
+
+func (fs *fileSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	w := bufio.NewWriter(fs.f)
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fs.f.Sync()
+}
+
+func (fs *fileSink) Close() error { return fs.f.Close() }
+
+// cdcFeedName names the feed configured with --cdc_sink.
+const cdcFeedName = "cdc"
+
+// cdcPublisher ships committed log entries to one sink. Each publisher
+// keeps its own checkpoint in raft_meta, so a slow or failing sink never
+// holds back another. Only the leader ships; it passes the lowest checkpoint
+// to followers with AppendEntries so a new leader resumes close to where the
+// old one stopped. The raft log is never compacted past any checkpoint.
+type cdcPublisher struct {
+	name     string
+	sink     ChangeSink
+	batch    int
+	interval time.Duration
+
+	// shipped is the last index delivered, guarded by kvServer.mu.
+	shipped uint64
+
+	events      atomic.Uint64
+	failures    atomic.Uint64
+	lastPublish atomic.Int64
+}
+
+// metaKey names f's checkpoint in raft_meta. The --cdc_sink feed keeps the
+// key it had before other feeds existed.
+func (f *cdcPublisher) metaKey() string {
+	if f.name == cdcFeedName {
+		return "cdc_shipped"
+	}
+	return "cdc_shipped:" + f.name
+}
+
+// addChangeFeed attaches sink under name, resuming from its persisted
+// checkpoint.
+func (s *kvServer) addChangeFeed(name string, sink ChangeSink, batch int, interval time.Duration) (*cdcPublisher, error) {
+	if batch <= 0 {
+		batch = 500
+	}
+	f := &cdcPublisher{name: name, sink: sink, batch: batch, interval: interval}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var raw string
+	err := s.db.QueryRow(`SELECT value FROM raft_meta WHERE key = ?`, f.metaKey()).Scan(&raw)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, fmt.Errorf("load %s: %w", f.metaKey(), err)
+	default:
+		if f.shipped, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.metaKey(), err)
+		}
+	}
+	s.feeds = append(s.feeds, f)
+	return f, nil
+}
+
+// setShippedLocked records that entries up to index reached f's sink.
+func (s *kvServer) setShippedLocked(f *cdcPublisher, index uint64) error {
+	if index <= f.shipped {
+		return nil
+	}
+	f.shipped = index
+	return s.persistMetaLocked(f.metaKey(), strconv.FormatUint(index, 10))
+}
+
+// feedsShippedLocked returns the lowest checkpoint over all change feeds,
+// or 0 if there are none.
+func (s *kvServer) feedsShippedLocked() uint64 {
+	var low uint64
+	for i, f := range s.feeds {
+		if i == 0 || f.shipped < low {
+			low = f.shipped
+		}
+	}
+	return low
+}
+
+// shipChanges publishes the next batch of committed entries to f and
+// returns how many log entries it covered.
+func (s *kvServer) shipChanges(ctx context.Context, f *cdcPublisher) (int, error) {
+	s.mu.Lock()
+	if s.role != roleLeader {
+		s.mu.Unlock()
+		return 0, nil
+	}
+	from := f.shipped
+	if from < s.logBase {
+		s.logf("cdc %s: entries %d..%d were compacted before they were shipped", f.name, from+1, s.logBase)
+		from = s.logBase
+	}
+	to := min(s.commitIndex, from+uint64(f.batch))
+	var events []ChangeEvent
+	for idx := from + 1; idx <= to; idx++ {
+		wal := s.entryLocked(idx).GetCommand().GetWal()
+		if wal == nil || wal.Op == kvpb.WALCommand_OP_UNSPECIFIED {
+			continue
+		}
+		// A batch ships as its writes, one event each.
+		wals := []*kvpb.WALCommand{wal}
+		if wal.Op == kvpb.WALCommand_OP_BATCH {
+			wals = batchWrites(wal)
+		}
+		for _, wal := range wals {
+			ev := ChangeEvent{
+				Partition:     s.partitionID,
+				Seq:           idx,
+				Op:            strings.TrimPrefix(wal.Op.String(), "OP_"),
+				Key:           wal.Key,
+				Value:         wal.Value,
+				DeleteAt:      wal.DeleteAt,
+				TTLNanos:      wal.TtlNanos,
+				UnixNanos:     wal.UnixNanos,
+				NewKey:        wal.NewKey,
+				Overwrite:     wal.Overwrite,
+				Origin:        wal.Origin,
+				MergeOperator: wal.MergeOperator,
+				HVC:           wal.Hvc,
+				ContentType:   wal.ContentType,
+			}
+			if wal.ValueType != kvpb.ValueType_VALUE_TYPE_STRING {
+				ev.ValueType = wal.ValueType.String()
+			}
+			if len(wal.Ingest) == 0 {
+				events = append(events, ev)
+			}
+			for _, p := range wal.Ingest {
+				ev.Key, ev.Value = p.Key, p.Value
+				events = append(events, ev)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if to <= from {
+		return 0, nil
+	}
+
+	if len(events) > 0 {
+		if err := f.sink.Publish(ctx, events); err != nil {
+			f.failures.Add(1)
+			return 0, err
+		}
+		f.events.Add(uint64(len(events)))
+	}
+	f.lastPublish.Store(time.Now().UnixNano())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.setShippedLocked(f, to); err != nil {
+		return 0, err
+	}
+	return int(to - from), nil
+}
+
+// cdcLoop ships to f until ctx ends, backing off while the sink fails.
+func (s *kvServer) cdcLoop(ctx context.Context, f *cdcPublisher) {
+	const maxBackoff = 30 * time.Second
+	wait := f.interval
+	backoff := f.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		pubCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		n, err := s.shipChanges(pubCtx, f)
+		cancel()
+		switch {
+		case err != nil:
+			log.Printf("cdc %s: publish failed, retrying in %s: %v", f.name, backoff, err)
+			wait = backoff
+			backoff = min(2*backoff, maxBackoff)
+		case n >= f.batch:
+			wait, backoff = 0, f.interval
+		default:
+			wait, backoff = f.interval, f.interval
+		}
+	}
+}
+
+// cdcLagLocked returns how many committed entries f has not shipped and how
+// old the oldest of them is.
+func (s *kvServer) cdcLagLocked(f *cdcPublisher, now time.Time) (uint64, time.Duration) {
+	next := f.shipped + 1
+	if next <= s.logBase {
+		next = s.logBase + 1
+	}
+	if next > s.commitIndex {
+		return 0, 0
+	}
+	lag := s.commitIndex - f.shipped
+	wal := s.entryLocked(next).GetCommand().GetWal()
+	if wal == nil || wal.UnixNanos == 0 {
+		return lag, 0
+	}
+	return lag, now.Sub(time.Unix(0, wal.UnixNanos))
+}
+
+func (s *kvServer) registerCDCMetrics(r *metricsRegistry) {
+	perFeed := func(fn func(f *cdcPublisher) float64) func() []metricSample {
+		return func() []metricSample {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			samples := make([]metricSample, 0, len(s.feeds))
+			for _, f := range s.feeds {
+				samples = append(samples, metricSample{labels: map[string]string{"feed": f.name}, value: fn(f)})
+			}
+			return samples
+		}
+	}
+	now := time.Now
+	r.register("kv_cdc_shipped_index", "Highest log index delivered to the change feed's sink.", "gauge", perFeed(func(f *cdcPublisher) float64 { return float64(f.shipped) }))
+	r.register("kv_cdc_lag_entries", "Committed log entries not yet delivered to the change feed's sink.", "gauge", perFeed(func(f *cdcPublisher) float64 {
+		lag, _ := s.cdcLagLocked(f, now())
+		return float64(lag)
+	}))
+	r.register("kv_cdc_lag_seconds", "Age of the oldest committed entry not yet delivered to the change feed's sink.", "gauge", perFeed(func(f *cdcPublisher) float64 {
+		_, age := s.cdcLagLocked(f, now())
+		return age.Seconds()
+	}))
+	r.register("kv_cdc_events_total", "Change events delivered to the change feed's sink.", "counter", perFeed(func(f *cdcPublisher) float64 { return float64(f.events.Load()) }))
+	r.register("kv_cdc_publish_failures_total", "Failed attempts to deliver a batch to the change feed's sink.", "counter", perFeed(func(f *cdcPublisher) float64 { return float64(f.failures.Load()) }))
+	r.register("kv_cdc_last_publish_timestamp_seconds", "Unix time of the last successful delivery.", "gauge", perFeed(func(f *cdcPublisher) float64 { return float64(f.lastPublish.Load()) / 1e9 }))
+}
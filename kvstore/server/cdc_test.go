@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+type memorySink struct {
+	events []ChangeEvent
+	fail   bool
+}
+
+func (m *memorySink) Publish(ctx context.Context, events []ChangeEvent) error {
+	if m.fail {
+		return errors.New("sink down")
+	}
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *memorySink) Close() error { return nil }
+
+func TestCDCShipsCommittedChangesAtLeastOnce(t *testing.T) {
+	backerDir := t.TempDir()
+	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
+	sink := &memorySink{fail: true}
+	feed, err := srv.addChangeFeed(cdcFeedName, sink, 2, 0)
+	if err != nil {
+		t.Fatalf("addChangeFeed() failed: %v", err)
+	}
+	becomeTestLeader(t, srv, 1)
+
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	if _, err := srv.Put(call("p1"), &kvpb.PutRequest{Key: "a", Value: "1"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.Delete(call("d1"), &kvpb.DeleteRequest{Key: "a"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := srv.Put(call("p2"), &kvpb.PutRequest{Key: "b", Value: "2"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if _, err := srv.shipChanges(context.Background(), feed); err == nil {
+		t.Fatalf("shipChanges succeeded with a failing sink")
+	}
+	srv.mu.Lock()
+	shipped, base := feed.shipped, srv.compactionBaseLocked()
+	srv.mu.Unlock()
+	if shipped != 0 || base != 0 {
+		t.Fatalf("after failure cdcShipped=%d compaction base=%d, want 0", shipped, base)
+	}
+
+	sink.fail = false
+	for {
+		n, err := srv.shipChanges(context.Background(), feed)
+		if err != nil {
+			t.Fatalf("shipChanges failed: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	var got []string
+	for _, ev := range sink.events {
+		got = append(got, ev.Op+":"+ev.Key+"="+ev.Value)
+	}
+	want := []string{"PUT:a=1", "DELETE:a=", "PUT:b=2"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+
+	reloaded := newTestServer(t, backerDir, 0, 0, 1, 1)
+	resumed, err := reloaded.addChangeFeed(cdcFeedName, &memorySink{}, 2, 0)
+	if err != nil {
+		t.Fatalf("addChangeFeed() after restart failed: %v", err)
+	}
+	if resumed.shipped != feed.shipped {
+		t.Fatalf("checkpoint after restart = %d, want %d", resumed.shipped, feed.shipped)
+	}
+}
+
+func TestWebhookSinkFiltersByPrefixAndSigns(t *testing.T) {
+	var bodies []string
+	fail := true
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get(webhookSignatureHeader))
+		}
+		if fail {
+			fail = false
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer hook.Close()
+
+	sink := newWebhookSink(webhookRule{prefix: "user/", url: hook.URL}, "s3cret")
+	events := []ChangeEvent{{Seq: 1, Op: "PUT", Key: "user/1", Value: "a"}, {Seq: 2, Op: "PUT", Key: "order/1", Value: "b"}}
+	if err := sink.Publish(context.Background(), events); err == nil {
+		t.Fatalf("Publish succeeded on a 503")
+	}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if err := sink.Publish(context.Background(), events[1:]); err != nil {
+		t.Fatalf("Publish without matches failed: %v", err)
+	}
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"user/1"`) || strings.Contains(bodies[0], "order/1") {
+		t.Fatalf("webhook bodies = %q, want one with only user/1", bodies)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chaosFlagPrefix marks fault-injection flags, which are left out of --help
+// so they are not mistaken for production tuning knobs.
+const chaosFlagPrefix = "chaos-"
+
+// chaosConfig injects faults into the client RPC path and the durable write
+// path. A nil *chaosConfig injects nothing.
+type chaosConfig struct {
+	latency    time.Duration
+	errorRate  float64
+	fsyncStall time.Duration
+}
+
+func newChaosConfig(latencyMS int, errorRate float64, fsyncStall time.Duration) *chaosConfig {
+	if latencyMS <= 0 && errorRate <= 0 && fsyncStall <= 0 {
+		return nil
+	}
+	return &chaosConfig{
+		latency:    time.Duration(latencyMS) * time.Millisecond,
+		errorRate:  errorRate,
+		fsyncStall: fsyncStall,
+	}
+}
+
+// stallFsync delays a durable write to mimic a slow or saturated disk.
+func (c *chaosConfig) stallFsync() {
+	if c == nil || c.fsyncStall <= 0 {
+		return
+	}
+	time.Sleep(c.fsyncStall)
+}
+
+func (c *chaosConfig) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if c == nil {
+		return handler(ctx, req)
+	}
+	if c.latency > 0 {
+		delay := time.Duration(rand.Int63n(int64(c.latency) + 1))
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(delay):
+		}
+	}
+	if c.errorRate > 0 && rand.Float64() < c.errorRate {
+		return nil, status.Errorf(codes.Unavailable, "chaos: injected error for %s", info.FullMethod)
+	}
+	return handler(ctx, req)
+}
+
+// visibleUsage prints flag defaults like the flag package does, minus the
+// hidden chaos flags.
+func visibleUsage() {
+	out := flag.CommandLine.Output()
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, chaosFlagPrefix) {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	visible.PrintDefaults()
+}
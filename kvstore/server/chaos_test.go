@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChaosInterceptorInjectsErrors(t *testing.T) {
+	if newChaosConfig(0, 0, 0) != nil {
+		t.Fatalf("newChaosConfig() with no faults should be nil")
+	}
+	var off *chaosConfig
+	if _, err := off.unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/KVS/Get"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("nil chaosConfig interceptor = %v, want the handler's result", err)
+	}
+	chaos := newChaosConfig(0, 1, 0)
+	called := false
+	_, err := chaos.unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/KVS/Get"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if called {
+		t.Fatalf("handler ran despite error_rate=1")
+	}
+	if st, ok := status.FromError(err); !ok || st.Code() != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+}
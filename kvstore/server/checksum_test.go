@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestValueChecksums(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	corrupt := func(what string, err error) {
+		t.Helper()
+		if status.Code(err) != codes.DataLoss || errorReason(err) != reasonChecksumMismatch {
+			t.Fatalf("%s: err = %v, want DataLoss %s", what, err, reasonChecksumMismatch)
+		}
+	}
+
+	_, err := srv.Put(call("bad"), &kvpb.PutRequest{Key: "k", Value: "truncat", ValueCrc32C: valueChecksum("truncated"), HasValueCrc32C: true})
+	corrupt("Put with a checksum the value does not match", err)
+	if _, err := srv.Put(call("good"), &kvpb.PutRequest{Key: "k", Value: "intact", ValueCrc32C: valueChecksum("intact"), HasValueCrc32C: true}); err != nil {
+		t.Fatalf("Put with a matching checksum: %v", err)
+	}
+	if _, err := srv.Put(call("other"), &kvpb.PutRequest{Key: "l", Value: "fine"}); err != nil {
+		t.Fatalf("Put without a checksum: %v", err)
+	}
+	got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	if err != nil || got.Value != "intact" || !got.HasValueCrc32C || got.ValueCrc32C != valueChecksum("intact") {
+		t.Fatalf("Get = %v, %v; want the value with its checksum", got, err)
+	}
+
+	// Damage the stored value behind the checksum's back.
+	srv.mu.Lock()
+	it, _ := srv.getLiveLocked("k")
+	it.value = "intacu"
+	srv.tree.ReplaceOrInsert(it)
+	srv.mu.Unlock()
+	_, err = srv.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	corrupt("Get of a damaged value", err)
+	_, err = srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "a", EndKey: "z"})
+	corrupt("Scan over a damaged value", err)
+	if n := srv.checksumFailures.Load(); n != 2 {
+		t.Fatalf("checksum failures = %d, want 2", n)
+	}
+	if got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "l"}); err != nil || got.Value != "fine" {
+		t.Fatalf("Get of an intact neighbour = %v, %v", got, err)
+	}
+}
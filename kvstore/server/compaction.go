@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// compactionJobSnapshot writes a snapshot and compacts the raft log behind it.
+// It is the only job kind today; the scheduler keys jobs by name so more can
+// share the single worker.
+const compactionJobSnapshot = "snapshot"
+
+// maxCompactionDefer bounds how long a job waits for load to drop, so a
+// continuously busy server still compacts eventually.
+const maxCompactionDefer = 30 * time.Second
+
+// compactionScheduler runs background compaction jobs one at a time, so jobs
+// never overlap, and throttles their disk writes. A job queued while the same
+// kind is already waiting is dropped.
+type compactionScheduler struct {
+	mu      sync.Mutex
+	queue   []string
+	queued  map[string]bool
+	running string
+	wake    chan struct{}
+
+	// bytesPerSec caps compaction write bandwidth; 0 means unlimited.
+	bytesPerSec float64
+	// busy reports whether foreground load is high enough to defer work.
+	busy func() bool
+
+	completed atomic.Uint64
+	failed    atomic.Uint64
+	deferrals atomic.Uint64
+}
+
+func newCompactionScheduler(bytesPerSec float64, busy func() bool) *compactionScheduler {
+	return &compactionScheduler{
+		queued:      make(map[string]bool),
+		wake:        make(chan struct{}, 1),
+		bytesPerSec: bytesPerSec,
+		busy:        busy,
+	}
+}
+
+// enqueue adds a job and reports whether it was queued.
+func (c *compactionScheduler) enqueue(job string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued[job] {
+		return false
+	}
+	c.queued[job] = true
+	c.queue = append(c.queue, job)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (c *compactionScheduler) queueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+func (c *compactionScheduler) isRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running != ""
+}
+
+func (c *compactionScheduler) next() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return "", false
+	}
+	job := c.queue[0]
+	c.queue = c.queue[1:]
+	delete(c.queued, job)
+	c.running = job
+	return job, true
+}
+
+func (c *compactionScheduler) finish() {
+	c.mu.Lock()
+	c.running = ""
+	c.mu.Unlock()
+}
+
+// waitForQuiet blocks while the server is busy, up to maxCompactionDefer.
+func (c *compactionScheduler) waitForQuiet(ctx context.Context, deadline time.Time) {
+	for c.busy != nil && c.busy() && time.Now().Before(deadline) {
+		c.deferrals.Add(1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// run executes queued jobs until ctx is cancelled.
+func (c *compactionScheduler) run(ctx context.Context, exec func(job string, wrap func(io.Writer) io.Writer) error) {
+	for {
+		job, ok := c.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wake:
+				continue
+			}
+		}
+		deadline := time.Now().Add(maxCompactionDefer)
+		c.waitForQuiet(ctx, deadline)
+		wrap := func(w io.Writer) io.Writer {
+			return &throttledWriter{ctx: ctx, w: w, sched: c, deadline: deadline, started: time.Now()}
+		}
+		if err := exec(job, wrap); err != nil {
+			c.failed.Add(1)
+			log.Printf("compaction job %s failed: %v", job, err)
+		} else {
+			c.completed.Add(1)
+		}
+		c.finish()
+	}
+}
+
+// throttledWriter paces writes to the scheduler's byte rate and pauses while
+// the server is busy.
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	sched    *compactionScheduler
+	deadline time.Time
+	started  time.Time
+	written  int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.sched.waitForQuiet(t.ctx, t.deadline)
+	n, err := t.w.Write(p)
+	t.written += int64(n)
+	if rate := t.sched.bytesPerSec; rate > 0 {
+		due := t.started.Add(time.Duration(float64(t.written) / rate * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-t.ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+	}
+	return n, err
+}
+
+// loadTracker counts in-flight client RPCs so background work can back off
+// while foreground traffic is heavy.
+type loadTracker struct {
+	inflight atomic.Int64
+}
+
+func (l *loadTracker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	l.inflight.Add(1)
+	defer l.inflight.Add(-1)
+	return handler(ctx, req)
+}
+
+// compactionLoop queues a snapshot whenever more than threshold entries have
+// been applied since the last one.
+func (s *kvServer) compactionLoop(ctx context.Context, threshold uint64) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			due := threshold > 0 && s.lastApplied-s.snapshotIndex >= threshold
+			s.mu.Unlock()
+			if due {
+				s.compactor.enqueue(compactionJobSnapshot)
+			}
+		}
+	}
+}
+
+func (s *kvServer) runCompactionJob(job string, wrap func(io.Writer) io.Writer) error {
+	switch job {
+	case compactionJobSnapshot:
+		return s.takeSnapshot(wrap)
+	default:
+		return nil
+	}
+}
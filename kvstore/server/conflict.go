@@ -0,0 +1,296 @@
+package main
+
+// Multi-writer mirroring lets two clusters mirror to each other (each with
+// --mirror_target pointing at the other) and both take client writes. Each
+// cluster needs a distinct --cluster_id, which every replica of it shares.
+//
+// Puts, swaps and deletes then carry a hybrid vector clock (HVC): for each
+// cluster, the hybrid logical clock of the latest write accepted there that
+// the new write follows. When a write applies, it either follows the key's
+// current version, precedes it (an old duplicate, which is dropped), or is
+// concurrent with it. Concurrent writes are a conflict: the one with the
+// higher clock wins on both sides, ties going to the higher cluster ID, so
+// both clusters keep the same value. Both versions' vectors are merged so a
+// later write on either side supersedes them cleanly. Resolution happens at
+// apply time from the log alone, so every replica reaches the same result.
+//
+// With --mirror_conflicts=merge:<path>, the partition leader also runs
+// <path> for each conflict and writes its output back as a new version that
+// follows both. The hook reads {"key": ..., "versions": [older, newer]} as
+// JSON on stdin, each version being {"value", "deleted", "hvc"}, and prints
+// the merged value. Both clusters run it for the same conflict, so it must
+// be deterministic; the two merged writes are then equal and do not
+// conflict again. If it fails the last-writer-wins result stands.
+//
+// Scheduled deletes, persists, expiries and ingests are not versioned and
+// apply in log order on each side.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os/exec"
+	"strings"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Conflict policies for --mirror_conflicts.
+const (
+	conflictLWW   = "lww"
+	conflictMerge = "merge"
+)
+
+const (
+	mergeHookTimeout = 5 * time.Second
+	mergeQueueDepth  = 1024
+)
+
+// Conflict resolutions counted in kv_mirror_conflicts_total.
+const (
+	resolvedIncoming    = "incoming_won"
+	resolvedExisting    = "existing_won"
+	resolvedMerged      = "merged"
+	resolvedMergeFailed = "merge_failed"
+)
+
+// hvc is a hybrid vector clock: cluster ID to hybrid logical clock.
+type hvc map[string]int64
+
+// covers reports whether v has seen every write o has.
+func (v hvc) covers(o hvc) bool {
+	for cluster, t := range o {
+		if v[cluster] < t {
+			return false
+		}
+	}
+	return true
+}
+
+// stamp returns v's latest clock and the cluster it belongs to.
+func (v hvc) stamp() (int64, string) {
+	var t int64
+	var cluster string
+	for c, ct := range v {
+		if ct > t || (ct == t && c > cluster) {
+			t, cluster = ct, c
+		}
+	}
+	return t, cluster
+}
+
+// newerThan orders concurrent versions for last-writer-wins.
+func (v hvc) newerThan(o hvc) bool {
+	vt, vc := v.stamp()
+	ot, oc := o.stamp()
+	return vt > ot || (vt == ot && vc > oc)
+}
+
+// join returns the pointwise maximum of v and o.
+func (v hvc) join(o hvc) hvc {
+	out := maps.Clone(v)
+	if out == nil {
+		out = make(hvc, len(o))
+	}
+	for c, t := range o {
+		if t > out[c] {
+			out[c] = t
+		}
+	}
+	return out
+}
+
+// conflictPolicy is the parsed --mirror_conflicts flag.
+type conflictPolicy struct {
+	kind string
+	hook string
+}
+
+func parseConflictPolicy(raw string) (conflictPolicy, error) {
+	if raw == "" || raw == conflictLWW {
+		return conflictPolicy{kind: conflictLWW}, nil
+	}
+	if hook, ok := strings.CutPrefix(raw, conflictMerge+":"); ok && hook != "" {
+		return conflictPolicy{kind: conflictMerge, hook: hook}, nil
+	}
+	return conflictPolicy{}, fmt.Errorf("conflict policy %q: want %s or %s:<path>", raw, conflictLWW, conflictMerge)
+}
+
+// multiWriterLocked reports whether wal is a write that carries a version.
+func (s *kvServer) multiWriterLocked(wal *kvpb.WALCommand) bool {
+	if s.clusterID == "" {
+		return false
+	}
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_SWAP, kvpb.WALCommand_OP_DELETE:
+		return true
+	}
+	return false
+}
+
+// observeHLCLocked moves the hybrid logical clock past every time in v.
+func (s *kvServer) observeHLCLocked(v hvc) {
+	if t, _ := v.stamp(); t > s.hlc {
+		s.hlc = t
+	}
+}
+
+// stampWriteLocked versions a write this cluster accepts: it follows the
+// key's current version, with this cluster's clock past anything seen.
+func (s *kvServer) stampWriteLocked(wal *kvpb.WALCommand) {
+	var cur hvc
+	if got, ok := s.tree.Get(item{key: wal.Key}); ok {
+		cur = got.hvc
+	}
+	t := time.Now().UnixNano()
+	if latest, _ := cur.stamp(); latest >= t {
+		t = latest + 1
+	}
+	if s.hlc >= t {
+		t = s.hlc + 1
+	}
+	s.hlc = t
+	next := cur.join(nil)
+	next[s.clusterID] = t
+	wal.Hvc = next
+	wal.Origin = s.clusterID
+}
+
+// resolveConflictLocked decides whether a versioned write applies and with
+// which vector. A write that applies must then be stamped with the returned
+// vector through setVersionLocked.
+func (s *kvServer) resolveConflictLocked(wal *kvpb.WALCommand) (hvc, bool) {
+	incoming := hvc(wal.Hvc)
+	s.observeHLCLocked(incoming)
+	cur, ok := s.tree.Get(item{key: wal.Key})
+	if !ok || cur.hvc == nil || incoming.covers(cur.hvc) {
+		return incoming, true
+	}
+	existing := cur.hvc
+	if existing.covers(incoming) {
+		// Already reflected here, for example a write mirrored back.
+		return nil, false
+	}
+	joined := existing.join(incoming)
+	deleted := wal.Op == kvpb.WALCommand_OP_DELETE
+	if cur.tombstone == deleted && (deleted || cur.value == wal.Value) {
+		// The same outcome reached on both sides is not a conflict.
+		s.setVersionLocked(wal.Key, joined)
+		return nil, false
+	}
+	wins := incoming.newerThan(existing)
+	if s.conflictPolicy.kind == conflictMerge && s.role == roleLeader {
+		older, newer := mergeVersion{Value: cur.value, Deleted: cur.tombstone, HVC: existing}, mergeVersion{Value: wal.Value, Deleted: deleted, HVC: incoming}
+		if !wins {
+			older, newer = newer, older
+		}
+		s.queueMergeLocked(mergeJob{Key: wal.Key, Versions: [2]mergeVersion{older, newer}, joined: joined})
+	}
+	if wins {
+		s.conflicts[resolvedIncoming]++
+		return joined, true
+	}
+	s.conflicts[resolvedExisting]++
+	s.setVersionLocked(wal.Key, joined)
+	return nil, false
+}
+
+// setVersionLocked records v as the version of key's value or tombstone.
+func (s *kvServer) setVersionLocked(key string, v hvc) {
+	it, ok := s.tree.Get(item{key: key})
+	if !ok {
+		return
+	}
+	it.hvc = v
+	s.tree.ReplaceOrInsert(it)
+}
+
+type mergeVersion struct {
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted"`
+	HVC     hvc    `json:"hvc"`
+}
+
+// mergeJob is the input to the merge hook. joined is the key's version
+// after resolution; the merged value is only written if it still is.
+type mergeJob struct {
+	Key      string          `json:"key"`
+	Versions [2]mergeVersion `json:"versions"`
+	joined   hvc
+}
+
+func (s *kvServer) queueMergeLocked(job mergeJob) {
+	select {
+	case s.mergeJobs <- job:
+	default:
+		s.conflicts[resolvedMergeFailed]++
+		s.logf("merge queue full; keeping last-writer-wins result for %q", s.redact.key(job.Key))
+	}
+}
+
+// mergeLoop runs the merge hook for queued conflicts and writes the results.
+func (s *kvServer) mergeLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-s.mergeJobs:
+			err := s.mergeConflict(ctx, job)
+			s.mu.Lock()
+			if err != nil {
+				s.conflicts[resolvedMergeFailed]++
+				s.logf("merge hook for %q failed; keeping last-writer-wins result: %v", s.redact.key(job.Key), err)
+			} else {
+				s.conflicts[resolvedMerged]++
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *kvServer) mergeConflict(ctx context.Context, job mergeJob) error {
+	input, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, mergeHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, s.conflictPolicy.hook)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	s.mu.Lock()
+	got, ok := s.tree.Get(item{key: job.Key})
+	current := ok && maps.Equal(got.hvc, job.joined)
+	s.mu.Unlock()
+	if !current {
+		// A newer write superseded both versions while the hook ran.
+		return nil
+	}
+	submitCtx, cancel := context.WithTimeout(ctx, mergeHookTimeout)
+	defer cancel()
+	_, err = s.submitCommand(submitCtx, &kvpb.ClientCommand{
+		Wal: &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: job.Key, Value: strings.TrimSuffix(string(out), "\n")},
+	})
+	return err
+}
+
+func (s *kvServer) registerConflictMetrics(r *metricsRegistry) {
+	r.register("kv_mirror_conflicts_total", "Concurrent writes to the same key from both mirrored clusters, by which version last-writer-wins kept; merged and merge_failed count merge hook runs on the leader.", "counter", func() []metricSample {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		samples := make([]metricSample, 0, 4)
+		for _, res := range []string{resolvedIncoming, resolvedExisting, resolvedMerged, resolvedMergeFailed} {
+			samples = append(samples, metricSample{labels: map[string]string{"resolution": res}, value: float64(s.conflicts[res])})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// versionedWrite returns the write for key as it would be mirrored out.
+func versionedWrite(t *testing.T, s *kvServer, key string) *kvpb.WALCommand {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.tree.Get(item{key: key})
+	if !ok || it.hvc == nil {
+		t.Fatalf("%s has no version for %q", s.clusterID, key)
+	}
+	return &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: key, Value: it.value, Hvc: it.hvc, Origin: s.clusterID}
+}
+
+func TestConcurrentMirroredWritesConverge(t *testing.T) {
+	clusters := map[string]*kvServer{}
+	for _, id := range []string{"a", "b"} {
+		srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+		srv.clusterID = id
+		becomeTestLeader(t, srv, 1)
+		if _, err := srv.Put(context.Background(), &kvpb.PutRequest{Key: "k", Value: "from-" + id}); err != nil {
+			t.Fatalf("Put on %s failed: %v", id, err)
+		}
+		clusters[id] = srv
+	}
+	a, b := clusters["a"], clusters["b"]
+	fromA, fromB := versionedWrite(t, a, "k"), versionedWrite(t, b, "k")
+	if err := a.applyMirrorBatch(context.Background(), &kvpb.MirrorBatch{SourcePartitions: 1, SourceCluster: "b", Changes: []*kvpb.WALCommand{fromB}}); err != nil {
+		t.Fatalf("mirror b->a failed: %v", err)
+	}
+	if err := b.applyMirrorBatch(context.Background(), &kvpb.MirrorBatch{SourcePartitions: 1, SourceCluster: "a", Changes: []*kvpb.WALCommand{fromA}}); err != nil {
+		t.Fatalf("mirror a->b failed: %v", err)
+	}
+
+	gotA, _ := a.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	gotB, _ := b.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	if gotA.GetValue() != gotB.GetValue() {
+		t.Fatalf("clusters diverged: a=%q b=%q", gotA.GetValue(), gotB.GetValue())
+	}
+	for id, srv := range clusters {
+		srv.mu.Lock()
+		n := srv.conflicts[resolvedIncoming] + srv.conflicts[resolvedExisting]
+		srv.mu.Unlock()
+		if n != 1 {
+			t.Fatalf("%s counted %d conflicts, want 1", id, n)
+		}
+	}
+
+	// A write made after the conflict follows both versions and applies
+	// cleanly on the other side.
+	if _, err := a.Put(context.Background(), &kvpb.PutRequest{Key: "k", Value: "after"}); err != nil {
+		t.Fatalf("Put after conflict failed: %v", err)
+	}
+	if err := b.applyMirrorBatch(context.Background(), &kvpb.MirrorBatch{SourcePartitions: 1, SourceCluster: "a", Changes: []*kvpb.WALCommand{versionedWrite(t, a, "k")}}); err != nil {
+		t.Fatalf("mirror a->b failed: %v", err)
+	}
+	if got, _ := b.Get(context.Background(), &kvpb.GetRequest{Key: "k"}); got.GetValue() != "after" {
+		t.Fatalf("b has %q after a later write, want after", got.GetValue())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := b.conflicts[resolvedIncoming] + b.conflicts[resolvedExisting]; n != 1 {
+		t.Fatalf("b counted %d conflicts after a causal write, want 1", n)
+	}
+}
+
+func TestRestartedReplicaReplaysConflictResolution(t *testing.T) {
+	ctx := context.Background()
+	dirA := t.TempDir()
+	clusters := map[string]*kvServer{}
+	// b writes first, so a's later write wins on both sides.
+	for _, id := range []string{"b", "a"} {
+		dir := t.TempDir()
+		if id == "a" {
+			dir = dirA
+		}
+		srv := newTestServer(t, dir, 0, 0, 1, 1)
+		srv.clusterID = id
+		becomeTestLeader(t, srv, 1)
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "from-" + id}); err != nil {
+			t.Fatalf("Put on %s failed: %v", id, err)
+		}
+		clusters[id] = srv
+	}
+	a, b := clusters["a"], clusters["b"]
+	fromA, fromB := versionedWrite(t, a, "k"), versionedWrite(t, b, "k")
+	if err := a.applyMirrorBatch(ctx, &kvpb.MirrorBatch{SourcePartitions: 1, SourceCluster: "b", Changes: []*kvpb.WALCommand{fromB}}); err != nil {
+		t.Fatalf("mirror b->a failed: %v", err)
+	}
+	if err := b.applyMirrorBatch(ctx, &kvpb.MirrorBatch{SourcePartitions: 1, SourceCluster: "a", Changes: []*kvpb.WALCommand{fromA}}); err != nil {
+		t.Fatalf("mirror a->b failed: %v", err)
+	}
+
+	if err := a.db.Close(); err != nil {
+		t.Fatalf("close a's db: %v", err)
+	}
+	restarted, err := newKVServer(dirA, 0, 0, 1, 1, "127.0.0.1:0", nil, "a")
+	if err != nil {
+		t.Fatalf("restart a: %v", err)
+	}
+	defer restarted.db.Close()
+
+	restarted.mu.Lock()
+	got, _ := restarted.tree.Get(item{key: "k"})
+	restarted.mu.Unlock()
+	b.mu.Lock()
+	want, _ := b.tree.Get(item{key: "k"})
+	b.mu.Unlock()
+	if got.value != "from-a" || got.value != want.value {
+		t.Fatalf("restarted a has %q, b has %q; want both from-a", got.value, want.value)
+	}
+	if !maps.Equal(got.hvc, want.hvc) {
+		t.Fatalf("restarted a has version %v, b has %v", got.hvc, want.hvc)
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for raw, want := range map[string]conflictPolicy{
+		"":              {kind: conflictLWW},
+		"lww":           {kind: conflictLWW},
+		"merge:/bin/mh": {kind: conflictMerge, hook: "/bin/mh"},
+	} {
+		if got, err := parseConflictPolicy(raw); err != nil || got != want {
+			t.Fatalf("parseConflictPolicy(%q) = %v, %v; want %v", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"merge", "merge:", "newest"} {
+		if _, err := parseConflictPolicy(raw); err == nil {
+			t.Fatalf("parseConflictPolicy(%q) succeeded", raw)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Content types: a put or swap may tag its value with a media type, which
+// is stored with the value, returned by Get and carried by renames, soft
+// deletes and the change feed. The server does not interpret most types,
+// but a value tagged as JSON must be JSON, and the JSON operations refuse
+// values tagged as anything else.
+
+// jsonContentType is the tag a json-set gives a key it creates.
+const jsonContentType = "application/json"
+
+// normalizeContentType returns contentType in canonical form, lowercased
+// with its parameters sorted, or "" for "".
+func normalizeContentType(contentType string) (string, error) {
+	if contentType == "" {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// isJSONContentType reports whether contentType is JSON, such as
+// application/json or a +json type like application/ld+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return mediaType == jsonContentType || strings.HasSuffix(mediaType, "+json")
+}
+
+// checkContentType normalizes the content type of a put or swap of value,
+// refusing one that is malformed or that value does not match.
+func checkContentType(contentType, value string) (string, error) {
+	ct, err := normalizeContentType(contentType)
+	if err != nil {
+		return "", invalidFieldError("content_type", "invalid content type %q: %v", contentType, err)
+	}
+	if isJSONContentType(ct) {
+		if _, err := decodeJSON(value); err != nil {
+			return "", invalidFieldError("value", "value tagged %s is not JSON: %v", ct, err)
+		}
+	}
+	return ct, nil
+}
+
+// checkJSONApplies refuses a JSON operation on a value tagged as something
+// other than JSON. Untagged values are left to fail to decode if they are
+// not JSON.
+func checkJSONApplies(it item) error {
+	if it.contentType != "" && !isJSONContentType(it.contentType) {
+		return fmt.Errorf("value is tagged %s, not JSON", it.contentType)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestContentTypeIsStoredAndChecked(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	contentType := func(key string) string {
+		t.Helper()
+		got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: key})
+		if err != nil || !got.Found {
+			t.Fatalf("Get(%s) = %v, %v", key, got, err)
+		}
+		return got.ContentType
+	}
+
+	if _, err := srv.Put(call("put-doc"), &kvpb.PutRequest{Key: "doc", Value: `{"a":1}`, ContentType: "Application/JSON; Charset=utf-8"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := contentType("doc"); got != "application/json; charset=utf-8" {
+		t.Fatalf("content type = %q, want it normalized", got)
+	}
+	if _, err := srv.Rename(call("mv-doc"), &kvpb.RenameRequest{OldKey: "doc", NewKey: "doc2"}); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if got := contentType("doc2"); got != "application/json; charset=utf-8" {
+		t.Fatalf("content type after rename = %q, want it carried over", got)
+	}
+	if _, err := srv.Swap(call("swap-doc"), &kvpb.SwapRequest{Key: "doc2", Value: "raw"}); err != nil {
+		t.Fatalf("Swap failed: %v", err)
+	}
+	if got := contentType("doc2"); got != "" {
+		t.Fatalf("content type after an untagged swap = %q, want none", got)
+	}
+
+	if _, err := srv.Put(call("bad-json"), &kvpb.PutRequest{Key: "x", Value: "{", ContentType: "application/ld+json"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put of a value tagged JSON that is not: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.Put(call("bad-type"), &kvpb.PutRequest{Key: "x", Value: "v", ContentType: "not a type"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put with a malformed content type: err = %v, want InvalidArgument", err)
+	}
+
+	if _, err := srv.Put(call("put-pb"), &kvpb.PutRequest{Key: "pb", Value: "{}", ContentType: "application/x-protobuf"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.JSONSet(call("set-pb"), &kvpb.JSONSetRequest{Key: "pb", Path: "a", Value: "1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("JSONSet on a protobuf value: err = %v, want FailedPrecondition", err)
+	}
+	if _, err := srv.JSONGet(context.Background(), &kvpb.JSONGetRequest{Key: "pb"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("JSONGet on a protobuf value: err = %v, want FailedPrecondition", err)
+	}
+	if _, err := srv.JSONSet(call("set-new"), &kvpb.JSONSetRequest{Key: "new", Path: "a", Value: "1"}); err != nil {
+		t.Fatalf("JSONSet failed: %v", err)
+	}
+	if got := contentType("new"); got != jsonContentType {
+		t.Fatalf("content type of a key JSONSet created = %q, want %s", got, jsonContentType)
+	}
+}
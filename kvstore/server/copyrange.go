@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// maxCopyRangeBytes bounds the keys and values one CopyRange logs, so its
+// entry still fits in a single AppendEntries call.
+const maxCopyRangeBytes = maxAppendBytes
+
+// CopyRange copies the live keys in [StartKey, EndKey] to DstPrefix+key as
+// one OP_BATCH. The range is read from a clone of the tree taken under s.mu,
+// so the copy is of a single point in the log. Each destination key is
+// deleted before it is written: it then takes the source key's value type,
+// content type and TTL, and no type it held can refuse part of the batch.
+func (s *kvServer) CopyRange(ctx context.Context, req *kvpb.CopyRangeRequest) (*kvpb.CopyRangeReply, error) {
+	if s.clusterID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "copy range is not supported in a multi-writer cluster")
+	}
+	if s.numPartitions > 1 {
+		return nil, status.Errorf(codes.FailedPrecondition, "copy range needs a single-partition cluster: keys are hashed to partitions, so a range is spread over all %d", s.numPartitions)
+	}
+	if req.DstPrefix == "" {
+		return nil, invalidFieldError("dst_prefix", "dst_prefix is required")
+	}
+	if req.StartKey > req.EndKey {
+		return nil, invalidFieldError("end_key", "end_key %q sorts before start_key %q", s.redact.key(req.EndKey), s.redact.key(req.StartKey))
+	}
+	if err := s.checkRangeRead("copy range"); err != nil {
+		return nil, err
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if cached, ok := s.dedup[reqID]; ok && reqID != "" {
+		s.mu.Unlock()
+		// A retry is answered from the copy first logged: one built from
+		// a newer snapshot could carry other values.
+		if cached.op != kvpb.WALCommand_OP_BATCH {
+			return nil, status.Errorf(codes.AlreadyExists, "request id reused with different operation")
+		}
+		return &kvpb.CopyRangeReply{Keys: copiedKeys(cached), Seq: cached.seq}, cached.applyError(s.redact)
+	}
+	tree := s.tree.Clone()
+	s.mu.Unlock()
+
+	wal := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_BATCH}
+	size := 0
+	var failed error
+	tree.AscendGreaterOrEqual(item{key: req.StartKey}, func(it item) bool {
+		key := it.fullKey()
+		if key > req.EndKey {
+			return false
+		}
+		if it.tombstone {
+			return true
+		}
+		if failed = s.verifyValue(key, it); failed != nil {
+			return false
+		}
+		dst := req.DstPrefix + key
+		if failed = s.keyPolicy.check(dst); failed != nil {
+			return false
+		}
+		if size += len(dst) + len(it.value); size > maxCopyRangeBytes {
+			failed = status.Errorf(codes.FailedPrecondition, "the range holds more than the %d bytes one log entry may carry; copy it in smaller ranges", maxCopyRangeBytes)
+			return false
+		}
+		wal.Batch = append(wal.Batch,
+			&kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE, Key: dst},
+			&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: dst, Value: it.value, ValueType: it.vtype, ContentType: it.contentType, ValueCrc32C: it.checksum})
+		if it.deleteAt != 0 {
+			wal.Batch = append(wal.Batch, &kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE_AT, Key: dst, DeleteAt: it.deleteAt})
+		}
+		return true
+	})
+	if failed != nil {
+		return nil, failed
+	}
+	if len(wal.Batch) == 0 {
+		return &kvpb.CopyRangeReply{}, nil
+	}
+	wal.Key = wal.Batch[0].Key
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{RequestId: reqID, Wal: wal})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.CopyRangeReply{Keys: copiedKeys(cached), Seq: cached.seq}, nil
+}
+
+// copiedKeys counts the keys a CopyRange batch wrote.
+func copiedKeys(cached cachedMutation) uint64 {
+	var n uint64
+	for _, r := range cached.batch {
+		if r.op == kvpb.WALCommand_OP_PUT && !r.typeMismatch {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestCopyRangeCopiesMetadataInOneEntry(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	seed := []struct {
+		reqID string
+		req   *kvpb.PutRequest
+	}{
+		{"seed-a", &kvpb.PutRequest{Key: "src/a", Value: "5", ValueType: kvpb.ValueType_VALUE_TYPE_INT64}},
+		{"seed-b", &kvpb.PutRequest{Key: "src/b", Value: "x", ContentType: "text/plain"}},
+		{"seed-c", &kvpb.PutRequest{Key: "src/c", Value: "gone"}},
+		{"seed-dst", &kvpb.PutRequest{Key: "dst/src/a", Value: "7", ValueType: kvpb.ValueType_VALUE_TYPE_INT64}},
+		{"seed-dst-b", &kvpb.PutRequest{Key: "dst/src/b", Value: "12", ValueType: kvpb.ValueType_VALUE_TYPE_INT64}},
+	}
+	for _, p := range seed {
+		if _, err := srv.Put(withRequestID(p.reqID), p.req); err != nil {
+			t.Fatalf("Put(%s) failed: %v", p.req.Key, err)
+		}
+	}
+	if _, err := srv.Expire(withRequestID("ttl-b"), &kvpb.ExpireRequest{Key: "src/b", TtlMillis: 60_000}); err != nil {
+		t.Fatalf("Expire() failed: %v", err)
+	}
+	if _, err := srv.Delete(withRequestID("del-c"), &kvpb.DeleteRequest{Key: "src/c"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	srv.mu.Lock()
+	before := srv.commitIndex
+	srv.mu.Unlock()
+
+	req := &kvpb.CopyRangeRequest{StartKey: "src/", EndKey: "src/~", DstPrefix: "dst/"}
+	got, err := srv.CopyRange(withRequestID("copy"), req)
+	if err != nil {
+		t.Fatalf("CopyRange() failed: %v", err)
+	}
+	srv.mu.Lock()
+	after := srv.commitIndex
+	for _, key := range []string{"src/a", "src/b"} {
+		src, _ := srv.getLiveLocked(key)
+		dst, ok := srv.getLiveLocked("dst/" + key)
+		if !ok || dst.value != src.value || dst.vtype != src.vtype || dst.contentType != src.contentType || dst.deleteAt != src.deleteAt {
+			t.Errorf("dst/%s = %+v, want the value and metadata of %+v", key, dst, src)
+		}
+	}
+	if _, ok := srv.getLiveLocked("dst/src/c"); ok {
+		t.Errorf("deleted key src/c was copied")
+	}
+	srv.mu.Unlock()
+	if got.Keys != 2 || after != before+1 || got.Seq != after {
+		t.Fatalf("CopyRange() = %+v logging entries %d..%d, want 2 keys in one entry", got, before+1, after)
+	}
+
+	if _, err := srv.Put(withRequestID("change-a"), &kvpb.PutRequest{Key: "src/a", Value: "6"}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if retry, err := srv.CopyRange(withRequestID("copy"), req); err != nil || retry.Seq != got.Seq || retry.Keys != got.Keys {
+		t.Fatalf("retried CopyRange() = %+v, %v; want the first reply %+v", retry, err, got)
+	}
+}
+
+func TestCopyRangeRefusedAcrossPartitions(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 2)
+	becomeTestLeader(t, srv, 1)
+	_, err := srv.CopyRange(withRequestID("copy"), &kvpb.CopyRangeRequest{StartKey: "a", EndKey: "z", DstPrefix: "copy/"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("CopyRange() on a two-partition cluster: err = %v, want FailedPrecondition", err)
+	}
+	caps, err := srv.Capabilities(context.Background(), &kvpb.CapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Capabilities() failed: %v", err)
+	}
+	if slices.Contains(caps.Features, featureCopyRange) {
+		t.Fatalf("a two-partition server advertises %q", featureCopyRange)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/btree"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	// expireBatch caps how many scheduled deletions one tick submits.
+	expireBatch = 256
+
+	defaultScanExpiringLimit = 1000
+	maxScanExpiringLimit     = 10000
+)
+
+// deadline is an entry in the scheduled-deletion index, ordered by time and
+// then key.
+type deadline struct {
+	at  int64
+	key string
+}
+
+func (a deadline) Less(b btree.Item) bool {
+	o := b.(deadline)
+	if a.at != o.at {
+		return a.at < o.at
+	}
+	return a.key < o.key
+}
+
+// scheduleLocked sets the deletion time of the live item it.
+func (s *kvServer) scheduleLocked(it item, at int64) {
+	s.unscheduleLocked(it)
+	it.deleteAt = at
+	s.tree.ReplaceOrInsert(it)
+	s.deadlines.ReplaceOrInsert(deadline{at: at, key: it.fullKey()})
+}
+
+// unscheduleLocked drops it from the deadline index. The caller replaces or
+// deletes the item itself.
+func (s *kvServer) unscheduleLocked(it item) {
+	if it.deleteAt != 0 {
+		s.deadlines.Delete(deadline{at: it.deleteAt, key: it.fullKey()})
+	}
+}
+
+// dueDeletionsLocked returns up to limit scheduled deletions due by now,
+// earliest first.
+func (s *kvServer) dueDeletionsLocked(now int64, limit int) []deadline {
+	var due []deadline
+	s.deadlines.Ascend(func(i btree.Item) bool {
+		d := i.(deadline)
+		if d.at > now || len(due) >= limit {
+			return false
+		}
+		due = append(due, d)
+		return true
+	})
+	return due
+}
+
+func (s *kvServer) DeleteAt(ctx context.Context, req *kvpb.DeleteAtRequest) (*kvpb.DeleteAtReply, error) {
+	if req.UnixNanos <= 0 {
+		return nil, invalidFieldError("unix_nanos", "delete time must be a positive unix timestamp")
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE_AT, Key: req.Key, DeleteAt: req.UnixNanos},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.DeleteAtReply{Found: cached.found, Seq: cached.seq}, nil
+}
+
+func (s *kvServer) Expire(ctx context.Context, req *kvpb.ExpireRequest) (*kvpb.ExpireReply, error) {
+	if req.TtlMillis <= 0 {
+		return nil, invalidFieldError("ttl_millis", "ttl must be positive")
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE_AT, Key: req.Key, TtlNanos: req.TtlMillis * int64(time.Millisecond)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.ExpireReply{Found: cached.found, Seq: cached.seq}, nil
+}
+
+func (s *kvServer) Persist(ctx context.Context, req *kvpb.PersistRequest) (*kvpb.PersistReply, error) {
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PERSIST, Key: req.Key},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.PersistReply{Found: cached.found, Seq: cached.seq}, nil
+}
+
+func (s *kvServer) TTL(ctx context.Context, req *kvpb.TTLRequest) (*kvpb.TTLReply, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateKeyOwner(req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	it, found := s.getLiveLocked(req.Key)
+	if !found {
+		return &kvpb.TTLReply{Found: false}, nil
+	}
+	reply := &kvpb.TTLReply{Found: true, DeleteAt: it.deleteAt}
+	if remaining := time.Until(time.Unix(0, it.deleteAt)); it.deleteAt != 0 && remaining > 0 {
+		reply.RemainingMillis = remaining.Milliseconds()
+	}
+	return reply, nil
+}
+
+// ScanExpiring previews the deadline index: the keys the expiry sweep will
+// remove within the requested window.
+func (s *kvServer) ScanExpiring(ctx context.Context, req *kvpb.ScanExpiringRequest) (*kvpb.ScanExpiringReply, error) {
+	if req.WithinMillis < 0 {
+		return nil, invalidFieldError("within_millis", "within_millis must not be negative")
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultScanExpiringLimit
+	}
+	limit = min(limit, maxScanExpiringLimit)
+
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	horizon := time.Now().Add(time.Duration(req.WithinMillis) * time.Millisecond).UnixNano()
+	due := s.dueDeletionsLocked(horizon, limit+1)
+	reply := &kvpb.ScanExpiringReply{Truncated: len(due) > limit}
+	if reply.Truncated {
+		due = due[:limit]
+	}
+	reply.Keys = make([]*kvpb.ExpiringKey, 0, len(due))
+	for _, d := range due {
+		reply.Keys = append(reply.Keys, &kvpb.ExpiringKey{Key: d.key, DeleteAt: d.at})
+	}
+	return reply, nil
+}
+
+// expireDue has the leader log an OP_EXPIRE for each due deletion. The
+// schedule is part of the replicated state, so a new leader or a restarted
+// server picks up whatever was still pending.
+func (s *kvServer) expireDue(ctx context.Context, timeout time.Duration) {
+	s.mu.Lock()
+	if s.role != roleLeader {
+		s.mu.Unlock()
+		return
+	}
+	due := s.dueDeletionsLocked(time.Now().UnixNano(), expireBatch)
+	s.mu.Unlock()
+
+	for _, d := range due {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		_, err := s.submitCommand(callCtx, &kvpb.ClientCommand{
+			Wal: &kvpb.WALCommand{Op: kvpb.WALCommand_OP_EXPIRE, Key: d.key, DeleteAt: d.at},
+		})
+		cancel()
+		if err != nil {
+			s.mu.Lock()
+			s.logf("scheduled delete of %q failed: %v", s.redact.key(d.key), err)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *kvServer) deleteAtLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expireDue(ctx, 5*interval)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestDeleteAtRunsAfterRestartAndOverwriteCancels(t *testing.T) {
+	backerDir := t.TempDir()
+	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+
+	for _, key := range []string{"doomed", "rewritten"} {
+		if _, err := srv.Put(withRequestID("put-"+key), &kvpb.PutRequest{Key: key, Value: "v"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	when := time.Now().Add(300 * time.Millisecond).UnixNano()
+	for _, key := range []string{"doomed", "rewritten", "missing"} {
+		resp, err := srv.DeleteAt(withRequestID("at-"+key), &kvpb.DeleteAtRequest{Key: key, UnixNanos: when})
+		if err != nil {
+			t.Fatalf("DeleteAt(%s) failed: %v", key, err)
+		}
+		if resp.Found != (key != "missing") {
+			t.Fatalf("DeleteAt(%s).Found = %v", key, resp.Found)
+		}
+	}
+	if _, err := srv.Put(withRequestID("put-again"), &kvpb.PutRequest{Key: "rewritten", Value: "v2"}); err != nil {
+		t.Fatalf("overwrite failed: %v", err)
+	}
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+
+	reloaded := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, reloaded, 2)
+	reloaded.mu.Lock()
+	pending := reloaded.deadlines.Len()
+	reloaded.mu.Unlock()
+	if pending != 1 {
+		t.Fatalf("pending scheduled deletes after restart = %d, want 1", pending)
+	}
+
+	reloaded.expireDue(context.Background(), time.Second)
+	if got, _ := reloaded.Get(context.Background(), &kvpb.GetRequest{Key: "doomed"}); !got.Found {
+		t.Fatalf("key deleted before its scheduled time")
+	}
+	time.Sleep(time.Until(time.Unix(0, when)))
+	reloaded.expireDue(context.Background(), time.Second)
+	for key, want := range map[string]bool{"doomed": false, "rewritten": true} {
+		got, err := reloaded.Get(context.Background(), &kvpb.GetRequest{Key: key})
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", key, err)
+		}
+		if got.Found != want {
+			t.Fatalf("Get(%s).Found = %v, want %v", key, got.Found, want)
+		}
+	}
+}
+
+func TestExpirePersistAndTTL(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("put"), &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	expired, err := srv.Expire(withRequestID("expire"), &kvpb.ExpireRequest{Key: "k", TtlMillis: 60_000})
+	if err != nil || !expired.Found {
+		t.Fatalf("Expire() = %+v, %v; want found", expired, err)
+	}
+	retried, err := srv.Expire(withRequestID("expire"), &kvpb.ExpireRequest{Key: "k", TtlMillis: 60_000})
+	if err != nil || retried.Seq != expired.Seq {
+		t.Fatalf("retried Expire() = %+v, %v; want seq %d", retried, err, expired.Seq)
+	}
+	ttl, err := srv.TTL(context.Background(), &kvpb.TTLRequest{Key: "k"})
+	if err != nil || !ttl.Found || ttl.RemainingMillis <= 59_000 || ttl.RemainingMillis > 60_000 {
+		t.Fatalf("TTL() = %+v, %v; want about 60s remaining", ttl, err)
+	}
+
+	persisted, err := srv.Persist(withRequestID("persist"), &kvpb.PersistRequest{Key: "k"})
+	if err != nil || !persisted.Found {
+		t.Fatalf("Persist() = %+v, %v; want found", persisted, err)
+	}
+	again, err := srv.Persist(withRequestID("persist-again"), &kvpb.PersistRequest{Key: "k"})
+	if err != nil || again.Found {
+		t.Fatalf("second Persist() = %+v, %v; want not found", again, err)
+	}
+	ttl, err = srv.TTL(context.Background(), &kvpb.TTLRequest{Key: "k"})
+	if err != nil || !ttl.Found || ttl.DeleteAt != 0 {
+		t.Fatalf("TTL() after Persist = %+v, %v; want no deadline", ttl, err)
+	}
+	srv.mu.Lock()
+	pending := srv.deadlines.Len()
+	srv.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("pending scheduled deletes = %d, want 0", pending)
+	}
+}
+
+func TestScanExpiringListsKeysInDeadlineOrder(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	for i, ttl := range map[string]int64{"soon": 1_000, "later": 10_000, "much-later": 100_000, "never": 0} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-"+i))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: i, Value: "v"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", i, err)
+		}
+		if ttl == 0 {
+			continue
+		}
+		ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "expire-"+i))
+		if _, err := srv.Expire(ctx, &kvpb.ExpireRequest{Key: i, TtlMillis: ttl}); err != nil {
+			t.Fatalf("Expire(%s) failed: %v", i, err)
+		}
+	}
+
+	resp, err := srv.ScanExpiring(context.Background(), &kvpb.ScanExpiringRequest{WithinMillis: 60_000})
+	if err != nil {
+		t.Fatalf("ScanExpiring() failed: %v", err)
+	}
+	if len(resp.Keys) != 2 || resp.Keys[0].Key != "soon" || resp.Keys[1].Key != "later" || resp.Truncated {
+		t.Fatalf("ScanExpiring(60s) = %v, want [soon later]", resp)
+	}
+	resp, err = srv.ScanExpiring(context.Background(), &kvpb.ScanExpiringRequest{WithinMillis: 1_000_000, Limit: 2})
+	if err != nil {
+		t.Fatalf("ScanExpiring() failed: %v", err)
+	}
+	if len(resp.Keys) != 2 || !resp.Truncated {
+		t.Fatalf("ScanExpiring(limit 2) = %v, want 2 keys and truncated", resp)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFileName is held with flock by the server using a data directory.
+const lockFileName = "LOCK"
+
+// dirLock keeps another server process from opening the same data directory
+// and appending to its raft log alongside this one. The kernel drops the
+// lock when the process exits, however it exits, so a stale LOCK file left
+// by a crash does not block a restart.
+type dirLock struct {
+	f *os.File
+}
+
+// lockDataDir takes dir's lock and records this process's PID in it. If
+// another process holds the lock, the error names that process's PID.
+func lockDataDir(dir string) (*dirLock, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		owner := "another process"
+		if raw, err := os.ReadFile(path); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(raw))); err == nil {
+				owner = fmt.Sprintf("pid %d", pid)
+			}
+		}
+		return nil, fmt.Errorf("data directory %s is in use by %s (it holds %s); is another server already running on it?", dir, owner, path)
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		// The lock is what matters; the PID only improves the message.
+		log.Printf("record pid in %s failed: %v", path, err)
+	}
+	return &dirLock{f: f}, nil
+}
+
+// release drops the lock. A binary upgrade calls it before starting the new
+// server so the new one can take the lock.
+func (l *dirLock) release() {
+	if l == nil {
+		return
+	}
+	_ = syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	_ = l.f.Close()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDataDirLockNamesOwner(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatalf("first lock failed: %v", err)
+	}
+	_, err = lockDataDir(dir)
+	if want := fmt.Sprintf("in use by pid %d", os.Getpid()); err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("second lock: err = %v, want one containing %q", err, want)
+	}
+	lock.release()
+	again, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatalf("lock after release failed: %v", err)
+	}
+	again.release()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// drainState tracks a maintenance drain; see Admin.Drain in admin.proto.
+type drainState struct {
+	// started turns away new connections and keeps the replica out of
+	// elections; refusing, set once leadership is handed off, turns away
+	// new client requests.
+	started, refusing atomic.Bool
+	// inflight counts the client requests being served.
+	inflight atomic.Int64
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err []string
+}
+
+func newDrainState() *drainState {
+	return &drainState{done: make(chan struct{})}
+}
+
+func (d *drainState) fail(format string, args ...any) {
+	log.Printf("drain: "+format, args...)
+	d.mu.Lock()
+	d.err = append(d.err, fmt.Sprintf(format, args...))
+	d.mu.Unlock()
+}
+
+func (d *drainState) finished() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainingError turns a client request away from a draining replica. It
+// is Unavailable, so clients move on to the partition's other replicas.
+func drainingError() error {
+	return status.Error(codes.Unavailable, "replica is draining for maintenance")
+}
+
+// unaryInterceptor counts client requests and refuses new ones once the
+// drain has handed off leadership. Admin calls, including Drain itself,
+// are never refused.
+func (d *drainState) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	// Count the request before checking, so a drain that has seen no
+	// requests in flight cannot miss one that is just starting.
+	d.inflight.Add(1)
+	defer d.inflight.Add(-1)
+	if d.refusing.Load() {
+		return nil, drainingError()
+	}
+	return handler(ctx, req)
+}
+
+func (d *drainState) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if d.refusing.Load() && strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return drainingError()
+	}
+	return handler(srv, ss)
+}
+
+// drainListener closes connections that arrive once a drain has started,
+// while those already open carry on.
+type drainListener struct {
+	net.Listener
+	drain *drainState
+}
+
+func (l drainListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !l.drain.started.Load() {
+			return conn, err
+		}
+		_ = conn.Close()
+	}
+}
+
+func (a *adminServer) Drain(ctx context.Context, req *kvpb.DrainRequest) (*kvpb.DrainReply, error) {
+	s := a.kv
+	if s.drain.started.CompareAndSwap(false, true) {
+		go a.runDrain()
+	}
+	if req.WaitMillis > 0 {
+		timer := time.NewTimer(time.Duration(req.WaitMillis) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-s.drain.done:
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	s.mu.Lock()
+	role := s.role
+	s.mu.Unlock()
+	s.drain.mu.Lock()
+	errs := strings.Join(s.drain.err, "; ")
+	s.drain.mu.Unlock()
+	return &kvpb.DrainReply{
+		SafeToStop: s.drain.finished(),
+		InFlight:   s.drain.inflight.Load(),
+		Role:       role,
+		Error:      errs,
+	}, nil
+}
+
+// runDrain carries out the drain steps in order; a step that fails is
+// reported and the drain carries on.
+func (a *adminServer) runDrain() {
+	s := a.kv
+	log.Printf("drain: started; failing health checks and refusing new connections")
+	if s.health != nil {
+		s.health.SetServingStatus(kvpb.KVS_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+		s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	if err := sdNotify("STATUS=draining"); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+
+	s.mu.Lock()
+	target := -1
+	if s.role == roleLeader {
+		target = s.drainTargetLocked()
+	}
+	s.mu.Unlock()
+	if target >= 0 {
+		log.Printf("drain: handing leadership to replica %d", target)
+		if _, err := a.TransferLeadership(context.Background(), &kvpb.TransferLeadershipRequest{TargetReplicaId: uint32(target)}); err != nil {
+			s.drain.fail("leadership handoff to replica %d failed: %v", target, err)
+		}
+	}
+
+	s.drain.refusing.Store(true)
+	s.watchers.closeAll(drainingError())
+	poll := time.NewTicker(20 * time.Millisecond)
+	for s.drain.inflight.Load() > 0 {
+		<-poll.C
+	}
+	poll.Stop()
+
+	// Acknowledged writes are already synced; the checkpoint folds the
+	// sqlite WAL into the database so the next start does not replay it.
+	if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		s.drain.fail("checkpoint of the raft log database failed: %v", err)
+	}
+	log.Printf("drain: finished; safe to stop")
+	if err := sdNotify("STATUS=drained; safe to stop"); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+	close(s.drain.done)
+}
+
+// drainTargetLocked picks the voter with the most of the log to take over
+// from a draining leader, or -1 if there is none.
+func (s *kvServer) drainTargetLocked() int {
+	target := -1
+	for id := range s.peerP2PAddrs {
+		if s.memberType(id) != memberVoter {
+			continue
+		}
+		if target < 0 || s.matchIndex[id] > s.matchIndex[target] {
+			target = id
+		}
+	}
+	return target
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestDrainRefusesNewRequestsAndFinishes(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	admin := &adminServer{kv: srv}
+	ctx := context.Background()
+	put := func() error {
+		info := &grpc.UnaryServerInfo{FullMethod: "/" + kvpb.KVS_ServiceDesc.ServiceName + "/Put"}
+		_, err := srv.drain.unaryInterceptor(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.Put(ctx, req.(*kvpb.PutRequest))
+		})
+		return err
+	}
+	if err := put(); err != nil {
+		t.Fatalf("Put before the drain failed: %v", err)
+	}
+
+	reply, err := admin.Drain(ctx, &kvpb.DrainRequest{WaitMillis: 5000})
+	if err != nil || !reply.SafeToStop || reply.InFlight != 0 {
+		t.Fatalf("Drain = %v, %v; want safe to stop with nothing in flight", reply, err)
+	}
+	if err := put(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Put after the drain = %v, want Unavailable", err)
+	}
+	srv.mu.Lock()
+	canLead := srv.canLead()
+	srv.mu.Unlock()
+	if canLead {
+		t.Fatalf("a drained replica may still stand for election")
+	}
+	// Asking again reports the finished drain.
+	if reply, err := admin.Drain(ctx, &kvpb.DrainRequest{}); err != nil || !reply.SafeToStop {
+		t.Fatalf("second Drain = %v, %v; want safe to stop", reply, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// durabilityMetadataKey carries a write's durability level. Writes without
+// it use quorum.
+const durabilityMetadataKey = "x-durability"
+
+// Durability levels choose when the leader acknowledges a write.
+const (
+	// durabilityLocal acknowledges once the entry is in the leader's own
+	// durable log. The write is lost if the leader fails before a quorum
+	// stores it, and a read that follows at once may not see it yet.
+	// found and old_value in the reply come from the leader's applied state,
+	// so they do not account for writes to the same key still in flight.
+	// Only put, swap and delete can be acknowledged this early; other
+	// writes fall back to quorum.
+	durabilityLocal = "local"
+	// durabilityQuorum acknowledges once the entry is committed and applied.
+	durabilityQuorum = "quorum"
+	// durabilityAll also waits until every replica, learners and witnesses
+	// included, has stored the entry.
+	durabilityAll = "all"
+)
+
+func durabilityFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return durabilityQuorum, nil
+	}
+	values := md.Get(durabilityMetadataKey)
+	if len(values) == 0 {
+		return durabilityQuorum, nil
+	}
+	switch level := strings.ToLower(strings.TrimSpace(values[0])); level {
+	case "":
+		return durabilityQuorum, nil
+	case durabilityLocal, durabilityQuorum, durabilityAll:
+		return level, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "unknown durability level %q (want %s, %s or %s)", level, durabilityLocal, durabilityQuorum, durabilityAll)
+	}
+}
+
+// localResultLocked returns the reply for a write acknowledged before it is
+// applied, or false if wal's reply cannot be known until then.
+func (s *kvServer) localResultLocked(wal *kvpb.WALCommand) (cachedMutation, bool) {
+	prev, found := s.getLiveLocked(wal.Key)
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_DELETE:
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found}, true
+	case kvpb.WALCommand_OP_SWAP:
+		if !found {
+			return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value}, true
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: true, oldValue: prev.value, hasOldValue: true}, true
+	}
+	return cachedMutation{}, false
+}
+
+// waitAllReplicas returns once every peer has stored the log through index.
+func (s *kvServer) waitAllReplicas(ctx context.Context, index uint64) error {
+	for {
+		s.mu.Lock()
+		if s.role != roleLeader {
+			addr := s.leaderAddr
+			s.mu.Unlock()
+			return notLeaderError(addr)
+		}
+		behind := 0
+		for _, peerID := range s.peerReplicaIDs {
+			if s.matchIndex[peerID] < index {
+				behind++
+			}
+		}
+		if behind == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		acked := s.ackSignal
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded, "write committed at seq %d but %d replicas have not stored it yet", index, behind)
+		case <-acked:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func durabilityContext(reqID, level string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID, durabilityMetadataKey, level))
+}
+
+func TestDurabilityLevels(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	becomeTestLeader(t, srv, 1)
+	stalled := &mockRaftPeerClient{
+		appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	srv.mu.Lock()
+	srv.peerClients[1] = stalled
+	srv.peerClients[2] = stalled
+	srv.mu.Unlock()
+
+	// With no follower answering, only a local write is acknowledged.
+	resp, err := srv.Put(durabilityContext("req-1", "local"), &kvpb.PutRequest{Key: "k", Value: "v1"})
+	if err != nil || resp.Seq == 0 {
+		t.Fatalf("local Put = %v, %v; want an acknowledged seq", resp, err)
+	}
+	ctx, cancel := context.WithTimeout(durabilityContext("req-2", "quorum"), 200*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v2"}); err == nil {
+		t.Fatalf("quorum Put succeeded without a follower")
+	}
+
+	// One follower catches up: quorum writes commit, all-replica writes
+	// still wait for the other.
+	srv.mu.Lock()
+	srv.peerClients[1] = &mockRaftPeerClient{}
+	srv.mu.Unlock()
+	ctx, cancel = context.WithTimeout(durabilityContext("req-3", "quorum"), 2*time.Second)
+	defer cancel()
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v3"}); err != nil {
+		t.Fatalf("quorum Put failed: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(durabilityContext("req-4", "all"), 300*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v4"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("all Put = %v, want DeadlineExceeded with a replica behind", err)
+	}
+
+	if _, err := srv.Put(durabilityContext("req-5", "fast"), &kvpb.PutRequest{Key: "k", Value: "v5"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put with unknown level = %v, want InvalidArgument", err)
+	}
+}
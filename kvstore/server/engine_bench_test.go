@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// The engine benchmarks drive a single-replica partition's storage path
+// directly, with no gRPC in between: writes go through the Raft log in
+// sqlite and are applied to the B-tree, reads come from the B-tree. Every
+// combination of key size, value size and operation mix is a sub-benchmark,
+// so runs are comparable with benchstat, e.g.
+//
+//	go test ./server -run '^$' -bench Engine -count 5 > before.txt
+//
+// cmd/kvbench-engine runs the same workloads outside go test, with key
+// sizes, value sizes and mixes set by flags, and reports per engine.
+
+// engineMix is a share of reads, with the rest split between puts and
+// deletes.
+type engineMix struct {
+	name    string
+	reads   float64
+	deletes float64
+}
+
+var engineMixes = []engineMix{
+	{name: "write", reads: 0},
+	{name: "update", reads: 0.5},
+	{name: "read", reads: 0.95},
+	{name: "churn", reads: 0.5, deletes: 0.25},
+}
+
+const engineBenchKeys = 2000
+
+func BenchmarkEngine(b *testing.B) {
+	for _, keySize := range []int{16, 128} {
+		for _, valueSize := range []int{100, 4096} {
+			for _, mix := range engineMixes {
+				b.Run(fmt.Sprintf("key=%d/value=%d/mix=%s", keySize, valueSize, mix.name), func(b *testing.B) {
+					benchmarkEngine(b, keySize, valueSize, mix)
+				})
+			}
+		}
+	}
+}
+
+// quietLogs keeps server logging out of benchmark output.
+func quietLogs(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func benchmarkEngine(b *testing.B, keySize, valueSize int, mix engineMix) {
+	quietLogs(b)
+	srv := newTestServer(b, b.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(b, srv, 1)
+	ctx := context.Background()
+	keys := make([]string, engineBenchKeys)
+	for i := range keys {
+		id := fmt.Sprintf("k%d-", i)
+		keys[i] = id + strings.Repeat("x", max(keySize-len(id), 0))
+	}
+	value := strings.Repeat("v", valueSize)
+	write := func(op kvpb.WALCommand_Op, key string) {
+		if _, err := srv.submitCommand(ctx, &kvpb.ClientCommand{Wal: &kvpb.WALCommand{Op: op, Key: key, Value: value}}); err != nil {
+			b.Fatalf("%s %q: %v", op, key, err)
+		}
+	}
+	for _, key := range keys {
+		write(kvpb.WALCommand_OP_PUT, key)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	b.SetBytes(int64(keySize + valueSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[rng.Intn(len(keys))]
+		switch r := rng.Float64(); {
+		case r < mix.reads:
+			srv.mu.Lock()
+			srv.getLiveLocked(key)
+			srv.mu.Unlock()
+		case r < mix.reads+mix.deletes:
+			write(kvpb.WALCommand_OP_DELETE, key)
+		default:
+			write(kvpb.WALCommand_OP_PUT, key)
+		}
+	}
+}
+
+// getAllocs is what a Get on the leader may allocate: the reply alone.
+const getAllocs = 1
+
+func newGetBenchServer(tb testing.TB) *kvServer {
+	srv := newTestServer(tb, tb.TempDir(), 1, 0, 1, 3)
+	becomeTestLeader(tb, srv, 1)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if ownerForKey(key, 3) == 1 {
+			srv.mu.Lock()
+			srv.putLocked(key, "value", 0)
+			srv.mu.Unlock()
+		}
+	}
+	return srv
+}
+
+func TestGetDoesNotAllocateBeyondReply(t *testing.T) {
+	srv := newGetBenchServer(t)
+	req := &kvpb.GetRequest{Key: "b"}
+	if ownerForKey(req.Key, 3) != 1 {
+		t.Fatalf("test key %q is not owned by partition 1", req.Key)
+	}
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := srv.Get(ctx, req); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	})
+	if allocs > getAllocs {
+		t.Fatalf("Get allocated %.1f times per call, want at most %d", allocs, getAllocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		srv.mu.Lock()
+		srv.getLiveLocked(req.Key)
+		srv.mu.Unlock()
+	}); allocs != 0 {
+		t.Fatalf("index lookup allocated %.1f times per call, want 0", allocs)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	quietLogs(b)
+	srv := newGetBenchServer(b)
+	req := &kvpb.GetRequest{Key: "b"}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := srv.Get(ctx, req); err != nil {
+			b.Fatalf("Get failed: %v", err)
+		}
+	}
+}
+
+// The client routes with hash/fnv, so the inline hash must match it.
+func TestOwnerForKeyMatchesFNV(t *testing.T) {
+	for _, key := range []string{"", "a", "user:42", strings.Repeat("z", 300)} {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		if got, want := ownerForKey(key, 7), int(h.Sum32()%7); got != want {
+			t.Fatalf("ownerForKey(%q, 7) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func BenchmarkPersistLogEntry(b *testing.B) {
+	quietLogs(b)
+	srv := newTestServer(b, b.TempDir(), 0, 0, 1, 1)
+	entry := &kvpb.RaftLogEntry{Term: 1, Command: &kvpb.ClientCommand{
+		RequestId: "bench-1",
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "key", Value: strings.Repeat("v", 1024)},
+	}}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.Index = uint64(i%64 + 1)
+		if err := srv.persistLogEntryLocked(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	quietLogs(b)
+	srv := newTestServer(b, b.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(b, srv, 1)
+	srv.mu.Lock()
+	for i := 0; i < 1000; i++ {
+		srv.putLocked(fmt.Sprintf("k%04d", i), "value", 0)
+	}
+	srv.mu.Unlock()
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Distinct ranges keep the scan cache from answering.
+		start := fmt.Sprintf("k%04d", i%500)
+		if _, err := srv.Scan(ctx, &kvpb.ScanRequest{StartKey: start, EndKey: "k9999"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
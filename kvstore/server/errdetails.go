@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Errors that a client can act on carry google.rpc error details next to
+// their message, so clients branch on those rather than on the wording:
+// an ErrorInfo reason in errorDomain for conditions such as a stale leader
+// or partition map, RetryInfo when waiting and retrying is expected to
+// work, BadRequest naming the offending request field, and QuotaFailure
+// naming the exhausted quota.
+const errorDomain = "kvstore.madkv"
+
+// ErrorInfo reasons.
+const (
+	reasonNotLeader           = "NOT_LEADER"
+	reasonWrongPartition      = "WRONG_PARTITION"
+	reasonMirrorStandby       = "MIRROR_STANDBY"
+	reasonScanSnapshotLost    = "SCAN_SNAPSHOT_LOST"
+	reasonWatchStartCompacted = "WATCH_START_COMPACTED"
+	reasonWatchLagged         = "WATCH_LAGGED"
+	reasonTypeMismatch        = "VALUE_TYPE_MISMATCH"
+	reasonMergeRefused        = "MERGE_REFUSED"
+	reasonPolicyDenied        = "POLICY_DENIED"
+	reasonWriteOnce           = "WRITE_ONCE"
+	reasonChecksumMismatch    = "CHECKSUM_MISMATCH"
+	reasonTimedOut            = "TIMED_OUT"
+)
+
+// leaderChangeRetryDelay is the wait suggested while a partition has no
+// leader able to serve: a heartbeat is long enough for a new leader to
+// announce itself or a fresh one to finish catching up.
+const leaderChangeRetryDelay = heartbeatInterval
+
+// errorWithDetails builds a status error carrying details. Details that
+// fail to encode are left off rather than losing the error itself.
+func errorWithDetails(code codes.Code, msg string, details ...protoadapt.MessageV1) error {
+	st := status.New(code, msg)
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// reasonError fails with an ErrorInfo carrying reason and metadata.
+func reasonError(code codes.Code, reason string, metadata map[string]string, format string, args ...any) error {
+	return errorWithDetails(code, fmt.Sprintf(format, args...),
+		&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain, Metadata: metadata})
+}
+
+// retryableError fails with a RetryInfo asking the client to retry after
+// delay.
+func retryableError(code codes.Code, delay time.Duration, format string, args ...any) error {
+	return errorWithDetails(code, fmt.Sprintf(format, args...),
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+}
+
+// invalidFieldError fails with InvalidArgument and a BadRequest naming
+// field, which uses the proto field name.
+func invalidFieldError(field, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return errorWithDetails(codes.InvalidArgument, msg, &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: field, Description: msg}},
+	})
+}
+
+// quotaError fails with ResourceExhausted and a QuotaFailure for subject.
+func quotaError(subject, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return errorWithDetails(codes.ResourceExhausted, msg, &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{Subject: subject, Description: msg}},
+	})
+}
+
+// errorReason returns the ErrorInfo reason err carries, if any.
+func errorReason(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
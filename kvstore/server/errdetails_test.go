@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorsCarryDetails(t *testing.T) {
+	details := func(err error) []any {
+		t.Helper()
+		st, ok := status.FromError(err)
+		if !ok {
+			t.Fatalf("%v is not a status error", err)
+		}
+		return st.Details()
+	}
+
+	err := notLeaderError("127.0.0.1:13778")
+	if errorReason(err) != reasonNotLeader || status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("notLeaderError = %v, want FailedPrecondition with reason %s", err, reasonNotLeader)
+	}
+	if info := details(err)[0].(*errdetails.ErrorInfo); info.Metadata["leader_addr"] != "127.0.0.1:13778" {
+		t.Fatalf("leader_addr = %q", info.Metadata["leader_addr"])
+	}
+
+	var p *keyPolicy
+	d := details(p.check(reservedKeyPrefix + "x"))
+	if br, ok := d[0].(*errdetails.BadRequest); !ok || br.FieldViolations[0].Field != "key" {
+		t.Fatalf("reserved key details = %v, want a BadRequest on key", d)
+	}
+
+	d = details(quotaError("namespace:tenant", "namespace %q is at its quota of %d keys", "tenant", 1))
+	if qf, ok := d[0].(*errdetails.QuotaFailure); !ok || qf.Violations[0].Subject != "namespace:tenant" {
+		t.Fatalf("quota details = %v, want a QuotaFailure for namespace:tenant", d)
+	}
+
+	d = details(retryableError(codes.Unavailable, leaderChangeRetryDelay, "leader not ready for reads"))
+	if ri, ok := d[0].(*errdetails.RetryInfo); !ok || ri.RetryDelay.AsDuration() != 150*time.Millisecond {
+		t.Fatalf("retry details = %v, want a RetryInfo of 150ms", d)
+	}
+}
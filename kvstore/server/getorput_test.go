@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestGetOrPutInstallsOnlyOnce(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+
+	first, err := srv.GetOrPut(call("first"), &kvpb.GetOrPutRequest{Key: "k", Value: "default"})
+	if err != nil || first.Found || first.Value != "default" || first.Seq == 0 {
+		t.Fatalf("GetOrPut of a missing key = %v, %v; want the default installed", first, err)
+	}
+	if retry, err := srv.GetOrPut(call("first"), &kvpb.GetOrPutRequest{Key: "k", Value: "default"}); err != nil || retry.Found || retry.Seq != first.Seq {
+		t.Fatalf("retried GetOrPut = %v, %v; want the first reply %v", retry, err, first)
+	}
+
+	srv.mu.Lock()
+	before := srv.commitIndex
+	srv.mu.Unlock()
+	second, err := srv.GetOrPut(call("second"), &kvpb.GetOrPutRequest{Key: "k", Value: "other"})
+	if err != nil || !second.Found || second.Value != "default" || second.Seq != 0 {
+		t.Fatalf("GetOrPut of a live key = %v, %v; want its value, unlogged", second, err)
+	}
+	srv.mu.Lock()
+	after := srv.commitIndex
+	srv.mu.Unlock()
+	if after != before {
+		t.Fatalf("GetOrPut of a live key logged %d entries, want none", after-before)
+	}
+
+	// Applied on its own, as a follower would, a get-or-put that finds a
+	// value leaves it alone.
+	srv.mu.Lock()
+	res := srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_GET_OR_PUT, Key: "k", Value: "late"}, after+1)
+	kept, _ := srv.getLiveLocked("k")
+	srv.mu.Unlock()
+	if !res.found || kept.value != "default" {
+		t.Fatalf("applying a get-or-put over a live key: found=%v value=%q, want found and %q kept", res.found, kept.value, "default")
+	}
+	if events := watchEvents(after+1, &kvpb.WALCommand{Op: kvpb.WALCommand_OP_GET_OR_PUT, Key: "k", Value: "late"}, res); len(events) != 0 {
+		t.Fatalf("watch events for a get-or-put that found a value = %v, want none", events)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+type fakeIngestStream struct {
+	grpc.ServerStream
+	batches []*kvpb.IngestBatch
+	reply   *kvpb.IngestReply
+}
+
+func (f *fakeIngestStream) Context() context.Context { return context.Background() }
+
+func (f *fakeIngestStream) Recv() (*kvpb.IngestBatch, error) {
+	if len(f.batches) == 0 {
+		return nil, io.EOF
+	}
+	b := f.batches[0]
+	f.batches = f.batches[1:]
+	return b, nil
+}
+
+func (f *fakeIngestStream) SendAndClose(reply *kvpb.IngestReply) error {
+	f.reply = reply
+	return nil
+}
+
+func TestIngestLogsOneEntryPerChunk(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.mu.Lock()
+	before := srv.lastLogIndexLocked()
+	srv.mu.Unlock()
+
+	value := strings.Repeat("x", 1000)
+	stream := &fakeIngestStream{}
+	for b := 0; b < 20; b++ {
+		batch := &kvpb.IngestBatch{}
+		for i := 0; i < 100; i++ {
+			batch.Pairs = append(batch.Pairs, &kvpb.KVPair{Key: fmt.Sprintf("k%02d%03d", b, i), Value: value})
+		}
+		stream.batches = append(stream.batches, batch)
+	}
+	if err := srv.Ingest(stream); err != nil {
+		t.Fatalf("Ingest() failed: %v", err)
+	}
+	srv.mu.Lock()
+	logged := srv.lastLogIndexLocked() - before
+	live := srv.liveKeys
+	srv.mu.Unlock()
+	if stream.reply.Keys != 2000 || live != 2000 {
+		t.Fatalf("ingested %d keys, %d live; want 2000", stream.reply.Keys, live)
+	}
+	if stream.reply.Entries != logged || logged < 3 || logged > 5 {
+		t.Fatalf("reply entries=%d, log grew by %d; want about 4 chunks of 512 KiB", stream.reply.Entries, logged)
+	}
+	got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "k19099"})
+	if err != nil || !got.Found || got.Value != value {
+		t.Fatalf("Get(k19099) = %v, %v", got, err)
+	}
+
+	unsorted := &fakeIngestStream{batches: []*kvpb.IngestBatch{{Pairs: []*kvpb.KVPair{{Key: "b", Value: "1"}, {Key: "a", Value: "2"}}}}}
+	if err := srv.Ingest(unsorted); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unsorted Ingest() err = %v, want InvalidArgument", err)
+	}
+}
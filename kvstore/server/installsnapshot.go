@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Snapshot install: a follower that needs entries the leader has compacted
+// out of its log, such as one that lost its disk or joined after the
+// compaction, is sent the leader's snapshot instead. The leader streams the
+// snapshot file in chunks; the follower collects them in a temporary file,
+// checks it, makes it its own snapshot, drops its log and rebuilds its
+// state from it. While a transfer runs the leader sends that peer nothing
+// else, and each chunk counts as contact from the leader.
+
+// snapshotChunkBytes is the size of one InstallSnapshot chunk.
+const snapshotChunkBytes = 1 << 20
+
+// snapshotReceive is a transfer in progress on a follower.
+type snapshotReceive struct {
+	term      uint64
+	lastIndex uint64
+	offset    uint64
+	// file holds the chunks on disk; buf holds them on ephemeral servers.
+	file *os.File
+	buf  bytes.Buffer
+}
+
+func (s *kvServer) snapshotReceivePath() string {
+	return s.snapshotPath() + ".recv"
+}
+
+// abortSnapshotReceiveLocked drops a transfer in progress, if any.
+func (s *kvServer) abortSnapshotReceiveLocked() {
+	rcv := s.snapshotRecv
+	s.snapshotRecv = nil
+	if rcv != nil && rcv.file != nil {
+		_ = rcv.file.Close()
+		_ = os.Remove(rcv.file.Name())
+	}
+}
+
+func (s *kvServer) InstallSnapshot(ctx context.Context, req *kvpb.InstallSnapshotRequest) (*kvpb.InstallSnapshotReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Term < s.currentTerm {
+		s.logf("reject snapshot from leader=%d stale_term=%d", req.LeaderId, req.Term)
+		return &kvpb.InstallSnapshotReply{Term: s.currentTerm, MatchIndex: s.lastLogIndexLocked()}, nil
+	}
+	if req.Term > s.currentTerm || s.role != roleFollower {
+		if err := s.becomeFollowerLocked(req.Term, int(req.LeaderId), req.LeaderApiAddr); err != nil {
+			return nil, err
+		}
+	} else {
+		s.leaderID = int(req.LeaderId)
+		s.leaderAddr = req.LeaderApiAddr
+		s.lastContact = time.Now()
+		s.resetElectionDeadlineLocked()
+	}
+	s.leaderContact = time.Now()
+
+	if req.Offset == 0 {
+		s.abortSnapshotReceiveLocked()
+		rcv := &snapshotReceive{term: req.Term, lastIndex: req.LastIndex}
+		if !s.ephemeral() {
+			f, err := os.Create(s.snapshotReceivePath())
+			if err != nil {
+				return nil, fmt.Errorf("receive snapshot: %w", err)
+			}
+			rcv.file = f
+		}
+		s.snapshotRecv = rcv
+	}
+	rcv := s.snapshotRecv
+	if rcv == nil || rcv.term != req.Term || rcv.lastIndex != req.LastIndex || rcv.offset != req.Offset {
+		s.abortSnapshotReceiveLocked()
+		return nil, status.Errorf(codes.Aborted, "snapshot chunk at offset %d does not continue the transfer in progress; start again", req.Offset)
+	}
+	var err error
+	if rcv.file != nil {
+		_, err = rcv.file.Write(req.Data)
+	} else {
+		_, err = rcv.buf.Write(req.Data)
+	}
+	if err != nil {
+		s.abortSnapshotReceiveLocked()
+		return nil, fmt.Errorf("receive snapshot: %w", err)
+	}
+	rcv.offset += uint64(len(req.Data))
+	if req.Done {
+		if err := s.installReceivedSnapshotLocked(req); err != nil {
+			s.logf("install snapshot through %d failed: %v", req.LastIndex, err)
+			return nil, err
+		}
+	}
+	return &kvpb.InstallSnapshotReply{Term: s.currentTerm, MatchIndex: s.lastLogIndexLocked()}, nil
+}
+
+// installReceivedSnapshotLocked makes the completed transfer the replica's
+// snapshot and replaces its log and state with it. A witness keeps no
+// state, so it is sent no data and only moves its log past the snapshot.
+func (s *kvServer) installReceivedSnapshotLocked(req *kvpb.InstallSnapshotRequest) error {
+	rcv := s.snapshotRecv
+	s.snapshotRecv = nil
+	witness := s.witnesses[s.replicaID]
+	lastIndex, lastTerm := req.LastIndex, req.LastTerm
+	var st *snapshotState
+	if !witness {
+		var err error
+		if rcv.file != nil {
+			path := rcv.file.Name()
+			err = rcv.file.Sync()
+			if closeErr := rcv.file.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				st, err = readSnapshotFile(path, s.keyPrefixes)
+			}
+			if err != nil {
+				_ = os.Remove(path)
+			}
+		} else {
+			st, err = readSnapshot(&rcv.buf, "received snapshot", s.keyPrefixes)
+		}
+		if err != nil {
+			return fmt.Errorf("install snapshot: %w", err)
+		}
+		lastIndex, lastTerm = st.header.LastIndex, st.header.LastTerm
+	} else if rcv.file != nil {
+		_ = rcv.file.Close()
+		_ = os.Remove(rcv.file.Name())
+	}
+	if lastIndex <= s.commitIndex || (lastIndex <= s.lastLogIndexLocked() && s.logTermLocked(lastIndex) == lastTerm) {
+		// Nothing the replica does not already have.
+		if rcv.file != nil && !witness {
+			_ = os.Remove(rcv.file.Name())
+		}
+		return nil
+	}
+
+	switch {
+	case witness:
+	case s.ephemeral():
+		s.memSnapshot = st
+	default:
+		if err := renameSynced(rcv.file.Name(), s.snapshotPath()); err != nil {
+			return fmt.Errorf("install snapshot: %w", err)
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM raft_log`); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	for key, value := range map[string]uint64{"log_base": lastIndex, "log_base_term": lastTerm, "commit_index": lastIndex} {
+		if _, err := tx.Exec(`INSERT INTO raft_meta(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, strconv.FormatUint(value, 10)); err != nil {
+			return fmt.Errorf("install snapshot: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	s.logEntries = nil
+	s.logBase, s.logBaseTerm = lastIndex, lastTerm
+	s.commitIndex = lastIndex
+	s.logf("installed snapshot from leader=%d through index=%d term=%d", req.LeaderId, lastIndex, lastTerm)
+	if witness {
+		s.lastApplied = lastIndex
+		return nil
+	}
+	return s.rebuildStateFromCommittedLocked()
+}
+
+// startSnapshotSendLocked begins sending peerID the latest snapshot, unless
+// a transfer to it is already running. It releases s.mu.
+func (s *kvServer) startSnapshotSendLocked(peerID int) {
+	if s.snapshotSending[peerID] {
+		s.mu.Unlock()
+		return
+	}
+	req := &kvpb.InstallSnapshotRequest{
+		Term:          s.currentTerm,
+		LeaderId:      uint32(s.replicaID),
+		LeaderApiAddr: s.apiAddr,
+		LastIndex:     s.snapshotIndex,
+		LastTerm:      s.logTermLocked(s.snapshotIndex),
+	}
+	var (
+		src io.ReadCloser
+		mem *snapshotState
+	)
+	switch {
+	case s.witnesses[peerID]:
+	case s.ephemeral():
+		mem = s.memSnapshot
+	default:
+		f, err := os.Open(s.snapshotPath())
+		if err != nil {
+			s.logf("snapshot for peer=%d unavailable: %v", peerID, err)
+			s.mu.Unlock()
+			return
+		}
+		src = f
+	}
+	if s.snapshotSending == nil {
+		s.snapshotSending = make(map[int]bool)
+	}
+	s.snapshotSending[peerID] = true
+	s.logf("peer=%d needs entries compacted through %d; sending snapshot through %d", peerID, s.logBase, req.LastIndex)
+	s.mu.Unlock()
+
+	if mem != nil {
+		// The tree of a stored snapshot is never written, so it can be
+		// encoded without s.mu.
+		var buf bytes.Buffer
+		if err := encodeSnapshot(&buf, mem); err != nil {
+			log.Printf("encode snapshot for peer=%d failed: %v", peerID, err)
+		} else {
+			src = io.NopCloser(&buf)
+		}
+	}
+	go s.sendSnapshot(peerID, req, src)
+}
+
+// sendSnapshot sends src to peerID in chunks, or, for a witness, just the
+// index the snapshot covers.
+func (s *kvServer) sendSnapshot(peerID int, req *kvpb.InstallSnapshotRequest, src io.ReadCloser) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.snapshotSending, peerID)
+		s.mu.Unlock()
+	}()
+	if src != nil {
+		defer src.Close()
+	} else if !s.witnesses[peerID] {
+		return
+	}
+	client, err := s.getPeerClient(peerID)
+	if err != nil {
+		s.mu.Lock()
+		s.logf("snapshot peer=%d dial failed: %v", peerID, err)
+		s.mu.Unlock()
+		return
+	}
+	buf := make([]byte, snapshotChunkBytes)
+	for {
+		n := 0
+		if src != nil {
+			n, err = io.ReadFull(src, buf)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("read snapshot for peer=%d failed: %v", peerID, err)
+				return
+			}
+		}
+		req.Data, req.Done = buf[:n], src == nil || n < len(buf)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		resp, err := client.InstallSnapshot(ctx, req)
+		cancel()
+
+		s.mu.Lock()
+		if err != nil {
+			s.logf("snapshot peer=%d failed at offset %d: %v", peerID, req.Offset, err)
+			s.resetPeerClient(peerID)
+			s.mu.Unlock()
+			return
+		}
+		if resp.Term > s.currentTerm {
+			if err := s.becomeFollowerLocked(resp.Term, -1, ""); err != nil {
+				log.Printf("become follower failed: %v", err)
+			}
+			s.mu.Unlock()
+			return
+		}
+		if s.role != roleLeader || req.Term != s.currentTerm {
+			s.mu.Unlock()
+			return
+		}
+		s.peerContact[peerID] = time.Now()
+		if req.Done {
+			s.matchIndex[peerID] = resp.MatchIndex
+			s.nextIndex[peerID] = resp.MatchIndex + 1
+			s.logf("snapshot sent to peer=%d match=%d bytes=%d", peerID, resp.MatchIndex, req.Offset+uint64(n))
+			if err := s.maybeAdvanceCommitLocked(); err != nil {
+				log.Printf("advance commit failed: %v", err)
+			}
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		req.Offset += uint64(n)
+	}
+}
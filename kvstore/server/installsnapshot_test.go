@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestFollowerBehindCompactionCatchesUpFromSnapshot(t *testing.T) {
+	leader := newTestServer(t, t.TempDir(), 0, 0, 2, 1)
+	becomeTestLeader(t, leader, 1)
+	leader.mu.Lock()
+	leader.peerClients[1] = &mockRaftPeerClient{}
+	leader.mu.Unlock()
+	put := func(key, value string) {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-"+key))
+		if _, err := leader.Put(ctx, &kvpb.PutRequest{Key: key, Value: value}); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	if err := leader.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot: %v", err)
+	}
+	leader.mu.Lock()
+	if leader.logBase == 0 {
+		leader.mu.Unlock()
+		t.Fatalf("leader log not compacted")
+	}
+	// The follower comes back with an empty disk.
+	follower := newTestServer(t, t.TempDir(), 0, 1, 2, 1)
+	installs := 0
+	leader.peerClients[1] = &mockRaftPeerClient{
+		appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+			return follower.AppendEntries(ctx, req)
+		},
+		installFn: func(ctx context.Context, req *kvpb.InstallSnapshotRequest, opts ...grpc.CallOption) (*kvpb.InstallSnapshotReply, error) {
+			installs++
+			return follower.InstallSnapshot(ctx, req)
+		},
+	}
+	leader.nextIndex[1], leader.matchIndex[1] = 1, 0
+	snapshotIndex := leader.snapshotIndex
+	leader.mu.Unlock()
+
+	caughtUp := func(index uint64) bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.matchIndex[1] >= index && !leader.snapshotSending[1]
+	}
+	leader.replicateToPeer(1)
+	for deadline := time.Now().Add(5 * time.Second); !caughtUp(snapshotIndex); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower never caught up to the snapshot at %d", snapshotIndex)
+		}
+	}
+	if installs != 1 {
+		t.Fatalf("InstallSnapshot called %d times, want 1", installs)
+	}
+
+	// Entries after the snapshot then replicate as usual.
+	put("after", "snapshot")
+	leader.replicateToPeer(1)
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	if follower.logBase != snapshotIndex || follower.lastLogIndexLocked() != snapshotIndex+1 {
+		t.Fatalf("follower logBase=%d last=%d, want the snapshot at %d and one entry after it", follower.logBase, follower.lastLogIndexLocked(), snapshotIndex)
+	}
+	for i := 0; i < 5; i++ {
+		it, ok := follower.getLiveLocked(fmt.Sprintf("k%d", i))
+		if !ok || it.value != fmt.Sprintf("v%d", i) {
+			t.Fatalf("follower k%d = %q, %v; want the snapshot's value", i, it.value, ok)
+		}
+	}
+}
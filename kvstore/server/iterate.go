@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	iterateCursorVersion = 1
+	defaultIterateLimit  = 100
+	maxIterateLimit      = 1000
+)
+
+// decodeIterateCursor returns the key to resume after and whether the
+// cursor is past the start of the key space.
+func (s *kvServer) decodeIterateCursor(raw []byte) (string, bool, error) {
+	if len(raw) == 0 {
+		return "", false, nil
+	}
+	var c kvpb.IterateCursor
+	if err := proto.Unmarshal(raw, &c); err != nil || c.Version != iterateCursorVersion {
+		return "", false, invalidFieldError("cursor", "malformed iterate cursor")
+	}
+	if int(c.PartitionId) != s.partitionID {
+		return "", false, invalidFieldError("cursor", "iterate cursor belongs to partition %d, not %d", c.PartitionId, s.partitionID)
+	}
+	return c.AfterKey, true, nil
+}
+
+func (s *kvServer) Iterate(ctx context.Context, req *kvpb.IterateRequest) (*kvpb.IterateReply, error) {
+	if err := s.checkRangeRead("iterate"); err != nil {
+		return nil, err
+	}
+	after, resume, err := s.decodeIterateCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultIterateLimit
+	}
+	limit = min(limit, maxIterateLimit)
+
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	reply := &kvpb.IterateReply{Pairs: make([]*kvpb.KVPair, 0, limit), Done: true}
+	from := after
+	if req.Prefix > from {
+		from = req.Prefix
+	}
+	s.tree.AscendGreaterOrEqual(item{key: from}, func(it item) bool {
+		key := it.fullKey()
+		if !strings.HasPrefix(key, req.Prefix) {
+			return false
+		}
+		if it.tombstone || (resume && key == after) {
+			return true
+		}
+		if len(reply.Pairs) == limit {
+			reply.Done = false
+			return false
+		}
+		if err = s.verifyValue(key, it); err != nil {
+			return false
+		}
+		reply.Pairs = append(reply.Pairs, &kvpb.KVPair{Key: key, Value: it.value})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Done {
+		last := reply.Pairs[len(reply.Pairs)-1].Key
+		reply.NextCursor, err = proto.Marshal(&kvpb.IterateCursor{Version: iterateCursorVersion, PartitionId: uint32(s.partitionID), AfterKey: last})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "encode iterate cursor: %v", err)
+		}
+	}
+	return reply, nil
+}
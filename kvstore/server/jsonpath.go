@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// JSONGet and JSONSet read and replace one field of a JSON value on the
+// server. A set is a merge with the json-set operator, whose operand names
+// the path and the new field, so it is atomic, deduplicated, replicated and
+// streamed to CDC like any other merge.
+
+// jsonPathSegment is one step of a path: an object member or, if isIndex,
+// an array element.
+type jsonPathSegment struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+func (seg jsonPathSegment) String() string {
+	if seg.isIndex {
+		return "[" + strconv.Itoa(seg.index) + "]"
+	}
+	return "." + seg.name
+}
+
+// parseJSONPath parses a path such as "$.profile.emails[0]". The leading
+// "$" and the dot before the first member are optional; "" and "$" are the
+// whole document.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	rest := strings.TrimPrefix(path, "$")
+	var segs []jsonPathSegment
+	for first := true; rest != ""; first = false {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", path)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("array index %q in %q is not a non-negative integer", rest[1:end], path)
+			}
+			segs = append(segs, jsonPathSegment{index: n, isIndex: true})
+			rest = rest[end+1:]
+		case rest[0] == '.' || first:
+			if rest[0] == '.' {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty member name in %q", path)
+			}
+			segs = append(segs, jsonPathSegment{name: rest[:end]})
+			rest = rest[end:]
+		default:
+			return nil, fmt.Errorf("expected . or [ at %q in %q", rest, path)
+		}
+	}
+	return segs, nil
+}
+
+// decodeJSON decodes one JSON document, keeping numbers as they were
+// written so re-encoding does not round them.
+func decodeJSON(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after the document")
+	}
+	return v, nil
+}
+
+// encodeJSON encodes v compactly. Object members come out sorted, so every
+// replica encodes the same document the same way.
+func encodeJSON(v any) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// jsonLookup returns the field of doc at segs.
+func jsonLookup(doc any, segs []jsonPathSegment) (any, bool) {
+	for _, seg := range segs {
+		if seg.isIndex {
+			arr, ok := doc.([]any)
+			if !ok || seg.index >= len(arr) {
+				return nil, false
+			}
+			doc = arr[seg.index]
+			continue
+		}
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[seg.name]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonReplace returns doc with the field at segs set to v. at is the path
+// to doc, for errors.
+func jsonReplace(doc any, segs []jsonPathSegment, v any, at string) (any, error) {
+	if len(segs) == 0 {
+		return v, nil
+	}
+	seg, rest := segs[0], segs[1:]
+	if seg.isIndex {
+		arr, ok := doc.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an array", at)
+		}
+		switch {
+		case seg.index < len(arr):
+			elem, err := jsonReplace(arr[seg.index], rest, v, at+seg.String())
+			if err != nil {
+				return nil, err
+			}
+			arr[seg.index] = elem
+		case seg.index == len(arr):
+			elem, err := jsonReplace(nil, rest, v, at+seg.String())
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		default:
+			return nil, fmt.Errorf("index %d is past the end of %s, which has %d elements", seg.index, at, len(arr))
+		}
+		return arr, nil
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", at)
+	}
+	member, err := jsonReplace(obj[seg.name], rest, v, at+seg.String())
+	if err != nil {
+		return nil, err
+	}
+	obj[seg.name] = member
+	return obj, nil
+}
+
+// jsonSetOperand is a json-set merge operand: the path to set and the JSON
+// to set it to.
+type jsonSetOperand struct {
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeJSONSetOperand returns the path and the decoded value an operand
+// holds.
+func decodeJSONSetOperand(operand string) ([]jsonPathSegment, any, error) {
+	var op jsonSetOperand
+	if err := json.Unmarshal([]byte(operand), &op); err != nil {
+		return nil, nil, fmt.Errorf("operand is not a json-set operand: %w", err)
+	}
+	segs, err := parseJSONPath(op.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if op.Value == nil {
+		return nil, nil, errors.New("operand has no value")
+	}
+	v, err := decodeJSON(string(op.Value))
+	if err != nil {
+		return nil, nil, fmt.Errorf("value is not JSON: %w", err)
+	}
+	return segs, v, nil
+}
+
+// jsonSetMerge treats the value as a JSON document, missing as empty, and
+// sets the field the operand's path names to the operand's value.
+type jsonSetMerge struct{}
+
+func (jsonSetMerge) CheckOperand(operand string) error {
+	_, _, err := decodeJSONSetOperand(operand)
+	return err
+}
+
+func (jsonSetMerge) Merge(existing string, found bool, operand string) (string, error) {
+	segs, v, err := decodeJSONSetOperand(operand)
+	if err != nil {
+		return "", err
+	}
+	var doc any
+	if found {
+		if doc, err = decodeJSON(existing); err != nil {
+			return "", fmt.Errorf("stored value is not a JSON document: %v", err)
+		}
+	}
+	if doc, err = jsonReplace(doc, segs, v, "$"); err != nil {
+		return "", err
+	}
+	return encodeJSON(doc)
+}
+
+func (s *kvServer) JSONGet(ctx context.Context, req *kvpb.JSONGetRequest) (*kvpb.JSONGetReply, error) {
+	segs, err := parseJSONPath(req.Path)
+	if err != nil {
+		return nil, invalidFieldError("path", "invalid path: %v", err)
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if err := s.validateKeyOwner(req.Key); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	if err := s.checkLeaderReadLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	it, found := s.getLiveLocked(req.Key)
+	if found {
+		s.accessStats.readLocked(req.Key)
+	}
+	s.mu.Unlock()
+
+	if !found {
+		return &kvpb.JSONGetReply{}, nil
+	}
+	if err := s.verifyValue(req.Key, it); err != nil {
+		return nil, err
+	}
+	if err := checkJSONApplies(it); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot read %q as JSON: %v", s.redact.key(req.Key), err)
+	}
+	doc, err := decodeJSON(it.value)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "value of %q is not a JSON document: %v", s.redact.key(req.Key), err)
+	}
+	field, ok := jsonLookup(doc, segs)
+	if !ok {
+		return &kvpb.JSONGetReply{}, nil
+	}
+	value, err := encodeJSON(field)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encoding %s of %q: %v", req.Path, s.redact.key(req.Key), err)
+	}
+	return &kvpb.JSONGetReply{Found: true, Value: value}, nil
+}
+
+func (s *kvServer) JSONSet(ctx context.Context, req *kvpb.JSONSetRequest) (*kvpb.JSONSetReply, error) {
+	if _, err := parseJSONPath(req.Path); err != nil {
+		return nil, invalidFieldError("path", "invalid path: %v", err)
+	}
+	if _, err := decodeJSON(req.Value); err != nil {
+		return nil, invalidFieldError("value", "value is not JSON: %v", err)
+	}
+	operand, err := json.Marshal(jsonSetOperand{Path: req.Path, Value: json.RawMessage(req.Value)})
+	if err != nil {
+		return nil, invalidFieldError("value", "value is not JSON: %v", err)
+	}
+	what := fmt.Sprintf("set %q of %q", req.Path, s.redact.key(req.Key))
+	cached, err := s.submitMerge(ctx, req.Key, jsonSetOperator, string(operand), what)
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.JSONSetReply{Document: cached.merged, Set: cached.found, Seq: cached.seq}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestJSONSetMerge(t *testing.T) {
+	for _, tt := range []struct {
+		existing  string
+		found     bool
+		path, val string
+		want      string
+		wantErr   string
+	}{
+		{"", false, "name", `"kv"`, `{"name":"kv"}`, ""},
+		{"", false, "", `[1]`, `[1]`, ""},
+		{`{"b":1,"a":{"x":2.50}}`, true, "$.a.y", `"<&>"`, `{"a":{"x":2.50,"y":"<&>"},"b":1}`, ""},
+		{`{"tags":["a","b"]}`, true, "tags[1]", `"c"`, `{"tags":["a","c"]}`, ""},
+		{`{"tags":["a"]}`, true, "tags[1].id", `7`, `{"tags":["a",{"id":7}]}`, ""},
+		{`{"tags":["a"]}`, true, "tags[3]", `"d"`, "", "index 3 is past the end of $.tags"},
+		{`{"n":1}`, true, "n.m", `2`, "", "$.n is not an object"},
+		{`{"n":1}`, true, "n[0]", `2`, "", "$.n is not an array"},
+		{`not json`, true, "n", `2`, "", "not a JSON document"},
+	} {
+		operand := `{"path":"` + tt.path + `","value":` + tt.val + `}`
+		got, err := jsonSetMerge{}.Merge(tt.existing, tt.found, operand)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("set %s=%s in %q: err = %v, want one containing %q", tt.path, tt.val, tt.existing, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("set %s=%s in %q = %q, %v; want %q", tt.path, tt.val, tt.existing, got, err, tt.want)
+		}
+	}
+	for _, path := range []string{"a..b", "a[x]", "a[-1]", "a[1", "."} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestJSONSetAndGetFields(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	if _, err := srv.Put(call("put-user"), &kvpb.PutRequest{Key: "user", Value: `{"name":"ann","emails":["a@x"]}`}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	set, err := srv.JSONSet(call("add-email"), &kvpb.JSONSetRequest{Key: "user", Path: "emails[1]", Value: `"b@x"`})
+	if err != nil || !set.Set {
+		t.Fatalf("JSONSet = %v, %v", set, err)
+	}
+	if want := `{"emails":["a@x","b@x"],"name":"ann"}`; set.Document != want {
+		t.Fatalf("document after JSONSet = %s, want %s", set.Document, want)
+	}
+	got, err := srv.JSONGet(context.Background(), &kvpb.JSONGetRequest{Key: "user", Path: "$.emails[1]"})
+	if err != nil || !got.Found || got.Value != `"b@x"` {
+		t.Fatalf("JSONGet emails[1] = %v, %v; want \"b@x\"", got, err)
+	}
+	if got, err := srv.JSONGet(context.Background(), &kvpb.JSONGetRequest{Key: "user", Path: "age"}); err != nil || got.Found {
+		t.Fatalf("JSONGet of a missing member = %v, %v; want not found", got, err)
+	}
+
+	if _, err := srv.JSONSet(call("bad-value"), &kvpb.JSONSetRequest{Key: "user", Path: "age", Value: "forty"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("JSONSet with a value that is not JSON: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.JSONSet(call("into-name"), &kvpb.JSONSetRequest{Key: "user", Path: "name.first", Value: `"a"`}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("JSONSet below a string: err = %v, want FailedPrecondition", err)
+	}
+	if _, err := srv.Put(call("put-raw"), &kvpb.PutRequest{Key: "raw", Value: "plain"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.JSONGet(context.Background(), &kvpb.JSONGetRequest{Key: "raw"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("JSONGet of a value that is not JSON: err = %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"unique"
+)
+
+// Key prefix compression: with --compress_key_prefixes, the index stores a
+// key's directory part, everything up to its last '/', once, shared by all
+// the keys under it. An item then holds a handle to its prefix and only the
+// rest of its key, and fullKey puts the two back together, so a
+// hierarchical keyspace such as tenant/users/<id> pays for tenant/users/
+// once rather than per key. Prefixes shorter than minInternedPrefix stay
+// inline, where the handle would cost about what it saves.
+//
+// Compression changes only how keys are held in memory: snapshots, the log
+// and every reply carry full keys.
+
+const (
+	keyPrefixDelimiter = "/"
+	minInternedPrefix  = 16
+	// prefixHandleBytes is what an item's handle to its prefix costs.
+	prefixHandleBytes = 8
+)
+
+// sharedPrefix returns the interned part of the item's key, or "".
+func (it item) sharedPrefix() string {
+	if it.prefix == (unique.Handle[string]{}) {
+		return ""
+	}
+	return it.prefix.Value()
+}
+
+// fullKey returns the item's key.
+func (it item) fullKey() string {
+	if it.prefix == (unique.Handle[string]{}) {
+		return it.key
+	}
+	return it.prefix.Value() + it.key
+}
+
+// splitLess reports whether a1+a2 sorts before b1+b2, without building
+// either.
+func splitLess(a1, a2, b1, b2 string) bool {
+	for {
+		if a1 == "" {
+			a1, a2 = a2, ""
+		}
+		if b1 == "" {
+			b1, b2 = b2, ""
+		}
+		if a1 == "" || b1 == "" {
+			return b1 != ""
+		}
+		n := min(len(a1), len(b1))
+		if a1[:n] != b1[:n] {
+			return a1[:n] < b1[:n]
+		}
+		a1, b1 = a1[n:], b1[n:]
+	}
+}
+
+// keyInterner splits keys into shared prefixes and accounts for the memory
+// the index's keys take before and after compression. It is guarded by
+// kvServer.mu. A nil *keyInterner compresses nothing.
+type keyInterner struct {
+	// refs counts the items in the index that hold each prefix.
+	refs map[unique.Handle[string]]int
+	// keyBytes is the length of the index's keys, tombstones included, as
+	// written; storedBytes is what they take as held: each item's own
+	// part and prefix handle, and each shared prefix once.
+	keyBytes, storedBytes int64
+}
+
+func newKeyInterner(enabled bool) *keyInterner {
+	if !enabled {
+		return nil
+	}
+	return &keyInterner{refs: make(map[unique.Handle[string]]int)}
+}
+
+// item returns an index entry for key, its prefix shared if it is worth
+// sharing.
+func (k *keyInterner) item(key string) item {
+	cut := strings.LastIndex(key, keyPrefixDelimiter) + len(keyPrefixDelimiter)
+	if k == nil || cut < minInternedPrefix {
+		return item{key: key}
+	}
+	// Cloning the rest lets the caller's copy of the whole key be freed.
+	return item{prefix: unique.Make(key[:cut]), key: strings.Clone(key[cut:])}
+}
+
+// addedLocked accounts for it joining the index.
+func (k *keyInterner) addedLocked(it item) {
+	if k == nil {
+		return
+	}
+	prefix := it.sharedPrefix()
+	k.keyBytes += int64(len(prefix) + len(it.key))
+	k.storedBytes += int64(len(it.key))
+	if prefix == "" {
+		return
+	}
+	k.storedBytes += prefixHandleBytes
+	if k.refs[it.prefix] == 0 {
+		k.storedBytes += int64(len(prefix))
+	}
+	k.refs[it.prefix]++
+}
+
+// removedLocked accounts for it leaving the index.
+func (k *keyInterner) removedLocked(it item) {
+	if k == nil {
+		return
+	}
+	prefix := it.sharedPrefix()
+	k.keyBytes -= int64(len(prefix) + len(it.key))
+	k.storedBytes -= int64(len(it.key))
+	if prefix == "" {
+		return
+	}
+	k.storedBytes -= prefixHandleBytes
+	if k.refs[it.prefix]--; k.refs[it.prefix] == 0 {
+		delete(k.refs, it.prefix)
+		k.storedBytes -= int64(len(prefix))
+	}
+}
+
+func (k *keyInterner) reset() {
+	if k == nil {
+		return
+	}
+	k.refs = make(map[unique.Handle[string]]int)
+	k.keyBytes, k.storedBytes = 0, 0
+}
+
+// compressKeysLocked rebuilds the index with shared prefixes, for state
+// loaded before compression was set up.
+func (s *kvServer) compressKeysLocked() {
+	if s.keyPrefixes == nil {
+		return
+	}
+	tree := newItemTree()
+	s.keyPrefixes.reset()
+	s.tree.Ascend(func(it item) bool {
+		stored := s.keyPrefixes.item(it.fullKey())
+		it.prefix, it.key = stored.prefix, stored.key
+		tree.ReplaceOrInsert(it)
+		s.keyPrefixes.addedLocked(it)
+		return true
+	})
+	s.replaceTreeLocked(tree)
+}
+
+func (s *kvServer) registerKeyPrefixMetrics(r *metricsRegistry) {
+	r.gauge("kv_key_bytes", "Bytes of the keys in memory, tombstones included, before prefix compression.", s.locked(func() float64 { return float64(s.keyPrefixes.keyBytes) }))
+	r.gauge("kv_key_stored_bytes", "Bytes the keys in memory take after prefix compression, counting each shared prefix once and a handle per key that uses one.", s.locked(func() float64 { return float64(s.keyPrefixes.storedBytes) }))
+	r.gauge("kv_key_shared_prefixes", "Distinct key prefixes shared in memory.", s.locked(func() float64 { return float64(len(s.keyPrefixes.refs)) }))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestSplitLess(t *testing.T) {
+	parts := [][2]string{{"", ""}, {"", "a"}, {"a", ""}, {"ab/", "c"}, {"ab/c", ""}, {"ab", "/d"}, {"ab/", ""}, {"b", "a"}, {"", "ab/ca"}}
+	for _, a := range parts {
+		for _, b := range parts {
+			if got, want := splitLess(a[0], a[1], b[0], b[1]), a[0]+a[1] < b[0]+b[1]; got != want {
+				t.Errorf("splitLess(%q, %q, %q, %q) = %v, want %v", a[0], a[1], b[0], b[1], got, want)
+			}
+		}
+	}
+}
+
+func TestCompressedKeysKeepOrderAndAccounting(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.keyPrefixes = newKeyInterner(true)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("tenant-a/users/profile/%02d", i))
+	}
+	keys = append(keys, "tenant-a/users/profile", "tenant-a/users/profile0", "short/x", "plain")
+	for _, key := range keys {
+		if _, err := srv.Put(call("put-"+key), &kvpb.PutRequest{Key: key, Value: "v"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	if _, err := srv.Delete(call("del"), &kvpb.DeleteRequest{Key: "tenant-a/users/profile/03"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	got, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "tenant-a/users/profile", EndKey: "tenant-a/users/profile/05"})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	want := []string{"tenant-a/users/profile", "tenant-a/users/profile/00", "tenant-a/users/profile/01", "tenant-a/users/profile/02", "tenant-a/users/profile/04", "tenant-a/users/profile/05"}
+	if len(got.Pairs) != len(want) {
+		t.Fatalf("Scan returned %d pairs, want %v", len(got.Pairs), want)
+	}
+	for i, p := range got.Pairs {
+		if p.Key != want[i] {
+			t.Fatalf("Scan pair %d = %q, want %q", i, p.Key, want[i])
+		}
+	}
+	if g, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "tenant-a/users/profile/07"}); err != nil || !g.Found {
+		t.Fatalf("Get of a compressed key = %v, %v", g, err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	k := srv.keyPrefixes
+	keyBytes, storedBytes, prefixes := k.keyBytes, k.storedBytes, len(k.refs)
+	if prefixes != 1 || storedBytes >= keyBytes {
+		t.Fatalf("after writes: %d prefixes, %d of %d key bytes stored, want 1 prefix and fewer bytes stored", prefixes, storedBytes, keyBytes)
+	}
+	srv.recountLocked()
+	if k.keyBytes != keyBytes || k.storedBytes != storedBytes {
+		t.Fatalf("recount = %d of %d key bytes, want the running %d of %d", k.storedBytes, k.keyBytes, storedBytes, keyBytes)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// reservedKeyPrefix is kept for keys the server itself stores. Clients can
+// neither read nor write under it.
+const reservedKeyPrefix = "__kv/"
+
+// keyPolicy validates client keys before a request reaches the handler.
+// Hierarchical keys use "/" as the separator, so "a/b/c" has depth 3.
+type keyPolicy struct {
+	// charset matches keys made only of allowed characters; nil allows any.
+	charset  *regexp.Regexp
+	maxDepth int
+	redact   redaction
+}
+
+// newKeyPolicy builds a policy from a regexp character class body such as
+// "A-Za-z0-9_./-" (empty allows any byte) and a depth limit (0 is none).
+// Keys in its errors are redacted by redact.
+func newKeyPolicy(charset string, maxDepth int, redact redaction) (*keyPolicy, error) {
+	p := &keyPolicy{maxDepth: maxDepth, redact: redact}
+	if charset != "" {
+		re, err := regexp.Compile("^[" + charset + "]*$")
+		if err != nil {
+			return nil, fmt.Errorf("key charset %q: %w", charset, err)
+		}
+		p.charset = re
+	}
+	return p, nil
+}
+
+// check validates key. A nil policy only enforces the reserved prefix.
+func (p *keyPolicy) check(key string) error {
+	var redact redaction
+	if p != nil {
+		redact = p.redact
+	}
+	if strings.HasPrefix(key, reservedKeyPrefix) {
+		return invalidFieldError("key", "key %q is under the reserved prefix %q", redact.key(key), reservedKeyPrefix)
+	}
+	if p == nil {
+		return nil
+	}
+	if p.charset != nil && !p.charset.MatchString(key) {
+		return invalidFieldError("key", "key %q has characters outside the allowed set", p.redact.key(key))
+	}
+	if p.maxDepth > 0 && strings.Count(key, "/")+1 > p.maxDepth {
+		return invalidFieldError("key", "key %q is deeper than %d levels", p.redact.key(key), p.maxDepth)
+	}
+	return nil
+}
+
+// unaryInterceptor checks the key of every single-key KVS request, both
+// keys of a Rename and every key of a Batch.
+func (p *keyPolicy) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	if r, ok := req.(interface{ GetKey() string }); ok {
+		if err := p.check(r.GetKey()); err != nil {
+			return nil, err
+		}
+	}
+	if r, ok := req.(*kvpb.RenameRequest); ok {
+		for _, key := range []string{r.OldKey, r.NewKey} {
+			if err := p.check(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, ok := req.(*kvpb.BatchRequest); ok {
+		for _, op := range r.Ops {
+			if err := p.check(op.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return handler(ctx, req)
+}
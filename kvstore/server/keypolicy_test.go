@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	p, err := newKeyPolicy("a-z0-9/_", 3, redaction{})
+	if err != nil {
+		t.Fatalf("newKeyPolicy() failed: %v", err)
+	}
+	for key, ok := range map[string]bool{
+		"users/42/name":   true,
+		"flat":            true,
+		"a/b/c/d":         false,
+		"Users/42":        false,
+		"has space":       false,
+		"__kv/meta":       false,
+		reservedKeyPrefix: false,
+	} {
+		err := p.check(key)
+		if (err == nil) != ok {
+			t.Errorf("check(%q) = %v, want ok=%v", key, err, ok)
+		}
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("check(%q) code = %v, want InvalidArgument", key, status.Code(err))
+		}
+	}
+	var unset *keyPolicy
+	if unset.check("Any Key/at/all/depths") != nil || unset.check("__kv/x") == nil {
+		t.Fatalf("nil policy should only enforce the reserved prefix")
+	}
+
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + kvpb.KVS_ServiceDesc.ServiceName + "/Put"}
+	if _, err := p.unaryInterceptor(context.Background(), &kvpb.PutRequest{Key: "__kv/x"}, info, handler); status.Code(err) != codes.InvalidArgument || called {
+		t.Fatalf("interceptor let a reserved key through: err=%v called=%v", err, called)
+	}
+	if _, err := p.unaryInterceptor(context.Background(), &kvpb.ScanRequest{StartKey: "A", EndKey: "Z"}, info, handler); err != nil || !called {
+		t.Fatalf("interceptor blocked a request without a key: err=%v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"math/bits"
+	"sort"
+	"strings"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	defaultHistogramSample   = 1000
+	defaultHistogramPrefixes = 10
+	maxHistogramPrefixes     = 1000
+)
+
+// sizeBucketBound returns the power of two that bounds the bucket of size.
+func sizeBucketBound(size int) uint64 {
+	if size <= 1 {
+		return uint64(size)
+	}
+	return 1 << bits.Len(uint(size-1))
+}
+
+// keyPrefix cuts key after the depth-th delimiter, or returns "" if it has
+// fewer.
+func keyPrefix(key, delimiter string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		j := strings.Index(key[end:], delimiter)
+		if j < 0 {
+			return ""
+		}
+		end += j + len(delimiter)
+	}
+	return key[:end]
+}
+
+func sizeBuckets(counts map[uint64]uint64) []*kvpb.SizeBucket {
+	out := make([]*kvpb.SizeBucket, 0, len(counts))
+	for le, n := range counts {
+		out = append(out, &kvpb.SizeBucket{LeBytes: le, Sampled: n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LeBytes < out[j].LeBytes })
+	return out
+}
+
+// topPrefixes returns the n prefixes with the largest by, ties broken by
+// prefix.
+func topPrefixes(stats []*kvpb.PrefixStat, n int, by func(*kvpb.PrefixStat) uint64) []*kvpb.PrefixStat {
+	sorted := append([]*kvpb.PrefixStat(nil), stats...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if by(sorted[i]) != by(sorted[j]) {
+			return by(sorted[i]) > by(sorted[j])
+		}
+		return sorted[i].Prefix < sorted[j].Prefix
+	})
+	return sorted[:min(n, len(sorted))]
+}
+
+// keyspaceHistogram summarizes a sample of live items.
+func keyspaceHistogram(sample []item, delimiter string, depth, top int) *kvpb.KeyspaceHistogramReply {
+	keySizes := make(map[uint64]uint64)
+	valueSizes := make(map[uint64]uint64)
+	byPrefix := make(map[string]*kvpb.PrefixStat)
+	var total uint64
+	for _, it := range sample {
+		key := it.fullKey()
+		keySizes[sizeBucketBound(len(key))]++
+		valueSizes[sizeBucketBound(len(it.value))]++
+		p := keyPrefix(key, delimiter, depth)
+		st := byPrefix[p]
+		if st == nil {
+			st = &kvpb.PrefixStat{Prefix: p}
+			byPrefix[p] = st
+		}
+		size := uint64(len(key) + len(it.value))
+		st.SampledKeys++
+		st.SampledBytes += size
+		total += size
+	}
+	stats := make([]*kvpb.PrefixStat, 0, len(byPrefix))
+	for _, st := range byPrefix {
+		stats = append(stats, st)
+	}
+	return &kvpb.KeyspaceHistogramReply{
+		Sampled:      uint32(len(sample)),
+		SampledBytes: total,
+		KeySizes:     sizeBuckets(keySizes),
+		ValueSizes:   sizeBuckets(valueSizes),
+		TopByKeys:    topPrefixes(stats, top, func(st *kvpb.PrefixStat) uint64 { return st.SampledKeys }),
+		TopByBytes:   topPrefixes(stats, top, func(st *kvpb.PrefixStat) uint64 { return st.SampledBytes }),
+	}
+}
+
+func (a *adminServer) KeyspaceHistogram(ctx context.Context, req *kvpb.KeyspaceHistogramRequest) (*kvpb.KeyspaceHistogramReply, error) {
+	s := a.kv
+	n := int(req.SampleSize)
+	if n == 0 {
+		n = defaultHistogramSample
+	}
+	if n > maxSampleKeys {
+		return nil, invalidFieldError("sample_size", "sample_size must be at most %d", maxSampleKeys)
+	}
+	top := int(req.TopPrefixes)
+	if top == 0 {
+		top = defaultHistogramPrefixes
+	}
+	top = min(top, maxHistogramPrefixes)
+	delimiter := req.Delimiter
+	if delimiter == "" {
+		delimiter = "/"
+	}
+	depth := max(1, int(req.Depth))
+
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	// The sample walks a clone, so writes are not held up while it runs.
+	tree, rng := s.samplerLocked()
+	population := uint64(s.liveKeys)
+	s.mu.Unlock()
+	sample := sampleItems(tree, rng, n)
+
+	reply := keyspaceHistogram(sample, delimiter, depth, top)
+	reply.Population = population
+	return reply, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		key, delimiter string
+		depth          int
+		want           string
+	}{
+		{"user/1/name", "/", 1, "user/"},
+		{"user/1/name", "/", 2, "user/1/"},
+		{"user/1/name", "/", 3, ""},
+		{"plain", "/", 1, ""},
+		{"a::b::c", "::", 2, "a::b::"},
+	} {
+		if got := keyPrefix(tc.key, tc.delimiter, tc.depth); got != tc.want {
+			t.Errorf("keyPrefix(%q, %q, %d) = %q, want %q", tc.key, tc.delimiter, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestKeyspaceHistogramSummarizesSample(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	put := func(key, value string) {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-"+key))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: value}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		put(fmt.Sprintf("user/%d", i), "v")
+	}
+	put("blob/1", string(make([]byte, 100)))
+	put("loose", "xyz")
+
+	reply, err := (&adminServer{kv: srv}).KeyspaceHistogram(context.Background(), &kvpb.KeyspaceHistogramRequest{TopPrefixes: 2})
+	if err != nil {
+		t.Fatalf("KeyspaceHistogram() failed: %v", err)
+	}
+	if reply.Population != 8 || reply.Sampled != 8 || reply.SampledBytes != 156 {
+		t.Fatalf("population=%d sampled=%d sampled_bytes=%d, want 8, 8 and 156", reply.Population, reply.Sampled, reply.SampledBytes)
+	}
+	var values []string
+	for _, b := range reply.ValueSizes {
+		values = append(values, fmt.Sprintf("%d:%d", b.LeBytes, b.Sampled))
+	}
+	if got := fmt.Sprint(values); got != "[1:6 4:1 128:1]" {
+		t.Errorf("value sizes = %s, want [1:6 4:1 128:1]", got)
+	}
+	if len(reply.TopByKeys) != 2 || reply.TopByKeys[0].Prefix != "user/" || reply.TopByKeys[0].SampledKeys != 6 {
+		t.Errorf("top by keys = %v, want user/ with 6 keys first of 2", reply.TopByKeys)
+	}
+	if reply.TopByBytes[0].Prefix != "blob/" || reply.TopByBytes[0].SampledBytes != 106 {
+		t.Errorf("top by bytes = %v, want blob/ with 106 bytes first", reply.TopByBytes)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	defaultListDirLimit = 1000
+	maxListDirLimit     = 10000
+)
+
+// prefixSuccessor returns the smallest key greater than every key starting
+// with p, or "" if there is none.
+func prefixSuccessor(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func (s *kvServer) ListDir(ctx context.Context, req *kvpb.ListDirRequest) (*kvpb.ListDirReply, error) {
+	if err := s.checkRangeRead("listdir"); err != nil {
+		return nil, err
+	}
+	delim := req.Delimiter
+	if delim == "" {
+		delim = "/"
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultListDirLimit
+	}
+	limit = min(limit, maxListDirLimit)
+
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	return s.listDirLocked(req.Prefix, delim, req.StartAfter, limit)
+}
+
+// listDirLocked lists this replica's children of prefix; see ListDir.
+func (s *kvServer) listDirLocked(prefix, delim, startAfter string, limit int) (*kvpb.ListDirReply, error) {
+	reply := &kvpb.ListDirReply{}
+	var corrupt error
+	from := prefix
+	if startAfter > from {
+		from = startAfter
+	}
+	// Each pass stops at a rolled-up prefix and the next one resumes past
+	// everything under it, so descendants are never walked.
+	for more := true; more; {
+		more = false
+		s.tree.AscendGreaterOrEqual(item{key: from}, func(it item) bool {
+			key := it.fullKey()
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if it.tombstone || key <= startAfter || strings.HasPrefix(key, reservedKeyPrefix) {
+				return true
+			}
+			name := key
+			rest := key[len(prefix):]
+			if idx := strings.Index(rest, delim); idx >= 0 {
+				name = prefix + rest[:idx+len(delim)]
+			}
+			if name != key && name <= startAfter {
+				// The page before ended on this common prefix.
+				from, more = prefixSuccessor(name), true
+				return false
+			}
+			if len(reply.Entries)+len(reply.CommonPrefixes) == limit {
+				reply.Truncated = true
+				return false
+			}
+			if name == key {
+				if corrupt = s.verifyValue(key, it); corrupt != nil {
+					return false
+				}
+				reply.Entries = append(reply.Entries, &kvpb.KVPair{Key: key, Value: it.value})
+				return true
+			}
+			reply.CommonPrefixes = append(reply.CommonPrefixes, name)
+			from, more = prefixSuccessor(name), true
+			return false
+		})
+		more = more && from != "" && corrupt == nil
+	}
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return reply, nil
+}
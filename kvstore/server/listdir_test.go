@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestListDirRollsUpChildrenAndPages(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	for i, key := range []string{"a/1", "a/b/x", "a/b/y", "a/c/z/deep", "a/d", "ab", "b/1"} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, fmt.Sprintf("put-%d", i)))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: "v"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	list := func(req *kvpb.ListDirRequest) string {
+		t.Helper()
+		resp, err := srv.ListDir(context.Background(), req)
+		if err != nil {
+			t.Fatalf("ListDir(%v) failed: %v", req, err)
+		}
+		out := fmt.Sprintf("%v", resp.CommonPrefixes)
+		for _, e := range resp.Entries {
+			out += " " + e.Key
+		}
+		if resp.Truncated {
+			out += " +"
+		}
+		return out
+	}
+	if got, want := list(&kvpb.ListDirRequest{Prefix: "a/"}), "[a/b/ a/c/] a/1 a/d"; got != want {
+		t.Fatalf("ListDir(a/) = %q, want %q", got, want)
+	}
+	if got, want := list(&kvpb.ListDirRequest{}), "[a/ b/] ab"; got != want {
+		t.Fatalf("ListDir() = %q, want %q", got, want)
+	}
+	if got, want := list(&kvpb.ListDirRequest{Prefix: "a/", Limit: 2}), "[a/b/] a/1 +"; got != want {
+		t.Fatalf("first page = %q, want %q", got, want)
+	}
+	if got, want := list(&kvpb.ListDirRequest{Prefix: "a/", Limit: 2, StartAfter: "a/b/"}), "[a/c/] a/d"; got != want {
+		t.Fatalf("second page = %q, want %q", got, want)
+	}
+}
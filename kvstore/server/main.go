@@ -6,41 +6,141 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unique"
 
 	"github.com/google/btree"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	kvpb "madkv/kvstore/gen/kvpb"
+	"madkv/kvstore/internal/buildinfo"
+	"madkv/kvstore/walformat"
 	_ "modernc.org/sqlite"
 )
 
 type item struct {
-	key   string
-	value string
+	// key is the item's key, less its prefix if prefix is set; fullKey
+	// returns the whole key. A lookup can leave prefix unset.
+	prefix unique.Handle[string]
+	key    string
+	value  string
+
+	// tombstone marks a deleted key that is kept until tombstone GC purges
+	// it; deletedSeq and deletedAt identify the delete that created it.
+	// A soft-deleted tombstone keeps its value, which Undelete may restore
+	// until undeleteUntil.
+	tombstone     bool
+	deletedSeq    uint64
+	deletedAt     int64
+	undeleteUntil int64
+
+	// deleteAt is the scheduled deletion time of a live key, or 0.
+	deleteAt int64
+
+	// hvc is the version of the value or tombstone in a multi-writer
+	// mirror, and nil otherwise. It is replaced, never modified.
+	hvc hvc
+
+	// vtype is the value's type and contentType the media type it was
+	// tagged with; a soft-deleted tombstone keeps both with the value.
+	vtype       kvpb.ValueType
+	contentType string
+
+	// writtenSeq is the log index of the write that left a live value, or
+	// 0 if that is not known, as for a value restored from a snapshot
+	// older than the field.
+	writtenSeq uint64
+
+	// checksum is the CRC-32C of value, which reads check it against; a
+	// soft-deleted tombstone keeps it with the value.
+	checksum uint32
 }
 
-func (a item) Less(b btree.Item) bool { return a.key < b.(item).key }
+func itemLess(a, b item) bool {
+	if a.prefix == b.prefix {
+		return a.key < b.key
+	}
+	return splitLess(a.sharedPrefix(), a.key, b.sharedPrefix(), b.key)
+}
+
+// newItemTree returns an empty index. Items are stored by value, so lookups
+// with a stack-allocated item{key: k} do not allocate.
+func newItemTree() *btree.BTreeG[item] { return btree.NewG(8, itemLess) }
 
 const (
-	dbFileName           = "commands.db"
+	dbFileName           = walformat.DBFileName
 	requestIDMetadataKey = "x-request-id"
 	roleFollower         = "follower"
 	roleCandidate        = "candidate"
 	roleLeader           = "leader"
+
+	// maxAppendBytes caps the entries sent in one AppendEntries call, keeping
+	// it under gRPC's default 4 MiB message limit. A single larger entry is
+	// still sent on its own.
+	maxAppendBytes = 2 * 1024 * 1024
+
+	// apiVersion is bumped whenever the KVS service changes incompatibly.
+	apiVersion = 1
+)
+
+// Optional features advertised through the Capabilities RPC. Clients check
+// for these names before using the matching RPCs, so older servers simply
+// leave them out. Change streams are "watch", and per-namespace quotas and
+// usage are "quotas"; Batch, the only atomic multi-key write, is "batch".
+// "transactions" stays reserved for interactive transactions, which are
+// not built yet.
+const (
+	featureServerInfo   = "server_info"
+	featureRequestDedup = "request_dedup"
+	featurePing         = "ping"
+	featureAdminStats   = "admin_stats"
+	featureCompaction   = "compaction"
+	featureQuotas       = "quotas"
+	featureDeleteAt     = "scheduled_delete"
+	featureTTL          = "ttl"
+	featureSampling     = "sampling"
+	featureRangeStats   = "range_stats"
+	featureIterate      = "iterate"
+	featureIngest       = "ingest"
+	featureEphemeral    = "ephemeral"
+	featureListDir      = "list_dir"
+	featureReplication  = "replication_status"
+	featureTransfer     = "leadership_transfer"
+	featureDurability   = "durability_levels"
+	featureMirror       = "mirror"
+	featureScanSnapshot = "scan_snapshots"
+	featureDrain        = "drain"
+	featureWatch        = "watch"
+	featureUndelete     = "undelete"
+	featureRename       = "rename"
+	featureGetOrPut     = "get_or_put"
+	featureBatch        = "batch"
+	featureMerge        = "merge"
+	featureCacheLeases  = "cache_leases"
+	featureHistogram    = "keyspace_histogram"
+	featureQuery        = "query"
+	featureJSONPaths    = "json_paths"
+	featureKeyMeta      = "key_meta"
+	featureIterPrefix   = "iterate_prefix"
+	featureScrub        = "scrub"
+	featureBackup       = "backup"
+	featureCopyRange    = "copy_range"
 )
 
 type cachedMutation struct {
@@ -50,6 +150,26 @@ type cachedMutation struct {
 	found       bool
 	oldValue    string
 	hasOldValue bool
+	seq         uint64
+	deleteAt    int64
+	ttl         int64
+	// newKey and overwrite are a rename's target and whether it may
+	// replace a live value there.
+	newKey    string
+	overwrite bool
+	// mergeOperator is a merge's operator and merged the value it left,
+	// with found reporting whether the operand was folded in.
+	mergeOperator string
+	merged        string
+	// valueType is the type a put or swap asked for, and typeMismatch is
+	// set if it was refused because of the key's type when it applied.
+	valueType    kvpb.ValueType
+	typeMismatch bool
+	// writeOnceKey is the existing write-once key the write would have
+	// changed, if it was refused for that when it applied.
+	writeOnceKey string
+	// batch holds a batch's result for each of its operations.
+	batch []cachedMutation
 }
 
 type applyResult struct {
@@ -62,7 +182,7 @@ type kvServer struct {
 	kvpb.UnimplementedRaftPeerServer
 
 	mu            sync.Mutex
-	tree          *btree.BTree
+	tree          *btree.BTreeG[item]
 	db            *sql.DB
 	partitionID   int
 	replicaID     int
@@ -72,8 +192,12 @@ type kvServer struct {
 
 	peerReplicaIDs []int
 	peerP2PAddrs   map[int]string
-	peerClients    map[int]kvpb.RaftPeerClient
-	peerConns      map[int]*grpc.ClientConn
+	// learners and witnesses hold the IDs of replicas that do not vote or
+	// keep no data; see membership.go.
+	learners    map[int]bool
+	witnesses   map[int]bool
+	peerClients map[int]kvpb.RaftPeerClient
+	peerConns   map[int]*grpc.ClientConn
 
 	rng *rand.Rand
 
@@ -83,18 +207,167 @@ type kvServer struct {
 	leaderID    int
 	leaderAddr  string
 
-	logEntries  []*kvpb.RaftLogEntry
-	commitIndex uint64
-	lastApplied uint64
+	// logEntries holds the log after logBase; entries up to logBase were
+	// compacted into the snapshot at snapshotIndex >= logBase.
+	logEntries    []*kvpb.RaftLogEntry
+	logBase       uint64
+	logBaseTerm   uint64
+	snapshotIndex uint64
+	commitIndex   uint64
+	lastApplied   uint64
 
 	nextIndex  map[int]uint64
 	matchIndex map[int]uint64
+	// peerApplied and peerContact hold each follower's last reported applied
+	// index and when it last answered; the leader resets them on election.
+	peerApplied map[int]uint64
+	peerContact map[int]time.Time
+	// peerAckSent is when the leader sent the latest message each follower
+	// has answered in the current term; see readBarrier.
+	peerAckSent map[int]time.Time
+	ackSignal   chan struct{}
 
 	lastContact      time.Time
 	electionDeadline time.Time
+	// leaderContact is when this follower last accepted an append from the
+	// leader.
+	leaderContact time.Time
+	// started is when this replica came up; see shouldIgnoreVoteLocked.
+	started time.Time
+
+	// transferTarget is the replica a leadership transfer is handing over
+	// to, or -1; writes are refused while it is set. transferElection marks
+	// the next election as one the leader asked for.
+	transferTarget   int
+	transferElection bool
+	// leaseFloor voids leases granted by acknowledgements of messages sent
+	// before it; a transfer that gives up sets it, as its target may still
+	// win an election.
+	leaseFloor time.Time
+
+	readMode          string
+	readLease         time.Duration
+	clockSuspectUntil time.Time
+	leaseReads        uint64
+	readIndexReads    uint64
+	leaseFallbacks    uint64
+	clockSuspicions   uint64
 
 	dedup   map[string]cachedMutation
 	waiters map[uint64][]chan applyResult
+	// appendTimer times the log write of the client command being
+	// appended, while submitCommand holds mu to append it.
+	appendTimer *opTimer
+
+	liveKeys           int
+	tombstones         int
+	usage              map[string]namespaceUsage
+	quotas             map[string]namespaceQuota
+	tombstonesPurged   uint64
+	tombstoneRetention time.Duration
+	// tombstoneCursor is the key the next tombstone GC pass starts at.
+	tombstoneCursor string
+	// demoted holds the bytes each key tiering dropped from memory is still
+	// charged to its namespace; demotedBytes is their sum.
+	demoted      map[string]int64
+	demotedBytes int64
+	// softDeleteRetention is how long a Delete the leader logs can be
+	// undone with Undelete; 0 turns soft delete off.
+	softDeleteRetention time.Duration
+	replicatedIndex     uint64
+
+	// deadlines orders live keys with a scheduled deletion by deleteAt.
+	deadlines        *btree.BTree
+	scheduledDeletes uint64
+
+	// histogram backs RangeStats; histogramDrift counts writes since it
+	// was built.
+	histogram      *rangeHistogram
+	histogramDrift int
+
+	scanCache     *scanCache
+	cacheLeases   *cacheLeases
+	accessStats   *accessStats
+	tier          *tiering
+	scrub         *scrubber
+	keyPrefixes   *keyInterner
+	scanSnapshots *scanSnapshots
+	keyPolicy     *keyPolicy
+	// redact is the --redact_values and --redact_keys policy.
+	redact redaction
+	// writeOnce are the --write_once_prefixes.
+	writeOnce []string
+
+	// adminAddr is where the Admin service listens if not beside KVS.
+	adminAddr string
+	// oidc authenticates KVS callers, with --oidc_issuer.
+	oidc *oidcVerifier
+
+	// backerDir is empty for an ephemeral server, which keeps its raft
+	// state in an in-memory database and its snapshot in memSnapshot.
+	backerDir       string
+	memSnapshot     *snapshotState
+	compactor       *compactionScheduler
+	load            loadTracker
+	busyInflight    int64
+	compactionBytes atomic.Int64
+	admission       *admissionController
+
+	// snapshotRecv is a snapshot being received from the leader;
+	// snapshotSending marks the peers the leader is sending one to.
+	snapshotRecv    *snapshotReceive
+	snapshotSending map[int]bool
+
+	// checksumFailures counts reads that found a value not matching its
+	// checksum.
+	checksumFailures atomic.Uint64
+
+	// backing is the store this server caches, if any; loads collapses
+	// concurrent read-through loads of one key.
+	backing            BackingStore
+	loads              flightGroup[bool]
+	backingLoads       atomic.Uint64
+	backingLoadsShared atomic.Uint64
+	backingErrors      atomic.Uint64
+
+	// feeds ship committed entries to change sinks (CDC, webhooks).
+	feeds []*cdcPublisher
+
+	// mirrorFeed ships to a standby cluster on a mirror source.
+	// mirrorStandby refuses client writes until a committed
+	// OP_MIRROR_PROMOTE sets mirrorPromoted; mirrorSourceSeq is the last
+	// source log index applied. Both are part of the applied state.
+	mirrorFeed      *cdcPublisher
+	mirrorStandby   bool
+	mirrorPromoted  bool
+	mirrorSourceSeq uint64
+	mirrorChanges   atomic.Uint64
+	mirrorLastBatch time.Time
+
+	// clusterID enables multi-writer mirroring (see conflict.go). hlc is
+	// the hybrid logical clock and conflicts counts resolutions.
+	clusterID      string
+	conflictPolicy conflictPolicy
+	hlc            int64
+	conflicts      map[string]uint64
+	mergeJobs      chan mergeJob
+
+	watchers *watchHub
+	// recovery is set while newKVServer rebuilds state from disk.
+	recovery *recoveryProgress
+
+	// drain tracks a maintenance drain; health is the API port's health
+	// service, which a drain marks as not serving.
+	drain  *drainState
+	health *health.Server
+
+	// meter counts per-namespace traffic for usage reports.
+	meter *meter
+	// metricNamespaces, if set, is the namespaces metrics label on their
+	// own; the rest are summed under otherNamespace.
+	metricNamespaces map[string]bool
+
+	chaos *chaosConfig
 }
 
 func (s *kvServer) logf(format string, args ...interface{}) {
@@ -102,13 +375,18 @@ func (s *kvServer) logf(format string, args ...interface{}) {
 	log.Printf(prefix+format, args...)
 }
 
+// ownerForKey hashes key with 32-bit FNV-1a, the same as the client. It is
+// computed inline because hash/fnv would allocate on every read.
 func ownerForKey(key string, numPartitions int) int {
 	if numPartitions <= 1 {
 		return 0
 	}
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(key))
-	return int(h.Sum32() % uint32(numPartitions))
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(numPartitions))
 }
 
 func parseCommaList(raw string) []string {
@@ -126,15 +404,26 @@ func parseCommaList(raw string) []string {
 	return out
 }
 
-func newKVServer(backerDir string, partitionID, replicaID, serverRF, numPartitions int, apiAddr string, peerAddrs []string) (*kvServer, error) {
-	if err := os.MkdirAll(backerDir, 0o755); err != nil {
-		return nil, fmt.Errorf("create backer directory: %w", err)
+// newKVServer opens the server's state in backerDir, or only in memory if
+// backerDir is empty. clusterID is the --cluster_id of a multi-writer
+// mirror, or empty; it is needed before the log is replayed, which resolves
+// versioned writes against each other as they were resolved at first.
+func newKVServer(backerDir string, partitionID, replicaID, serverRF, numPartitions int, apiAddr string, peerAddrs []string, clusterID string) (*kvServer, error) {
+	dbPath := ":memory:"
+	if backerDir != "" {
+		if err := os.MkdirAll(backerDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create backer directory: %w", err)
+		}
+		dbPath = filepath.Join(backerDir, dbFileName)
 	}
-	dbPath := filepath.Join(backerDir, dbFileName)
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite db: %w", err)
 	}
+	if backerDir == "" {
+		// Every connection to :memory: is a separate database.
+		db.SetMaxOpenConns(1)
+	}
 
 	peerReplicaIDs := make([]int, 0, len(peerAddrs))
 	peerP2PAddrs := make(map[int]string, len(peerAddrs))
@@ -157,7 +446,9 @@ func newKVServer(backerDir string, partitionID, replicaID, serverRF, numPartitio
 	}
 
 	s := &kvServer{
-		tree:           btree.New(8),
+		backerDir:      backerDir,
+		tree:           newItemTree(),
+		deadlines:      btree.New(8),
 		db:             db,
 		partitionID:    partitionID,
 		replicaID:      replicaID,
@@ -174,39 +465,86 @@ func newKVServer(backerDir string, partitionID, replicaID, serverRF, numPartitio
 		votedFor:       -1,
 		nextIndex:      make(map[int]uint64, serverRF),
 		matchIndex:     make(map[int]uint64, serverRF),
+		peerApplied:    make(map[int]uint64, serverRF),
+		peerContact:    make(map[int]time.Time, serverRF),
+		peerAckSent:    make(map[int]time.Time, serverRF),
+		ackSignal:      make(chan struct{}),
+		readMode:       readModeLeader,
+		transferTarget: -1,
+		clusterID:      clusterID,
 		dedup:          make(map[string]cachedMutation),
+		conflicts:      make(map[string]uint64),
+		mergeJobs:      make(chan mergeJob, mergeQueueDepth),
+		watchers:       newWatchHub(defaultWatchBuffer),
+		drain:          newDrainState(),
+		meter:          newMeter(defaultMeteringWindow),
+		usage:          make(map[string]namespaceUsage),
 		waiters:        make(map[uint64][]chan applyResult),
 	}
+	s.compactor = newCompactionScheduler(0, func() bool {
+		limit := atomic.LoadInt64(&s.busyInflight)
+		return limit > 0 && s.load.inflight.Load() >= limit
+	})
 	if err := s.initDB(); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
-	if err := s.loadPersistentState(); err != nil {
-		_ = db.Close()
-		return nil, err
+	if !s.ephemeral() {
+		s.recovery = &startupRecovery
+		err := s.loadPersistentState()
+		s.recovery = nil
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
 	}
+	startupRecovery.finish()
 	s.resetElectionDeadlineLocked()
 	s.lastContact = time.Now()
+	s.started = s.lastContact
 	s.logf("initialized api=%s peers=%v", s.apiAddr, s.peerP2PAddrs)
 	return s, nil
 }
 
+// ephemeral reports whether the server runs without durable state.
+func (s *kvServer) ephemeral() bool {
+	return s.backerDir == ""
+}
+
+// resolveDataDir returns the directory the server keeps durable state in:
+// backerDir, or "" under --ephemeral. It refuses --ephemeral on a
+// replicated partition: a restarted ephemeral replica has lost its log and
+// the votes it cast, so it could vote twice in one term or help elect a
+// leader that is missing committed writes.
+func resolveDataDir(backerDir string, ephemeral bool, serverRF int, peerAddrs []string) (string, error) {
+	if !ephemeral {
+		return backerDir, nil
+	}
+	if serverRF > 1 || len(peerAddrs) > 0 {
+		return "", fmt.Errorf("--ephemeral needs a single-replica partition, but server rf is %d with %d peers", serverRF, len(peerAddrs))
+	}
+	return "", nil
+}
+
 func (s *kvServer) initDB() error {
-	if _, err := s.db.Exec(`
-		PRAGMA journal_mode = WAL;
-		PRAGMA synchronous = FULL;
-		CREATE TABLE IF NOT EXISTS raft_meta (
-			key TEXT PRIMARY KEY,
-			value TEXT NOT NULL
-		);
-		CREATE TABLE IF NOT EXISTS raft_log (
-			log_index INTEGER PRIMARY KEY,
-			term INTEGER NOT NULL,
-			payload BLOB NOT NULL
-		);
-	`); err != nil {
+	if _, err := s.db.Exec(walformat.Pragmas + walformat.Schema); err != nil {
 		return fmt.Errorf("initialize sqlite schema: %w", err)
 	}
+	format, err := walformat.Detect(s.db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case format == walformat.Empty:
+		// A new log, or an old layout with nothing in it yet.
+		if _, err := walformat.Migrate(s.db, nil); err != nil {
+			return err
+		}
+	case format > walformat.Current:
+		return fmt.Errorf("raft log in %s is in format %s, written by a newer server; this one reads format %s", s.backerDir, walformat.Name(format), walformat.Name(walformat.Current))
+	case format < walformat.Current:
+		return fmt.Errorf("raft log in %s is in format %s; stop the server and run kvmigrate --backer_path %s to upgrade it to format %s", s.backerDir, walformat.Name(format), s.backerDir, walformat.Name(walformat.Current))
+	}
 	return nil
 }
 
@@ -252,8 +590,24 @@ func (s *kvServer) loadPersistentState() error {
 		}
 		s.commitIndex = commit
 	}
+	for name, dst := range map[string]*uint64{"log_base": &s.logBase, "log_base_term": &s.logBaseTerm} {
+		if v := meta[name]; v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("parse %s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
 
-	logRows, err := s.db.Query(`SELECT log_index, term, payload FROM raft_log ORDER BY log_index ASC`)
+	var lastIndex sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(log_index) FROM raft_log`).Scan(&lastIndex); err != nil {
+		return fmt.Errorf("query raft_log: %w", err)
+	}
+	if uint64(lastIndex.Int64) > s.logBase {
+		s.recovery.begin(recoveryReadingLog, uint64(lastIndex.Int64)-s.logBase)
+	}
+	logRows, err := s.db.Query(`SELECT log_index, term, payload, crc FROM raft_log WHERE log_index > ? ORDER BY log_index ASC`, s.logBase)
 	if err != nil {
 		return fmt.Errorf("query raft_log: %w", err)
 	}
@@ -263,9 +617,13 @@ func (s *kvServer) loadPersistentState() error {
 		var idx uint64
 		var term uint64
 		var payload []byte
-		if err := logRows.Scan(&idx, &term, &payload); err != nil {
+		var crc uint32
+		if err := logRows.Scan(&idx, &term, &payload, &crc); err != nil {
 			return fmt.Errorf("scan raft_log row: %w", err)
 		}
+		if err := walformat.Verify(idx, payload, crc); err != nil {
+			return err
+		}
 		var cmd kvpb.ClientCommand
 		if err := proto.Unmarshal(payload, &cmd); err != nil {
 			return fmt.Errorf("decode raft payload: %w", err)
@@ -275,6 +633,7 @@ func (s *kvServer) loadPersistentState() error {
 			Term:    term,
 			Command: &cmd,
 		})
+		s.recovery.advance()
 	}
 	if err := logRows.Err(); err != nil {
 		return fmt.Errorf("iterate raft_log rows: %w", err)
@@ -286,6 +645,7 @@ func (s *kvServer) loadPersistentState() error {
 }
 
 func (s *kvServer) persistMetaLocked(key, value string) error {
+	s.chaos.stallFsync()
 	_, err := s.db.Exec(`INSERT INTO raft_meta(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
 	if err != nil {
 		return fmt.Errorf("persist meta %s: %w", key, err)
@@ -293,12 +653,34 @@ func (s *kvServer) persistMetaLocked(key, value string) error {
 	return nil
 }
 
+// logBufPool holds encode buffers for log entries. sqlite copies bound
+// blobs, so a buffer can be reused as soon as the insert returns.
+var logBufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledLogBuf keeps the occasional huge entry, such as an ingest batch,
+// from pinning its buffer in the pool.
+const maxPooledLogBuf = 1 << 20
+
 func (s *kvServer) persistLogEntryLocked(entry *kvpb.RaftLogEntry) error {
-	payload, err := proto.Marshal(entry.Command)
+	buf := logBufPool.Get().(*[]byte)
+	defer func() {
+		if cap(*buf) <= maxPooledLogBuf {
+			logBufPool.Put(buf)
+		}
+	}()
+	payload, err := proto.MarshalOptions{}.MarshalAppend((*buf)[:0], entry.Command)
 	if err != nil {
 		return fmt.Errorf("marshal log entry: %w", err)
 	}
-	if _, err := s.db.Exec(`INSERT INTO raft_log(log_index, term, payload) VALUES(?, ?, ?) ON CONFLICT(log_index) DO UPDATE SET term = excluded.term, payload = excluded.payload`, entry.Index, entry.Term, payload); err != nil {
+	s.appendTimer.mark(phaseWALAppend)
+	defer s.appendTimer.mark(phaseFsync)
+	*buf = payload
+	if payload == nil {
+		// Witness entries have no command; payload is NOT NULL.
+		payload = []byte{}
+	}
+	s.chaos.stallFsync()
+	if _, err := s.db.Exec(walformat.AppendSQL, entry.Index, entry.Term, payload, walformat.Checksum(payload)); err != nil {
 		return fmt.Errorf("persist log entry %d: %w", entry.Index, err)
 	}
 	return nil
@@ -308,12 +690,15 @@ func (s *kvServer) deleteLogSuffixLocked(fromIndex uint64) error {
 	if fromIndex == 0 {
 		return nil
 	}
+	if fromIndex <= s.snapshotIndex {
+		return fmt.Errorf("cannot truncate log at %d: entries up to %d are in the snapshot", fromIndex, s.snapshotIndex)
+	}
 	needRebuild := fromIndex <= s.lastApplied
 	if _, err := s.db.Exec(`DELETE FROM raft_log WHERE log_index >= ?`, fromIndex); err != nil {
 		return fmt.Errorf("delete log suffix from %d: %w", fromIndex, err)
 	}
-	if fromIndex <= uint64(len(s.logEntries)) {
-		s.logEntries = s.logEntries[:fromIndex-1]
+	if fromIndex <= s.lastLogIndexLocked() {
+		s.logEntries = s.logEntries[:fromIndex-s.logBase-1]
 	}
 	if s.commitIndex >= fromIndex {
 		s.commitIndex = fromIndex - 1
@@ -331,31 +716,43 @@ func (s *kvServer) deleteLogSuffixLocked(fromIndex uint64) error {
 }
 
 func (s *kvServer) lastLogIndexLocked() uint64 {
-	if len(s.logEntries) == 0 {
-		return 0
-	}
-	return s.logEntries[len(s.logEntries)-1].Index
+	return s.logBase + uint64(len(s.logEntries))
 }
 
 func (s *kvServer) lastLogTermLocked() uint64 {
 	if len(s.logEntries) == 0 {
-		return 0
+		return s.logBaseTerm
 	}
 	return s.logEntries[len(s.logEntries)-1].Term
 }
 
+// logTermLocked returns the term of the entry at index, or 0 if it is past
+// the end of the log or was compacted away.
 func (s *kvServer) logTermLocked(index uint64) uint64 {
-	if index == 0 {
+	if index == 0 || index > s.lastLogIndexLocked() || index < s.logBase {
 		return 0
 	}
-	if index > uint64(len(s.logEntries)) {
-		return 0
+	if index == s.logBase {
+		return s.logBaseTerm
 	}
-	return s.logEntries[index-1].Term
+	return s.logEntries[index-s.logBase-1].Term
+}
+
+// entryLocked returns the stored entry at index, which must lie in
+// (logBase, lastLogIndex].
+func (s *kvServer) entryLocked(index uint64) *kvpb.RaftLogEntry {
+	return s.logEntries[index-s.logBase-1]
 }
 
+const (
+	heartbeatInterval = 150 * time.Millisecond
+	// minElectionTimeout is the shortest time a follower waits without
+	// hearing from the leader before it stands for election.
+	minElectionTimeout = 2000 * time.Millisecond
+)
+
 func (s *kvServer) resetElectionDeadlineLocked() {
-	timeout := time.Duration(2000+s.rng.Intn(2000)) * time.Millisecond
+	timeout := minElectionTimeout + time.Duration(s.rng.Intn(2000))*time.Millisecond
 	s.electionDeadline = time.Now().Add(timeout)
 }
 
@@ -375,6 +772,7 @@ func (s *kvServer) becomeFollowerLocked(term uint64, leaderID int, leaderAddr st
 	s.role = roleFollower
 	s.leaderID = leaderID
 	s.leaderAddr = leaderAddr
+	s.transferTarget = -1
 	s.lastContact = time.Now()
 	s.resetElectionDeadlineLocked()
 	s.logf("became follower from role=%s prev_term=%d leader=%d leader_addr=%s", prevRole, prevTerm, leaderID, leaderAddr)
@@ -392,6 +790,10 @@ func (s *kvServer) becomeLeaderLocked() {
 	}
 	s.matchIndex[s.replicaID] = s.lastLogIndexLocked()
 	s.nextIndex[s.replicaID] = s.lastLogIndexLocked() + 1
+	clear(s.peerApplied)
+	clear(s.peerContact)
+	clear(s.peerAckSent)
+	s.transferTarget = -1
 	s.resetElectionDeadlineLocked()
 	log.Printf("partition %d replica %d became leader for term %d", s.partitionID, s.replicaID, s.currentTerm)
 	if _, _, err := s.appendLocalEntryLocked(&kvpb.ClientCommand{
@@ -423,7 +825,7 @@ func (s *kvServer) resetPeerClient(replicaID int) {
 }
 
 func notLeaderError(addr string) error {
-	return status.Errorf(codes.FailedPrecondition, "not leader: %s", addr)
+	return reasonError(codes.FailedPrecondition, reasonNotLeader, map[string]string{"leader_addr": addr}, "not leader: %s", addr)
 }
 
 func parseMutationRequestID(ctx context.Context) (string, bool, error) {
@@ -450,36 +852,223 @@ func commandsEqual(a, b *kvpb.ClientCommand) bool {
 }
 
 func validateCachedMutation(cached cachedMutation, wal *kvpb.WALCommand) error {
-	if cached.op != wal.Op || cached.key != wal.Key || cached.value != wal.Value {
+	// An undelete's or rename's value is filled in by the leader, not the
+	// client.
+	leaderValue := wal.Op == kvpb.WALCommand_OP_UNDELETE || wal.Op == kvpb.WALCommand_OP_RENAME
+	valueDiffers := cached.value != wal.Value && !leaderValue
+	if cached.op != wal.Op || cached.key != wal.Key || valueDiffers || cached.deleteAt != wal.DeleteAt || cached.ttl != wal.TtlNanos ||
+		cached.newKey != wal.NewKey || cached.overwrite != wal.Overwrite || cached.mergeOperator != wal.MergeOperator ||
+		cached.valueType != wal.ValueType {
 		return status.Errorf(codes.AlreadyExists, "request id reused with different operation")
 	}
-	return nil
+	return validateCachedBatch(cached, wal)
+}
+
+// answerUnloggedLocked answers a conditional write that applied state shows
+// would change nothing, so it is not logged, and prepares those that will
+// be. It reports whether the write was answered.
+func (s *kvServer) answerUnloggedLocked(wal *kvpb.WALCommand) (cachedMutation, bool) {
+	switch wal.Op {
+	case kvpb.WALCommand_OP_RENAME:
+		return s.stampRenameLocked(wal)
+	case kvpb.WALCommand_OP_GET_OR_PUT:
+		if prev, found := s.getLiveLocked(wal.Key); found {
+			return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: true, oldValue: prev.value, hasOldValue: true}, true
+		}
+	}
+	return cachedMutation{}, false
 }
 
 func (s *kvServer) validateKeyOwner(key string) error {
 	if ownerForKey(key, s.numPartitions) != s.partitionID {
-		return status.Errorf(codes.FailedPrecondition, "wrong partition for key %q", key)
+		return reasonError(codes.FailedPrecondition, reasonWrongPartition, map[string]string{"key": s.redact.key(key), "partition": strconv.Itoa(s.partitionID)}, "wrong partition for key %q", s.redact.key(key))
 	}
 	return nil
 }
 
-func (s *kvServer) applyWALLocked(wal *kvpb.WALCommand) cachedMutation {
+// getLiveLocked returns the stored item for key, ignoring tombstones.
+func (s *kvServer) getLiveLocked(key string) (item, bool) {
+	got, ok := s.tree.Get(item{key: key})
+	if !ok || got.tombstone {
+		return item{}, false
+	}
+	return got, true
+}
+
+// putLocked stores a live string value written by the entry at seq,
+// replacing a value or tombstone for key.
+func (s *kvServer) putLocked(key, value string, seq uint64) {
+	s.putTypedLocked(key, value, kvpb.ValueType_VALUE_TYPE_STRING, "", seq)
+}
+
+// putTypedLocked is putLocked for a value of type vt, which the caller has
+// checked with writeTypeLocked where that applies, tagged with contentType.
+func (s *kvServer) putTypedLocked(key, value string, vt kvpb.ValueType, contentType string, seq uint64) {
+	s.putCheckedLocked(key, value, vt, contentType, valueChecksum(value), seq)
+}
+
+// putCheckedLocked is putTypedLocked for a value whose checksum is already
+// known, as one a client sent or one moving from another key.
+func (s *kvServer) putCheckedLocked(key, value string, vt kvpb.ValueType, contentType string, sum uint32, seq uint64) {
+	next := s.keyPrefixes.item(key)
+	next.value, next.vtype, next.contentType, next.writtenSeq, next.checksum = value, vt, contentType, seq, sum
+	prev, replaced := s.tree.ReplaceOrInsert(next)
+	if replaced {
+		s.keyPrefixes.removedLocked(prev)
+	}
+	s.keyPrefixes.addedLocked(next)
+	s.histogramDrift++
+	s.scanCache.invalidate(key)
+	s.cacheLeases.invalidate(key)
+	s.accessStats.wroteLocked(key)
+	if replaced {
+		s.unscheduleLocked(prev)
+	}
+	switch {
+	case !replaced:
+		s.undemoteLocked(key)
+		s.liveKeys++
+		s.chargeLocked(key, 1, int64(len(key)+len(value)))
+	case prev.tombstone:
+		s.tombstones--
+		s.liveKeys++
+		s.chargeLocked(key, 1, int64(len(key)+len(value)))
+	default:
+		s.chargeLocked(key, 0, int64(len(value)-len(prev.value)))
+	}
+}
+
+// deleteLocked replaces a live value with a tombstone, which keeps the value
+// if undeleteUntil is set.
+func (s *kvServer) deleteLocked(prev item, seq uint64, at, undeleteUntil int64) {
+	tomb := item{prefix: prev.prefix, key: prev.key, tombstone: true, deletedSeq: seq, deletedAt: at}
+	if undeleteUntil != 0 {
+		tomb.value, tomb.undeleteUntil, tomb.vtype, tomb.contentType, tomb.checksum = prev.value, undeleteUntil, prev.vtype, prev.contentType, prev.checksum
+	}
+	s.tree.ReplaceOrInsert(tomb)
+	s.unscheduleLocked(prev)
+	key := prev.fullKey()
+	s.histogramDrift++
+	s.scanCache.invalidate(key)
+	s.cacheLeases.invalidate(key)
+	s.accessStats.forgetLocked(key)
+	s.liveKeys--
+	s.tombstones++
+	s.chargeLocked(key, -1, -int64(len(key)+len(prev.value)))
+}
+
+func (s *kvServer) applyWALLocked(wal *kvpb.WALCommand, seq uint64) cachedMutation {
+	if wal.Op == kvpb.WALCommand_OP_MERGE && wal.MirrorSeq != 0 && wal.MirrorSeq <= s.mirrorSourceSeq {
+		// A mirror batch sent again must not fold its operands twice.
+		it, _ := s.getLiveLocked(wal.Key)
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, mergeOperator: wal.MergeOperator, merged: it.value}
+	}
+	if wal.MirrorSeq > s.mirrorSourceSeq {
+		s.mirrorSourceSeq = wal.MirrorSeq
+	}
+	if key, refused := s.writeOnceConflictLocked(wal); refused {
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: true, valueType: wal.ValueType,
+			deleteAt: wal.DeleteAt, ttl: wal.TtlNanos, newKey: wal.NewKey, overwrite: wal.Overwrite, mergeOperator: wal.MergeOperator, writeOnceKey: key}
+	}
+	if s.multiWriterLocked(wal) && wal.Hvc != nil {
+		version, apply := s.resolveConflictLocked(wal)
+		if !apply {
+			_, found := s.getLiveLocked(wal.Key)
+			return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found}
+		}
+		defer s.setVersionLocked(wal.Key, version)
+	}
 	switch wal.Op {
 	case kvpb.WALCommand_OP_PUT:
-		prev := s.tree.Get(item{key: wal.Key})
-		_ = s.tree.ReplaceOrInsert(item{key: wal.Key, value: wal.Value})
-		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: prev != nil}
+		_, found := s.getLiveLocked(wal.Key)
+		res := cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found, valueType: wal.ValueType}
+		vt, err := s.writeTypeLocked(wal.Key, wal.Value, wal.ValueType)
+		if err != nil {
+			res.typeMismatch = true
+			return res
+		}
+		s.putCheckedLocked(wal.Key, wal.Value, vt, wal.ContentType, walChecksum(wal), seq)
+		return res
 	case kvpb.WALCommand_OP_SWAP:
-		prev := s.tree.Get(item{key: wal.Key})
-		_ = s.tree.ReplaceOrInsert(item{key: wal.Key, value: wal.Value})
-		if prev == nil {
-			return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: false}
+		prev, found := s.getLiveLocked(wal.Key)
+		res := cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found, valueType: wal.ValueType}
+		if found {
+			res.oldValue, res.hasOldValue = prev.value, true
 		}
-		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: true, oldValue: prev.(item).value, hasOldValue: true}
+		vt, err := s.writeTypeLocked(wal.Key, wal.Value, wal.ValueType)
+		if err != nil {
+			res.typeMismatch = true
+			return res
+		}
+		s.putCheckedLocked(wal.Key, wal.Value, vt, wal.ContentType, walChecksum(wal), seq)
+		return res
 	case kvpb.WALCommand_OP_DELETE:
-		prev := s.tree.Get(item{key: wal.Key})
-		_ = s.tree.Delete(item{key: wal.Key})
-		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: prev != nil}
+		prev, found := s.getLiveLocked(wal.Key)
+		if found {
+			s.deleteLocked(prev, seq, wal.UnixNanos, wal.UndeleteUntil)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found}
+	case kvpb.WALCommand_OP_UNDELETE:
+		tomb, found := s.undeletableLocked(wal.Key, wal.UnixNanos)
+		if found {
+			s.putCheckedLocked(tomb.fullKey(), tomb.value, tomb.vtype, tomb.contentType, tomb.checksum, seq)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, value: tomb.value, found: found}
+	case kvpb.WALCommand_OP_RENAME:
+		return s.renameLocked(wal, seq)
+	case kvpb.WALCommand_OP_MERGE:
+		return s.mergeLocked(wal, seq)
+	case kvpb.WALCommand_OP_BATCH:
+		return s.applyBatchLocked(wal, seq)
+	case kvpb.WALCommand_OP_GET_OR_PUT:
+		prev, found := s.getLiveLocked(wal.Key)
+		if !found {
+			s.putLocked(wal.Key, wal.Value, seq)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, found: found, oldValue: prev.value, hasOldValue: found}
+	case kvpb.WALCommand_OP_DELETE_AT:
+		prev, found := s.getLiveLocked(wal.Key)
+		if found {
+			at := wal.DeleteAt
+			if wal.TtlNanos > 0 {
+				at = wal.UnixNanos + wal.TtlNanos
+			}
+			s.scheduleLocked(prev, at)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, found: found, deleteAt: wal.DeleteAt, ttl: wal.TtlNanos}
+	case kvpb.WALCommand_OP_PERSIST:
+		prev, found := s.getLiveLocked(wal.Key)
+		found = found && prev.deleteAt != 0
+		if found {
+			s.unscheduleLocked(prev)
+			prev.deleteAt = 0
+			s.tree.ReplaceOrInsert(prev)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, found: found}
+	case kvpb.WALCommand_OP_EVICT:
+		return s.evictLocked(wal)
+	case kvpb.WALCommand_OP_FILL:
+		if s.tree.Has(item{key: wal.Key}) {
+			return cachedMutation{op: wal.Op, key: wal.Key, found: true}
+		}
+		s.putLocked(wal.Key, wal.Value, seq)
+		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value}
+	case kvpb.WALCommand_OP_INGEST:
+		for _, p := range wal.Ingest {
+			s.putLocked(p.Key, p.Value, seq)
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, found: true}
+	case kvpb.WALCommand_OP_MIRROR_PROMOTE:
+		s.mirrorPromoted = true
+		return cachedMutation{op: wal.Op}
+	case kvpb.WALCommand_OP_EXPIRE:
+		prev, found := s.getLiveLocked(wal.Key)
+		found = found && prev.deleteAt == wal.DeleteAt && prev.deleteAt <= wal.UnixNanos
+		if found {
+			s.deleteLocked(prev, seq, wal.UnixNanos, 0)
+			s.scheduledDeletes++
+		}
+		return cachedMutation{op: wal.Op, key: wal.Key, found: found, deleteAt: wal.DeleteAt}
 	default:
 		return cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value}
 	}
@@ -497,7 +1086,8 @@ func (s *kvServer) applyEntryLocked(entry *kvpb.RaftLogEntry) (cachedMutation, e
 			return cached, nil
 		}
 	}
-	cached := s.applyWALLocked(entry.Command.Wal)
+	cached := s.applyWALLocked(entry.Command.Wal, entry.Index)
+	cached.seq = entry.Index
 	if reqID := entry.Command.RequestId; reqID != "" {
 		s.dedup[reqID] = cached
 	}
@@ -514,25 +1104,51 @@ func (s *kvServer) notifyWaitersLocked(index uint64, result applyResult) {
 }
 
 func (s *kvServer) applyCommittedEntriesLocked() error {
+	if s.witnesses[s.replicaID] {
+		// A witness keeps no commands, so there is nothing to apply.
+		s.lastApplied = s.commitIndex
+		return nil
+	}
 	for s.lastApplied < s.commitIndex {
 		s.lastApplied++
-		entry := s.logEntries[s.lastApplied-1]
+		entry := s.entryLocked(s.lastApplied)
 		cached, err := s.applyEntryLocked(entry)
 		if err != nil {
 			return err
 		}
+		if s.watchers.active.Load() > 0 {
+			s.watchers.publish(watchEvents(entry.Index, entry.Command.GetWal(), cached))
+		}
 		s.notifyWaitersLocked(entry.Index, applyResult{command: entry.Command, cached: cached})
 	}
 	return nil
 }
 
+// rebuildStateFromCommittedLocked reloads the snapshot, if any, and replays
+// the committed log after it.
 func (s *kvServer) rebuildStateFromCommittedLocked() error {
-	s.tree = btree.New(8)
-	s.dedup = make(map[string]cachedMutation)
-	s.lastApplied = 0
+	s.watchers.closeAll(status.Error(codes.Aborted, "replica state was rebuilt from its log; watch again"))
+	s.recovery.begin(recoveryLoadingSnapshot, 0)
+	if err := s.loadSnapshotLocked(); err != nil {
+		return err
+	}
+	if s.lastApplied < s.logBase {
+		return fmt.Errorf("log is compacted through %d but the snapshot only covers %d", s.logBase, s.lastApplied)
+	}
+	if s.witnesses[s.replicaID] {
+		s.lastApplied = s.commitIndex
+		return nil
+	}
+	s.recovery.begin(recoveryReplaying, s.commitIndex-s.lastApplied)
 	for s.lastApplied < s.commitIndex {
 		s.lastApplied++
-		entry := s.logEntries[s.lastApplied-1]
+		s.recovery.advance()
+		entry := s.entryLocked(s.lastApplied)
+		if entry.GetCommand().GetWal() == nil {
+			// Witnesses store entries without their commands. Replay runs
+			// before membership is known, so skip them here.
+			continue
+		}
 		cached, err := s.applyEntryLocked(entry)
 		if err != nil {
 			return err
@@ -552,11 +1168,11 @@ func (s *kvServer) maybeAdvanceCommitLocked() error {
 		}
 		votes := 1
 		for _, peerID := range s.peerReplicaIDs {
-			if s.matchIndex[peerID] >= idx {
+			if !s.learners[peerID] && s.matchIndex[peerID] >= idx {
 				votes++
 			}
 		}
-		if votes > s.serverRF/2 {
+		if votes >= s.quorum() {
 			s.commitIndex = idx
 			if err := s.persistMetaLocked("commit_index", strconv.FormatUint(s.commitIndex, 10)); err != nil {
 				return err
@@ -600,12 +1216,32 @@ func (s *kvServer) leaderReadyForReadsLocked() bool {
 }
 
 func (s *kvServer) submitCommand(ctx context.Context, command *kvpb.ClientCommand) (cachedMutation, error) {
+	level, err := durabilityFromContext(ctx)
+	if err != nil {
+		return cachedMutation{}, err
+	}
+	ctx, cancel := withTimeoutMargin(ctx)
+	defer cancel()
+	timer := newOpTimer()
 	s.mu.Lock()
+	timer.mark(phaseLockWait)
+	if ctx.Err() != nil {
+		s.mu.Unlock()
+		return cachedMutation{}, timer.timeoutError(ctx, "%s was not logged", s.describeWrite(command.Wal))
+	}
 	if s.role != roleLeader {
 		addr := s.leaderAddr
 		s.mu.Unlock()
 		return cachedMutation{}, notLeaderError(addr)
 	}
+	if s.transferTarget >= 0 {
+		s.mu.Unlock()
+		return cachedMutation{}, retryableError(codes.Unavailable, leaderChangeRetryDelay, "leadership is being transferred to replica %d", s.transferTarget)
+	}
+	if err := s.refuseStandbyWriteLocked(command.Wal); err != nil {
+		s.mu.Unlock()
+		return cachedMutation{}, err
+	}
 	if err := s.validateKeyOwner(command.Wal.Key); err != nil {
 		s.mu.Unlock()
 		return cachedMutation{}, err
@@ -617,10 +1253,42 @@ func (s *kvServer) submitCommand(ctx context.Context, command *kvpb.ClientComman
 				return cachedMutation{}, err
 			}
 			s.mu.Unlock()
-			return cached, nil
+			return cached, cached.applyError(s.redact)
 		}
 	}
-	_, waitCh, err := s.appendLocalEntryLocked(command, true)
+	if command.Wal.UnixNanos == 0 {
+		command.Wal.UnixNanos = time.Now().UnixNano()
+	}
+	s.stampSoftDeleteLocked(command.Wal)
+	s.stampBatchLocked(command.Wal)
+	s.stampWriteOnceLocked(command.Wal)
+	if cached, done := s.answerUnloggedLocked(command.Wal); done {
+		s.mu.Unlock()
+		return cached, nil
+	}
+	if err := s.checkValueTypeLocked(command.Wal); err != nil {
+		s.mu.Unlock()
+		return cachedMutation{}, err
+	}
+	if err := s.checkWriteOnceLocked(command.Wal); err != nil {
+		s.mu.Unlock()
+		return cachedMutation{}, err
+	}
+	if err := s.checkQuotaLocked(command.Wal); err != nil {
+		s.mu.Unlock()
+		return cachedMutation{}, err
+	}
+	if s.multiWriterLocked(command.Wal) {
+		s.stampWriteLocked(command.Wal)
+	}
+	local, early := cachedMutation{}, false
+	if level == durabilityLocal {
+		local, early = s.localResultLocked(command.Wal)
+	}
+	timer.skip()
+	s.appendTimer = timer
+	index, waitCh, err := s.appendLocalEntryLocked(command, true)
+	s.appendTimer = nil
 	if err != nil {
 		s.mu.Unlock()
 		return cachedMutation{}, err
@@ -628,37 +1296,76 @@ func (s *kvServer) submitCommand(ctx context.Context, command *kvpb.ClientComman
 	s.mu.Unlock()
 
 	s.broadcastAppendEntries()
+	if early {
+		local.seq = index
+		return local, nil
+	}
 
+	var cached cachedMutation
 	select {
 	case <-ctx.Done():
-		return cachedMutation{}, ctx.Err()
+		timer.mark(phaseReplication)
+		return cachedMutation{}, timer.timeoutError(ctx, "%s logged at seq %d was not committed", s.describeWrite(command.Wal), index)
 	case result := <-waitCh:
 		if !commandsEqual(result.command, command) {
 			return cachedMutation{}, notLeaderError("")
 		}
-		return result.cached, nil
+		cached = result.cached
+	}
+	if level == durabilityAll {
+		err := s.waitAllReplicas(ctx, index)
+		timer.mark(phaseReplication)
+		if err != nil && ctx.Err() != nil {
+			return cachedMutation{}, timer.timeoutError(ctx, "%s", status.Convert(err).Message())
+		}
+		if err != nil {
+			return cachedMutation{}, err
+		}
 	}
+	return cached, cached.applyError(s.redact)
 }
 
 func (s *kvServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetReply, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if err := s.validateKeyOwner(req.Key); err != nil {
+		s.mu.Unlock()
 		return nil, err
 	}
 	if s.role != roleLeader {
+		s.mu.Unlock()
 		return nil, notLeaderError(s.leaderAddr)
 	}
 	if !s.leaderReadyForReadsLocked() {
-		return nil, status.Error(codes.Unavailable, "leader not ready for reads")
+		s.mu.Unlock()
+		return nil, retryableError(codes.Unavailable, leaderChangeRetryDelay, "leader not ready for reads")
+	}
+	it, found := s.getLiveLocked(req.Key)
+	// Only keys the cache knows nothing about read through; a tombstone
+	// means the key was deleted here.
+	miss := !found && s.backing != nil && !s.tree.Has(item{key: req.Key})
+	var lease time.Duration
+	if !miss {
+		lease = s.cacheLeases.grantLocked(req.Key, leaseHolderID(ctx, req.LeaseHolder), time.Now())
 	}
-	got := s.tree.Get(item{key: req.Key})
-	if got == nil {
-		return &kvpb.GetReply{Found: false}, nil
+	if found {
+		s.accessStats.readLocked(req.Key)
 	}
-	it := got.(item)
-	return &kvpb.GetReply{Found: true, Value: it.value}, nil
+	s.mu.Unlock()
+
+	if miss {
+		return s.readThrough(ctx, req.Key)
+	}
+	if !found {
+		return &kvpb.GetReply{Found: false, LeaseMillis: lease.Milliseconds()}, nil
+	}
+	if err := s.verifyValue(req.Key, it); err != nil {
+		return nil, err
+	}
+	return &kvpb.GetReply{Found: true, Value: it.value, ValueType: it.vtype, LeaseMillis: lease.Milliseconds(), ContentType: it.contentType,
+		ValueCrc32C: it.checksum, HasValueCrc32C: true}, nil
 }
 
 func (s *kvServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutReply, error) {
@@ -666,14 +1373,27 @@ func (s *kvServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutRepl
 	if err != nil {
 		return nil, err
 	}
+	wal := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: req.Key, Value: req.Value, ValueType: req.ValueType}
+	if err := s.stampChecksum(req, wal); err != nil {
+		return nil, err
+	}
+	if wal.ContentType, err = checkContentType(req.ContentType, req.Value); err != nil {
+		return nil, err
+	}
+	if _, ok := s.writeOncePrefix(req.Key); ok {
+		// A write-once key held only by the backing store still exists.
+		if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+			return nil, err
+		}
+	}
 	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
 		RequestId: reqID,
-		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: req.Key, Value: req.Value},
+		Wal:       wal,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &kvpb.PutReply{Found: cached.found}, nil
+	return &kvpb.PutReply{Found: cached.found, Seq: cached.seq}, nil
 }
 
 func (s *kvServer) Swap(ctx context.Context, req *kvpb.SwapRequest) (*kvpb.SwapReply, error) {
@@ -681,17 +1401,54 @@ func (s *kvServer) Swap(ctx context.Context, req *kvpb.SwapRequest) (*kvpb.SwapR
 	if err != nil {
 		return nil, err
 	}
+	contentType, err := checkContentType(req.ContentType, req.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
 	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
 		RequestId: reqID,
-		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_SWAP, Key: req.Key, Value: req.Value},
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_SWAP, Key: req.Key, Value: req.Value, ValueType: req.ValueType, ContentType: contentType, ValueCrc32C: valueChecksum(req.Value)},
 	})
 	if err != nil {
 		return nil, err
 	}
 	if !cached.found {
-		return &kvpb.SwapReply{Found: false}, nil
+		return &kvpb.SwapReply{Found: false, Seq: cached.seq}, nil
+	}
+	return &kvpb.SwapReply{Found: true, OldValue: cached.oldValue, Seq: cached.seq}, nil
+}
+
+// GetOrPut returns key's value, storing req.Value first if it has none. A
+// value that was already there is a read, so it waits for the same barrier
+// as Get.
+func (s *kvServer) GetOrPut(ctx context.Context, req *kvpb.GetOrPutRequest) (*kvpb.GetOrPutReply, error) {
+	if s.clusterID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "get-or-put is not supported in a multi-writer cluster")
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return &kvpb.SwapReply{Found: true, OldValue: cached.oldValue}, nil
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_GET_OR_PUT, Key: req.Key, Value: req.Value},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cached.found {
+		return &kvpb.GetOrPutReply{Found: true, Value: cached.oldValue, Seq: cached.seq}, nil
+	}
+	return &kvpb.GetOrPutReply{Value: cached.value, Seq: cached.seq}, nil
 }
 
 func (s *kvServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteReply, error) {
@@ -699,6 +1456,9 @@ func (s *kvServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.D
 	if err != nil {
 		return nil, err
 	}
+	if err := s.loadBeforeWrite(ctx, req.Key); err != nil {
+		return nil, err
+	}
 	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
 		RequestId: reqID,
 		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE, Key: req.Key},
@@ -706,10 +1466,38 @@ func (s *kvServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.D
 	if err != nil {
 		return nil, err
 	}
-	return &kvpb.DeleteReply{Found: cached.found}, nil
+	return &kvpb.DeleteReply{Found: cached.found, Seq: cached.seq}, nil
+}
+
+// kvPairAllocator hands out scan result pairs from blocks that grow up to
+// maxKVPairBlock, instead of one allocation per pair. Scan replies cannot
+// come from a sync.Pool: the scan cache keeps them, and gRPC marshals them
+// after the handler returns, with no hook to give them back.
+type kvPairAllocator struct {
+	block []kvpb.KVPair
+	size  int
+}
+
+const maxKVPairBlock = 256
+
+func (a *kvPairAllocator) pair(key, value string) *kvpb.KVPair {
+	if len(a.block) == 0 {
+		a.size = min(max(a.size*2, 16), maxKVPairBlock)
+		a.block = make([]kvpb.KVPair, a.size)
+	}
+	p := &a.block[0]
+	a.block = a.block[1:]
+	p.Key, p.Value = key, value
+	return p
 }
 
 func (s *kvServer) Scan(ctx context.Context, req *kvpb.ScanRequest) (*kvpb.ScanReply, error) {
+	if err := s.checkRangeRead("scan"); err != nil {
+		return nil, err
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -717,18 +1505,119 @@ func (s *kvServer) Scan(ctx context.Context, req *kvpb.ScanRequest) (*kvpb.ScanR
 		return nil, notLeaderError(s.leaderAddr)
 	}
 	if !s.leaderReadyForReadsLocked() {
-		return nil, status.Error(codes.Unavailable, "leader not ready for reads")
+		return nil, retryableError(codes.Unavailable, leaderChangeRetryDelay, "leader not ready for reads")
+	}
+	now := time.Now()
+	tree, seq := s.tree, s.lastApplied
+	live := req.SnapshotSeq == 0 || req.SnapshotSeq == s.lastApplied
+	if !live {
+		pinned, ok := s.scanSnapshots.get(req.SnapshotSeq, now)
+		if !ok {
+			return nil, reasonError(codes.FailedPrecondition, reasonScanSnapshotLost, map[string]string{"snapshot_seq": strconv.FormatUint(req.SnapshotSeq, 10)},
+				"scan snapshot at seq %d is no longer held (now at seq %d); restart the scan", req.SnapshotSeq, s.lastApplied)
+		}
+		tree, seq = pinned, req.SnapshotSeq
+	}
+	limit := int(req.Limit)
+	cacheable := live && limit == 0
+	if cacheable {
+		if pairs, ok := s.scanCache.get(req.StartKey, req.EndKey, now); ok {
+			return &kvpb.ScanReply{Pairs: pairs, SnapshotSeq: seq}, nil
+		}
 	}
 	pairs := make([]*kvpb.KVPair, 0)
-	s.tree.AscendGreaterOrEqual(item{key: req.StartKey}, func(i btree.Item) bool {
-		it := i.(item)
-		if it.key > req.EndKey {
+	var alloc kvPairAllocator
+	truncated := false
+	var corrupt error
+	tree.AscendGreaterOrEqual(item{key: req.StartKey}, func(it item) bool {
+		key := it.fullKey()
+		if key > req.EndKey {
 			return false
 		}
-		pairs = append(pairs, &kvpb.KVPair{Key: it.key, Value: it.value})
+		if it.tombstone {
+			return true
+		}
+		if len(pairs) == limit && limit > 0 {
+			truncated = true
+			return false
+		}
+		if corrupt = s.verifyValue(key, it); corrupt != nil {
+			return false
+		}
+		pairs = append(pairs, alloc.pair(key, it.value))
 		return true
 	})
-	return &kvpb.ScanReply{Pairs: pairs}, nil
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	if truncated && live {
+		s.scanSnapshots.pin(seq, s.tree.Clone, now)
+	}
+	if cacheable {
+		s.scanCache.put(req.StartKey, req.EndKey, pairs, now)
+	}
+	return &kvpb.ScanReply{Pairs: pairs, SnapshotSeq: seq, Truncated: truncated}, nil
+}
+
+func (s *kvServer) GetServerInfo(ctx context.Context, req *kvpb.GetServerInfoRequest) (*kvpb.GetServerInfoReply, error) {
+	info := buildinfo.Read()
+	s.mu.Lock()
+	role := s.role
+	s.mu.Unlock()
+	return &kvpb.GetServerInfoReply{
+		Version:     info.Version,
+		GitCommit:   info.Commit,
+		BuildTime:   info.BuildTime,
+		GoVersion:   info.GoVersion,
+		Modified:    info.Modified,
+		PartitionId: uint32(s.partitionID),
+		ReplicaId:   uint32(s.replicaID),
+		Role:        role,
+		AdminAddr:   s.adminAddr,
+	}, nil
+}
+
+// Ping echoes the payload without touching raft state, so it answers on any
+// replica and measures pure RPC round-trip time.
+func (s *kvServer) Ping(ctx context.Context, req *kvpb.EchoRequest) (*kvpb.EchoReply, error) {
+	return &kvpb.EchoReply{
+		Payload:         req.Payload,
+		ServerUnixNanos: time.Now().UnixNano(),
+		PartitionId:     uint32(s.partitionID),
+		ReplicaId:       uint32(s.replicaID),
+	}, nil
+}
+
+func (s *kvServer) capabilities() []string {
+	features := []string{featureServerInfo, featureRequestDedup, featurePing, featureAdminStats, featureCompaction, featureQuotas, featureDeleteAt, featureTTL, featureSampling, featureRangeStats, featureIterate, featureIterPrefix, featureIngest, featureListDir, featureReplication, featureTransfer, featureDurability, featureMirror, featureWatch, featureScanSnapshot, featureDrain, featureHistogram, featureQuery, featureKeyMeta}
+	if s.ephemeral() {
+		features = append(features, featureEphemeral)
+	} else {
+		features = append(features, featureBackup)
+	}
+	if s.softDeleteRetention > 0 {
+		features = append(features, featureUndelete)
+	}
+	if s.clusterID == "" {
+		features = append(features, featureRename, featureGetOrPut, featureBatch)
+		if s.numPartitions == 1 {
+			features = append(features, featureCopyRange)
+		}
+		if s.backing == nil {
+			features = append(features, featureMerge, featureJSONPaths)
+		}
+	}
+	if s.cacheLeases != nil {
+		features = append(features, featureCacheLeases)
+	}
+	if s.scrub != nil {
+		features = append(features, featureScrub)
+	}
+	return features
+}
+
+func (s *kvServer) Capabilities(ctx context.Context, req *kvpb.CapabilitiesRequest) (*kvpb.CapabilitiesReply, error) {
+	return &kvpb.CapabilitiesReply{ApiVersion: apiVersion, Features: s.capabilities()}, nil
 }
 
 func (s *kvServer) RequestVote(ctx context.Context, req *kvpb.RequestVoteRequest) (*kvpb.RequestVoteReply, error) {
@@ -739,6 +1628,14 @@ func (s *kvServer) RequestVote(ctx context.Context, req *kvpb.RequestVoteRequest
 		s.logf("deny vote to candidate=%d stale_term=%d", req.CandidateId, req.Term)
 		return &kvpb.RequestVoteReply{Term: s.currentTerm, VoteGranted: false}, nil
 	}
+	if s.learners[s.replicaID] {
+		s.logf("deny vote to candidate=%d: learners do not vote", req.CandidateId)
+		return &kvpb.RequestVoteReply{Term: s.currentTerm, VoteGranted: false}, nil
+	}
+	if !req.LeadershipTransfer && s.shouldIgnoreVoteLocked(time.Now()) {
+		s.logf("deny vote to candidate=%d term=%d: leader heard from recently, or replica just started", req.CandidateId, req.Term)
+		return &kvpb.RequestVoteReply{Term: s.currentTerm, VoteGranted: false}, nil
+	}
 	if req.Term > s.currentTerm {
 		if err := s.becomeFollowerLocked(req.Term, -1, ""); err != nil {
 			return nil, err
@@ -767,7 +1664,7 @@ func (s *kvServer) AppendEntries(ctx context.Context, req *kvpb.AppendEntriesReq
 
 	if req.Term < s.currentTerm {
 		s.logf("reject append from leader=%d stale_term=%d", req.LeaderId, req.Term)
-		return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: false, MatchIndex: s.lastLogIndexLocked()}, nil
+		return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: false, MatchIndex: s.lastLogIndexLocked(), LastApplied: s.lastApplied}, nil
 	}
 	if req.Term > s.currentTerm || s.role != roleFollower {
 		if err := s.becomeFollowerLocked(req.Term, int(req.LeaderId), req.LeaderApiAddr); err != nil {
@@ -779,15 +1676,21 @@ func (s *kvServer) AppendEntries(ctx context.Context, req *kvpb.AppendEntriesReq
 		s.lastContact = time.Now()
 		s.resetElectionDeadlineLocked()
 	}
+	s.leaderContact = time.Now()
 
-	if req.PrevLogIndex > s.lastLogIndexLocked() || s.logTermLocked(req.PrevLogIndex) != req.PrevLogTerm {
+	// Entries up to logBase are committed, so they match whatever the leader
+	// sends for them.
+	if req.PrevLogIndex > s.lastLogIndexLocked() || (req.PrevLogIndex >= s.logBase && s.logTermLocked(req.PrevLogIndex) != req.PrevLogTerm) {
 		s.logf("reject append from leader=%d prev=(%d,%d) local_last=(%d,%d)", req.LeaderId, req.PrevLogIndex, req.PrevLogTerm, s.lastLogIndexLocked(), s.lastLogTermLocked())
-		return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: false, MatchIndex: s.lastLogIndexLocked()}, nil
+		return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: false, MatchIndex: s.lastLogIndexLocked(), LastApplied: s.lastApplied}, nil
 	}
 
 	insertAt := req.PrevLogIndex + 1
 	for offset, entry := range req.Entries {
 		targetIndex := insertAt + uint64(offset)
+		if targetIndex <= s.logBase {
+			continue
+		}
 		if targetIndex <= s.lastLogIndexLocked() && s.logTermLocked(targetIndex) != entry.Term {
 			if err := s.deleteLogSuffixLocked(targetIndex); err != nil {
 				return nil, err
@@ -795,6 +1698,9 @@ func (s *kvServer) AppendEntries(ctx context.Context, req *kvpb.AppendEntriesReq
 		}
 		if targetIndex > s.lastLogIndexLocked() {
 			cloned := proto.Clone(entry).(*kvpb.RaftLogEntry)
+			if s.witnesses[s.replicaID] {
+				cloned = witnessEntry(entry)
+			}
 			if err := s.persistLogEntryLocked(cloned); err != nil {
 				return nil, err
 			}
@@ -802,6 +1708,12 @@ func (s *kvServer) AppendEntries(ctx context.Context, req *kvpb.AppendEntriesReq
 		}
 	}
 
+	s.replicatedIndex = req.ReplicatedIndex
+	for _, f := range s.feeds {
+		if err := s.setShippedLocked(f, min(req.CdcShipped, s.lastLogIndexLocked())); err != nil {
+			return nil, err
+		}
+	}
 	if req.LeaderCommit > s.commitIndex {
 		s.commitIndex = req.LeaderCommit
 		if s.commitIndex > s.lastLogIndexLocked() {
@@ -817,16 +1729,18 @@ func (s *kvServer) AppendEntries(ctx context.Context, req *kvpb.AppendEntriesReq
 	if len(req.Entries) == 0 {
 		s.logf("accepted heartbeat from leader=%d commit=%d", req.LeaderId, req.LeaderCommit)
 	}
-	return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: true, MatchIndex: s.lastLogIndexLocked()}, nil
+	return &kvpb.AppendEntriesReply{Term: s.currentTerm, Success: true, MatchIndex: s.lastLogIndexLocked(), LastApplied: s.lastApplied}, nil
 }
 
 func (s *kvServer) startElection() {
 	s.mu.Lock()
-	if s.role == roleLeader || time.Now().Before(s.electionDeadline) {
+	if s.role == roleLeader || !s.canLead() || time.Now().Before(s.electionDeadline) {
 		s.mu.Unlock()
 		return
 	}
 	prevRole := s.role
+	transfer := s.transferElection
+	s.transferElection = false
 	s.role = roleCandidate
 	s.currentTerm++
 	s.votedFor = s.replicaID
@@ -847,12 +1761,23 @@ func (s *kvServer) startElection() {
 	}
 	s.resetElectionDeadlineLocked()
 	s.logf("starting election from_role=%s last_log=(%d,%d)", prevRole, lastIndex, lastTerm)
+	quorum := s.quorum()
+	if quorum == 1 {
+		// No other replica votes.
+		s.becomeLeaderLocked()
+		s.mu.Unlock()
+		go s.broadcastAppendEntries()
+		return
+	}
 	s.mu.Unlock()
 
 	votes := 1
 	var voteMu sync.Mutex
 	announcedLeader := false
 	for _, peerID := range s.peerReplicaIDs {
+		if s.learners[peerID] {
+			continue
+		}
 		go func(peerID int) {
 			client, err := s.getPeerClient(peerID)
 			if err != nil {
@@ -864,10 +1789,11 @@ func (s *kvServer) startElection() {
 			ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
 			defer cancel()
 			resp, err := client.RequestVote(ctx, &kvpb.RequestVoteRequest{
-				Term:         term,
-				CandidateId:  uint32(s.replicaID),
-				LastLogIndex: lastIndex,
-				LastLogTerm:  lastTerm,
+				Term:               term,
+				CandidateId:        uint32(s.replicaID),
+				LastLogIndex:       lastIndex,
+				LastLogTerm:        lastTerm,
+				LeadershipTransfer: transfer,
 			})
 			if err != nil {
 				s.mu.Lock()
@@ -891,7 +1817,7 @@ func (s *kvServer) startElection() {
 				shouldBroadcast := false
 				voteMu.Lock()
 				votes++
-				shouldLead := votes > s.serverRF/2
+				shouldLead := votes >= quorum
 				if shouldLead && !announcedLeader {
 					announcedLeader = true
 					shouldBroadcast = true
@@ -928,23 +1854,41 @@ func (s *kvServer) replicateToPeer(peerID int) {
 		nextIdx = s.lastLogIndexLocked() + 1
 		s.nextIndex[peerID] = nextIdx
 	}
+	if nextIdx <= s.logBase {
+		// The peer needs entries compacted out of the log, as after losing
+		// its disk or joining late: send it the snapshot instead.
+		s.startSnapshotSendLocked(peerID)
+		return
+	}
 	prevIdx := nextIdx - 1
 	prevTerm := s.logTermLocked(prevIdx)
 	entries := make([]*kvpb.RaftLogEntry, 0)
 	if nextIdx > 0 && nextIdx <= s.lastLogIndexLocked() {
-		for _, entry := range s.logEntries[nextIdx-1:] {
+		size := 0
+		for _, entry := range s.logEntries[nextIdx-s.logBase-1:] {
+			size += proto.Size(entry)
+			if len(entries) > 0 && size > maxAppendBytes {
+				break
+			}
+			if s.witnesses[peerID] {
+				entries = append(entries, witnessEntry(entry))
+				continue
+			}
 			entries = append(entries, proto.Clone(entry).(*kvpb.RaftLogEntry))
 		}
 	}
 	req := &kvpb.AppendEntriesRequest{
-		Term:          s.currentTerm,
-		LeaderId:      uint32(s.replicaID),
-		PrevLogIndex:  prevIdx,
-		PrevLogTerm:   prevTerm,
-		Entries:       entries,
-		LeaderCommit:  s.commitIndex,
-		LeaderApiAddr: s.apiAddr,
-	}
+		Term:            s.currentTerm,
+		LeaderId:        uint32(s.replicaID),
+		PrevLogIndex:    prevIdx,
+		PrevLogTerm:     prevTerm,
+		Entries:         entries,
+		LeaderCommit:    s.commitIndex,
+		LeaderApiAddr:   s.apiAddr,
+		ReplicatedIndex: s.gcHorizonLocked(),
+		CdcShipped:      s.feedsShippedLocked(),
+	}
+	sent := time.Now()
 	s.mu.Unlock()
 
 	client, err := s.getPeerClient(peerID)
@@ -976,6 +1920,9 @@ func (s *kvServer) replicateToPeer(peerID int) {
 	if s.role != roleLeader || req.Term != s.currentTerm {
 		return
 	}
+	s.peerApplied[peerID] = resp.LastApplied
+	s.peerContact[peerID] = time.Now()
+	s.recordAckLocked(peerID, sent)
 	if resp.Success {
 		s.matchIndex[peerID] = resp.MatchIndex
 		s.nextIndex[peerID] = resp.MatchIndex + 1
@@ -1017,7 +1964,7 @@ func (s *kvServer) electionLoop(ctx context.Context) {
 }
 
 func (s *kvServer) heartbeatLoop(ctx context.Context) {
-	ticker := time.NewTicker(150 * time.Millisecond)
+	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 	for {
 		select {
@@ -1080,8 +2027,7 @@ func registerWithManagersWithFuncs(
 				continue
 			}
 			if accepted == nil {
-				cloned := *resp
-				accepted = &cloned
+				accepted = proto.Clone(resp).(*kvpb.RegisterServerReply)
 				successes++
 				continue
 			}
@@ -1104,13 +2050,102 @@ func main() {
 	replicaID := flag.Int("replica_id", 0, "replica ID within the partition")
 	managerAddrsRaw := flag.String("manager_addrs", "127.0.0.1:3666", "comma-separated manager ip:port list")
 	apiListen := flag.String("api_listen", "0.0.0.0:3777", "ip:port for client API")
+	adminListen := flag.String("admin_listen", "", "if set, serve the Admin service on this ip:port instead of --api_listen, so it can be firewalled away from clients")
+	adminToken := flag.String("admin_token", "", "if set, every Admin RPC must carry this bearer token")
+	oidcIssuer := flag.String("oidc_issuer", "", "if set, KVS RPCs must carry a bearer JWT from this OIDC provider, e.g. https://sso.example.com")
+	oidcAudience := flag.String("oidc_audience", "", "the aud claim tokens must carry for --oidc_issuer")
+	oidcJWKSURL := flag.String("oidc_jwks_url", "", "where to fetch the provider's signing keys; empty finds them through its discovery document")
+	oidcIdentityClaim := flag.String("oidc_identity_claim", "sub", "the token claim that names the caller")
+	oidcJWKSRefresh := flag.Duration("oidc_jwks_refresh", time.Hour, "how long to cache the provider's signing keys before fetching them again")
+	oidcOneTime := flag.Bool("oidc_one_time_tokens", false, "accept each --oidc_issuer token for one request only: tokens must carry a jti, and one seen before is refused until it expires, so captured requests cannot be replayed; clients need a fresh token per request and retry, as the client's --auth_token_command provides")
+	authzPolicyFile := flag.String("authz_policy", "", "if set, check every KVS RPC against the rules in this file, one 'allow|deny <identity> <verbs> <key prefix>' per line")
+	redactValues := flag.Bool("redact_values", false, "keep values out of logs, the request trace and error messages, for stores holding credentials or personal data")
+	redactKeys := flag.String("redact_keys", "", "if set, keep keys matching this regexp out of logs, the request trace and error messages too")
 	p2pListen := flag.String("p2p_listen", "0.0.0.0:3707", "ip:port for raft peer RPC")
 	peerAddrsRaw := flag.String("peer_addrs", "none", "comma-separated peer p2p addresses excluding self")
 	backerDir := flag.String("backer_path", "data", "directory where durable server state is stored")
+	ephemeral := flag.Bool("ephemeral", false, "keep all state in memory and ignore backer_path, for tests and caches; data and raft votes are lost on restart, so it is refused on a partition with other replicas")
 	retryInterval := flag.Duration("retry_interval", time.Second, "retry interval for manager connectivity")
 	rpcTimeout := flag.Duration("timeout", 2*time.Second, "timeout for manager RPC")
+	usageWindow := flag.Duration("usage_window", defaultMeteringWindow, "length of the windows per-namespace request and byte counts are reported over")
+	metricsNamespaces := flag.String("metrics_namespaces", "", "comma-separated namespaces per-namespace metrics label on their own (- is the default namespace); others are summed as \""+otherNamespace+"\". Default: the first "+strconv.Itoa(maxMetricNamespaces)+" by name")
+	usageLog := flag.String("usage_log", "", "if set, append a JSON usage record per namespace to this file at the end of every usage window, for billing")
+	tracePath := flag.String("trace_path", "", "if set, append every unary KVS request with its arrival time to this JSON-lines trace file, for the client's --replay")
+	chaosLatencyMS := flag.Int(chaosFlagPrefix+"latency-ms", 0, "inject a random delay of up to this many ms into each client RPC")
+	chaosErrorRate := flag.Float64(chaosFlagPrefix+"error-rate", 0, "fraction of client RPCs to fail with Unavailable")
+	chaosFsyncStall := flag.Duration(chaosFlagPrefix+"fsync-stall", 0, "stall every durable write by this long")
+	softDeleteRetention := flag.Duration("soft_delete_retention", 0, "if set, deleted values are kept this long so Undelete can restore them; 0 makes deletes final")
+	tombstoneRetention := flag.Duration("tombstone_retention", time.Hour, "keep deleted keys as tombstones at least this long before GC may purge them")
+	deleteAtInterval := flag.Duration("delete_at_interval", time.Second, "how often the leader checks for scheduled deletions that are due")
+	tombstoneGCInterval := flag.Duration("tombstone_gc_interval", time.Minute, "how often tombstone GC runs")
+	snapshotThreshold := flag.Uint64("snapshot_threshold", 10000, "snapshot and compact the raft log after this many applied entries; 0 disables automatic snapshots")
+	scrubInterval := flag.Duration("scrub_interval", 24*time.Hour, "how often to check the snapshot file, raft log and values against their checksums in the background; 0 disables scrubbing")
+	compactionRateMB := flag.Float64("compaction_rate_mb", 16, "cap snapshot write bandwidth in MiB/s; 0 is unlimited")
+	compactionDeferInflight := flag.Int64("compaction_defer_inflight", 64, "pause compaction while at least this many client RPCs are in flight; 0 never pauses")
+	maxInflight := flag.Int("max_inflight", 0, "admit at most this many client data requests at once, preferring high priority ones; 0 is unlimited")
+	admissionMaxWait := flag.Duration("admission_max_wait", time.Second, "reject a request with ResourceExhausted after it waits this long for admission")
+	quotas := quotaFlag{}
+	flag.Var(quotas, "quota", "per-namespace limit as ns=max_keys,max_bytes (0 is unlimited); may be repeated")
+	cdcSink := flag.String("cdc_sink", "", "ship committed changes to kafka:<REST proxy URL> or file:<path>")
+	cdcTopic := flag.String("cdc_topic", "kvstore-changes", "Kafka topic for the kafka CDC sink")
+	cdcBatch := flag.Int("cdc_batch", 500, "most log entries shipped to the CDC sink per batch")
+	cdcInterval := flag.Duration("cdc_interval", 200*time.Millisecond, "how often the leader ships new changes to the CDC sink")
+	mirrorTarget := flag.String("mirror_target", "", "comma-separated manager addresses of a standby cluster to mirror committed changes to")
+	mirrorAdminToken := flag.String("mirror_admin_token", "", "the standby cluster's --admin_token, sent with mirrored changes")
+	clusterID := flag.String("cluster_id", "", "this cluster's name in a multi-writer mirror; every replica of the cluster must use the same one")
+	mirrorConflicts := flag.String("mirror_conflicts", conflictLWW, "how a multi-writer mirror resolves concurrent writes: lww or merge:<hook path>")
+	watchBuffer := flag.Int("watch_buffer", defaultWatchBuffer, "undelivered events each Watch stream may hold before it is disconnected or, with drop_on_lag, loses events")
+	mirrorStandby := flag.Bool("mirror_standby", false, "run as a mirror standby: accept changes from a source cluster and refuse client writes until promoted")
+	scanCacheTTL := flag.Duration("scan_cache_ttl", 2*time.Second, "serve repeated identical Scans from a cache for up to this long while their range is unchanged; 0 disables")
+	scanCacheEntries := flag.Int("scan_cache_entries", 64, "most Scan ranges held in the scan cache")
+	cacheLease := flag.Duration("cache_lease", 0, "grant clients that ask a lease this long to cache Get replies, and push an invalidation to them when a leased key changes; 0 disables")
+	cacheLeaseKeys := flag.Int("cache_lease_keys", 100000, "most keys with cache leases at once; Gets past it are served without a lease")
+	trackAccess := flag.Bool("access_stats", false, "count reads and writes of each key, and when it was last read and written, for GetMeta; costs memory for every live key")
+	tierAfter := flag.Duration("tier_after", 0, "drop keys nobody has read or written for this long from memory, leaving them in --backing_store to be loaded again when read; implies --access_stats and refuses Scan, Iterate, ListDir and Query, which read memory only; 0 disables")
+	compressKeyPrefixes := flag.Bool("compress_key_prefixes", false, "store each key's prefix up to its last / once in memory, shared by the keys under it; saves memory in hierarchical keyspaces at some CPU cost")
+	tierInterval := flag.Duration("tier_interval", time.Minute, "how often the leader looks for keys to drop from memory under --tier_after")
+	scanSnapshotTTL := flag.Duration("scan_snapshot_ttl", 30*time.Second, "keep the state a paginated Scan reads for this long after its last page, so later pages see the same snapshot; 0 disables")
+	scanSnapshotMax := flag.Int("scan_snapshots", 16, "most states held for paginated Scans at once")
+	keyCharset := flag.String("key_charset", "", "allowed key characters as a regexp character class body, e.g. A-Za-z0-9_./- (empty allows any)")
+	keyMaxDepth := flag.Int("key_max_depth", 0, "most /-separated levels in a key; 0 is unlimited")
+	writeOncePrefixes := flag.String("write_once_prefixes", "", "comma-separated key prefixes whose keys can be created but never changed or deleted; every replica should use the same list")
+	backingStore := flag.String("backing_store", "", "cache a slower store: load misses from it and write changes behind to it; sqlite:<path> is supported")
+	var webhooks webhookFlag
+	flag.Var(&webhooks, "webhook", "POST changes to keys under prefix to a URL, as prefix=https://host/path; may be repeated")
+	webhookSecret := flag.String("webhook_secret", "", "if set, sign webhook bodies with HMAC-SHA256 in the "+webhookSignatureHeader+" header")
+	metricsListen := flag.String("metrics_listen", "", "if set, serve Prometheus metrics at http://<addr>/metrics, and startup progress at /recovery from the moment the server starts")
+	recoveryLogInterval := flag.Duration("recovery_log_interval", 5*time.Second, "while replaying the raft log at startup, log progress this often; 0 disables")
+	learnerReplicas := flag.String("learner_replicas", "", "comma-separated replica ids that replicate the log but never vote or lead; use the same list on every replica")
+	witnessReplicas := flag.String("witness_replicas", "", "comma-separated replica ids that vote and acknowledge appends but keep no data and never lead; use the same list on every replica")
+	readMode := flag.String("read_mode", readModeLeader, "how the leader checks it still leads before a read: leader (no check), readindex (a heartbeat round per read) or lease (skip the round while a quorum-granted lease holds); use the same mode on every replica")
+	readLease := flag.Duration("read_lease", 1500*time.Millisecond, "lease length for --read_mode=lease; must be shorter than the 2s minimum election timeout, with room for clock drift. In lease mode a replica ignores votes for the election timeout plus the lease after it starts, which delays the first election")
+	statsdAddr := flag.String("statsd_addr", "", "if set, push metrics to the StatsD agent at this host:port over UDP, with labels as DogStatsD tags")
+	statsdInterval := flag.Duration("statsd_interval", defaultStatsDInterval, "how often metrics are pushed to --statsd_addr")
+	statsdPrefix := flag.String("statsd_prefix", "kvstore.", "prefix for metric names pushed to --statsd_addr")
+	adminUIListen := flag.String("admin_ui_listen", "", "if set, serve the web admin console at http://<addr>/ (requires --admin_ui_token)")
+	adminUIToken := flag.String("admin_ui_token", "", "token the admin console requires, as a bearer token or basic auth password")
+	showVersion := flag.Bool("version", false, "print build information and exit")
+	flag.Usage = visibleUsage
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("server %s\n", buildinfo.Read())
+		return
+	}
+	if err := validateReadMode(*readMode, *readLease); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *adminUIListen != "" && *adminUIToken == "" {
+		log.Fatalf("--admin_ui_listen requires --admin_ui_token")
+	}
+	if *chaosErrorRate < 0 || *chaosErrorRate > 1 {
+		log.Fatalf("--%serror-rate must be between 0 and 1, got %g", chaosFlagPrefix, *chaosErrorRate)
+	}
+	redact, err := newRedaction(*redactValues, *redactKeys)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	managerAddrs := parseCommaList(*managerAddrsRaw)
 	if len(managerAddrs) == 0 {
 		log.Fatalf("manager_addrs must not be empty")
@@ -1137,10 +2172,145 @@ func main() {
 		assignedAPIAddr = *apiListen
 	}
 
-	srv, err := newKVServer(*backerDir, *partitionID, *replicaID, serverRF, numPartitions, assignedAPIAddr, peerAddrs)
+	dataDir, err := resolveDataDir(*backerDir, *ephemeral, serverRF, peerAddrs)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *ephemeral {
+		log.Printf("ephemeral mode: nothing is written to disk")
+	}
+	// Deferred first so it runs last, after the database is closed and
+	// the data directory unlocked.
+	var upgrade upgrader
+	defer upgrade.handoff()
+	if dataDir != "" {
+		lock, err := lockDataDir(dataDir)
+		if err != nil {
+			log.Fatalf("server init failed: %v", err)
+		}
+		defer lock.release()
+	}
+
+	var metricsMux *http.ServeMux
+	if *metricsListen != "" {
+		if metricsMux, err = serveMetrics(*metricsListen); err != nil {
+			log.Fatalf("metrics listen failed: %v", err)
+		}
+	}
+	if err := sdNotify("STATUS=replaying raft log"); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+	stopProgress := startupRecovery.logProgress(*recoveryLogInterval)
+	srv, err := newKVServer(dataDir, *partitionID, *replicaID, serverRF, numPartitions, assignedAPIAddr, peerAddrs, *clusterID)
+	stopProgress()
 	if err != nil {
 		log.Fatalf("server init failed: %v", err)
 	}
+	if st := startupRecovery.status(); st.ElapsedSeconds > 0 {
+		log.Printf("recovery: finished in %s", time.Duration(st.ElapsedSeconds*float64(time.Second)).Round(time.Millisecond))
+	}
+	srv.tombstoneRetention = *tombstoneRetention
+	srv.softDeleteRetention = *softDeleteRetention
+	srv.quotas = quotas
+	srv.compactor.bytesPerSec = *compactionRateMB * (1 << 20)
+	srv.busyInflight = *compactionDeferInflight
+	srv.admission = newAdmissionController(*maxInflight, *admissionMaxWait)
+	srv.scanCache = newScanCache(*scanCacheTTL, *scanCacheEntries)
+	srv.cacheLeases = newCacheLeases(*cacheLease, *cacheLeaseKeys)
+	srv.accessStats = newAccessStats(*trackAccess || *tierAfter > 0)
+	srv.tier = newTiering(*tierAfter)
+	srv.scrub = newScrubber(*scrubInterval)
+	srv.keyPrefixes = newKeyInterner(*compressKeyPrefixes)
+	srv.mu.Lock()
+	srv.compressKeysLocked()
+	srv.mu.Unlock()
+	srv.scanSnapshots = newScanSnapshots(*scanSnapshotTTL, *scanSnapshotMax)
+	srv.readMode, srv.readLease = *readMode, *readLease
+	learners, err := parseReplicaSet(*learnerReplicas, serverRF)
+	if err != nil {
+		log.Fatalf("learner_replicas: %v", err)
+	}
+	witnesses, err := parseReplicaSet(*witnessReplicas, serverRF)
+	if err != nil {
+		log.Fatalf("witness_replicas: %v", err)
+	}
+	if err := srv.setMembership(learners, witnesses); err != nil {
+		log.Fatalf("membership: %v", err)
+	}
+	if kind := srv.memberType(*replicaID); kind != memberVoter {
+		log.Printf("replica %d is a %s", *replicaID, kind)
+	}
+	srv.redact = redact
+	if srv.keyPolicy, err = newKeyPolicy(*keyCharset, *keyMaxDepth, redact); err != nil {
+		log.Fatalf("key policy: %v", err)
+	}
+	if srv.writeOnce, err = parseWriteOncePrefixes(*writeOncePrefixes); err != nil {
+		log.Fatalf("--write_once_prefixes: %v", err)
+	}
+	if *cdcSink != "" {
+		sink, err := newChangeSink(*cdcSink, *cdcTopic)
+		if err != nil {
+			log.Fatalf("cdc init failed: %v", err)
+		}
+		defer sink.Close()
+		if _, err := srv.addChangeFeed(cdcFeedName, sink, *cdcBatch, *cdcInterval); err != nil {
+			log.Fatalf("cdc init failed: %v", err)
+		}
+	}
+	if *backingStore != "" {
+		store, err := openBackingStore(*backingStore)
+		if err != nil {
+			log.Fatalf("backing store init failed: %v", err)
+		}
+		defer store.Close()
+		srv.backing = store
+		if _, err := srv.addChangeFeed(backingFeedName, &backingSink{store: store, redact: redact}, *cdcBatch, *cdcInterval); err != nil {
+			log.Fatalf("backing store init failed: %v", err)
+		}
+	} else if srv.tier != nil {
+		log.Fatalf("--tier_after needs a --backing_store to keep the keys it drops from memory")
+	}
+	if *mirrorTarget != "" {
+		sink := newMirrorSink(parseCommaList(*mirrorTarget), *clusterID, srv.partitionID, srv.numPartitions)
+		sink.adminToken = *mirrorAdminToken
+		defer sink.Close()
+		if srv.mirrorFeed, err = srv.addChangeFeed(mirrorFeedName, sink, *cdcBatch, *cdcInterval); err != nil {
+			log.Fatalf("mirror init failed: %v", err)
+		}
+	}
+	srv.mirrorStandby = *mirrorStandby
+	if *watchBuffer <= 0 {
+		log.Fatalf("watch_buffer must be positive")
+	}
+	srv.watchers.buffer = *watchBuffer
+	if srv.conflictPolicy, err = parseConflictPolicy(*mirrorConflicts); err != nil {
+		log.Fatalf("mirror_conflicts: %v", err)
+	}
+	if srv.clusterID != "" && srv.softDeleteRetention > 0 {
+		log.Fatalf("soft delete is not supported in a multi-writer cluster; drop --cluster_id or --soft_delete_retention")
+	}
+	if srv.clusterID != "" && srv.mirrorStandby {
+		log.Fatalf("a mirror standby cannot also be a multi-writer cluster; drop --cluster_id or --mirror_standby")
+	}
+	for _, rule := range webhooks {
+		if _, err := srv.addChangeFeed(rule.feedName(), newWebhookSink(rule, *webhookSecret), *cdcBatch, *cdcInterval); err != nil {
+			log.Fatalf("webhook init failed: %v", err)
+		}
+	}
+	if *usageWindow <= 0 {
+		log.Fatalf("usage_window must be positive")
+	}
+	srv.meter.window = *usageWindow
+	srv.metricNamespaces = parseMetricNamespaces(*metricsNamespaces)
+	if *usageLog != "" {
+		if err := srv.meter.openUsageLog(*usageLog); err != nil {
+			log.Fatalf("metering init failed: %v", err)
+		}
+	}
+	srv.chaos = newChaosConfig(*chaosLatencyMS, *chaosErrorRate, *chaosFsyncStall)
+	if srv.chaos != nil {
+		log.Printf("chaos enabled: latency<=%dms error_rate=%.3f fsync_stall=%s", *chaosLatencyMS, *chaosErrorRate, *chaosFsyncStall)
+	}
 	defer func() {
 		srv.mu.Lock()
 		for peerID := range srv.peerConns {
@@ -1152,17 +2322,77 @@ func main() {
 		}
 	}()
 
-	apiLis, err := net.Listen("tcp", *apiListen)
+	inherited, err := inheritedListeners()
 	if err != nil {
-		log.Fatalf("api listen failed: %v", err)
+		log.Fatalf("inherited listeners: %v", err)
 	}
-	p2pLis, err := net.Listen("tcp", *p2pListen)
-	if err != nil {
-		log.Fatalf("p2p listen failed: %v", err)
+	apiLis, ok := inherited["api"]
+	if !ok {
+		if apiLis, err = net.Listen("tcp", *apiListen); err != nil {
+			log.Fatalf("api listen failed: %v", err)
+		}
+	}
+	p2pLis, ok := inherited["p2p"]
+	if !ok {
+		if p2pLis, err = net.Listen("tcp", *p2pListen); err != nil {
+			log.Fatalf("p2p listen failed: %v", err)
+		}
+	}
+	listeners := map[string]net.Listener{"api": apiLis, "p2p": p2pLis}
+	var adminLis net.Listener
+	if *adminListen != "" {
+		if adminLis, ok = inherited["admin"]; !ok {
+			if adminLis, err = net.Listen("tcp", *adminListen); err != nil {
+				log.Fatalf("admin listen failed: %v", err)
+			}
+		}
+		listeners["admin"] = adminLis
+		srv.adminAddr = adminLis.Addr().String()
 	}
 
-	apiServer := grpc.NewServer()
+	auth := adminAuth(*adminToken)
+	oidc, err := newOIDCVerifier(*oidcIssuer, *oidcAudience, *oidcJWKSURL, *oidcIdentityClaim, *oidcJWKSRefresh, *oidcOneTime)
+	if err != nil {
+		log.Fatalf("oidc init failed: %v", err)
+	}
+	srv.oidc = oidc
+	policy, err := loadAuthzPolicy(*authzPolicyFile, redact)
+	if err != nil {
+		log.Fatalf("authz policy init failed: %v", err)
+	}
+	interceptors := []grpc.UnaryServerInterceptor{traceIDUnaryInterceptor, auth.unaryInterceptor, oidc.unaryInterceptor, policy.unaryInterceptor, srv.drain.unaryInterceptor, srv.load.unaryInterceptor, srv.keyPolicy.unaryInterceptor}
+	if srv.admission != nil {
+		interceptors = append(interceptors, srv.admission.unaryInterceptor)
+	}
+	interceptors = append(interceptors, srv.meter.unaryInterceptor)
+	if *tracePath != "" {
+		recorder, err := newTraceRecorder(*tracePath, *partitionID, redact)
+		if err != nil {
+			log.Fatalf("trace init failed: %v", err)
+		}
+		defer func() {
+			if err := recorder.close(); err != nil {
+				log.Printf("trace close failed: %v", err)
+			}
+		}()
+		interceptors = append(interceptors, recorder.unaryInterceptor)
+	}
+	if srv.chaos != nil {
+		interceptors = append(interceptors, srv.chaos.unaryInterceptor)
+	}
+	apiServer := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...), grpc.ChainStreamInterceptor(traceIDStreamInterceptor, auth.streamInterceptor, oidc.streamInterceptor, policy.streamInterceptor, srv.drain.streamInterceptor))
 	kvpb.RegisterKVSServer(apiServer, srv)
+	var adminGRPC *grpc.Server
+	if adminLis != nil {
+		adminGRPC = grpc.NewServer(grpc.ChainUnaryInterceptor(traceIDUnaryInterceptor, auth.unaryInterceptor), grpc.ChainStreamInterceptor(traceIDStreamInterceptor, auth.streamInterceptor))
+		kvpb.RegisterAdminServer(adminGRPC, &adminServer{kv: srv})
+	} else {
+		kvpb.RegisterAdminServer(apiServer, &adminServer{kv: srv})
+	}
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(kvpb.KVS_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(apiServer, healthServer)
+	srv.health = healthServer
 	p2pServer := grpc.NewServer()
 	kvpb.RegisterRaftPeerServer(p2pServer, srv)
 
@@ -1170,15 +2400,75 @@ func main() {
 	defer cancel()
 	go srv.electionLoop(runCtx)
 	go srv.heartbeatLoop(runCtx)
+	go srv.tombstoneGCLoop(runCtx, *tombstoneGCInterval)
+	go srv.deleteAtLoop(runCtx, *deleteAtInterval)
+	if srv.tier != nil {
+		go srv.tierLoop(runCtx, *tierInterval)
+	}
+	if srv.scrub != nil {
+		go srv.scrubLoop(runCtx)
+	}
+	go srv.compactor.run(runCtx, srv.runCompactionJob)
+	if srv.readMode == readModeLease {
+		go srv.clockWatchLoop(runCtx)
+	}
+	go srv.compactionLoop(runCtx, *snapshotThreshold)
+	if srv.conflictPolicy.kind == conflictMerge {
+		go srv.mergeLoop(runCtx)
+	}
+	for _, f := range srv.feeds {
+		go srv.cdcLoop(runCtx, f)
+	}
+	go srv.meteringLoop(runCtx)
+
+	var metrics *metricsRegistry
+	if *metricsListen != "" || *adminUIListen != "" || *statsdAddr != "" {
+		metrics = newMetricsRegistry(map[string]string{"partition": strconv.Itoa(srv.partitionID)})
+		srv.registerMetrics(metrics)
+	}
+	if metricsMux != nil {
+		metricsMux.Handle("/metrics", metrics)
+	}
+	if *statsdAddr != "" {
+		pusher, err := newStatsDPusher(*statsdAddr, *statsdPrefix, *statsdInterval, metrics)
+		if err != nil {
+			log.Fatalf("statsd init failed: %v", err)
+		}
+		go pusher.run(runCtx)
+	}
+	if *adminUIListen != "" {
+		go func() {
+			if err := serveAdminUI(*adminUIListen, srv, *adminUIToken, metrics); err != nil {
+				log.Fatalf("admin ui serve failed: %v", err)
+			}
+		}()
+	}
+
+	servers := []*grpc.Server{p2pServer, apiServer}
+	if adminGRPC != nil {
+		servers = append(servers, adminGRPC)
+	}
+	upgrade.watch(listeners, servers...)
 
 	go func() {
 		if err := p2pServer.Serve(p2pLis); err != nil {
 			log.Fatalf("p2p serve failed: %v", err)
 		}
 	}()
+	if adminGRPC != nil {
+		go func() {
+			if err := adminGRPC.Serve(adminLis); err != nil {
+				log.Fatalf("admin serve failed: %v", err)
+			}
+		}()
+	}
 
-	fmt.Printf("server partition=%d replica=%d api=%s p2p=%s rf=%d\n", *partitionID, *replicaID, *apiListen, *p2pListen, serverRF)
-	if err := apiServer.Serve(apiLis); err != nil {
+	fmt.Printf("server partition=%d replica=%d api=%s p2p=%s rf=%d %s\n", *partitionID, *replicaID, apiLis.Addr(), p2pLis.Addr(), serverRF, buildinfo.Read())
+	// The log was replayed in newKVServer, so this replica can take traffic.
+	if err := sdNotify("READY=1\nSTATUS=serving"); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+	if err := apiServer.Serve(drainListener{Listener: apiLis, drain: srv.drain}); err != nil {
 		log.Fatalf("api serve failed: %v", err)
 	}
 }
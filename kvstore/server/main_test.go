@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync/atomic"
 	"testing"
@@ -21,6 +23,8 @@ import (
 type mockRaftPeerClient struct {
 	requestVoteFn func(context.Context, *kvpb.RequestVoteRequest, ...grpc.CallOption) (*kvpb.RequestVoteReply, error)
 	appendFn      func(context.Context, *kvpb.AppendEntriesRequest, ...grpc.CallOption) (*kvpb.AppendEntriesReply, error)
+	timeoutNowFn  func(context.Context, *kvpb.TimeoutNowRequest, ...grpc.CallOption) (*kvpb.TimeoutNowReply, error)
+	installFn     func(context.Context, *kvpb.InstallSnapshotRequest, ...grpc.CallOption) (*kvpb.InstallSnapshotReply, error)
 }
 
 func (m *mockRaftPeerClient) RequestVote(ctx context.Context, req *kvpb.RequestVoteRequest, opts ...grpc.CallOption) (*kvpb.RequestVoteReply, error) {
@@ -34,7 +38,21 @@ func (m *mockRaftPeerClient) AppendEntries(ctx context.Context, req *kvpb.Append
 	return &kvpb.AppendEntriesReply{Term: req.Term, Success: true, MatchIndex: req.PrevLogIndex + uint64(len(req.Entries))}, nil
 }
 
-func newTestServer(t *testing.T, backerDir string, partitionID, replicaID, serverRF, numPartitions int) *kvServer {
+func (m *mockRaftPeerClient) TimeoutNow(ctx context.Context, req *kvpb.TimeoutNowRequest, opts ...grpc.CallOption) (*kvpb.TimeoutNowReply, error) {
+	if m.timeoutNowFn != nil {
+		return m.timeoutNowFn(ctx, req, opts...)
+	}
+	return &kvpb.TimeoutNowReply{Term: req.Term}, nil
+}
+
+func (m *mockRaftPeerClient) InstallSnapshot(ctx context.Context, req *kvpb.InstallSnapshotRequest, opts ...grpc.CallOption) (*kvpb.InstallSnapshotReply, error) {
+	if m.installFn != nil {
+		return m.installFn(ctx, req, opts...)
+	}
+	return &kvpb.InstallSnapshotReply{Term: req.Term, MatchIndex: req.LastIndex}, nil
+}
+
+func newTestServer(t testing.TB, backerDir string, partitionID, replicaID, serverRF, numPartitions int) *kvServer {
 	t.Helper()
 	peerAddrs := make([]string, 0, max(serverRF-1, 0))
 	for id := 0; id < serverRF; id++ {
@@ -43,7 +61,7 @@ func newTestServer(t *testing.T, backerDir string, partitionID, replicaID, serve
 		}
 		peerAddrs = append(peerAddrs, fmt.Sprintf("127.0.0.1:%d", 4700+id))
 	}
-	srv, err := newKVServer(backerDir, partitionID, replicaID, serverRF, numPartitions, "127.0.0.1:0", peerAddrs)
+	srv, err := newKVServer(backerDir, partitionID, replicaID, serverRF, numPartitions, "127.0.0.1:0", peerAddrs, "")
 	if err != nil {
 		t.Fatalf("newKVServer() failed: %v", err)
 	}
@@ -60,7 +78,7 @@ func max(a, b int) int {
 	return b
 }
 
-func becomeTestLeader(t *testing.T, srv *kvServer, term uint64) {
+func becomeTestLeader(t testing.TB, srv *kvServer, term uint64) {
 	t.Helper()
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
@@ -71,6 +89,12 @@ func becomeTestLeader(t *testing.T, srv *kvServer, term uint64) {
 	srv.becomeLeaderLocked()
 }
 
+// withRequestID returns an incoming call context carrying reqID, as a
+// client's retry-safe write would.
+func withRequestID(reqID string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+}
+
 func TestSingleReplicaLeaderCommitsAndReplays(t *testing.T) {
 	backerDir := t.TempDir()
 	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
@@ -103,7 +127,7 @@ func TestSingleReplicaLeaderCommitsAndReplays(t *testing.T) {
 		t.Fatalf("close first db: %v", err)
 	}
 
-	reloaded, err := newKVServer(backerDir, 0, 0, 1, 1, "127.0.0.1:0", nil)
+	reloaded, err := newKVServer(backerDir, 0, 0, 1, 1, "127.0.0.1:0", nil, "")
 	if err != nil {
 		t.Fatalf("reload newKVServer() failed: %v", err)
 	}
@@ -230,8 +254,8 @@ func TestAppendEntriesAppliesCommittedCommand(t *testing.T) {
 	if srv.commitIndex != 1 || srv.lastApplied != 1 {
 		t.Fatalf("commitIndex=%d lastApplied=%d, want 1/1", srv.commitIndex, srv.lastApplied)
 	}
-	got := srv.tree.Get(item{key: "beta"})
-	if got == nil || got.(item).value != "two" {
+	got, ok := srv.tree.Get(item{key: "beta"})
+	if !ok || got.value != "two" {
 		t.Fatalf("applied tree value = %v, want beta=two", got)
 	}
 }
@@ -263,13 +287,13 @@ func TestDeleteLogSuffixRebuildsAppliedState(t *testing.T) {
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	if got := srv.tree.Get(item{key: "ghost"}); got == nil {
+	if !srv.tree.Has(item{key: "ghost"}) {
 		t.Fatalf("expected ghost key before truncation")
 	}
 	if err := srv.deleteLogSuffixLocked(1); err != nil {
 		t.Fatalf("deleteLogSuffixLocked() failed: %v", err)
 	}
-	if got := srv.tree.Get(item{key: "ghost"}); got != nil {
+	if got, ok := srv.tree.Get(item{key: "ghost"}); ok {
 		t.Fatalf("ghost key remained after truncation: %v", got)
 	}
 	if srv.commitIndex != 0 || srv.lastApplied != 0 {
@@ -412,7 +436,7 @@ func TestFailingSomeServerFollowerReplicas(t *testing.T) {
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	if got := srv.tree.Get(item{key: "follower-down"}); got == nil {
+	if !srv.tree.Has(item{key: "follower-down"}) {
 		t.Fatalf("expected committed value despite one failed follower")
 	}
 }
@@ -486,7 +510,7 @@ func TestFailingBeyondAvailabilityThreshold(t *testing.T) {
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	if got := srv.tree.Get(item{key: "no-quorum"}); got != nil {
+	if got, ok := srv.tree.Get(item{key: "no-quorum"}); ok {
 		t.Fatalf("key unexpectedly applied without quorum: %v", got)
 	}
 }
@@ -531,3 +555,138 @@ func TestFailingManagerReplicaStillSupportsRegistration(t *testing.T) {
 		t.Fatalf("unexpected retries: sleepCalls=%d", sleepCalls)
 	}
 }
+
+func TestGetServerInfoReportsIdentity(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 1, 3, 1)
+	resp, err := srv.GetServerInfo(context.Background(), &kvpb.GetServerInfoRequest{})
+	if err != nil {
+		t.Fatalf("GetServerInfo() failed: %v", err)
+	}
+	if resp.ReplicaId != 1 || resp.Role != roleFollower || resp.GoVersion == "" || resp.Version == "" {
+		t.Fatalf("unexpected server info: %+v", resp)
+	}
+}
+
+func TestEphemeralRefusedOnReplicatedPartition(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverRF  int
+		peerAddrs []string
+		wantErr   bool
+	}{
+		{name: "single replica", serverRF: 1},
+		{name: "rf 3", serverRF: 3, peerAddrs: []string{"127.0.0.1:4701", "127.0.0.1:4702"}, wantErr: true},
+		{name: "peers without rf", serverRF: 1, peerAddrs: []string{"127.0.0.1:4701"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := resolveDataDir("data", true, tc.serverRF, tc.peerAddrs)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("resolveDataDir() error = %v, want error %v", err, tc.wantErr)
+			}
+			if dir != "" {
+				t.Fatalf("resolveDataDir() = %q, want no data directory", dir)
+			}
+		})
+	}
+	if dir, err := resolveDataDir("data", false, 3, []string{"a", "b"}); err != nil || dir != "data" {
+		t.Fatalf("resolveDataDir() without --ephemeral = %q, %v; want data", dir, err)
+	}
+}
+
+func TestEphemeralServerLeavesBackerPathUntouched(t *testing.T) {
+	root := t.TempDir()
+	t.Chdir(root)
+	dataDir, err := resolveDataDir(filepath.Join(root, "data"), true, 1, nil)
+	if err != nil {
+		t.Fatalf("resolveDataDir() failed: %v", err)
+	}
+	srv := newTestServer(t, dataDir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("req-1"), &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot() failed: %v", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("ephemeral server wrote %v, want nothing on disk", entries)
+	}
+}
+
+func TestBackupRejectedOnEphemeralServer(t *testing.T) {
+	srv := newTestServer(t, "", 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	admin := &adminServer{kv: srv}
+	if _, err := admin.Backup(context.Background(), &kvpb.BackupRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Backup() error = %v, want FailedPrecondition", err)
+	}
+	caps, err := srv.Capabilities(context.Background(), &kvpb.CapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Capabilities() failed: %v", err)
+	}
+	if slices.Contains(caps.Features, featureBackup) {
+		t.Fatalf("features = %v, want no %q on an ephemeral server", caps.Features, featureBackup)
+	}
+}
+
+func TestBackupWritesLoadableSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, dir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("req-1"), &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	admin := &adminServer{kv: srv}
+	resp, err := admin.Backup(context.Background(), &kvpb.BackupRequest{Name: "nightly.dat"})
+	if err != nil {
+		t.Fatalf("Backup() failed: %v", err)
+	}
+	if want := filepath.Join(dir, backupDirName, "nightly.dat"); resp.Path != want || resp.Bytes == 0 {
+		t.Fatalf("Backup() = %+v, want a non-empty file at %s", resp, want)
+	}
+	st, err := readSnapshotFile(resp.Path, nil)
+	if err != nil {
+		t.Fatalf("readSnapshotFile() failed: %v", err)
+	}
+	if it, ok := st.tree.Get(item{key: "k"}); !ok || it.value != "v" || st.header.LastIndex != resp.LastIndex {
+		t.Fatalf("backup holds %+v at index %d, want k=v at %d", it, st.header.LastIndex, resp.LastIndex)
+	}
+	if _, err := admin.Backup(context.Background(), &kvpb.BackupRequest{Name: "nightly.dat"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("second Backup() error = %v, want AlreadyExists", err)
+	}
+	if _, err := admin.Backup(context.Background(), &kvpb.BackupRequest{Name: "../snapshot.dat"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Backup() outside the backup directory error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestMutationRepliesCarryLogSeq(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+
+	putCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+	first, err := srv.Put(putCtx, &kvpb.PutRequest{Key: "alpha", Value: "one"})
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	retried, err := srv.Put(putCtx, &kvpb.PutRequest{Key: "alpha", Value: "one"})
+	if err != nil {
+		t.Fatalf("retried Put() failed: %v", err)
+	}
+	if first.Seq == 0 || retried.Seq != first.Seq {
+		t.Fatalf("Put seq = %d, retried seq = %d; want equal and non-zero", first.Seq, retried.Seq)
+	}
+
+	delCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-2"))
+	del, err := srv.Delete(delCtx, &kvpb.DeleteRequest{Key: "alpha"})
+	if err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if del.Seq != first.Seq+1 {
+		t.Fatalf("Delete seq = %d, want %d", del.Seq, first.Seq+1)
+	}
+}
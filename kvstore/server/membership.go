@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Member types. Every replica of a partition must be started with the same
+// --learner_replicas and --witness_replicas so they agree on the quorum.
+const (
+	// memberVoter stores data, votes, counts towards commit, and can lead.
+	memberVoter = "voter"
+	// memberLearner stores and applies the log, so it can serve as a warm
+	// standby or an analytics copy, but it neither votes nor counts towards
+	// commit, and it never stands for election.
+	memberLearner = "learner"
+	// memberWitness votes and acknowledges appends so a small cluster keeps
+	// its quorum, but it keeps only the index and term of each entry, never
+	// the data, and never stands for election.
+	memberWitness = "witness"
+)
+
+// parseReplicaSet parses a comma-separated list of replica IDs.
+func parseReplicaSet(raw string, serverRF int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range parseCommaList(raw) {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 || id >= serverRF {
+			return nil, fmt.Errorf("replica id %q must be an integer in [0,%d)", part, serverRF)
+		}
+		set[id] = true
+	}
+	return set, nil
+}
+
+// setMembership records which replicas are learners and witnesses. At least
+// one replica must be a voter that stores data, and no replica can be both.
+func (s *kvServer) setMembership(learners, witnesses map[int]bool) error {
+	dataVoters := 0
+	for id := 0; id < s.serverRF; id++ {
+		if learners[id] && witnesses[id] {
+			return fmt.Errorf("replica %d cannot be both a learner and a witness", id)
+		}
+		if !learners[id] && !witnesses[id] {
+			dataVoters++
+		}
+	}
+	if dataVoters == 0 {
+		return fmt.Errorf("no replica is left to lead: every replica is a learner or witness")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.learners, s.witnesses = learners, witnesses
+	return nil
+}
+
+func (s *kvServer) memberType(id int) string {
+	switch {
+	case s.learners[id]:
+		return memberLearner
+	case s.witnesses[id]:
+		return memberWitness
+	}
+	return memberVoter
+}
+
+// quorum returns how many voters must agree to elect a leader or commit an
+// entry.
+func (s *kvServer) quorum() int {
+	return (s.serverRF-len(s.learners))/2 + 1
+}
+
+// canLead reports whether this replica may stand for election. A draining
+// replica stays out, so leadership it handed off does not come back.
+func (s *kvServer) canLead() bool {
+	return s.memberType(s.replicaID) == memberVoter && !s.drain.started.Load()
+}
+
+// witnessEntry returns entry without its command, which is all a witness
+// keeps.
+func witnessEntry(entry *kvpb.RaftLogEntry) *kvpb.RaftLogEntry {
+	return &kvpb.RaftLogEntry{Index: entry.Index, Term: entry.Term}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestLearnerDoesNotCountTowardsQuorum(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	if err := srv.setMembership(map[int]bool{2: true}, nil); err != nil {
+		t.Fatalf("setMembership failed: %v", err)
+	}
+	if got := srv.quorum(); got != 2 {
+		t.Fatalf("quorum = %d, want 2 of the two voters", got)
+	}
+	becomeTestLeader(t, srv, 1)
+	srv.mu.Lock()
+	// Only the learner answers, so nothing can commit.
+	srv.peerClients[1] = &mockRaftPeerClient{
+		appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	srv.peerClients[2] = &mockRaftPeerClient{}
+	srv.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1")), 300*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}); err == nil {
+		t.Fatalf("Put committed with only a learner acknowledging")
+	}
+
+	learner := newTestServer(t, t.TempDir(), 0, 2, 3, 1)
+	if err := learner.setMembership(map[int]bool{2: true}, nil); err != nil {
+		t.Fatalf("setMembership failed: %v", err)
+	}
+	resp, err := learner.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 1, CandidateId: 0})
+	if err != nil || resp.VoteGranted {
+		t.Fatalf("learner RequestVote = %v, %v; want denied", resp, err)
+	}
+}
+
+func TestWitnessKeepsOnlyIndexAndTerm(t *testing.T) {
+	dir := t.TempDir()
+	witness := newTestServer(t, dir, 0, 2, 3, 1)
+	if err := witness.setMembership(nil, map[int]bool{2: true}); err != nil {
+		t.Fatalf("setMembership failed: %v", err)
+	}
+	entries := []*kvpb.RaftLogEntry{
+		{Index: 1, Term: 1, Command: &kvpb.ClientCommand{Wal: &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "k", Value: "secret"}}},
+	}
+	resp, err := witness.AppendEntries(context.Background(), &kvpb.AppendEntriesRequest{Term: 1, LeaderId: 0, Entries: entries, LeaderCommit: 1})
+	if err != nil || !resp.Success || resp.LastApplied != 1 {
+		t.Fatalf("AppendEntries = %v, %v; want success applied through 1", resp, err)
+	}
+	witness.mu.Lock()
+	stored := witness.entryLocked(1)
+	live := witness.liveKeys
+	witness.mu.Unlock()
+	if stored.Command != nil || live != 0 {
+		t.Fatalf("witness stored %v with %d live keys, want no command and no data", stored, live)
+	}
+
+	// A restarted witness replays its command-less log.
+	if err := witness.db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	restarted := newTestServer(t, dir, 0, 2, 3, 1)
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if restarted.lastApplied != 1 {
+		t.Fatalf("restarted witness applied %d, want 1", restarted.lastApplied)
+	}
+}
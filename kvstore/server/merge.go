@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Merge operators let clients update a value without reading it, like
+// RocksDB's. The operand, not the result, is logged, and every replica
+// folds it into its copy of the value as the entry applies, so many
+// clients can add to one counter or set without contending on a swap loop.
+
+// MergeOperator folds operands into stored values. Merge must be a pure
+// function of its arguments: every replica calls it on the same inputs and
+// must reach the same value.
+type MergeOperator interface {
+	// CheckOperand rejects an operand before it is logged.
+	CheckOperand(operand string) error
+	// Merge returns the value after folding operand into existing, which
+	// is "" with found false if the key has no value.
+	Merge(existing string, found bool, operand string) (string, error)
+}
+
+// mergeOperators are the operators a Merge request can name. Register new
+// ones here; every replica of a cluster must run a binary that has them.
+var mergeOperators = map[string]MergeOperator{
+	"append":        appendMerge{},
+	"int-add":       intAddMerge{},
+	jsonSetOperator: jsonSetMerge{},
+	"set-union":     setUnionMerge{},
+}
+
+func mergeOperatorNames() string {
+	names := make([]string, 0, len(mergeOperators))
+	for name := range mergeOperators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// appendMerge concatenates operands onto the value.
+type appendMerge struct{}
+
+func (appendMerge) CheckOperand(string) error { return nil }
+
+func (appendMerge) Merge(existing string, _ bool, operand string) (string, error) {
+	return existing + operand, nil
+}
+
+// intAddMerge treats the value as a decimal int64, missing as 0, and adds
+// the operand to it.
+type intAddMerge struct{}
+
+func (intAddMerge) CheckOperand(operand string) error {
+	_, err := strconv.ParseInt(operand, 10, 64)
+	return err
+}
+
+func (intAddMerge) Merge(existing string, found bool, operand string) (string, error) {
+	delta, err := strconv.ParseInt(operand, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	var sum int64
+	if found {
+		if sum, err = strconv.ParseInt(existing, 10, 64); err != nil {
+			return "", errors.New("stored value is not an integer")
+		}
+	}
+	if (delta > 0 && sum > math.MaxInt64-delta) || (delta < 0 && sum < math.MinInt64-delta) {
+		return "", errors.New("sum overflows int64")
+	}
+	return strconv.FormatInt(sum+delta, 10), nil
+}
+
+// setUnionMerge treats the value and the operand as comma-separated sets
+// and stores their union, sorted.
+type setUnionMerge struct{}
+
+func (setUnionMerge) CheckOperand(operand string) error {
+	if operand == "" {
+		return errors.New("operand must name at least one element")
+	}
+	return nil
+}
+
+func (setUnionMerge) Merge(existing string, _ bool, operand string) (string, error) {
+	set := make(map[string]struct{})
+	for _, part := range []string{existing, operand} {
+		for _, elem := range strings.Split(part, ",") {
+			if elem != "" {
+				set[elem] = struct{}{}
+			}
+		}
+	}
+	elems := make([]string, 0, len(set))
+	for elem := range set {
+		elems = append(elems, elem)
+	}
+	sort.Strings(elems)
+	return strings.Join(elems, ","), nil
+}
+
+// jsonSetOperator sets a field of a JSON document; see jsonSetMerge.
+const jsonSetOperator = "json-set"
+
+// intMergeOperator is the one merge operator an integer key takes. Its
+// results are integers, so it makes the key one.
+const intMergeOperator = "int-add"
+
+// mergeResultLocked is the value, and its type, that wal would leave behind
+// if it applied now.
+func (s *kvServer) mergeResultLocked(wal *kvpb.WALCommand) (string, kvpb.ValueType, error) {
+	op, ok := mergeOperators[wal.MergeOperator]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown merge operator %q", wal.MergeOperator)
+	}
+	prev, found := s.getLiveLocked(wal.Key)
+	if wal.MergeOperator == intMergeOperator {
+		merged, err := op.Merge(prev.value, found, wal.Value)
+		return merged, kvpb.ValueType_VALUE_TYPE_INT64, err
+	}
+	if prev.vtype == kvpb.ValueType_VALUE_TYPE_INT64 {
+		return "", 0, fmt.Errorf("key holds an integer, which only %s merges into", intMergeOperator)
+	}
+	if wal.MergeOperator == jsonSetOperator {
+		if err := checkJSONApplies(prev); err != nil {
+			return "", 0, err
+		}
+	}
+	merged, err := op.Merge(prev.value, found, wal.Value)
+	return merged, prev.vtype, err
+}
+
+// mergeLocked applies an OP_MERGE. Unlike a put it keeps the key's
+// scheduled deletion, so a counter can expire with its TTL, and its content
+// type; a json-set that creates the key tags it as JSON.
+func (s *kvServer) mergeLocked(wal *kvpb.WALCommand, seq uint64) cachedMutation {
+	res := cachedMutation{op: wal.Op, key: wal.Key, value: wal.Value, mergeOperator: wal.MergeOperator}
+	prev, found := s.getLiveLocked(wal.Key)
+	merged, vt, err := s.mergeResultLocked(wal)
+	if err != nil {
+		res.merged = prev.value
+		return res
+	}
+	contentType := prev.contentType
+	if !found && wal.MergeOperator == jsonSetOperator {
+		contentType = jsonContentType
+	}
+	s.putTypedLocked(wal.Key, merged, vt, contentType, seq)
+	if prev.deleteAt != 0 {
+		it, _ := s.getLiveLocked(wal.Key)
+		s.scheduleLocked(it, prev.deleteAt)
+	}
+	res.found, res.merged = true, merged
+	return res
+}
+
+func (s *kvServer) Merge(ctx context.Context, req *kvpb.MergeRequest) (*kvpb.MergeReply, error) {
+	what := fmt.Sprintf("%s %q into %q", req.Operator, s.redact.value(req.Operand), s.redact.key(req.Key))
+	cached, err := s.submitMerge(ctx, req.Key, req.Operator, req.Operand, what)
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.MergeReply{Value: cached.merged, Merged: cached.found, Seq: cached.seq}, nil
+}
+
+// submitMerge logs a merge of operand into key with the named operator and
+// waits for it to apply. what describes the merge if it is refused.
+func (s *kvServer) submitMerge(ctx context.Context, key, operator, operand, what string) (cachedMutation, error) {
+	switch {
+	case s.clusterID != "":
+		return cachedMutation{}, status.Errorf(codes.FailedPrecondition, "merge is not supported in a multi-writer cluster")
+	case s.backing != nil:
+		// The write-behind feed may deliver an event twice, which would
+		// fold its operand into the backing store twice.
+		return cachedMutation{}, status.Errorf(codes.FailedPrecondition, "merge is not supported with a backing store")
+	}
+	op, ok := mergeOperators[operator]
+	if !ok {
+		return cachedMutation{}, invalidFieldError("operator", "unknown merge operator %q (have %s)", operator, mergeOperatorNames())
+	}
+	if err := op.CheckOperand(operand); err != nil {
+		return cachedMutation{}, invalidFieldError("operand", "bad %s operand %q: %v", operator, s.redact.value(operand), s.redact.detail(err))
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return cachedMutation{}, err
+	}
+	wal := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_MERGE, Key: key, Value: operand, MergeOperator: operator}
+	// Refuse an operand the stored value cannot take rather than log a
+	// merge every replica will skip. Followers leave this to the leader,
+	// and a retry gets its first reply from submitCommand.
+	s.mu.Lock()
+	if _, retried := s.dedup[reqID]; s.role == roleLeader && !retried {
+		if _, _, err := s.mergeResultLocked(wal); err != nil {
+			s.mu.Unlock()
+			return cachedMutation{}, reasonError(codes.FailedPrecondition, reasonMergeRefused, map[string]string{"key": s.redact.key(key)}, "cannot %s: %v", what, s.redact.detail(err))
+		}
+	}
+	s.mu.Unlock()
+	return s.submitCommand(ctx, &kvpb.ClientCommand{RequestId: reqID, Wal: wal})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestMergeOperators(t *testing.T) {
+	tests := []struct {
+		op       string
+		existing string
+		found    bool
+		operand  string
+		want     string
+		wantErr  bool
+	}{
+		{op: "append", operand: "a", want: "a"},
+		{op: "append", existing: "ab", found: true, operand: "c", want: "abc"},
+		{op: "int-add", operand: "5", want: "5"},
+		{op: "int-add", existing: "5", found: true, operand: "-7", want: "-2"},
+		{op: "int-add", existing: "x", found: true, operand: "1", wantErr: true},
+		{op: "int-add", existing: "9223372036854775807", found: true, operand: "1", wantErr: true},
+		{op: "set-union", operand: "b,a", want: "a,b"},
+		{op: "set-union", existing: "a,c", found: true, operand: "b,a", want: "a,b,c"},
+	}
+	for _, tt := range tests {
+		got, err := mergeOperators[tt.op].Merge(tt.existing, tt.found, tt.operand)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s(%q, %v, %q) = %q, %v; want %q, error %v", tt.op, tt.existing, tt.found, tt.operand, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMergeFoldsOperandsOnce(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	var last *kvpb.MergeReply
+	for i := 1; i <= 3; i++ {
+		got, err := srv.Merge(call("add-"+strconv.Itoa(i)), &kvpb.MergeRequest{Key: "hits", Operand: strconv.Itoa(i), Operator: "int-add"})
+		if err != nil || !got.Merged {
+			t.Fatalf("Merge %d = %v, %v", i, got, err)
+		}
+		last = got
+	}
+	if last.Value != "6" {
+		t.Fatalf("counter after adding 1..3 = %q, want 6", last.Value)
+	}
+	if retry, err := srv.Merge(call("add-3"), &kvpb.MergeRequest{Key: "hits", Operand: "3", Operator: "int-add"}); err != nil || retry.Seq != last.Seq || retry.Value != "6" {
+		t.Fatalf("retried Merge = %v, %v; want the first reply %v", retry, err, last)
+	}
+	if _, err := srv.Merge(call("add-3"), &kvpb.MergeRequest{Key: "hits", Operand: "3", Operator: "append"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Merge reusing a request id with another operator: err = %v, want AlreadyExists", err)
+	}
+
+	if _, err := srv.Merge(call("bad-op"), &kvpb.MergeRequest{Key: "hits", Operand: "1", Operator: "max"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Merge with an unknown operator: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.Merge(call("bad-operand"), &kvpb.MergeRequest{Key: "hits", Operand: "one", Operator: "int-add"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Merge with a bad operand: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.Put(call("put-name"), &kvpb.PutRequest{Key: "name", Value: "kv"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.Merge(call("add-name"), &kvpb.MergeRequest{Key: "name", Operand: "1", Operator: "int-add"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("int-add into a string: err = %v, want FailedPrecondition", err)
+	}
+
+	// A mirror batch delivered twice folds each operand only once.
+	mirrored := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_MERGE, Key: "hits", Value: "10", MergeOperator: "int-add", MirrorSeq: 40}
+	srv.mu.Lock()
+	first := srv.applyWALLocked(mirrored, 100)
+	again := srv.applyWALLocked(mirrored, 101)
+	srv.mu.Unlock()
+	if first.merged != "16" || again.found || again.merged != "16" {
+		t.Fatalf("mirrored merge applied twice: first=%+v again=%+v, want 16 once", first, again)
+	}
+}
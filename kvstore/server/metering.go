@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// defaultMeteringWindow is how often metering closes a window when
+// --usage_window is not set.
+const defaultMeteringWindow = time.Minute
+
+// maxMetricNamespaces bounds the namespaces a metric family labels when
+// --metrics_namespaces is not set: the first this many by name.
+const maxMetricNamespaces = 50
+
+// otherNamespace labels the namespaces a metric does not name on their own.
+// No real namespace can have it, as namespaces never contain the separator.
+const otherNamespace = namespaceSeparator + "other"
+
+// meterCounts is the metered traffic of one namespace. Bytes count keys and
+// values, as namespaceUsage does for storage; duration is the time spent
+// serving the requests.
+type meterCounts struct {
+	requests     uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	duration     time.Duration
+}
+
+func (c *meterCounts) add(o meterCounts) {
+	c.requests += o.requests
+	c.bytesRead += o.bytesRead
+	c.bytesWritten += o.bytesWritten
+	c.duration += o.duration
+}
+
+// meter counts the requests each namespace makes of this replica and the
+// bytes they move, both since startup and per fixed window, for usage
+// reports and chargeback. A request is charged to the namespace of the key
+// it names; bytes read are charged to the namespace of each pair returned,
+// so a Scan across namespaces bills each for its own data.
+type meter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	started time.Time
+	current map[string]meterCounts
+	total   map[string]meterCounts
+	// last is the most recent complete window, [lastStart, lastEnd).
+	last               map[string]meterCounts
+	lastStart, lastEnd time.Time
+	// records, if set, receives a usage record per namespace per window.
+	records *os.File
+}
+
+func newMeter(window time.Duration) *meter {
+	return &meter{
+		window:  window,
+		started: time.Now(),
+		current: make(map[string]meterCounts),
+		total:   make(map[string]meterCounts),
+	}
+}
+
+func (m *meter) charge(ns string, c meterCounts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.current[ns]
+	cur.add(c)
+	m.current[ns] = cur
+	tot := m.total[ns]
+	tot.add(c)
+	m.total[ns] = tot
+}
+
+// chargePairs charges reading pairs to each pair's namespace.
+func (m *meter) chargePairs(pairs []*kvpb.KVPair) {
+	for _, p := range pairs {
+		m.charge(namespaceOf(p.Key), meterCounts{bytesRead: uint64(len(p.Key) + len(p.Value))})
+	}
+}
+
+// chargeBatch charges each operation of a batch to its key's namespace.
+func (m *meter) chargeBatch(req *kvpb.BatchRequest, reply *kvpb.BatchReply) {
+	for i, op := range req.Ops {
+		c := meterCounts{requests: 1}
+		switch strings.ToUpper(op.Op) {
+		case "PUT", "SWAP":
+			c.bytesWritten = uint64(len(op.Key) + len(op.Value))
+		}
+		if i < len(reply.Results) && reply.Results[i].Found && reply.Results[i].Value != "" {
+			c.bytesRead = uint64(len(op.Key) + len(reply.Results[i].Value))
+		}
+		m.charge(namespaceOf(op.Key), c)
+	}
+}
+
+// meteredKey returns the key a KVS request is charged by: its key, or the
+// start of the range or prefix it covers. Requests without one, such as
+// Iterate or Ping, are not counted, though pairs they return still are.
+func meteredKey(req interface{}) (string, bool) {
+	switch r := req.(type) {
+	case interface{ GetKey() string }:
+		return r.GetKey(), true
+	case interface{ GetOldKey() string }:
+		return r.GetOldKey(), true
+	case interface{ GetStartKey() string }:
+		return r.GetStartKey(), true
+	case interface{ GetPrefix() string }:
+		return r.GetPrefix(), true
+	}
+	return "", false
+}
+
+// unaryInterceptor meters KVS requests. Requests redirected to the leader
+// are left for the leader to count.
+func (m *meter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if isNotLeaderError(err) {
+		return resp, err
+	}
+	key, keyed := meteredKey(req)
+	if keyed {
+		c := meterCounts{requests: 1, duration: time.Since(start)}
+		if err == nil {
+			switch r := req.(type) {
+			case *kvpb.PutRequest:
+				c.bytesWritten = uint64(len(r.Key) + len(r.Value))
+			case *kvpb.SwapRequest:
+				c.bytesWritten = uint64(len(r.Key) + len(r.Value))
+			case *kvpb.MergeRequest:
+				c.bytesWritten = uint64(len(r.Key) + len(r.Operand))
+			case *kvpb.JSONSetRequest:
+				c.bytesWritten = uint64(len(r.Key) + len(r.Value))
+			}
+			switch r := resp.(type) {
+			case *kvpb.GetReply:
+				if r.Found {
+					c.bytesRead = uint64(len(key) + len(r.Value))
+				}
+			case *kvpb.SwapReply:
+				if r.Found {
+					c.bytesRead = uint64(len(key) + len(r.OldValue))
+				}
+			case *kvpb.JSONGetReply:
+				if r.Found {
+					c.bytesRead = uint64(len(key) + len(r.Value))
+				}
+			case *kvpb.GetOrPutReply:
+				if r.Found {
+					c.bytesRead = uint64(len(key) + len(r.Value))
+				} else {
+					c.bytesWritten = uint64(len(key) + len(r.Value))
+				}
+			}
+		}
+		m.charge(namespaceOf(key), c)
+	}
+	if r, ok := req.(*kvpb.BatchRequest); ok && err == nil {
+		m.chargeBatch(r, resp.(*kvpb.BatchReply))
+	}
+	if err == nil {
+		switch r := resp.(type) {
+		case *kvpb.ScanReply:
+			m.chargePairs(r.Pairs)
+		case *kvpb.IterateReply:
+			m.chargePairs(r.Pairs)
+		case *kvpb.ListDirReply:
+			m.chargePairs(r.Entries)
+		case *kvpb.QueryReply:
+			m.chargePairs(r.Rows)
+		}
+	}
+	return resp, err
+}
+
+// roll closes the current window at now. It returns the window's counts and
+// start so the caller can write usage records.
+func (m *meter) roll(now time.Time) (map[string]meterCounts, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := m.lastEnd
+	if start.IsZero() {
+		start = m.started
+	}
+	m.last, m.lastStart, m.lastEnd = m.current, start, now
+	m.current = make(map[string]meterCounts, len(m.last))
+	return m.last, start
+}
+
+// usageRecord is one line of the --usage_log file: a namespace's traffic in
+// one window and its storage at the window's end.
+type usageRecord struct {
+	WindowStart  time.Time `json:"window_start"`
+	WindowEnd    time.Time `json:"window_end"`
+	Partition    int       `json:"partition"`
+	Replica      int       `json:"replica"`
+	Namespace    string    `json:"namespace"`
+	Requests     uint64    `json:"requests"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+	Keys         int64     `json:"keys"`
+	Bytes        int64     `json:"bytes"`
+}
+
+// openUsageLog appends usage records to path.
+func (m *meter) openUsageLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open usage log: %w", err)
+	}
+	m.records = f
+	return nil
+}
+
+// meteringLoop closes a metering window every m.window and, with a usage
+// log, writes a record for every namespace that had traffic or data.
+func (s *kvServer) meteringLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.meter.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if s.meter.records != nil {
+				if err := s.meter.records.Close(); err != nil {
+					log.Printf("usage log close failed: %v", err)
+				}
+			}
+			return
+		case now := <-ticker.C:
+			counts, start := s.meter.roll(now)
+			if s.meter.records != nil {
+				s.writeUsageRecords(counts, start, now)
+			}
+		}
+	}
+}
+
+func (s *kvServer) writeUsageRecords(counts map[string]meterCounts, start, end time.Time) {
+	s.mu.Lock()
+	storage := make(map[string]namespaceUsage, len(s.usage))
+	for ns, u := range s.usage {
+		storage[ns] = u
+	}
+	s.mu.Unlock()
+	names := make([]string, 0, len(counts)+len(storage))
+	for ns := range counts {
+		names = append(names, ns)
+	}
+	for ns := range storage {
+		if _, ok := counts[ns]; !ok {
+			names = append(names, ns)
+		}
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, ns := range names {
+		c, u := counts[ns], storage[ns]
+		line, err := json.Marshal(usageRecord{
+			WindowStart: start.UTC(), WindowEnd: end.UTC(),
+			Partition: s.partitionID, Replica: s.replicaID, Namespace: ns,
+			Requests: c.requests, BytesRead: c.bytesRead, BytesWritten: c.bytesWritten,
+			Keys: u.keys, Bytes: u.bytes,
+		})
+		if err != nil {
+			log.Printf("usage record encode failed: %v", err)
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	// One write per window, so a crash loses whole windows, not half lines.
+	if _, err := s.meter.records.Write(buf); err != nil {
+		log.Printf("usage log write failed: %v", err)
+	}
+}
+
+// report adds metering to usage from namespaceUsageLocked, including
+// namespaces that have traffic but no data or quota, and returns the last
+// complete window.
+func (m *meter) report(usage []*kvpb.NamespaceUsage) ([]*kvpb.NamespaceUsage, time.Time, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byName := make(map[string]*kvpb.NamespaceUsage, len(usage))
+	for _, u := range usage {
+		byName[u.Namespace] = u
+	}
+	get := func(ns string) *kvpb.NamespaceUsage {
+		u, ok := byName[ns]
+		if !ok {
+			u = &kvpb.NamespaceUsage{Namespace: ns}
+			byName[ns] = u
+			usage = append(usage, u)
+		}
+		return u
+	}
+	for ns, c := range m.total {
+		u := get(ns)
+		u.Requests, u.BytesRead, u.BytesWritten = c.requests, c.bytesRead, c.bytesWritten
+	}
+	for ns, c := range m.last {
+		u := get(ns)
+		u.WindowRequests, u.WindowBytesRead, u.WindowBytesWritten = c.requests, c.bytesRead, c.bytesWritten
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Namespace < usage[j].Namespace })
+	return usage, m.lastStart, m.lastEnd
+}
+
+// parseMetricNamespaces parses --metrics_namespaces: a comma-separated
+// list of the namespaces metrics label on their own. "-" names the default
+// namespace. It returns nil for an empty list.
+func parseMetricNamespaces(raw string) map[string]bool {
+	names := parseCommaList(raw)
+	if len(names) == 0 {
+		return nil
+	}
+	allow := make(map[string]bool, len(names))
+	for _, ns := range names {
+		if ns == "-" {
+			ns = ""
+		}
+		allow[ns] = true
+	}
+	return allow
+}
+
+// namespaceSamples turns per-namespace values into samples labelled by
+// namespace, keeping the label's cardinality bounded: namespaces outside
+// allow, or past the first maxMetricNamespaces by name if allow is nil, are
+// summed under otherNamespace.
+func namespaceSamples(allow map[string]bool, values map[string]float64) []metricSample {
+	names := make([]string, 0, len(values))
+	for ns := range values {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	samples := make([]metricSample, 0, min(len(names), maxMetricNamespaces)+1)
+	var other float64
+	folded := false
+	for _, ns := range names {
+		if allow != nil && !allow[ns] || allow == nil && len(samples) == maxMetricNamespaces {
+			other += values[ns]
+			folded = true
+			continue
+		}
+		samples = append(samples, metricSample{labels: map[string]string{"namespace": ns}, value: values[ns]})
+	}
+	if folded {
+		samples = append(samples, metricSample{labels: map[string]string{"namespace": otherNamespace}, value: other})
+	}
+	return samples
+}
+
+func (s *kvServer) registerMeteringMetrics(r *metricsRegistry) {
+	m := s.meter
+	totals := func(pick func(meterCounts) float64) func() []metricSample {
+		return func() []metricSample {
+			m.mu.Lock()
+			values := make(map[string]float64, len(m.total))
+			for ns, c := range m.total {
+				values[ns] = pick(c)
+			}
+			m.mu.Unlock()
+			return namespaceSamples(s.metricNamespaces, values)
+		}
+	}
+	r.register("kv_namespace_requests_total", "Requests served by this replica, by namespace of the key they name.", "counter", totals(func(c meterCounts) float64 { return float64(c.requests) }))
+	r.register("kv_namespace_request_seconds_total", "Time spent serving the requests in kv_namespace_requests_total, by namespace.", "counter", totals(func(c meterCounts) float64 { return c.duration.Seconds() }))
+	r.register("kv_namespace_read_bytes_total", "Key and value bytes returned by this replica, by namespace.", "counter", totals(func(c meterCounts) float64 { return float64(c.bytesRead) }))
+	r.register("kv_namespace_written_bytes_total", "Key and value bytes written through this replica, by namespace.", "counter", totals(func(c meterCounts) float64 { return float64(c.bytesWritten) }))
+	storage := func(pick func(namespaceUsage) int64) func() []metricSample {
+		return func() []metricSample {
+			s.mu.Lock()
+			values := make(map[string]float64, len(s.usage))
+			for ns, u := range s.usage {
+				values[ns] = float64(pick(u))
+			}
+			s.mu.Unlock()
+			return namespaceSamples(s.metricNamespaces, values)
+		}
+	}
+	r.register("kv_namespace_keys", "Live keys stored, by namespace.", "gauge", storage(func(u namespaceUsage) int64 { return u.keys }))
+	r.register("kv_namespace_bytes", "Live key and value bytes stored, by namespace.", "gauge", storage(func(u namespaceUsage) int64 { return u.bytes }))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestMeteringChargesNamespacesAndWritesUsageRecords(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, method+time.Now().String()))
+		info := &grpc.UnaryServerInfo{FullMethod: "/" + kvpb.KVS_ServiceDesc.ServiceName + "/" + method}
+		if _, err := srv.meter.unaryInterceptor(ctx, req, info, handler); err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+	}
+	put := func(key, value string) {
+		call("Put", &kvpb.PutRequest{Key: key, Value: value}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.Put(ctx, req.(*kvpb.PutRequest))
+		})
+	}
+	put("a/k1", "12345")
+	put("a/k2", "1")
+	put("b/k", "xyz")
+	call("Get", &kvpb.GetRequest{Key: "a/k1"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.Get(ctx, req.(*kvpb.GetRequest))
+	})
+	// A scan starting in a bills each namespace for the pairs it returns.
+	call("Scan", &kvpb.ScanRequest{StartKey: "a/", EndKey: "c"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.Scan(ctx, req.(*kvpb.ScanRequest))
+	})
+
+	reply, err := (&adminServer{kv: srv}).NamespaceUsage(context.Background(), &kvpb.NamespaceUsageRequest{})
+	if err != nil {
+		t.Fatalf("NamespaceUsage failed: %v", err)
+	}
+	want := map[string][4]uint64{
+		// requests, bytes read, bytes written, stored bytes
+		"a": {4, 9 + 9 + 5, 9 + 5, 14},
+		"b": {1, 6, 6, 6},
+	}
+	for _, ns := range reply.Namespaces {
+		w, ok := want[ns.Namespace]
+		if !ok {
+			t.Fatalf("unexpected namespace %q in %v", ns.Namespace, reply.Namespaces)
+		}
+		if got := [4]uint64{ns.Requests, ns.BytesRead, ns.BytesWritten, ns.Bytes}; got != w {
+			t.Fatalf("namespace %q: requests, read, written, stored = %v, want %v", ns.Namespace, got, w)
+		}
+		delete(want, ns.Namespace)
+	}
+	if len(want) != 0 || reply.WindowEndUnixNanos != 0 {
+		t.Fatalf("missing namespaces %v or window set before one ended: %v", want, reply)
+	}
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	if err := srv.meter.openUsageLog(path); err != nil {
+		t.Fatalf("openUsageLog failed: %v", err)
+	}
+	end := time.Now()
+	counts, start := srv.meter.roll(end)
+	srv.writeUsageRecords(counts, start, end)
+	srv.meter.records.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open usage log: %v", err)
+	}
+	defer f.Close()
+	var records []usageRecord
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var r usageRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("decode %q: %v", sc.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].Namespace != "a" || records[0].Requests != 4 || records[0].Keys != 2 || records[1].BytesWritten != 6 {
+		t.Fatalf("usage records = %+v", records)
+	}
+	reply, _ = (&adminServer{kv: srv}).NamespaceUsage(context.Background(), &kvpb.NamespaceUsageRequest{})
+	if reply.WindowEndUnixNanos != end.UnixNano() || reply.Namespaces[0].WindowRequests != 4 {
+		t.Fatalf("after a window: %v", reply)
+	}
+}
+
+func TestNamespaceMetricsAreBoundedAndLabelledByPartition(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	for i := 0; i < maxMetricNamespaces+2; i++ {
+		srv.meter.charge(fmt.Sprintf("ns%03d", i), meterCounts{requests: 1, duration: time.Second})
+	}
+	srv.meter.charge("", meterCounts{requests: 1})
+	metrics := newMetricsRegistry(map[string]string{"partition": "3"})
+	srv.registerMetrics(metrics)
+	scrape := func() string {
+		t.Helper()
+		var buf strings.Builder
+		if err := metrics.writeText(&buf); err != nil {
+			t.Fatalf("writeText: %v", err)
+		}
+		return buf.String()
+	}
+
+	text := scrape()
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.Contains(line, `partition="3"`) {
+			t.Fatalf("sample without the partition label: %q", line)
+		}
+	}
+	// The default namespace sorts first, so the last two charged are folded.
+	for _, want := range []string{
+		`kv_namespace_requests_total{namespace="",partition="3"} 1`,
+		`kv_namespace_requests_total{namespace="ns048",partition="3"} 1`,
+		`kv_namespace_requests_total{namespace="/other",partition="3"} 3`,
+		`kv_namespace_request_seconds_total{namespace="/other",partition="3"} 3`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics have no %s", want)
+		}
+	}
+	if strings.Contains(text, `namespace="ns049"`) {
+		t.Errorf("metrics label a namespace past the limit")
+	}
+
+	srv.metricNamespaces = parseMetricNamespaces("ns007,-")
+	text = scrape()
+	for _, want := range []string{
+		`kv_namespace_requests_total{namespace="",partition="3"} 1`,
+		`kv_namespace_requests_total{namespace="ns007",partition="3"} 1`,
+		fmt.Sprintf(`kv_namespace_requests_total{namespace="/other",partition="3"} %d`, maxMetricNamespaces+1),
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics with an allowlist have no %s", want)
+		}
+	}
+	if strings.Contains(text, `namespace="ns008"`) {
+		t.Errorf("metrics label a namespace outside the allowlist")
+	}
+}
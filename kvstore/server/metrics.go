@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry is a small Prometheus text-format exporter. Values are read
+// through callbacks at scrape time, so request paths only maintain the plain
+// fields they already need. Every sample also carries the registry's
+// labels, such as the partition (shard) the replica serves, so series from
+// different partitions can be told apart once scraped together.
+type metricsRegistry struct {
+	labels map[string]string
+
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	collect func() []metricSample
+}
+
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+func newMetricsRegistry(labels map[string]string) *metricsRegistry {
+	return &metricsRegistry{labels: labels}
+}
+
+// register adds a metric family whose samples are produced by collect.
+func (r *metricsRegistry) register(name, help, kind string, collect func() []metricSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, &metricFamily{name: name, help: help, kind: kind, collect: collect})
+}
+
+func (r *metricsRegistry) gauge(name, help string, fn func() float64) {
+	r.register(name, help, "gauge", func() []metricSample {
+		return []metricSample{{value: fn()}}
+	})
+}
+
+func (r *metricsRegistry) counter(name, help string, fn func() float64) {
+	r.register(name, help, "counter", func() []metricSample {
+		return []metricSample{{value: fn()}}
+	})
+}
+
+// collect calls fn with every family and its current samples, in the order
+// they were registered, stopping at the first error.
+func (r *metricsRegistry) collect(fn func(f *metricFamily, samples []metricSample) error) error {
+	r.mu.Lock()
+	families := append([]*metricFamily(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		if err := fn(f, f.collect()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *metricsRegistry) writeText(w io.Writer) error {
+	return r.collect(func(f *metricFamily, samples []metricSample) error {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(r.labels, sample.labels), strconv.FormatFloat(sample.value, 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeLabels returns common and a sample's own labels, which win where both
+// have a name, and their names in order.
+func mergeLabels(common, own map[string]string) (map[string]string, []string) {
+	labels := make(map[string]string, len(common)+len(own))
+	for name, value := range common {
+		labels[name] = value
+	}
+	for name, value := range own {
+		labels[name] = value
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return labels, names
+}
+
+func formatLabels(common, own map[string]string) string {
+	if len(common)+len(own) == 0 {
+		return ""
+	}
+	labels, names := mergeLabels(common, own)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.writeText(w); err != nil {
+		log.Printf("metrics write failed: %v", err)
+	}
+}
+
+// serveMetrics listens on addr and serves startup progress at /recovery
+// right away, so it can be watched while the server replays its log. The
+// caller adds /metrics to the returned mux once the registry exists.
+func serveMetrics(addr string) (*http.ServeMux, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/recovery", &startupRecovery)
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			log.Fatalf("metrics serve failed: %v", err)
+		}
+	}()
+	return mux, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+// Cross-cluster mirroring keeps a standby cluster in another datacenter a
+// short, measurable distance behind a source cluster.
+//
+// Each source partition leader ships its committed changes through a change
+// feed (see cdc.go) to the leader of the same partition in the standby
+// cluster, over a gzip-compressed Mirror stream. The feed's checkpoint is
+// replicated like any other, so a new source leader resumes where the old
+// one stopped, and the source log is not compacted past it. Both clusters
+// must have the same number of partitions. Delivery is at least once;
+// replaying a batch leaves the standby in the same state.
+//
+// Standby servers run with --mirror_standby and refuse client writes.
+// kv_mirror_rpo_seconds on the source leaders (and rpo_millis in
+// MirrorStatus) is how much would be lost by failing over now.
+//
+// Planned failover:
+//  1. Stop client writes to the source.
+//  2. Wait until every source partition reports lag_entries=0 in
+//     `client admin mirror` against the source.
+//  3. Run `client admin promote` against the standby. Each partition leader
+//     commits the promotion, after which it accepts client writes and
+//     refuses further mirrored changes.
+//  4. Point clients at the standby's managers.
+//
+// After an unplanned failover skip steps 1 and 2; the source's last
+// reported RPO bounds what was lost. To fail back, rebuild the old source
+// as a standby of the promoted cluster and repeat the procedure.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// mirrorFeedName names the change feed configured with --mirror_target.
+const mirrorFeedName = "mirror"
+
+// Mirror roles reported by MirrorStatus.
+const (
+	mirrorRoleSource   = "source"
+	mirrorRoleStandby  = "standby"
+	mirrorRolePromoted = "promoted"
+	mirrorRolePeer     = "multi_writer"
+)
+
+// mirrorSink ships change batches to the standby partition leader. It keeps
+// one stream open between batches and reopens it, against the replica the
+// last error named as leader, when anything goes wrong.
+type mirrorSink struct {
+	managerAddrs  []string
+	clusterID     string
+	partition     int
+	numPartitions int
+	// adminToken is the standby's --admin_token, which Mirror needs.
+	adminToken string
+
+	replicas []string
+	next     int
+	conns    map[string]*grpc.ClientConn
+	stream   kvpb.Admin_MirrorClient
+	cancel   context.CancelFunc
+	// adminConns are connections to the standby replicas' Admin
+	// services, keyed by API address.
+	adminConns map[string]*grpc.ClientConn
+}
+
+func newMirrorSink(managerAddrs []string, clusterID string, partition, numPartitions int) *mirrorSink {
+	return &mirrorSink{
+		managerAddrs:  managerAddrs,
+		clusterID:     clusterID,
+		partition:     partition,
+		numPartitions: numPartitions,
+		conns:         make(map[string]*grpc.ClientConn),
+		adminConns:    make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (m *mirrorSink) dial(addr string) (*grpc.ClientConn, error) {
+	if conn, ok := m.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	m.conns[addr] = conn
+	return conn, nil
+}
+
+// dialAdmin returns a connection to the Admin service of the standby
+// replica at addr, which may serve it on another address.
+func (m *mirrorSink) dialAdmin(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	if conn, ok := m.adminConns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := m.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := kvpb.NewKVSClient(conn).GetServerInfo(ctx, &kvpb.GetServerInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	target := resolveAdminAddr(addr, info.AdminAddr)
+	if target == addr && m.adminToken == "" {
+		m.adminConns[addr] = conn
+		return conn, nil
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if m.adminToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(adminBearer(m.adminToken)))
+	}
+	if conn, err = grpc.NewClient(target, opts...); err != nil {
+		return nil, err
+	}
+	m.adminConns[addr] = conn
+	return conn, nil
+}
+
+// lookupReplicas asks the standby cluster's managers where this partition's
+// replicas are.
+func (m *mirrorSink) lookupReplicas(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range m.managerAddrs {
+		conn, err := m.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info, err := kvpb.NewClusterManagerClient(conn).GetClusterInfo(ctx, &kvpb.GetClusterInfoRequest{})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if int(info.NumPartitions) != m.numPartitions {
+			return fmt.Errorf("standby cluster has %d partitions, this one has %d", info.NumPartitions, m.numPartitions)
+		}
+		rf := int(info.ServerRf)
+		m.replicas = info.ServerAddrs[m.partition*rf : (m.partition+1)*rf]
+		return nil
+	}
+	return fmt.Errorf("standby managers unreachable: %w", lastErr)
+}
+
+func (m *mirrorSink) open(ctx context.Context) (kvpb.Admin_MirrorClient, error) {
+	if m.stream != nil {
+		return m.stream, nil
+	}
+	if m.replicas == nil {
+		if err := m.lookupReplicas(ctx); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := m.dialAdmin(ctx, m.replicas[m.next%len(m.replicas)])
+	if err != nil {
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream, err := kvpb.NewAdminClient(conn).Mirror(streamCtx, grpc.UseCompressor(gzip.Name))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	m.stream, m.cancel = stream, cancel
+	return stream, nil
+}
+
+// reset drops the stream after err and picks the replica to try next.
+func (m *mirrorSink) reset(err error) {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.stream, m.cancel = nil, nil
+	if hint, ok := strings.CutPrefix(status.Convert(err).Message(), "not leader: "); ok {
+		for i, addr := range m.replicas {
+			if addr == hint {
+				m.next = i
+				return
+			}
+		}
+	}
+	m.next++
+}
+
+func (m *mirrorSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	batch := &kvpb.MirrorBatch{
+		SourcePartition:  uint32(m.partition),
+		SourcePartitions: uint32(m.numPartitions),
+		LastSeq:          events[len(events)-1].Seq,
+		SourceCluster:    m.clusterID,
+	}
+	for _, ev := range events {
+		if ev.Origin != m.clusterID {
+			// Changes mirrored in from the peer are not sent back.
+			continue
+		}
+		if wal := mirroredWAL(ev); wal != nil {
+			batch.Changes = append(batch.Changes, wal)
+		}
+	}
+	stream, err := m.open(ctx)
+	if err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	acks := make(chan error, 1)
+	go func() {
+		if err := stream.Send(batch); err != nil {
+			// The standby closed the stream; Recv returns its reason.
+			_, err = stream.Recv()
+			acks <- err
+			return
+		}
+		ack, err := stream.Recv()
+		if err == nil && ack.LastSeq != batch.LastSeq {
+			err = fmt.Errorf("standby acknowledged %d, want %d", ack.LastSeq, batch.LastSeq)
+		}
+		acks <- err
+	}()
+	select {
+	case <-ctx.Done():
+		m.reset(ctx.Err())
+		return ctx.Err()
+	case err := <-acks:
+		if err != nil {
+			m.reset(err)
+			return fmt.Errorf("mirror: %w", err)
+		}
+		return nil
+	}
+}
+
+func (m *mirrorSink) Close() error {
+	m.reset(nil)
+	for addr, conn := range m.adminConns {
+		if conn != m.conns[addr] {
+			_ = conn.Close()
+		}
+	}
+	for _, conn := range m.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// mirroredWAL turns a change event back into the command the standby logs,
+// or nil for events that must not cross clusters.
+func mirroredWAL(ev ChangeEvent) *kvpb.WALCommand {
+	op := kvpb.WALCommand_Op(kvpb.WALCommand_Op_value["OP_"+ev.Op])
+	switch op {
+	case kvpb.WALCommand_OP_UNSPECIFIED, kvpb.WALCommand_OP_MIRROR_PROMOTE, kvpb.WALCommand_OP_EVICT:
+		// An eviction only moves a key between the source's own tiers.
+		return nil
+	case kvpb.WALCommand_OP_INGEST, kvpb.WALCommand_OP_UNDELETE:
+		// Ingest events already carry one pair each, and an undelete
+		// carries the value it restores, which the standby may not have
+		// kept.
+		op = kvpb.WALCommand_OP_PUT
+	}
+	return &kvpb.WALCommand{
+		Op:            op,
+		Key:           ev.Key,
+		Value:         ev.Value,
+		UnixNanos:     ev.UnixNanos,
+		DeleteAt:      ev.DeleteAt,
+		TtlNanos:      ev.TTLNanos,
+		NewKey:        ev.NewKey,
+		Overwrite:     ev.Overwrite,
+		MirrorSeq:     ev.Seq,
+		MergeOperator: ev.MergeOperator,
+		ValueType:     kvpb.ValueType(kvpb.ValueType_value[ev.ValueType]),
+		ContentType:   ev.ContentType,
+		Hvc:           ev.HVC,
+		Origin:        ev.Origin,
+	}
+}
+
+// Mirror applies batches from the source cluster's partition leader.
+func (a *adminServer) Mirror(stream kvpb.Admin_MirrorServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.kv.applyMirrorBatch(stream.Context(), batch); err != nil {
+			return err
+		}
+		if err := stream.Send(&kvpb.MirrorAck{LastSeq: batch.LastSeq}); err != nil {
+			return err
+		}
+	}
+}
+
+// applyMirrorBatch logs every change in batch and returns once the last of
+// them has committed.
+func (s *kvServer) applyMirrorBatch(ctx context.Context, batch *kvpb.MirrorBatch) error {
+	err := s.commitMirrorCommands(ctx, batch.Changes, func() error {
+		if err := s.checkMirrorBatchLocked(batch); err != nil {
+			return err
+		}
+		s.mirrorLastBatch = time.Now()
+		return nil
+	})
+	if err == nil {
+		s.mirrorChanges.Add(uint64(len(batch.Changes)))
+	}
+	return err
+}
+
+// commitMirrorCommands logs wals in order if check, run under s.mu, passes,
+// and waits until the last one commits. Unlike submitCommand it skips the
+// per-key checks, which mirrored changes passed on the source and which do
+// not apply to a promotion.
+func (s *kvServer) commitMirrorCommands(ctx context.Context, wals []*kvpb.WALCommand, check func() error) error {
+	s.mu.Lock()
+	if err := check(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var waitCh <-chan applyResult
+	var last *kvpb.ClientCommand
+	for i, wal := range wals {
+		last = &kvpb.ClientCommand{Wal: wal}
+		var err error
+		if _, waitCh, err = s.appendLocalEntryLocked(last, i == len(wals)-1); err != nil {
+			s.mu.Unlock()
+			return status.Errorf(codes.Internal, "log mirror command: %v", err)
+		}
+	}
+	s.mu.Unlock()
+	if last == nil {
+		return nil
+	}
+
+	s.broadcastAppendEntries()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case result := <-waitCh:
+		if !commandsEqual(result.command, last) {
+			return notLeaderError("")
+		}
+		return nil
+	}
+}
+
+func (s *kvServer) checkMirrorBatchLocked(batch *kvpb.MirrorBatch) error {
+	switch {
+	case s.clusterID != "":
+		if batch.SourceCluster == "" || batch.SourceCluster == s.clusterID {
+			return status.Errorf(codes.FailedPrecondition, "multi-writer cluster %q needs batches from a peer with a different --cluster_id, got %q", s.clusterID, batch.SourceCluster)
+		}
+	case !s.mirrorStandby:
+		return status.Error(codes.FailedPrecondition, "this cluster is not a mirror standby")
+	case s.mirrorPromoted:
+		return status.Error(codes.FailedPrecondition, "this standby was promoted and no longer accepts mirrored changes")
+	}
+	if s.role != roleLeader {
+		return notLeaderError(s.leaderAddr)
+	}
+	if s.transferTarget >= 0 {
+		return retryableError(codes.Unavailable, leaderChangeRetryDelay, "leadership is being transferred to replica %d", s.transferTarget)
+	}
+	if int(batch.SourcePartitions) != s.numPartitions || int(batch.SourcePartition) != s.partitionID {
+		return status.Errorf(codes.FailedPrecondition, "batch from source partition %d of %d sent to partition %d of %d",
+			batch.SourcePartition, batch.SourcePartitions, s.partitionID, s.numPartitions)
+	}
+	for _, wal := range batch.Changes {
+		if err := s.validateKeyOwner(wal.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refuseStandbyWriteLocked rejects a client write on an unpromoted standby.
+// Scheduled deletions, cache fills and evictions are derived from replicated
+// state, so they reach the same result as the source and are still allowed.
+func (s *kvServer) refuseStandbyWriteLocked(wal *kvpb.WALCommand) error {
+	if !s.mirrorStandby || s.mirrorPromoted {
+		return nil
+	}
+	switch wal.Op {
+	case kvpb.WALCommand_OP_EXPIRE, kvpb.WALCommand_OP_FILL, kvpb.WALCommand_OP_EVICT:
+		return nil
+	}
+	return reasonError(codes.FailedPrecondition, reasonMirrorStandby, nil, "this cluster is a mirror standby; writes are refused until it is promoted")
+}
+
+func (s *kvServer) mirrorRoleLocked() string {
+	switch {
+	case s.clusterID != "":
+		return mirrorRolePeer
+	case s.mirrorStandby && s.mirrorPromoted:
+		return mirrorRolePromoted
+	case s.mirrorStandby:
+		return mirrorRoleStandby
+	case s.mirrorFeed != nil:
+		return mirrorRoleSource
+	}
+	return ""
+}
+
+func (a *adminServer) MirrorStatus(ctx context.Context, req *kvpb.MirrorStatusRequest) (*kvpb.MirrorStatusReply, error) {
+	s := a.kv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := &kvpb.MirrorStatusReply{
+		Role:           s.mirrorRoleLocked(),
+		SourceSeq:      s.mirrorSourceSeq,
+		ChangesApplied: s.mirrorChanges.Load(),
+	}
+	reply.Conflicts = s.conflicts[resolvedIncoming] + s.conflicts[resolvedExisting]
+	if !s.mirrorLastBatch.IsZero() {
+		reply.LastBatchUnixNanos = s.mirrorLastBatch.UnixNano()
+	}
+	if f := s.mirrorFeed; f != nil {
+		lag, rpo := s.cdcLagLocked(f, time.Now())
+		reply.ShippedIndex = f.shipped
+		reply.LagEntries = lag
+		reply.RpoMillis = rpo.Milliseconds()
+	}
+	return reply, nil
+}
+
+// PromoteMirror commits OP_MIRROR_PROMOTE so this partition takes client
+// writes. Promoting twice is harmless.
+func (a *adminServer) PromoteMirror(ctx context.Context, req *kvpb.PromoteMirrorRequest) (*kvpb.PromoteMirrorReply, error) {
+	s := a.kv
+	promote := []*kvpb.WALCommand{{Op: kvpb.WALCommand_OP_MIRROR_PROMOTE}}
+	if err := s.commitMirrorCommands(ctx, promote, func() error {
+		if !s.mirrorStandby {
+			return status.Error(codes.FailedPrecondition, "this cluster is not a mirror standby")
+		}
+		if s.role != roleLeader {
+			return notLeaderError(s.leaderAddr)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logf("promoted mirror standby at source seq %d", s.mirrorSourceSeq)
+	return &kvpb.PromoteMirrorReply{SourceSeq: s.mirrorSourceSeq}, nil
+}
+
+func (s *kvServer) registerMirrorMetrics(r *metricsRegistry) {
+	if s.mirrorFeed != nil {
+		r.gauge("kv_mirror_rpo_seconds", "Age of the oldest committed change the standby cluster does not have; what a failover now would lose.", s.locked(func() float64 {
+			_, rpo := s.cdcLagLocked(s.mirrorFeed, time.Now())
+			return rpo.Seconds()
+		}))
+	}
+	if s.mirrorStandby {
+		r.gauge("kv_mirror_source_seq", "Last source log index applied on this standby.", s.locked(func() float64 { return float64(s.mirrorSourceSeq) }))
+		r.counter("kv_mirror_changes_applied_total", "Mirrored changes committed on this standby.", func() float64 { return float64(s.mirrorChanges.Load()) })
+		r.gauge("kv_mirror_promoted", "1 once this standby has been promoted.", s.locked(func() float64 {
+			if s.mirrorPromoted {
+				return 1
+			}
+			return 0
+		}))
+	}
+}
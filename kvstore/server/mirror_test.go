@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestMirrorStandbyAppliesChangesUntilPromoted(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, dir, 0, 0, 1, 1)
+	srv.mirrorStandby = true
+	becomeTestLeader(t, srv, 1)
+	admin := &adminServer{kv: srv}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "local"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Put on standby = %v, want FailedPrecondition", err)
+	}
+	events := []ChangeEvent{
+		{Seq: 7, Op: "PUT", Key: "k", Value: "v1"},
+		{Seq: 8, Op: "INGEST", Key: "j", Value: "v2"},
+		{Seq: 9, Op: "MIRROR_PROMOTE"},
+	}
+	batch := &kvpb.MirrorBatch{SourcePartitions: 1, LastSeq: 9}
+	for _, ev := range events {
+		if wal := mirroredWAL(ev); wal != nil {
+			batch.Changes = append(batch.Changes, wal)
+		}
+	}
+	if len(batch.Changes) != 2 || batch.Changes[1].Op != kvpb.WALCommand_OP_PUT {
+		t.Fatalf("mirrored changes = %v, want two puts", batch.Changes)
+	}
+	if err := srv.applyMirrorBatch(context.Background(), batch); err != nil {
+		t.Fatalf("applyMirrorBatch failed: %v", err)
+	}
+	got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "j"})
+	if err != nil || got.Value != "v2" {
+		t.Fatalf("Get(j) = %v, %v; want v2", got, err)
+	}
+
+	resp, err := admin.PromoteMirror(context.Background(), &kvpb.PromoteMirrorRequest{})
+	if err != nil || resp.SourceSeq != 8 {
+		t.Fatalf("PromoteMirror = %v, %v; want source seq 8", resp, err)
+	}
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "local"}); err != nil {
+		t.Fatalf("Put after promotion failed: %v", err)
+	}
+	if err := srv.applyMirrorBatch(context.Background(), batch); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("applyMirrorBatch after promotion = %v, want FailedPrecondition", err)
+	}
+
+	// The promotion is replicated state, so it survives a restart.
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	restarted := newTestServer(t, dir, 0, 0, 1, 1)
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if !restarted.mirrorPromoted || restarted.mirrorSourceSeq != 8 {
+		t.Fatalf("restarted promoted=%v source_seq=%d, want true and 8", restarted.mirrorPromoted, restarted.mirrorSourceSeq)
+	}
+}
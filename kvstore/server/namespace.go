@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/btree"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// namespaceSeparator splits a key into namespace and name: "tenant/key" is
+// in namespace "tenant". Keys without a separator are in the default
+// namespace "".
+const namespaceSeparator = "/"
+
+func namespaceOf(key string) string {
+	ns, _, found := strings.Cut(key, namespaceSeparator)
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+// namespaceUsage is the live data stored in a namespace. Bytes count keys and
+// values; tombstones are not charged.
+type namespaceUsage struct {
+	keys  int64
+	bytes int64
+}
+
+// namespaceQuota limits a namespace. Zero fields are unlimited.
+type namespaceQuota struct {
+	maxKeys  int64
+	maxBytes int64
+}
+
+// quotaFlag collects repeated --quota ns=max_keys,max_bytes flags.
+type quotaFlag map[string]namespaceQuota
+
+func (q quotaFlag) String() string {
+	names := make([]string, 0, len(q))
+	for ns := range q {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, ns := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d,%d", ns, q[ns].maxKeys, q[ns].maxBytes))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (q quotaFlag) Set(raw string) error {
+	ns, limits, ok := strings.Cut(raw, "=")
+	if !ok {
+		return fmt.Errorf("expected ns=max_keys,max_bytes, got %q", raw)
+	}
+	keysRaw, bytesRaw, ok := strings.Cut(limits, ",")
+	if !ok {
+		return fmt.Errorf("expected ns=max_keys,max_bytes, got %q", raw)
+	}
+	maxKeys, err := strconv.ParseInt(keysRaw, 10, 64)
+	if err != nil || maxKeys < 0 {
+		return fmt.Errorf("invalid max_keys %q", keysRaw)
+	}
+	maxBytes, err := strconv.ParseInt(bytesRaw, 10, 64)
+	if err != nil || maxBytes < 0 {
+		return fmt.Errorf("invalid max_bytes %q", bytesRaw)
+	}
+	q[ns] = namespaceQuota{maxKeys: maxKeys, maxBytes: maxBytes}
+	return nil
+}
+
+func (s *kvServer) chargeLocked(key string, keys, bytes int64) {
+	ns := namespaceOf(key)
+	u := s.usage[ns]
+	u.keys += keys
+	u.bytes += bytes
+	if u.keys == 0 && u.bytes == 0 {
+		delete(s.usage, ns)
+		return
+	}
+	s.usage[ns] = u
+}
+
+// recountLocked recomputes key counts, namespace usage and the deadline
+// index from the tree.
+func (s *kvServer) recountLocked() {
+	s.liveKeys, s.tombstones = 0, 0
+	s.usage = make(map[string]namespaceUsage)
+	s.deadlines = btree.New(8)
+	s.histogram = nil
+	s.accessStats.reset()
+	s.keyPrefixes.reset()
+	s.tree.Ascend(func(it item) bool {
+		s.keyPrefixes.addedLocked(it)
+		if it.tombstone {
+			s.tombstones++
+			return true
+		}
+		key := it.fullKey()
+		s.liveKeys++
+		s.chargeLocked(key, 1, int64(len(key)+len(it.value)))
+		if it.deleteAt != 0 {
+			s.deadlines.ReplaceOrInsert(deadline{at: it.deleteAt, key: key})
+		}
+		return true
+	})
+	s.demotedBytes = 0
+	for key, bytes := range s.demoted {
+		s.chargeLocked(key, 1, bytes)
+		s.demotedBytes += bytes
+	}
+}
+
+// checkQuotaLocked rejects a write that would push its namespace past its
+// quota. It runs on the leader before the write is logged and compares
+// against applied state, so writes still in flight can overshoot slightly.
+func (s *kvServer) checkQuotaLocked(wal *kvpb.WALCommand) error {
+	var pairs []*kvpb.WALPair
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_SWAP, kvpb.WALCommand_OP_UNDELETE, kvpb.WALCommand_OP_GET_OR_PUT:
+		pairs = []*kvpb.WALPair{{Key: wal.Key, Value: wal.Value}}
+	case kvpb.WALCommand_OP_INGEST:
+		pairs = wal.Ingest
+	case kvpb.WALCommand_OP_MERGE:
+		merged, _, err := s.mergeResultLocked(wal)
+		if err != nil {
+			return nil
+		}
+		pairs = []*kvpb.WALPair{{Key: wal.Key, Value: merged}}
+	case kvpb.WALCommand_OP_RENAME:
+		// A rename within a namespace does not change its usage.
+		if namespaceOf(wal.NewKey) == namespaceOf(wal.Key) {
+			return nil
+		}
+		pairs = []*kvpb.WALPair{{Key: wal.NewKey, Value: wal.Value}}
+	case kvpb.WALCommand_OP_BATCH:
+		// Deletes in the batch are not credited.
+		for _, sub := range wal.Batch {
+			if sub.Op == kvpb.WALCommand_OP_PUT || sub.Op == kvpb.WALCommand_OP_SWAP {
+				pairs = append(pairs, &kvpb.WALPair{Key: sub.Key, Value: sub.Value})
+			}
+		}
+	default:
+		return nil
+	}
+	projected := make(map[string]namespaceUsage)
+	for _, p := range pairs {
+		ns := namespaceOf(p.Key)
+		if _, ok := s.quotas[ns]; !ok {
+			continue
+		}
+		u, ok := projected[ns]
+		if !ok {
+			u = s.usage[ns]
+		}
+		if prev, found := s.getLiveLocked(p.Key); found {
+			u.bytes += int64(len(p.Value) - len(prev.value))
+		} else if bytes, demoted := s.demoted[p.Key]; demoted {
+			u.bytes += int64(len(p.Key)+len(p.Value)) - bytes
+		} else {
+			u.keys++
+			u.bytes += int64(len(p.Key) + len(p.Value))
+		}
+		projected[ns] = u
+	}
+	for ns, u := range projected {
+		quota := s.quotas[ns]
+		if quota.maxKeys > 0 && u.keys > quota.maxKeys {
+			return quotaError("namespace:"+ns, "namespace %q is at its quota of %d keys", ns, quota.maxKeys)
+		}
+		if quota.maxBytes > 0 && u.bytes > quota.maxBytes {
+			return quotaError("namespace:"+ns, "namespace %q would exceed its quota of %d bytes", ns, quota.maxBytes)
+		}
+	}
+	return nil
+}
+
+// namespaceUsageLocked reports usage for every namespace with data or a
+// quota, sorted by name.
+func (s *kvServer) namespaceUsageLocked() []*kvpb.NamespaceUsage {
+	names := make(map[string]bool, len(s.usage)+len(s.quotas))
+	for ns := range s.usage {
+		names[ns] = true
+	}
+	for ns := range s.quotas {
+		names[ns] = true
+	}
+	out := make([]*kvpb.NamespaceUsage, 0, len(names))
+	for ns := range names {
+		u, q := s.usage[ns], s.quotas[ns]
+		out = append(out, &kvpb.NamespaceUsage{
+			Namespace: ns,
+			Keys:      uint64(u.keys),
+			Bytes:     uint64(u.bytes),
+			MaxKeys:   uint64(q.maxKeys),
+			MaxBytes:  uint64(q.maxBytes),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Namespace < out[j].Namespace })
+	return out
+}
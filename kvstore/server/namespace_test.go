@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestNamespaceQuotaRejectsWritesOverLimit(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.quotas = map[string]namespaceQuota{"tenant": {maxKeys: 2}}
+
+	put := func(reqID, key, value string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+		_, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: value})
+		return err
+	}
+	for i, key := range []string{"tenant/a", "tenant/b", "other/c"} {
+		if err := put("req-"+key, key, "v"); err != nil {
+			t.Fatalf("Put #%d (%s) failed: %v", i, key, err)
+		}
+	}
+	if err := put("req-overwrite", "tenant/a", "v2"); err != nil {
+		t.Fatalf("overwrite inside quota failed: %v", err)
+	}
+	if err := put("req-over", "tenant/c", "v"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Put over quota err = %v, want ResourceExhausted", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-del"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "tenant/b"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if err := put("req-after-delete", "tenant/c", "v"); err != nil {
+		t.Fatalf("Put after freeing quota failed: %v", err)
+	}
+
+	usage, err := (&adminServer{kv: srv}).NamespaceUsage(context.Background(), &kvpb.NamespaceUsageRequest{})
+	if err != nil {
+		t.Fatalf("NamespaceUsage() failed: %v", err)
+	}
+	var tenant *kvpb.NamespaceUsage
+	for _, ns := range usage.Namespaces {
+		if ns.Namespace == "tenant" {
+			tenant = ns
+		}
+	}
+	wantBytes := uint64(len("tenant/a") + len("v2") + len("tenant/c") + len("v"))
+	if tenant == nil || tenant.Keys != 2 || tenant.Bytes != wantBytes || tenant.MaxKeys != 2 {
+		t.Fatalf("tenant usage = %+v, want keys=2 bytes=%d max_keys=2", tenant, wantBytes)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// OIDC authentication: with --oidc_issuer, every KVS RPC must carry, as a
+// bearer token, a JWT that provider issued for --oidc_audience, so clients
+// authenticate through the organisation's SSO rather than a shared secret.
+// A token is accepted if its signature verifies against a key in the
+// provider's JWKS and its iss, aud, exp and nbf claims hold. The JWKS is
+// found through the provider's discovery document, or taken from
+// --oidc_jwks_url, and cached: it is fetched again every --oidc_jwks_refresh,
+// and sooner when a token names a key it does not hold, as after the
+// provider rotates keys, though at most once per oidcMinRefetch. Fetches
+// run in the background, one at a time; tokens signed by a cached key are
+// checked against it meanwhile, and only tokens that need the new keys wait.
+//
+// With --oidc_one_time_tokens each token is good for one request: it must
+// carry a jti, which is remembered until the token expires, and a token
+// seen before is refused, so a request captured on the wire cannot be sent
+// again. Clients then mint a token per request, retries included: the
+// token is checked before the request ID, so a retried write with a used
+// token is refused even if its first attempt was applied, and only with a
+// fresh token does the deduplication cache answer it. The in-tree client
+// mints tokens with --auth_token_command; a fixed --auth_token works for
+// one request. Each server remembers only the tokens it was sent, so the
+// provider should scope a token's aud to the cluster and its exp to
+// seconds.
+//
+// The claim named by --oidc_identity_claim is the caller's identity, which
+// handlers read with identityFromContext and the request trace records.
+// Discovery and liveness RPCs (GetServerInfo, Capabilities, Ping) and
+// health checks stay open for managers and load balancers, and Admin is
+// guarded by --admin_token instead.
+
+const (
+	// oidcClockSkew is how far exp and nbf may be off before a token is
+	// refused, for clock drift between the provider and this server.
+	oidcClockSkew = time.Minute
+	// oidcMinRefetch bounds how often tokens signed by keys the cache does
+	// not hold can make the server fetch the JWKS.
+	oidcMinRefetch = 30 * time.Second
+)
+
+// oidcOpenMethods need no token.
+var oidcOpenMethods = map[string]bool{
+	"GetServerInfo": true,
+	"Capabilities":  true,
+	"Ping":          true,
+}
+
+type identityKey struct{}
+
+// identityFromContext returns the authenticated caller's identity, or "" if
+// the server does not authenticate callers.
+func identityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// oidcVerifier checks bearer JWTs from one provider. A nil *oidcVerifier
+// admits every call.
+type oidcVerifier struct {
+	issuer, audience, claim string
+	refresh                 time.Duration
+	client                  *http.Client
+
+	// jwksURL is --oidc_jwks_url, or found by discovery on first fetch. Only
+	// the fetch in flight uses it.
+	jwksURL string
+
+	mu sync.Mutex
+	// keys is the cached JWKS by key ID; fetched is when it was loaded and
+	// attempted when a load was last tried.
+	keys               map[string]crypto.PublicKey
+	fetched, attempted time.Time
+	// loading is closed when the fetch in flight, if any, finishes.
+	loading chan struct{}
+
+	// used maps the jti of each token accepted under
+	// --oidc_one_time_tokens to when the token stops being valid; it is
+	// nil without the flag. pruned is when expired entries were last
+	// dropped.
+	usedMu sync.Mutex
+	used   map[string]time.Time
+	pruned time.Time
+
+	accepted      atomic.Uint64
+	rejected      atomic.Uint64
+	replays       atomic.Uint64
+	fetches       atomic.Uint64
+	fetchFailures atomic.Uint64
+}
+
+func newOIDCVerifier(issuer, audience, jwksURL, claim string, refresh time.Duration, oneTime bool) (*oidcVerifier, error) {
+	if issuer == "" {
+		if audience != "" || jwksURL != "" || oneTime {
+			return nil, errors.New("--oidc_audience, --oidc_jwks_url and --oidc_one_time_tokens need --oidc_issuer")
+		}
+		return nil, nil
+	}
+	if audience == "" {
+		return nil, errors.New("--oidc_issuer needs --oidc_audience")
+	}
+	if claim == "" {
+		return nil, errors.New("--oidc_identity_claim must name a claim")
+	}
+	if refresh < oidcMinRefetch {
+		return nil, fmt.Errorf("--oidc_jwks_refresh must be at least %v", oidcMinRefetch)
+	}
+	v := &oidcVerifier{
+		issuer:   issuer,
+		audience: audience,
+		claim:    claim,
+		refresh:  refresh,
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if oneTime {
+		v.used = make(map[string]time.Time)
+	}
+	return v, nil
+}
+
+func oidcGuarded(fullMethod string) bool {
+	method, ok := strings.CutPrefix(fullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/")
+	return ok && !oidcOpenMethods[method]
+}
+
+// authenticate returns ctx carrying the caller's identity, or fails with
+// Unauthenticated. Every bearer value is tried, as a call may carry the
+// admin token beside its JWT.
+func (v *oidcVerifier) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	err := status.Error(codes.Unauthenticated, "requests require a bearer token from the OIDC provider")
+	for _, h := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok {
+			continue
+		}
+		identity, verr := v.verify(ctx, token, time.Now())
+		if verr == nil {
+			v.accepted.Add(1)
+			return context.WithValue(ctx, identityKey{}, identity), nil
+		}
+		if err = verr; status.Code(err) == codes.Unknown {
+			err = status.Errorf(codes.Unauthenticated, "invalid bearer token: %v", verr)
+		}
+	}
+	v.rejected.Add(1)
+	return ctx, err
+}
+
+func (v *oidcVerifier) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if v == nil || !oidcGuarded(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	ctx, err := v.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (v *oidcVerifier) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if v == nil || !oidcGuarded(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	ctx, err := v.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextStream is a ServerStream with a replaced context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	Expiry    float64     `json:"exp"`
+	NotBefore float64     `json:"nbf"`
+	ID        string      `json:"jti"`
+}
+
+// jwtAudience is the aud claim, which is a string or an array of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return errors.New("aud is neither a string nor an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+// verify checks token's signature and claims at now and returns the
+// caller's identity. Errors other than status errors describe a bad token.
+func (v *oidcVerifier) verify(ctx context.Context, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("not a signed JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("header: %w", err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return "", fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("signature is not base64url")
+	}
+	key, err := v.key(ctx, header.Kid, now)
+	if err != nil {
+		return "", err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(header.Alg, key, hash, h.Sum(nil), sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("claims: %w", err)
+	}
+	if claims.Issuer != v.issuer {
+		return "", fmt.Errorf("issuer %q is not %q", claims.Issuer, v.issuer)
+	}
+	audienceOK := false
+	for _, aud := range claims.Audience {
+		audienceOK = audienceOK || aud == v.audience
+	}
+	if !audienceOK {
+		return "", fmt.Errorf("token is not for audience %q", v.audience)
+	}
+	if claims.Expiry == 0 {
+		return "", errors.New("token has no exp")
+	}
+	exp := time.Unix(int64(claims.Expiry), 0)
+	if now.After(exp.Add(oidcClockSkew)) {
+		return "", fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf := time.Unix(int64(claims.NotBefore), 0); claims.NotBefore != 0 && now.Add(oidcClockSkew).Before(nbf) {
+		return "", fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+
+	var all map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &all); err != nil {
+		return "", fmt.Errorf("claims: %w", err)
+	}
+	var identity string
+	if err := json.Unmarshal(all[v.claim], &identity); err != nil || identity == "" {
+		return "", fmt.Errorf("token has no %s claim", v.claim)
+	}
+	if err := v.useOnce(claims.ID, exp.Add(oidcClockSkew), now); err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+// useOnce records that the token with jti, valid until expires, has been
+// used, and fails if it was used before. It does nothing without
+// --oidc_one_time_tokens.
+func (v *oidcVerifier) useOnce(jti string, expires, now time.Time) error {
+	if v.used == nil {
+		return nil
+	}
+	if jti == "" {
+		return errors.New("token has no jti, which one-time tokens need")
+	}
+	v.usedMu.Lock()
+	defer v.usedMu.Unlock()
+	if now.Sub(v.pruned) >= oidcMinRefetch {
+		// Expired tokens are refused anyway, so their entries can go.
+		for id, until := range v.used {
+			if now.After(until) {
+				delete(v.used, id)
+			}
+		}
+		v.pruned = now
+	}
+	if _, seen := v.used[jti]; seen {
+		v.replays.Add(1)
+		return fmt.Errorf("token %q was already used", jti)
+	}
+	v.used[jti] = expires
+	return nil
+}
+
+func decodeJWTPart(part string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("not base64url")
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return errors.New("not a JSON object")
+	}
+	return nil
+}
+
+// jwtHashes are the supported signing algorithms. HMAC and "none" are
+// deliberately absent: a provider's tokens are checked with its public
+// keys.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurves is the curve each ECDSA algorithm signs with.
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %s does not match the RSA signing key", alg)
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if jwtCurves[alg] != k.Curve {
+			return fmt.Errorf("alg %s does not match the %s signing key", alg, k.Curve.Params().Name)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("bad signature")
+		}
+	default:
+		return errors.New("unsupported signing key")
+	}
+	return nil
+}
+
+// key returns the signing key kid names, or the only key if kid is empty,
+// fetching the JWKS if the cache is stale or lacks it. A stale key is
+// returned at once while the fetch runs.
+func (v *oidcVerifier) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, found := v.lookupLocked(kid)
+	if found && now.Sub(v.fetched) < v.refresh {
+		v.mu.Unlock()
+		return key, nil
+	}
+	loading := v.loading
+	if loading == nil && now.Sub(v.attempted) >= oidcMinRefetch {
+		v.attempted = now
+		loading = make(chan struct{})
+		v.loading = loading
+		go v.load(now, loading)
+	}
+	v.mu.Unlock()
+	if found {
+		return key, nil
+	}
+	if loading != nil {
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, found = v.lookupLocked(kid)
+	switch {
+	case found:
+		return key, nil
+	case v.keys == nil:
+		return nil, retryableError(codes.Unavailable, oidcMinRefetch, "the OIDC provider's signing keys could not be fetched")
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// load fetches the JWKS into the cache as of now, then closes done. It
+// does not take a caller's context, so one caller giving up does not fail
+// the fetch for the others.
+func (v *oidcVerifier) load(now time.Time, done chan struct{}) {
+	v.fetches.Add(1)
+	keys, err := v.fetch(context.Background())
+	v.mu.Lock()
+	if err != nil {
+		// A key already cached stays in use while the provider is
+		// unreachable.
+		v.fetchFailures.Add(1)
+		log.Printf("fetching OIDC signing keys failed: %v", err)
+	} else {
+		v.keys, v.fetched = keys, now
+	}
+	v.loading = nil
+	v.mu.Unlock()
+	close(done)
+}
+
+func (v *oidcVerifier) lookupLocked(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// fetch loads the JWKS, discovering its URL first if need be.
+func (v *oidcVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if v.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("discovery: %w", err)
+		}
+		if discovery.Issuer != v.issuer {
+			return nil, fmt.Errorf("discovery: provider reports issuer %q, not %q", discovery.Issuer, v.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("discovery: no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("skipping OIDC signing key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks: no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonWebKey is one key of a JWKS (RFC 7517); only public RSA and EC keys
+// are used.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	field := func(name, s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("bad %s", name)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := field("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := field("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+func (v *oidcVerifier) registerMetrics(r *metricsRegistry) {
+	r.counter("kv_oidc_accepted_total", "Requests whose OIDC bearer token was accepted.", func() float64 { return float64(v.accepted.Load()) })
+	r.counter("kv_oidc_rejected_total", "Requests refused for a missing or invalid OIDC bearer token.", func() float64 { return float64(v.rejected.Load()) })
+	r.counter("kv_oidc_replays_total", "Requests refused for reusing a one-time token under --oidc_one_time_tokens.", func() float64 { return float64(v.replays.Load()) })
+	r.counter("kv_oidc_jwks_fetches_total", "Fetches of the OIDC provider's signing keys.", func() float64 { return float64(v.fetches.Load()) })
+	r.counter("kv_oidc_jwks_fetch_failures_total", "Fetches of the OIDC provider's signing keys that failed.", func() float64 { return float64(v.fetchFailures.Load()) })
+}
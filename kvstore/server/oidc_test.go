@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// testProvider is an OIDC provider serving discovery and a JWKS.
+type testProvider struct {
+	*httptest.Server
+	mu         sync.Mutex
+	keys       []map[string]string
+	jwksServed int
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	p := &testProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.URL, "jwks_uri": p.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.jwksServed++
+		json.NewEncoder(w).Encode(map[string]any{"keys": p.keys})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) publish(keys ...map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := jwtHashes[alg].New()
+	digest.Write([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, jwtHashes[alg], digest.Sum(nil)); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(sig)
+}
+
+func TestOIDCVerifiesTokens(t *testing.T) {
+	provider := newTestProvider(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.publish(rsaJWK("r1", rsaKey))
+	v, err := newOIDCVerifier(provider.URL, "kvstore", "", "email", time.Hour, false)
+	if err != nil {
+		t.Fatalf("newOIDCVerifier: %v", err)
+	}
+	now := time.Now()
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": provider.URL, "aud": []string{"other", "kvstore"}, "exp": now.Add(time.Hour).Unix(), "sub": "u-17", "email": "ann@example.com"}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	identity, err := v.verify(context.Background(), signJWT(t, "RS256", "r1", rsaKey, claims(nil)), now)
+	if err != nil || identity != "ann@example.com" {
+		t.Fatalf("verify valid token = %q, %v; want ann@example.com", identity, err)
+	}
+	for name, token := range map[string]string{
+		"wrong audience": signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["aud"] = "other" })),
+		"wrong issuer":   signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })),
+		"expired":        signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["exp"] = now.Add(-2 * oidcClockSkew).Unix() })),
+		"no exp":         signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })),
+		"not yet valid":  signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { c["nbf"] = now.Add(2 * oidcClockSkew).Unix() })),
+		"no identity":    signJWT(t, "RS256", "r1", rsaKey, claims(func(c map[string]any) { delete(c, "email") })),
+		"alg mismatch":   signJWT(t, "ES256", "r1", ecKey, claims(nil)),
+		"unsigned":       strings.Join(strings.Split(signJWT(t, "RS256", "r1", rsaKey, claims(nil)), ".")[:2], ".") + ".",
+		"alg none":       b64([]byte(`{"alg":"none"}`)) + "." + strings.Split(signJWT(t, "RS256", "r1", rsaKey, claims(nil)), ".")[1] + ".",
+		"tampered payload": func() string {
+			p := strings.Split(signJWT(t, "RS256", "r1", rsaKey, claims(nil)), ".")
+			p[1] = b64([]byte(`{"iss":"x"}`))
+			return strings.Join(p, ".")
+		}(),
+	} {
+		if _, err := v.verify(context.Background(), token, now); err == nil {
+			t.Errorf("verify %s token succeeded, want an error", name)
+		}
+	}
+
+	// A token from a rotated-in key refetches the JWKS, once.
+	provider.publish(rsaJWK("r1", rsaKey), ecJWK("e1", ecKey))
+	served := provider.jwksServed
+	if identity, err := v.verify(context.Background(), signJWT(t, "ES256", "e1", ecKey, claims(nil)), now.Add(oidcMinRefetch)); err != nil || identity != "ann@example.com" {
+		t.Fatalf("verify token from a new key = %q, %v; want it accepted after a refetch", identity, err)
+	}
+	if _, err := v.verify(context.Background(), signJWT(t, "ES256", "e2", ecKey, claims(nil)), now.Add(oidcMinRefetch+time.Second)); err == nil {
+		t.Fatal("verify token from an unknown key succeeded")
+	}
+	if got := provider.jwksServed - served; got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1: unknown keys refetch at most once per %v", got, oidcMinRefetch)
+	}
+}
+
+func TestOIDCServesCachedKeysDuringRefresh(t *testing.T) {
+	provider := newTestProvider(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.publish(rsaJWK("r1", rsaKey))
+	v, err := newOIDCVerifier(provider.URL, "kvstore", "", "email", time.Minute, false)
+	if err != nil {
+		t.Fatalf("newOIDCVerifier: %v", err)
+	}
+	now := time.Now()
+	token := signJWT(t, "RS256", "r1", rsaKey, map[string]any{"iss": provider.URL, "aud": "kvstore", "exp": now.Add(24 * time.Hour).Unix(), "email": "ann@example.com"})
+	if _, err := v.verify(context.Background(), token, now); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// The provider hangs; the stale cache still verifies, and the refresh
+	// it starts does not hold up later tokens either.
+	provider.mu.Lock()
+	for i := 1; i <= 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := v.verify(ctx, token, now.Add(time.Duration(i)*time.Hour))
+		cancel()
+		if err != nil {
+			provider.mu.Unlock()
+			t.Fatalf("verify during a refresh: %v", err)
+		}
+	}
+	v.mu.Lock()
+	loading := v.loading
+	v.mu.Unlock()
+	provider.mu.Unlock()
+	if loading == nil {
+		t.Fatal("no refresh started for a stale cache")
+	}
+	<-loading
+	if got := v.fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2: one refresh at a time", got)
+	}
+}
+
+func TestOIDCGuardsDataPlane(t *testing.T) {
+	provider := newTestProvider(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.publish(rsaJWK("r1", key))
+	v, err := newOIDCVerifier(provider.URL, "kvstore", provider.URL+"/keys", "sub", time.Hour, false)
+	if err != nil {
+		t.Fatalf("newOIDCVerifier: %v", err)
+	}
+	token := signJWT(t, "RS256", "r1", key, map[string]any{"iss": provider.URL, "aud": "kvstore", "exp": time.Now().Add(time.Hour).Unix(), "sub": "svc-billing"})
+	var seen string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen = identityFromContext(ctx)
+		return "ok", nil
+	}
+	call := func(method string, tokens ...string) error {
+		ctx := context.Background()
+		if len(tokens) > 0 {
+			md := metadata.MD{}
+			for _, tok := range tokens {
+				md.Append("authorization", "Bearer "+tok)
+			}
+			ctx = metadata.NewIncomingContext(ctx, md)
+		}
+		seen = ""
+		_, err := v.unaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	get := "/" + kvpb.KVS_ServiceDesc.ServiceName + "/Get"
+
+	if err := call(get); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Get without a token: err = %v, want Unauthenticated", err)
+	}
+	if err := call(get, "not-a-jwt"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Get with a bad token: err = %v, want Unauthenticated", err)
+	}
+	if err := call(get, "admin-secret", token); err != nil || seen != "svc-billing" {
+		t.Fatalf("Get with a JWT beside the admin token: err = %v, identity %q; want svc-billing", err, seen)
+	}
+	if err := call("/" + kvpb.KVS_ServiceDesc.ServiceName + "/GetServerInfo"); err != nil {
+		t.Fatalf("GetServerInfo without a token failed: %v", err)
+	}
+	if err := call("/" + kvpb.Admin_ServiceDesc.ServiceName + "/Stats"); err != nil {
+		t.Fatalf("Admin call without a JWT failed: %v; Admin is guarded by --admin_token", err)
+	}
+	if _, err := (*oidcVerifier)(nil).unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: get}, handler); err != nil {
+		t.Fatalf("no issuer configured: err = %v, want every call admitted", err)
+	}
+}
+
+func TestOIDCOneTimeTokensRefuseReplays(t *testing.T) {
+	provider := newTestProvider(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.publish(rsaJWK("r1", key))
+	v, err := newOIDCVerifier(provider.URL, "kvstore", provider.URL+"/keys", "sub", time.Hour, true)
+	if err != nil {
+		t.Fatalf("newOIDCVerifier: %v", err)
+	}
+	now := time.Now()
+	token := func(jti string) string {
+		c := map[string]any{"iss": provider.URL, "aud": "kvstore", "exp": now.Add(time.Minute).Unix(), "sub": "u-17"}
+		if jti != "" {
+			c["jti"] = jti
+		}
+		return signJWT(t, "RS256", "r1", key, c)
+	}
+
+	if _, err := v.verify(context.Background(), token(""), now); err == nil {
+		t.Fatal("verify token without a jti succeeded")
+	}
+	first := token("j1")
+	if _, err := v.verify(context.Background(), first, now); err != nil {
+		t.Fatalf("verify first use: %v", err)
+	}
+	if _, err := v.verify(context.Background(), first, now.Add(time.Second)); err == nil {
+		t.Fatal("verify replayed token succeeded")
+	}
+	if _, err := v.verify(context.Background(), token("j2"), now.Add(time.Second)); err != nil {
+		t.Fatalf("verify fresh token: %v", err)
+	}
+	if got := v.replays.Load(); got != 1 {
+		t.Fatalf("replays = %d, want 1", got)
+	}
+
+	// Once the tokens have expired their entries are dropped.
+	if err := v.useOnce("j3", now.Add(3*time.Minute), now.Add(2*time.Minute+oidcMinRefetch)); err != nil {
+		t.Fatalf("useOnce: %v", err)
+	}
+	v.usedMu.Lock()
+	defer v.usedMu.Unlock()
+	if len(v.used) != 1 {
+		t.Fatalf("%d tokens remembered after the others expired, want 1", len(v.used))
+	}
+}
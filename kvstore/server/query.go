@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 10000
+)
+
+// queryToken is one lexical token of a query: a word, a 'quoted' string, a
+// ? placeholder or a punctuation mark.
+type queryToken struct {
+	kind byte // 'w' word, 's' string, '?' placeholder, 'p' punctuation
+	text string
+}
+
+func lexQuery(sql string) ([]queryToken, error) {
+	var toks []queryToken
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at offset %d", i)
+				}
+				if sql[j] == '\'' {
+					if j+1 < len(sql) && sql[j+1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(sql[j])
+				j++
+			}
+			toks = append(toks, queryToken{kind: 's', text: b.String()})
+			i = j + 1
+		case c == '?':
+			toks = append(toks, queryToken{kind: '?', text: "?"})
+			i++
+		case c == '<' || c == '>' || c == '!':
+			if i+1 < len(sql) && sql[i+1] == '=' {
+				toks = append(toks, queryToken{kind: 'p', text: sql[i : i+2]})
+				i += 2
+			} else if c == '<' && i+1 < len(sql) && sql[i+1] == '>' {
+				toks = append(toks, queryToken{kind: 'p', text: "!="})
+				i += 2
+			} else if c == '!' {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			} else {
+				toks = append(toks, queryToken{kind: 'p', text: string(c)})
+				i++
+			}
+		case c == '=' || c == ',' || c == '*' || c == ';':
+			toks = append(toks, queryToken{kind: 'p', text: string(c)})
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(sql) && (sql[j] == '_' || unicode.IsLetter(rune(sql[j])) || unicode.IsDigit(rune(sql[j]))) {
+				j++
+			}
+			toks = append(toks, queryToken{kind: 'w', text: sql[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+	}
+	return toks, nil
+}
+
+var queryComparisons = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// queryCond is one condition of a WHERE clause.
+type queryCond struct {
+	column         string // "key" or "value"
+	op             string // =, !=, <, <=, >, >=, BETWEEN or LIKE
+	operand, upper string
+	like           *regexp.Regexp
+}
+
+func (c queryCond) match(it item) bool {
+	v := it.fullKey()
+	if c.column == "value" {
+		v = it.value
+	}
+	switch c.op {
+	case "=":
+		return v == c.operand
+	case "!=":
+		return v != c.operand
+	case "<":
+		return v < c.operand
+	case "<=":
+		return v <= c.operand
+	case ">":
+		return v > c.operand
+	case ">=":
+		return v >= c.operand
+	case "BETWEEN":
+		return c.operand <= v && v <= c.upper
+	case "LIKE":
+		return c.like.MatchString(v)
+	}
+	return false
+}
+
+// likePrefix returns the literal text a LIKE pattern starts with.
+func likePrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "%_"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+func compileLike(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString("(?s:.*)")
+		case '_':
+			b.WriteString("(?s:.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// parsedQuery is a query ready to run: the key range to walk, the conditions
+// every row must meet, the selected columns and the row limit.
+type parsedQuery struct {
+	columns []string
+	conds   []queryCond
+	limit   int
+	// start is the first key to visit; walking stops past end if hasEnd,
+	// and at the first key without prefix once past it.
+	start  string
+	end    string
+	hasEnd bool
+	prefix string
+}
+
+type queryParser struct {
+	toks   []queryToken
+	pos    int
+	args   []string
+	used   int
+	redact redaction
+}
+
+func (p *queryParser) peek() queryToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return queryToken{}
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// keyword consumes the next token if it is the word kw in any case.
+func (p *queryParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'w' && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(kw string) error {
+	if !p.keyword(kw) {
+		return fmt.Errorf("expected %s, got %s", kw, p.describe())
+	}
+	return nil
+}
+
+func (p *queryParser) describe() string {
+	t := p.peek()
+	switch t.kind {
+	case 0:
+		return "end of query"
+	case 's':
+		return fmt.Sprintf("'%s'", p.redact.text(t.text))
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (p *queryParser) column() (string, error) {
+	t := p.peek()
+	if t.kind == 'w' && (strings.EqualFold(t.text, "key") || strings.EqualFold(t.text, "value")) {
+		p.pos++
+		return strings.ToLower(t.text), nil
+	}
+	return "", fmt.Errorf("expected key or value, got %s", p.describe())
+}
+
+func (p *queryParser) operand() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return t.text, nil
+	case '?':
+		if p.used >= len(p.args) {
+			return "", fmt.Errorf("placeholder %d has no argument", p.used+1)
+		}
+		p.used++
+		return p.args[p.used-1], nil
+	}
+	p.pos--
+	return "", fmt.Errorf("expected a 'string' or ?, got %s", p.describe())
+}
+
+func (p *queryParser) cond() (queryCond, error) {
+	col, err := p.column()
+	if err != nil {
+		return queryCond{}, err
+	}
+	c := queryCond{column: col}
+	switch t := p.peek(); {
+	case t.kind == 'p' && queryComparisons[t.text]:
+		p.pos++
+		c.op = t.text
+		c.operand, err = p.operand()
+	case p.keyword("BETWEEN"):
+		c.op = "BETWEEN"
+		if c.operand, err = p.operand(); err != nil {
+			return c, err
+		}
+		if err = p.expect("AND"); err != nil {
+			return c, err
+		}
+		c.upper, err = p.operand()
+	case p.keyword("LIKE"):
+		c.op = "LIKE"
+		if c.operand, err = p.operand(); err == nil {
+			c.like = compileLike(c.operand)
+		}
+	default:
+		err = fmt.Errorf("expected a comparison after %s, got %s", col, p.describe())
+	}
+	return c, err
+}
+
+// parseQuery parses sql, binding its placeholders to args. String literals
+// in its errors are redacted by redact.
+func parseQuery(sql string, args []string, redact redaction) (*parsedQuery, error) {
+	toks, err := lexQuery(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks, args: args, redact: redact}
+	q := &parsedQuery{}
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == 'p' && t.text == "*" {
+		p.pos++
+		q.columns = []string{"key", "value"}
+	} else {
+		for {
+			col, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			q.columns = append(q.columns, col)
+			if t := p.peek(); t.kind != 'p' || t.text != "," {
+				break
+			}
+			p.pos++
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if !p.keyword("kv") {
+		return nil, fmt.Errorf("the only table is kv, got %s", p.describe())
+	}
+	if p.keyword("WHERE") {
+		for {
+			c, err := p.cond()
+			if err != nil {
+				return nil, err
+			}
+			q.conds = append(q.conds, c)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != 'w' || err != nil || n <= 0 {
+			return nil, fmt.Errorf("LIMIT takes a positive number, got %q", t.text)
+		}
+		q.limit = n
+	}
+	if t := p.peek(); t.kind == 'p' && t.text == ";" {
+		p.pos++
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.describe())
+	}
+	if p.used < len(args) {
+		return nil, fmt.Errorf("%d arguments for %d placeholders", len(args), p.used)
+	}
+	q.bound()
+	return q, nil
+}
+
+// bound narrows the key range to walk from the key conditions.
+func (q *parsedQuery) bound() {
+	lower := func(k string) {
+		if k > q.start {
+			q.start = k
+		}
+	}
+	upper := func(k string) {
+		if !q.hasEnd || k < q.end {
+			q.end, q.hasEnd = k, true
+		}
+	}
+	for _, c := range q.conds {
+		if c.column != "key" {
+			continue
+		}
+		switch c.op {
+		case "=":
+			lower(c.operand)
+			upper(c.operand)
+		case ">", ">=":
+			lower(c.operand)
+		case "<", "<=":
+			upper(c.operand)
+		case "BETWEEN":
+			lower(c.operand)
+			upper(c.upper)
+		case "LIKE":
+			if prefix := likePrefix(c.operand); len(prefix) > len(q.prefix) {
+				q.prefix = prefix
+				lower(prefix)
+			}
+		}
+	}
+}
+
+// runLocked walks tree for the query's rows.
+func (q *parsedQuery) runLocked(s *kvServer, limit int) (*kvpb.QueryReply, error) {
+	reply := &kvpb.QueryReply{Columns: q.columns, Rows: make([]*kvpb.KVPair, 0), Limit: uint32(limit)}
+	withValue := slices.Contains(q.columns, "value")
+	readsValue := withValue || slices.ContainsFunc(q.conds, func(c queryCond) bool { return c.column == "value" })
+	var corrupt error
+	s.tree.AscendGreaterOrEqual(item{key: q.start}, func(it item) bool {
+		key := it.fullKey()
+		if q.hasEnd && key > q.end {
+			return false
+		}
+		if q.prefix != "" && !strings.HasPrefix(key, q.prefix) {
+			return false
+		}
+		if it.tombstone {
+			return true
+		}
+		reply.Examined++
+		if readsValue {
+			if corrupt = s.verifyValue(key, it); corrupt != nil {
+				return false
+			}
+		}
+		for _, c := range q.conds {
+			if !c.match(it) {
+				return true
+			}
+		}
+		if len(reply.Rows) == limit {
+			reply.Truncated = true
+			return false
+		}
+		row := &kvpb.KVPair{Key: key}
+		if withValue {
+			row.Value = it.value
+		}
+		reply.Rows = append(reply.Rows, row)
+		return true
+	})
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return reply, nil
+}
+
+func (s *kvServer) Query(ctx context.Context, req *kvpb.QueryRequest) (*kvpb.QueryReply, error) {
+	if err := s.checkRangeRead("query"); err != nil {
+		return nil, err
+	}
+	q, err := parseQuery(req.Sql, req.Args, s.redact)
+	if err != nil {
+		return nil, invalidFieldError("sql", "invalid query: %v", err)
+	}
+	limit := defaultQueryLimit
+	if q.limit > 0 {
+		limit = min(q.limit, maxQueryLimit)
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	return q.runLocked(s, limit)
+}
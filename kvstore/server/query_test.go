@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestParseQueryRejectsBadQueries(t *testing.T) {
+	for _, tc := range []struct {
+		sql  string
+		args []string
+		want string
+	}{
+		{"DELETE FROM kv", nil, "expected SELECT"},
+		{"SELECT name FROM kv", nil, "expected key or value"},
+		{"SELECT * FROM users", nil, "the only table is kv"},
+		{"SELECT * FROM kv WHERE key ~ 'a'", nil, "unexpected"},
+		{"SELECT * FROM kv WHERE key = ?", nil, "placeholder 1 has no argument"},
+		{"SELECT * FROM kv WHERE key = ?", []string{"a", "b"}, "2 arguments for 1 placeholders"},
+		{"SELECT * FROM kv WHERE value LIKE 'a", nil, "unterminated string"},
+		{"SELECT * FROM kv LIMIT 0", nil, "LIMIT takes a positive number"},
+		{"SELECT * FROM kv WHERE key BETWEEN 'a' 'b'", nil, "expected AND"},
+		{"SELECT * FROM kv extra", nil, "unexpected"},
+	} {
+		if _, err := parseQuery(tc.sql, tc.args, redaction{}); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseQuery(%q) error = %v, want one containing %q", tc.sql, err, tc.want)
+		}
+	}
+}
+
+func TestQueryFiltersAndBoundsTheWalk(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	for _, kv := range [][2]string{
+		{"user/1", "alice"}, {"user/2", "bob"}, {"user/3", "alfred"}, {"user/4", "it's"},
+		{"order/1", "alpha"}, {"zebra", "al"},
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-"+kv[0]))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: kv[0], Value: kv[1]}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", kv[0], err)
+		}
+	}
+	query := func(sql string, args ...string) *kvpb.QueryReply {
+		t.Helper()
+		reply, err := srv.Query(context.Background(), &kvpb.QueryRequest{Sql: sql, Args: args})
+		if err != nil {
+			t.Fatalf("Query(%q) failed: %v", sql, err)
+		}
+		return reply
+	}
+	rows := func(reply *kvpb.QueryReply) string {
+		var out []string
+		for _, r := range reply.Rows {
+			out = append(out, r.Key+"="+r.Value)
+		}
+		return strings.Join(out, " ")
+	}
+
+	reply := query("select key, value from kv where key like ? and value like 'al%'", "user/%")
+	if got := rows(reply); got != "user/1=alice user/3=alfred" {
+		t.Errorf("rows = %q, want user/1 and user/3", got)
+	}
+	if reply.Examined != 4 {
+		t.Errorf("examined = %d, want only the 4 user/ keys", reply.Examined)
+	}
+	if got := rows(query("SELECT value FROM kv WHERE key BETWEEN 'user/2' AND 'user/3'")); got != "user/2=bob user/3=alfred" {
+		t.Errorf("rows = %q, want user/2 and user/3", got)
+	}
+	if got := rows(query("SELECT key FROM kv WHERE value = 'it''s';")); got != "user/4=" {
+		t.Errorf("rows = %q, want user/4 without its value for a quoted quote", got)
+	}
+	reply = query("SELECT * FROM kv WHERE key > 'order/1' AND value LIKE 'a_%' LIMIT 2")
+	if got := rows(reply); got != "user/1=alice user/3=alfred" || !reply.Truncated {
+		t.Errorf("rows = %q truncated=%v, want two rows and truncated", got, reply.Truncated)
+	}
+
+	_, err := srv.Query(context.Background(), &kvpb.QueryRequest{Sql: "SELECT * FROM kv WHERE"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Query with a dangling WHERE = %v, want InvalidArgument", err)
+	}
+}
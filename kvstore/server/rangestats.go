@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const (
+	histogramBuckets = 256
+	// The histogram is rebuilt once writes since the last build exceed this
+	// fraction of the keys it covered, or histogramMinDrift if that is more.
+	histogramMaxDrift = 0.1
+	histogramMinDrift = 1000
+)
+
+// rangeHistogram is an equi-depth histogram of the live keys: each bucket
+// covers about the same number of consecutive keys.
+type rangeHistogram struct {
+	buckets               []histogramBucket
+	totalKeys, totalBytes int64
+}
+
+type histogramBucket struct {
+	first, last string
+	keys, bytes int64
+}
+
+func (s *kvServer) buildHistogramLocked() *rangeHistogram {
+	h := &rangeHistogram{}
+	per := max(1, s.liveKeys/histogramBuckets)
+	var cur *histogramBucket
+	s.tree.Ascend(func(it item) bool {
+		if it.tombstone {
+			return true
+		}
+		key := it.fullKey()
+		if cur == nil || cur.keys >= int64(per) {
+			h.buckets = append(h.buckets, histogramBucket{first: key})
+			cur = &h.buckets[len(h.buckets)-1]
+		}
+		size := int64(len(key) + len(it.value))
+		cur.last = key
+		cur.keys++
+		cur.bytes += size
+		h.totalKeys++
+		h.totalBytes += size
+		return true
+	})
+	return h
+}
+
+func (h *rangeHistogram) driftLimit() int {
+	return max(histogramMinDrift, int(histogramMaxDrift*float64(h.totalKeys)))
+}
+
+// estimate counts buckets that lie inside [start, end] in full and buckets
+// that straddle a boundary at half.
+func (h *rangeHistogram) estimate(start, end string) (float64, float64) {
+	var keys, bytes float64
+	for _, b := range h.buckets {
+		switch {
+		case b.last < start || b.first > end:
+		case b.first >= start && b.last <= end:
+			keys += float64(b.keys)
+			bytes += float64(b.bytes)
+		default:
+			keys += float64(b.keys) / 2
+			bytes += float64(b.bytes) / 2
+		}
+	}
+	return keys, bytes
+}
+
+// rangeStatsLocked estimates the live keys and bytes in [start, end],
+// scaling the histogram to the current totals.
+func (s *kvServer) rangeStatsLocked(start, end string) (uint64, uint64) {
+	if s.histogram == nil || s.histogramDrift > s.histogram.driftLimit() {
+		s.histogram = s.buildHistogramLocked()
+		s.histogramDrift = 0
+	}
+	h := s.histogram
+	if h.totalKeys == 0 {
+		return 0, 0
+	}
+	var liveBytes int64
+	for _, u := range s.usage {
+		liveBytes += u.bytes
+	}
+	keys, bytes := h.estimate(start, end)
+	keys *= float64(s.liveKeys) / float64(h.totalKeys)
+	if h.totalBytes > 0 {
+		bytes *= float64(liveBytes) / float64(h.totalBytes)
+	}
+	return uint64(keys + 0.5), uint64(bytes + 0.5)
+}
+
+func (s *kvServer) RangeStats(ctx context.Context, req *kvpb.RangeStatsRequest) (*kvpb.RangeStatsReply, error) {
+	if req.StartKey > req.EndKey {
+		return nil, invalidFieldError("start_key", "start_key must not be after end_key")
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	keys, bytes := s.rangeStatsLocked(req.StartKey, req.EndKey)
+	return &kvpb.RangeStatsReply{Keys: keys, Bytes: bytes, TotalKeys: uint64(s.liveKeys)}, nil
+}
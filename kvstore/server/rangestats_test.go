@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestRangeStatsEstimatesFromHistogram(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.mu.Lock()
+	for i := 0; i < 5000; i++ {
+		srv.putLocked(fmt.Sprintf("k%05d", i), "0123456789", 0)
+	}
+	srv.mu.Unlock()
+
+	within := func(got, want uint64) bool {
+		diff := int64(got) - int64(want)
+		return diff >= -int64(want)/20 && diff <= int64(want)/20
+	}
+	resp, err := srv.RangeStats(context.Background(), &kvpb.RangeStatsRequest{StartKey: "k01000", EndKey: "k01999"})
+	if err != nil {
+		t.Fatalf("RangeStats() failed: %v", err)
+	}
+	if !within(resp.Keys, 1000) || !within(resp.Bytes, 16000) || resp.TotalKeys != 5000 {
+		t.Fatalf("RangeStats(k01000..k01999) = %+v, want about 1000 keys and 16000 bytes", resp)
+	}
+
+	// Deleting half the keys outside the range scales the estimate down
+	// until enough drift accumulates to rebuild the histogram.
+	srv.mu.Lock()
+	for i := 2500; i < 5000; i++ {
+		prev, _ := srv.getLiveLocked(fmt.Sprintf("k%05d", i))
+		srv.deleteLocked(prev, 0, 0, 0)
+	}
+	srv.mu.Unlock()
+	resp, err = srv.RangeStats(context.Background(), &kvpb.RangeStatsRequest{StartKey: "k01000", EndKey: "k01999"})
+	if err != nil {
+		t.Fatalf("RangeStats() failed: %v", err)
+	}
+	if !within(resp.Keys, 1000) || resp.TotalKeys != 2500 {
+		t.Fatalf("RangeStats after deletes = %+v, want about 1000 keys of 2500", resp)
+	}
+}
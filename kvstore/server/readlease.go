@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// Read modes choose how a leader makes sure it is still the leader before
+// serving a read from its own state.
+const (
+	// readModeLeader serves reads from the leader's state without checking.
+	// It is fastest, but a deposed leader that has not noticed yet can
+	// return stale data.
+	readModeLeader = "leader"
+	// readModeReadIndex confirms leadership with a heartbeat round to a
+	// quorum before every read.
+	readModeReadIndex = "readindex"
+	// readModeLease skips the round while a lease granted by the last
+	// quorum-acknowledged heartbeat is in force, and falls back to a
+	// ReadIndex round when it is not or the clock looks unreliable.
+	readModeLease = "lease"
+)
+
+const (
+	// clockCheckInterval is how often the clock watchdog runs.
+	clockCheckInterval = 100 * time.Millisecond
+	// maxClockJump is how far the wall clock may move away from the
+	// monotonic clock between two checks before leases are suspended.
+	maxClockJump = 50 * time.Millisecond
+)
+
+func validateReadMode(mode string, lease time.Duration) error {
+	switch mode {
+	case readModeLeader, readModeReadIndex:
+		return nil
+	case readModeLease:
+		if lease <= 0 || lease >= minElectionTimeout {
+			return fmt.Errorf("read lease %s must be positive and shorter than the %s minimum election timeout", lease, minElectionTimeout)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown read mode %q (want %s, %s or %s)", mode, readModeLeader, readModeReadIndex, readModeLease)
+}
+
+// recordAckLocked notes that peerID answered a heartbeat or append the
+// leader sent at sent, which confirms leadership as of that time.
+func (s *kvServer) recordAckLocked(peerID int, sent time.Time) {
+	if !sent.After(s.peerAckSent[peerID]) {
+		return
+	}
+	s.peerAckSent[peerID] = sent
+	close(s.ackSignal)
+	s.ackSignal = make(chan struct{})
+}
+
+// quorumAckLocked returns the latest time at which a quorum, counting the
+// leader itself, is known to have accepted this replica as leader.
+func (s *kvServer) quorumAckLocked(now time.Time) time.Time {
+	acks := []time.Time{now}
+	for _, peerID := range s.peerReplicaIDs {
+		if !s.learners[peerID] {
+			acks = append(acks, s.peerAckSent[peerID])
+		}
+	}
+	slices.SortFunc(acks, func(a, b time.Time) int { return b.Compare(a) })
+	return acks[s.quorum()-1]
+}
+
+// leaseExpiryLocked returns when the current read lease runs out. Followers
+// that acknowledged a heartbeat refuse votes for minElectionTimeout after
+// receiving it, so no other leader can be elected before the lease ends as
+// long as clocks advance at roughly the same rate.
+func (s *kvServer) leaseExpiryLocked(now time.Time) time.Time {
+	if s.role != roleLeader || s.transferTarget >= 0 || now.Before(s.clockSuspectUntil) {
+		// A transfer target may win an election at any moment.
+		return time.Time{}
+	}
+	ack := s.quorumAckLocked(now)
+	if ack.Before(s.leaseFloor) {
+		// The quorum acknowledged this leader only before a transfer that
+		// gave up; a fresh round is needed to rule out its target.
+		return time.Time{}
+	}
+	return ack.Add(s.readLease)
+}
+
+// readBarrier returns once a read that arrived now may be served from this
+// replica's state. Replicas that are not the leader return at once and let
+// the handler report it.
+func (s *kvServer) readBarrier(ctx context.Context) error {
+	start := time.Now()
+	timer := opTimer{start: start, last: start}
+	s.mu.Lock()
+	timer.mark(phaseLockWait)
+	if s.readMode == readModeLeader || s.role != roleLeader {
+		s.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if s.readMode == readModeLease {
+		if now.Before(s.leaseExpiryLocked(now)) {
+			s.leaseReads++
+			s.mu.Unlock()
+			return nil
+		}
+		s.leaseFallbacks++
+	}
+	s.readIndexReads++
+	term, readIndex := s.currentTerm, s.commitIndex
+	s.mu.Unlock()
+
+	ctx, cancel := withTimeoutMargin(ctx)
+	defer cancel()
+	s.broadcastAppendEntries()
+	retry := time.NewTicker(heartbeatInterval)
+	defer retry.Stop()
+	for {
+		s.mu.Lock()
+		if s.role != roleLeader || s.currentTerm != term {
+			addr := s.leaderAddr
+			s.mu.Unlock()
+			return notLeaderError(addr)
+		}
+		if !s.quorumAckLocked(now).Before(now) && s.lastApplied >= readIndex {
+			s.mu.Unlock()
+			return nil
+		}
+		acked := s.ackSignal
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			timer.mark(phaseReplication)
+			return timer.timeoutError(ctx, "read could not confirm leadership with a quorum at seq %d", readIndex)
+		case <-acked:
+		case <-retry.C:
+			s.broadcastAppendEntries()
+		}
+	}
+}
+
+// shouldIgnoreVoteLocked reports whether a vote request must be ignored
+// because this replica heard from a live leader too recently. It applies
+// only in lease mode, where it is what keeps a lease safe. A replica that
+// just started does not know when it last heard from the leader, and its
+// ack before a restart may still hold up a lease, so it ignores votes until
+// any such lease has run out.
+func (s *kvServer) shouldIgnoreVoteLocked(now time.Time) bool {
+	if s.readMode != readModeLease {
+		return false
+	}
+	if s.role == roleLeader || now.Before(s.started.Add(minElectionTimeout+s.readLease)) {
+		return true
+	}
+	return s.leaderID != -1 && now.Sub(s.leaderContact) < minElectionTimeout
+}
+
+// clockWatchLoop suspends read leases when the wall clock jumps against the
+// monotonic clock, as it does when the host is suspended or its time is
+// stepped. Either can mean the monotonic clock no longer tracks the time
+// that followers see, so reads use ReadIndex until a fresh lease could have
+// been granted and expired.
+func (s *kvServer) clockWatchLoop(ctx context.Context) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	prev := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			mono := now.Sub(prev)
+			wall := now.Round(0).Sub(prev.Round(0))
+			prev = now
+			if drift := (wall - mono).Abs(); drift > maxClockJump {
+				until := now.Add(minElectionTimeout + s.readLease)
+				s.mu.Lock()
+				s.clockSuspectUntil = until
+				s.clockSuspicions++
+				s.mu.Unlock()
+				log.Printf("wall clock moved %s against the monotonic clock; suspending read leases until %s", drift, until.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+func (s *kvServer) registerReadMetrics(r *metricsRegistry) {
+	r.counter("kv_read_lease_reads_total", "Reads served under a leader lease.", s.locked(func() float64 { return float64(s.leaseReads) }))
+	r.counter("kv_read_index_reads_total", "Reads that confirmed leadership with a heartbeat round.", s.locked(func() float64 { return float64(s.readIndexReads) }))
+	r.counter("kv_read_lease_fallbacks_total", "Reads in lease mode that found no valid lease.", s.locked(func() float64 { return float64(s.leaseFallbacks) }))
+	r.counter("kv_clock_suspicions_total", "Times the wall clock jumped against the monotonic clock.", s.locked(func() float64 { return float64(s.clockSuspicions) }))
+	r.gauge("kv_read_lease_remaining_seconds", "Time left on the leader's read lease; 0 without one.", s.locked(func() float64 {
+		now := time.Now()
+		if left := s.leaseExpiryLocked(now).Sub(now); left > 0 {
+			return left.Seconds()
+		}
+		return 0
+	}))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// newReadModeTestLeader returns a leader of three replicas in mode whose
+// peer 1 answers appends and peer 2 never does.
+func newReadModeTestLeader(t *testing.T, mode string) *kvServer {
+	t.Helper()
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	srv.readMode, srv.readLease = mode, time.Second
+	srv.mu.Lock()
+	srv.peerClients[1] = &mockRaftPeerClient{}
+	srv.peerClients[2] = &mockRaftPeerClient{
+		appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	srv.mu.Unlock()
+	becomeTestLeader(t, srv, 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	return srv
+}
+
+func TestReadIndexConfirmsLeadershipPerRead(t *testing.T) {
+	srv := newReadModeTestLeader(t, readModeReadIndex)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := srv.Get(ctx, &kvpb.GetRequest{Key: "k"})
+		cancel()
+		if err != nil || resp.Value != "v" {
+			t.Fatalf("Get = %v, %v; want v", resp, err)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.readIndexReads != 2 || srv.leaseReads != 0 {
+		t.Fatalf("readindex=%d lease=%d, want 2 and 0", srv.readIndexReads, srv.leaseReads)
+	}
+}
+
+func TestReadIndexWaitsForQuorum(t *testing.T) {
+	srv := newReadModeTestLeader(t, readModeReadIndex)
+	srv.mu.Lock()
+	srv.peerClients[1] = srv.peerClients[2]
+	srv.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Get(ctx, &kvpb.GetRequest{Key: "k"}); err == nil {
+		t.Fatalf("Get without a reachable quorum succeeded")
+	}
+}
+
+func TestLeaseReadsSkipRoundUntilClockSuspect(t *testing.T) {
+	srv := newReadModeTestLeader(t, readModeLease)
+	get := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if resp, err := srv.Get(ctx, &kvpb.GetRequest{Key: "k"}); err != nil || resp.Value != "v" {
+			t.Fatalf("Get = %v, %v; want v", resp, err)
+		}
+	}
+	get()
+	srv.mu.Lock()
+	if srv.leaseReads != 1 {
+		t.Fatalf("lease reads = %d after a committed Put, want 1", srv.leaseReads)
+	}
+	srv.clockSuspectUntil = time.Now().Add(time.Minute)
+	srv.mu.Unlock()
+	get()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.leaseReads != 1 || srv.leaseFallbacks != 1 || srv.readIndexReads != 1 {
+		t.Fatalf("lease=%d fallbacks=%d readindex=%d, want 1 each", srv.leaseReads, srv.leaseFallbacks, srv.readIndexReads)
+	}
+}
+
+func TestLeaseModeFollowerIgnoresVotesWhileLeaderIsLive(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 1, 3, 1)
+	srv.readMode = readModeLease
+	if _, err := srv.AppendEntries(context.Background(), &kvpb.AppendEntriesRequest{Term: 1, LeaderId: 0}); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	resp, err := srv.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 2, CandidateId: 2})
+	if err != nil {
+		t.Fatalf("RequestVote failed: %v", err)
+	}
+	if resp.VoteGranted || resp.Term != 1 {
+		t.Fatalf("RequestVote = %v, want denied at term 1", resp)
+	}
+
+	srv.mu.Lock()
+	srv.leaderContact = time.Now().Add(-minElectionTimeout)
+	srv.started = srv.leaderContact
+	srv.mu.Unlock()
+	if resp, err := srv.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 2, CandidateId: 2}); err != nil || !resp.VoteGranted {
+		t.Fatalf("RequestVote after the leader went quiet = %v, %v; want granted", resp, err)
+	}
+}
+
+func TestLeaseModeRestartedFollowerIgnoresVotes(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, dir, 0, 1, 3, 1)
+	srv.readMode, srv.readLease = readModeLease, time.Second
+	if _, err := srv.AppendEntries(context.Background(), &kvpb.AppendEntriesRequest{Term: 1, LeaderId: 0}); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+
+	// The leader may still hold a lease this follower's ack counted toward,
+	// though the restarted follower no longer knows of the leader.
+	restarted := newTestServer(t, dir, 0, 1, 3, 1)
+	restarted.readMode, restarted.readLease = readModeLease, time.Second
+	resp, err := restarted.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 2, CandidateId: 2})
+	if err != nil {
+		t.Fatalf("RequestVote failed: %v", err)
+	}
+	if resp.VoteGranted {
+		t.Fatalf("RequestVote right after a restart = %v, want denied", resp)
+	}
+
+	restarted.mu.Lock()
+	restarted.started = time.Now().Add(-minElectionTimeout - restarted.readLease)
+	restarted.mu.Unlock()
+	if resp, err := restarted.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 2, CandidateId: 2}); err != nil || !resp.VoteGranted {
+		t.Fatalf("RequestVote once any lease ran out = %v, %v; want granted", resp, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recovery phases, in the order startup goes through them.
+const (
+	recoveryReadingLog      = "reading_log"
+	recoveryLoadingSnapshot = "loading_snapshot"
+	recoveryReplaying       = "replaying"
+	recoveryDone            = "done"
+)
+
+// recoveryProgress reports how far startup has got rebuilding state from
+// the raft log, so a replica replaying a long log can be told apart from a
+// hung one. Progress is counted in log entries within the current phase.
+type recoveryProgress struct {
+	mu           sync.Mutex
+	phase        string
+	started      time.Time
+	phaseStarted time.Time
+	finished     time.Time
+	total        uint64
+	// done is bumped once per entry, so it avoids the lock.
+	done atomic.Uint64
+}
+
+// startupRecovery is the progress of this process's startup. It exists
+// before the server does, so its status can be served while the server is
+// still being built.
+var startupRecovery recoveryProgress
+
+// recoveryStatus is the JSON served at /recovery.
+type recoveryStatus struct {
+	Phase          string  `json:"phase"`
+	EntriesDone    uint64  `json:"entries_done"`
+	EntriesTotal   uint64  `json:"entries_total"`
+	Percent        float64 `json:"percent"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// ETASeconds estimates the rest of the current phase from its rate so
+	// far; it is omitted until there is a rate to go on.
+	ETASeconds *float64 `json:"eta_seconds,omitempty"`
+	Ready      bool     `json:"ready"`
+}
+
+// begin starts phase, which has total entries to get through. Like
+// advance, it does nothing on a nil progress, which is what the server
+// holds once startup is over.
+func (p *recoveryProgress) begin(phase string, total uint64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.started.IsZero() {
+		p.started = now
+	}
+	p.phase, p.phaseStarted, p.total = phase, now, total
+	if phase == recoveryDone {
+		p.finished = now
+	}
+	p.done.Store(0)
+}
+
+func (p *recoveryProgress) advance() {
+	if p != nil {
+		p.done.Add(1)
+	}
+}
+
+func (p *recoveryProgress) finish() { p.begin(recoveryDone, 0) }
+
+func (p *recoveryProgress) status() recoveryStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	st := recoveryStatus{Phase: p.phase, EntriesDone: p.done.Load(), EntriesTotal: p.total, Ready: p.phase == recoveryDone}
+	if st.Phase == "" {
+		st.Phase = "starting"
+	}
+	if !p.started.IsZero() {
+		end := now
+		if !p.finished.IsZero() {
+			end = p.finished
+		}
+		st.ElapsedSeconds = end.Sub(p.started).Seconds()
+	}
+	if st.EntriesTotal > 0 {
+		st.EntriesDone = min(st.EntriesDone, st.EntriesTotal)
+		st.Percent = 100 * float64(st.EntriesDone) / float64(st.EntriesTotal)
+		if elapsed := now.Sub(p.phaseStarted).Seconds(); st.EntriesDone > 0 && elapsed > 0 {
+			eta := float64(st.EntriesTotal-st.EntriesDone) / (float64(st.EntriesDone) / elapsed)
+			st.ETASeconds = &eta
+		}
+	}
+	return st
+}
+
+func (p *recoveryProgress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	st := p.status()
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Printf("recovery status write failed: %v", err)
+	}
+}
+
+func (st recoveryStatus) String() string {
+	s := fmt.Sprintf("phase=%s entries=%d/%d percent=%.1f elapsed=%s", st.Phase, st.EntriesDone, st.EntriesTotal, st.Percent,
+		time.Duration(st.ElapsedSeconds*float64(time.Second)).Round(time.Second))
+	if st.ETASeconds != nil {
+		s += " eta=" + time.Duration(*st.ETASeconds*float64(time.Second)).Round(time.Second).String()
+	}
+	return s
+}
+
+// logProgress logs, and reports to systemd, the progress every interval
+// until the returned stop is called.
+func (p *recoveryProgress) logProgress(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				st := p.status()
+				log.Printf("recovery: %s", st)
+				if err := sdNotify(fmt.Sprintf("STATUS=recovering: %s %.0f%%", st.Phase, st.Percent)); err != nil {
+					log.Printf("sd_notify failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecoveryProgressReportsPercentAndReady(t *testing.T) {
+	var p recoveryProgress
+	get := func() (int, recoveryStatus) {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/recovery", nil))
+		var st recoveryStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, st
+	}
+
+	if code, st := get(); code != http.StatusServiceUnavailable || st.Ready || st.Phase != "starting" {
+		t.Fatalf("before begin: code=%d status=%+v", code, st)
+	}
+	p.begin(recoveryReplaying, 4)
+	time.Sleep(time.Millisecond)
+	p.advance()
+	code, st := get()
+	if code != http.StatusServiceUnavailable || st.Phase != recoveryReplaying || st.EntriesDone != 1 || st.Percent != 25 {
+		t.Fatalf("mid replay: code=%d status=%+v", code, st)
+	}
+	if st.ETASeconds == nil || *st.ETASeconds <= 0 {
+		t.Fatalf("mid replay eta = %v, want a positive estimate", st.ETASeconds)
+	}
+	p.finish()
+	if code, st := get(); code != http.StatusOK || !st.Ready || st.Phase != recoveryDone {
+		t.Fatalf("after finish: code=%d status=%+v", code, st)
+	}
+
+	// Outside startup the server holds no progress; hooks must be no-ops.
+	var none *recoveryProgress
+	none.begin(recoveryReplaying, 1)
+	none.advance()
+	none.finish()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Redaction, for stores that hold credentials or personal data: with
+// --redact_values no value, operand or query literal is written to the
+// server's logs, its request trace or the errors it returns, and with
+// --redact_keys the same holds for keys matching that regexp. Each stands
+// in as redactedText. Replies, the change feeds and the data on disk are
+// unaffected: they are where the data is meant to go.
+
+const redactedText = "<redacted>"
+
+// redaction is the configured policy. The zero value redacts nothing.
+type redaction struct {
+	values bool
+	keys   *regexp.Regexp
+}
+
+func newRedaction(values bool, keyPattern string) (redaction, error) {
+	r := redaction{values: values}
+	if keyPattern != "" {
+		re, err := regexp.Compile(keyPattern)
+		if err != nil {
+			return redaction{}, fmt.Errorf("--redact_keys: %w", err)
+		}
+		r.keys = re
+	}
+	return r, nil
+}
+
+// value returns v, or redactedText if values are redacted.
+func (r redaction) value(v string) string {
+	if r.values {
+		return redactedText
+	}
+	return v
+}
+
+// key returns k, or redactedText if it matches --redact_keys.
+func (r redaction) key(k string) string {
+	if r.keys != nil && r.keys.MatchString(k) {
+		return redactedText
+	}
+	return k
+}
+
+// text redacts s, which may be a key or a value, as either would be.
+func (r redaction) text(s string) string {
+	return r.key(r.value(s))
+}
+
+// detail returns err's message for an error about a value. strconv quotes
+// the text it failed to parse, so with values redacted only the reason is
+// kept.
+func (r redaction) detail(err error) string {
+	var num *strconv.NumError
+	if r.values && errors.As(err, &num) {
+		return num.Err.Error()
+	}
+	return err.Error()
+}
+
+// Request fields holding values or keys, by proto name.
+var (
+	redactValueFields = map[protoreflect.Name]bool{"value": true, "operand": true, "old_value": true, "args": true}
+	redactKeyFields   = map[protoreflect.Name]bool{"key": true, "old_key": true, "new_key": true, "start_key": true, "end_key": true, "start_after": true}
+)
+
+// message returns msg, or a copy with its values and matching keys
+// redacted, however deeply they are nested.
+func (r redaction) message(msg proto.Message) proto.Message {
+	if !r.values && r.keys == nil {
+		return msg
+	}
+	out := proto.Clone(msg)
+	r.redactMessage(out.ProtoReflect())
+	return out
+}
+
+func (r redaction) redactMessage(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		var fix func(string) string
+		switch {
+		case fd.Kind() == protoreflect.StringKind && redactValueFields[fd.Name()]:
+			fix = r.value
+		case fd.Kind() == protoreflect.StringKind && redactKeyFields[fd.Name()]:
+			fix = r.key
+		}
+		switch {
+		case fd.IsList() && fix != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				list.Set(i, protoreflect.ValueOfString(fix(list.Get(i).String())))
+			}
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				r.redactMessage(list.Get(i).Message())
+			}
+		case fix != nil:
+			m.Set(fd, protoreflect.ValueOfString(fix(v.String())))
+		case fd.Message() != nil && !fd.IsMap():
+			r.redactMessage(v.Message())
+		}
+		return true
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestRedactionKeepsDataOutOfErrors(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	r, err := newRedaction(true, `^users/`)
+	if err != nil {
+		t.Fatalf("newRedaction: %v", err)
+	}
+	srv.redact = r
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+
+	if _, err := srv.Put(call("put-n"), &kvpb.PutRequest{Key: "users/ann/visits", Value: "1", ValueType: kvpb.ValueType_VALUE_TYPE_INT64}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	_, err = srv.Put(call("put-s"), &kvpb.PutRequest{Key: "users/ann/visits", Value: "hunter2"})
+	if err == nil || strings.Contains(err.Error(), "hunter2") || strings.Contains(err.Error(), "users/ann") || !strings.Contains(err.Error(), redactedText) {
+		t.Fatalf("Put of a string over an integer: err = %v, want it refused with key and value redacted", err)
+	}
+	_, err = srv.Merge(call("merge"), &kvpb.MergeRequest{Key: "counters/x", Operator: "int-add", Operand: "12ab"})
+	if err == nil || strings.Contains(err.Error(), "12ab") || !strings.Contains(err.Error(), "invalid syntax") {
+		t.Fatalf("Merge of a bad operand: err = %v, want the operand redacted and the reason kept", err)
+	}
+
+	got := r.message(&kvpb.BatchRequest{Ops: []*kvpb.BatchOp{
+		{Op: "PUT", Key: "users/bob", Value: "pii"},
+		{Op: "PUT", Key: "orders/1", Value: "pii"},
+	}})
+	line, err := protojson.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(line); strings.Contains(s, "pii") || strings.Contains(s, "users/bob") || !strings.Contains(s, "orders/1") {
+		t.Fatalf("redacted trace record = %s, want values and users/ keys redacted", s)
+	}
+	if (redaction{}).message(got) != got {
+		t.Fatal("message copied a request with redaction off")
+	}
+}
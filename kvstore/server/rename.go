@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Rename moves a value between two keys of one partition as a single
+// OP_RENAME entry, so no replica, watcher or change feed ever sees the
+// value under both keys or under neither.
+
+// stampRenameLocked prepares a rename before it is logged. It copies the
+// moved value into the command for log readers, and reports done, with the
+// reply, when applied state already shows the rename would change nothing:
+// such a rename is answered without logging it, so readers never see a
+// rename that did not happen. A write still in flight can change the
+// outcome afterwards, and apply decides again from the state it finds.
+func (s *kvServer) stampRenameLocked(wal *kvpb.WALCommand) (cachedMutation, bool) {
+	res := s.renameOutcomeLocked(wal)
+	if !res.found || (res.hasOldValue && !wal.Overwrite) {
+		return res, true
+	}
+	wal.Value = res.value
+	return cachedMutation{}, false
+}
+
+// renameOutcomeLocked is what applying wal would do now: found if the old
+// key has a value, which it returns, and hasOldValue if the new key has one
+// too.
+func (s *kvServer) renameOutcomeLocked(wal *kvpb.WALCommand) cachedMutation {
+	res := cachedMutation{op: wal.Op, key: wal.Key, newKey: wal.NewKey, overwrite: wal.Overwrite}
+	if src, ok := s.getLiveLocked(wal.Key); ok {
+		res.found, res.value = true, src.value
+	}
+	if dst, ok := s.getLiveLocked(wal.NewKey); ok {
+		res.hasOldValue, res.oldValue = true, dst.value
+	}
+	return res
+}
+
+// renameLocked applies an OP_RENAME. The new key takes the old key's value
+// and deletion schedule, and the old key becomes an ordinary tombstone that
+// Undelete does not restore, since its value lives on under the new key.
+func (s *kvServer) renameLocked(wal *kvpb.WALCommand, seq uint64) cachedMutation {
+	res := s.renameOutcomeLocked(wal)
+	if !renamed(res) {
+		return res
+	}
+	src, _ := s.getLiveLocked(wal.Key)
+	s.putCheckedLocked(wal.NewKey, src.value, src.vtype, src.contentType, src.checksum, seq)
+	if src.deleteAt != 0 {
+		dst, _ := s.getLiveLocked(wal.NewKey)
+		s.scheduleLocked(dst, src.deleteAt)
+	}
+	s.deleteLocked(src, seq, wal.UnixNanos, 0)
+	return res
+}
+
+// renamed reports whether a rename with result res moved its value.
+func renamed(res cachedMutation) bool {
+	return res.found && (!res.hasOldValue || res.overwrite)
+}
+
+func (s *kvServer) Rename(ctx context.Context, req *kvpb.RenameRequest) (*kvpb.RenameReply, error) {
+	if s.clusterID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "rename is not supported in a multi-writer cluster")
+	}
+	if req.OldKey == req.NewKey {
+		return nil, invalidFieldError("new_key", "must differ from old_key %q", s.redact.key(req.OldKey))
+	}
+	if ownerForKey(req.NewKey, s.numPartitions) != ownerForKey(req.OldKey, s.numPartitions) {
+		// Not reasonWrongPartition: clients take that as a stale route and
+		// retry, and no route puts both keys on one leader.
+		return nil, invalidFieldError("new_key", "cannot rename %q to %q: the keys are in different partitions", s.redact.key(req.OldKey), s.redact.key(req.NewKey))
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Both keys matter: the value moves from one, and the other may hold
+	// one that overwrite guards.
+	for _, key := range []string{req.OldKey, req.NewKey} {
+		if err := s.loadBeforeWrite(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_RENAME, Key: req.OldKey, NewKey: req.NewKey, Overwrite: req.Overwrite},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.RenameReply{Found: cached.found, Renamed: renamed(cached), Seq: cached.seq}, nil
+}
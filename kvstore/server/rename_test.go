@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestRenameMovesValueInOneEntry(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	get := func(key string) *kvpb.GetReply {
+		t.Helper()
+		got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: key})
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", key, err)
+		}
+		return got
+	}
+	for key, value := range map[string]string{"a": "va", "b": "vb"} {
+		if _, err := srv.Put(call("put-"+key), &kvpb.PutRequest{Key: key, Value: value}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	deleteAt := time.Now().Add(time.Hour).UnixNano()
+	if _, err := srv.DeleteAt(call("sched-a"), &kvpb.DeleteAtRequest{Key: "a", UnixNanos: deleteAt}); err != nil {
+		t.Fatalf("DeleteAt failed: %v", err)
+	}
+
+	if _, err := srv.Rename(call("same"), &kvpb.RenameRequest{OldKey: "a", NewKey: "a"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Rename to itself: err = %v, want InvalidArgument", err)
+	}
+	srv.mu.Lock()
+	before := srv.commitIndex
+	srv.mu.Unlock()
+	refused, err := srv.Rename(call("refused"), &kvpb.RenameRequest{OldKey: "a", NewKey: "b"})
+	if err != nil || !refused.Found || refused.Renamed || refused.Seq != 0 {
+		t.Fatalf("Rename onto a live key = %v, %v; want found, not renamed, not logged", refused, err)
+	}
+	if missing, err := srv.Rename(call("missing"), &kvpb.RenameRequest{OldKey: "nope", NewKey: "c"}); err != nil || missing.Found || missing.Renamed {
+		t.Fatalf("Rename of a missing key = %v, %v; want not found", missing, err)
+	}
+	srv.mu.Lock()
+	after := srv.commitIndex
+	srv.mu.Unlock()
+	if after != before {
+		t.Fatalf("refused renames logged %d entries, want none", after-before)
+	}
+
+	got, err := srv.Rename(call("move"), &kvpb.RenameRequest{OldKey: "a", NewKey: "b", Overwrite: true})
+	if err != nil || !got.Found || !got.Renamed || got.Seq != before+1 {
+		t.Fatalf("Rename with overwrite = %v, %v; want renamed at seq %d", got, err, before+1)
+	}
+	if again, err := srv.Rename(call("move"), &kvpb.RenameRequest{OldKey: "a", NewKey: "b", Overwrite: true}); err != nil || again.Seq != got.Seq || !again.Renamed {
+		t.Fatalf("retried Rename = %v, %v; want the first reply %v", again, err, got)
+	}
+	if _, err := srv.Rename(call("move"), &kvpb.RenameRequest{OldKey: "a", NewKey: "c"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Rename reusing a request id for another target: err = %v, want AlreadyExists", err)
+	}
+	if a := get("a"); a.Found {
+		t.Fatalf("Get(a) after rename = %v, want not found", a)
+	}
+	if b := get("b"); !b.Found || b.Value != "va" {
+		t.Fatalf("Get(b) after rename = %v, want va", b)
+	}
+	srv.mu.Lock()
+	moved, _ := srv.getLiveLocked("b")
+	entry := srv.entryLocked(got.Seq).GetCommand().GetWal()
+	srv.mu.Unlock()
+	if moved.deleteAt != deleteAt {
+		t.Fatalf("renamed key deleteAt = %d, want the old key's %d", moved.deleteAt, deleteAt)
+	}
+	if entry.GetOp() != kvpb.WALCommand_OP_RENAME || entry.Value != "va" {
+		t.Fatalf("logged entry = %v, want one OP_RENAME carrying the moved value", entry)
+	}
+	events := watchEvents(got.Seq, entry, cachedMutation{found: true, hasOldValue: true, overwrite: true})
+	if len(events) != 2 || events[0].Op != "DELETE" || events[0].Key != "a" || events[1].Op != "PUT" || events[1].Key != "b" || events[1].Value != "va" {
+		t.Fatalf("watch events = %v, want DELETE a then PUT b va", events)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// followerStatusLocked returns the leader's view of every follower, or nil
+// on a replica that is not the leader.
+func (s *kvServer) followerStatusLocked(now time.Time) []*kvpb.FollowerStatus {
+	if s.role != roleLeader {
+		return nil
+	}
+	last := s.lastLogIndexLocked()
+	followers := make([]*kvpb.FollowerStatus, 0, len(s.peerReplicaIDs))
+	for _, peerID := range s.peerReplicaIDs {
+		fs := &kvpb.FollowerStatus{
+			ReplicaId:    uint32(peerID),
+			MatchIndex:   s.matchIndex[peerID],
+			AppliedIndex: s.peerApplied[peerID],
+			MemberType:   s.memberType(peerID),
+		}
+		if contact, ok := s.peerContact[peerID]; ok {
+			fs.LastContactUnixNanos = contact.UnixNano()
+		}
+		if fs.AppliedIndex < last {
+			fs.LagEntries = last - fs.AppliedIndex
+			fs.LagMillis = uint64(s.oldestUnappliedAgeLocked(fs.AppliedIndex, now).Milliseconds())
+		}
+		followers = append(followers, fs)
+	}
+	return followers
+}
+
+// oldestUnappliedAgeLocked returns how long ago the first client command
+// after applied was written. Leader no-op entries carry no timestamp and are
+// skipped.
+func (s *kvServer) oldestUnappliedAgeLocked(applied uint64, now time.Time) time.Duration {
+	from := applied + 1
+	if from <= s.logBase {
+		from = s.logBase + 1
+	}
+	for idx := from; idx <= s.lastLogIndexLocked(); idx++ {
+		if wal := s.entryLocked(idx).GetCommand().GetWal(); wal.GetUnixNanos() != 0 {
+			return now.Sub(time.Unix(0, wal.UnixNanos))
+		}
+	}
+	return 0
+}
+
+func (a *adminServer) ReplicationStatus(ctx context.Context, req *kvpb.ReplicationStatusRequest) (*kvpb.ReplicationStatusReply, error) {
+	s := a.kv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.role != roleLeader {
+		return nil, notLeaderError(s.leaderAddr)
+	}
+	return &kvpb.ReplicationStatusReply{
+		PartitionId:     uint32(s.partitionID),
+		LeaderReplicaId: uint32(s.replicaID),
+		Term:            s.currentTerm,
+		CommitIndex:     s.commitIndex,
+		LastLogIndex:    s.lastLogIndexLocked(),
+		Followers:       s.followerStatusLocked(time.Now()),
+	}, nil
+}
+
+func (s *kvServer) registerReplicationMetrics(r *metricsRegistry) {
+	perFollower := func(fn func(fs *kvpb.FollowerStatus, now time.Time) float64) func() []metricSample {
+		return func() []metricSample {
+			now := time.Now()
+			s.mu.Lock()
+			followers := s.followerStatusLocked(now)
+			s.mu.Unlock()
+			samples := make([]metricSample, 0, len(followers))
+			for _, fs := range followers {
+				samples = append(samples, metricSample{labels: map[string]string{"follower": strconv.Itoa(int(fs.ReplicaId))}, value: fn(fs, now)})
+			}
+			return samples
+		}
+	}
+	r.register("kv_replication_follower_match_index", "Highest log index the leader knows the follower has stored.", "gauge", perFollower(func(fs *kvpb.FollowerStatus, _ time.Time) float64 { return float64(fs.MatchIndex) }))
+	r.register("kv_replication_follower_applied_index", "Highest log index the follower last reported applying.", "gauge", perFollower(func(fs *kvpb.FollowerStatus, _ time.Time) float64 { return float64(fs.AppliedIndex) }))
+	r.register("kv_replication_follower_lag_entries", "Leader log entries the follower has yet to apply.", "gauge", perFollower(func(fs *kvpb.FollowerStatus, _ time.Time) float64 { return float64(fs.LagEntries) }))
+	r.register("kv_replication_follower_lag_seconds", "Age of the oldest entry the follower has yet to apply.", "gauge", perFollower(func(fs *kvpb.FollowerStatus, _ time.Time) float64 { return float64(fs.LagMillis) / 1e3 }))
+	r.register("kv_replication_follower_last_contact_seconds", "Seconds since the follower last answered the leader; -1 if it has not.", "gauge", perFollower(func(fs *kvpb.FollowerStatus, now time.Time) float64 {
+		if fs.LastContactUnixNanos == 0 {
+			return -1
+		}
+		return now.Sub(time.Unix(0, fs.LastContactUnixNanos)).Seconds()
+	}))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestReplicationStatusReportsFollowerLag(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	becomeTestLeader(t, srv, 1)
+
+	srv.mu.Lock()
+	// Replica 1 stores and applies everything; replica 2 stores entries but
+	// reports nothing applied.
+	srv.peerClients[1] = &mockRaftPeerClient{
+		appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+			match := req.PrevLogIndex + uint64(len(req.Entries))
+			return &kvpb.AppendEntriesReply{Term: req.Term, Success: true, MatchIndex: match, LastApplied: match}, nil
+		},
+	}
+	srv.peerClients[2] = &mockRaftPeerClient{}
+	srv.mu.Unlock()
+
+	admin := &adminServer{kv: srv}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	srv.broadcastAppendEntries()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := admin.ReplicationStatus(context.Background(), &kvpb.ReplicationStatusRequest{})
+	if err != nil {
+		t.Fatalf("ReplicationStatus failed: %v", err)
+	}
+	if len(resp.Followers) != 2 {
+		t.Fatalf("followers = %v, want 2", resp.Followers)
+	}
+	for _, f := range resp.Followers {
+		if f.MatchIndex != resp.LastLogIndex || f.LastContactUnixNanos == 0 {
+			t.Fatalf("follower %d = %v, want match %d and a contact time", f.ReplicaId, f, resp.LastLogIndex)
+		}
+		switch f.ReplicaId {
+		case 1:
+			if f.LagEntries != 0 {
+				t.Fatalf("follower 1 lag = %d, want 0", f.LagEntries)
+			}
+		case 2:
+			if f.LagEntries != resp.LastLogIndex || f.LagMillis < 100 {
+				t.Fatalf("follower 2 = %v, want lag %d entries over at least 100ms", f, resp.LastLogIndex)
+			}
+		}
+	}
+
+	srv.mu.Lock()
+	err = srv.becomeFollowerLocked(2, 1, "")
+	srv.mu.Unlock()
+	if err != nil {
+		t.Fatalf("becomeFollowerLocked failed: %v", err)
+	}
+	if _, err := admin.ReplicationStatus(context.Background(), &kvpb.ReplicationStatusRequest{}); err == nil {
+		t.Fatalf("ReplicationStatus on a follower succeeded, want not-leader")
+	}
+}
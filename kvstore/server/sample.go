@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/google/btree"
+	"google.golang.org/grpc/codes"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+const maxSampleKeys = 10000
+
+// samplerLocked returns what sampleItems needs to run without s.mu: a
+// copy-on-write clone of the tree, which costs O(1) to take, and a random
+// source seeded from s.rng, which is not safe to share.
+func (s *kvServer) samplerLocked() (*btree.BTreeG[item], *rand.Rand) {
+	return s.tree.Clone(), rand.New(rand.NewSource(s.rng.Int63()))
+}
+
+// sampleItems draws up to n live items of tree uniformly without
+// replacement with reservoir sampling, then shuffles them so that any
+// prefix of the result is itself a uniform sample. It visits every key, so
+// callers run it on a clone from samplerLocked, outside s.mu.
+func sampleItems(tree *btree.BTreeG[item], rng *rand.Rand, n int) []item {
+	reservoir := make([]item, 0, n)
+	seen := 0
+	tree.Ascend(func(it item) bool {
+		if it.tombstone {
+			return true
+		}
+		seen++
+		if len(reservoir) < n {
+			reservoir = append(reservoir, it)
+		} else if j := rng.Intn(seen); j < n {
+			reservoir[j] = it
+		}
+		return true
+	})
+	rng.Shuffle(len(reservoir), func(i, j int) { reservoir[i], reservoir[j] = reservoir[j], reservoir[i] })
+	return reservoir
+}
+
+func (s *kvServer) checkLeaderReadLocked() error {
+	if s.role != roleLeader {
+		return notLeaderError(s.leaderAddr)
+	}
+	if !s.leaderReadyForReadsLocked() {
+		return retryableError(codes.Unavailable, leaderChangeRetryDelay, "leader not ready for reads")
+	}
+	return nil
+}
+
+func (s *kvServer) RandomKey(ctx context.Context, req *kvpb.RandomKeyRequest) (*kvpb.RandomKeyReply, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	tree, rng := s.samplerLocked()
+	s.mu.Unlock()
+	sample := sampleItems(tree, rng, 1)
+	if len(sample) == 0 {
+		return &kvpb.RandomKeyReply{Found: false}, nil
+	}
+	return &kvpb.RandomKeyReply{Found: true, Key: sample[0].fullKey()}, nil
+}
+
+func (s *kvServer) SampleKeys(ctx context.Context, req *kvpb.SampleKeysRequest) (*kvpb.SampleKeysReply, error) {
+	if req.N == 0 || req.N > maxSampleKeys {
+		return nil, invalidFieldError("n", "n must be between 1 and %d", maxSampleKeys)
+	}
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	tree, rng := s.samplerLocked()
+	population := uint64(s.liveKeys)
+	s.mu.Unlock()
+	sample := sampleItems(tree, rng, int(req.N))
+	reply := &kvpb.SampleKeysReply{Keys: make([]*kvpb.SampledKey, 0, len(sample)), Population: population}
+	for _, it := range sample {
+		reply.Keys = append(reply.Keys, &kvpb.SampledKey{Key: it.fullKey(), ValueBytes: uint32(len(it.value))})
+	}
+	return reply, nil
+}
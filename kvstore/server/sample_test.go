@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestSampleKeysSkipsTombstonesAndCoversKeySpace(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("k%d", i)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-"+key))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: "value"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "del"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "k5"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	resp, err := srv.SampleKeys(context.Background(), &kvpb.SampleKeysRequest{N: 3})
+	if err != nil {
+		t.Fatalf("SampleKeys() failed: %v", err)
+	}
+	if resp.Population != 5 || len(resp.Keys) != 3 {
+		t.Fatalf("SampleKeys(3) = %v, want 3 of 5 keys", resp)
+	}
+	distinct := map[string]bool{}
+	for _, k := range resp.Keys {
+		if k.Key == "k5" || k.ValueBytes != 5 {
+			t.Fatalf("unexpected sampled key %v", k)
+		}
+		distinct[k.Key] = true
+	}
+	if len(distinct) != 3 {
+		t.Fatalf("sample has duplicates: %v", resp.Keys)
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		got, err := srv.RandomKey(context.Background(), &kvpb.RandomKeyRequest{})
+		if err != nil || !got.Found {
+			t.Fatalf("RandomKey() = %v, %v", got, err)
+		}
+		seen[got.Key]++
+	}
+	for i := 0; i < 5; i++ {
+		if n := seen[fmt.Sprintf("k%d", i)]; n < 100 {
+			t.Fatalf("RandomKey counts %v look skewed", seen)
+		}
+	}
+}
+
+func TestSampleReadsCloneTakenUnderLock(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("put-a"), &kvpb.PutRequest{Key: "a", Value: "1"}); err != nil {
+		t.Fatalf("Put(a) failed: %v", err)
+	}
+	srv.mu.Lock()
+	tree, rng := srv.samplerLocked()
+	srv.mu.Unlock()
+
+	// Writes go on while the sample walks its clone.
+	if _, err := srv.Put(withRequestID("put-b"), &kvpb.PutRequest{Key: "b", Value: "1"}); err != nil {
+		t.Fatalf("Put(b) failed: %v", err)
+	}
+	sample := sampleItems(tree, rng, 10)
+	if len(sample) != 1 || sample[0].fullKey() != "a" {
+		t.Fatalf("sample of the clone = %v, want only a", sample)
+	}
+}
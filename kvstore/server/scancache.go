@@ -0,0 +1,105 @@
+package main
+
+import (
+	"time"
+
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// scanCacheMaxPairs keeps large scans out of the scan cache.
+const scanCacheMaxPairs = 10000
+
+type scanRange struct {
+	start, end string
+}
+
+type scanCacheEntry struct {
+	pairs   []*kvpb.KVPair
+	expires time.Time
+}
+
+// scanCache serves repeated identical Scans, such as dashboards polling one
+// range, without walking the tree again. An entry stays valid until a write
+// to a key inside its range, which drops it, or until it expires. The TTL
+// only bounds how long idle entries hold memory. It is guarded by
+// kvServer.mu; a nil cache is disabled.
+type scanCache struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[scanRange]scanCacheEntry
+	hits       uint64
+	misses     uint64
+}
+
+func newScanCache(ttl time.Duration, maxEntries int) *scanCache {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &scanCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[scanRange]scanCacheEntry)}
+}
+
+// get returns the cached pairs for [start, end]. Callers must not modify
+// them: the same slice backs every reply served from the entry.
+func (c *scanCache) get(start, end string, now time.Time) ([]*kvpb.KVPair, bool) {
+	if c == nil {
+		return nil, false
+	}
+	e, ok := c.entries[scanRange{start, end}]
+	if !ok || now.After(e.expires) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return e.pairs, true
+}
+
+func (c *scanCache) put(start, end string, pairs []*kvpb.KVPair, now time.Time) {
+	if c == nil || len(pairs) > scanCacheMaxPairs {
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		// Make room by dropping expired entries, or else the one closest to
+		// expiring.
+		var victim scanRange
+		var soonest time.Time
+		for r, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, r)
+				continue
+			}
+			if soonest.IsZero() || e.expires.Before(soonest) {
+				victim, soonest = r, e.expires
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, victim)
+		}
+	}
+	c.entries[scanRange{start, end}] = scanCacheEntry{pairs: pairs, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops every entry whose range covers key.
+func (c *scanCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	for r := range c.entries {
+		if r.start <= key && key <= r.end {
+			delete(c.entries, r)
+		}
+	}
+}
+
+// reset drops all entries, for when the whole tree is replaced.
+func (c *scanCache) reset() {
+	if c == nil {
+		return
+	}
+	clear(c.entries)
+}
+
+func (s *kvServer) registerScanCacheMetrics(r *metricsRegistry) {
+	r.counter("kv_scan_cache_hits_total", "Scans served from the scan cache.", s.locked(func() float64 { return float64(s.scanCache.hits) }))
+	r.counter("kv_scan_cache_misses_total", "Scans that walked the tree.", s.locked(func() float64 { return float64(s.scanCache.misses) }))
+	r.gauge("kv_scan_cache_entries", "Ranges held in the scan cache.", s.locked(func() float64 { return float64(len(s.scanCache.entries)) }))
+}
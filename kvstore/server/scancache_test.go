@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestScanCacheServesRepeatsUntilRangeChanges(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.scanCache = newScanCache(time.Minute, 4)
+	becomeTestLeader(t, srv, 1)
+
+	put := func(reqID, key, value string) {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: value}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	scan := func() []string {
+		t.Helper()
+		resp, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "b", EndKey: "d"})
+		if err != nil {
+			t.Fatalf("Scan() failed: %v", err)
+		}
+		var got []string
+		for _, p := range resp.Pairs {
+			got = append(got, p.Key+"="+p.Value)
+		}
+		return got
+	}
+	put("p1", "b", "1")
+	put("p2", "c", "1")
+
+	scan()
+	put("p3", "z", "outside")
+	if got := scan(); len(got) != 2 || srv.scanCache.hits != 1 {
+		t.Fatalf("scan = %v hits=%d, want a cache hit after an unrelated write", got, srv.scanCache.hits)
+	}
+	put("p4", "c", "2")
+	if got := scan(); len(got) != 2 || got[1] != "c=2" || srv.scanCache.hits != 1 {
+		t.Fatalf("scan = %v hits=%d, want a fresh scan after a write in range", got, srv.scanCache.hits)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "d1"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "b"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if got := scan(); len(got) != 1 || got[0] != "c=2" {
+		t.Fatalf("scan after delete = %v, want [c=2]", got)
+	}
+}
+
+func TestScanCacheDroppedWhenTreeIsReplaced(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.scanCache = newScanCache(time.Minute, 4)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("p1"), &kvpb.PutRequest{Key: "b", Value: "1"}); err != nil {
+		t.Fatalf("Put(b) failed: %v", err)
+	}
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot() failed: %v", err)
+	}
+	if _, err := srv.Put(withRequestID("p2"), &kvpb.PutRequest{Key: "c", Value: "1"}); err != nil {
+		t.Fatalf("Put(c) failed: %v", err)
+	}
+	if resp, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "b", EndKey: "d"}); err != nil || len(resp.Pairs) != 2 {
+		t.Fatalf("Scan() = %v, %v; want 2 pairs", resp, err)
+	}
+
+	// Going back to the snapshot, as installing one does, loses c without
+	// deleting it.
+	srv.mu.Lock()
+	err := srv.loadSnapshotLocked()
+	srv.mu.Unlock()
+	if err != nil {
+		t.Fatalf("loadSnapshotLocked() failed: %v", err)
+	}
+	resp, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "b", EndKey: "d"})
+	if err != nil {
+		t.Fatalf("Scan() failed: %v", err)
+	}
+	if len(resp.Pairs) != 1 || resp.Pairs[0].Key != "b" {
+		t.Fatalf("Scan() after the tree was replaced = %v, want only b", resp.Pairs)
+	}
+}
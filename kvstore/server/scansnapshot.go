@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/btree"
+)
+
+// scanSnapshots holds the tree states that paginated Scans are reading,
+// keyed by the applied index they were taken at. A clone of the tree costs
+// O(1) to take, but while it is held every write copies the nodes it
+// touches, so a state is only pinned when a page leaves more to read and is
+// dropped once unused for ttl. It is guarded by kvServer.mu; a nil
+// scanSnapshots pins nothing, so only the current state can be paged.
+type scanSnapshots struct {
+	ttl     time.Duration
+	max     int
+	held    map[uint64]*scanSnapshot
+	pinned  uint64
+	expired uint64
+}
+
+type scanSnapshot struct {
+	tree     *btree.BTreeG[item]
+	lastUsed time.Time
+}
+
+func newScanSnapshots(ttl time.Duration, max int) *scanSnapshots {
+	if ttl <= 0 || max <= 0 {
+		return nil
+	}
+	return &scanSnapshots{ttl: ttl, max: max, held: make(map[uint64]*scanSnapshot)}
+}
+
+// get returns the state pinned at seq and marks it used.
+func (ss *scanSnapshots) get(seq uint64, now time.Time) (*btree.BTreeG[item], bool) {
+	if ss == nil {
+		return nil, false
+	}
+	snap, ok := ss.held[seq]
+	if !ok {
+		return nil, false
+	}
+	if now.Sub(snap.lastUsed) > ss.ttl {
+		delete(ss.held, seq)
+		ss.expired++
+		return nil, false
+	}
+	snap.lastUsed = now
+	return snap.tree, true
+}
+
+// pin keeps tree, the state at seq, for later pages. clone is only called
+// if seq is not already held.
+func (ss *scanSnapshots) pin(seq uint64, clone func() *btree.BTreeG[item], now time.Time) {
+	if ss == nil {
+		return
+	}
+	if snap, ok := ss.held[seq]; ok {
+		snap.lastUsed = now
+		return
+	}
+	if len(ss.held) >= ss.max {
+		// Make room by dropping expired states, or else the least recently
+		// used one.
+		var victim uint64
+		var oldest time.Time
+		for seq, snap := range ss.held {
+			if now.Sub(snap.lastUsed) > ss.ttl {
+				delete(ss.held, seq)
+				ss.expired++
+				continue
+			}
+			if oldest.IsZero() || snap.lastUsed.Before(oldest) {
+				victim, oldest = seq, snap.lastUsed
+			}
+		}
+		if len(ss.held) >= ss.max {
+			delete(ss.held, victim)
+			ss.expired++
+		}
+	}
+	ss.held[seq] = &scanSnapshot{tree: clone(), lastUsed: now}
+	ss.pinned++
+}
+
+func (s *kvServer) registerScanSnapshotMetrics(r *metricsRegistry) {
+	r.gauge("kv_scan_snapshots", "Tree states held for paginated Scans.", s.locked(func() float64 { return float64(len(s.scanSnapshots.held)) }))
+	r.counter("kv_scan_snapshots_pinned_total", "Tree states pinned for paginated Scans.", s.locked(func() float64 { return float64(s.scanSnapshots.pinned) }))
+	r.counter("kv_scan_snapshots_expired_total", "Pinned Scan states dropped for going unused or to make room.", s.locked(func() float64 { return float64(s.scanSnapshots.expired) }))
+}
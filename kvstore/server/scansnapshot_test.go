@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestScanPagesReadOneSnapshot(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.scanSnapshots = newScanSnapshots(time.Minute, 2)
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: "old"}); err != nil {
+			t.Fatalf("Put(%q) failed: %v", key, err)
+		}
+	}
+
+	first, err := srv.Scan(ctx, &kvpb.ScanRequest{StartKey: "a", EndKey: "z", Limit: 2})
+	if err != nil || len(first.Pairs) != 2 || !first.Truncated {
+		t.Fatalf("first page = %v, %v; want 2 pairs and more to come", first, err)
+	}
+	// Writes between pages must not show through.
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "c", Value: "new"}); err != nil {
+		t.Fatalf("Put(c) failed: %v", err)
+	}
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "d"}); err != nil {
+		t.Fatalf("Delete(d) failed: %v", err)
+	}
+	second, err := srv.Scan(ctx, &kvpb.ScanRequest{StartKey: "b\x00", EndKey: "z", Limit: 2, SnapshotSeq: first.SnapshotSeq})
+	if err != nil || second.Truncated || second.SnapshotSeq != first.SnapshotSeq {
+		t.Fatalf("second page = %v, %v; want the last page of seq %d", second, err, first.SnapshotSeq)
+	}
+	if len(second.Pairs) != 2 || second.Pairs[0].Value != "old" || second.Pairs[1].Key != "d" {
+		t.Fatalf("second page pairs = %v, want c=old and d", second.Pairs)
+	}
+	if current, _ := srv.Scan(ctx, &kvpb.ScanRequest{StartKey: "c", EndKey: "z"}); len(current.Pairs) != 1 || current.Pairs[0].Value != "new" {
+		t.Fatalf("current scan = %v, want c=new only", current.Pairs)
+	}
+
+	srv.mu.Lock()
+	srv.scanSnapshots.held[first.SnapshotSeq].lastUsed = time.Now().Add(-2 * time.Minute)
+	srv.mu.Unlock()
+	if _, err := srv.Scan(ctx, &kvpb.ScanRequest{StartKey: "b\x00", EndKey: "z", SnapshotSeq: first.SnapshotSeq}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("page of an expired snapshot = %v, want FailedPrecondition", err)
+	}
+}
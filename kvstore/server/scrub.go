@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+	"madkv/kvstore/walformat"
+)
+
+// Scrubbing finds corruption before a read trips over it. Every
+// --scrub_interval each replica walks its snapshot file, checking its
+// checksum and each value's, the raft log rows it still keeps, checking
+// each row's checksum, and the values it holds in memory, checking each
+// against the checksum stored with it. What it finds is logged, counted in
+// kv_scrub_problems_total and kept for the Admin Scrub RPC; nothing is
+// repaired. The scrubber is low priority: it works in small batches,
+// pausing between them, and waits while the server is busy.
+
+const (
+	// scrubBatch is how many keys or log rows the scrubber checks at a
+	// time, holding the server's lock for keys.
+	scrubBatch = 1000
+	// scrubPause is how long it rests after each batch.
+	scrubPause = 10 * time.Millisecond
+	// maxScrubProblems bounds the problems kept from one pass.
+	maxScrubProblems = 100
+)
+
+// Where a scrub problem was found, as the kv_scrub_problems_total label.
+const (
+	scrubInSnapshot = "snapshot"
+	scrubInLog      = "log"
+	scrubInValues   = "values"
+)
+
+// scrubReport is what one pass checked and found.
+type scrubReport struct {
+	started, finished time.Time
+	snapshotChecked   bool
+	logEntries        uint64
+	values            uint64
+	problems          []string
+	problemCount      uint64
+}
+
+// scrubber runs passes one at a time. A nil *scrubber never scrubs.
+type scrubber struct {
+	interval time.Duration
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	last    *scrubReport
+
+	passes   atomic.Uint64
+	problems map[string]*atomic.Uint64
+}
+
+func newScrubber(interval time.Duration) *scrubber {
+	if interval <= 0 {
+		return nil
+	}
+	return &scrubber{
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+		problems: map[string]*atomic.Uint64{scrubInSnapshot: {}, scrubInLog: {}, scrubInValues: {}},
+	}
+}
+
+// start queues a pass and reports whether it did: one already waiting
+// covers it.
+func (sc *scrubber) start() bool {
+	select {
+	case sc.wake <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// problem records a corruption found in where.
+func (sc *scrubber) problem(s *kvServer, r *scrubReport, where, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.logf("scrub: %s: %s", where, msg)
+	sc.problems[where].Add(1)
+	r.problemCount++
+	if len(r.problems) < maxScrubProblems {
+		r.problems = append(r.problems, where+": "+msg)
+	}
+}
+
+func (s *kvServer) scrubLoop(ctx context.Context) {
+	sc := s.scrub
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sc.wake:
+		}
+		r := s.scrubPass(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logf("scrub pass done in %s: snapshot=%v log_entries=%d values=%d problems=%d",
+			r.finished.Sub(r.started).Round(time.Millisecond), r.snapshotChecked, r.logEntries, r.values, r.problemCount)
+	}
+}
+
+// scrubPass checks the snapshot, the raft log and the values in turn.
+func (s *kvServer) scrubPass(ctx context.Context) *scrubReport {
+	sc := s.scrub
+	sc.mu.Lock()
+	sc.running = true
+	sc.mu.Unlock()
+
+	r := &scrubReport{started: time.Now()}
+	s.scrubSnapshot(ctx, r)
+	s.scrubLog(ctx, r)
+	s.scrubValues(ctx, r)
+	r.finished = time.Now()
+
+	sc.passes.Add(1)
+	sc.mu.Lock()
+	sc.running = false
+	sc.last = r
+	sc.mu.Unlock()
+	return r
+}
+
+// scrubRest pauses after a batch, and for as long as the server is busy.
+func (s *kvServer) scrubRest(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(scrubPause):
+		}
+		if !s.compactor.busy() {
+			return nil
+		}
+	}
+}
+
+// scrubSnapshot reads the snapshot file through, checking its checksum and
+// that of every value in it. An ephemeral server keeps its snapshot in
+// memory, which the file checks do not apply to.
+func (s *kvServer) scrubSnapshot(ctx context.Context, r *scrubReport) {
+	if s.ephemeral() {
+		return
+	}
+	path := s.snapshotPath()
+	entries := 0
+	err := walkSnapshotFile(path, func(kind byte, payload []byte) error {
+		if kind != snapEntry {
+			return nil
+		}
+		var e kvpb.SnapshotEntry
+		if err := proto.Unmarshal(payload, &e); err != nil {
+			return fmt.Errorf("snapshot %s: decode entry: %w", path, err)
+		}
+		if e.ValueCrc32C != 0 && valueChecksum(e.Value) != e.ValueCrc32C {
+			s.scrub.problem(s, r, scrubInSnapshot, "value for key %q in %s does not match its checksum", s.redact.key(e.Key), path)
+		}
+		if entries++; entries%scrubBatch == 0 {
+			return s.scrubRest(ctx)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil && ctx.Err() == nil:
+		s.scrub.problem(s, r, scrubInSnapshot, "%v", err)
+	case err == nil:
+		r.snapshotChecked = true
+	}
+}
+
+// scrubLog checks the checksum of every raft log row still stored.
+func (s *kvServer) scrubLog(ctx context.Context, r *scrubReport) {
+	var after uint64
+	for ctx.Err() == nil {
+		rows, err := s.db.QueryContext(ctx, `SELECT log_index, payload, crc FROM raft_log WHERE log_index > ? ORDER BY log_index ASC LIMIT ?`, after, scrubBatch)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.scrub.problem(s, r, scrubInLog, "query raft_log: %v", err)
+			}
+			return
+		}
+		n := 0
+		for rows.Next() {
+			var idx uint64
+			var payload []byte
+			var crc uint32
+			if err := rows.Scan(&idx, &payload, &crc); err != nil {
+				s.scrub.problem(s, r, scrubInLog, "scan raft_log row after index %d: %v", after, err)
+				break
+			}
+			if err := walformat.Verify(idx, payload, crc); err != nil {
+				s.scrub.problem(s, r, scrubInLog, "%v", err)
+			}
+			after, n = idx, n+1
+			r.logEntries++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.scrub.problem(s, r, scrubInLog, "read raft_log: %v", err)
+			}
+			return
+		}
+		if n < scrubBatch || s.scrubRest(ctx) != nil {
+			return
+		}
+	}
+}
+
+// scrubValues checks every value held in memory, soft-deleted ones too,
+// against its checksum.
+func (s *kvServer) scrubValues(ctx context.Context, r *scrubReport) {
+	from, first := "", true
+	for ctx.Err() == nil {
+		n := 0
+		s.mu.Lock()
+		s.tree.AscendGreaterOrEqual(item{key: from}, func(it item) bool {
+			key := it.fullKey()
+			if !first && key == from {
+				return true
+			}
+			if n == scrubBatch {
+				return false
+			}
+			if valueChecksum(it.value) != it.checksum {
+				s.scrub.problem(s, r, scrubInValues, "value for key %q does not match its checksum", s.redact.key(key))
+			}
+			from, n = key, n+1
+			r.values++
+			return true
+		})
+		s.mu.Unlock()
+		first = false
+		if n < scrubBatch || s.scrubRest(ctx) != nil {
+			return
+		}
+	}
+}
+
+func (a *adminServer) Scrub(ctx context.Context, req *kvpb.ScrubRequest) (*kvpb.ScrubReply, error) {
+	sc := a.kv.scrub
+	if sc == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "scrubbing is off on this replica (--scrub_interval=0)")
+	}
+	reply := &kvpb.ScrubReply{}
+	if req.Start {
+		reply.Started = sc.start()
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	reply.Running = sc.running
+	if r := sc.last; r != nil {
+		reply.LastStartedUnixNanos, reply.LastFinishedUnixNanos = r.started.UnixNano(), r.finished.UnixNano()
+		reply.SnapshotChecked, reply.LogEntriesChecked, reply.ValuesChecked = r.snapshotChecked, r.logEntries, r.values
+		reply.Problems, reply.ProblemCount = r.problems, r.problemCount
+	}
+	return reply, nil
+}
+
+func (sc *scrubber) registerMetrics(r *metricsRegistry) {
+	r.counter("kv_scrub_passes_total", "Scrub passes finished.", func() float64 { return float64(sc.passes.Load()) })
+	r.register("kv_scrub_problems_total", "Corruption the scrubber found, by where: the snapshot file, the raft log or the values in memory.", "counter", func() []metricSample {
+		samples := make([]metricSample, 0, len(sc.problems))
+		for _, where := range []string{scrubInSnapshot, scrubInLog, scrubInValues} {
+			samples = append(samples, metricSample{labels: map[string]string{"where": where}, value: float64(sc.problems[where].Load())})
+		}
+		return samples
+	})
+	r.gauge("kv_scrub_last_finished_timestamp_seconds", "When the last scrub pass finished, or 0 if none has.", func() float64 {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if sc.last == nil {
+			return 0
+		}
+		return float64(sc.last.finished.UnixNano()) / 1e9
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestScrubFindsCorruption(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.scrub = newScrubber(time.Hour)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := srv.Put(call("put-"+key), &kvpb.PutRequest{Key: key, Value: "value of " + key}); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	admin := &adminServer{kv: srv}
+
+	if r := srv.scrubPass(context.Background()); r.problemCount != 0 || r.values != 3 || r.logEntries == 0 || r.snapshotChecked {
+		t.Fatalf("scrub of an intact replica without a snapshot = %+v, want every value and log entry checked and no problems", r)
+	}
+
+	// A snapshot whose file checksum is intact but which holds a value that
+	// does not match its own checksum.
+	srv.mu.Lock()
+	st := &snapshotState{header: &kvpb.SnapshotHeader{LastIndex: srv.lastApplied}, tree: srv.tree.Clone(), dedup: srv.dedup}
+	bad, _ := st.tree.Get(item{key: "a"})
+	bad.value = "value of x"
+	st.tree.ReplaceOrInsert(bad)
+	srv.mu.Unlock()
+	if _, err := writeSnapshotFile(srv.snapshotPath(), st, noThrottle); err != nil {
+		t.Fatalf("writeSnapshotFile: %v", err)
+	}
+	if _, err := srv.db.Exec(`UPDATE raft_log SET crc = crc + 1 WHERE log_index = (SELECT MAX(log_index) FROM raft_log)`); err != nil {
+		t.Fatalf("corrupt crc: %v", err)
+	}
+	srv.mu.Lock()
+	it, _ := srv.getLiveLocked("b")
+	it.value = "value of y"
+	srv.tree.ReplaceOrInsert(it)
+	srv.mu.Unlock()
+
+	r := srv.scrubPass(context.Background())
+	if r.problemCount != 3 || !r.snapshotChecked {
+		t.Fatalf("scrub found %d problems %q, want one each in the snapshot, log and values", r.problemCount, r.problems)
+	}
+	for _, where := range []string{scrubInSnapshot, scrubInLog, scrubInValues} {
+		if n := srv.scrub.problems[where].Load(); n != 1 {
+			t.Errorf("problems in %s = %d, want 1", where, n)
+		}
+	}
+	reply, err := admin.Scrub(context.Background(), &kvpb.ScrubRequest{Start: true})
+	if err != nil || !reply.Started || reply.ProblemCount != 3 || len(reply.Problems) != 3 || reply.LastFinishedUnixNanos == 0 {
+		t.Fatalf("Scrub() = %v, %v; want a pass queued and the last one's three problems", reply, err)
+	}
+	if again, err := admin.Scrub(context.Background(), &kvpb.ScrubRequest{Start: true}); err != nil || again.Started {
+		t.Fatalf("second Scrub(start) = %v, %v; want the pass already queued", again, err)
+	}
+}
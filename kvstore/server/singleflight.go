@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// flightGroup collapses concurrent calls for the same key into one: while a
+// call for key is running, later callers wait for it and share its result
+// instead of starting their own. Nothing is cached once the call returns.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// do runs fn for key unless a call for key is already in flight, and
+// reports whether the result came from another caller's call.
+func (g *flightGroup[T]) do(key string, fn func() (T, error)) (T, bool, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.value, true, f.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight[T])
+	}
+	f := &flight[T]{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fn()
+	return f.value, false, f.err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCollapsesConcurrentCalls(t *testing.T) {
+	var g flightGroup[string]
+	var calls, shared atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, _, err := g.do("k", func() (string, error) {
+			calls.Add(1)
+			close(started)
+			<-release
+			return "v", nil
+		})
+		if err != nil || v != "v" {
+			t.Errorf("leader call = %q, %v", v, err)
+		}
+	}()
+	<-started
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, wasShared, err := g.do("k", func() (string, error) {
+				calls.Add(1)
+				return "again", nil
+			})
+			if wasShared {
+				shared.Add(1)
+			}
+			if err != nil || (wasShared && v != "v") {
+				t.Errorf("follower call = %q, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let the followers block in do
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 || shared.Load() != 10 {
+		t.Fatalf("calls=%d shared=%d, want 1 call shared by 10 waiters", calls.Load(), shared.Load())
+	}
+
+	v, wasShared, _ := g.do("k", func() (string, error) { return "fresh", nil })
+	if v != "fresh" || wasShared {
+		t.Fatalf("call after completion = %q shared=%v, want a fresh call", v, wasShared)
+	}
+}
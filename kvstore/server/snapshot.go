@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/btree"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Snapshot files are a magic string followed by frames of
+// [type byte][uvarint length][payload]. The final frame is snapEnd, whose
+// payload is the big-endian CRC-32C of every byte before it. Files with
+// snapshotMagicIEEE, from older servers, use CRC-32 IEEE there instead and
+// are still read.
+const (
+	snapshotFileName  = "snapshot.dat"
+	snapshotMagic     = "KVSNAP02"
+	snapshotMagicIEEE = "KVSNAP01"
+
+	snapHeader byte = 'H'
+	snapEntry  byte = 'K'
+	snapDedup  byte = 'D'
+	snapTiered byte = 'T'
+	snapEnd    byte = 'E'
+)
+
+// snapshotState is the key space and dedup table at a log index.
+type snapshotState struct {
+	header *kvpb.SnapshotHeader
+	tree   *btree.BTreeG[item]
+	dedup  map[string]cachedMutation
+	// demoted is kvServer.demoted.
+	demoted map[string]int64
+}
+
+// clone returns a copy that later writes to either side do not affect.
+func (st *snapshotState) clone() *snapshotState {
+	c := &snapshotState{header: st.header, tree: st.tree.Clone(), dedup: make(map[string]cachedMutation, len(st.dedup)), demoted: maps.Clone(st.demoted)}
+	for reqID, m := range st.dedup {
+		c.dedup[reqID] = m
+	}
+	return c
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf []byte
+}
+
+func (sw *snapshotWriter) write(p []byte) error {
+	sw.crc.Write(p)
+	_, err := sw.w.Write(p)
+	return err
+}
+
+func (sw *snapshotWriter) frame(kind byte, msg proto.Message) error {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sw.buf = append(sw.buf[:0], kind)
+	sw.buf = binary.AppendUvarint(sw.buf, uint64(len(payload)))
+	if err := sw.write(sw.buf); err != nil {
+		return err
+	}
+	return sw.write(payload)
+}
+
+// writeSnapshotFile writes st to path atomically: the data goes to a
+// temporary file that is synced and renamed over path. wrap lets the caller
+// throttle the file writes.
+func writeSnapshotFile(path string, st *snapshotState, wrap func(io.Writer) io.Writer) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("create snapshot: %w", err)
+	}
+	counter := &countingWriter{w: f}
+	err = encodeSnapshot(wrap(counter), st)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := renameSynced(tmp, path); err != nil {
+		return 0, fmt.Errorf("install snapshot: %w", err)
+	}
+	return counter.n, nil
+}
+
+// renameSynced renames tmp over path and syncs the directory, so the
+// rename survives a crash.
+func renameSynced(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// encodeSnapshot writes st to w in the snapshot file format.
+func encodeSnapshot(w io.Writer, st *snapshotState) error {
+	sw := &snapshotWriter{w: bufio.NewWriterSize(w, 64*1024), crc: crc32.New(castagnoli)}
+	if err := sw.write([]byte(snapshotMagic)); err != nil {
+		return err
+	}
+	if err := sw.frame(snapHeader, st.header); err != nil {
+		return err
+	}
+	var iterErr error
+	st.tree.Ascend(func(it item) bool {
+		iterErr = sw.frame(snapEntry, &kvpb.SnapshotEntry{
+			Key:           it.fullKey(),
+			Value:         it.value,
+			Tombstone:     it.tombstone,
+			DeletedSeq:    it.deletedSeq,
+			DeletedAt:     it.deletedAt,
+			UndeleteUntil: it.undeleteUntil,
+			DeleteAt:      it.deleteAt,
+			Hvc:           it.hvc,
+			ValueType:     it.vtype,
+			ContentType:   it.contentType,
+			WrittenSeq:    it.writtenSeq,
+			ValueCrc32C:   it.checksum,
+		})
+		return iterErr == nil
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	for reqID, m := range st.dedup {
+		if err := sw.frame(snapDedup, dedupToProto(reqID, m)); err != nil {
+			return err
+		}
+	}
+	for key, bytes := range st.demoted {
+		if err := sw.frame(snapTiered, &kvpb.SnapshotDemoted{Key: key, Bytes: bytes}); err != nil {
+			return err
+		}
+	}
+	trailer := binary.BigEndian.AppendUint32([]byte{snapEnd, 4}, sw.crc.Sum32())
+	if _, err := sw.w.Write(trailer); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readSnapshotFile loads and verifies a snapshot, sharing key prefixes
+// through keys. A missing file returns an error satisfying
+// errors.Is(err, os.ErrNotExist).
+func readSnapshotFile(path string, keys *keyInterner) (*snapshotState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSnapshot(f, path, keys)
+}
+
+// readSnapshot decodes and verifies a snapshot read from r; path names it
+// in errors.
+func readSnapshot(r io.Reader, path string, keys *keyInterner) (*snapshotState, error) {
+	st := &snapshotState{tree: newItemTree(), dedup: make(map[string]cachedMutation)}
+	err := walkSnapshot(r, path, func(kind byte, payload []byte) error {
+		switch kind {
+		case snapHeader:
+			st.header = &kvpb.SnapshotHeader{}
+			if err := proto.Unmarshal(payload, st.header); err != nil {
+				return fmt.Errorf("snapshot %s: decode header: %w", path, err)
+			}
+		case snapEntry:
+			var e kvpb.SnapshotEntry
+			if err := proto.Unmarshal(payload, &e); err != nil {
+				return fmt.Errorf("snapshot %s: decode entry: %w", path, err)
+			}
+			it := keys.item(e.Key)
+			it.value, it.tombstone, it.deletedSeq, it.deletedAt, it.undeleteUntil = e.Value, e.Tombstone, e.DeletedSeq, e.DeletedAt, e.UndeleteUntil
+			it.deleteAt, it.hvc, it.vtype, it.contentType, it.writtenSeq = e.DeleteAt, e.Hvc, e.ValueType, e.ContentType, e.WrittenSeq
+			if it.checksum = e.ValueCrc32C; it.checksum == 0 {
+				it.checksum = valueChecksum(e.Value)
+			}
+			st.tree.ReplaceOrInsert(it)
+		case snapDedup:
+			var d kvpb.SnapshotDedup
+			if err := proto.Unmarshal(payload, &d); err != nil {
+				return fmt.Errorf("snapshot %s: decode dedup: %w", path, err)
+			}
+			st.dedup[d.RequestId] = dedupFromProto(&d)
+		case snapTiered:
+			var d kvpb.SnapshotDemoted
+			if err := proto.Unmarshal(payload, &d); err != nil {
+				return fmt.Errorf("snapshot %s: decode demoted key: %w", path, err)
+			}
+			if st.demoted == nil {
+				st.demoted = make(map[string]int64)
+			}
+			st.demoted[d.Key] = d.Bytes
+		default:
+			return fmt.Errorf("snapshot %s: unknown frame type %q", path, kind)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if st.header == nil {
+		return nil, fmt.Errorf("snapshot %s: missing header", path)
+	}
+	return st, nil
+}
+
+// walkSnapshotFile passes each frame of a snapshot but the last to fn, then
+// checks the file's checksum. fn must not keep payload, whose buffer is
+// reused.
+func walkSnapshotFile(path string, fn func(kind byte, payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return walkSnapshot(f, path, fn)
+}
+
+// walkSnapshot is walkSnapshotFile for a snapshot read from src.
+func walkSnapshot(src io.Reader, path string, fn func(kind byte, payload []byte) error) error {
+	r := bufio.NewReaderSize(src, 64*1024)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return fmt.Errorf("snapshot %s: bad magic", path)
+	}
+	var crc hash.Hash32
+	switch string(magic) {
+	case snapshotMagic:
+		crc = crc32.New(castagnoli)
+	case snapshotMagicIEEE:
+		crc = crc32.NewIEEE()
+	default:
+		return fmt.Errorf("snapshot %s: bad magic", path)
+	}
+	crc.Write(magic)
+	var payload, prefix []byte
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("snapshot %s: truncated (no end frame)", path)
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > 64<<20 {
+			return fmt.Errorf("snapshot %s: bad frame length", path)
+		}
+		if cap(payload) < int(size) {
+			payload = make([]byte, size)
+		}
+		payload = payload[:size]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return fmt.Errorf("snapshot %s: truncated frame", path)
+		}
+		if kind == snapEnd {
+			if len(payload) != 4 || binary.BigEndian.Uint32(payload) != crc.Sum32() {
+				return fmt.Errorf("snapshot %s: checksum mismatch", path)
+			}
+			return nil
+		}
+		prefix = binary.AppendUvarint(append(prefix[:0], kind), size)
+		crc.Write(prefix)
+		crc.Write(payload)
+		if err := fn(kind, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *kvServer) snapshotPath() string {
+	return filepath.Join(s.backerDir, snapshotFileName)
+}
+
+// loadSnapshotLocked resets the in-memory state to the latest snapshot, or
+// to empty if there is none.
+func (s *kvServer) loadSnapshotLocked() error {
+	var st *snapshotState
+	switch {
+	case s.memSnapshot != nil:
+		st = s.memSnapshot.clone()
+	case !s.ephemeral():
+		var err error
+		st, err = readSnapshotFile(s.snapshotPath(), s.keyPrefixes)
+		if errors.Is(err, os.ErrNotExist) {
+			st = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if st == nil {
+		s.replaceTreeLocked(newItemTree())
+		s.demoted = nil
+		s.recountLocked()
+		s.dedup = make(map[string]cachedMutation)
+		s.snapshotIndex, s.lastApplied = 0, 0
+		s.mirrorPromoted, s.mirrorSourceSeq = false, 0
+		return nil
+	}
+	s.replaceTreeLocked(st.tree)
+	s.demoted = st.demoted
+	s.recountLocked()
+	s.dedup = st.dedup
+	s.snapshotIndex = st.header.LastIndex
+	s.lastApplied = st.header.LastIndex
+	s.mirrorPromoted = st.header.MirrorPromoted
+	s.mirrorSourceSeq = st.header.MirrorSourceSeq
+	return nil
+}
+
+// replaceTreeLocked makes tree the whole key space. Keys missing from it
+// never pass through deleteLocked, so cached scans and cache leases taken
+// on the old tree are dropped here rather than invalidated key by key.
+func (s *kvServer) replaceTreeLocked(tree *btree.BTreeG[item]) {
+	s.tree = tree
+	s.scanCache.reset()
+	s.cacheLeases.reset()
+}
+
+// takeSnapshot writes the applied state to disk and then drops the raft log
+// up to the GC horizon, which never passes the snapshot. Only the in-memory
+// copy is taken under s.mu; the file is written while requests continue.
+func (s *kvServer) takeSnapshot(wrap func(io.Writer) io.Writer) error {
+	s.mu.Lock()
+	if s.lastApplied <= s.snapshotIndex {
+		// Nothing new to snapshot, but lagging replicas may have caught up
+		// since the last compaction.
+		defer s.mu.Unlock()
+		if base := s.compactionBaseLocked(); base > s.logBase {
+			return s.compactLogLocked(base)
+		}
+		return nil
+	}
+	st := s.snapshotStateLocked()
+	s.mu.Unlock()
+
+	var written int64
+	if s.ephemeral() {
+		s.mu.Lock()
+		s.memSnapshot = st
+		s.mu.Unlock()
+	} else {
+		var err error
+		if written, err = writeSnapshotFile(s.snapshotPath(), st, wrap); err != nil {
+			return err
+		}
+	}
+	s.compactionBytes.Add(written)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshotIndex = st.header.LastIndex
+	base := s.compactionBaseLocked()
+	if base <= s.logBase {
+		s.logf("snapshot index=%d bytes=%d; log compaction waiting for replicas (horizon=%d cdc_shipped=%d)", s.snapshotIndex, written, s.gcHorizonLocked(), s.feedsShippedLocked())
+		return nil
+	}
+	return s.compactLogLocked(base)
+}
+
+// snapshotStateLocked returns a copy of the applied state that later
+// writes do not affect.
+func (s *kvServer) snapshotStateLocked() *snapshotState {
+	st := &snapshotState{
+		header: &kvpb.SnapshotHeader{
+			LastIndex:        s.lastApplied,
+			LastTerm:         s.logTermLocked(s.lastApplied),
+			PartitionId:      uint32(s.partitionID),
+			CreatedUnixNanos: time.Now().UnixNano(),
+			MirrorPromoted:   s.mirrorPromoted,
+			MirrorSourceSeq:  s.mirrorSourceSeq,
+		},
+		tree:    s.tree.Clone(),
+		dedup:   make(map[string]cachedMutation, len(s.dedup)),
+		demoted: maps.Clone(s.demoted),
+	}
+	for reqID, m := range s.dedup {
+		st.dedup[reqID] = m
+	}
+	return st
+}
+
+// compactionBaseLocked returns how far the raft log may be compacted: never
+// past the snapshot or the GC horizon, nor past entries CDC has yet to ship.
+func (s *kvServer) compactionBaseLocked() uint64 {
+	base := min(s.snapshotIndex, s.gcHorizonLocked())
+	if len(s.feeds) > 0 {
+		base = min(base, s.feedsShippedLocked())
+	}
+	return base
+}
+
+// compactLogLocked drops raft log entries up to and including base.
+func (s *kvServer) compactLogLocked(base uint64) error {
+	baseTerm := s.logTermLocked(base)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("compact log: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM raft_log WHERE log_index <= ?`, base); err != nil {
+		return fmt.Errorf("compact log: %w", err)
+	}
+	for key, value := range map[string]uint64{"log_base": base, "log_base_term": baseTerm} {
+		if _, err := tx.Exec(`INSERT INTO raft_meta(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, strconv.FormatUint(value, 10)); err != nil {
+			return fmt.Errorf("compact log: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("compact log: %w", err)
+	}
+	dropped := base - s.logBase
+	s.logEntries = append([]*kvpb.RaftLogEntry(nil), s.logEntries[dropped:]...)
+	s.logBase, s.logBaseTerm = base, baseTerm
+	s.logf("snapshot index=%d; compacted %d log entries through %d", s.snapshotIndex, dropped, base)
+	return nil
+}
+
+// dedupToProto encodes a dedup table entry for a snapshot.
+func dedupToProto(reqID string, m cachedMutation) *kvpb.SnapshotDedup {
+	d := &kvpb.SnapshotDedup{
+		RequestId:     reqID,
+		Op:            m.op,
+		Key:           m.key,
+		Value:         m.value,
+		Found:         m.found,
+		OldValue:      m.oldValue,
+		HasOldValue:   m.hasOldValue,
+		Seq:           m.seq,
+		DeleteAt:      m.deleteAt,
+		TtlNanos:      m.ttl,
+		NewKey:        m.newKey,
+		Overwrite:     m.overwrite,
+		MergeOperator: m.mergeOperator,
+		Merged:        m.merged,
+		ValueType:     m.valueType,
+		TypeMismatch:  m.typeMismatch,
+		WriteOnceKey:  m.writeOnceKey,
+	}
+	for _, sub := range m.batch {
+		d.Batch = append(d.Batch, dedupToProto("", sub))
+	}
+	return d
+}
+
+func dedupFromProto(d *kvpb.SnapshotDedup) cachedMutation {
+	m := cachedMutation{
+		op: d.Op, key: d.Key, value: d.Value, found: d.Found, oldValue: d.OldValue, hasOldValue: d.HasOldValue,
+		seq: d.Seq, deleteAt: d.DeleteAt, ttl: d.TtlNanos, newKey: d.NewKey, overwrite: d.Overwrite,
+		mergeOperator: d.MergeOperator, merged: d.Merged, valueType: d.ValueType, typeMismatch: d.TypeMismatch,
+		writeOnceKey: d.WriteOnceKey,
+	}
+	for _, sub := range d.Batch {
+		m.batch = append(m.batch, dedupFromProto(sub))
+	}
+	return m
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func noThrottle(w io.Writer) io.Writer { return w }
+
+func TestSnapshotCompactsLogAndSurvivesRestart(t *testing.T) {
+	backerDir := t.TempDir()
+	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+
+	put := func(srv *kvServer, reqID, key, value string) *kvpb.PutReply {
+		t.Helper()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+		resp, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: value})
+		if err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+		return resp
+	}
+	first := put(srv, "req-1", "alpha", "one")
+	put(srv, "req-2", "beta", "two")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-3"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "beta"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot() failed: %v", err)
+	}
+	srv.mu.Lock()
+	if srv.snapshotIndex != srv.lastApplied || srv.logBase != srv.lastApplied || len(srv.logEntries) != 0 {
+		t.Fatalf("snapshot=%d logBase=%d entries=%d lastApplied=%d, want log fully compacted", srv.snapshotIndex, srv.logBase, len(srv.logEntries), srv.lastApplied)
+	}
+	srv.mu.Unlock()
+	var rows int
+	if err := srv.db.QueryRow(`SELECT COUNT(*) FROM raft_log`).Scan(&rows); err != nil || rows != 0 {
+		t.Fatalf("raft_log rows = %d (err %v), want 0", rows, err)
+	}
+	put(srv, "req-4", "gamma", "three")
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+
+	reloaded := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, reloaded, 2)
+	for key, want := range map[string]string{"alpha": "one", "beta": "", "gamma": "three"} {
+		got, err := reloaded.Get(context.Background(), &kvpb.GetRequest{Key: key})
+		if err != nil {
+			t.Fatalf("Get(%s) after restart failed: %v", key, err)
+		}
+		if got.Found != (want != "") || got.Value != want {
+			t.Fatalf("Get(%s) after restart = %+v, want %q", key, got, want)
+		}
+	}
+	if retried := put(reloaded, "req-1", "alpha", "one"); retried.Seq != first.Seq {
+		t.Fatalf("retried Put seq = %d, want %d from the snapshot dedup table", retried.Seq, first.Seq)
+	}
+}
+
+func TestSnapshotFileDetectsCorruption(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.mu.Lock()
+	srv.putLocked("k", "v", 0)
+	st := &snapshotState{header: &kvpb.SnapshotHeader{LastIndex: 1}, tree: srv.tree.Clone(), dedup: srv.dedup}
+	srv.mu.Unlock()
+
+	path := filepath.Join(t.TempDir(), snapshotFileName)
+	if _, err := writeSnapshotFile(path, st, noThrottle); err != nil {
+		t.Fatalf("writeSnapshotFile() failed: %v", err)
+	}
+	if _, err := readSnapshotFile(path, nil); err != nil {
+		t.Fatalf("readSnapshotFile() failed on intact file: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	idx := strings.Index(string(raw), "k")
+	raw[idx] = 'x'
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatalf("rewrite snapshot: %v", err)
+	}
+	if _, err := readSnapshotFile(path, nil); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("readSnapshotFile() on corrupted file err = %v, want checksum mismatch", err)
+	}
+}
+
+func TestSnapshotFromOlderServerStillReads(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	srv.mu.Lock()
+	srv.putLocked("k", "v", 0)
+	st := &snapshotState{header: &kvpb.SnapshotHeader{LastIndex: 1}, tree: srv.tree.Clone(), dedup: srv.dedup}
+	srv.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, st); err != nil {
+		t.Fatalf("encodeSnapshot() failed: %v", err)
+	}
+	// Rewrite it as older servers did: their magic, and a CRC-32 IEEE in
+	// the end frame, which is its last 6 bytes.
+	raw := buf.Bytes()
+	copy(raw, snapshotMagicIEEE)
+	body := raw[:len(raw)-6]
+	binary.BigEndian.PutUint32(raw[len(raw)-4:], crc32.ChecksumIEEE(body))
+	got, err := readSnapshot(bytes.NewReader(raw), "legacy", nil)
+	if err != nil {
+		t.Fatalf("readSnapshot() of a CRC-32 IEEE snapshot failed: %v", err)
+	}
+	if it, ok := got.tree.Get(item{key: "k"}); !ok || it.value != "v" {
+		t.Fatalf("legacy snapshot k = %v, %v; want v", it, ok)
+	}
+	// The new magic with the old checksum is damage, not an old file.
+	copy(raw, snapshotMagic)
+	if _, err := readSnapshot(bytes.NewReader(raw), "mixed", nil); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("readSnapshot() with a mismatched polynomial err = %v, want checksum mismatch", err)
+	}
+}
+
+func TestCompactionSchedulerDropsDuplicateJobs(t *testing.T) {
+	sched := newCompactionScheduler(0, nil)
+	if !sched.enqueue(compactionJobSnapshot) {
+		t.Fatalf("first enqueue was rejected")
+	}
+	if sched.enqueue(compactionJobSnapshot) {
+		t.Fatalf("duplicate enqueue was accepted")
+	}
+	if depth := sched.queueDepth(); depth != 1 {
+		t.Fatalf("queueDepth() = %d, want 1", depth)
+	}
+}
+
+func TestEphemeralServerKeepsSnapshotsInMemory(t *testing.T) {
+	srv := newTestServer(t, "", 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	caps, err := srv.Capabilities(context.Background(), &kvpb.CapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Capabilities() failed: %v", err)
+	}
+	if !slices.Contains(caps.Features, featureEphemeral) {
+		t.Fatalf("features = %v, want %q", caps.Features, featureEphemeral)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot() failed: %v", err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-2"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v2"}); err != nil {
+		t.Fatalf("Put() after snapshot failed: %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.logBase == 0 || srv.memSnapshot == nil {
+		t.Fatalf("logBase=%d memSnapshot=%v, want a compacted log", srv.logBase, srv.memSnapshot)
+	}
+	if err := srv.rebuildStateFromCommittedLocked(); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if it, ok := srv.getLiveLocked("k"); !ok || it.value != "v2" {
+		t.Fatalf("after rebuild k = %+v, %v; want v2", it, ok)
+	}
+	if it, _ := srv.memSnapshot.tree.Get(item{key: "k"}); it.value != "v" {
+		t.Fatalf("snapshot copy changed to %q", it.value)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD push: where nothing scrapes /metrics, --statsd_addr sends the same
+// metrics registry to a StatsD agent over UDP every --statsd_interval.
+// Gauges go as gauges; counters go as the increase since the last push, as
+// StatsD counters are. Labels go as DogStatsD tags (|#name:value), which
+// the Datadog agent, Telegraf and statsd_exporter all read.
+
+// defaultStatsDInterval is how often metrics are pushed when
+// --statsd_interval is not set.
+const defaultStatsDInterval = 10 * time.Second
+
+// maxStatsDPacket keeps each datagram within a typical 1500-byte MTU.
+const maxStatsDPacket = 1432
+
+type statsdPusher struct {
+	conn     net.Conn
+	prefix   string
+	interval time.Duration
+	metrics  *metricsRegistry
+	// last is each counter's value at the previous push, by name and tags.
+	last map[string]float64
+}
+
+func newStatsDPusher(addr, prefix string, interval time.Duration, metrics *metricsRegistry) (*statsdPusher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("statsd_interval must be positive")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd dial %s: %w", addr, err)
+	}
+	return &statsdPusher{conn: conn, prefix: prefix, interval: interval, metrics: metrics, last: make(map[string]float64)}, nil
+}
+
+func (p *statsdPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	defer p.conn.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.push(); err != nil {
+				log.Printf("statsd push failed: %v", err)
+			}
+		}
+	}
+}
+
+// push sends every sample, packing as many lines into a datagram as fit.
+func (p *statsdPusher) push() error {
+	var packet []byte
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := p.conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+	err := p.metrics.collect(func(f *metricFamily, samples []metricSample) error {
+		for _, sample := range samples {
+			line, ok := p.line(f, sample)
+			if !ok {
+				continue
+			}
+			if len(packet) > 0 && len(packet)+1+len(line) > maxStatsDPacket {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// line formats one sample, or reports false for a counter that has not
+// moved since the last push.
+func (p *statsdPusher) line(f *metricFamily, sample metricSample) (string, bool) {
+	var tags string
+	if len(p.metrics.labels)+len(sample.labels) > 0 {
+		labels, names := mergeLabels(p.metrics.labels, sample.labels)
+		parts := make([]string, 0, len(names))
+		for _, name := range names {
+			parts = append(parts, name+":"+statsdTagValue(labels[name]))
+		}
+		tags = "|#" + strings.Join(parts, ",")
+	}
+	name := p.prefix + f.name
+	value, kind := sample.value, "g"
+	if f.kind == "counter" {
+		key := name + tags
+		prev, seen := p.last[key]
+		p.last[key] = sample.value
+		// A counter below its last value was reset; all of it is new.
+		if seen && sample.value >= prev {
+			value -= prev
+		}
+		if value == 0 {
+			return "", false
+		}
+		kind = "c"
+	}
+	return name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind + tags, true
+}
+
+// statsdTagValue replaces the characters that delimit tags and lines.
+func statsdTagValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_").Replace(v)
+}
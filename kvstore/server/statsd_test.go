@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatsDPushSendsGaugesAndCounterIncreases(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer agent.Close()
+	var requests atomic.Uint64
+	metrics := newMetricsRegistry(map[string]string{"partition": "2"})
+	metrics.gauge("kv_live_keys", "Keys.", func() float64 { return 7 })
+	metrics.counter("kv_requests_total", "Requests.", func() float64 { return float64(requests.Load()) })
+	metrics.register("kv_namespace_keys", "Keys by namespace.", "gauge", func() []metricSample {
+		return []metricSample{{labels: map[string]string{"namespace": "a|b"}, value: 3}}
+	})
+	p, err := newStatsDPusher(agent.LocalAddr().String(), "kvs.", time.Second, metrics)
+	if err != nil {
+		t.Fatalf("newStatsDPusher: %v", err)
+	}
+	defer p.conn.Close()
+	receive := func() []string {
+		t.Helper()
+		buf := make([]byte, maxStatsDPacket)
+		agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read push: %v", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	requests.Store(5)
+	if err := p.push(); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	want := []string{
+		"kvs.kv_live_keys:7|g|#partition:2",
+		"kvs.kv_requests_total:5|c|#partition:2",
+		"kvs.kv_namespace_keys:3|g|#namespace:a_b,partition:2",
+	}
+	if got := receive(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("first push = %q, want %q", got, want)
+	}
+
+	requests.Store(8)
+	if err := p.push(); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := receive(); len(got) != 3 || got[1] != "kvs.kv_requests_total:3|c|#partition:2" {
+		t.Fatalf("second push = %q, want the counter's increase of 3", got)
+	}
+	if err := p.push(); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got := receive(); len(got) != 2 {
+		t.Fatalf("push with an idle counter = %q, want only the gauges", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sdListenFDsStart is the first descriptor systemd passes to an activated
+// service (SD_LISTEN_FDS_START).
+const sdListenFDsStart = 3
+
+// inheritedListeners returns the sockets this process was started with,
+// keyed by name ("api", "p2p" or "admin"). They come from a server handing
+// over during a binary upgrade, or from systemd socket activation, where
+// names are taken from FileDescriptorName= and unnamed sockets are taken as
+// api then p2p in the order the unit lists them. It returns nil when nothing was
+// inherited, and clears the variables so child processes do not see them.
+func inheritedListeners() (map[string]net.Listener, error) {
+	var names []string
+	if v := os.Getenv(upgradeFDsEnv); v != "" {
+		names = strings.Split(v, ":")
+		os.Unsetenv(upgradeFDsEnv)
+	} else {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return nil, nil
+		}
+		names = make([]string, n)
+		copy(names, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+
+	defaults := []string{"api", "p2p"}
+	listeners := make(map[string]net.Listener, len(names))
+	for i, name := range names {
+		if (name == "" || name == "unknown") && i < len(defaults) {
+			name = defaults[i]
+		}
+		if name != "api" && name != "p2p" && name != "admin" {
+			return nil, fmt.Errorf("socket %d has unexpected name %q; want api, p2p or admin", sdListenFDsStart+i, name)
+		}
+		if _, dup := listeners[name]; dup {
+			return nil, fmt.Errorf("more than one %s socket passed", name)
+		}
+		f := os.NewFile(uintptr(sdListenFDsStart+i), "LISTEN_FD_"+strconv.Itoa(sdListenFDsStart+i))
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s socket: %w", name, err)
+		}
+		listeners[name] = lis
+	}
+	return listeners, nil
+}
+
+// sdNotify sends state (such as "READY=1") to the service manager. It does
+// nothing unless NOTIFY_SOCKET is set, as it is for Type=notify units.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract namespace socket.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notify %q: %w", state, err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Tiering keeps memory for keys in use. With --tier_after, the leader
+// demotes keys nobody has read or written for that long to the backing
+// store, which already holds every write, by logging an OP_EVICT that drops
+// them from memory on every replica. A read of a demoted key, and any write
+// whose outcome depends on its value, loads it back through the backing
+// store first, like any key not yet loaded. Range reads such as Scan walk
+// memory only, so a tiering server refuses them (see checkRangeRead).
+// Demoted keys stay charged to their namespace, so quotas and usage count
+// them as before.
+//
+// A key is only demoted once the write-behind feed has shipped the write
+// that left its value, so the backing store never answers with an older
+// one. Keys with a TTL, an integer type or a content type stay in memory:
+// expiry is cache eviction already, and the backing store keeps values
+// only.
+
+const (
+	// tierBatch caps the keys one sweep demotes.
+	tierBatch = 256
+	// tierScanLimit caps the keys one sweep examines; the next sweep
+	// carries on after the last one.
+	tierScanLimit = 10000
+)
+
+// backingSizer is a BackingStore that can report its size.
+type backingSizer interface {
+	Size(ctx context.Context) (keys, bytes int64, err error)
+}
+
+func (b *sqlBackingStore) Size(ctx context.Context) (int64, int64, error) {
+	var keys, bytes int64
+	err := b.db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(LENGTH(value)), 0) FROM kv`).Scan(&keys, &bytes)
+	return keys, bytes, err
+}
+
+// tiering is the demotion policy and its counters. A nil *tiering demotes
+// nothing.
+type tiering struct {
+	after time.Duration
+	// cursor is the key the next sweep starts at, guarded by kvServer.mu.
+	cursor string
+
+	demotions  atomic.Uint64
+	promotions atomic.Uint64
+	// backingKeys and backingBytes are the backing store's size as of the
+	// last sweep, or -1 if it cannot report one.
+	backingKeys  atomic.Int64
+	backingBytes atomic.Int64
+}
+
+func newTiering(after time.Duration) *tiering {
+	if after <= 0 {
+		return nil
+	}
+	t := &tiering{after: after}
+	t.backingKeys.Store(-1)
+	t.backingBytes.Store(-1)
+	return t
+}
+
+func (t *tiering) promoted() {
+	if t != nil {
+		t.promotions.Add(1)
+	}
+}
+
+// lastTouchLocked returns when key was last read or written, or when
+// tracking started if neither has happened since.
+func (a *accessStats) lastTouchLocked(key string) int64 {
+	e := a.keys[key]
+	if e == nil {
+		return a.since
+	}
+	if e.lastRead > e.lastWrite {
+		return e.lastRead
+	}
+	return e.lastWrite
+}
+
+// coldKeysLocked returns evictions for up to tierBatch keys that may be
+// demoted at now, continuing the walk where the last call stopped.
+func (s *kvServer) coldKeysLocked(now time.Time) []*kvpb.WALCommand {
+	cutoff := now.Add(-s.tier.after).UnixNano()
+	shipped := s.backingHorizonLocked(s.commitIndex)
+	var cold []*kvpb.WALCommand
+	examined := 0
+	// walk visits keys from from up to stop, or the end if stop is "", and
+	// reports whether it got there.
+	walk := func(from, stop string) bool {
+		done := true
+		s.tree.AscendGreaterOrEqual(item{key: from}, func(it item) bool {
+			key := it.fullKey()
+			if stop != "" && key >= stop {
+				return false
+			}
+			if examined == tierScanLimit || len(cold) == tierBatch {
+				done = false
+				return false
+			}
+			examined++
+			s.tier.cursor = key + "\x00"
+			switch {
+			case it.tombstone, it.deleteAt != 0, it.vtype != kvpb.ValueType_VALUE_TYPE_STRING, it.contentType != "":
+			case it.writtenSeq == 0 || it.writtenSeq > shipped:
+			case s.accessStats.lastTouchLocked(key) >= cutoff:
+			default:
+				cold = append(cold, &kvpb.WALCommand{Op: kvpb.WALCommand_OP_EVICT, Key: key, WrittenSeq: it.writtenSeq})
+			}
+			return true
+		})
+		return done
+	}
+	start := s.tier.cursor
+	if walk(start, "") {
+		// Reached the last key: wrap around to the first.
+		s.tier.cursor = ""
+		if start != "" {
+			walk("", start)
+		}
+	}
+	return cold
+}
+
+// evictLocked applies an OP_EVICT.
+func (s *kvServer) evictLocked(wal *kvpb.WALCommand) cachedMutation {
+	it, found := s.getLiveLocked(wal.Key)
+	found = found && it.writtenSeq != 0 && it.writtenSeq == wal.WrittenSeq && it.deleteAt == 0
+	if found {
+		s.tree.Delete(it)
+		s.keyPrefixes.removedLocked(it)
+		s.histogramDrift++
+		s.scanCache.invalidate(wal.Key)
+		s.cacheLeases.invalidate(wal.Key)
+		s.accessStats.forgetLocked(wal.Key)
+		s.liveKeys--
+		// The key still exists, so its charge stays until it is loaded
+		// back.
+		if s.demoted == nil {
+			s.demoted = make(map[string]int64)
+		}
+		bytes := int64(len(wal.Key) + len(it.value))
+		s.demoted[wal.Key] = bytes
+		s.demotedBytes += bytes
+		if s.tier != nil {
+			s.tier.demotions.Add(1)
+		}
+	}
+	return cachedMutation{op: wal.Op, key: wal.Key, found: found}
+}
+
+// undemoteLocked drops the charge a demoted key kept, as it is written to
+// memory again.
+func (s *kvServer) undemoteLocked(key string) {
+	bytes, ok := s.demoted[key]
+	if !ok {
+		return
+	}
+	delete(s.demoted, key)
+	s.demotedBytes -= bytes
+	s.chargeLocked(key, -1, -bytes)
+}
+
+// checkRangeRead refuses a read of a key range on a tiering server, where
+// the range may hold demoted keys that only the backing store has. rpc
+// names the read.
+func (s *kvServer) checkRangeRead(rpc string) error {
+	if s.tier == nil {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "%s is not supported with --tier_after: keys demoted to the backing store are not held in memory to read", rpc)
+}
+
+// demoteCold has the leader log an OP_EVICT for each cold key, then
+// refreshes the backing store's size.
+func (s *kvServer) demoteCold(ctx context.Context, timeout time.Duration) {
+	s.mu.Lock()
+	if s.role != roleLeader {
+		s.mu.Unlock()
+		return
+	}
+	cold := s.coldKeysLocked(time.Now())
+	s.mu.Unlock()
+
+	for _, wal := range cold {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		_, err := s.submitCommand(callCtx, &kvpb.ClientCommand{Wal: wal})
+		cancel()
+		if err != nil {
+			s.mu.Lock()
+			s.logf("demoting %q failed: %v", s.redact.key(wal.Key), err)
+			s.mu.Unlock()
+			return
+		}
+	}
+	if sizer, ok := s.backing.(backingSizer); ok {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		keys, bytes, err := sizer.Size(callCtx)
+		cancel()
+		if err == nil {
+			s.tier.backingKeys.Store(keys)
+			s.tier.backingBytes.Store(bytes)
+		}
+	}
+}
+
+func (s *kvServer) tierLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.demoteCold(ctx, 5*interval)
+		}
+	}
+}
+
+func (s *kvServer) registerTierMetrics(r *metricsRegistry) {
+	r.gauge("kv_tier_memory_keys", "Live keys held in memory, the hot tier.", s.locked(func() float64 { return float64(s.liveKeys) }))
+	r.gauge("kv_tier_memory_bytes", "Bytes of the keys and values held in memory.", s.locked(func() float64 {
+		var total int64
+		for _, u := range s.usage {
+			total += u.bytes
+		}
+		return float64(total - s.demotedBytes)
+	}))
+	r.gauge("kv_tier_backing_keys", "Keys in the backing store, the cold tier, as of the last tiering sweep; -1 if unknown.", func() float64 { return float64(s.tier.backingKeys.Load()) })
+	r.gauge("kv_tier_backing_bytes", "Bytes of the values in the backing store as of the last tiering sweep; -1 if unknown.", func() float64 { return float64(s.tier.backingBytes.Load()) })
+	r.counter("kv_tier_demotions_total", "Keys dropped from memory after going untouched for --tier_after.", func() float64 { return float64(s.tier.demotions.Load()) })
+	r.counter("kv_tier_promotions_total", "Keys loaded back into memory from the backing store.", func() float64 { return float64(s.tier.promotions.Load()) })
+}
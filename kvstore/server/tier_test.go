@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// newTieringTestServer returns a leader that tiers keys out to a backing
+// store after an hour, and the feed that writes behind to it.
+func newTieringTestServer(t *testing.T) (*kvServer, *cdcPublisher) {
+	t.Helper()
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	store := &mapStore{data: map[string]string{}}
+	srv.backing = store
+	srv.accessStats = newAccessStats(true)
+	srv.tier = newTiering(time.Hour)
+	feed, err := srv.addChangeFeed(backingFeedName, &backingSink{store: store}, 100, 0)
+	if err != nil {
+		t.Fatalf("addChangeFeed() failed: %v", err)
+	}
+	becomeTestLeader(t, srv, 1)
+	return srv, feed
+}
+
+func TestTieringDemotesShippedColdKeys(t *testing.T) {
+	srv, feed := newTieringTestServer(t)
+	cold := func() []*kvpb.WALCommand {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.coldKeysLocked(time.Now().Add(2 * time.Hour))
+	}
+
+	if _, err := srv.Put(withRequestID("put-k"), &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.Put(withRequestID("put-ttl"), &kvpb.PutRequest{Key: "ttl", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := srv.Expire(withRequestID("expire-ttl"), &kvpb.ExpireRequest{Key: "ttl", TtlMillis: 24 * 3600 * 1000}); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if got := cold(); len(got) != 0 {
+		t.Fatalf("cold keys before the write shipped = %v, want none", got)
+	}
+	if _, err := srv.shipChanges(context.Background(), feed); err != nil {
+		t.Fatalf("shipChanges failed: %v", err)
+	}
+	evictions := cold()
+	if len(evictions) != 1 || evictions[0].Key != "k" {
+		t.Fatalf("cold keys = %v, want only k", evictions)
+	}
+
+	stale := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_EVICT, Key: "k", WrittenSeq: evictions[0].WrittenSeq + 1}
+	for _, wal := range []*kvpb.WALCommand{stale, evictions[0]} {
+		if _, err := srv.submitCommand(context.Background(), &kvpb.ClientCommand{Wal: wal}); err != nil {
+			t.Fatalf("submitting an eviction failed: %v", err)
+		}
+	}
+	srv.mu.Lock()
+	_, inMemory := srv.getLiveLocked("k")
+	liveKeys := srv.liveKeys
+	srv.mu.Unlock()
+	if inMemory || liveKeys != 1 {
+		t.Fatalf("after eviction: k in memory = %v, live keys = %d, want k gone and 1 live key", inMemory, liveKeys)
+	}
+	if got := srv.tier.demotions.Load(); got != 1 {
+		t.Fatalf("demotions = %d, want 1 (the stale eviction must not apply)", got)
+	}
+
+	got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	if err != nil || !got.Found || got.Value != "v" {
+		t.Fatalf("Get(k) after demotion = %v, %v, want v from the backing store", got, err)
+	}
+	if got := srv.tier.promotions.Load(); got != 1 {
+		t.Fatalf("promotions = %d, want 1", got)
+	}
+}
+
+func TestDemotedKeysStayChargedAndLoadBeforeWrites(t *testing.T) {
+	srv, feed := newTieringTestServer(t)
+	for _, key := range []string{"ns/a", "ns/b"} {
+		if _, err := srv.Put(withRequestID("put-"+key), &kvpb.PutRequest{Key: key, Value: "value"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	if _, err := srv.shipChanges(context.Background(), feed); err != nil {
+		t.Fatalf("shipChanges failed: %v", err)
+	}
+	srv.mu.Lock()
+	want := srv.usage["ns"]
+	srv.mu.Unlock()
+	demote := func(key string) {
+		t.Helper()
+		srv.mu.Lock()
+		it, _ := srv.getLiveLocked(key)
+		srv.mu.Unlock()
+		wal := &kvpb.WALCommand{Op: kvpb.WALCommand_OP_EVICT, Key: key, WrittenSeq: it.writtenSeq}
+		if _, err := srv.submitCommand(context.Background(), &kvpb.ClientCommand{Wal: wal}); err != nil {
+			t.Fatalf("evicting %s failed: %v", key, err)
+		}
+	}
+	checkUsage := func(when string) {
+		t.Helper()
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if got := srv.usage["ns"]; got != want {
+			t.Fatalf("usage %s = %+v, want %+v", when, got, want)
+		}
+	}
+
+	demote("ns/a")
+	demote("ns/b")
+	checkUsage("after demotion")
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot: %v", err)
+	}
+	srv.mu.Lock()
+	err := srv.loadSnapshotLocked()
+	srv.mu.Unlock()
+	if err != nil {
+		t.Fatalf("loadSnapshotLocked: %v", err)
+	}
+	checkUsage("after a restart from the snapshot")
+
+	if reply, err := srv.Expire(withRequestID("expire-a"), &kvpb.ExpireRequest{Key: "ns/a", TtlMillis: 60000}); err != nil || !reply.Found {
+		t.Fatalf("Expire of a demoted key = %v, %v; want it found", reply, err)
+	}
+	if reply, err := srv.Rename(withRequestID("rename-b"), &kvpb.RenameRequest{OldKey: "ns/b", NewKey: "ns/c"}); err != nil || !reply.Renamed {
+		t.Fatalf("Rename of a demoted key = %v, %v; want it renamed", reply, err)
+	}
+	checkUsage("after loading the keys back")
+
+	if _, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "ns/", EndKey: "ns0"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Scan on a tiering server = %v, want FailedPrecondition", err)
+	}
+}
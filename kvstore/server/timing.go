@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Timeout breakdowns: a write or a read barrier that runs out of time
+// fails with DEADLINE_EXCEEDED and an ErrorInfo (reason TIMED_OUT) giving
+// where its time went: waiting for the server's lock, encoding the log
+// entry, writing it to the log database, whose commit is an fsync, and
+// waiting for a quorum to store and apply it. The server logs the same
+// breakdown, and gives up a little before the caller's deadline so that
+// the caller, rather than its own timer, is the one to see it.
+
+// opPhase is a part of a request's time.
+type opPhase int
+
+const (
+	phaseLockWait opPhase = iota
+	phaseWALAppend
+	phaseFsync
+	phaseReplication
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"lock_wait", "wal_append", "fsync", "replication"}
+
+// maxTimeoutMargin caps how early the server gives up: a tenth of the time
+// a request has left, but no more than this.
+const maxTimeoutMargin = 100 * time.Millisecond
+
+// opTimer adds up the time a request spends in each phase. A nil *opTimer
+// records nothing.
+type opTimer struct {
+	start, last time.Time
+	spent       [numPhases]time.Duration
+}
+
+func newOpTimer() *opTimer {
+	now := time.Now()
+	return &opTimer{start: now, last: now}
+}
+
+// mark charges the time since the last mark to p.
+func (t *opTimer) mark(p opPhase) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.spent[p] += now.Sub(t.last)
+	t.last = now
+}
+
+// skip charges the time since the last mark to no phase; it shows as
+// other.
+func (t *opTimer) skip() {
+	if t != nil {
+		t.last = time.Now()
+	}
+}
+
+// withTimeoutMargin returns ctx with its deadline, if it has one, brought
+// forward so a timeout error reaches the caller before it stops waiting.
+func withTimeoutMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	margin := min(time.Until(deadline)/10, maxTimeoutMargin)
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// timeoutError is the error for a request whose ctx is done, with the
+// time spent so far broken down if it ran out of time. format and args say
+// what it was doing.
+func (t *opTimer) timeoutError(ctx context.Context, format string, args ...any) error {
+	if err := ctx.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	what := fmt.Sprintf(format, args...)
+	total := time.Since(t.start)
+	other := total
+	md := map[string]string{"total": total.String()}
+	parts := make([]string, 0, numPhases+1)
+	for p, d := range t.spent {
+		md[phaseNames[p]] = d.String()
+		parts = append(parts, phaseNames[p]+"="+d.Round(time.Microsecond).String())
+		other -= d
+	}
+	md["other"] = other.String()
+	parts = append(parts, "other="+other.Round(time.Microsecond).String())
+	breakdown := strings.Join(parts, " ")
+	log.Printf("timed out: %s after %s: %s", what, total.Round(time.Microsecond), breakdown)
+	err := reasonError(codes.DeadlineExceeded, reasonTimedOut, md, "%s: timed out after %s: %s", what, total.Round(time.Microsecond), breakdown)
+	return timeoutErr{status.Convert(err)}
+}
+
+// timeoutErr is a DEADLINE_EXCEEDED status that callers in this process
+// can still match with errors.Is(err, context.DeadlineExceeded).
+type timeoutErr struct{ st *status.Status }
+
+func (e timeoutErr) Error() string              { return e.st.Err().Error() }
+func (e timeoutErr) GRPCStatus() *status.Status { return e.st }
+func (e timeoutErr) Unwrap() error              { return context.DeadlineExceeded }
+
+// describeWrite names wal's operation and key for a timeout error.
+func (s *kvServer) describeWrite(wal *kvpb.WALCommand) string {
+	return fmt.Sprintf("%s of %q", strings.ToLower(strings.TrimPrefix(wal.Op.String(), "OP_")), s.redact.key(wal.Key))
+}
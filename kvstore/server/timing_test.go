@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestTimeoutErrorBreaksDownTime(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.mu.Lock()
+	for _, peerID := range []int{1, 2} {
+		srv.peerClients[peerID] = &mockRaftPeerClient{
+			appendFn: func(ctx context.Context, req *kvpb.AppendEntriesRequest, opts ...grpc.CallOption) (*kvpb.AppendEntriesReply, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		}
+	}
+	srv.mu.Unlock()
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	_, err := srv.submitCommand(ctx, &kvpb.ClientCommand{Wal: &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "k", Value: "v"}})
+	if returned := time.Now(); !returned.Before(deadline) {
+		t.Fatalf("submitCommand returned %s after the caller's deadline, want before it", returned.Sub(deadline))
+	}
+	if status.Code(err) != codes.DeadlineExceeded || errorReason(err) != reasonTimedOut || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("submitCommand() err = %v, want DeadlineExceeded %s", err, reasonTimedOut)
+	}
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, `put of "k"`) || !strings.Contains(msg, "replication=") {
+		t.Fatalf("timeout message = %q, want the write and its time broken down", msg)
+	}
+	var info *errdetails.ErrorInfo
+	for _, d := range status.Convert(err).Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	replication, perr := time.ParseDuration(info.GetMetadata()["replication"])
+	if perr != nil || replication < 200*time.Millisecond {
+		t.Fatalf("ErrorInfo metadata = %v, want most of the time under replication", info.GetMetadata())
+	}
+	for _, phase := range []string{"lock_wait", "wal_append", "fsync", "other", "total"} {
+		if _, ok := info.GetMetadata()[phase]; !ok {
+			t.Errorf("ErrorInfo metadata has no %s: %v", phase, info.GetMetadata())
+		}
+	}
+
+	canceled, stop := context.WithCancel(context.Background())
+	stop()
+	if err := newOpTimer().timeoutError(canceled, "anything"); status.Code(err) != codes.Canceled {
+		t.Fatalf("timeoutError for a canceled request = %v, want Canceled", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// gcHorizonLocked returns the highest log index every replica is known to
+// have stored. A tombstone at or below it can no longer be needed to bring a
+// lagging replica up to date.
+func (s *kvServer) gcHorizonLocked() uint64 {
+	if s.role != roleLeader {
+		return min(s.replicatedIndex, s.commitIndex)
+	}
+	horizon := s.commitIndex
+	for _, peerID := range s.peerReplicaIDs {
+		horizon = min(horizon, s.matchIndex[peerID])
+	}
+	return horizon
+}
+
+// tombstoneScanLimit caps the keys one GC pass examines while holding the
+// server's lock; the next pass carries on after the last one.
+const tombstoneScanLimit = 10000
+
+// collectTombstonesLocked purges tombstones that are both older than the
+// retention window and at or below the GC horizon, returning how many it
+// removed. Each call examines at most tombstoneScanLimit keys, continuing
+// the walk where the last call stopped, so a large key space is covered over
+// several passes rather than in one long hold of the lock. Purging is local
+// to each replica: reads never observe tombstones, so replicas may purge at
+// different times without diverging. Undelete does see them, so a
+// soft-deleted tombstone is kept for the retention window past its undelete
+// deadline, time for an undelete logged before the deadline to reach every
+// replica.
+func (s *kvServer) collectTombstonesLocked(now time.Time) int {
+	horizon := s.backingHorizonLocked(s.gcHorizonLocked())
+	cutoff := now.Add(-s.tombstoneRetention).UnixNano()
+	var expired []item
+	examined := 0
+	// walk visits keys from from up to stop, or the end if stop is "", and
+	// reports whether it got there.
+	walk := func(from, stop string) bool {
+		done := true
+		s.tree.AscendGreaterOrEqual(item{key: from}, func(it item) bool {
+			key := it.fullKey()
+			if stop != "" && key >= stop {
+				return false
+			}
+			if examined == tombstoneScanLimit {
+				done = false
+				return false
+			}
+			examined++
+			s.tombstoneCursor = key + "\x00"
+			if it.tombstone && it.deletedSeq <= horizon && it.deletedAt <= cutoff && it.undeleteUntil <= cutoff {
+				expired = append(expired, it)
+			}
+			return true
+		})
+		return done
+	}
+	start := s.tombstoneCursor
+	if walk(start, "") {
+		// Reached the last key: wrap around to the first.
+		s.tombstoneCursor = ""
+		if start != "" {
+			walk("", start)
+		}
+	}
+	for _, it := range expired {
+		s.tree.Delete(it)
+		s.keyPrefixes.removedLocked(it)
+	}
+	s.tombstones -= len(expired)
+	s.tombstonesPurged += uint64(len(expired))
+	return len(expired)
+}
+
+func (s *kvServer) tombstoneGCLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if purged := s.collectTombstonesLocked(time.Now()); purged > 0 {
+				s.logf("tombstone gc purged=%d remaining=%d horizon=%d", purged, s.tombstones, s.gcHorizonLocked())
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestDeleteLeavesTombstoneUntilGC(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.tombstoneRetention = time.Minute
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-put"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "alpha", Value: "one"}); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-del"))
+	if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: "alpha"}); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	got, err := srv.Get(context.Background(), &kvpb.GetRequest{Key: "alpha"})
+	if err != nil || got.Found {
+		t.Fatalf("Get() after delete = %+v, %v; want not found", got, err)
+	}
+	scan, err := srv.Scan(context.Background(), &kvpb.ScanRequest{StartKey: "a", EndKey: "z"})
+	if err != nil || len(scan.Pairs) != 0 {
+		t.Fatalf("Scan() after delete = %+v, %v; want no pairs", scan, err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.liveKeys != 0 || srv.tombstones != 1 {
+		t.Fatalf("liveKeys=%d tombstones=%d, want 0/1", srv.liveKeys, srv.tombstones)
+	}
+	if purged := srv.collectTombstonesLocked(time.Now()); purged != 0 {
+		t.Fatalf("purged %d tombstones inside the retention window", purged)
+	}
+	if purged := srv.collectTombstonesLocked(time.Now().Add(2 * time.Minute)); purged != 1 {
+		t.Fatalf("purged %d tombstones after retention, want 1", purged)
+	}
+	if srv.tree.Len() != 0 || srv.tombstones != 0 {
+		t.Fatalf("tree len=%d tombstones=%d after GC, want 0/0", srv.tree.Len(), srv.tombstones)
+	}
+}
+
+func TestTombstoneGCWaitsForLaggingReplica(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	becomeTestLeader(t, srv, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "k", Value: "v"}, 1)
+	srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE, Key: "k"}, 2)
+	srv.commitIndex = 2
+	srv.matchIndex[1] = 2
+	srv.matchIndex[2] = 1
+
+	if purged := srv.collectTombstonesLocked(time.Now()); purged != 0 {
+		t.Fatalf("purged %d tombstones past a replica's match index", purged)
+	}
+	srv.matchIndex[2] = 2
+	if purged := srv.collectTombstonesLocked(time.Now()); purged != 1 {
+		t.Fatalf("purged %d tombstones once every replica caught up, want 1", purged)
+	}
+}
+
+func TestTombstoneGCWorksThroughKeysInPasses(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	n := tombstoneScanLimit + 10
+	var idx uint64
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%06d", i)
+		idx++
+		srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: key, Value: "v"}, idx)
+		idx++
+		srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_DELETE, Key: key}, idx)
+	}
+	srv.commitIndex = idx
+	srv.tombstoneRetention = 0
+
+	if purged := srv.collectTombstonesLocked(time.Now()); purged != tombstoneScanLimit {
+		t.Fatalf("first pass purged %d tombstones, want the scan limit %d", purged, tombstoneScanLimit)
+	}
+	if purged := srv.collectTombstonesLocked(time.Now()); purged != 10 {
+		t.Fatalf("second pass purged %d tombstones, want the remaining 10", purged)
+	}
+	if srv.tombstones != 0 || srv.tree.Len() != 0 {
+		t.Fatalf("tombstones=%d tree len=%d after two passes, want 0/0", srv.tombstones, srv.tree.Len())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// traceRecord is one JSON line of a workload trace. The client replays these
+// with --replay, so the field names are part of the trace file format.
+type traceRecord struct {
+	UnixNanos int64           `json:"ts"`
+	Method    string          `json:"method"`
+	Request   json.RawMessage `json:"request"`
+	// Partition is the recording server's partition. Replay sends requests
+	// without a key, such as a Scan page, back to it.
+	Partition int `json:"partition"`
+	// TraceID is the client's x-trace-id, if it sent one.
+	TraceID string `json:"trace_id,omitempty"`
+	// Identity is the authenticated caller, with --oidc_issuer.
+	Identity string `json:"identity,omitempty"`
+}
+
+type traceRecorder struct {
+	partition int
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	stop   chan struct{}
+	done   chan struct{}
+	redact redaction
+}
+
+func newTraceRecorder(path string, partition int, redact redaction) (*traceRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open trace file: %w", err)
+	}
+	t := &traceRecorder{
+		partition: partition,
+		file:      f,
+		w:         bufio.NewWriter(f),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		redact:    redact,
+	}
+	go t.flushLoop()
+	return t, nil
+}
+
+func (t *traceRecorder) record(at time.Time, method, traceID, identity string, req proto.Message) {
+	payload, err := protojson.Marshal(t.redact.message(req))
+	if err != nil {
+		log.Printf("trace encode %s failed: %v", method, err)
+		return
+	}
+	line, err := json.Marshal(traceRecord{UnixNanos: at.UnixNano(), Method: method, Request: payload, Partition: t.partition, TraceID: traceID, Identity: identity})
+	if err != nil {
+		log.Printf("trace encode %s failed: %v", method, err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.w.Write(line)
+	_ = t.w.WriteByte('\n')
+}
+
+func (t *traceRecorder) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.Flush()
+}
+
+// flushLoop bounds how much of the trace can be lost when the server is
+// killed, since the serve loop never returns through main's defers.
+func (t *traceRecorder) flushLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			if err := t.flush(); err != nil {
+				log.Printf("trace flush failed: %v", err)
+			}
+		}
+	}
+}
+
+func (t *traceRecorder) close() error {
+	close(t.stop)
+	<-t.done
+	if err := t.flush(); err != nil {
+		_ = t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+// unaryInterceptor records KVS requests stamped with their arrival time.
+// Admin and health RPCs sharing the port are not client workload and are
+// left out. So are requests bounced with a leader redirect, because the
+// client re-sends them to the leader, which records them there.
+func (t *traceRecorder) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	arrived := time.Now()
+	resp, err := handler(ctx, req)
+	if !strings.HasPrefix(info.FullMethod, "/"+kvpb.KVS_ServiceDesc.ServiceName+"/") {
+		return resp, err
+	}
+	if msg, ok := req.(proto.Message); ok && !isNotLeaderError(err) {
+		t.record(arrived, info.FullMethod, traceIDFromContext(ctx), identityFromContext(ctx), msg)
+	}
+	return resp, err
+}
+
+func isNotLeaderError(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.FailedPrecondition && errorReason(err) == reasonNotLeader
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// traceIDMetadataKey carries a client-chosen ID that ties one operation's
+// client, router and server logs together. Unlike x-request-id it is never
+// used to deduplicate writes, so a client may reuse it across the requests
+// of one logical operation.
+const traceIDMetadataKey = "x-trace-id"
+
+// maxTraceIDLen bounds what a client can make the server log and echo.
+const maxTraceIDLen = 128
+
+type traceIDKey struct{}
+
+// traceIDFromContext returns the request's trace ID, or "".
+func traceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// incomingTraceID reads the trace ID a client sent, if any.
+func incomingTraceID(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	values := md.Get(traceIDMetadataKey)
+	if len(values) == 0 {
+		return "", nil
+	}
+	id := values[0]
+	if len(values) > 1 || id == "" || len(id) > maxTraceIDLen {
+		return "", status.Errorf(codes.InvalidArgument, "%q must be one non-empty value of at most %d bytes", traceIDMetadataKey, maxTraceIDLen)
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return "", status.Errorf(codes.InvalidArgument, "%q must be printable ASCII without spaces", traceIDMetadataKey)
+		}
+	}
+	return id, nil
+}
+
+// withTraceID echoes id in the response headers and makes it available to
+// the handler through the context.
+func withTraceID(ctx context.Context, id string) context.Context {
+	_ = grpc.SetHeader(ctx, metadata.Pairs(traceIDMetadataKey, id))
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// tagTraceID logs a failed request under its trace ID and appends the ID
+// to the error message, keeping the code and details.
+func tagTraceID(method, id string, err error) error {
+	log.Printf("%s failed [trace_id=%s]: %v", method, id, err)
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(codes.Unknown, err.Error())
+	}
+	p := st.Proto()
+	p.Message += " [trace_id=" + id + "]"
+	return status.FromProto(p).Err()
+}
+
+// traceIDUnaryInterceptor runs first in the chain, so the errors of later
+// interceptors are tagged too.
+func traceIDUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id, err := incomingTraceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return handler(ctx, req)
+	}
+	resp, err := handler(withTraceID(ctx, id), req)
+	if err != nil {
+		return nil, tagTraceID(info.FullMethod, id, err)
+	}
+	return resp, nil
+}
+
+// tracedStream hands handlers a context carrying the trace ID.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context { return s.ctx }
+
+func traceIDStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id, err := incomingTraceID(ss.Context())
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return handler(srv, ss)
+	}
+	if err := handler(srv, &tracedStream{ServerStream: ss, ctx: withTraceID(ss.Context(), id)}); err != nil {
+		return tagTraceID(info.FullMethod, id, err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTraceIDReachesHandlerAndErrors(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/kvs.KVS/Put"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceIDMetadataKey, "op-42"))
+	var seen string
+	_, err := traceIDUnaryInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen = traceIDFromContext(ctx)
+		return nil, notLeaderError("127.0.0.1:13778")
+	})
+	if seen != "op-42" {
+		t.Fatalf("handler saw trace ID %q, want op-42", seen)
+	}
+	if !strings.HasSuffix(status.Convert(err).Message(), "[trace_id=op-42]") || errorReason(err) != reasonNotLeader {
+		t.Fatalf("error = %v, want the trace ID appended and the NOT_LEADER detail kept", err)
+	}
+
+	bad := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceIDMetadataKey, "has space"))
+	if _, err := traceIDUnaryInterceptor(bad, nil, info, func(context.Context, interface{}) (interface{}, error) {
+		t.Fatal("handler ran with an invalid trace ID")
+		return nil, nil
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid trace ID = %v, want InvalidArgument", err)
+	}
+}
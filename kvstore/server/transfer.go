@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// transferTimeout bounds a leadership transfer. If the target has not taken
+// over by then the leader gives up and takes writes again, and serves reads
+// under a lease only once a quorum has acknowledged it afresh.
+const transferTimeout = minElectionTimeout
+
+// TransferLeadership hands leadership to another voter: the leader stops
+// taking writes, waits for the target to hold its whole log, and then tells
+// it to start an election, which it wins because no other replica's log is
+// ahead of it.
+func (a *adminServer) TransferLeadership(ctx context.Context, req *kvpb.TransferLeadershipRequest) (*kvpb.TransferLeadershipReply, error) {
+	s := a.kv
+	target := int(req.TargetReplicaId)
+	s.mu.Lock()
+	if s.role != roleLeader {
+		addr := s.leaderAddr
+		s.mu.Unlock()
+		return nil, notLeaderError(addr)
+	}
+	if err := s.checkTransferTargetLocked(target); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	term := s.currentTerm
+	s.transferTarget = target
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.transferTarget == target {
+			s.transferTarget = -1
+			// If the target was told to campaign but has not won yet, it
+			// still may, so the old lease no longer holds.
+			s.leaseFloor = time.Now()
+		}
+		s.mu.Unlock()
+	}()
+	s.logf("transferring leadership to replica %d", target)
+
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+	if err := s.waitCaughtUp(ctx, target, term); err != nil {
+		return nil, err
+	}
+	client, err := s.getPeerClient(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "dial replica %d: %v", target, err)
+	}
+	if _, err := client.TimeoutNow(ctx, &kvpb.TimeoutNowRequest{Term: term, LeaderId: uint32(s.replicaID)}); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "replica %d refused to campaign: %v", target, err)
+	}
+
+	poll := time.NewTicker(20 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		s.mu.Lock()
+		newTerm := s.currentTerm
+		s.mu.Unlock()
+		if newTerm > term {
+			return &kvpb.TransferLeadershipReply{Term: newTerm}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, status.Errorf(codes.DeadlineExceeded, "replica %d did not take over within %s", target, transferTimeout)
+		case <-poll.C:
+		}
+	}
+}
+
+func (s *kvServer) checkTransferTargetLocked(target int) error {
+	if target == s.replicaID {
+		return invalidFieldError("target_replica_id", "replica %d is already the leader", target)
+	}
+	if _, ok := s.peerP2PAddrs[target]; !ok {
+		return invalidFieldError("target_replica_id", "partition %d has no replica %d", s.partitionID, target)
+	}
+	if kind := s.memberType(target); kind != memberVoter {
+		return status.Errorf(codes.FailedPrecondition, "replica %d is a %s and cannot lead", target, kind)
+	}
+	if s.transferTarget >= 0 {
+		return status.Errorf(codes.FailedPrecondition, "a transfer to replica %d is already in progress", s.transferTarget)
+	}
+	return nil
+}
+
+// waitCaughtUp returns once target has stored the leader's whole log.
+// Writes are refused during a transfer, so the log stops growing.
+func (s *kvServer) waitCaughtUp(ctx context.Context, target int, term uint64) error {
+	retry := time.NewTicker(heartbeatInterval)
+	defer retry.Stop()
+	go s.replicateToPeer(target)
+	for {
+		s.mu.Lock()
+		if s.role != roleLeader || s.currentTerm != term {
+			s.mu.Unlock()
+			return status.Errorf(codes.Aborted, "lost leadership during the transfer")
+		}
+		if s.matchIndex[target] >= s.lastLogIndexLocked() {
+			s.mu.Unlock()
+			return nil
+		}
+		acked := s.ackSignal
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded, "replica %d did not catch up within %s", target, transferTimeout)
+		case <-acked:
+		case <-retry.C:
+			go s.replicateToPeer(target)
+		}
+	}
+}
+
+// TimeoutNow starts an election at once on behalf of the leader.
+func (s *kvServer) TimeoutNow(ctx context.Context, req *kvpb.TimeoutNowRequest) (*kvpb.TimeoutNowReply, error) {
+	s.mu.Lock()
+	if req.Term < s.currentTerm {
+		defer s.mu.Unlock()
+		return &kvpb.TimeoutNowReply{Term: s.currentTerm}, nil
+	}
+	if s.drain.started.Load() {
+		defer s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "replica %d is draining and cannot lead", s.replicaID)
+	}
+	if !s.canLead() {
+		defer s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "replica %d is a %s and cannot lead", s.replicaID, s.memberType(s.replicaID))
+	}
+	s.logf("leader=%d asked this replica to take over", req.LeaderId)
+	s.transferElection = true
+	s.electionDeadline = time.Time{}
+	term := s.currentTerm
+	s.mu.Unlock()
+	s.startElection()
+	return &kvpb.TimeoutNowReply{Term: term}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestTransferLeadershipHandsOverToCaughtUpVoter(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 3, 1)
+	becomeTestLeader(t, srv, 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "req-1"))
+
+	var writeErr error
+	srv.mu.Lock()
+	srv.peerClients[1] = &mockRaftPeerClient{
+		timeoutNowFn: func(_ context.Context, req *kvpb.TimeoutNowRequest, opts ...grpc.CallOption) (*kvpb.TimeoutNowReply, error) {
+			_, writeErr = srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"})
+			// Replica 1 wins the election it was asked to start.
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if err := srv.becomeFollowerLocked(req.Term+1, 1, ""); err != nil {
+				t.Errorf("becomeFollowerLocked failed: %v", err)
+			}
+			return &kvpb.TimeoutNowReply{Term: req.Term}, nil
+		},
+	}
+	srv.peerClients[2] = &mockRaftPeerClient{}
+	srv.mu.Unlock()
+
+	admin := &adminServer{kv: srv}
+	if _, err := admin.TransferLeadership(context.Background(), &kvpb.TransferLeadershipRequest{TargetReplicaId: 0}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("transfer to self = %v, want InvalidArgument", err)
+	}
+	resp, err := admin.TransferLeadership(context.Background(), &kvpb.TransferLeadershipRequest{TargetReplicaId: 1})
+	if err != nil {
+		t.Fatalf("TransferLeadership failed: %v", err)
+	}
+	if resp.Term != 2 {
+		t.Fatalf("term = %d, want 2", resp.Term)
+	}
+	if status.Code(writeErr) != codes.Unavailable {
+		t.Fatalf("write during transfer = %v, want Unavailable", writeErr)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.role != roleFollower || srv.transferTarget != -1 {
+		t.Fatalf("role=%s transferTarget=%d, want follower with no transfer", srv.role, srv.transferTarget)
+	}
+}
+
+func TestTimeoutNowStartsTransferElection(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 1, 3, 1)
+	srv.mu.Lock()
+	srv.readMode = readModeLease
+	if err := srv.becomeFollowerLocked(1, 0, ""); err != nil {
+		t.Fatalf("becomeFollowerLocked failed: %v", err)
+	}
+	grant := func(_ context.Context, req *kvpb.RequestVoteRequest, opts ...grpc.CallOption) (*kvpb.RequestVoteReply, error) {
+		if !req.LeadershipTransfer {
+			t.Errorf("vote request %v is not marked as a transfer", req)
+		}
+		return &kvpb.RequestVoteReply{Term: req.Term, VoteGranted: true}, nil
+	}
+	srv.peerClients[0] = &mockRaftPeerClient{requestVoteFn: grant}
+	srv.peerClients[2] = &mockRaftPeerClient{requestVoteFn: grant}
+	srv.mu.Unlock()
+
+	if _, err := srv.TimeoutNow(context.Background(), &kvpb.TimeoutNowRequest{Term: 1, LeaderId: 0}); err != nil {
+		t.Fatalf("TimeoutNow failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		srv.mu.Lock()
+		role, term := srv.role, srv.currentTerm
+		srv.mu.Unlock()
+		if role == roleLeader {
+			if term != 2 {
+				t.Fatalf("term = %d, want 2", term)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("role = %s, want leader after TimeoutNow", role)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A replica that heard from its leader just now still grants the vote
+	// in lease mode when the leader asked for the election.
+	voter := newTestServer(t, t.TempDir(), 0, 2, 3, 1)
+	voter.mu.Lock()
+	voter.readMode = readModeLease
+	err := voter.becomeFollowerLocked(1, 0, "")
+	voter.leaderContact = time.Now()
+	voter.mu.Unlock()
+	if err != nil {
+		t.Fatalf("becomeFollowerLocked failed: %v", err)
+	}
+	reply, err := voter.RequestVote(context.Background(), &kvpb.RequestVoteRequest{Term: 2, CandidateId: 1, LeadershipTransfer: true})
+	if err != nil || !reply.VoteGranted {
+		t.Fatalf("RequestVote = %v, %v; want granted", reply, err)
+	}
+}
+
+func TestFailedTransferVoidsReadLease(t *testing.T) {
+	srv := newReadModeTestLeader(t, readModeLease)
+	srv.mu.Lock()
+	srv.peerClients[1] = &mockRaftPeerClient{
+		timeoutNowFn: func(context.Context, *kvpb.TimeoutNowRequest, ...grpc.CallOption) (*kvpb.TimeoutNowReply, error) {
+			return nil, status.Error(codes.Unavailable, "connection reset")
+		},
+	}
+	srv.mu.Unlock()
+
+	admin := &adminServer{kv: srv}
+	if _, err := admin.TransferLeadership(context.Background(), &kvpb.TransferLeadershipRequest{TargetReplicaId: 1}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("TransferLeadership = %v, want Unavailable", err)
+	}
+	srv.mu.Lock()
+	if now := time.Now(); now.Before(srv.leaseExpiryLocked(now)) {
+		srv.mu.Unlock()
+		t.Fatalf("lease still held after a failed transfer")
+	}
+	srv.mu.Unlock()
+
+	// The next read confirms leadership with a round, which renews the lease.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := srv.Get(ctx, &kvpb.GetRequest{Key: "k"})
+		cancel()
+		if err != nil || resp.Value != "v" {
+			t.Fatalf("Get = %v, %v; want v", resp, err)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.readIndexReads != 1 || srv.leaseReads != 1 {
+		t.Fatalf("readindex=%d lease=%d, want 1 each", srv.readIndexReads, srv.leaseReads)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Soft delete: with --soft_delete_retention set, the leader stamps each
+// Delete with an undelete deadline. Every replica then keeps the deleted
+// value in the tombstone, so an Undelete logged before the deadline
+// restores the same value everywhere, whichever replica is leader by then.
+
+// stampSoftDeleteLocked fills in the leader-derived parts of a delete or
+// undelete before it is logged: a delete's undelete deadline, and the
+// value an undelete will restore, so the log records it for CDC and
+// mirrors. It leaves other commands, and mirrored deletes, alone.
+func (s *kvServer) stampSoftDeleteLocked(wal *kvpb.WALCommand) {
+	switch wal.Op {
+	case kvpb.WALCommand_OP_DELETE:
+		if s.softDeleteRetention > 0 && wal.MirrorSeq == 0 {
+			wal.UndeleteUntil = wal.UnixNanos + s.softDeleteRetention.Nanoseconds()
+		}
+	case kvpb.WALCommand_OP_UNDELETE:
+		if tomb, ok := s.undeletableLocked(wal.Key, wal.UnixNanos); ok {
+			wal.Value = tomb.value
+		}
+	}
+}
+
+// undeletable reports whether it is a tombstone that kept a value which
+// may still be restored at unix nanos at.
+func (it item) undeletable(at int64) bool {
+	return it.tombstone && it.undeleteUntil != 0 && at <= it.undeleteUntil
+}
+
+// undeletableLocked returns key's tombstone if it is undeletable at at.
+func (s *kvServer) undeletableLocked(key string, at int64) (item, bool) {
+	it, ok := s.tree.Get(item{key: key})
+	if !ok || !it.undeletable(at) {
+		return item{}, false
+	}
+	return it, true
+}
+
+func (s *kvServer) Undelete(ctx context.Context, req *kvpb.UndeleteRequest) (*kvpb.UndeleteReply, error) {
+	if s.softDeleteRetention <= 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "soft delete is off; start the server with --soft_delete_retention to keep deleted values")
+	}
+	reqID, _, err := parseMutationRequestID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.submitCommand(ctx, &kvpb.ClientCommand{
+		RequestId: reqID,
+		Wal:       &kvpb.WALCommand{Op: kvpb.WALCommand_OP_UNDELETE, Key: req.Key},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.UndeleteReply{Found: cached.found, Seq: cached.seq, Value: cached.value}, nil
+}
+
+const (
+	defaultScanDeletedLimit = 1000
+	maxScanDeletedLimit     = 10000
+)
+
+// ScanDeleted lists the soft-deleted keys in a range that Undelete can
+// still restore, so an operator can audit deletions before restoring some.
+func (a *adminServer) ScanDeleted(ctx context.Context, req *kvpb.ScanDeletedRequest) (*kvpb.ScanDeletedReply, error) {
+	s := a.kv
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultScanDeletedLimit
+	}
+	limit = min(limit, maxScanDeletedLimit)
+
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLeaderReadLocked(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	reply := &kvpb.ScanDeletedReply{Keys: make([]*kvpb.DeletedKey, 0)}
+	s.tree.AscendGreaterOrEqual(item{key: req.StartKey}, func(it item) bool {
+		key := it.fullKey()
+		if key > req.EndKey {
+			return false
+		}
+		if !it.undeletable(now) {
+			return true
+		}
+		if len(reply.Keys) == limit {
+			reply.Truncated = true
+			return false
+		}
+		reply.Keys = append(reply.Keys, &kvpb.DeletedKey{
+			Key:                    key,
+			DeletedUnixNanos:       it.deletedAt,
+			DeletedSeq:             it.deletedSeq,
+			UndeleteUntilUnixNanos: it.undeleteUntil,
+			ValueBytes:             uint32(len(it.value)),
+		})
+		return true
+	})
+	return reply, nil
+}
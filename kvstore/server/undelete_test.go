@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestUndeleteRestoresWithinRetention(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	if _, err := srv.Undelete(call("off"), &kvpb.UndeleteRequest{Key: "k"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Undelete with soft delete off: err = %v, want FailedPrecondition", err)
+	}
+
+	srv.softDeleteRetention = time.Hour
+	for _, key := range []string{"k", "rewritten"} {
+		if _, err := srv.Put(call("put-"+key), &kvpb.PutRequest{Key: key, Value: "v-" + key}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+		if _, err := srv.Delete(call("del-"+key), &kvpb.DeleteRequest{Key: key}); err != nil {
+			t.Fatalf("Delete(%s) failed: %v", key, err)
+		}
+	}
+	if _, err := srv.Put(call("put-again"), &kvpb.PutRequest{Key: "rewritten", Value: "new"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, err := srv.Undelete(call("undel-k"), &kvpb.UndeleteRequest{Key: "k"})
+	if err != nil || !got.Found || got.Value != "v-k" {
+		t.Fatalf("Undelete(k) = %v, %v; want the deleted value", got, err)
+	}
+	if again, err := srv.Undelete(call("undel-k"), &kvpb.UndeleteRequest{Key: "k"}); err != nil || again.Seq != got.Seq || again.Value != "v-k" {
+		t.Fatalf("retried Undelete(k) = %v, %v; want the first reply %v", again, err, got)
+	}
+	if read, _ := srv.Get(context.Background(), &kvpb.GetRequest{Key: "k"}); !read.Found || read.Value != "v-k" {
+		t.Fatalf("Get(k) after undelete = %v", read)
+	}
+	if got, err := srv.Undelete(call("undel-rewritten"), &kvpb.UndeleteRequest{Key: "rewritten"}); err != nil || got.Found {
+		t.Fatalf("Undelete of a key written since its delete = %v, %v; want not found", got, err)
+	}
+
+	// Past the deadline the value stays deleted, and tombstone GC waits a
+	// full retention window beyond the deadline before purging it.
+	if _, err := srv.Delete(call("del-k2"), &kvpb.DeleteRequest{Key: "k"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	srv.mu.Lock()
+	tomb, _ := srv.tree.Get(item{key: "k"})
+	srv.tombstoneRetention = time.Minute
+	srv.replicatedIndex = srv.commitIndex
+	purged := srv.collectTombstonesLocked(time.Unix(0, tomb.undeleteUntil))
+	_, restorable := srv.undeletableLocked("k", tomb.undeleteUntil+1)
+	srv.mu.Unlock()
+	if purged != 0 || restorable {
+		t.Fatalf("at the undelete deadline: purged=%d restorable after it=%v, want 0 and false", purged, restorable)
+	}
+}
+
+func TestScanDeletedListsRestorableKeys(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	put := func(key string) {
+		if _, err := srv.Put(call("put-"+key), &kvpb.PutRequest{Key: key, Value: "value"}); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	del := func(key string) {
+		if _, err := srv.Delete(call("del-"+key), &kvpb.DeleteRequest{Key: key}); err != nil {
+			t.Fatalf("Delete(%s) failed: %v", key, err)
+		}
+	}
+	put("hard")
+	del("hard")
+	srv.softDeleteRetention = time.Hour
+	for _, key := range []string{"a", "b", "c", "live", "z"} {
+		put(key)
+	}
+	for _, key := range []string{"a", "b", "c", "z"} {
+		del(key)
+	}
+
+	admin := &adminServer{kv: srv}
+	got, err := admin.ScanDeleted(context.Background(), &kvpb.ScanDeletedRequest{StartKey: "a", EndKey: "y", Limit: 2})
+	if err != nil {
+		t.Fatalf("ScanDeleted failed: %v", err)
+	}
+	if len(got.Keys) != 2 || got.Keys[0].Key != "a" || got.Keys[1].Key != "b" || !got.Truncated {
+		t.Fatalf("ScanDeleted(a..y, limit 2) = %v", got)
+	}
+	if k := got.Keys[0]; k.ValueBytes != 5 || k.UndeleteUntilUnixNanos <= k.DeletedUnixNanos || k.DeletedSeq == 0 {
+		t.Fatalf("deleted key a = %v", k)
+	}
+	// Hard-deleted and live keys are never listed.
+	got, err = admin.ScanDeleted(context.Background(), &kvpb.ScanDeletedRequest{StartKey: "c", EndKey: "y"})
+	if err != nil || len(got.Keys) != 1 || got.Keys[0].Key != "c" || got.Truncated {
+		t.Fatalf("ScanDeleted(c..y) = %v, %v; want just c", got, err)
+	}
+}
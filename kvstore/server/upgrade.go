@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// upgradeFDsEnv tells a server started by a binary upgrade which listeners
+// it inherited, as names in descriptor order from 3 (for example "api:p2p").
+const upgradeFDsEnv = "KVSTORE_UPGRADE_FDS"
+
+// upgradeDrainTimeout bounds how long in-flight RPCs may run once an upgrade
+// starts; any still running after it are cancelled.
+const upgradeDrainTimeout = 10 * time.Second
+
+// upgrader hands the listening sockets to a new copy of the server binary.
+// On SIGUSR2 it keeps duplicates of the sockets, drains both gRPC servers,
+// and, once main has closed the database, starts the binary now on disk
+// with the sockets and the same arguments. Connections that arrive in
+// between wait in the listen backlog instead of being refused, and the
+// child opens the database only after this process is done with it.
+type upgrader struct {
+	mu    sync.Mutex
+	files []*os.File
+	names []string
+}
+
+// watch starts an upgrade when the process receives SIGUSR2.
+func (u *upgrader) watch(listeners map[string]net.Listener, servers ...*grpc.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		if err := u.prepare(listeners); err != nil {
+			log.Printf("upgrade aborted: %v", err)
+			return
+		}
+		log.Printf("upgrade requested; draining in-flight RPCs")
+		for _, srv := range servers {
+			done := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(upgradeDrainTimeout):
+				srv.Stop()
+			}
+		}
+	}()
+}
+
+// prepare duplicates each listener's descriptor so the sockets stay open
+// after the gRPC servers close the listeners.
+func (u *upgrader) prepare(listeners map[string]net.Listener) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, name := range []string{"api", "p2p", "admin"} {
+		lis, ok := listeners[name]
+		if !ok && name == "admin" {
+			continue
+		}
+		tl, ok := lis.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("%s listener is not a TCP listener", name)
+		}
+		f, err := tl.File()
+		if err != nil {
+			for _, f := range u.files {
+				f.Close()
+			}
+			u.files, u.names = nil, nil
+			return fmt.Errorf("duplicate %s listener: %w", name, err)
+		}
+		u.files = append(u.files, f)
+		u.names = append(u.names, name)
+	}
+	return nil
+}
+
+// handoff starts the new server if an upgrade was requested. main defers it
+// first so it runs after every other cleanup, including closing the
+// database and unlocking the data directory.
+func (u *upgrader) handoff() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.files) == 0 {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("upgrade failed: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeFDsEnv+"="+strings.Join(u.names, ":"))
+	cmd.ExtraFiles = u.files
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("upgrade failed: %v", err)
+	}
+	// Under systemd the child becomes the main process; the unit needs
+	// NotifyAccess=all so its READY=1 is accepted.
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+	log.Printf("upgrade handed listeners to pid %d", cmd.Process.Pid)
+}
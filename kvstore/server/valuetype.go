@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Typed values: a key written as VALUE_TYPE_INT64, by a typed Put or Swap
+// or by an int-add merge, holds a canonical decimal int64 until it is
+// deleted. The type is part of the replicated state, so every replica
+// refuses the same writes; the leader also refuses them before they are
+// logged, leaving only writes that raced with a typed one to be refused as
+// they apply. Ingest, like a delete, replaces keys wholesale and stores
+// strings.
+
+// canonicalInt reports whether value is an int64 in the form
+// strconv.FormatInt writes it.
+func canonicalInt(value string) bool {
+	n, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == value
+}
+
+// writeTypeLocked returns the type key takes when value is written to it
+// with type requested: an integer key stays one, whatever was requested.
+func (s *kvServer) writeTypeLocked(key, value string, requested kvpb.ValueType) (kvpb.ValueType, error) {
+	vt := requested
+	if prev, ok := s.getLiveLocked(key); ok && prev.vtype == kvpb.ValueType_VALUE_TYPE_INT64 {
+		vt = prev.vtype
+	}
+	if vt == kvpb.ValueType_VALUE_TYPE_INT64 && !canonicalInt(value) {
+		return vt, fmt.Errorf("key %q holds an integer and %q is not one; delete it to store a string", s.redact.key(key), s.redact.value(value))
+	}
+	return vt, nil
+}
+
+// checkValueTypeLocked refuses a put or swap its key's type would refuse
+// when it applies.
+func (s *kvServer) checkValueTypeLocked(wal *kvpb.WALCommand) error {
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_SWAP:
+	default:
+		return nil
+	}
+	if wal.ValueType == kvpb.ValueType_VALUE_TYPE_INT64 && !canonicalInt(wal.Value) {
+		return invalidFieldError("value", "%q is not a decimal int64", s.redact.value(wal.Value))
+	}
+	if _, err := s.writeTypeLocked(wal.Key, wal.Value, wal.ValueType); err != nil {
+		return reasonError(codes.FailedPrecondition, reasonTypeMismatch, map[string]string{"key": s.redact.key(wal.Key)}, "%v", err)
+	}
+	return nil
+}
+
+// typeError is the error for a write refused as it applied.
+func (m cachedMutation) typeError(redact redaction) error {
+	if !m.typeMismatch {
+		return nil
+	}
+	return reasonError(codes.FailedPrecondition, reasonTypeMismatch, map[string]string{"key": redact.key(m.key)},
+		"key %q became an integer before this write applied; %q is not one", redact.key(m.key), redact.value(m.value))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestIntegerKeysRefuseNonIntegerWrites(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	const intType = kvpb.ValueType_VALUE_TYPE_INT64
+
+	if _, err := srv.Put(call("bad"), &kvpb.PutRequest{Key: "n", Value: "012", ValueType: intType}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("typed Put of a non-canonical integer: err = %v, want InvalidArgument", err)
+	}
+	if _, err := srv.Put(call("typed"), &kvpb.PutRequest{Key: "n", Value: "41", ValueType: intType}); err != nil {
+		t.Fatalf("typed Put failed: %v", err)
+	}
+	if got, _ := srv.Get(context.Background(), &kvpb.GetRequest{Key: "n"}); got.ValueType != intType {
+		t.Fatalf("Get(n) type = %v, want %v", got.ValueType, intType)
+	}
+	// An untyped write of an integer keeps the type; anything else is refused.
+	if _, err := srv.Put(call("untyped-int"), &kvpb.PutRequest{Key: "n", Value: "42"}); err != nil {
+		t.Fatalf("untyped Put of an integer failed: %v", err)
+	}
+	if _, err := srv.Swap(call("string"), &kvpb.SwapRequest{Key: "n", Value: "forty-two"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Swap of a string into an integer key: err = %v, want FailedPrecondition", err)
+	}
+	if _, err := srv.Merge(call("append"), &kvpb.MergeRequest{Key: "n", Operand: "0", Operator: "append"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("append merge into an integer key: err = %v, want FailedPrecondition", err)
+	}
+	got, err := srv.Merge(call("add"), &kvpb.MergeRequest{Key: "n", Operand: "-2", Operator: "int-add"})
+	if err != nil || got.Value != "40" {
+		t.Fatalf("int-add merge = %v, %v; want 40", got, err)
+	}
+
+	// A write that only finds the integer once it applies is refused
+	// there, on every replica, and its retries get the same error.
+	srv.mu.Lock()
+	srv.dedup["raced"] = srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "n", Value: "x"}, srv.commitIndex+1)
+	kept, _ := srv.getLiveLocked("n")
+	srv.mu.Unlock()
+	if kept.value != "40" || kept.vtype != intType {
+		t.Fatalf("after a raced string put, n = %q (%v), want 40 and an integer", kept.value, kept.vtype)
+	}
+	if _, err := srv.Put(call("raced"), &kvpb.PutRequest{Key: "n", Value: "x"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("retry of a put refused as it applied: err = %v, want FailedPrecondition", err)
+	}
+
+	// Deleting the key drops its type.
+	if _, err := srv.Delete(call("del"), &kvpb.DeleteRequest{Key: "n"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := srv.Put(call("string-again"), &kvpb.PutRequest{Key: "n", Value: "forty"}); err != nil {
+		t.Fatalf("string Put after delete failed: %v", err)
+	}
+}
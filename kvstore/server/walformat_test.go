@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/crc32"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+	"madkv/kvstore/walformat"
+)
+
+// downgradeToJSON rewrites the log in backerDir the way servers wrote it
+// before the format header: JSON frames, no crc column.
+func downgradeToJSON(t *testing.T, backerDir string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(backerDir, dbFileName))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	rows, err := db.Query(`SELECT log_index, payload FROM raft_log`)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	frames := make(map[uint64][]byte)
+	for rows.Next() {
+		var idx uint64
+		var payload []byte
+		if err := rows.Scan(&idx, &payload); err != nil {
+			t.Fatalf("scan log: %v", err)
+		}
+		var cmd kvpb.ClientCommand
+		if err := proto.Unmarshal(payload, &cmd); err != nil {
+			t.Fatalf("decode entry %d: %v", idx, err)
+		}
+		if frames[idx], err = protojson.Marshal(&cmd); err != nil {
+			t.Fatalf("encode entry %d: %v", idx, err)
+		}
+	}
+	rows.Close()
+	for idx, frame := range frames {
+		if _, err := db.Exec(`UPDATE raft_log SET payload = ? WHERE log_index = ?`, frame, idx); err != nil {
+			t.Fatalf("rewrite entry %d: %v", idx, err)
+		}
+	}
+	for _, stmt := range []string{`ALTER TABLE raft_log DROP COLUMN crc`, `DELETE FROM raft_meta WHERE key = 'wal_format'`} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+func TestOldLogFormatIsMigratedAndChecksummed(t *testing.T) {
+	backerDir := t.TempDir()
+	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, "put-k"))
+	if _, err := srv.Put(ctx, &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+	downgradeToJSON(t, backerDir)
+
+	if _, err := newKVServer(backerDir, 0, 0, 1, 1, "127.0.0.1:0", nil, ""); err == nil || !strings.Contains(err.Error(), "kvmigrate") {
+		t.Fatalf("opening a JSON-format log: err = %v, want one pointing at kvmigrate", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(backerDir, dbFileName))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if from, err := walformat.Migrate(db, nil); err != nil || from != walformat.JSON {
+		t.Fatalf("Migrate() = %d, %v; want format %d", from, err, walformat.JSON)
+	}
+
+	reloaded := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, reloaded, 2)
+	got, err := reloaded.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	if err != nil || !got.Found || got.Value != "v" {
+		t.Fatalf("Get(k) after migration = %v, %v; want v", got, err)
+	}
+	reloaded.db.Close()
+
+	if _, err := db.Exec(`UPDATE raft_log SET crc = crc + 1 WHERE log_index = (SELECT MAX(log_index) FROM raft_log)`); err != nil {
+		t.Fatalf("corrupt crc: %v", err)
+	}
+	if _, err := newKVServer(backerDir, 0, 0, 1, 1, "127.0.0.1:0", nil, ""); !errors.Is(err, walformat.ErrChecksum) {
+		t.Fatalf("opening a log with a bad crc: err = %v, want %v", err, walformat.ErrChecksum)
+	}
+}
+
+func TestCRC32IEEELogIsMigratedToCastagnoli(t *testing.T) {
+	backerDir := t.TempDir()
+	srv := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	if _, err := srv.Put(withRequestID("put-k"), &kvpb.PutRequest{Key: "k", Value: "v"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := srv.db.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(backerDir, dbFileName))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	// Rewrite the log as format 3 servers did, with one entry damaged.
+	rows, err := db.Query(`SELECT log_index, payload FROM raft_log ORDER BY log_index`)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	ieee := make(map[uint64]uint32)
+	var last uint64
+	for rows.Next() {
+		var idx uint64
+		var payload []byte
+		if err := rows.Scan(&idx, &payload); err != nil {
+			t.Fatalf("scan log: %v", err)
+		}
+		ieee[idx], last = crc32.ChecksumIEEE(payload), idx
+	}
+	rows.Close()
+	setCRCs := func(damaged uint64) {
+		t.Helper()
+		for idx, crc := range ieee {
+			if idx == damaged {
+				crc++
+			}
+			if _, err := db.Exec(`UPDATE raft_log SET crc = ? WHERE log_index = ?`, crc, idx); err != nil {
+				t.Fatalf("rewrite crc %d: %v", idx, err)
+			}
+		}
+	}
+	setCRCs(last)
+	if _, err := db.Exec(`UPDATE raft_meta SET value = '3' WHERE key = 'wal_format'`); err != nil {
+		t.Fatalf("set format: %v", err)
+	}
+
+	if _, err := newKVServer(backerDir, 0, 0, 1, 1, "127.0.0.1:0", nil, ""); err == nil || !strings.Contains(err.Error(), "kvmigrate") {
+		t.Fatalf("opening a format 3 log: err = %v, want one pointing at kvmigrate", err)
+	}
+	if _, err := walformat.Migrate(db, nil); !errors.Is(err, walformat.ErrChecksum) {
+		t.Fatalf("Migrate() of a damaged format 3 log: err = %v, want %v", err, walformat.ErrChecksum)
+	}
+	setCRCs(0)
+	if from, err := walformat.Migrate(db, nil); err != nil || from != walformat.Checksummed {
+		t.Fatalf("Migrate() = %d, %v; want format %d", from, err, walformat.Checksummed)
+	}
+	reloaded := newTestServer(t, backerDir, 0, 0, 1, 1)
+	becomeTestLeader(t, reloaded, 2)
+	got, err := reloaded.Get(context.Background(), &kvpb.GetRequest{Key: "k"})
+	if err != nil || !got.Found || got.Value != "v" {
+		t.Fatalf("Get(k) after migration = %v, %v; want v", got, err)
+	}
+}
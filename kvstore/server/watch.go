@@ -0,0 +1,383 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// defaultWatchBuffer is the number of undelivered events a watcher may hold
+// before it counts as lagging.
+const defaultWatchBuffer = 1024
+
+// watchReplayChunk is the number of log entries a replaying watch reads per
+// hold of the server lock.
+const watchReplayChunk = 256
+
+// watchHub fans applied changes out to Watch streams. The apply path only
+// ever appends to bounded per-watcher buffers, so a watcher that stops
+// reading costs memory up to its buffer and never delays the state machine.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	// active mirrors len(watchers) so publish can skip the lock when nobody
+	// is watching.
+	active atomic.Int64
+	buffer int
+
+	sent, replayed, dropped, coalesced, disconnects atomic.Uint64
+}
+
+func newWatchHub(buffer int) *watchHub {
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+	return &watchHub{watchers: make(map[*watcher]struct{}), buffer: buffer}
+}
+
+// watcher is one Watch stream's buffer. Coalesced-away events leave nil
+// slots in queue so the events that remain stay in log order.
+type watcher struct {
+	prefix string
+	// from is the first seq the watcher wants; live events before it,
+	// which a replica behind the watcher's start_seq still applies, are
+	// skipped.
+	from      uint64
+	coalesce  bool
+	dropOnLag bool
+	limit     int
+	mu        sync.Mutex
+	queue     []*kvpb.WatchEvent
+	pending   int
+	byKey     map[string]int
+	dropped   uint64
+	err       error
+	notify    chan struct{}
+}
+
+// subscribe registers a watcher for the live changes from seq from on.
+func (h *watchHub) subscribe(req *kvpb.WatchRequest, from uint64) *watcher {
+	w := &watcher{
+		prefix:    req.Prefix,
+		from:      from,
+		coalesce:  req.Coalesce,
+		dropOnLag: req.DropOnLag,
+		limit:     h.buffer,
+		notify:    make(chan struct{}, 1),
+	}
+	if w.coalesce {
+		w.byKey = make(map[string]int)
+	}
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.active.Store(int64(len(h.watchers)))
+	h.mu.Unlock()
+	return w
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.active.Store(int64(len(h.watchers)))
+	h.mu.Unlock()
+}
+
+// closeAll ends every watch with err.
+func (h *watchHub) closeAll(err error) {
+	if h.active.Load() == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.fail(err)
+	}
+}
+
+// publish hands the changes applied by one log entry to every watcher.
+func (h *watchHub) publish(events []*kvpb.WatchEvent) {
+	if len(events) == 0 || h.active.Load() == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		for _, ev := range events {
+			if ev.Seq >= w.from && strings.HasPrefix(ev.Key, w.prefix) {
+				w.offer(h, ev)
+			}
+		}
+	}
+}
+
+// offer queues ev for w, coalescing or applying w's lag policy as needed.
+func (w *watcher) offer(h *watchHub, ev *kvpb.WatchEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	var carried uint64
+	if w.coalesce {
+		if i, ok := w.byKey[ev.Key]; ok {
+			carried = w.queue[i].Dropped
+			w.queue[i] = nil
+			w.pending--
+			h.coalesced.Add(1)
+		}
+	}
+	if w.pending >= w.limit {
+		if !w.dropOnLag {
+			h.disconnects.Add(1)
+			w.failLocked(reasonError(codes.ResourceExhausted, reasonWatchLagged, map[string]string{"seq": strconv.FormatUint(ev.Seq, 10)},
+				"watcher fell %d events behind at seq %d; watch again, with coalesce or drop_on_lag if it cannot keep up", w.pending, ev.Seq))
+			return
+		}
+		w.dropped++
+		h.dropped.Add(1)
+		return
+	}
+	if dropped := w.dropped + carried; dropped > 0 {
+		// Events are shared between watchers, so mark a copy.
+		ev = proto.Clone(ev).(*kvpb.WatchEvent)
+		ev.Dropped, w.dropped = dropped, 0
+	}
+	if w.coalesce {
+		if len(w.queue) >= 2*w.limit {
+			w.compactLocked()
+		}
+		w.byKey[ev.Key] = len(w.queue)
+	}
+	w.queue = append(w.queue, ev)
+	w.pending++
+	w.signal()
+}
+
+// compactLocked drops the nil slots coalescing left behind, so a watcher
+// that keeps seeing the same keys does not grow its queue without bound.
+func (w *watcher) compactLocked() {
+	live := w.queue[:0]
+	for _, ev := range w.queue {
+		if ev != nil {
+			w.byKey[ev.Key] = len(live)
+			live = append(live, ev)
+		}
+	}
+	clear(w.queue[len(live):])
+	w.queue = live
+}
+
+func (w *watcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failLocked(err)
+}
+
+func (w *watcher) failLocked(err error) {
+	if w.err == nil {
+		w.err = err
+		w.queue, w.byKey = nil, nil
+		w.signal()
+	}
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued events in order, or the error that ended the
+// watch.
+func (w *watcher) take() ([]*kvpb.WatchEvent, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return nil, w.err
+	}
+	out := make([]*kvpb.WatchEvent, 0, w.pending)
+	for _, ev := range w.queue {
+		if ev != nil {
+			out = append(out, ev)
+		}
+	}
+	w.queue, w.pending = w.queue[:0], 0
+	if w.coalesce {
+		clear(w.byKey)
+	}
+	return out, nil
+}
+
+// Watch streams applied changes under req.Prefix until the client goes away
+// or falls too far behind.
+func (s *kvServer) Watch(req *kvpb.WatchRequest, stream kvpb.KVS_WatchServer) error {
+	var w *watcher
+	if req.StartSeq == 0 {
+		w = s.watchers.subscribe(req, 0)
+	} else {
+		var err error
+		if w, err = s.replayWatch(req, stream); err != nil {
+			return err
+		}
+	}
+	defer s.watchers.unsubscribe(w)
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.notify:
+		}
+		events, err := w.take()
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+		s.watchers.sent.Add(uint64(len(events)))
+	}
+}
+
+// replayWatch sends the changes from req.StartSeq up to the last applied
+// entry out of the log, then subscribes to live changes in the same hold of
+// the lock that saw the end of the log, so none fall between the two.
+// Replay reads a chunk at a time so a long catch-up does not stall writes,
+// and the watcher's buffer only starts filling once it has caught up.
+func (s *kvServer) replayWatch(req *kvpb.WatchRequest, stream kvpb.KVS_WatchServer) (*watcher, error) {
+	next := req.StartSeq
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		if next <= s.logBase {
+			logBase := s.logBase
+			s.mu.Unlock()
+			return nil, reasonError(codes.OutOfRange, reasonWatchStartCompacted, map[string]string{"compacted_through": strconv.FormatUint(logBase, 10)},
+				"start_seq %d is too old: the log is compacted through %d; resnapshot with a live watch and a scan", req.StartSeq, logBase)
+		}
+		if next > s.lastApplied {
+			w := s.watchers.subscribe(req, next)
+			s.mu.Unlock()
+			return w, nil
+		}
+		var events []*kvpb.WatchEvent
+		end := min(s.lastApplied, next+watchReplayChunk-1)
+		for ; next <= end; next++ {
+			entry := s.entryLocked(next)
+			for _, ev := range replayedWatchEvents(entry.Index, entry.Command.GetWal()) {
+				if strings.HasPrefix(ev.Key, req.Prefix) {
+					events = append(events, ev)
+				}
+			}
+		}
+		s.mu.Unlock()
+		for _, ev := range events {
+			if err := stream.Send(ev); err != nil {
+				return nil, err
+			}
+		}
+		s.watchers.sent.Add(uint64(len(events)))
+		s.watchers.replayed.Add(uint64(len(events)))
+	}
+}
+
+// replayedWatchEvents describes wal for a replaying watcher. The outcome of
+// applying it is gone, so removals are reported as if they found their key.
+func replayedWatchEvents(seq uint64, wal *kvpb.WALCommand) []*kvpb.WatchEvent {
+	return watchEvents(seq, wal, cachedMutation{found: true})
+}
+
+// watchEvents describes what applying wal at seq changed, given the
+// result of applying it. Commands that changed nothing yield no events.
+func watchEvents(seq uint64, wal *kvpb.WALCommand, res cachedMutation) []*kvpb.WatchEvent {
+	if wal == nil {
+		return nil
+	}
+	ev := &kvpb.WatchEvent{Seq: seq, Op: strings.TrimPrefix(wal.Op.String(), "OP_"), Key: wal.Key, UnixNanos: wal.UnixNanos}
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_SWAP:
+		ev.Value = wal.Value
+	case kvpb.WALCommand_OP_UNDELETE:
+		if !res.found {
+			return nil
+		}
+		ev.Value = wal.Value
+	case kvpb.WALCommand_OP_DELETE, kvpb.WALCommand_OP_EXPIRE, kvpb.WALCommand_OP_PERSIST:
+		if !res.found {
+			return nil
+		}
+	case kvpb.WALCommand_OP_DELETE_AT:
+		if !res.found {
+			return nil
+		}
+		ev.DeleteAt = wal.DeleteAt
+		if wal.TtlNanos > 0 {
+			ev.DeleteAt = wal.UnixNanos + wal.TtlNanos
+		}
+	case kvpb.WALCommand_OP_MERGE:
+		// The event carries the operand; the merged value is only known
+		// to the replica that applied it, not to a replaying watcher.
+		if !res.found {
+			return nil
+		}
+		ev.Value = wal.Value
+	case kvpb.WALCommand_OP_GET_OR_PUT:
+		if res.found {
+			return nil
+		}
+		ev.Op, ev.Value = "PUT", wal.Value
+	case kvpb.WALCommand_OP_RENAME:
+		if !renamed(res) {
+			return nil
+		}
+		return []*kvpb.WatchEvent{
+			{Seq: seq, Op: "DELETE", Key: wal.Key, UnixNanos: wal.UnixNanos},
+			{Seq: seq, Op: "PUT", Key: wal.NewKey, Value: wal.Value, UnixNanos: wal.UnixNanos},
+		}
+	case kvpb.WALCommand_OP_BATCH:
+		var events []*kvpb.WatchEvent
+		for i, sub := range wal.Batch {
+			if sub.Op == kvpb.WALCommand_OP_GET {
+				continue
+			}
+			// A replaying watcher has no results, so it sees every write.
+			subRes := cachedMutation{found: true}
+			if i < len(res.batch) {
+				subRes = res.batch[i]
+			}
+			events = append(events, watchEvents(seq, sub, subRes)...)
+		}
+		return events
+	case kvpb.WALCommand_OP_INGEST:
+		events := make([]*kvpb.WatchEvent, len(wal.Ingest))
+		for i, p := range wal.Ingest {
+			events[i] = &kvpb.WatchEvent{Seq: seq, Op: "PUT", Key: p.Key, Value: p.Value, UnixNanos: wal.UnixNanos}
+		}
+		return events
+	default:
+		// FILL and EVICT only move a value between memory and the
+		// backing store, and the rest do not touch keys.
+		return nil
+	}
+	return []*kvpb.WatchEvent{ev}
+}
+
+func (s *kvServer) registerWatchMetrics(r *metricsRegistry) {
+	h := s.watchers
+	r.gauge("kv_watchers", "Open Watch streams on this replica.", func() float64 { return float64(h.active.Load()) })
+	r.counter("kv_watch_events_sent_total", "Events delivered to Watch streams.", func() float64 { return float64(h.sent.Load()) })
+	r.counter("kv_watch_events_replayed_total", "Events sent from the log to watchers that asked for a start_seq.", func() float64 { return float64(h.replayed.Load()) })
+	r.counter("kv_watch_events_coalesced_total", "Pending watch events replaced by a newer change to the same key.", func() float64 { return float64(h.coalesced.Load()) })
+	r.counter("kv_watch_events_dropped_total", "Events dropped for watchers with drop_on_lag whose buffer was full.", func() float64 { return float64(h.dropped.Load()) })
+	r.counter("kv_watch_disconnects_total", "Watchers disconnected for falling behind.", func() float64 { return float64(h.disconnects.Load()) })
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func putEvent(seq uint64, key, value string) []*kvpb.WatchEvent {
+	return watchEvents(seq, &kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: key, Value: value}, cachedMutation{})
+}
+
+func TestWatchLaggardPolicies(t *testing.T) {
+	h := newWatchHub(2)
+	strict := h.subscribe(&kvpb.WatchRequest{}, 0)
+	lossy := h.subscribe(&kvpb.WatchRequest{DropOnLag: true}, 0)
+	for seq, key := range []string{"a", "b", "a", "c"} {
+		h.publish(putEvent(uint64(seq+1), key, "v"))
+	}
+
+	if _, err := strict.take(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("strict watcher take = %v, want ResourceExhausted", err)
+	}
+	got, err := lossy.take()
+	if err != nil || len(got) != 2 || got[0].Seq != 1 || got[1].Seq != 2 {
+		t.Fatalf("lossy watcher take = %v, %v; want seqs 1 and 2", got, err)
+	}
+	h.publish(putEvent(5, "d", "v"))
+	if got, _ := lossy.take(); len(got) != 1 || got[0].Seq != 5 || got[0].Dropped != 2 {
+		t.Fatalf("lossy watcher take after drops = %v, want seq 5 with 2 dropped", got)
+	}
+	if h.disconnects.Load() != 1 || h.dropped.Load() != 2 {
+		t.Fatalf("disconnects=%d dropped=%d, want 1/2", h.disconnects.Load(), h.dropped.Load())
+	}
+}
+
+func TestWatchCoalescingKeepsLogOrder(t *testing.T) {
+	h := newWatchHub(2)
+	w := h.subscribe(&kvpb.WatchRequest{Coalesce: true}, 0)
+	// Without coalescing the third event would overflow the buffer.
+	for seq, key := range []string{"a", "b", "a"} {
+		h.publish(putEvent(uint64(seq+1), key, "v"))
+	}
+	got, err := w.take()
+	if err != nil || len(got) != 2 || got[0].Key != "b" || got[1].Key != "a" || got[1].Seq != 3 {
+		t.Fatalf("take = %v, %v; want b then a@3", got, err)
+	}
+	// Repeated updates to one key must not grow the queue.
+	for seq := 4; seq < 100; seq++ {
+		h.publish(putEvent(uint64(seq), "hot", "v"))
+	}
+	w.mu.Lock()
+	queued := len(w.queue)
+	w.mu.Unlock()
+	if queued > 2*h.buffer+1 {
+		t.Fatalf("queue holds %d slots for one pending event", queued)
+	}
+	if got, _ := w.take(); len(got) != 1 || got[0].Seq != 99 {
+		t.Fatalf("take = %v, want hot@99", got)
+	}
+}
+
+func TestWatchSeesAppliedChangesOnly(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	w := srv.watchers.subscribe(&kvpb.WatchRequest{Prefix: "user/"}, 0)
+	defer srv.watchers.unsubscribe(w)
+	ctx := context.Background()
+	put, err := srv.Put(ctx, &kvpb.PutRequest{Key: "user/1", Value: "ann"})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for _, key := range []string{"other", "user/missing"} {
+		if _, err := srv.Delete(ctx, &kvpb.DeleteRequest{Key: key}); err != nil {
+			t.Fatalf("Delete(%q) failed: %v", key, err)
+		}
+	}
+	got, err := w.take()
+	if err != nil || len(got) != 1 || got[0].Key != "user/1" || got[0].Op != "PUT" || got[0].Seq != put.Seq {
+		t.Fatalf("take = %v, %v; want one PUT of user/1 at seq %d", got, err, put.Seq)
+	}
+}
+
+// replayStream collects what a Watch sends.
+type replayStream struct {
+	kvpb.KVS_WatchServer
+	sent []*kvpb.WatchEvent
+}
+
+func (r *replayStream) Context() context.Context { return context.Background() }
+
+func (r *replayStream) Send(ev *kvpb.WatchEvent) error {
+	r.sent = append(r.sent, ev)
+	return nil
+}
+
+func TestWatchReplaysFromStartSeq(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	ctx := context.Background()
+	var seqs []uint64
+	for _, key := range []string{"a", "b", "c"} {
+		put, err := srv.Put(ctx, &kvpb.PutRequest{Key: key, Value: "v"})
+		if err != nil {
+			t.Fatalf("Put(%q) failed: %v", key, err)
+		}
+		seqs = append(seqs, put.Seq)
+	}
+
+	stream := &replayStream{}
+	w, err := srv.replayWatch(&kvpb.WatchRequest{StartSeq: seqs[1]}, stream)
+	if err != nil {
+		t.Fatalf("replayWatch failed: %v", err)
+	}
+	defer srv.watchers.unsubscribe(w)
+	if len(stream.sent) != 2 || stream.sent[0].Key != "b" || stream.sent[1].Key != "c" {
+		t.Fatalf("replayed %v, want b and c", stream.sent)
+	}
+	put, err := srv.Put(ctx, &kvpb.PutRequest{Key: "d", Value: "v"})
+	if err != nil {
+		t.Fatalf("Put(d) failed: %v", err)
+	}
+	if got, err := w.take(); err != nil || len(got) != 1 || got[0].Seq != put.Seq {
+		t.Fatalf("live take = %v, %v; want d at seq %d", got, err, put.Seq)
+	}
+
+	if err := srv.takeSnapshot(noThrottle); err != nil {
+		t.Fatalf("takeSnapshot() failed: %v", err)
+	}
+	if _, err := srv.replayWatch(&kvpb.WatchRequest{StartSeq: seqs[1]}, &replayStream{}); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("replay from compacted seq = %v, want OutOfRange", err)
+	}
+	w, err = srv.replayWatch(&kvpb.WatchRequest{StartSeq: put.Seq + 1}, &replayStream{})
+	if err != nil {
+		t.Fatalf("replay from the end of a compacted log = %v", err)
+	}
+	srv.watchers.unsubscribe(w)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const webhookSignatureHeader = "X-KVStore-Signature"
+
+// webhookRule sends changes to keys under prefix to url.
+type webhookRule struct {
+	prefix string
+	url    string
+}
+
+func (r webhookRule) feedName() string { return "webhook:" + r.prefix + "=" + r.url }
+
+// webhookFlag collects repeated --webhook prefix=url flags.
+type webhookFlag []webhookRule
+
+func (w *webhookFlag) String() string {
+	parts := make([]string, 0, len(*w))
+	for _, r := range *w {
+		parts = append(parts, r.prefix+"="+r.url)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (w *webhookFlag) Set(raw string) error {
+	prefix, target, ok := strings.Cut(raw, "=")
+	if !ok {
+		return fmt.Errorf("expected prefix=url, got %q", raw)
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", target)
+	}
+	*w = append(*w, webhookRule{prefix: prefix, url: target})
+	return nil
+}
+
+// webhookSink POSTs the events for one rule as {"events": [...]}. A batch
+// with no matching keys is skipped without a request. Any non-2xx answer
+// fails the batch, and the feed retries it with backoff.
+type webhookSink struct {
+	rule   webhookRule
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookSink(rule webhookRule, secret string) *webhookSink {
+	return &webhookSink{rule: rule, secret: []byte(secret), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *webhookSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	var matched []ChangeEvent
+	for _, ev := range events {
+		if strings.HasPrefix(ev.Key, w.rule.prefix) {
+			matched = append(matched, ev)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(map[string]any{"events": matched})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.rule.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", w.rule.url, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", w.rule.url, resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookSink) Close() error { return nil }
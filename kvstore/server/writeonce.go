@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+// Write-once keys: keys under a --write_once_prefixes prefix can be
+// created but never changed or deleted afterwards, for audit-style records
+// nobody should be able to rewrite. A Put, Swap, Delete, DeleteAt, Merge,
+// JSONSet, Rename or Ingest that would change an existing one fails with
+// FAILED_PRECONDITION. The leader refuses such writes before logging them,
+// and stamps the prefixes covering a logged command's keys into it, so
+// that every replica refuses it again as it applies if the key has come to
+// exist since: of two writers racing to create a key, only the first
+// succeeds. Replicas decide from the stamp, not their own flag, but a
+// replica that becomes leader stamps with its own, so every replica should
+// use the same prefixes.
+
+// parseWriteOncePrefixes parses --write_once_prefixes.
+func parseWriteOncePrefixes(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var prefixes []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			return nil, fmt.Errorf("empty prefix in %q", raw)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// writeOncePrefix returns the --write_once_prefixes prefix key is under,
+// if any.
+func (s *kvServer) writeOncePrefix(key string) (string, bool) {
+	p := writeOnceUnder(s.writeOnce, key)
+	return p, p != ""
+}
+
+// stampWriteOnceLocked records in wal, and in each operation of a batch,
+// the write-once prefixes its keys are under.
+func (s *kvServer) stampWriteOnceLocked(wal *kvpb.WALCommand) {
+	if len(s.writeOnce) == 0 {
+		return
+	}
+	keys := []string{wal.Key, wal.NewKey}
+	for _, p := range wal.Ingest {
+		keys = append(keys, p.Key)
+	}
+	for _, key := range keys {
+		if p, ok := s.writeOncePrefix(key); ok && key != "" && !slices.Contains(wal.WriteOncePrefixes, p) {
+			wal.WriteOncePrefixes = append(wal.WriteOncePrefixes, p)
+		}
+	}
+	for _, sub := range wal.Batch {
+		s.stampWriteOnceLocked(sub)
+	}
+}
+
+// writeOnceConflictLocked returns the existing key under one of wal's
+// write-once prefixes that it would change or delete, if there is one. A
+// batch's operations are checked one by one as they apply.
+func (s *kvServer) writeOnceConflictLocked(wal *kvpb.WALCommand) (string, bool) {
+	if len(wal.WriteOncePrefixes) == 0 {
+		return "", false
+	}
+	exists := func(key string) bool {
+		if writeOnceUnder(wal.WriteOncePrefixes, key) == "" {
+			return false
+		}
+		_, found := s.getLiveLocked(key)
+		return found
+	}
+	switch wal.Op {
+	case kvpb.WALCommand_OP_PUT, kvpb.WALCommand_OP_SWAP, kvpb.WALCommand_OP_DELETE,
+		kvpb.WALCommand_OP_DELETE_AT, kvpb.WALCommand_OP_MERGE:
+		return wal.Key, exists(wal.Key)
+	case kvpb.WALCommand_OP_RENAME:
+		if exists(wal.Key) {
+			return wal.Key, true
+		}
+		return wal.NewKey, exists(wal.NewKey)
+	case kvpb.WALCommand_OP_INGEST:
+		for _, p := range wal.Ingest {
+			if exists(p.Key) {
+				return p.Key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// writeOnceUnder returns the prefix of prefixes that key is under, or "".
+func writeOnceUnder(prefixes []string, key string) string {
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// checkWriteOnceLocked refuses a stamped write that would change an
+// existing write-once key.
+func (s *kvServer) checkWriteOnceLocked(wal *kvpb.WALCommand) error {
+	key, ok := s.writeOnceConflictLocked(wal)
+	if !ok {
+		return nil
+	}
+	return reasonError(codes.FailedPrecondition, reasonWriteOnce, map[string]string{"key": s.redact.key(key)},
+		"key %q already exists and is write-once (under %q): it cannot be changed or deleted",
+		s.redact.key(key), writeOnceUnder(wal.WriteOncePrefixes, key))
+}
+
+// applyError is the error for a write refused as it applied, because of its
+// key's type or because it would have changed a write-once key.
+func (m cachedMutation) applyError(redact redaction) error {
+	if m.writeOnceKey != "" {
+		return reasonError(codes.FailedPrecondition, reasonWriteOnce, map[string]string{"key": redact.key(m.writeOnceKey)},
+			"key %q is write-once and already existed when this write applied: it cannot be changed or deleted", redact.key(m.writeOnceKey))
+	}
+	return m.typeError(redact)
+}
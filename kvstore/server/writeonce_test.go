@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kvpb "madkv/kvstore/gen/kvpb"
+)
+
+func TestWriteOnceKeys(t *testing.T) {
+	srv := newTestServer(t, t.TempDir(), 0, 0, 1, 1)
+	becomeTestLeader(t, srv, 1)
+	srv.writeOnce = []string{"audit/"}
+	call := func(reqID string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDMetadataKey, reqID))
+	}
+	refused := func(what string, err error) {
+		t.Helper()
+		if status.Code(err) != codes.FailedPrecondition || errorReason(err) != reasonWriteOnce {
+			t.Fatalf("%s: err = %v, want FailedPrecondition %s", what, err, reasonWriteOnce)
+		}
+	}
+
+	if _, err := srv.Put(call("create"), &kvpb.PutRequest{Key: "audit/1", Value: "login"}); err != nil {
+		t.Fatalf("Put creating a write-once key: %v", err)
+	}
+	_, err := srv.Put(call("overwrite"), &kvpb.PutRequest{Key: "audit/1", Value: "nothing happened"})
+	refused("Put over a write-once key", err)
+	_, err = srv.Swap(call("swap"), &kvpb.SwapRequest{Key: "audit/1", Value: "x"})
+	refused("Swap of a write-once key", err)
+	_, err = srv.Delete(call("delete"), &kvpb.DeleteRequest{Key: "audit/1"})
+	refused("Delete of a write-once key", err)
+	if _, err := srv.Put(call("other"), &kvpb.PutRequest{Key: "notes/1", Value: "a"}); err != nil {
+		t.Fatalf("Put outside the prefix: %v", err)
+	}
+	if _, err := srv.Put(call("other-again"), &kvpb.PutRequest{Key: "notes/1", Value: "b"}); err != nil {
+		t.Fatalf("second Put outside the prefix: %v", err)
+	}
+
+	// A logged write that raced another creating the same key is refused as
+	// it applies, by the prefixes stamped into it rather than the flag.
+	srv.writeOnce = nil
+	srv.mu.Lock()
+	seq := srv.commitIndex + 1
+	res := srv.applyWALLocked(&kvpb.WALCommand{Op: kvpb.WALCommand_OP_PUT, Key: "audit/1", Value: "late", WriteOncePrefixes: []string{"audit/"}}, seq)
+	kept, _ := srv.getLiveLocked("audit/1")
+	srv.mu.Unlock()
+	refused("applying a stamped Put over a write-once key", res.applyError(redaction{}))
+	if kept.value != "login" {
+		t.Fatalf("write-once key = %q after a refused apply, want %q", kept.value, "login")
+	}
+}
@@ -0,0 +1,282 @@
+// Package testharness builds the real manager, server, and client binaries
+// and runs them as separate processes, so end-to-end behavior (crashes,
+// restarts, leader failover) can be asserted from Go tests. The tests using it
+// are behind the "integration" build tag:
+//
+//	go test -tags=integration ./testharness
+package testharness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Binaries holds the paths of freshly built executables.
+type Binaries struct {
+	Manager string
+	Server  string
+	Client  string
+}
+
+// Build compiles the manager, server, and client into a temporary directory
+// that is removed when the test finishes.
+func Build(t testing.TB) Binaries {
+	t.Helper()
+	root, err := moduleRoot()
+	if err != nil {
+		t.Fatalf("locate module root: %v", err)
+	}
+	out := t.TempDir()
+	bins := Binaries{
+		Manager: filepath.Join(out, "manager"),
+		Server:  filepath.Join(out, "server"),
+		Client:  filepath.Join(out, "client"),
+	}
+	for pkg, dst := range map[string]string{"./manager": bins.Manager, "./server": bins.Server, "./client": bins.Client} {
+		cmd := exec.Command("go", "build", "-o", dst, pkg)
+		cmd.Dir = root
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go build %s failed: %v\n%s", pkg, err, output)
+		}
+	}
+	return bins
+}
+
+func moduleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no go.mod above working directory")
+		}
+		dir = parent
+	}
+}
+
+// FreeAddr reserves an ephemeral loopback port and returns it as ip:port.
+func FreeAddr(t testing.TB) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve port: %v", err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+	return addr
+}
+
+type process struct {
+	cmd     *exec.Cmd
+	logPath string
+	done    chan struct{}
+}
+
+func (p *process) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Cluster is one manager plus a single partition of serverRF server replicas.
+type Cluster struct {
+	t       testing.TB
+	bins    Binaries
+	dir     string
+	Manager string
+	APIs    []string
+	P2Ps    []string
+
+	mu      sync.Mutex
+	manager *process
+	servers []*process
+}
+
+// NewCluster reserves addresses for a manager and serverRF replicas and
+// starts all of them. Every process is killed when the test finishes.
+func NewCluster(t testing.TB, bins Binaries, serverRF int) *Cluster {
+	t.Helper()
+	c := &Cluster{
+		t:       t,
+		bins:    bins,
+		dir:     t.TempDir(),
+		Manager: FreeAddr(t),
+		servers: make([]*process, serverRF),
+	}
+	for i := 0; i < serverRF; i++ {
+		c.APIs = append(c.APIs, FreeAddr(t))
+		c.P2Ps = append(c.P2Ps, FreeAddr(t))
+	}
+	t.Cleanup(c.Stop)
+
+	c.manager = c.spawn("manager.log", bins.Manager,
+		"--man_listen", c.Manager,
+		"--server_rf", strconv.Itoa(serverRF),
+		"--server_addrs", strings.Join(c.APIs, ","),
+	)
+	for i := range c.servers {
+		c.StartServer(i)
+	}
+	return c
+}
+
+func (c *Cluster) spawn(logName, bin string, args ...string) *process {
+	c.t.Helper()
+	logPath := filepath.Join(c.dir, logName)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		c.t.Fatalf("open %s: %v", logPath, err)
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		_ = logFile.Close()
+		c.t.Fatalf("start %s: %v", bin, err)
+	}
+	p := &process{cmd: cmd, logPath: logPath, done: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		_ = logFile.Close()
+		close(p.done)
+	}()
+	return p
+}
+
+// StartServer launches replica i, reusing its backer directory so a restart
+// recovers the state it had when it was killed.
+func (c *Cluster) StartServer(i int) {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.servers[i] != nil && c.servers[i].running() {
+		c.t.Fatalf("server %d is already running", i)
+	}
+	peers := make([]string, 0, len(c.P2Ps)-1)
+	for j, addr := range c.P2Ps {
+		if j != i {
+			peers = append(peers, addr)
+		}
+	}
+	peerArg := strings.Join(peers, ",")
+	if peerArg == "" {
+		peerArg = "none"
+	}
+	c.servers[i] = c.spawn(fmt.Sprintf("server%d.log", i), c.bins.Server,
+		"--partition_id", "0",
+		"--replica_id", strconv.Itoa(i),
+		"--manager_addrs", c.Manager,
+		"--api_listen", c.APIs[i],
+		"--p2p_listen", c.P2Ps[i],
+		"--peer_addrs", peerArg,
+		"--backer_path", filepath.Join(c.dir, fmt.Sprintf("backer.s%d", i)),
+	)
+}
+
+// KillServer SIGKILLs replica i and waits for it to exit.
+func (c *Cluster) KillServer(i int) {
+	c.t.Helper()
+	c.mu.Lock()
+	p := c.servers[i]
+	c.mu.Unlock()
+	if p == nil || !p.running() {
+		return
+	}
+	_ = p.cmd.Process.Kill()
+	<-p.done
+}
+
+// RestartServer kills replica i and starts it again on the same data.
+func (c *Cluster) RestartServer(i int) {
+	c.t.Helper()
+	c.KillServer(i)
+	c.StartServer(i)
+}
+
+// Stop kills every process in the cluster.
+func (c *Cluster) Stop() {
+	for i := range c.servers {
+		c.KillServer(i)
+	}
+	if c.manager != nil && c.manager.running() {
+		_ = c.manager.cmd.Process.Kill()
+		<-c.manager.done
+	}
+}
+
+var becameLeaderRE = regexp.MustCompile(`replica (\d+) became leader for term (\d+)`)
+
+// WaitForLeader polls the running servers' logs until one reports winning an
+// election, and returns the replica with the highest announced term.
+func (c *Cluster) WaitForLeader(timeout time.Duration) int {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		leader, bestTerm := -1, -1
+		c.mu.Lock()
+		for i, p := range c.servers {
+			if p == nil || !p.running() {
+				continue
+			}
+			raw, err := os.ReadFile(p.logPath)
+			if err != nil {
+				continue
+			}
+			for _, m := range becameLeaderRE.FindAllStringSubmatch(string(raw), -1) {
+				term, _ := strconv.Atoi(m[2])
+				if term > bestTerm {
+					leader, bestTerm = i, term
+				}
+			}
+		}
+		c.mu.Unlock()
+		if leader >= 0 {
+			return leader
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.t.Fatalf("no leader elected within %s", timeout)
+	return -1
+}
+
+// ServerLog returns everything replica i has logged so far.
+func (c *Cluster) ServerLog(i int) string {
+	raw, _ := os.ReadFile(filepath.Join(c.dir, fmt.Sprintf("server%d.log", i)))
+	return string(raw)
+}
+
+// Client runs the client binary in stdin mode with the given commands and
+// returns its stdout. STOP is appended automatically.
+func (c *Cluster) Client(timeout time.Duration, commands ...string) []string {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.bins.Client, "--manager_addrs", c.Manager)
+	cmd.Stdin = strings.NewReader(strings.Join(append(commands, "STOP"), "\n") + "\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		c.t.Fatalf("client failed: %v\nstdout:\n%s\nstderr:\n%s", err, stdout.String(), stderr.String())
+	}
+	return strings.Split(strings.TrimRight(stdout.String(), "\n"), "\n")
+}
@@ -0,0 +1,49 @@
+//go:build integration
+
+package testharness
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func expectLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		if !slices.Contains(got, line) {
+			t.Fatalf("client output missing %q; got:\n%v", line, got)
+		}
+	}
+}
+
+func TestReplicatedWritesSurviveLeaderCrash(t *testing.T) {
+	bins := Build(t)
+	c := NewCluster(t, bins, 3)
+	leader := c.WaitForLeader(15 * time.Second)
+
+	expectLines(t, c.Client(20*time.Second, "PUT alpha one", "GET alpha"),
+		"PUT alpha not_found", "GET alpha one")
+
+	c.KillServer(leader)
+	expectLines(t, c.Client(30*time.Second, "GET alpha", "SWAP alpha two", "GET alpha"),
+		"GET alpha one", "SWAP alpha one", "GET alpha two")
+}
+
+func TestFullClusterRestartRecoversState(t *testing.T) {
+	bins := Build(t)
+	c := NewCluster(t, bins, 3)
+	c.WaitForLeader(15 * time.Second)
+
+	expectLines(t, c.Client(20*time.Second, "PUT k1 v1", "PUT k2 v2", "DELETE k1"),
+		"PUT k1 not_found", "PUT k2 not_found", "DELETE k1 found")
+
+	for i := range c.APIs {
+		c.KillServer(i)
+	}
+	for i := range c.APIs {
+		c.StartServer(i)
+	}
+	expectLines(t, c.Client(30*time.Second, "GET k1", "GET k2", "SCAN k0 k9"),
+		"GET k1 null", "GET k2 v2", "  k2 v2", "SCAN END")
+}